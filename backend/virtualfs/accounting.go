@@ -0,0 +1,103 @@
+package virtualfs
+
+import (
+	"context"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/diskusage"
+)
+
+// dirUsage is the running totals of the files in a top level directory
+type dirUsage struct {
+	Dir          string `json:"dir"`
+	Files        int64  `json:"files"`
+	Bytes        int64  `json:"bytes"`
+	StoredBytes  int64  `json:"storedBytes"`
+	EvictedFiles int64  `json:"evictedFiles"`
+	EvictedBytes int64  `json:"evictedBytes"`
+	Deleted      int64  `json:"deleted"`
+}
+
+// add adds the totals of u to t
+func (t *dirUsage) add(u dirUsage) {
+	t.Files += u.Files
+	t.Bytes += u.Bytes
+	t.StoredBytes += u.StoredBytes
+	t.EvictedFiles += u.EvictedFiles
+	t.EvictedBytes += u.EvictedBytes
+	t.Deleted += u.Deleted
+}
+
+// usage returns the running totals of the whole catalog and of each top
+// level directory, in order, the files at the top being under
+// rootBookmark.
+//
+// The totals are kept by triggers on the files table so they are read
+// without scanning it. StoredBytes counts content shared by several
+// files once for each.
+func (f *Fs) usage(ctx context.Context) (total dirUsage, dirs []dirUsage, err error) {
+	rows, err := f.rdb.QueryContext(ctx, `SELECT dir, files, bytes, stored_bytes, evicted_files, evicted_bytes, deleted_files
+		FROM dir_totals WHERE files != 0 OR deleted_files != 0 ORDER BY dir`)
+	if err != nil {
+		return total, nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var u dirUsage
+		err = rows.Scan(&u.Dir, &u.Files, &u.Bytes, &u.StoredBytes, &u.EvictedFiles, &u.EvictedBytes, &u.Deleted)
+		if err != nil {
+			return total, nil, err
+		}
+		if u.Dir == "" {
+			u.Dir = rootBookmark
+		}
+		total.add(u)
+		dirs = append(dirs, u)
+	}
+	return total, dirs, rows.Err()
+}
+
+// About gets quota information from the Fs
+//
+// Used is the space the content takes in the root directories and
+// Free the free space of the disks holding them.
+func (f *Fs) About(ctx context.Context) (*fs.Usage, error) {
+	total, _, err := f.usage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	usage := &fs.Usage{
+		Used:    fs.NewUsageValue(total.StoredBytes),
+		Objects: fs.NewUsageValue(total.Files),
+	}
+	if free, ok := f.freeBytes(); ok {
+		usage.Free = fs.NewUsageValue(free)
+	}
+	return usage, nil
+}
+
+// freeBytes returns the free space of the disks holding the root
+// directories, or false if it can't be read
+func (f *Fs) freeBytes() (int64, bool) {
+	roots := f.localRoots()
+	if len(roots) == 0 {
+		return 0, false
+	}
+	var free int64
+	for _, root := range roots {
+		avail, err := freeSpace(root)
+		if err != nil {
+			if err != diskusage.ErrUnsupported {
+				fs.Debugf(nil, "VirtualFS: Can't read free space of %s: %v", root, err)
+			}
+			return 0, false
+		}
+		free += avail
+	}
+	return free, true
+}
+
+// Check the interfaces are satisfied
+var _ fs.Abouter = (*Fs)(nil)
@@ -0,0 +1,68 @@
+package virtualfs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// maxAnnotationSize is the largest annotation which may be recorded
+const maxAnnotationSize = 64 * 1024
+
+// annotationEntry is returned by the annotate command
+type annotationEntry struct {
+	Path       string          `json:"path"`
+	Annotation json.RawMessage `json:"annotation"`
+}
+
+// annotate records the JSON annotation against the file at the catalog
+// path remote, replacing any it had, or removes it if annotation is
+// null. It is kept when the file is ingested again.
+func (f *Fs) annotate(ctx context.Context, remote, annotation string) (*annotationEntry, error) {
+	if !json.Valid([]byte(annotation)) {
+		return nil, errors.New("annotation isn't valid JSON")
+	}
+	if len(annotation) > maxAnnotationSize {
+		return nil, fmt.Errorf("annotation is %d bytes, more than the %d allowed", len(annotation), maxAnnotationSize)
+	}
+	// Stored compacted so it is the same however it was written
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(annotation)); err != nil {
+		return nil, err
+	}
+	stored := compact.String()
+	if stored == "null" {
+		stored = ""
+	}
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE files SET annotation = ? WHERE remote = ? AND deleted = 0 AND is_dir = 0`, nullString(stored), remote)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("%s: file not found", remote)
+		}
+		return f.audit(ctx, tx, auditAnnotate, remote, stored)
+	})
+	f.objects.remove(remote)
+	if err != nil {
+		return nil, err
+	}
+	return &annotationEntry{Path: remote, Annotation: json.RawMessage(compact.Bytes())}, nil
+}
+
+// annotationJSON returns the stored annotation for JSON output, nil if
+// there isn't one
+func annotationJSON(annotation string) json.RawMessage {
+	if annotation == "" {
+		return nil
+	}
+	return json.RawMessage(annotation)
+}
@@ -0,0 +1,156 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/random"
+)
+
+// Operations recorded in the audit log
+const (
+	auditPut        = "put"
+	auditRemove     = "remove"
+	auditEvict      = "evict"
+	auditStatus     = "status"
+	auditPriority   = "priority"
+	auditQuarantine = "quarantine"
+	auditAnnotate   = "annotate"
+	auditTag        = "tag"
+	auditUntag      = "untag"
+	auditHold       = "hold"
+	auditErase      = "erase"
+	auditRewrite    = "rewrite"
+)
+
+// defaultAuditLimit is how many entries the audit command returns if
+// not told otherwise
+const defaultAuditLimit = 1000
+
+// auditor identifies this run of rclone in the audit log
+var auditor = struct {
+	user       string
+	host       string
+	invocation string
+}{
+	invocation: random.String(16),
+}
+
+func init() {
+	if u, err := user.Current(); err == nil {
+		auditor.user = u.Username
+	}
+	auditor.host, _ = os.Hostname()
+}
+
+// audit records op on remote in the audit log if audit_log is set
+func (f *Fs) audit(ctx context.Context, tx *sql.Tx, op, remote, detail string) error {
+	if !f.opt.AuditLog {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO audit (time, op, remote, detail, user, host, invocation) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		formatDBTime(time.Now()), op, remote, nullString(detail), nullString(auditor.user), nullString(auditor.host), auditor.invocation)
+	if err != nil {
+		return fmt.Errorf("failed to audit %s of %s: %w", op, remote, err)
+	}
+	return nil
+}
+
+// auditEntry is one entry returned by the audit command
+type auditEntry struct {
+	ID         int64  `json:"id"`
+	Time       string `json:"time"`
+	Op         string `json:"op"`
+	Path       string `json:"path"`
+	Detail     string `json:"detail,omitempty"`
+	User       string `json:"user,omitempty"`
+	Host       string `json:"host,omitempty"`
+	Invocation string `json:"invocation"`
+}
+
+// auditQuery selects what the audit command returns
+type auditQuery struct {
+	since      time.Time // entries at or after this, if set
+	remote     string    // entries for this file or below this directory, if set
+	op         string    // entries of this operation, if set
+	invocation string    // entries of this run of rclone, if set
+	limit      int
+}
+
+// auditLog returns the audit entries matching q, oldest first
+func (f *Fs) auditLog(ctx context.Context, q auditQuery) ([]auditEntry, error) {
+	query := `SELECT id, time, op, remote, detail, user, host, invocation FROM audit WHERE 1`
+	var args []interface{}
+	if !q.since.IsZero() {
+		query += ` AND time >= ?`
+		args = append(args, formatDBTime(q.since))
+	}
+	if q.remote != "" {
+		query += ` AND (remote = ? OR substr(remote, 1, ?) = ?)`
+		args = append(args, q.remote, len(q.remote)+1, q.remote+"/")
+	}
+	if q.op != "" {
+		query += ` AND op = ?`
+		args = append(args, q.op)
+	}
+	if q.invocation != "" {
+		query += ` AND invocation = ?`
+		args = append(args, q.invocation)
+	}
+	query += ` ORDER BY id LIMIT ?`
+	args = append(args, q.limit)
+
+	rows, err := f.rdb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	entries := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		var auditTime, detail, user, host sql.NullString
+		err = rows.Scan(&e.ID, &auditTime, &e.Op, &e.Path, &detail, &user, &host, &e.Invocation)
+		if err != nil {
+			return nil, err
+		}
+		e.Time = formatTime(parseNullTime(auditTime))
+		e.Detail, e.User, e.Host = detail.String, user.String, host.String
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// parseAuditQuery reads the options of the audit command
+func parseAuditQuery(arg []string, opt map[string]string) (q auditQuery, err error) {
+	q.limit = defaultAuditLimit
+	if len(arg) > 1 {
+		return q, errors.New("audit takes at most one path argument")
+	}
+	if len(arg) == 1 {
+		q.remote = arg[0]
+	}
+	if v, ok := opt["since"]; ok {
+		q.since, err = fs.ParseTime(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid since %q: %w", v, err)
+		}
+	}
+	if v, ok := opt["limit"]; ok {
+		q.limit, err = strconv.Atoi(v)
+		if err != nil || q.limit <= 0 {
+			return q, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	q.op = opt["op"]
+	q.invocation = opt["invocation"]
+	return q, nil
+}
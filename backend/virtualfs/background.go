@@ -0,0 +1,89 @@
+package virtualfs
+
+import (
+	"context"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// startBackground runs fn straight away and then every interval until
+// the Fs is shut down. If wake is not nil a send on it runs fn early.
+func (f *Fs) startBackground(name string, interval time.Duration, wake <-chan struct{}, fn func(ctx context.Context) error) {
+	f.bgWG.Add(1)
+	go func() {
+		defer f.bgWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			err := fn(f.bgCtx)
+			if err != nil && f.bgCtx.Err() == nil {
+				fs.Errorf(nil, "VirtualFS: Background %s failed: %v", name, err)
+			}
+			select {
+			case <-f.bgCtx.Done():
+				return
+			case <-ticker.C:
+			case <-wake:
+			}
+		}
+	}()
+}
+
+// maintenanceInterval returns how often to run a background task
+// working to the time limit every, which is maintenance_interval if set
+func (f *Fs) maintenanceInterval(every time.Duration) time.Duration {
+	if f.opt.MaintenanceInterval > 0 {
+		return time.Duration(f.opt.MaintenanceInterval)
+	}
+	return ttlInterval(every)
+}
+
+// gcOrphans removes content files not referenced by the catalog for
+// gc_interval, and forgets interrupted uploads kept for longer than
+// resume_partial
+func (f *Fs) gcOrphans(ctx context.Context) error {
+	err := f.expirePartials(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = f.gc(ctx, false, gcMinAge)
+	return err
+}
+
+// Shutdown logs a summary of what was done then stops the background
+// tasks, waiting for any in progress to finish, and backs up the
+// catalog a last time if catalog_backup is set
+func (f *Fs) Shutdown(ctx context.Context) error {
+	f.logSummary()
+	err := f.bookmarkTouched(ctx)
+	if err != nil {
+		fs.Errorf(nil, "VirtualFS: Failed to update bookmarks: %v", err)
+	}
+	f.bgCancel()
+	done := make(chan struct{})
+	go func() {
+		f.bgWG.Wait()
+		if f.deleteWake != nil {
+			// Finish removing the content of the files deleted
+			err := f.deleteAside(ctx)
+			if err != nil {
+				fs.Errorf(nil, "VirtualFS: Failed to remove content of deleted files: %v", err)
+			}
+		}
+		if f.opt.CatalogBackup != "" && !f.opt.ReadOnly {
+			// Catch the changes since the last background backup
+			err := f.backupCatalog(ctx)
+			if err != nil {
+				fs.Errorf(nil, "VirtualFS: Failed to back up catalog: %v", err)
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
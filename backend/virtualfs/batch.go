@@ -0,0 +1,99 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// batchRequest asks the batcher to run fn in the next transaction
+type batchRequest struct {
+	ctx  context.Context
+	fn   func(tx *sql.Tx) error
+	done chan error // receives the result once committed
+}
+
+// startBatcher starts grouping the transactions run by inTx so up to
+// batch_size are committed at once
+func (f *Fs) startBatcher() {
+	f.batch = make(chan batchRequest)
+	f.bgWG.Add(1)
+	go func() {
+		defer f.bgWG.Done()
+		for {
+			var reqs []batchRequest
+			select {
+			case <-f.bgCtx.Done():
+				return
+			case req := <-f.batch:
+				reqs = append(reqs, req)
+			}
+			// Wait a little for others to share the commit
+			timer := time.NewTimer(time.Duration(f.opt.BatchTimeout))
+		collect:
+			for len(reqs) < f.opt.BatchSize {
+				select {
+				case req := <-f.batch:
+					reqs = append(reqs, req)
+				case <-timer.C:
+					break collect
+				}
+			}
+			timer.Stop()
+			f.commitBatch(reqs)
+		}
+	}()
+}
+
+// commitBatch runs each of reqs in its own savepoint of a single
+// transaction, so one failing doesn't undo the others, then commits
+// them all and tells each how it went
+//
+// The whole batch is run again if the catalog is busy.
+func (f *Fs) commitBatch(reqs []batchRequest) {
+	errs := make([]error, len(reqs))
+	err := f.retryBusy(f.bgCtx, func() error {
+		for i := range errs {
+			errs[i] = nil
+		}
+		tx, err := f.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() {
+			_ = tx.Rollback()
+		}()
+		for i, req := range reqs {
+			if errs[i] = req.ctx.Err(); errs[i] != nil {
+				continue
+			}
+			_, err = tx.Exec(`SAVEPOINT batch`)
+			if err != nil {
+				return err
+			}
+			errs[i] = req.fn(tx)
+			if errs[i] != nil {
+				_, err = tx.Exec(`ROLLBACK TO batch`)
+				if err != nil {
+					return err
+				}
+			}
+			_, err = tx.Exec(`RELEASE batch`)
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return nil
+	})
+	for i, req := range reqs {
+		if err != nil && errs[i] == nil {
+			errs[i] = err
+		}
+		req.done <- errs[i]
+	}
+}
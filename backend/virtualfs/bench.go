@@ -0,0 +1,227 @@
+package virtualfs
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/file"
+)
+
+// Defaults of the bench command
+const (
+	defaultBenchFiles = 1000
+	defaultBenchSize  = fs.SizeSuffix(64 << 20)
+)
+
+// benchPragmas are the pragmas reported by the bench command, as they
+// are what most changes how fast the catalog is
+var benchPragmas = []string{"journal_mode", "synchronous", "cache_size", "mmap_size", "busy_timeout"}
+
+// benchResult is returned by the bench command
+type benchResult struct {
+	Driver  string            `json:"driver"`  // the SQLite library and its version
+	Pragmas map[string]string `json:"pragmas"` // as set on connections to the catalog
+	Catalog benchCatalog      `json:"catalog"`
+	List    benchList         `json:"list"`
+	Writes  []benchWrite      `json:"writes"`
+}
+
+// benchCatalog is how fast a scratch catalog set up like the real one
+// takes new files, each committed on its own as Put does, and finds them
+type benchCatalog struct {
+	Path             string  `json:"path"`  // where the scratch catalog was made
+	Files            int     `json:"files"` // how many were inserted and looked up
+	InsertsPerSecond float64 `json:"inserts_per_second"`
+	LookupsPerSecond float64 `json:"lookups_per_second"`
+}
+
+// benchList is how long listing a directory of the remote took
+type benchList struct {
+	Dir       string  `json:"dir"`
+	Entries   int     `json:"entries"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// benchWrite is how fast content was written to a staging directory
+type benchWrite struct {
+	Path           string  `json:"path"`
+	Bytes          int64   `json:"bytes"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+// bench measures how fast the catalog takes and finds files, how long
+// dir takes to list and how fast content is written to each root
+// directory, with the current options.
+//
+// The catalog measured is a scratch copy of its schema next to the real
+// one, so the real one gets nothing added to it or its history, and
+// content is written to the staging directories and removed again.
+func (f *Fs) bench(ctx context.Context, dir string, files int, size fs.SizeSuffix) (res *benchResult, err error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	var version string
+	err = f.rdb.QueryRowContext(ctx, `SELECT sqlite_version()`).Scan(&version)
+	if err != nil {
+		return nil, err
+	}
+	res = &benchResult{Driver: "sqlite3 " + version, Pragmas: map[string]string{}, Writes: []benchWrite{}}
+	res.Catalog, err = f.benchCatalog(ctx, files, res.Pragmas)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	entries, err := f.List(ctx, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %q: %w", dir, err)
+	}
+	res.List = benchList{Dir: dir, Entries: len(entries), LatencyMs: float64(time.Since(start)) / float64(time.Millisecond)}
+
+	var stagings []string
+	for _, root := range f.localRoots() {
+		stagings = append(stagings, filepath.Join(root, stagingDir))
+	}
+	if store, ok := f.baseStore().(*remoteStore); ok {
+		stagings = append(stagings, store.staging)
+	}
+	for _, staging := range stagings {
+		w, err := f.benchWrite(ctx, staging, int64(size))
+		if err != nil {
+			return nil, fmt.Errorf("failed to write to %s: %w", staging, err)
+		}
+		res.Writes = append(res.Writes, w)
+	}
+	return res, nil
+}
+
+// benchCatalog inserts files rows into a scratch catalog and looks each
+// up again, filling in pragmas with the settings it was made with
+func (f *Fs) benchCatalog(ctx context.Context, files int, pragmas map[string]string) (res benchCatalog, err error) {
+	// Named like the catalog so it is never taken for content
+	dbDir, err := os.MkdirTemp(filepath.Dir(f.dbFile), dbName+"-bench-*")
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		_ = os.RemoveAll(dbDir)
+	}()
+	scratch := &Fs{opt: f.opt, pragmas: f.pragmas}
+	scratch.opt.ReadOnly = false
+	scratch.dbFile = filepath.Join(dbDir, dbName)
+	res = benchCatalog{Path: scratch.dbFile, Files: files}
+	scratch.db, err = scratch.openDB(scratch.dbFile, false)
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		_ = scratch.db.Close()
+	}()
+	scratch.db.SetMaxOpenConns(1)
+	err = scratch.createTables()
+	if err != nil {
+		return res, fmt.Errorf("failed to create scratch catalog: %w", err)
+	}
+	scratch.rdb, err = scratch.openDB(scratch.dbFile, true)
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		_ = scratch.rdb.Close()
+	}()
+	for _, name := range benchPragmas {
+		var value string
+		err = scratch.db.QueryRowContext(ctx, `PRAGMA `+name).Scan(&value)
+		if err != nil {
+			return res, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		pragmas[name] = value
+	}
+
+	remotes := make([]string, files)
+	modTime := time.Now().UnixNano()
+	start := time.Now()
+	for i := range remotes {
+		remotes[i] = path.Join("bench", strconv.Itoa(i/1000), strconv.Itoa(i))
+		err = scratch.inTx(ctx, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `INSERT INTO files (remote, size, mod_time_ns, has_hash, hash, deleted, is_dir, parent, key) VALUES (?, ?, ?, 0, '', 0, 0, ?, ?)`,
+				remotes[i], i, modTime, path.Dir(remotes[i]), remotes[i])
+			return err
+		})
+		if err != nil {
+			return res, fmt.Errorf("failed to insert into scratch catalog: %w", err)
+		}
+	}
+	res.InsertsPerSecond = perSecond(float64(files), time.Since(start))
+
+	start = time.Now()
+	for _, remote := range remotes {
+		var size int64
+		err = scratch.rdb.QueryRowContext(ctx, `SELECT size FROM files WHERE remote = ?`, remote).Scan(&size)
+		if err != nil {
+			return res, fmt.Errorf("failed to look up %s in scratch catalog: %w", remote, err)
+		}
+	}
+	res.LookupsPerSecond = perSecond(float64(files), time.Since(start))
+	return res, nil
+}
+
+// benchWrite writes size bytes to a temporary file in staging, as
+// content is written, and removes it again
+func (f *Fs) benchWrite(ctx context.Context, staging string, size int64) (res benchWrite, err error) {
+	err = file.MkdirAll(staging, 0755)
+	if err != nil {
+		return res, err
+	}
+	out, err := os.CreateTemp(staging, incomingPrefix+"bench-*")
+	if err != nil {
+		return res, err
+	}
+	res = benchWrite{Path: staging, Bytes: size}
+	defer func() {
+		_ = out.Close()
+		_ = os.Remove(out.Name())
+	}()
+	buf := f.buffers.Get().(*[]byte)
+	defer f.buffers.Put(buf)
+	_, err = rand.Read(*buf)
+	if err != nil {
+		return res, err
+	}
+	start := time.Now()
+	for written := int64(0); written < size; {
+		if err = ctx.Err(); err != nil {
+			return res, err
+		}
+		n := min(int64(len(*buf)), size-written)
+		_, err = out.Write((*buf)[:n])
+		if err != nil {
+			return res, err
+		}
+		written += n
+	}
+	if f.opt.DurableWrites {
+		err = out.Sync()
+		if err != nil {
+			return res, err
+		}
+	}
+	res.BytesPerSecond = perSecond(float64(size), time.Since(start))
+	return res, nil
+}
+
+// perSecond returns how many of n were done each second in elapsed
+func perSecond(n float64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return n / elapsed.Seconds()
+}
@@ -0,0 +1,178 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+)
+
+// rootBookmark is the name of the bookmark for files at the top level
+const rootBookmark = "/"
+
+// bookmarkDir returns the name of the bookmark covering remote, which
+// is its top level directory
+func bookmarkDir(remote string) string {
+	dir, _, found := strings.Cut(remote, "/")
+	if !found {
+		return rootBookmark
+	}
+	return dir
+}
+
+// touchBookmark notes that remote was changed so its bookmark is updated when
+// the Fs shuts down
+func (f *Fs) touchBookmark(remote string) {
+	f.touchedMu.Lock()
+	defer f.touchedMu.Unlock()
+	if f.touched == nil {
+		f.touched = map[string]struct{}{}
+	}
+	f.touched[bookmarkDir(remote)] = struct{}{}
+}
+
+// bookmarkTouched bookmarks the directories changed since the Fs was
+// created, as long as no errors were counted, as that means the sync
+// into them completed
+func (f *Fs) bookmarkTouched(ctx context.Context) error {
+	f.touchedMu.Lock()
+	dirs := make([]string, 0, len(f.touched))
+	for dir := range f.touched {
+		dirs = append(dirs, dir)
+	}
+	f.touched = nil
+	f.touchedMu.Unlock()
+	if len(dirs) == 0 {
+		return nil
+	}
+	if errs := accounting.GlobalStats().GetErrors(); errs > 0 {
+		fs.Infof(nil, "VirtualFS: Not updating bookmarks after %d errors", errs)
+		return nil
+	}
+	_, err := f.bookmark(ctx, dirs)
+	return err
+}
+
+// bookmarkEntry describes the last sync into a directory
+type bookmarkEntry struct {
+	Dir  string `json:"dir"`
+	Time string `json:"time"`
+	Seq  int64  `json:"seq"` // last journal sequence number at the time
+}
+
+// bookmark records that a sync into each of dirs has just completed,
+// returning the new bookmarks
+func (f *Fs) bookmark(ctx context.Context, dirs []string) ([]bookmarkEntry, error) {
+	now := time.Now()
+	var entries []bookmarkEntry
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		var seq int64
+		err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM journal`).Scan(&seq)
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			dir = strings.Trim(dir, "/")
+			if dir == "" {
+				dir = rootBookmark
+			}
+			_, err = tx.ExecContext(ctx, `INSERT INTO bookmarks (dir, time, seq) VALUES (?, ?, ?) ON CONFLICT(dir) DO UPDATE SET time = excluded.time, seq = excluded.seq`,
+				dir, formatDBTime(now), seq)
+			if err != nil {
+				return fmt.Errorf("failed to bookmark %s: %w", dir, err)
+			}
+			entries = append(entries, bookmarkEntry{Dir: dir, Time: formatTime(now.UTC().Truncate(time.Second)), Seq: seq})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fs.Infof(nil, "VirtualFS: Bookmarked %d directories", len(entries))
+	return entries, nil
+}
+
+// bookmarks returns all the bookmarks sorted by directory
+func (f *Fs) bookmarks(ctx context.Context) ([]bookmarkEntry, error) {
+	rows, err := f.rdb.QueryContext(ctx, `SELECT dir, time, seq FROM bookmarks`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	entries := []bookmarkEntry{}
+	for rows.Next() {
+		var e bookmarkEntry
+		var bookmarkTime sql.NullString
+		err = rows.Scan(&e.Dir, &bookmarkTime, &e.Seq)
+		if err != nil {
+			return nil, err
+		}
+		e.Time = formatTime(parseNullTime(bookmarkTime))
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Dir < entries[j].Dir
+	})
+	return entries, rows.Err()
+}
+
+// bookmarkSeq returns the journal sequence number of the bookmark of dir
+func (f *Fs) bookmarkSeq(ctx context.Context, dir string) (int64, error) {
+	dir = strings.Trim(dir, "/")
+	if dir == "" {
+		dir = rootBookmark
+	}
+
+	var seq int64
+	err := f.rdb.QueryRowContext(ctx, `SELECT seq FROM bookmarks WHERE dir = ?`, dir).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("no bookmark for %q", dir)
+	}
+	return seq, err
+}
+
+// statsResult is returned by the stats command
+type statsResult struct {
+	Files        int64           `json:"files"`
+	Deleted      int64           `json:"deleted"`
+	Bytes        int64           `json:"bytes"`
+	StoredBytes  int64           `json:"storedBytes"`
+	EvictedFiles int64           `json:"evictedFiles"`
+	EvictedBytes int64           `json:"evictedBytes"`
+	LastSeq      int64           `json:"lastSeq"`
+	Dirs         []dirUsage      `json:"dirs"`
+	Bookmarks    []bookmarkEntry `json:"bookmarks"`
+}
+
+// stats returns a summary of the catalog
+func (f *Fs) stats(ctx context.Context) (*statsResult, error) {
+	total, dirs, err := f.usage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := &statsResult{
+		Files:        total.Files,
+		Deleted:      total.Deleted,
+		Bytes:        total.Bytes,
+		StoredBytes:  total.StoredBytes,
+		EvictedFiles: total.EvictedFiles,
+		EvictedBytes: total.EvictedBytes,
+		Dirs:         dirs,
+	}
+	err = f.rdb.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM journal`).Scan(&res.LastSeq)
+	if err != nil {
+		return nil, err
+	}
+	res.Bookmarks, err = f.bookmarks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,28 @@
+package virtualfs
+
+import (
+	"io"
+	"sync"
+)
+
+// newBufferPool makes the pool of copy_buffer_size buffers content is
+// copied with
+func (f *Fs) newBufferPool() {
+	size := int(f.opt.CopyBufferSize)
+	f.buffers = &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		},
+	}
+}
+
+// copyContent copies in to out through a buffer from the pool,
+// returning the number of bytes copied
+func (f *Fs) copyContent(out io.Writer, in io.Reader) (int64, error) {
+	buf := f.buffers.Get().(*[]byte)
+	defer f.buffers.Put(buf)
+	// Hide any ReadFrom of out, such as that of *os.File, so the
+	// buffer is always used rather than a small one of its own
+	return io.CopyBuffer(struct{ io.Writer }{out}, in, *buf)
+}
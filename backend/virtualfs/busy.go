@@ -0,0 +1,66 @@
+package virtualfs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+const (
+	busyBackoff    = 100 * time.Millisecond // first wait before trying again, doubling each time
+	busyMaxBackoff = 5 * time.Second        // longest wait between tries
+)
+
+// dbDSN returns the data source name the catalog at dbPath is opened
+// with, so it can be shared with other processes.
+//
+// The write ahead log lets readers carry on while another process
+// writes, and immediate transactions take the write lock when they
+// begin, where SQLite can wait busy_timeout for it, rather than when
+// they first write, where it can't.
+//
+// If read_only is set, or the connections are for reader, SQLite
+// refuses to change the catalog.
+func dbDSN(dbPath string, opt *Options, reader bool) string {
+	dsn := fmt.Sprintf("%s?_busy_timeout=%d&_journal_mode=WAL&_txlock=immediate", dbPath, time.Duration(opt.BusyTimeout).Milliseconds())
+	if opt.ReadOnly || reader {
+		dsn += "&_query_only=1"
+	}
+	if opt.DurableWrites {
+		dsn += "&_synchronous=FULL"
+	}
+	return dsn
+}
+
+// retryBusy runs fn, running it again with backoff while it fails
+// because the catalog is busy for longer than busy_timeout, until it
+// has been busy for locked_timeout
+func (f *Fs) retryBusy(ctx context.Context, fn func() error) (err error) {
+	sleep := busyBackoff
+	var start time.Time
+	for {
+		err = fn()
+		if !isBusy(err) {
+			return err
+		}
+		if start.IsZero() {
+			start = time.Now()
+		}
+		waited := time.Since(start)
+		if waited >= time.Duration(f.opt.LockedTimeout) {
+			if f.opt.LockedTimeout > 0 {
+				fs.Errorf(nil, "VirtualFS: Catalog locked by another process for %v, giving up", waited.Truncate(time.Millisecond))
+			}
+			return fmt.Errorf("catalog locked by another process for longer than locked_timeout %v: %w", f.opt.LockedTimeout, err)
+		}
+		fs.Debugf(nil, "VirtualFS: Catalog busy, trying again in %v: %v", sleep, err)
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		sleep = min(2*sleep, busyMaxBackoff)
+	}
+}
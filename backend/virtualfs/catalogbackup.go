@@ -0,0 +1,103 @@
+package virtualfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// catalogChanged returns the last time the catalog database or its
+// write ahead log was written to
+func (f *Fs) catalogChanged() (time.Time, error) {
+	var changed time.Time
+	for _, p := range []string{f.dbFile, f.dbFile + "-wal"} {
+		info, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return changed, err
+		}
+		if info.ModTime().After(changed) {
+			changed = info.ModTime()
+		}
+	}
+	return changed, nil
+}
+
+// backupCatalog writes a snapshot of the catalog to catalog_backup if
+// it has changed since the newest one there, then removes all but the
+// newest catalog_backup_keep snapshots
+func (f *Fs) backupCatalog(ctx context.Context) error {
+	dst, err := cache.Get(ctx, f.opt.CatalogBackup)
+	if err != nil && err != fs.ErrorIsFile {
+		return fmt.Errorf("failed to open catalog_backup: %w", err)
+	}
+	names, err := listSnapshots(ctx, dst)
+	if err != nil {
+		return err
+	}
+	changed, err := f.catalogChanged()
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		newest, err := snapshotTime(names[len(names)-1])
+		if err == nil && !newest.Before(changed) {
+			return nil
+		}
+	}
+	dir := f.opt.CatalogBackup
+	if !strings.HasSuffix(dir, "/") && !strings.HasSuffix(dir, ":") {
+		dir += "/"
+	}
+	name := snapshotName(time.Now())
+	_, err = f.snapshot(ctx, dir+name)
+	if err != nil {
+		return err
+	}
+	names = append(names, name)
+	for len(names) > f.opt.CatalogBackupKeep {
+		o, err := dst.NewObject(ctx, names[0])
+		if err == nil {
+			err = operations.DeleteFile(ctx, o)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to remove old catalog backup %s: %w", names[0], err)
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// listSnapshots returns the names of the snapshots at the top of dst,
+// oldest first
+func listSnapshots(ctx context.Context, dst fs.Fs) ([]string, error) {
+	entries, err := dst.List(ctx, "")
+	if err == fs.ErrorDirNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list catalog_backup: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Remote()
+		if _, ok := entry.(fs.Object); ok && strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, snapshotSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// snapshotTime returns when the snapshot called name was taken
+func snapshotTime(name string) (time.Time, error) {
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix)
+	return time.Parse(snapshotLayout, stamp)
+}
@@ -0,0 +1,85 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// listChangedBookmark is the list_changed_since value which lists the
+// files changed since the bookmark of their top level directory
+const listChangedBookmark = "bookmark"
+
+// changedSince is the parsed list_changed_since option
+type changedSince struct {
+	seq      int64     // journal sequence number to list the changes after, if set
+	time     time.Time // time to list the changes from, if set
+	bookmark bool      // set to use the bookmark of the directory listed
+}
+
+// parseChangedSince parses the list_changed_since option, returning nil
+// if it isn't set
+func parseChangedSince(since string) (*changedSince, error) {
+	if since == "" {
+		return nil, nil
+	}
+	if since == listChangedBookmark {
+		return &changedSince{bookmark: true}, nil
+	}
+	if seq, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return &changedSince{seq: seq}, nil
+	}
+	t, err := fs.ParseTime(since)
+	if err != nil {
+		return nil, fmt.Errorf("invalid list_changed_since %q: need a sequence number, a time or %q", since, listChangedBookmark)
+	}
+	return &changedSince{time: t}, nil
+}
+
+// changedIn returns the files in dir, or further down, which have been
+// ingested or modified since list_changed_since, or nil if everything
+// is listed
+func (f *Fs) changedIn(ctx context.Context, dir string) (map[string]struct{}, error) {
+	since := f.changedSince
+	if since == nil {
+		return nil, nil
+	}
+	cond, dirArgs := inDir(dir)
+	query := `SELECT DISTINCT remote FROM journal WHERE ` + cond
+	args := append([]interface{}{}, dirArgs...)
+	switch {
+	case since.bookmark:
+		var seq int64
+		err := f.rdb.QueryRowContext(ctx, `SELECT seq FROM bookmarks WHERE dir = ?`, bookmarkDir(dir)).Scan(&seq)
+		if err == sql.ErrNoRows {
+			// Nothing has been bookmarked yet so everything is new
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		query += ` AND seq > ?`
+		args = append(args, seq)
+	case since.time.IsZero():
+		query += ` AND seq > ?`
+		args = append(args, since.seq)
+	default:
+		// Modification times set since aren't journalled
+		query += ` AND time >= ? UNION SELECT remote FROM files WHERE ` + cond + ` AND mod_time_ns >= ?`
+		args = append(args, formatDBTime(since.time))
+		args = append(args, dirArgs...)
+		args = append(args, since.time.UnixNano())
+	}
+	remotes, err := f.queryRemotes(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find changes since %s: %w", f.opt.ListChangedSince, err)
+	}
+	changed := make(map[string]struct{}, len(remotes))
+	for _, remote := range remotes {
+		changed[remote] = struct{}{}
+	}
+	return changed, nil
+}
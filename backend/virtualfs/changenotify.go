@@ -0,0 +1,119 @@
+package virtualfs
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// changeNotifyBatch is the most changes read from history at once
+const changeNotifyBatch = 1000
+
+// ChangeNotify calls notifyFunc for each file and directory changed in
+// the catalog, by this or any other process sharing it, checking the
+// history every poll interval read from pollIntervalChan.
+//
+// Changes are looked for from the end of the history when it is
+// called. The poll interval can be changed at any time and polling
+// stops when pollIntervalChan is closed.
+func (f *Fs) ChangeNotify(ctx context.Context, notifyFunc func(string, fs.EntryType), pollIntervalChan <-chan time.Duration) {
+	go func() {
+		generation, err := f.lastGeneration(ctx)
+		if err != nil {
+			fs.Errorf(f, "VirtualFS: Failed to read the history: %v", err)
+		}
+		var ticker *time.Ticker
+		var tickerC <-chan time.Time
+		for {
+			select {
+			case pollInterval, ok := <-pollIntervalChan:
+				if ticker != nil {
+					ticker.Stop()
+					ticker, tickerC = nil, nil
+				}
+				if !ok {
+					return
+				}
+				if pollInterval > 0 {
+					ticker = time.NewTicker(pollInterval)
+					tickerC = ticker.C
+				}
+			case <-tickerC:
+				if f.opt.At.IsSet() {
+					// The catalog as it was then doesn't change
+					continue
+				}
+				generation, err = f.pollChanges(ctx, generation, notifyFunc)
+				if err != nil {
+					fs.Errorf(f, "VirtualFS: Failed to poll for changes: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// lastGeneration returns the generation of the last change in history
+func (f *Fs) lastGeneration(ctx context.Context) (generation int64, err error) {
+	err = f.rdb.QueryRowContext(ctx, `SELECT COALESCE(MAX(generation), 0) FROM history`).Scan(&generation)
+	return generation, err
+}
+
+// historyChange is a change read from history by pollChanges
+type historyChange struct {
+	remote string
+	isDir  bool
+}
+
+// readChanges returns up to changeNotifyBatch changes after generation
+// and the generation of the last
+func (f *Fs) readChanges(ctx context.Context, generation int64) ([]historyChange, int64, error) {
+	rows, err := f.rdb.QueryContext(ctx, `SELECT generation, remote, is_dir FROM history WHERE generation > ? ORDER BY generation LIMIT ?`, generation, changeNotifyBatch)
+	if err != nil {
+		return nil, generation, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var changes []historyChange
+	for rows.Next() {
+		var c historyChange
+		err = rows.Scan(&generation, &c.remote, &c.isDir)
+		if err != nil {
+			return nil, generation, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, generation, rows.Err()
+}
+
+// pollChanges calls notifyFunc for each change after generation which
+// is under the root, dropping the changed files from the object cache,
+// and returns the generation to carry on from
+func (f *Fs) pollChanges(ctx context.Context, generation int64, notifyFunc func(string, fs.EntryType)) (int64, error) {
+	for {
+		changes, last, err := f.readChanges(ctx, generation)
+		if err != nil {
+			return generation, err
+		}
+		for _, c := range changes {
+			f.objects.remove(c.remote)
+			if f.root != "" && !strings.HasPrefix(c.remote, f.root+"/") {
+				continue
+			}
+			entryType := fs.EntryObject
+			if c.isDir {
+				entryType = fs.EntryDirectory
+			}
+			notifyFunc(f.relPath(c.remote), entryType)
+		}
+		generation = last
+		if len(changes) < changeNotifyBatch {
+			return generation, nil
+		}
+	}
+}
+
+// Check the interfaces are satisfied
+var _ fs.ChangeNotifier = (*Fs)(nil)
@@ -0,0 +1,104 @@
+package virtualfs
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Values for the startup_check option
+const (
+	startupCheckOff   = "off"
+	startupCheckQuick = "quick"
+	startupCheckFull  = "full"
+)
+
+// checkResult is what the startup check found
+type checkResult struct {
+	rows    int      // content files the catalog refers to
+	files   int      // content files found
+	missing []string // files whose content is missing
+	orphans []string // content files nothing refers to, only if full
+}
+
+// checkContent compares the content files the catalog refers to with
+// those in the content store. The content of every live file which
+// hasn't been evicted should be there.
+//
+// If full is set each content file the catalog doesn't expect is looked
+// up as the gc command does to find the orphans. Otherwise they are
+// taken to be placeholders and not counted.
+func (f *Fs) checkContent(ctx context.Context, full bool) (*checkResult, error) {
+	objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE deleted = 0 AND is_dir = 0 AND evicted = 0`)
+	if err != nil {
+		return nil, err
+	}
+	want := make(map[string]string, len(objects))
+	for _, o := range objects {
+		if !o.chunked() {
+			want[o.contentKey()] = o.remote
+			continue
+		}
+		keys, err := o.chunkKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			want[key] = o.remote
+		}
+	}
+	res := &checkResult{rows: len(want)}
+	err = f.store.walk(ctx, func(rel string, _ time.Time) error {
+		if _, ok := want[rel]; ok {
+			delete(want, rel)
+			res.files++
+			return nil
+		}
+		if !full {
+			return nil
+		}
+		referenced, err := f.isReferenced(ctx, rel)
+		if err != nil {
+			return err
+		}
+		if !referenced {
+			res.orphans = append(res.orphans, f.displayKey(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, remote := range want {
+		res.missing = append(res.missing, remote)
+	}
+	sort.Strings(res.missing)
+	sort.Strings(res.orphans)
+	return res, nil
+}
+
+// startupCheck runs the check chosen by startup_check, logging what
+// it finds. Nothing is repaired.
+func (f *Fs) startupCheck(ctx context.Context) error {
+	full := f.opt.StartupCheck == startupCheckFull
+	res, err := f.checkContent(ctx, full)
+	if err != nil {
+		return err
+	}
+	if !full {
+		if len(res.missing) > 0 {
+			fs.Errorf(nil, "VirtualFS: Startup check found %d of %d content files missing, set startup_check full to list them", len(res.missing), res.rows)
+		}
+		return nil
+	}
+	for _, remote := range res.missing {
+		fs.Errorf(nil, "VirtualFS: Startup check found content of %s missing", remote)
+	}
+	for _, key := range res.orphans {
+		fs.Errorf(nil, "VirtualFS: Startup check found content file %s not in the catalog", key)
+	}
+	fs.Infof(nil, "VirtualFS: Startup check found %d of %d content files, %d missing, %d not in the catalog", res.files, res.rows, len(res.missing), len(res.orphans))
+	return nil
+}
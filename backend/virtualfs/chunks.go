@@ -0,0 +1,393 @@
+package virtualfs
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rclone/rclone/backend/crypt"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/lib/file"
+)
+
+// chunkedContent is the content_path of a file stored as chunks, the
+// pieces of which are listed in the chunks table
+const chunkedContent = "chunked:"
+
+// chunk is one piece of content stored as chunks
+type chunk struct {
+	offset     int64  // where the chunk starts in the content
+	size       int64  // bytes of content in the chunk
+	md5        string // MD5 of the bytes of the chunk
+	blob       string // name of the blob holding the chunk under blobDir
+	storedSize int64  // size of the blob on disk
+	tmp        string // where the chunk was written, "" once it is in place
+}
+
+// chunked returns true if the content of the object is stored as chunks
+func (o *Object) chunked() bool {
+	return o.contentPath == chunkedContent
+}
+
+// chunkedSize returns true if content of size bytes is stored as
+// chunks, as it is larger than chunk_size. Streams of unknown size are
+// stored whole.
+func (f *Fs) chunkedSize(size int64) bool {
+	return f.opt.ChunkSize > 0 && size > int64(f.opt.ChunkSize)
+}
+
+// chunkKey returns the key in the store of the blob holding a chunk
+func chunkKey(blob string) string {
+	return blobDir + "/" + blob
+}
+
+// hasChunk returns true if key is where one of the chunks of c is kept
+func (c *content) hasChunk(key string) bool {
+	for _, ch := range c.chunks {
+		if chunkKey(ch.blob) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// removeTmp removes the files c was written to which haven't been moved
+// into place
+func (c *content) removeTmp() {
+	if c.tmp != "" {
+		_ = os.Remove(c.tmp)
+	}
+	for _, ch := range c.chunks {
+		if ch.tmp != "" {
+			_ = os.Remove(ch.tmp)
+		}
+	}
+}
+
+// writeChunks copies in to new chunks of chunk_size, returning a
+// description of what was written. Each chunk is named after its MD5 so
+// it is stored once however many files or versions of a file have it.
+func (f *Fs) writeChunks(ctx context.Context, in io.Reader) (c *content, err error) {
+	dir := f.store.stagingDir(blobDir)
+	err = file.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	multiHasher, err := hash.NewMultiHasherTypes(f.ingestHashes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multi hasher: %w", err)
+	}
+	if f.ingestHashes().Count() > 0 {
+		in = io.TeeReader(in, multiHasher)
+	}
+	c = &content{path: chunkedContent, keyID: f.keyID, chunks: []*chunk{}}
+	if f.opt.Compress == compressZstd {
+		c.compression = compressZstd
+	}
+	defer func() {
+		if err != nil {
+			c.removeTmp()
+		}
+	}()
+	for {
+		ch, err := f.writeChunk(dir, io.LimitReader(in, int64(f.opt.ChunkSize)), c)
+		if err != nil {
+			return nil, err
+		}
+		if ch == nil {
+			break
+		}
+		ch.offset = c.size
+		c.size += ch.size
+		c.storedSize += ch.storedSize
+		c.chunks = append(c.chunks, ch)
+		if ch.size < int64(f.opt.ChunkSize) {
+			break
+		}
+	}
+	c.md5 = multiHasher.Sums()[hash.MD5]
+	c.hashes = multiHasher.Sums()
+	return c, nil
+}
+
+// writeChunk copies in to a new chunk in dir, stored as c is, returning
+// nil if in was empty
+func (f *Fs) writeChunk(dir string, in io.Reader, c *content) (ch *chunk, err error) {
+	outFile, err := os.CreateTemp(dir, incomingPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		closeErr := outFile.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil || ch == nil {
+			_ = os.Remove(outFile.Name())
+		}
+	}()
+	out, flush, err := f.encodeContent(outFile)
+	if err != nil {
+		return nil, err
+	}
+	hasher := md5.New()
+	written, err := f.copyContent(out, io.TeeReader(in, hasher))
+	flushErr := flush()
+	if err == nil {
+		err = flushErr
+	}
+	if err != nil || written == 0 {
+		return nil, err
+	}
+	if f.opt.DurableWrites {
+		err = outFile.Sync()
+		if err != nil {
+			return nil, fmt.Errorf("failed to flush content to disk: %w", err)
+		}
+	}
+	info, err := outFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	return &chunk{
+		size:       written,
+		md5:        sum,
+		blob:       blobName(sum, c.compression, c.keyID),
+		storedSize: info.Size(),
+		tmp:        outFile.Name(),
+	}, nil
+}
+
+// publishChunks moves the chunks of c into place, dropping those which
+// are stored already. It must be called with blobMu held.
+func (f *Fs) publishChunks(ctx context.Context, c *content) error {
+	for _, ch := range c.chunks {
+		key := chunkKey(ch.blob)
+		exists, err := f.store.exists(ctx, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			_ = os.Remove(ch.tmp)
+			ch.tmp = ""
+			continue
+		}
+		err = f.store.publish(ctx, ch.tmp, key)
+		if err != nil {
+			return fmt.Errorf("failed to move chunk into place: %w", err)
+		}
+		ch.tmp = ""
+		if f.opt.DurableWrites {
+			err = f.syncPublished(key)
+			if err != nil {
+				return fmt.Errorf("failed to flush content to disk: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// recordChunks records the chunks of remote in tx, taking a reference
+// on the blob of each
+func recordChunks(ctx context.Context, tx *sql.Tx, remote string, chunks []*chunk) error {
+	for i, ch := range chunks {
+		_, err := tx.ExecContext(ctx, `INSERT INTO chunks (remote, idx, start, size, md5, blob) VALUES (?, ?, ?, ?, ?, ?)`,
+			remote, i, ch.offset, ch.size, ch.md5, ch.blob)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO blobs (hash, size, refcount) VALUES (?, ?, 1) ON CONFLICT(hash) DO UPDATE SET refcount = refcount + 1`, ch.blob, ch.storedSize)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseChunks forgets the chunks of remote in tx, returning the keys
+// of the blobs nothing refers to any more
+func releaseChunks(ctx context.Context, tx *sql.Tx, remote string) (removeKeys []string, err error) {
+	blobs, err := queryRemotesTx(ctx, tx, `SELECT blob FROM chunks WHERE remote = ? ORDER BY idx`, remote)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM chunks WHERE remote = ?`, remote)
+	if err != nil {
+		return nil, err
+	}
+	for _, blob := range blobs {
+		unused, err := dropBlobRef(ctx, tx, blob)
+		if err != nil {
+			return nil, err
+		}
+		if unused {
+			removeKeys = append(removeKeys, chunkKey(blob))
+		}
+	}
+	return removeKeys, nil
+}
+
+// chunksOf returns the chunks of the object overlapping the limit bytes
+// from offset, or all those after offset if limit is -1
+func (o *Object) chunksOf(ctx context.Context, offset, limit int64) ([]*chunk, error) {
+	end := o.size
+	if limit >= 0 {
+		end = min(end, offset+limit)
+	}
+	rows, err := o.fs.rdb.QueryContext(ctx, `SELECT start, size, md5, blob FROM chunks WHERE remote = ? AND start + size > ? AND start < ? ORDER BY idx`, o.remote, offset, end)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var chunks []*chunk
+	for rows.Next() {
+		ch := &chunk{}
+		err = rows.Scan(&ch.offset, &ch.size, &ch.md5, &ch.blob)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, ch)
+	}
+	return chunks, rows.Err()
+}
+
+// chunkKeys returns the keys of the blobs holding the chunks of the object
+func (o *Object) chunkKeys(ctx context.Context) ([]string, error) {
+	chunks, err := o.chunksOf(ctx, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(chunks))
+	for i, ch := range chunks {
+		keys[i] = chunkKey(ch.blob)
+	}
+	return keys, nil
+}
+
+// openChunks opens the limit bytes of the content from offset, or all
+// of it after offset if limit is -1, reading only the chunks they are
+// in and decrypting them with cipher
+func (o *Object) openChunks(ctx context.Context, cipher *crypt.Cipher, offset, limit int64) (io.ReadCloser, error) {
+	chunks, err := o.chunksOf(ctx, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 && offset < o.size && limit != 0 {
+		return nil, fmt.Errorf("chunks of %s are missing: %w", o.remote, os.ErrNotExist)
+	}
+	if limit < 0 {
+		limit = o.size - offset
+	}
+	return &chunkReader{ctx: ctx, o: o, cipher: cipher, chunks: chunks, offset: offset, left: max(limit, 0)}, nil
+}
+
+// chunkReader reads a range of content stored as chunks, opening each
+// chunk as it gets to it
+type chunkReader struct {
+	ctx    context.Context
+	o      *Object
+	cipher *crypt.Cipher
+	chunks []*chunk      // the chunks still to read
+	offset int64         // where in the content to read from next
+	left   int64         // bytes still to read
+	in     io.ReadCloser // the chunk being read, nil if none
+}
+
+// Read implements io.Reader
+func (r *chunkReader) Read(p []byte) (n int, err error) {
+	if r.left <= 0 {
+		return 0, io.EOF
+	}
+	for r.in == nil {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		err = r.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err = r.in.Read(p)
+	r.offset += int64(n)
+	r.left -= int64(n)
+	if err == io.EOF {
+		err = r.in.Close()
+		r.in = nil
+		if err == nil && n == 0 {
+			return r.Read(p)
+		}
+	}
+	return n, err
+}
+
+// next opens the next chunk, skipping to the offset in it
+func (r *chunkReader) next() error {
+	ch := r.chunks[0]
+	r.chunks = r.chunks[1:]
+	in, err := r.o.fs.store.open(r.ctx, chunkKey(ch.blob))
+	if err != nil {
+		return fmt.Errorf("failed to open chunk of %s: %w", r.o.remote, err)
+	}
+	in, err = r.o.decodeContent(in, r.cipher)
+	if err != nil {
+		return err
+	}
+	if skip := r.offset - ch.offset; skip > 0 {
+		_, err = io.CopyN(io.Discard, in, skip)
+		if err != nil {
+			_ = in.Close()
+			return fmt.Errorf("failed to seek in chunk of %s: %w", r.o.remote, err)
+		}
+	}
+	r.in = in
+	return nil
+}
+
+// Close the chunk being read
+func (r *chunkReader) Close() error {
+	r.chunks = nil
+	if r.in == nil {
+		return nil
+	}
+	err := r.in.Close()
+	r.in = nil
+	return err
+}
+
+// chunkEntry describes one chunk of a file for the chunks command
+type chunkEntry struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5"`
+}
+
+// listChunks returns the chunks of the file at the catalog path remote
+func (f *Fs) listChunks(ctx context.Context, remote string) ([]chunkEntry, error) {
+	obj, err := f.findObject(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	o := obj.(*Object)
+	entries := []chunkEntry{}
+	if !o.chunked() || o.evicted {
+		return entries, nil
+	}
+	chunks, err := o.chunksOf(ctx, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	for _, ch := range chunks {
+		entries = append(entries, chunkEntry{Offset: ch.offset, Size: ch.size, MD5: ch.md5})
+	}
+	return entries, nil
+}
@@ -0,0 +1,1491 @@
+package virtualfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+var commandHelp = []fs.CommandHelp{{
+	Name:  "snapshot",
+	Short: "Take a consistent snapshot of the catalog database",
+	Long: `Copy the live catalog into a new SQLite file using the online backup
+API, so it is consistent even while other operations are running.
+
+With no argument the snapshot is written to a timestamped file in the
+".virtualfs/snapshots" directory under the root directory. The argument
+may be a local path or any rclone remote path. If it ends in "/" it is
+treated as a directory and a timestamped file name is generated inside
+it.
+
+Usage Examples:
+
+    rclone backend snapshot virtualfs:
+    rclone backend snapshot virtualfs: /backups/catalog.db
+    rclone backend snapshot virtualfs: s3:bucket/catalogs/
+
+The path of the written snapshot is returned.
+`,
+}, {
+	Name:  "backup-db",
+	Short: "Back up the catalog database without stopping ingest",
+	Long: `The same as the "snapshot" command, named to pair with "restore-db".
+
+Copying the database file while the remote is in use can give a torn
+copy as changes are still in the write ahead log. This takes a
+consistent copy with the SQLite online backup API instead.
+
+Usage Examples:
+
+    rclone backend backup-db virtualfs: /backups/catalog.db
+    rclone backend backup-db virtualfs: s3:bucket/catalogs/
+
+The path of the written backup is returned.
+`,
+}, {
+	Name:  "restore-db",
+	Short: "Restore the catalog database from a snapshot",
+	Long: `Replace the contents of the live catalog with a snapshot previously
+written by the "snapshot" or "backup-db" command or catalog_backup.
+
+The argument may be a local path or any rclone remote path. With no
+argument the most recent snapshot in the ".virtualfs/snapshots" directory
+under the root directory is used.
+
+The snapshot is checked for integrity before anything is overwritten.
+Content files are not touched, only the metadata.
+
+Usage Examples:
+
+    rclone backend restore-db virtualfs:
+    rclone backend restore-db virtualfs: s3:bucket/catalogs/virtualfs-20240101-120000.db
+`,
+}, {
+	Name:  "gc",
+	Short: "Remove content files not referenced by the catalog",
+	Long: `Walk the root directory looking for content files which no catalog
+row refers to, such as those left behind by interrupted uploads or put
+there by other tools, and remove them.
+
+Files modified less than min-age ago are skipped as they may belong to
+an upload in progress. Use --dry-run to see what would be removed.
+
+Usage Examples:
+
+    rclone backend gc virtualfs:
+    rclone backend gc virtualfs: -o quarantine -o min-age=24h
+
+A JSON summary of the files scanned and the orphans found is returned.
+`,
+	Opts: map[string]string{
+		"quarantine": "Move orphans into the quarantine directory instead of deleting them",
+		"min-age":    "Only consider files older than this (default 1h)",
+	},
+}, {
+	Name:  "prune-empty-dirs",
+	Short: "Remove directories without any live files",
+	Long: `Remove the directories below the directory given, the top of the remote
+if none, which have no live files in them or further down, from the
+catalog and the content directory, deepest first. Long running
+catalogs pile up thousands of them as files are deleted or moved
+away. Directory rows left when directories were removed are dropped
+too.
+
+With -o keep-tombstones directories holding deleted files are kept,
+so the files are still in the trash where they were. Directories with
+files in them which the catalog doesn't know about are left alone. Use
+--dry-run to see what would be removed.
+
+Usage Examples:
+
+    rclone backend prune-empty-dirs virtualfs:
+    rclone backend prune-empty-dirs virtualfs: projects -o keep-tombstones
+
+The directories removed are returned.
+`,
+	Opts: map[string]string{
+		"keep-tombstones": "Keep directories holding deleted files",
+	},
+}, {
+	Name:  "rewrite",
+	Short: "Rename the paths matching a regular expression",
+	Long: `Rename every file and directory in the catalog whose path matches the
+regular expression "match", replacing the match with "replace", which
+may use $1 style references to the groups of the expression.
+Everything in a directory renamed goes with it.
+
+The catalog is updated in a single transaction, moving the tags,
+versions and hashes of the files with them, so large catalogs can be
+reorganized after an upstream layout change without ingesting anything
+again. Content stored under the paths of the files is moved too.
+Nothing is renamed if any new path is invalid or already in the
+catalog. Use --dry-run to see what would be renamed.
+
+Usage Example:
+
+    rclone backend rewrite virtualfs: -o match='^old-prefix/' -o replace='new-prefix/'
+
+The paths renamed are returned.
+`,
+	Opts: map[string]string{
+		"match":   "Regular expression the paths to rename match",
+		"replace": "What to replace the match with",
+	},
+}, {
+	Name:  "status",
+	Short: "Show the processing status of files",
+	Long: `Show the processing lifecycle state of each file given.
+
+Files move through pending -> claimed -> processed or failed. Every
+ingest of new content puts the file back to pending.
+
+Usage Example:
+
+    rclone backend status virtualfs: path/to/file1 path/to/file2
+`,
+}, {
+	Name:  "pending",
+	Short: "List files in a processing state",
+	Long: `List the live files in a processing state, highest priority first
+and then oldest ingest first.
+
+With no argument the whole remote is searched, otherwise only the
+directory given and below.
+
+Usage Examples:
+
+    rclone backend pending virtualfs:
+    rclone backend pending virtualfs: path/to/dir -o status=failed
+`,
+	Opts: map[string]string{
+		"status": "State to list: pending (default), claimed, processed or failed",
+	},
+}, {
+	Name:  "claim",
+	Short: "Mark files as claimed for processing",
+	Long: `Move each file given from pending or failed to claimed.
+
+All the files change status in one transaction and if any of them is
+in the wrong state none are changed, so this can be used by several
+consumers to coordinate which of them process which files.
+
+With "worker" the files are claimed by that worker until its "lease"
+runs out, 10m by default, after which another worker may claim them.
+A worker claiming a file it already holds renews its lease. With a
+worker and no paths, the next "count" files waiting in "dir", highest
+priority and then oldest first, are claimed, so processors on several
+hosts can pull work from one catalog without processing a file twice.
+Nothing is returned if nothing is waiting.
+
+Usage Examples:
+
+    rclone backend claim virtualfs: path/to/file1 path/to/file2
+    rclone backend claim virtualfs: -o worker=host1 -o lease=30m -o dir=incoming -o count=10
+`,
+	Opts: map[string]string{
+		"worker": "ID of the worker claiming the files",
+		"lease":  "How long the worker's claim lasts (default 10m)",
+		"dir":    "Directory to claim the next files from, with a worker and no paths",
+		"count":  "How many files to claim from dir (default 1)",
+	},
+}, {
+	Name:  "next",
+	Short: "Claim the next file to process",
+	Long: `Claim the file waiting to be processed with the highest priority, the
+oldest ingested of those, and return its path, size and where its
+content is on the local disk, so the catalog can be used as a work
+queue.
+
+With a directory only files at or below it are claimed. With "worker"
+the claim lasts until the worker's "lease" runs out, as for the claim
+command. If no file is waiting it fails, ending a shell loop such as:
+
+    while next=$(rclone backend next virtualfs: incoming -o worker=$HOSTNAME); do
+        process "$(echo "$next" | jq -r .local)"
+        rclone backend mark-processed virtualfs: "$(echo "$next" | jq -r .path)"
+    done
+
+The local path is left out if the content is evicted, encrypted,
+compressed or kept in content_remote.
+`,
+	Opts: map[string]string{
+		"worker": "ID of the worker claiming the file",
+		"lease":  "How long the worker's claim lasts (default 10m)",
+	},
+}, {
+	Name:  "annotate",
+	Short: "Record JSON against a file",
+	Long: `Record a JSON value against the file given, replacing any recorded
+before, so processing pipelines can keep their results, such as what
+was extracted or why it failed, next to the file. Pass null to remove
+it.
+
+The annotation is returned as the "annotation" metadata, as by
+"rclone lsjson --metadata", by the search command and in the
+annotation column of v_files. It is kept when the file is ingested
+again.
+
+Usage Examples:
+
+    rclone backend annotate virtualfs: path/to/file '{"pages":12,"ocr":"done"}'
+    rclone backend annotate virtualfs: path/to/file null
+`,
+}, {
+	Name:  "tag",
+	Short: "Tag a file",
+	Long: `Add each tag given to the file given, so files in different
+directories can be grouped, by customer, batch or type of data say, and
+found with the search command's "tag" option or evicted with the evict
+command's. Tags already on the file are left as they are.
+
+The tags of each file are returned by the search command and as the
+"tags" metadata.
+
+Usage Example:
+
+    rclone backend tag virtualfs: path/to/file invoices customer-42
+`,
+}, {
+	Name:  "untag",
+	Short: "Remove tags from a file",
+	Long: `Remove each tag given from the file given. Tags it doesn't have are
+ignored.
+
+Usage Example:
+
+    rclone backend untag virtualfs: path/to/file invoices
+`,
+}, {
+	Name:  "release",
+	Short: "Give up the claim on files",
+	Long: `Move each file given from claimed back to pending, for another worker
+to claim. With "worker" only files claimed by that worker are released
+and if any of them aren't none are.
+
+Usage Example:
+
+    rclone backend release virtualfs: path/to/file1 -o worker=host1
+`,
+	Opts: map[string]string{
+		"worker": "ID of the worker which claimed the files",
+	},
+}, {
+	Name:  "mark-processed",
+	Short: "Mark files as processed",
+	Long: `Move each file given from pending or claimed to processed.
+
+Usage Example:
+
+    rclone backend mark-processed virtualfs: path/to/file1 path/to/file2
+`,
+}, {
+	Name:  "mark-failed",
+	Short: "Mark files as failed",
+	Long: `Move each file given from pending or claimed to failed.
+
+Usage Example:
+
+    rclone backend mark-failed virtualfs: path/to/file1 path/to/file2
+`,
+}, {
+	Name:  "reset",
+	Short: "Reset files back to pending",
+	Long: `Move each file given back to pending whatever its current state.
+
+Usage Example:
+
+    rclone backend reset virtualfs: path/to/file1 path/to/file2
+`,
+}, {
+	Name:  "rotate-key",
+	Short: "Re-encrypt content with the configured key",
+	Long: `Rewrite content encrypted with an old key so it is encrypted with the
+key currently configured by encryption_password or encryption_key_file.
+
+To retire a key, configure the new one, then run this giving the old
+one. Content is re-encrypted a file at a time, each committed as it is
+done, so the command may be stopped and run again to carry on. With no
+old key given, content stored unencrypted is encrypted instead.
+
+Usage Examples:
+
+    rclone backend rotate-key virtualfs: -o old-password-file=/path/to/old.key
+    rclone backend rotate-key virtualfs: -o old-password=secret -o limit=1000
+
+A JSON summary of the files rotated and those still using the old key
+is returned.
+`,
+	Opts: map[string]string{
+		"old-password":      "Password the content is currently encrypted with",
+		"old-password-file": "File to read the old password from",
+		"limit":             "Maximum number of files to re-encrypt in this run",
+	},
+}, {
+	Name:  "scrub",
+	Short: "Check content against its stored hashes",
+	Long: `Re-read the content of each file with content held, comparing it with
+the hashes stored when it was ingested.
+
+Files which don't match are flagged corrupt in the catalog. Files with
+no stored hashes can't be checked and are counted as unverified.
+
+With no argument the whole remote is scrubbed, otherwise only the
+directory given and below.
+
+Usage Examples:
+
+    rclone backend scrub virtualfs:
+    rclone backend scrub virtualfs: path/to/dir -o bwlimit=10M
+
+A JSON summary listing the corrupt files and any with content missing
+is returned.
+`,
+	Opts: map[string]string{
+		"bwlimit": "Maximum rate to read at in bytes per second (default scrub_bwlimit)",
+	},
+}, {
+	Name:  "changes",
+	Short: "List the changes made to files",
+	Long: `Return the files created, updated and deleted, in the order they
+happened, from the change journal. A file renamed by the rewrite command
+is deleted at its old path and renamed at its new one.
+
+Each change has a sequence number. Pass the "last" sequence number
+returned as "since" to get the changes made after it, so downstream
+tools can pull changes incrementally without listing everything.
+"since" may instead be a time, or a duration meaning that long ago.
+
+With "bookmark" instead the changes since the bookmark of the top level
+directory given are returned.
+
+Usage Examples:
+
+    rclone backend changes virtualfs:
+    rclone backend changes virtualfs: -o bookmark=photos
+    rclone backend changes virtualfs: -o since=1234
+    rclone backend changes virtualfs: -o since=2024-01-02T15:00:00Z
+    rclone backend changes virtualfs: -o since=24h -o limit=100
+
+A JSON object with the changes is returned. "more" is set if there are
+changes after "last" left out by the limit.
+`,
+	Opts: map[string]string{
+		"since":    "Sequence number or time to list the changes after",
+		"bookmark": "List the changes since the bookmark of this directory",
+		"limit":    "Maximum number of changes to return (default 1000)",
+	},
+}, {
+	Name:  "bookmark",
+	Short: "Record that a sync into directories has completed",
+	Long: `Bookmark each top level directory given, recording the time and the
+last change journal sequence number, so later commands can work with
+what changed since that sync. Use "/" for the files at the top level.
+
+Bookmarks are also updated for each directory changed when the remote
+is shut down, as long as no errors were counted.
+
+Usage Example:
+
+    rclone sync source: virtualfs: && rclone backend bookmark virtualfs: photos docs
+`,
+}, {
+	Name:  "stats",
+	Short: "Show a summary of the catalog",
+	Long: `Show how many files and deleted files the catalog holds, their total
+size, the size of their content on disk, how many have had their content
+evicted, the last change journal sequence number and the totals and
+bookmark of each top level directory.
+
+The totals are kept up to date as files change so this is quick however
+big the catalog is.
+
+How many uploads have been skipped as identical, files ingested,
+contents evicted and fetched back, files deleted and object cache hits
+and misses there have been since rclone started are counted separately.
+They are shown under "virtualfs" in core/stats and, as
+rclone_virtualfs_*_total, by the Prometheus endpoint of --metrics-addr
+or --rc-enable-metrics.
+
+Usage Example:
+
+    rclone backend stats virtualfs:
+`,
+}, {
+	Name:  "health",
+	Short: "Check the catalog and root directories are usable",
+	Long: `Check the catalog can be read and, unless read_only is set, written,
+that each root directory is there, can be written and has at least
+"min-free" bytes free, min_free_space by default, and that the write
+ahead log of the catalog is no bigger than "max-wal", 1 GiB by default.
+Nothing is changed.
+
+A JSON report is returned with "healthy" set if every check passed and
+the result of each check under "checks", with why it failed if it did.
+The same report is returned by the virtualfs/health rc command, for
+monitoring systems.
+
+Usage Examples:
+
+    rclone backend health virtualfs:
+    rclone backend health virtualfs: -o min-free=10G -o max-wal=256M
+`,
+	Opts: map[string]string{
+		"min-free": "Least free space each root directory must have (default min_free_space)",
+		"max-wal":  "Largest the write ahead log of the catalog may be (default 1G)",
+	},
+}, {
+	Name:  "bench",
+	Short: "Measure how fast the catalog and root directories are",
+	Long: `Measure, with the current options, how many files a second the
+catalog takes, each committed on its own as an upload does, and looks
+up, how long the directory given, the root by default, takes to list
+and how fast content is written to the staging directory of each root
+directory, so db_pragmas, durable_writes and where the catalog and
+content are kept can be tuned by trying them.
+
+The catalog measured is a scratch one next to the real one, made with
+the same schema, pragmas and driver, and removed afterwards, so nothing
+is added to the real one. The content written is removed too.
+
+A JSON report is returned with the SQLite version, the pragmas in
+effect and the results.
+
+Usage Examples:
+
+    rclone backend bench virtualfs:
+    rclone backend bench virtualfs: dir -o files=10000 -o size=1G
+`,
+	Opts: map[string]string{
+		"files": "How many files to insert into and look up in the scratch catalog (default 1000)",
+		"size":  "How much content to write to each root directory (default 64M)",
+	},
+}, {
+	Name:  "audit",
+	Short: "Show the audit log",
+	Long: `List the uploads, deletions, evictions and status changes recorded
+while audit_log was set, oldest first.
+
+With an argument only the entries for that file or the files below that
+directory are listed.
+
+Usage Examples:
+
+    rclone backend audit virtualfs:
+    rclone backend audit virtualfs: path/to/dir -o since=24h -o op=remove
+
+Each entry has the time, the operation, the path, the user and host
+rclone ran as and the ID of the run of rclone it was made by.
+`,
+	Opts: map[string]string{
+		"since":      "Only list entries at or after this time",
+		"op":         "Only list entries of this operation: put, remove, evict or status",
+		"invocation": "Only list entries made by the run of rclone with this ID",
+		"limit":      "Maximum number of entries to return (default 1000)",
+	},
+}, {
+	Name:  "evict",
+	Short: "Evict the content of files",
+	Long: `Remove the content of each file given from the root directory,
+keeping its metadata in the catalog, as content_ttl and max_cache_size
+do. Reading a file whose content has been evicted fetches it from the
+origin_remote if one is set.
+
+Files claimed for processing, waiting to be replicated or under legal
+hold can't be evicted. Files already evicted are left alone.
+
+With "tag" instead of paths every file with that tag is evicted.
+
+Usage Examples:
+
+    rclone backend evict virtualfs: path/to/file1 path/to/file2
+    rclone backend evict virtualfs: -o tag=archived
+
+The bytes freed for each file are returned.
+`,
+	Opts: map[string]string{
+		"tag": "Evict the files with this tag instead of the paths given",
+	},
+}, {
+	Name:  "hold",
+	Short: "Put files under legal hold",
+	Long: `Put each file given, or every file in each directory given, under legal
+hold until it is released with "unhold".
+
+A held file can't be updated, overwritten, removed, purged or have its
+modification time set, which fails with a permission error, and its
+content isn't evicted by the evict command, content_ttl,
+max_cache_size, a quota, min_free_space, evict_after_read or
+on_ingest_evict, whatever their settings. The legal-hold metadata
+shows whether a file is held.
+
+Usage Example:
+
+    rclone backend hold virtualfs: case-42/mail path/to/file
+
+The files held are returned.
+`,
+}, {
+	Name:  "unhold",
+	Short: "Release files from legal hold",
+	Long: `Release each file given, or every file in each directory given, from
+the legal hold put on it by "hold", so it can be changed and evicted as
+usual again.
+
+Usage Example:
+
+    rclone backend unhold virtualfs: case-42/mail
+
+The files released are returned.
+`,
+}, {
+	Name:  "set-ttl",
+	Short: "Give files a TTL of their own overriding content_ttl",
+	Long: `Give each file given, or every file in each directory given, the TTL
+"ttl", after which its content is evicted if it hasn't been ingested or
+read, in place of content_ttl. Use "off" to keep the content however
+old it gets, for example to pin a reference dataset while bulk ingest
+churns through the rest, or "default" to go back to content_ttl.
+
+Files uploaded later aren't affected, but a file keeps its TTL when it
+is uploaded again. The TTL can also be set as the content-ttl metadata,
+when the file is uploaded or afterwards, and is shown there.
+
+Usage Examples:
+
+    rclone backend set-ttl virtualfs: reference -o ttl=off
+    rclone backend set-ttl virtualfs: scratch/file -o ttl=2h
+    rclone backend set-ttl virtualfs: reference -o ttl=default
+
+The files changed are returned with their TTLs.
+`,
+	Opts: map[string]string{
+		"ttl": "Duration such as 30d, off to keep the content or default to use content_ttl",
+	},
+}, {
+	Name:  "mark-synced",
+	Short: "Record that the sync of directories has finished",
+	Long: `Record that the sync of each directory given finished, now or at the
+time "at", so processors can tell a batch directory is complete and
+safe to consume rather than racing a sync still writing to it. Run it
+once the ingest job's rclone sync or copy into the directory returns.
+
+A directory keeps the marker until it is marked again or cleared, but
+sync-status reports it as no longer complete once anything in it is
+ingested, removed or renamed afterwards, as the change journal records.
+
+Usage Examples:
+
+    rclone sync /data/batch-42 virtualfs:batches/batch-42 && \
+        rclone backend mark-synced virtualfs: batches/batch-42
+    rclone backend mark-synced virtualfs: batches/batch-42 -o clear
+
+The markers of the directories are returned as sync-status returns them.
+`,
+	Opts: map[string]string{
+		"at":    "When the sync finished, a time or how long ago, instead of now",
+		"clear": "Forget the markers instead",
+	},
+}, {
+	Name:  "sync-status",
+	Short: "Show which directories are marked synced",
+	Long: `Show the directory given, the top of the remote if none, and every
+directory below it which mark-synced has marked, with when its sync
+finished and whether it is still complete: false if a file in it or
+further down has been ingested or removed since, with when that was.
+
+Usage Example:
+
+    rclone backend sync-status virtualfs: batches
+
+Each marked directory is returned with "path", "synced_at", "complete"
+and "changed_at".
+`,
+}, {
+	Name:  "erase",
+	Short: "Erase every trace of files for a right to be forgotten request",
+	Long: `Erase each path given, with everything under it if it is a directory,
+or the paths matching each glob given. Their content, old versions and
+interrupted uploads are removed along with their rows in the catalog,
+deleted files in the trash included, and every mention of them in the
+history, change journal and audit log, so nothing of them is left.
+
+With "overwrite" content kept in the root directory is overwritten with
+zeros before it is removed and the catalog overwrites what it frees.
+Content in a content_remote is just removed.
+
+Files under legal hold or retention_period can't be erased, so nothing
+is if any of them match.
+
+A receipt is recorded of each erasure, with the "reference" given. It
+holds how many paths were erased and a SHA-256 digest of them, sorted
+one per line, rather than the paths themselves.
+
+Usage Examples:
+
+    rclone backend erase virtualfs: customers/42 -o reference=ticket-1234
+    rclone backend erase virtualfs: "**/jane.doe*" -o overwrite
+
+The receipt is returned.
+`,
+	Opts: map[string]string{
+		"overwrite": "Overwrite the content with zeros before removing it",
+		"reference": "What the erasure is for, recorded in the receipt",
+	},
+}, {
+	Name:  "warm",
+	Short: "Fetch the content of evicted files ahead of reading them",
+	Long: `Fetch the content of the evicted files at or below the directory given,
+or everywhere if there isn't one, from the origin_remote so reading
+them later doesn't have to wait, as before a processing run. The files
+can be narrowed down with the options of the search command, such as
+"glob", "tag" and "status".
+
+"concurrency" files are fetched at once, 4 by default. Each is shown
+as a transfer by --progress and how far it has got is logged every 10
+seconds. Files over cache_max_size are skipped as they are never kept.
+
+Usage Examples:
+
+    rclone backend warm virtualfs: reference/2024 -P
+    rclone backend warm virtualfs: -o tag=nightly -o concurrency=16
+
+How many files were fetched and their size is returned, along with
+the error for each file which couldn't be.
+`,
+	Opts: map[string]string{
+		"concurrency": "How many files to fetch at once (default 4)",
+		"glob":        "Only files whose path matches this",
+		"status":      "Only files in this processing state",
+		"tag":         "Only files with this tag",
+		"limit":       "The most files to fetch",
+	},
+}, {
+	Name:  "replication-status",
+	Short: "Show the state of replication to the mirror_remote",
+	Long: `With no arguments, show how many files are waiting to be replicated to
+the mirror_remote, have been replicated and have failed, along with
+the reason for each failure.
+
+Otherwise show the replication state of each file given.
+
+Usage Examples:
+
+    rclone backend replication-status virtualfs:
+    rclone backend replication-status virtualfs: path/to/file1 path/to/file2
+`,
+}, {
+	Name:  "versions",
+	Short: "List the previous versions kept of a file",
+	Long: `List the versions of a file kept by keep_versions, oldest first, with
+the size, modification time, hash and time each was replaced.
+
+Usage Example:
+
+    rclone backend versions virtualfs: path/to/file
+`,
+}, {
+	Name:  "get-version",
+	Short: "Copy a previous version of a file out",
+	Long: `Copy the content of a version of a file kept by keep_versions to a
+local path or any rclone remote path. The version number is one of
+those shown by the "versions" command.
+
+Usage Example:
+
+    rclone backend get-version virtualfs: path/to/file /tmp/file.old -o version=3
+
+The path written is returned.
+`,
+}, {
+	Name:  "snapshot-create",
+	Short: "Name the current generation of the catalog",
+	Long: `Every change to a file in the catalog gets the next generation number.
+This records the current generation under the name given, or the time
+now if there isn't one, so the files as they were then can be listed
+later with "snapshot-list" even after they have been changed or
+deleted. Only the catalog is kept, not the content.
+
+Usage Examples:
+
+    rclone backend snapshot-create virtualfs:
+    rclone backend snapshot-create virtualfs: before-run-42
+
+The name and generation recorded are returned.
+`,
+}, {
+	Name:  "snapshot-list",
+	Short: "List named generations or the files in one",
+	Long: `With no arguments list the generations named by "snapshot-create",
+oldest first.
+
+Otherwise list the files which existed at the generation given, either
+by name or by number, with the size, modification time and hash each
+had then. A directory may be given after it to list only the files at
+or below it.
+
+Usage Examples:
+
+    rclone backend snapshot-list virtualfs:
+    rclone backend snapshot-list virtualfs: before-run-42
+    rclone backend snapshot-list virtualfs: 1234 path/to/dir
+`,
+}, {
+	Name:  "search",
+	Short: "Find files by path and metadata",
+	Long: `Find the files at or below the directory given, or everywhere if there
+isn't one, matching all the options given, in path order.
+
+The glob is matched against the whole path with the same rules as
+rclone's filters, so "*.parquet" matches files of that name in any
+directory and "/dir/**" only below dir at the top.
+
+Options:
+
+- "glob": paths matching this
+- "min-size": at least this big, eg 1G
+- "max-size": no bigger than this
+- "status": in this processing state
+- "unprocessed": not yet marked processed
+- "md5": with this MD5
+- "source": ingested from the remote of this name
+- "tag": tagged with this by the tag command
+- "min-accesses": opened at least this many times
+- "max-accesses": opened no more than this many times, eg 0 for never
+- "idle": not opened for this long, eg 30d
+- "limit": the most matches to return, 1000 by default
+
+Usage Examples:
+
+    rclone backend search virtualfs: -o glob='**/*.parquet' -o min-size=1G -o unprocessed=true
+    rclone backend search virtualfs: path/to/dir -o md5=d41d8cd98f00b204e9800998ecf8427e
+    rclone backend search virtualfs: -o source=s3
+    rclone backend search virtualfs: -o tag=invoices -o unprocessed=true
+
+The matches are returned along with whether there were more than the
+limit.
+`,
+}, {
+	Name:  "views",
+	Short: "Show the SQL views other programs may read the catalog through",
+	Long: `The catalog is a SQLite database whose tables change as rclone does.
+Other programs, like BI tools and schedulers, should read it through
+these views instead, which keep the same columns with the same meaning
+for as long as the contract version in v_info stays the same. Columns
+may be added without changing it.
+
+- "v_info": contract_version
+- "v_files": the live files with path, dir, size, mod_time (RFC 3339),
+  mod_time_ns, md5, status, status_time, ingested_at, last_access,
+  evicted, corrupt, replication_status, priority, source_remote,
+  source_path and annotation
+- "v_dirs": the live directories with path and dir
+- "v_deleted_dirs": the removed directories kept until the
+  deleted_retention with path, dir and deleted_at
+- "v_changes": the change journal with seq, path, event, size, md5 and
+  time
+
+Paths are relative to the top of the catalog, and dir is "" at the
+top. Open the database read only, eg with "?mode=ro", so other
+programs never block writes for long.
+
+Usage Example:
+
+    rclone backend views virtualfs:
+
+The contract version and the columns each view has now are returned.
+`,
+}, {
+	Name:  "manifest",
+	Short: "List the files ingested or changed since a point as a work list",
+	Long: `List the live files at or below the directory given, or everywhere if
+there isn't one, with their path, size, MD5, processing status,
+modification time and ingest time, in path order, to hand to a batch
+job as its work list.
+
+With "since" only the files ingested or changed after that change
+journal sequence number or at or after that time are listed. A
+duration means that long ago. With "bookmark" instead only those
+changed since the bookmark of the top level directory given.
+
+The manifest is JSON unless "format" is "csv" or "parquet". A Parquet
+manifest is written to "output", a local path or an rclone path, for
+Spark, DuckDB or pandas to load, with the columns path, size, mtime (a
+timestamp), hash (the MD5), status, tags (comma separated) and source
+(the remote and path it was ingested from, if known). Where it was
+written is returned.
+
+Usage Examples:
+
+    rclone backend manifest virtualfs: -o since=24h
+    rclone backend manifest virtualfs: photos -o bookmark=photos -o format=csv > work.csv
+    rclone backend manifest virtualfs: -o format=parquet -o output=s3:lake/catalog.parquet
+`,
+	Opts: map[string]string{
+		"since":    "Sequence number or time to list the changes after",
+		"bookmark": "List the files changed since the bookmark of this directory",
+		"format":   "json, csv or parquet (default json)",
+		"output":   "Local or rclone path to write a parquet manifest to",
+	},
+}, {
+	Name:  "set-priority",
+	Short: "Set the processing priority of files",
+	Long: `Set the priority of each file given, so "pending" lists the files
+with the highest priority first. Files start at 0 unless priority_rules
+gives them another. Priorities may be negative to process files last.
+
+Usage Example:
+
+    rclone backend set-priority virtualfs: path/to/file1 path/to/file2 -o priority=10
+
+The new state of each file is returned.
+`,
+}, {
+	Name:  "merge",
+	Short: "Merge another catalog into this one",
+	Long: `Copy the live files and directories of another virtualfs catalog into
+this one, below the root of the remote, to consolidate catalogs built
+on different machines. The catalog to merge is given by the path of
+its database, and is only read.
+
+If the root directory of the other catalog is given too the content of
+its files is copied in as if uploaded. Otherwise the files are merged
+with their content evicted, to be fetched from the origin_remote when
+read. Their processing status, priority and source are kept.
+
+A file in both catalogs is replaced by the one merged in if that was
+modified later, unless "conflict" is "error", in which case nothing is
+merged if any are.
+
+Usage Examples:
+
+    rclone backend merge virtualfs: /mnt/other/virtualfs.db /mnt/other
+    rclone backend merge virtualfs: other.db -o conflict=error
+
+How many files were merged, merged without content and kept as they
+were newer here is returned, along with the files in both.
+`,
+	Opts: map[string]string{
+		"conflict": "newest or error (default newest)",
+	},
+}, {
+	Name:  "du",
+	Short: "Show the usage of each directory",
+	Long: `Show how many files there are at or below the directory given, or the
+root if there isn't one, and below each of its subdirectories, and
+their total size. The files are split into those with their content
+cached, those whose content has been evicted and those kept as deleted.
+The counts are worked out from the catalog without touching the
+content.
+
+With "format" set to "ncdu" the live files are written instead as an
+ncdu export, which "ncdu -f" browses. Evicted files are shown with
+their size but no disk usage.
+
+Usage Examples:
+
+    rclone backend du virtualfs: photos
+    rclone backend du virtualfs: -o format=ncdu > usage.json && ncdu -f usage.json
+`,
+	Opts: map[string]string{
+		"format": "json or ncdu (default json)",
+	},
+}, {
+	Name:  "tiers",
+	Short: "Show the directories content is stored in",
+	Long: `Show each root directory and content_routing tier, with the patterns
+routed to it, its tier_max_size if it has one and the number and total
+size of the files with their content in it.
+
+Tiers no longer in content_routing are still shown while the catalog
+records content in them.
+
+Usage Example:
+
+    rclone backend tiers virtualfs:
+`,
+}, {
+	Name:  "wait-for-change",
+	Short: "Wait for a file to be created or updated",
+	Long: `Block until at least one file is created, updated or renamed into
+place by the rewrite command, by this or any other rclone sharing the
+catalog, then return the changes as the changes command does and exit.
+With a directory only changes at or below it count, and with "include"
+only those whose paths match one of the comma separated globs.
+
+Only changes from when it starts count, unless "since" is given as a
+change journal sequence number. Pass the "last" returned as "since" to
+wait for the next changes without missing any in between.
+
+With "timeout" it gives up with an error if nothing changes in that
+long, otherwise it waits for ever. The change journal is checked every
+"poll".
+
+Usage Examples:
+
+    rclone backend wait-for-change virtualfs: incoming
+    rclone backend wait-for-change virtualfs: -o include="*.csv" -o timeout=1h
+
+A simple processing loop:
+
+    since=$(rclone backend stats virtualfs: | jq .lastSeq)
+    while out=$(rclone backend wait-for-change virtualfs: -o since=$since); do
+        echo "$out" | jq -r '.changes[].path' | xargs -n1 process
+        since=$(echo "$out" | jq .last)
+    done
+`,
+	Opts: map[string]string{
+		"since":   "Change journal sequence number to wait for changes after (default now)",
+		"include": "Comma separated globs the paths must match",
+		"timeout": "How long to wait before giving up (default forever)",
+		"poll":    "How often to check for changes (default 1s)",
+	},
+}, {
+	Name:  "repair",
+	Short: "Fetch corrupt or missing content from the origin again",
+	Long: `Fetch the content of each file flagged corrupt, or whose content file
+is missing, from the origin_remote again. The content fetched is checked
+against all the hashes stored for the file before the flag is cleared,
+so a file whose origin copy is bad too stays flagged.
+
+With no argument the whole remote is repaired, otherwise only the
+directory given and below.
+
+Usage Examples:
+
+    rclone backend scrub virtualfs:
+    rclone backend repair virtualfs:
+    rclone backend repair virtualfs: path/to/dir
+
+A JSON summary of how many files were checked, those repaired and those
+which couldn't be, with why, is returned.
+`,
+}, {
+	Name:  "verify-against",
+	Short: "Compare the catalog with the remote its files came from",
+	Long: `List the remote given, whose root is taken to be the root of the
+catalog, and compare each file in it with the catalog by size,
+modification time and any hash both have, to find where they have
+drifted apart. No content is transferred, though the remote may read
+its own files to give their hashes, and hashes the catalog hasn't
+stored are left out.
+
+With a directory after the remote only that directory and below are
+compared.
+
+Usage Examples:
+
+    rclone backend verify-against virtualfs: s3:bucket/data
+    rclone backend verify-against virtualfs: s3:bucket/data path/to/dir
+
+A JSON report is returned of the files which changed upstream, with the
+attributes which differ, the files missing upstream and those missing
+from the catalog.
+`,
+}, {
+	Name:  "chunks",
+	Short: "List the chunks a file is stored as",
+	Long: `List the chunks the file given is stored as when chunk_size is set,
+with where each starts, its size and its MD5. The list is empty for a
+file stored whole or whose content has been evicted.
+
+Usage Example:
+
+    rclone backend chunks virtualfs: path/to/file
+`,
+}}
+
+// Command the backend to run a named command
+//
+// The command run is name
+// args may be used to read arguments from
+// opts may be used to read optional arguments from
+//
+// The result should be capable of being JSON encoded
+// If it is a string or a []string it will be shown to the user
+// otherwise it will be JSON encoded and shown to the user like that
+func (f *Fs) Command(ctx context.Context, name string, arg []string, opt map[string]string) (out interface{}, err error) {
+	arg = f.nsArgs(name, arg)
+	switch name {
+	case "snapshot", "backup-db":
+		if len(arg) > 1 {
+			return nil, fmt.Errorf("%s takes at most one destination argument", name)
+		}
+		dst := ""
+		if len(arg) == 1 {
+			dst = arg[0]
+		}
+		return f.snapshot(ctx, dst)
+	case "restore-db":
+		if len(arg) > 1 {
+			return nil, errors.New("restore-db takes at most one source argument")
+		}
+		src := ""
+		if len(arg) == 1 {
+			src = arg[0]
+		}
+		return f.restoreDB(ctx, src)
+	case "gc":
+		quarantine, err := optBool(opt, "quarantine")
+		if err != nil {
+			return nil, err
+		}
+		minAge := gcMinAge
+		if v, ok := opt["min-age"]; ok {
+			minAge, err = fs.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid min-age: %w", err)
+			}
+		}
+		return f.gc(ctx, quarantine, minAge)
+	case "prune-empty-dirs":
+		if len(arg) > 1 {
+			return nil, errors.New("prune-empty-dirs takes at most one directory argument")
+		}
+		keepTombstones, err := optBool(opt, "keep-tombstones")
+		if err != nil {
+			return nil, err
+		}
+		dir := ""
+		if len(arg) == 1 {
+			dir = arg[0]
+		}
+		return f.pruneEmptyDirs(ctx, dir, keepTombstones)
+	case "rewrite":
+		match, ok := opt["match"]
+		if !ok || match == "" {
+			return nil, errors.New("need -o match=regexp")
+		}
+		re, err := regexp.Compile(match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match: %w", err)
+		}
+		return f.rewritePaths(ctx, re, opt["replace"])
+	case "status":
+		if len(arg) == 0 {
+			return nil, errors.New("need at least one path")
+		}
+		return f.fileStatus(ctx, arg)
+	case "pending":
+		if len(arg) > 1 {
+			return nil, errors.New("pending takes at most one directory argument")
+		}
+		dir := ""
+		if len(arg) == 1 {
+			dir = arg[0]
+		}
+		status := statusPending
+		if v, ok := opt["status"]; ok {
+			status = v
+		}
+		return f.listByStatus(ctx, dir, status)
+	case "claim":
+		if _, ok := opt["worker"]; !ok {
+			if len(arg) == 0 {
+				return nil, errors.New("need at least one path")
+			}
+			return f.setStatus(ctx, arg, commandStatus[name])
+		}
+		q, err := f.parseClaimQuery(arg, opt)
+		if err != nil {
+			return nil, err
+		}
+		return f.claimFiles(ctx, q)
+	case "next":
+		if len(arg) > 1 {
+			return nil, errors.New("next takes at most one directory argument")
+		}
+		q := claimQuery{worker: opt["worker"]}
+		if len(arg) == 1 {
+			q.dir = strings.Trim(arg[0], "/")
+		}
+		var err error
+		q.lease, err = parseLease(opt)
+		if err != nil {
+			return nil, err
+		}
+		return f.next(ctx, q)
+	case "annotate":
+		if len(arg) != 2 {
+			return nil, errors.New("annotate takes a path and a JSON value")
+		}
+		return f.annotate(ctx, arg[0], arg[1])
+	case "tag", "untag":
+		if len(arg) < 2 {
+			return nil, fmt.Errorf("%s takes a path and at least one tag", name)
+		}
+		return f.tagFiles(ctx, arg[0], arg[1:], name == "untag")
+	case "release":
+		if len(arg) == 0 {
+			return nil, errors.New("need at least one path")
+		}
+		return f.releaseFiles(ctx, arg, opt["worker"])
+	case "mark-processed", "mark-failed", "reset":
+		if len(arg) == 0 {
+			return nil, errors.New("need at least one path")
+		}
+		return f.setStatus(ctx, arg, commandStatus[name])
+	case "rotate-key":
+		oldPassword, err := readPasswordOpt(opt, "old-password")
+		if err != nil {
+			return nil, err
+		}
+		limit := 0
+		if v, ok := opt["limit"]; ok {
+			limit, err = strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid limit: %w", err)
+			}
+		}
+		return f.rotateKey(ctx, oldPassword, limit)
+	case "changes":
+		limit := defaultChangesLimit
+		if v, ok := opt["limit"]; ok {
+			var err error
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit <= 0 {
+				return nil, fmt.Errorf("invalid limit %q", v)
+			}
+		}
+		since := opt["since"]
+		if dir, ok := opt["bookmark"]; ok {
+			if since != "" {
+				return nil, errors.New("can't use since and bookmark together")
+			}
+			seq, err := f.bookmarkSeq(ctx, dir)
+			if err != nil {
+				return nil, err
+			}
+			since = strconv.FormatInt(seq, 10)
+		}
+		return f.changes(ctx, since, limit)
+	case "bookmark":
+		if len(arg) == 0 {
+			return nil, errors.New("need at least one directory")
+		}
+		return f.bookmark(ctx, arg)
+	case "stats":
+		return f.stats(ctx)
+	case "health":
+		minFree, maxWAL := fs.SizeSuffix(-1), defaultHealthMaxWAL
+		if v, ok := opt["min-free"]; ok {
+			err := minFree.Set(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid min-free: %w", err)
+			}
+		}
+		if v, ok := opt["max-wal"]; ok {
+			err := maxWAL.Set(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max-wal: %w", err)
+			}
+		}
+		return f.health(ctx, minFree, maxWAL), nil
+	case "bench":
+		if len(arg) > 1 {
+			return nil, errors.New("bench takes at most one directory argument")
+		}
+		dir := ""
+		if len(arg) == 1 {
+			dir = arg[0]
+		}
+		files, size := defaultBenchFiles, defaultBenchSize
+		if v, ok := opt["files"]; ok {
+			var err error
+			files, err = strconv.Atoi(v)
+			if err != nil || files <= 0 {
+				return nil, fmt.Errorf("invalid files %q", v)
+			}
+		}
+		if v, ok := opt["size"]; ok {
+			err := size.Set(v)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("invalid size %q", v)
+			}
+		}
+		return f.bench(ctx, dir, files, size)
+	case "audit":
+		q, err := parseAuditQuery(arg, opt)
+		if err != nil {
+			return nil, err
+		}
+		return f.auditLog(ctx, q)
+	case "evict":
+		if tag, ok := opt["tag"]; ok {
+			if len(arg) > 0 {
+				return nil, errors.New("can't use tag with paths")
+			}
+			var err error
+			arg, err = f.taggedFiles(ctx, f.nsPath(""), tag)
+			if err != nil {
+				return nil, err
+			}
+			return f.evictFiles(ctx, arg)
+		}
+		if len(arg) == 0 {
+			return nil, errors.New("need at least one path")
+		}
+		return f.evictFiles(ctx, arg)
+	case "erase":
+		if len(arg) == 0 {
+			return nil, errors.New("need at least one path or pattern")
+		}
+		overwrite, err := optBool(opt, "overwrite")
+		if err != nil {
+			return nil, err
+		}
+		patterns, err := f.parseErasePatterns(arg)
+		if err != nil {
+			return nil, err
+		}
+		return f.erase(ctx, patterns, opt["reference"], overwrite)
+	case "hold", "unhold":
+		if len(arg) == 0 {
+			return nil, errors.New("need at least one path")
+		}
+		return f.hold(ctx, arg, name == "hold")
+	case "set-ttl":
+		if len(arg) == 0 {
+			return nil, errors.New("need at least one path")
+		}
+		ttl, ok := opt["ttl"]
+		if !ok {
+			return nil, errors.New("need a ttl option")
+		}
+		return f.setTTL(ctx, arg, ttl)
+	case "mark-synced":
+		if len(arg) == 0 {
+			return nil, errors.New("need at least one directory")
+		}
+		clear, err := optBool(opt, "clear")
+		if err != nil {
+			return nil, err
+		}
+		at := time.Now()
+		if v, ok := opt["at"]; ok {
+			at, err = fs.ParseTime(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid at: %w", err)
+			}
+		}
+		return f.markSynced(ctx, arg, at, clear)
+	case "sync-status":
+		if len(arg) > 1 {
+			return nil, errors.New("sync-status takes at most one directory argument")
+		}
+		dir := ""
+		if len(arg) == 1 {
+			dir = arg[0]
+		}
+		return f.syncStatus(ctx, dir, true)
+	case "warm":
+		if len(arg) > 1 {
+			return nil, errors.New("warm takes at most one directory argument")
+		}
+		q, err := f.parseSearchQuery(arg, opt)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := opt["limit"]; !ok {
+			q.limit = 0
+		}
+		concurrency := defaultWarmConcurrency
+		if v, ok := opt["concurrency"]; ok {
+			concurrency, err = strconv.Atoi(v)
+			if err != nil || concurrency <= 0 {
+				return nil, fmt.Errorf("invalid concurrency %q", v)
+			}
+		}
+		return f.warm(ctx, q, concurrency)
+	case "replication-status":
+		return f.replicationStatus(ctx, arg)
+	case "scrub":
+		if len(arg) > 1 {
+			return nil, errors.New("scrub takes at most one directory argument")
+		}
+		dir := ""
+		if len(arg) == 1 {
+			dir = arg[0]
+		}
+		bwlimit := f.opt.ScrubBwLimit
+		if v, ok := opt["bwlimit"]; ok {
+			err := bwlimit.Set(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bwlimit: %w", err)
+			}
+		}
+		return f.scrub(ctx, dir, time.Now(), bwlimit)
+	case "versions":
+		if len(arg) != 1 {
+			return nil, errors.New("versions takes one path")
+		}
+		return f.versions(ctx, arg[0])
+	case "get-version":
+		if len(arg) != 2 {
+			return nil, errors.New("get-version takes a path and a destination")
+		}
+		version, err := strconv.ParseInt(opt["version"], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", opt["version"])
+		}
+		return f.getVersion(ctx, arg[0], version, arg[1])
+	case "search":
+		q, err := f.parseSearchQuery(arg, opt)
+		if err != nil {
+			return nil, err
+		}
+		return f.search(ctx, q)
+	case "manifest":
+		if len(arg) > 1 {
+			return nil, errors.New("manifest takes at most one directory argument")
+		}
+		dir := ""
+		if len(arg) == 1 {
+			dir = strings.Trim(arg[0], "/")
+		}
+		since := opt["since"]
+		if bookmark, ok := opt["bookmark"]; ok {
+			if since != "" {
+				return nil, errors.New("can't use since and bookmark together")
+			}
+			seq, err := f.bookmarkSeq(ctx, bookmark)
+			if err != nil {
+				return nil, err
+			}
+			since = strconv.FormatInt(seq, 10)
+		}
+		format := manifestJSON
+		if v, ok := opt["format"]; ok {
+			format = v
+		}
+		return f.manifest(ctx, dir, since, format, opt["output"])
+	case "set-priority":
+		if len(arg) == 0 {
+			return nil, errors.New("need at least one path")
+		}
+		priority, err := strconv.Atoi(opt["priority"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority %q", opt["priority"])
+		}
+		return f.setPriority(ctx, arg, priority)
+	case "merge":
+		if len(arg) == 0 || len(arg) > 2 {
+			return nil, errors.New("merge takes a database and at most one root directory")
+		}
+		contentDir := ""
+		if len(arg) == 2 {
+			contentDir = arg[1]
+		}
+		conflict := mergeNewest
+		if v, ok := opt["conflict"]; ok {
+			conflict = v
+		}
+		return f.merge(ctx, arg[0], contentDir, conflict)
+	case "du":
+		if len(arg) > 1 {
+			return nil, errors.New("du takes at most one directory argument")
+		}
+		dir := ""
+		if len(arg) == 1 {
+			dir = strings.Trim(arg[0], "/")
+		}
+		switch format := opt["format"]; format {
+		case "", duJSON:
+			return f.du(ctx, dir)
+		case duNcdu:
+			return f.duNcduDump(ctx, dir)
+		default:
+			return nil, fmt.Errorf("invalid format %q", format)
+		}
+	case "tiers":
+		return f.listTiers(ctx)
+	case "wait-for-change":
+		q, err := f.parseWaitQuery(ctx, arg, opt)
+		if err != nil {
+			return nil, err
+		}
+		return f.waitForChange(ctx, q)
+	case "repair":
+		if len(arg) > 1 {
+			return nil, errors.New("repair takes at most one directory argument")
+		}
+		dir := ""
+		if len(arg) == 1 {
+			dir = strings.Trim(arg[0], "/")
+		}
+		return f.repair(ctx, dir)
+	case "verify-against":
+		if len(arg) == 0 || len(arg) > 2 {
+			return nil, errors.New("verify-against takes a remote and at most one directory")
+		}
+		dir := ""
+		if len(arg) == 2 {
+			dir = strings.Trim(arg[1], "/")
+		}
+		return f.verifyAgainst(ctx, arg[0], dir)
+	case "chunks":
+		if len(arg) != 1 {
+			return nil, errors.New("chunks takes one path")
+		}
+		return f.listChunks(ctx, arg[0])
+	case "views":
+		return f.describeViews(ctx)
+	case "snapshot-create":
+		if len(arg) > 1 {
+			return nil, errors.New("snapshot-create takes at most one name")
+		}
+		name := ""
+		if len(arg) == 1 {
+			name = arg[0]
+		}
+		return f.createGeneration(ctx, name)
+	case "snapshot-list":
+		if len(arg) == 0 {
+			return f.listGenerations(ctx)
+		} else if len(arg) > 2 {
+			return nil, errors.New("snapshot-list takes a generation and at most one directory")
+		}
+		generation, err := f.resolveGeneration(ctx, arg[0])
+		if err != nil {
+			return nil, err
+		}
+		dir := ""
+		if len(arg) == 2 {
+			dir = arg[1]
+		}
+		return f.filesAtGeneration(ctx, dir, generation)
+	default:
+		return nil, fs.ErrorCommandNotFound
+	}
+}
+
+// commandStatus maps the status changing commands to the status they set
+var commandStatus = map[string]string{
+	"claim":          statusClaimed,
+	"mark-processed": statusProcessed,
+	"mark-failed":    statusFailed,
+	"reset":          statusPending,
+}
+
+// optBool reads the boolean option name from opt
+//
+// An option given without a value, as in "-o name", counts as true
+func optBool(opt map[string]string, name string) (bool, error) {
+	v, ok := opt[name]
+	if !ok {
+		return false, nil
+	}
+	if v == "" {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,187 @@
+package virtualfs
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// Values of the ingest_compare option
+const (
+	compareAuto        = "auto"
+	compareSize        = "size"
+	compareModTime     = "modtime"
+	compareHash        = "hash"
+	compareFingerprint = "fingerprint"
+)
+
+// ingestCompare is the parsed ingest_compare option, saying which
+// attributes of a file are compared to decide if it has changed
+type ingestCompare struct {
+	auto        bool
+	size        bool
+	modTime     bool
+	hash        bool
+	fingerprint bool
+}
+
+// parseIngestCompare parses the ingest_compare option
+func parseIngestCompare(s string) (cmp ingestCompare, err error) {
+	if s == compareAuto {
+		return ingestCompare{auto: true}, nil
+	}
+	for _, name := range strings.Split(s, "+") {
+		switch strings.TrimSpace(name) {
+		case compareSize:
+			cmp.size = true
+		case compareModTime:
+			cmp.modTime = true
+		case compareHash:
+			cmp.hash = true
+		case compareFingerprint:
+			cmp.fingerprint = true
+		default:
+			return cmp, fmt.Errorf("invalid ingest_compare %q: unknown attribute %q", s, name)
+		}
+	}
+	return cmp, nil
+}
+
+// parseGlobs parses globs, the patterns of the option named option
+func parseGlobs(option string, globs fs.CommaSepList) ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(globs))
+	for _, glob := range globs {
+		re, err := filter.GlobPathToRegexp(glob, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", option, glob, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// matchAny returns true if remote matches one of patterns
+func matchAny(patterns []*regexp.Regexp, remote string) bool {
+	for _, re := range patterns {
+		if re.MatchString(remote) {
+			return true
+		}
+	}
+	return false
+}
+
+// alwaysReingest returns true if remote matches one of the
+// always_reingest patterns
+func (f *Fs) alwaysReingest(remote string) bool {
+	return matchAny(f.reingest, remote)
+}
+
+// changedFrom returns true if src differs from o in any of the
+// attributes compared by ingest_compare, or matches always_reingest or
+// is quarantined, so must be ingested again.
+//
+// Attributes the source doesn't support, such as a hash type, are left
+// out.
+func (o *Object) changedFrom(ctx context.Context, src fs.ObjectInfo) bool {
+	if o.fs.alwaysReingest(o.remote) || o.fs.hideCorrupt(o) {
+		return true
+	}
+	cmp := o.fs.compare
+	if cmp.auto {
+		if changed, known := o.fingerprintChanged(ctx, src); known {
+			return changed
+		}
+		cmp = ingestCompare{size: true, modTime: true, hash: true}
+	}
+	if cmp.size && src.Size() != o.size {
+		return true
+	}
+	if cmp.modTime && !o.fs.sameModTime(src.ModTime(ctx), o.modTime) {
+		return true
+	}
+	if cmp.fingerprint {
+		if changed, _ := o.fingerprintChanged(ctx, src); changed {
+			return true
+		}
+	}
+	if cmp.hash && o.hashChanged(ctx, src) {
+		return true
+	}
+	return false
+}
+
+// sameModTime returns true if the modification times a and b are
+// within modify_window of each other
+func (f *Fs) sameModTime(a, b time.Time) bool {
+	dt := a.Sub(b)
+	if dt < 0 {
+		dt = -dt
+	}
+	return dt <= time.Duration(f.opt.ModifyWindow)
+}
+
+// hashChanged returns true if src and o support a common hash type and
+// their hashes differ. A source which supports the type but can't give
+// the hash counts as changed.
+func (o *Object) hashChanged(ctx context.Context, src fs.ObjectInfo) bool {
+	srcFs := src.Fs()
+	if srcFs == nil {
+		return false
+	}
+	t := srcFs.Hashes().Overlap(o.fs.hashes).GetOne()
+	if t == hash.None {
+		return false
+	}
+	srcSum, err := src.Hash(ctx, t)
+	if err != nil || srcSum == "" {
+		return true
+	}
+	sum, err := o.Hash(ctx, t)
+	if err != nil || sum == "" {
+		return false
+	}
+	return srcSum != sum
+}
+
+// skipDuplicate returns true if src, changed from o, is taken to be a
+// duplicate upload of it as duplicate_window says, recording the
+// modification time of src if it is
+func (o *Object) skipDuplicate(ctx context.Context, src fs.ObjectInfo) (bool, error) {
+	window := time.Duration(o.fs.opt.DuplicateWindow)
+	if window <= 0 || o.corrupt || o.ingestedAt.IsZero() || time.Since(o.ingestedAt) > window || src.Size() != o.size ||
+		o.fs.alwaysReingest(o.remote) || !o.sameHash(ctx, src) {
+		return false, nil
+	}
+	o.fs.logOp(o.fs, "Skipping duplicate upload: %s", o.remote)
+	o.fs.countSkipped(ctx, src)
+	modTime := src.ModTime(ctx)
+	if modTime.Equal(o.modTime) {
+		return true, nil
+	}
+	return true, o.SetModTime(ctx, modTime)
+}
+
+// sameHash returns true if src and o support a common hash type and
+// their hashes of it are known and the same
+func (o *Object) sameHash(ctx context.Context, src fs.ObjectInfo) bool {
+	srcFs := src.Fs()
+	if srcFs == nil {
+		return false
+	}
+	t := srcFs.Hashes().Overlap(o.fs.hashes).GetOne()
+	if t == hash.None {
+		return false
+	}
+	srcSum, err := src.Hash(ctx, t)
+	if err != nil || srcSum == "" {
+		return false
+	}
+	sum, err := o.Hash(ctx, t)
+	return err == nil && sum == srcSum
+}
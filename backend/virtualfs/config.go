@@ -0,0 +1,215 @@
+package virtualfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configmap"
+)
+
+// Answers to the eviction question of the config wizard
+const (
+	configEvictKeep = "keep"
+	configEvictTTL  = "ttl"
+	configEvictSize = "size"
+)
+
+// Config runs the backend configuration protocol.
+//
+// After the basic options it offers to go through the choices which
+// most change how the remote behaves: where the catalog is kept, when
+// content is evicted and what deleted files leave behind. The root
+// directory and remotes already given are checked, and asked for again
+// if they can't be used.
+func Config(ctx context.Context, name string, m configmap.Mapper, config fs.ConfigIn) (*fs.ConfigOut, error) {
+	switch config.State {
+	case "":
+		return fs.ConfigConfirm("guided", true, "config_guided", `Go through how this remote keeps content?
+
+This asks where the catalog is kept, when content is evicted and what
+deleted files leave behind, which are otherwise in the advanced config.`)
+	case "guided":
+		if config.Result != "true" {
+			return nil, nil
+		}
+		return fs.ConfigGoto("root")
+	case "root":
+		root, _ := m.Get("root_directory")
+		if err := checkConfigRoot(name, root); err != nil {
+			return fs.ConfigError("root_ask", err.Error())
+		}
+		return fs.ConfigGoto("remotes")
+	case "root_ask":
+		return configAsk("root_set", "root_directory", m)
+	case "root_set":
+		return configSet("root", "root_ask", "root_directory", m, config.Result)
+	case "remotes":
+		for _, option := range []string{"origin_remote", "content_remote", "mirror_remote"} {
+			remote, _ := m.Get(option)
+			if remote == "" {
+				continue
+			}
+			if _, _, _, _, err := fs.ParseRemote(remote); err != nil {
+				return fs.ConfigError(option+"_ask", fmt.Sprintf("Can't use %s %q: %v", option, remote, err))
+			}
+		}
+		return fs.ConfigGoto("db_path")
+	case "origin_remote_ask", "content_remote_ask", "mirror_remote_ask":
+		option := strings.TrimSuffix(config.State, "_ask")
+		return configAsk(option+"_set", option, m)
+	case "origin_remote_set", "content_remote_set", "mirror_remote_set":
+		option := strings.TrimSuffix(config.State, "_set")
+		return configSet("remotes", option+"_ask", option, m, config.Result)
+	case "db_path":
+		return configAsk("db_path_set", "db_path", m)
+	case "db_path_set":
+		if config.Result != "" {
+			info, err := os.Stat(expandPath(config.Result))
+			if err == nil && info.IsDir() {
+				return fs.ConfigError("db_path", fmt.Sprintf("db_path %q is a directory: give the path of the catalog file itself, such as %q", config.Result, config.Result+"/"+dbName))
+			}
+		}
+		return configSet("evict", "db_path", "db_path", m, config.Result)
+	case "evict":
+		current := configEvictKeep
+		if v, _ := m.Get("max_cache_size"); v != "" && v != "0" && v != "off" {
+			current = configEvictSize
+		} else if v, _ := m.Get("content_ttl"); v != "" && v != "0" && v != "0s" && v != "off" {
+			current = configEvictTTL
+		}
+		return &fs.ConfigOut{
+			State: "evict_set",
+			Option: &fs.Option{
+				Name: "config_eviction",
+				Help: `When should content be evicted?
+
+Evicting content keeps the file in the catalog, so it is still listed
+and can be fetched again from origin_remote if that is set.`,
+				Default: current,
+				Examples: []fs.OptionExample{{
+					Value: configEvictKeep,
+					Help:  "Never, keep content until it is deleted.",
+				}, {
+					Value: configEvictTTL,
+					Help:  "When it hasn't been ingested or read for a time, content_ttl.",
+				}, {
+					Value: configEvictSize,
+					Help:  "When the content kept gets too big, max_cache_size.",
+				}},
+				Exclusive: true,
+			},
+		}, nil
+	case "evict_set":
+		switch config.Result {
+		case configEvictTTL:
+			return configAsk("content_ttl_set", "content_ttl", m)
+		case configEvictSize:
+			return configAsk("max_cache_size_set", "max_cache_size", m)
+		}
+		return fs.ConfigGoto("deletion")
+	case "content_ttl_set":
+		return configSet("deletion", "evict", "content_ttl", m, config.Result)
+	case "max_cache_size_set":
+		return configSet("eviction_policy", "evict", "max_cache_size", m, config.Result)
+	case "eviction_policy":
+		return configAsk("eviction_policy_set", "eviction_policy", m)
+	case "eviction_policy_set":
+		return configSet("deletion", "eviction_policy", "eviction_policy", m, config.Result)
+	case "deletion":
+		return configAsk("deletion_set", "deletion_mode", m)
+	case "deletion_set":
+		return configSet("", "deletion", "deletion_mode", m, config.Result)
+	}
+	return nil, fmt.Errorf("unknown state %q", config.State)
+}
+
+// configOption returns a copy of the option called name, with its
+// current value in m as the default so editing the config keeps it
+func configOption(name string, m configmap.Mapper) (*fs.Option, error) {
+	regInfo, err := fs.Find("virtualfs")
+	if err != nil {
+		return nil, err
+	}
+	option := regInfo.Options.Get(name)
+	if option == nil {
+		return nil, fmt.Errorf("internal error: no option %q", name)
+	}
+	option = option.Copy()
+	if value, ok := m.Get(name); ok && value != "" {
+		if option.Set(value) == nil {
+			option.Default, option.Value = option.Value, nil
+		}
+	}
+	return option, nil
+}
+
+// configAsk asks for the option called name, going to state next
+func configAsk(next, name string, m configmap.Mapper) (*fs.ConfigOut, error) {
+	option, err := configOption(name, m)
+	if err != nil {
+		return nil, err
+	}
+	return &fs.ConfigOut{State: next, Option: option}, nil
+}
+
+// configSet sets the option called name to value and goes to state
+// next, or back to the question at retry if value isn't valid for it
+func configSet(next, retry, name string, m configmap.Mapper, value string) (*fs.ConfigOut, error) {
+	regInfo, err := fs.Find("virtualfs")
+	if err != nil {
+		return nil, err
+	}
+	option := regInfo.Options.Get(name).Copy()
+	if value != "" {
+		if err := option.Set(value); err != nil {
+			return fs.ConfigError(retry, fmt.Sprintf("Invalid %s %q: %v", name, value, err))
+		}
+		if len(option.Examples) > 0 && !hasExample(option.Examples, value) {
+			return fs.ConfigError(retry, fmt.Sprintf("Invalid %s %q: want one of the choices", name, value))
+		}
+	}
+	// m falls back to the defaults, so an option left at its default
+	// isn't written
+	current, _ := m.Get(name)
+	if current != value && (value != "" || option.Default == "") {
+		m.Set(name, value)
+	}
+	return fs.ConfigGoto(next)
+}
+
+// hasExample returns true if value is one of examples
+func hasExample(examples fs.OptionExamples, value string) bool {
+	for _, example := range examples {
+		if example.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfigRoot checks the root directories in root can hold a
+// catalog and content, returning an error saying why not if they can't
+func checkConfigRoot(name, root string) error {
+	dirs, err := parseRootDirectories(name, root)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := checkRootDirectory(dir); err != nil {
+			return err
+		}
+		info, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("can't use root_directory %q: %w", dir, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("can't use root_directory %q: it is not a directory", dir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+)
+
+// Values for the conflict_policy option
+const (
+	conflictOverwrite  = "overwrite"
+	conflictNewestWins = "newest-wins"
+	conflictError      = "error"
+	conflictKeepBoth   = "keep-both"
+)
+
+// conflictSuffix is put before the extension of the second of two files
+// written at once to the same path with conflict_policy keep-both
+const conflictSuffix = "-conflict-"
+
+// errWriteConflict is returned when another upload changed a file while
+// it was being written and conflict_policy is error
+var errWriteConflict = errors.New("changed by another upload while being written")
+
+// errConflictOlder is returned by the conflict check when the file
+// written is older than the one another upload committed first, and
+// conflict_policy is newest-wins
+var errConflictOlder = errors.New("older than the file committed first")
+
+// rowQuerier is satisfied by *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// rowVersion returns what identifies the content of the live file at
+// remote, or "" if there isn't one, so a writer can tell whether
+// another has committed to it since
+func rowVersion(ctx context.Context, q rowQuerier, remote string) (string, error) {
+	var ingestedAt, hash, contentPath string
+	var modTime, size int64
+	err := q.QueryRowContext(ctx, `SELECT COALESCE(ingested_at, ''), mod_time_ns, size, COALESCE(hash, ''), COALESCE(content_path, '') FROM files WHERE remote = ? AND deleted = 0 AND is_dir = 0`,
+		remote).Scan(&ingestedAt, &modTime, &size, &hash, &contentPath)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s|%d|%d|%s|%s", ingestedAt, modTime, size, hash, contentPath), nil
+}
+
+// conflictCheck returns the check for commitContent enforcing
+// conflict_policy on o, given the version of the file when writing it
+// started, or nil if writes just overwrite each other.
+//
+// With keep-both it renames o to a free conflict name if another upload
+// got there first, before its content is moved into place.
+func (f *Fs) conflictCheck(o *Object, base string) func(ctx context.Context, tx *sql.Tx) error {
+	if f.opt.ConflictPolicy == conflictOverwrite {
+		return nil
+	}
+	return func(ctx context.Context, tx *sql.Tx) error {
+		current, err := rowVersion(ctx, tx, o.remote)
+		if err != nil || current == base || current == "" {
+			return err
+		}
+		switch f.opt.ConflictPolicy {
+		case conflictError:
+			return fserrors.NoRetryError(fmt.Errorf("%s: %w", o.remote, errWriteConflict))
+		case conflictNewestWins:
+			var modTime int64
+			err = tx.QueryRowContext(ctx, `SELECT mod_time_ns FROM files WHERE remote = ?`, o.remote).Scan(&modTime)
+			if err != nil {
+				return err
+			}
+			if !o.modTime.After(time.Unix(0, modTime)) {
+				return errConflictOlder
+			}
+			fs.Infof(nil, "VirtualFS: Replacing %s written by another upload as this one is newer", o.remote)
+			return nil
+		case conflictKeepBoth:
+			name, err := freeConflictName(ctx, tx, o.remote)
+			if err != nil {
+				return err
+			}
+			fs.Logf(nil, "VirtualFS: %s was written by another upload at the same time, keeping this one as %s", o.remote, name)
+			o.remote = name
+			return nil
+		}
+		return fmt.Errorf("invalid conflict_policy %q", f.opt.ConflictPolicy)
+	}
+}
+
+// freeConflictName returns the first name for a conflicting copy of
+// remote, such as "dir/file-conflict-1.txt", not in the catalog
+func freeConflictName(ctx context.Context, tx *sql.Tx, remote string) (string, error) {
+	dir, leaf := path.Split(remote)
+	ext := path.Ext(leaf)
+	base := strings.TrimSuffix(leaf, ext)
+	for i := 1; ; i++ {
+		name := dir + base + conflictSuffix + strconv.Itoa(i) + ext
+		var exists bool
+		err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE remote = ?)`, name).Scan(&exists)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return name, nil
+		}
+	}
+}
@@ -0,0 +1,769 @@
+package virtualfs
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rclone/rclone/backend/crypt"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/lib/file"
+)
+
+// Values for the content_layout option
+const (
+	layoutMirror = "mirror"  // content stored at the remote path
+	layoutCAS    = "cas"     // content stored once per MD5 under blobDir
+	layoutShard  = "sharded" // content stored under hash prefixed directories in shardDir
+	layoutID     = "id"      // content stored under idDir named by a random ID
+)
+
+const (
+	blobDir        = "blobs"      // directory under the root holding CAS blobs
+	shardDir       = "shards"     // directory under the root holding sharded content
+	idDir          = "ids"        // directory under the root holding content named by ID
+	incomingPrefix = ".incoming-" // prefix of content files still being written
+)
+
+// Values for the compress option
+const (
+	compressNone = "none"
+	compressZstd = "zstd"
+)
+
+// zstdSuffix is added to the names of compressed blobs to keep them
+// apart from uncompressed blobs of the same content
+const zstdSuffix = ".zst"
+
+// blobName returns the name of the blob holding content with the given
+// MD5, as stored with compression and encrypted with the key keyID
+func blobName(md5, compression, keyID string) string {
+	name := md5
+	if compression == compressZstd {
+		name += zstdSuffix
+	}
+	if keyID != "" {
+		name += "." + keyID + encryptedSuffix
+	}
+	return name
+}
+
+// encodeContent returns a writer which compresses and encrypts what is
+// written to it as configured on its way to out, and a function to
+// flush it which must be called once everything has been written
+func (f *Fs) encodeContent(out io.Writer) (w io.Writer, flush func() error, err error) {
+	var closers []io.Closer
+	flush = func() (err error) {
+		// Close the outermost layer first so it flushes into the next
+		for i := len(closers) - 1; i >= 0; i-- {
+			closeErr := closers[i].Close()
+			if err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}
+	w = out
+	if f.cipher != nil {
+		ew, err := newEncryptWriter(f.cipher, w)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create encrypter: %w", err)
+		}
+		closers = append(closers, ew)
+		w = ew
+	}
+	if f.opt.Compress == compressZstd {
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			_ = flush()
+			return nil, nil, fmt.Errorf("failed to create compressor: %w", err)
+		}
+		closers = append(closers, enc)
+		w = enc
+	}
+	return w, flush, nil
+}
+
+// content describes content written by writeContent
+type content struct {
+	size        int64                // bytes written
+	md5         string               // MD5 of the bytes written, "" if not computed
+	hashes      map[hash.Type]string // all the hashes computed of the bytes written
+	path        string               // location relative to the root directory, "" for the remote path
+	tmp         string               // where the content was written, moved into place by commitContent
+	compression string               // how the content is compressed, "" if it isn't
+	storedSize  int64                // size of the content on disk
+	keyID       string               // ID of the key the content is encrypted with, "" if it isn't
+	disk        int                  // which of the root directories the content is in
+
+	discarded bool     // set if the content wasn't kept, only its size and hashes
+	head      []byte   // the start of discarded content kept in the catalog, if any
+	chunks    []*chunk // the pieces of content stored as chunks, nil if it isn't
+	rewrite   bool     // set if these are the same bytes as the row already has, stored a different way
+	intent    int64    // ID of the ingest journal entry of the content, 0 if none
+
+	// if set, commitContent calls this first and doesn't commit if it
+	// returns an error, for rewrites which need the row unchanged
+	check func(ctx context.Context, tx *sql.Tx) error
+}
+
+// contentKey returns the path of the object's content in the store
+func (o *Object) contentKey() string {
+	return diskKey(o.disk, o.fs.contentKey(o.remote, o.contentPath))
+}
+
+// contentExists returns true if all of the content of the object is
+// in the store
+func (o *Object) contentExists(ctx context.Context) (bool, error) {
+	if !o.chunked() {
+		return o.fs.store.exists(ctx, o.contentKey())
+	}
+	keys, err := o.chunkKeys(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		found, err := o.fs.store.exists(ctx, key)
+		if err != nil || !found {
+			return false, err
+		}
+	}
+	return len(keys) > 0 || o.size == 0, nil
+}
+
+// shardPath returns the content path of remote in the sharded layout
+//
+// The file is named after the MD5 of the remote path and stored two
+// directory levels down, named from the start of that, so no directory
+// gets more than 256 entries until there are many millions of files.
+func shardPath(remote string) string {
+	sum := md5.Sum([]byte(remote))
+	name := hex.EncodeToString(sum[:])
+	return path.Join(shardDir, name[0:2], name[2:4], name)
+}
+
+// idPath returns a new content path in the id layout
+//
+// The file is named by a random ID, which nothing else is named by, and
+// stored two directory levels down like sharded content. Only the
+// catalog knows which file it belongs to.
+func idPath() (string, error) {
+	var id [16]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to make content ID: %w", err)
+	}
+	name := hex.EncodeToString(id[:])
+	return path.Join(idDir, name[0:2], name[2:4], name), nil
+}
+
+// openContent opens the content of the object for reading, undoing
+// any encryption and compression
+func (o *Object) openContent(ctx context.Context) (io.ReadCloser, error) {
+	if o.keyID != "" && o.keyID != o.fs.keyID {
+		return nil, fmt.Errorf("content of %s is encrypted with key %s which is not configured", o.remote, o.keyID)
+	}
+	return o.openContentWith(ctx, o.fs.cipher)
+}
+
+// openContentWith opens the content of the object for reading,
+// decrypting it with cipher if it is encrypted
+func (o *Object) openContentWith(ctx context.Context, cipher *crypt.Cipher) (io.ReadCloser, error) {
+	if o.chunked() {
+		return o.openChunks(ctx, cipher, 0, -1)
+	}
+	in, err := o.fs.store.open(ctx, o.contentKey())
+	if err != nil {
+		return nil, err
+	}
+	return o.decodeContent(in, cipher)
+}
+
+// decodeContent returns the content read from in, which is stored as
+// the object's content is, decrypted with cipher and decompressed
+func (o *Object) decodeContent(in io.ReadCloser, cipher *crypt.Cipher) (_ io.ReadCloser, err error) {
+	if o.keyID != "" {
+		in, err = cipher.DecryptData(in)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", o.remote, err)
+		}
+	}
+	switch o.compression {
+	case "":
+		return in, nil
+	case compressZstd:
+		dec, err := zstd.NewReader(in)
+		if err != nil {
+			_ = in.Close()
+			return nil, fmt.Errorf("failed to create decompressor: %w", err)
+		}
+		return &decompressReader{ReadCloser: dec.IOReadCloser(), in: in}, nil
+	default:
+		_ = in.Close()
+		return nil, fmt.Errorf("unknown compression %q for %s", o.compression, o.remote)
+	}
+}
+
+// decompressReader reads decompressed content, closing what it reads
+// from when it is closed
+type decompressReader struct {
+	io.ReadCloser
+	in io.Closer
+}
+
+// Close the decompressor and what it reads from
+func (r *decompressReader) Close() error {
+	err := r.ReadCloser.Close()
+	closeErr := r.in.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// blobHash returns the hash of the blob at contentPath, if it is one
+func blobHash(contentPath string) (string, bool) {
+	return strings.CutPrefix(contentPath, blobDir+"/")
+}
+
+// writeContent copies in to a new content file for remote, returning
+// a description of what was written
+//
+// size is the expected size of the content or -1 if unknown. If local
+// is set it is the path of a local file with the same bytes as in,
+// which is linked rather than copied if link_local allows. If src is
+// set it is what is being uploaded, which resume_partial resumes if an
+// earlier upload of it was interrupted.
+func (f *Fs) writeContent(ctx context.Context, remote string, in io.Reader, size int64, local string, src fs.ObjectInfo) (c *content, err error) {
+	err = f.waitIngest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !f.opt.StoreContent {
+		return f.discardContent(in)
+	}
+	metadataOnly, err := f.checkFileSize(remote, size)
+	if err != nil {
+		return nil, err
+	} else if metadataOnly {
+		return f.discardContent(in)
+	}
+	in = f.limitRate(ctx, f.limitSize(remote, in))
+	if size >= 0 {
+		err = f.checkQuota(ctx, remote, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = f.checkFreeSpace(ctx, remote, max(size, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := f.acquireWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if f.chunkedSize(size) {
+		return f.writeChunks(ctx, in)
+	}
+
+	// Content is written to a temporary file and moved into place by
+	// commitContent, so readers never see a partial file.
+	contentPath, dir, disk, err := f.contentDir(remote)
+	if err != nil {
+		return nil, err
+	}
+	if local != "" && f.canLinkContent() {
+		c, err = f.linkContent(ctx, dir, local, in)
+		if err == nil {
+			c.path, c.disk = contentPath, disk
+			return c, nil
+		} else if err != errCantLink {
+			return nil, err
+		}
+		err = nil
+	}
+	resume := f.canResume(remote, src)
+	var outFile *os.File
+	var kept int64
+	if resume {
+		outFile, kept, err = f.takePartial(ctx, remote, dir, src)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if outFile == nil {
+		outFile, err = os.CreateTemp(dir, incomingPrefix+"*")
+		if err != nil {
+			return nil, err
+		}
+	}
+	keep := false
+	var intent int64
+	if src != nil {
+		intent, err = f.beginIngest(ctx, remote, outFile.Name())
+	}
+	defer func() {
+		closeErr := outFile.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil && !keep {
+			_ = os.Remove(outFile.Name())
+		}
+		if err != nil && intent != 0 {
+			f.endIngest(ctx, intent)
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if kept > 0 {
+		var rest io.ReadCloser
+		rest, kept, err = f.resumeFrom(ctx, remote, src, in, outFile, kept)
+		if err != nil {
+			keep = f.keepPartial(ctx, remote, src, outFile, kept)
+			return nil, err
+		}
+		defer func() {
+			_ = rest.Close()
+		}()
+		in = rest
+	}
+	if !f.opt.NoPreAllocate && f.opt.Compress == compressNone {
+		// Allocating the space up front keeps the file in one piece and
+		// finds out now if the disk hasn't room for it
+		err = file.PreAllocate(size, outFile)
+		if err == file.ErrDiskFull {
+			return nil, err
+		} else if err != nil {
+			fs.Debugf(nil, "VirtualFS: Failed to pre-allocate %s: %v", remote, err)
+			err = nil
+		}
+	}
+
+	// Compute hash while copying
+	multiHasher, err := hash.NewMultiHasherTypes(f.ingestHashes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multi hasher: %w", err)
+	}
+	teeReader := in
+	if f.ingestHashes().Count() > 0 {
+		teeReader = io.TeeReader(in, multiHasher)
+		if kept > 0 {
+			// Hash what was kept of an interrupted upload first
+			_, err = io.Copy(multiHasher, io.NewSectionReader(outFile, 0, kept))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read interrupted upload: %w", err)
+			}
+		}
+	}
+
+	out, flush, err := f.encodeContent(outFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy the content and compute hash
+	written, err := f.copyContent(out, teeReader)
+	written += kept
+	flushErr := flush()
+	if err != nil && flushErr == nil && resume {
+		keep = f.keepPartial(ctx, remote, src, outFile, written)
+	}
+	if err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.opt.DurableWrites {
+		err = outFile.Sync()
+		if err != nil {
+			return nil, fmt.Errorf("failed to flush content to disk: %w", err)
+		}
+	}
+	info, err := outFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Streams of unknown size can only be checked once they are stored
+	if size < 0 {
+		err = f.checkQuota(ctx, remote, written)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c = &content{
+		size:       written,
+		md5:        multiHasher.Sums()[hash.MD5],
+		hashes:     multiHasher.Sums(),
+		path:       contentPath,
+		tmp:        outFile.Name(),
+		storedSize: info.Size(),
+		keyID:      f.keyID,
+		disk:       disk,
+		intent:     intent,
+	}
+	if f.opt.Compress == compressZstd {
+		c.compression = compressZstd
+	}
+	if f.opt.ContentLayout == layoutCAS {
+		c.path = blobDir + "/" + blobName(c.md5, c.compression, c.keyID)
+	}
+	return c, nil
+}
+
+// contentDir returns the content path to record for new content of
+// remote, "" if it is worked out from remote, and the disk and
+// directory to write it to, which it creates
+func (f *Fs) contentDir(remote string) (contentPath, dir string, disk int, err error) {
+	disk = f.pickDisk(remote)
+	switch f.opt.ContentLayout {
+	case layoutCAS:
+		// The name of a blob isn't known until it has been hashed
+		dir = f.store.stagingDir(blobDir)
+	case layoutShard:
+		contentPath = shardPath(remote)
+		dir = f.store.stagingDir(diskKey(disk, path.Dir(contentPath)))
+	case layoutID:
+		contentPath, err = idPath()
+		if err != nil {
+			return "", "", 0, err
+		}
+		dir = f.store.stagingDir(diskKey(disk, path.Dir(contentPath)))
+	default:
+		// Content with overlong names has its stand-in path recorded
+		// as it can't be worked out from the store
+		if key := f.contentKey(remote, ""); key != f.encodePath(path.Clean(remote)) {
+			contentPath = key
+		}
+		dir = f.store.stagingDir(diskKey(disk, path.Dir(f.contentKey(remote, ""))))
+	}
+	return contentPath, dir, disk, file.MkdirAll(dir, 0755)
+}
+
+// discardContent reads in to the end, returning its size and hashes
+// without keeping any of it
+func (f *Fs) discardContent(in io.Reader) (*content, error) {
+	multiHasher, err := hash.NewMultiHasherTypes(f.hashes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multi hasher: %w", err)
+	}
+	var out io.Writer = io.Discard
+	if f.hashes.Count() > 0 {
+		out = multiHasher
+	}
+	written, err := f.copyContent(out, in)
+	if err != nil {
+		return nil, err
+	}
+	return &content{
+		size:      written,
+		md5:       multiHasher.Sums()[hash.MD5],
+		hashes:    multiHasher.Sums(),
+		discarded: true,
+	}, nil
+}
+
+// errContentChanged is returned by commitContent if the row was changed
+// by something else while the content was being rewritten
+var errContentChanged = errors.New("content changed while being rewritten")
+
+// withContent returns a copy of the object with its content replaced by
+// c, which must be the same bytes stored a different way, keeping
+// everything else about it the same
+func (o *Object) withContent(c *content) *Object {
+	n := *o
+	n.evicted = false
+	n.contentPath = c.path
+	n.compression = c.compression
+	n.storedSize = c.storedSize
+	n.keyID = c.keyID
+	n.disk = c.disk
+	n.headSize = 0
+	n.corrupt = false
+	return &n
+}
+
+// commitContent moves the content c into place and records the object
+// o in the catalog, releasing whatever content it had before
+func (f *Fs) commitContent(ctx context.Context, o *Object, c *content) (err error) {
+	f.blobMu.Lock()
+	defer f.blobMu.Unlock()
+	published := false
+	defer func() {
+		if err != nil {
+			c.removeTmp()
+			// Once published the entry is left for recovery to deal with
+			// the content in place of what the catalog describes
+			if c.intent != 0 && !published {
+				f.endIngest(ctx, c.intent)
+			}
+		}
+	}()
+	posix, err := marshalPosix(o.posix)
+	if err != nil {
+		return fmt.Errorf("failed to store metadata: %w", err)
+	}
+
+	// Nothing else changes content while blobMu is held so the check
+	// still holds once the content is in place
+	if c.check != nil {
+		err = f.inTx(ctx, func(tx *sql.Tx) error {
+			return c.check(ctx, tx)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	newKey := ""
+	if !c.discarded && c.chunks == nil {
+		newKey = diskKey(c.disk, f.contentKey(o.remote, c.path))
+	}
+	exists := c.discarded
+	if _, isBlob := blobHash(c.path); isBlob {
+		exists, err = f.store.exists(ctx, newKey)
+		if err != nil {
+			return err
+		}
+	}
+	var kept *keptVersion
+	if !c.rewrite {
+		kept, err = f.keepVersion(ctx, o.remote)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				kept.undo(ctx)
+			}
+		}()
+	}
+	if c.discarded {
+		// Nothing to keep
+	} else if c.chunks != nil {
+		err = f.publishChunks(ctx, c)
+		if err != nil {
+			return err
+		}
+	} else if exists {
+		// Already have this content
+		_ = os.Remove(c.tmp)
+	} else {
+		if c.intent != 0 {
+			err = f.publishingIngest(ctx, c.intent, newKey)
+			if err != nil {
+				return err
+			}
+		}
+		err = f.store.publish(ctx, c.tmp, newKey)
+		if err != nil {
+			return fmt.Errorf("failed to move content into place: %w", err)
+		}
+		published = true
+		if f.opt.DurableWrites {
+			err = f.syncPublished(newKey)
+			if err != nil {
+				return fmt.Errorf("failed to flush content to disk: %w", err)
+			}
+		}
+	}
+
+	replStatus := ""
+	if f.opt.MirrorRemote != "" && !c.discarded {
+		replStatus = replicationPending
+	}
+	ruled := false
+	if !c.rewrite {
+		o.priority, ruled = f.rulePriority(o.remote)
+	}
+	var oldKeys []string
+	var pruned []string
+	err = f.inTx(ctx, func(tx *sql.Tx) (err error) {
+		pruned, err = f.recordVersion(ctx, tx, kept)
+		if err != nil {
+			return err
+		}
+		if !c.rewrite {
+			err = f.journalIngest(ctx, tx, o)
+			if err != nil {
+				return err
+			}
+			err = f.audit(ctx, tx, auditPut, o.remote, fmt.Sprintf("size=%d", o.size))
+			if err != nil {
+				return err
+			}
+		}
+		oldKeys, _, err = f.releaseContent(ctx, tx, o.remote)
+		if err != nil {
+			return err
+		}
+		_, err = tx.StmtContext(ctx, f.stmts.upsert).ExecContext(ctx, o.remote, o.size, o.modTime.UnixNano(), o.hasHash, o.hash,
+			o.status, formatDBTime(o.statusTime), formatDBTime(o.ingestedAt), c.discarded, formatDBTime(o.lastAccess), nullString(c.path),
+			nullString(c.compression), c.storedSize, nullString(c.keyID), nullString(replStatus), nullString(o.fingerprint), nullString(o.linkTarget), posix, c.disk, parentDir(o.remote), foldKey(o.remote), o.priority, nullString(o.sourceRemote), nullString(o.sourcePath), c.head, c.rewrite, ruled)
+		if err != nil {
+			return err
+		}
+		err = storeHashes(ctx, tx, o.remote, c.hashes)
+		if err != nil {
+			return err
+		}
+		err = recordChunks(ctx, tx, o.remote, c.chunks)
+		if err != nil {
+			return err
+		}
+		err = completeIngest(ctx, tx, c.intent)
+		if err != nil {
+			return err
+		}
+		if blob, ok := blobHash(c.path); ok {
+			_, err = tx.ExecContext(ctx, `INSERT INTO blobs (hash, size, refcount) VALUES (?, ?, 1) ON CONFLICT(hash) DO UPDATE SET refcount = refcount + 1`, blob, c.storedSize)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if f.opt.DurableWrites {
+		err = f.checkpoint(ctx)
+		if err != nil {
+			// The commit is already durable in the write ahead log
+			fs.Debugf(o, "VirtualFS: Failed to checkpoint catalog: %v", err)
+		}
+	}
+	f.objects.remove(o.remote)
+	if !c.discarded {
+		f.applyPosix(o)
+	}
+	if !c.rewrite {
+		f.wakeReplication()
+	}
+	for _, key := range pruned {
+		err = f.removeContent(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range oldKeys {
+		// The new content may be in the same blob or chunks
+		if key == newKey || c.hasChunk(key) {
+			continue
+		}
+		err = f.removeContent(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseContent drops the reference the catalog row for remote holds
+// on its content, if it has any.
+//
+// It returns the paths of the content in the store nothing refers to
+// any more, so they should be removed once tx commits, and the size of
+// the row whose content was released. It must be called with blobMu
+// held.
+func (f *Fs) releaseContent(ctx context.Context, tx *sql.Tx, remote string) (removeKeys []string, size int64, err error) {
+	var contentPath sql.NullString
+	var evicted, deleted, isDir bool
+	var disk int
+	err = tx.QueryRowContext(ctx, `SELECT content_path, size, evicted, deleted, is_dir, disk FROM files WHERE remote = ?`, remote).Scan(&contentPath, &size, &evicted, &deleted, &isDir, &disk)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if evicted || deleted || isDir {
+		return nil, 0, nil
+	}
+	if contentPath.String == chunkedContent {
+		removeKeys, err = releaseChunks(ctx, tx, remote)
+		return removeKeys, size, err
+	}
+	if blob, ok := blobHash(contentPath.String); ok {
+		unused, err := dropBlobRef(ctx, tx, blob)
+		if err != nil || !unused {
+			return nil, size, err
+		}
+	}
+	return []string{diskKey(disk, f.contentKey(remote, contentPath.String))}, size, nil
+}
+
+// dropBlobRef decrements the reference count of blob, returning true if
+// nothing refers to it any more
+func dropBlobRef(ctx context.Context, tx *sql.Tx, blob string) (unused bool, err error) {
+	_, err = tx.ExecContext(ctx, `UPDATE blobs SET refcount = refcount - 1 WHERE hash = ?`, blob)
+	if err != nil {
+		return false, err
+	}
+	var refcount int64
+	err = tx.QueryRowContext(ctx, `SELECT refcount FROM blobs WHERE hash = ?`, blob).Scan(&refcount)
+	if err == sql.ErrNoRows {
+		// Not a blob this catalog knows about so leave it alone
+		fs.Errorf(nil, "VirtualFS: Blob %s missing from catalog", blob)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if refcount > 0 {
+		return false, nil
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM blobs WHERE hash = ?`, blob)
+	return err == nil, err
+}
+
+// writePlaceholder writes an empty file at key in the store. It is
+// never stored inline as it is there for programs reading the content
+// directory.
+func (f *Fs) writePlaceholder(ctx context.Context, key string) error {
+	publish := f.store.publish
+	if s, ok := f.store.(*inlineStore); ok {
+		publish = s.publishFile
+	}
+	dir := f.store.stagingDir(path.Dir(key))
+	err := file.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, incomingPrefix+"*")
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err == nil {
+		err = publish(ctx, tmp.Name(), key)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// removeContent removes the content at key from the store, if any
+func (f *Fs) removeContent(ctx context.Context, key string) error {
+	if key == "" {
+		return nil
+	}
+	return f.store.remove(ctx, key)
+}
+
+// nullString returns s for the database, with "" as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
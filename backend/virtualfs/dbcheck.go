@@ -0,0 +1,260 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+)
+
+// Values for the db_check option
+const (
+	dbCheckOff       = "off"
+	dbCheckQuick     = "quick"
+	dbCheckIntegrity = "integrity"
+)
+
+// Values for the db_recover option
+const (
+	dbRecoverOff      = "off"
+	dbRecoverSnapshot = "snapshot"
+	dbRecoverScan     = "scan"
+)
+
+// errCatalogCorrupt is returned when the catalog fails its integrity check
+var errCatalogCorrupt = errors.New("catalog is corrupt")
+
+// integrityCheck runs the SQLite check chosen by db_check on db
+func integrityCheck(ctx context.Context, db *sql.DB, check string) error {
+	pragma := `PRAGMA quick_check`
+	if check == dbCheckIntegrity {
+		pragma = `PRAGMA integrity_check`
+	}
+	rows, err := db.QueryContext(ctx, pragma)
+	if err != nil {
+		return checkError(err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var problems []string
+	for rows.Next() {
+		var problem string
+		err = rows.Scan(&problem)
+		if err != nil {
+			return checkError(err)
+		}
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return checkError(err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errCatalogCorrupt, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkError returns err wrapped in errCatalogCorrupt if SQLite says
+// the database is damaged or isn't one at all
+func checkError(err error) error {
+	if isCorrupt(err) {
+		return fmt.Errorf("%w: %v", errCatalogCorrupt, err)
+	}
+	return err
+}
+
+// checkCatalog checks the catalog just opened as db, recovering it as
+// db_recover says if it is corrupt. It returns the database to use in
+// its place and whether it needs to be rebuilt from the content once
+// its tables are made.
+func (f *Fs) checkCatalog(ctx context.Context, db *sql.DB) (_ *sql.DB, rebuild bool, err error) {
+	err = integrityCheck(ctx, db, f.opt.DBCheck)
+	if err == nil {
+		return db, false, nil
+	}
+	if !errors.Is(err, errCatalogCorrupt) {
+		return nil, false, fmt.Errorf("failed to check catalog: %w", err)
+	}
+	if f.opt.DBRecover == dbRecoverOff || f.opt.ReadOnly {
+		_ = db.Close()
+		return nil, false, fmt.Errorf("%s: %w, restore it with the \"restore-db\" backend command or set db_recover", f.dbFile, err)
+	}
+	fs.Errorf(nil, "VirtualFS: %s: %v", f.dbFile, err)
+
+	// Find the snapshot first so a catalog which can't be recovered
+	// is left where it is
+	var src string
+	if f.opt.DBRecover == dbRecoverSnapshot {
+		src, err = f.newestSnapshot(ctx)
+		if err != nil {
+			_ = db.Close()
+			return nil, false, fmt.Errorf("failed to find a snapshot to recover the catalog from: %w", err)
+		}
+	} else if err = f.checkRebuild(); err != nil {
+		_ = db.Close()
+		return nil, false, err
+	}
+	_ = db.Close()
+	aside, err := moveAsideDB(f.dbFile)
+	if err != nil {
+		return nil, false, err
+	}
+	fs.Errorf(nil, "VirtualFS: Moved corrupt catalog aside to %s", aside)
+	db, err = f.openDB(f.dbFile, false)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open database: %w", err)
+	}
+	if src == "" {
+		return db, true, nil
+	}
+	err = restoreSnapshot(ctx, db, src)
+	if err != nil {
+		_ = db.Close()
+		return nil, false, err
+	}
+	fs.Logf(nil, "VirtualFS: Recovered catalog from %s, changes since then are lost", src)
+	return db, false, nil
+}
+
+// moveAsideDB renames the database at dbPath and its write ahead log
+// out of the way, returning the new name of the database
+func moveAsideDB(dbPath string) (string, error) {
+	aside := dbPath + "-corrupt-" + time.Now().UTC().Format(snapshotLayout)
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		err := os.Rename(dbPath+suffix, aside+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to move corrupt catalog aside: %w", err)
+		}
+	}
+	return aside, nil
+}
+
+// newestSnapshot returns the path of the newest snapshot in the
+// default snapshot directory or catalog_backup
+func (f *Fs) newestSnapshot(ctx context.Context) (string, error) {
+	newest, err := f.latestSnapshot()
+	if err != nil && f.opt.CatalogBackup == "" {
+		return "", err
+	}
+	if f.opt.CatalogBackup == "" {
+		return newest, nil
+	}
+	dst, err := cache.Get(ctx, f.opt.CatalogBackup)
+	if err != nil && err != fs.ErrorIsFile {
+		return "", fmt.Errorf("failed to open catalog_backup: %w", err)
+	}
+	names, err := listSnapshots(ctx, dst)
+	if err != nil {
+		return "", err
+	}
+	if len(names) > 0 && (newest == "" || names[len(names)-1] > path.Base(newest)) {
+		dir := f.opt.CatalogBackup
+		if !strings.HasSuffix(dir, "/") && !strings.HasSuffix(dir, ":") {
+			dir += "/"
+		}
+		return dir + names[len(names)-1], nil
+	}
+	if newest == "" {
+		return "", fmt.Errorf("no snapshots found in %s or catalog_backup", snapshotDir)
+	}
+	return newest, nil
+}
+
+// checkRebuild returns an error if the catalog can't be rebuilt from
+// the content. Only content stored as it is at its own path can be.
+func (f *Fs) checkRebuild() error {
+	if _, ok := f.localPath(""); !ok || f.opt.ContentLayout != layoutMirror || f.opt.Compress != compressNone || f.cipher != nil {
+		return errors.New("the catalog can only be rebuilt from local content in the mirror layout without compression or encryption")
+	}
+	return nil
+}
+
+// rebuiltFile is a content file found by rebuildCatalog
+type rebuiltFile struct {
+	disk    int
+	remote  string
+	size    int64
+	modTime time.Time
+}
+
+// rebuildCatalog fills an empty catalog with a row for each content
+// file, pending processing with its hashes still to be worked out.
+// Empty files named like placeholders are taken to be placeholders.
+func (f *Fs) rebuildCatalog(ctx context.Context) error {
+	var files []rebuiltFile
+	err := f.store.walk(ctx, func(key string, modTime time.Time) error {
+		p, _ := f.localPath(key)
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if info.Size() == 0 && strings.HasSuffix(key, placeholderSuffix) {
+			return nil
+		}
+		disk, rel := splitDiskKey(key)
+		files = append(files, rebuiltFile{disk: disk, remote: f.storeRemote(rel), size: info.Size(), modTime: modTime})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan content: %w", err)
+	}
+	now := formatDBTime(time.Now())
+	err = f.inTx(ctx, func(tx *sql.Tx) error {
+		dirs := map[string]bool{}
+		for _, file := range files {
+			for dir := parentDir(file.remote); dir != "" && !dirs[dir]; dir = parentDir(dir) {
+				dirs[dir] = true
+				_, err := tx.ExecContext(ctx, `INSERT INTO files (remote, size, mod_time_ns, has_hash, hash, deleted, is_dir, parent, key) VALUES (?, 0, ?, 0, '', 0, 1, ?, ?) ON CONFLICT(remote) DO NOTHING`,
+					dir, time.Now().UnixNano(), parentDir(dir), foldKey(dir))
+				if err != nil {
+					return fmt.Errorf("failed to insert directory %s: %w", dir, err)
+				}
+			}
+			priority, ruled := f.rulePriority(file.remote)
+			_, err := tx.StmtContext(ctx, f.stmts.upsert).ExecContext(ctx, file.remote, file.size, file.modTime.UnixNano(), false, "",
+				statusPending, now, now, false, now, nil,
+				nil, file.size, nil, nil, nil, nil, nil, file.disk, parentDir(file.remote), foldKey(file.remote), priority, nil, nil, nil, false, ruled)
+			if err != nil {
+				return fmt.Errorf("failed to insert %s: %w", file.remote, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fs.Logf(nil, "VirtualFS: Rebuilt catalog from %d content files, their metadata beyond size and modification time is lost", len(files))
+	return nil
+}
+
+// restoreSnapshot copies the snapshot at src, a local or remote path,
+// into db
+func restoreSnapshot(ctx context.Context, db *sql.DB, src string) error {
+	localPath, cleanup, err := fetchSnapshot(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	snap, err := openSnapshot(ctx, localPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = snap.Close()
+	}()
+	err = copyDatabase(ctx, db, snap)
+	if err != nil {
+		return fmt.Errorf("failed to restore catalog: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// deletingDir is the directory under each root directory content is
+// moved to for the deletion worker to remove
+const deletingDir = internalDir + "/deleting"
+
+// deleteInterval is how often the deletion worker looks for content to
+// remove without being woken
+const deleteInterval = time.Hour
+
+// removeBatchSize is the most files tombstoned in one transaction
+const removeBatchSize = 1000
+
+// removeQueue collects the files being removed at the same time so
+// they can share a transaction
+type removeQueue struct {
+	mu      sync.Mutex
+	pending []removeRequest
+	running bool // set while a Remove is tombstoning the pending files
+}
+
+// removeRequest asks for o to be tombstoned
+type removeRequest struct {
+	o    *Object
+	done chan error // receives the result once removed
+}
+
+// removeQueued removes o along with any other files being removed at
+// the same time. The first to arrive tombstones the files queued
+// behind it in batches until there are none left, so a sync deleting
+// many files at once doesn't commit a transaction for each.
+func (f *Fs) removeQueued(ctx context.Context, o *Object) error {
+	req := removeRequest{o: o, done: make(chan error, 1)}
+	q := &f.removals
+	q.mu.Lock()
+	q.pending = append(q.pending, req)
+	if q.running {
+		q.mu.Unlock()
+		return <-req.done
+	}
+	q.running = true
+	// The others waiting shouldn't fail because this one gave up
+	ctx = context.WithoutCancel(ctx)
+	for len(q.pending) > 0 {
+		n := min(len(q.pending), removeBatchSize)
+		reqs := q.pending[:n:n]
+		q.pending = q.pending[n:]
+		q.mu.Unlock()
+		objects := make([]*Object, len(reqs))
+		for i := range reqs {
+			objects[i] = reqs[i].o
+		}
+		errs := f.removeObjects(ctx, objects)
+		for i := range reqs {
+			reqs[i].done <- errs[i]
+		}
+		q.mu.Lock()
+	}
+	q.running = false
+	q.mu.Unlock()
+	return <-req.done
+}
+
+// writeDeletePlaceholder creates the .delete placeholder file marking
+// o as deleted, unless a file of that name is stored there already
+func (o *Object) writeDeletePlaceholder(ctx context.Context) error {
+	if o.fs.opt.DeletionMode != deletionPlaceholder {
+		return nil
+	}
+	taken, err := o.fs.placeholderTaken(ctx, o.remote)
+	if err != nil {
+		return err
+	}
+	if taken {
+		fs.Debugf(o, "VirtualFS: Not writing delete placeholder over %s", o.remote+placeholderSuffix)
+		return nil
+	}
+	err = o.fs.writePlaceholder(ctx, o.fs.placeholderKey(o.remote))
+	if err != nil {
+		return fmt.Errorf("failed to create delete placeholder: %w", err)
+	}
+	return nil
+}
+
+// removeObjects tombstones objects in a single transaction then
+// removes their content, returning what happened to each. Their
+// placeholders must have been written already.
+func (f *Fs) removeObjects(ctx context.Context, objects []*Object) []error {
+	errs := make([]error, len(objects))
+	f.blobMu.Lock()
+	defer f.blobMu.Unlock()
+
+	now := time.Now()
+	removeKeys := make([][]string, len(objects))
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		for i, o := range objects {
+			var err error
+			removeKeys[i], _, err = f.releaseContent(ctx, tx, o.remote)
+			if err != nil {
+				return err
+			}
+			if f.opt.HardDelete {
+				err = forgetFile(ctx, tx, o.remote)
+			} else {
+				_, err = tx.StmtContext(ctx, f.stmts.remove).ExecContext(ctx, now.UnixNano(), formatDBTime(now), o.remote)
+			}
+			if err != nil {
+				return err
+			}
+			err = f.audit(ctx, tx, auditRemove, o.remote, "")
+			if err != nil {
+				return err
+			}
+			err = f.journalChange(ctx, tx, o.remote, eventDelete, o.size, o.hash)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	for i, o := range objects {
+		f.objects.remove(o.remote)
+		errs[i] = o.removedContent(ctx, removeKeys[i])
+		o.deleted = true
+		f.metrics.tombstoned.Add(1)
+		f.events.add(eventDelete, o.remote, o.size)
+		f.removeLink(o.remote)
+		f.afterChange(o.remote)
+	}
+	return errs
+}
+
+// removedContent removes the content at removeKeys released when o
+// was tombstoned, leaving an empty file in its place if deletion_mode
+// says
+func (o *Object) removedContent(ctx context.Context, removeKeys []string) error {
+	zeroKey := ""
+	if o.fs.opt.DeletionMode == deletionZeroByte {
+		zeroKey = o.fs.contentKey(o.remote, "")
+	}
+	for _, key := range removeKeys {
+		if key == zeroKey {
+			continue
+		}
+		err := o.fs.removeContentLater(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	if zeroKey != "" {
+		// Put in place of the content, so only once it is released
+		err := o.fs.writePlaceholder(ctx, zeroKey)
+		if err != nil {
+			return fmt.Errorf("failed to create empty file in place of deleted file: %w", err)
+		}
+	}
+	return nil
+}
+
+// Purge removes dir and everything under it, tombstoning the files
+// removeBatchSize to a transaction rather than one at a time
+func (f *Fs) Purge(ctx context.Context, dir string) error {
+	f.logOp(nil, "VirtualFS: Purge called for directory %s", dir)
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
+	dir, err := f.resolveCase(ctx, f.absPath(f.normalize(dir)))
+	if err != nil {
+		return err
+	}
+	err = f.checkDirExists(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	cond, args := inDir(dir)
+	objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE `+cond+` AND deleted = 0 AND is_dir = 0`, args...)
+	if err != nil {
+		return err
+	}
+	// Nothing goes unless all of it can
+	for _, o := range objects {
+		err = o.checkChangeable()
+		if err != nil {
+			return err
+		}
+	}
+	for _, o := range objects {
+		err = o.writeDeletePlaceholder(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	for len(objects) > 0 {
+		n := min(len(objects), removeBatchSize)
+		for _, err := range f.removeObjects(ctx, objects[:n]) {
+			if err != nil {
+				return err
+			}
+		}
+		objects = objects[n:]
+	}
+
+	// A directory sorts before everything in it, so this empties the
+	// deepest first
+	dirs, err := f.queryRemotes(ctx, `SELECT remote FROM files WHERE `+cond+` AND deleted = 0 AND is_dir = 1 ORDER BY remote DESC`, args...)
+	if err != nil {
+		return err
+	}
+	if dir != "" {
+		dirs = append(dirs, dir)
+	}
+	for _, d := range dirs {
+		err = f.removePlaceholders(ctx, d)
+		if err != nil {
+			return err
+		}
+		err = f.store.rmdir(ctx, f.storePath(d))
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	return f.inTx(ctx, func(tx *sql.Tx) error {
+		for _, d := range dirs {
+			err := f.removeDir(ctx, tx, d, now)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// forgetFile removes every trace of the file at remote from the
+// catalog, rather than tombstoning it, for hard_delete
+func forgetFile(ctx context.Context, tx *sql.Tx, remote string) error {
+	for _, query := range []string{
+		`DELETE FROM files WHERE remote = ?`,
+		`DELETE FROM hashes WHERE remote = ?`,
+		`DELETE FROM tags WHERE remote = ?`,
+	} {
+		_, err := tx.ExecContext(ctx, query, remote)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeDir marks the directory dir deleted in the catalog, like a
+// file, or forgets it if hard_delete is set
+func (f *Fs) removeDir(ctx context.Context, tx *sql.Tx, dir string, now time.Time) error {
+	if f.opt.HardDelete {
+		_, err := tx.ExecContext(ctx, `DELETE FROM files WHERE remote = ? AND is_dir = 1`, dir)
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `UPDATE files SET deleted = 1, mod_time_ns = ?, deleted_at = ? WHERE remote = ? AND is_dir = 1 AND deleted = 0`, now.UnixNano(), formatDBTime(now), dir)
+	return err
+}
+
+// removeContentLater removes the content at key, or if async_delete
+// is set moves it into the deleting directory of its disk for the
+// deletion worker to remove. The rename is quick however big the
+// content and frees key for new content straight away.
+func (f *Fs) removeContentLater(ctx context.Context, key string) error {
+	if f.deleteWake == nil || key == "" || f.isInline(key) {
+		// Removing inline content is as quick as moving it
+		return f.removeContent(ctx, key)
+	}
+	disk, _ := splitDiskKey(key)
+	aside := diskKey(disk, path.Join(deletingDir, strconv.FormatInt(time.Now().UnixNano(), 36)+"-"+strconv.FormatInt(f.deleteSeq.Add(1), 36)))
+	err := f.store.move(ctx, key, aside)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	select {
+	case f.deleteWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// deleteAside removes everything in the deleting directories, which
+// holds the content of deleted files when async_delete is set
+func (f *Fs) deleteAside(ctx context.Context) error {
+	for _, root := range f.localRoots() {
+		dir := filepath.Join(root, deletingDir)
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			err = os.RemoveAll(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
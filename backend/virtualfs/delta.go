@@ -0,0 +1,46 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// hideProcessed returns true if o is left out of listings as the delta
+// option is set and it has been dealt with already
+func (f *Fs) hideProcessed(o *Object) bool {
+	return f.opt.Delta && o.status != statusPending
+}
+
+// markRead marks o processed now it has been read in full, as long as
+// it hasn't been ingested again or moved on by a consumer since it was
+// listed
+func (o *Object) markRead(ctx context.Context) {
+	// The reader may be closed as the transfer finishes
+	ctx = context.WithoutCancel(ctx)
+	now := time.Now()
+	var n int64
+	err := o.fs.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE files SET status = ?, status_time = ? WHERE remote = ? AND ingested_at = ? AND size = ? AND hash = ? AND status = ? AND deleted = 0`,
+			statusProcessed, formatDBTime(now), o.remote, formatDBTime(o.ingestedAt), o.size, o.hash, statusPending)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		if err != nil || n == 0 {
+			return err
+		}
+		return o.fs.audit(ctx, tx, auditStatus, o.remote, statusProcessed)
+	})
+	if err != nil {
+		fs.Errorf(nil, "VirtualFS: Failed to mark %s processed after read: %v", o.remote, err)
+		return
+	}
+	o.fs.objects.remove(o.remote)
+	if n > 0 {
+		o.status, o.statusTime = statusProcessed, now
+		o.fs.logOp(nil, "VirtualFS: Marked %s processed after read", o.remote)
+	}
+}
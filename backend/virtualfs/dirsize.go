@@ -0,0 +1,52 @@
+package virtualfs
+
+import (
+	"context"
+)
+
+// dirTotal is the number of files below a directory and their total size
+type dirTotal struct {
+	items int64
+	size  int64
+}
+
+// dirTotals returns the totals of the files below each subdirectory of
+// dir, keyed by the path of the subdirectory.
+//
+// Every remote below "a/b" sorts between "a/b/" and "a/b0" as "0"
+// follows "/", so the totals are read from a range of the primary key.
+// The remotes are cut as blobs so the lengths are in bytes, x'2f' being
+// "/" as a blob.
+func (f *Fs) dirTotals(ctx context.Context, dir string) (map[string]dirTotal, error) {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	query := `SELECT CAST(substr(CAST(remote AS BLOB), 1, ? + instr(substr(CAST(remote AS BLOB), ? + 1), x'2f') - 1) AS TEXT) AS child, COUNT(*), COALESCE(SUM(size), 0)
+		FROM files WHERE parent != ? AND deleted = 0 AND is_dir = 0`
+	args := []interface{}{len(prefix), len(prefix), dir}
+	if dir != "" {
+		query += ` AND remote >= ? AND remote < ?`
+		args = append(args, prefix, dir+"0")
+	}
+	query += ` GROUP BY child`
+
+	rows, err := f.rdb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	totals := map[string]dirTotal{}
+	for rows.Next() {
+		var child string
+		var total dirTotal
+		err = rows.Scan(&child, &total.items, &total.size)
+		if err != nil {
+			return nil, err
+		}
+		totals[child] = total
+	}
+	return totals, rows.Err()
+}
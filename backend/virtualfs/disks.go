@@ -0,0 +1,282 @@
+package virtualfs
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+const (
+	distributeHash = "hash" // disk chosen from the hash of the remote path
+	distributeFree = "free" // disk with the most free space chosen
+)
+
+// diskMark starts the keys of content on the disks after the first.
+// Names in the store can't contain it so the keys of the first disk,
+// which are unmarked, never look like one.
+const diskMark = "\x00"
+
+// diskKey returns the key in the store of the content at key on disk
+func diskKey(disk int, key string) string {
+	if disk == 0 {
+		return key
+	}
+	return path.Join(diskMark+strconv.Itoa(disk), key)
+}
+
+// splitDiskKey reverses diskKey
+func splitDiskKey(key string) (disk int, rel string) {
+	if !strings.HasPrefix(key, diskMark) {
+		return 0, key
+	}
+	first, rel, _ := strings.Cut(key[len(diskMark):], "/")
+	disk, err := strconv.Atoi(first)
+	if err != nil {
+		return 0, key
+	}
+	return disk, rel
+}
+
+// parseRootDirectories splits the root_directory option into the
+// directories content is spread across, expanding each, or returns the
+// default root directory of the remote called name if it isn't set
+func parseRootDirectories(name, roots string) ([]string, error) {
+	var dirs fs.CommaSepList
+	err := dirs.Set(roots)
+	if err != nil {
+		return nil, fmt.Errorf("invalid root_directory: %w", err)
+	}
+	if len(dirs) == 0 {
+		return []string{defaultRootDirectory(name)}, nil
+	}
+	for i, dir := range dirs {
+		dirs[i] = expandPath(dir)
+	}
+	return dirs, nil
+}
+
+// pickDisk returns the disk new content for remote is stored on
+func (f *Fs) pickDisk(remote string) int {
+	disks, ok := f.baseStore().(*diskStore)
+	if !ok {
+		return 0
+	}
+	if disk, ok := f.routeDisk(remote); ok {
+		return disk
+	}
+	n := len(disks.disks)
+	if f.opt.Distribution == distributeFree {
+		best, bestFree := 0, int64(-1)
+		for i, disk := range disks.disks {
+			avail, err := freeSpace(disk.root)
+			if err != nil {
+				fs.Debugf(nil, "VirtualFS: Can't read free space of %s: %v", disk.root, err)
+				continue
+			}
+			if avail > bestFree {
+				best, bestFree = i, avail
+			}
+		}
+		return best
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(remote))
+	return int(h.Sum32() % uint32(n))
+}
+
+// localPath returns the local path of the content at key if the store
+// is local, or false if it isn't or the content is stored inline
+func (f *Fs) localPath(key string) (string, bool) {
+	if f.isInline(key) {
+		return "", false
+	}
+	switch store := f.baseStore().(type) {
+	case *localStore:
+		return store.path(key), true
+	case *diskStore:
+		disk, rel := store.disk(key)
+		return disk.path(rel), true
+	}
+	return "", false
+}
+
+// localRoots returns the local root directories content is kept in,
+// or nil if it is kept in content_remote
+func (f *Fs) localRoots() []string {
+	switch store := f.baseStore().(type) {
+	case *localStore:
+		return []string{store.root}
+	case *diskStore:
+		roots := make([]string, 0, len(store.disks))
+		for _, disk := range store.disks {
+			roots = append(roots, disk.root)
+		}
+		for _, n := range store.tierDisks() {
+			roots = append(roots, store.tiers[n].root)
+		}
+		return roots
+	}
+	return nil
+}
+
+// displayKey returns key as shown to users, the keys of the disks
+// after the first being shown as their local paths
+func (f *Fs) displayKey(key string) string {
+	if n, _ := splitDiskKey(key); n == 0 {
+		return key
+	}
+	p, _ := f.localPath(key)
+	return filepath.ToSlash(p)
+}
+
+// quarantineKey returns where the content at key is quarantined, on
+// the same disk
+func quarantineKey(key string) string {
+	disk, rel := splitDiskKey(key)
+	return diskKey(disk, path.Join(quarantineDir, rel))
+}
+
+// checkDisks returns an error if the catalog has content in more than
+// the n root directories configured, or in content_routing tiers it
+// has no record of
+func (f *Fs) checkDisks(n int) error {
+	var disks, unknown int
+	err := f.db.QueryRow(`SELECT COALESCE(MAX(disk), 0) + 1 FROM files WHERE disk < ?`, firstTierDisk).Scan(&disks)
+	if err == nil {
+		err = f.db.QueryRow(`SELECT COUNT(*) FROM files WHERE disk >= ? AND disk NOT IN (SELECT disk FROM content_tiers)`, firstTierDisk).Scan(&unknown)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read root directories in use: %w", err)
+	}
+	if disks > n {
+		return fmt.Errorf("catalog has content in %d root directories but only %d are configured", disks, n)
+	}
+	if unknown > 0 {
+		return fmt.Errorf("catalog has %d files in content tiers it has no record of", unknown)
+	}
+	return nil
+}
+
+// diskStore spreads content across several local directories, the
+// first of which also holds the directories backing the remote's
+// directory structure, and the content_routing tiers
+type diskStore struct {
+	disks []*localStore
+	tiers map[int]*localStore // tiers which aren't root directories by disk number
+}
+
+// tierDisks returns the disk numbers of the tiers in order
+func (s *diskStore) tierDisks() []int {
+	disks := make([]int, 0, len(s.tiers))
+	for n := range s.tiers {
+		disks = append(disks, n)
+	}
+	sort.Ints(disks)
+	return disks
+}
+
+// disk returns the disk of key and the path on it
+func (s *diskStore) disk(key string) (*localStore, string) {
+	n, rel := splitDiskKey(key)
+	if tier, ok := s.tiers[n]; ok {
+		return tier, rel
+	}
+	if n >= len(s.disks) {
+		// checkDisks makes sure the catalog has no keys like this, so
+		// look where nothing can be found rather than on another disk
+		return &localStore{root: filepath.Join(s.disks[0].root, stagingDir, "missing-disk-"+strconv.Itoa(n))}, rel
+	}
+	return s.disks[n], rel
+}
+
+func (s *diskStore) stagingDir(dir string) string {
+	disk, rel := s.disk(dir)
+	return disk.stagingDir(rel)
+}
+
+func (s *diskStore) publish(ctx context.Context, tmp, p string) error {
+	disk, rel := s.disk(p)
+	return disk.publish(ctx, tmp, rel)
+}
+
+func (s *diskStore) open(ctx context.Context, p string) (io.ReadCloser, error) {
+	disk, rel := s.disk(p)
+	return disk.open(ctx, rel)
+}
+
+func (s *diskStore) exists(ctx context.Context, p string) (bool, error) {
+	disk, rel := s.disk(p)
+	return disk.exists(ctx, rel)
+}
+
+func (s *diskStore) remove(ctx context.Context, p string) error {
+	disk, rel := s.disk(p)
+	return disk.remove(ctx, rel)
+}
+
+func (s *diskStore) move(ctx context.Context, src, dst string) error {
+	srcDisk, srcRel := s.disk(src)
+	dstDisk, dstRel := s.disk(dst)
+	if srcDisk != dstDisk {
+		return fmt.Errorf("can't move %s to %s on another disk", src, dst)
+	}
+	return srcDisk.move(ctx, srcRel, dstRel)
+}
+
+// mkdir makes the directory on the first disk, the others getting
+// directories as content is stored in them
+func (s *diskStore) mkdir(ctx context.Context, dir string) error {
+	disk, rel := s.disk(dir)
+	return disk.mkdir(ctx, rel)
+}
+
+// rmdir removes the directory from every disk, returning
+// fs.ErrorDirNotFound only if the first disk hasn't got it
+func (s *diskStore) rmdir(ctx context.Context, dir string) error {
+	if n, _ := splitDiskKey(dir); n != 0 {
+		disk, rel := s.disk(dir)
+		return disk.rmdir(ctx, rel)
+	}
+	others := append([]*localStore{}, s.disks[1:]...)
+	for _, n := range s.tierDisks() {
+		others = append(others, s.tiers[n])
+	}
+	for _, disk := range others {
+		err := disk.rmdir(ctx, dir)
+		if err != nil && err != fs.ErrorDirNotFound {
+			return err
+		}
+	}
+	return s.disks[0].rmdir(ctx, dir)
+}
+
+func (s *diskStore) walk(ctx context.Context, fn func(p string, modTime time.Time) error) error {
+	disks := make([]int, 0, len(s.disks)+len(s.tiers))
+	for i := range s.disks {
+		disks = append(disks, i)
+	}
+	disks = append(disks, s.tierDisks()...)
+	for _, n := range disks {
+		n := n
+		disk, _ := s.disk(diskKey(n, ""))
+		err := disk.walk(ctx, func(p string, modTime time.Time) error {
+			return fn(diskKey(n, p), modTime)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the interfaces are satisfied
+var _ contentStore = (*diskStore)(nil)
@@ -0,0 +1,147 @@
+package virtualfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/walk"
+)
+
+// driftResult is returned by the verify-against command
+type driftResult struct {
+	Checked            int          `json:"checked"`              // files in the catalog or the origin compared
+	Changed            []driftEntry `json:"changed"`              // files which differ between them
+	MissingUpstream    []string     `json:"missing_upstream"`     // files in the catalog but not the origin
+	MissingFromCatalog []string     `json:"missing_from_catalog"` // files in the origin but not the catalog
+}
+
+// driftEntry is a file which differs between the catalog and the origin
+type driftEntry struct {
+	Path      string   `json:"path"`
+	Differs   []string `json:"differs"` // the attributes which differ: size, modtime or a hash type
+	Size      int64    `json:"size"`
+	Upstream  int64    `json:"upstream_size"`
+	ModTime   string   `json:"mod_time"`
+	UpModTime string   `json:"upstream_mod_time"`
+}
+
+// verifyAgainst lists the files at or below dir in the origin, an
+// rclone path whose root is the root of the catalog, and compares each
+// with the catalog by size, modification time and any hash both have,
+// without reading any content here. Hashes the catalog hasn't stored
+// are left out, though the origin may need to read its files to give
+// its own.
+func (f *Fs) verifyAgainst(ctx context.Context, origin, dir string) (*driftResult, error) {
+	if err := f.checkDirExists(ctx, dir); err != nil {
+		return nil, err
+	}
+	fsrc, err := cache.Get(ctx, origin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open origin %q: %w", origin, err)
+	}
+	cond, args := inDir(dir)
+	objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE `+cond+` AND deleted = 0 AND is_dir = 0`, args...)
+	if err != nil {
+		return nil, err
+	}
+	catalog := make(map[string]*Object, len(objects))
+	for _, o := range objects {
+		catalog[o.remote] = o
+	}
+
+	res := &driftResult{Changed: []driftEntry{}, MissingUpstream: []string{}, MissingFromCatalog: []string{}}
+	window := fs.GetModifyWindow(ctx, f, fsrc)
+	types := fsrc.Hashes().Overlap(f.hashes)
+	err = walk.ListR(ctx, fsrc, dir, true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+		for _, entry := range entries {
+			src, ok := entry.(fs.Object)
+			if !ok {
+				continue
+			}
+			res.Checked++
+			o, ok := catalog[src.Remote()]
+			if !ok {
+				res.MissingFromCatalog = append(res.MissingFromCatalog, src.Remote())
+				continue
+			}
+			delete(catalog, src.Remote())
+			differs, err := o.driftFrom(ctx, src, window, types)
+			if err != nil {
+				return err
+			}
+			if len(differs) > 0 {
+				res.Changed = append(res.Changed, driftEntry{
+					Path:      o.remote,
+					Differs:   differs,
+					Size:      o.size,
+					Upstream:  src.Size(),
+					ModTime:   formatTime(o.modTime),
+					UpModTime: formatTime(src.ModTime(ctx)),
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+		return nil, fmt.Errorf("failed to list origin: %w", err)
+	}
+	for remote := range catalog {
+		res.Checked++
+		res.MissingUpstream = append(res.MissingUpstream, remote)
+	}
+	sort.Slice(res.Changed, func(i, j int) bool {
+		return res.Changed[i].Path < res.Changed[j].Path
+	})
+	sort.Strings(res.MissingUpstream)
+	sort.Strings(res.MissingFromCatalog)
+	fs.Infof(nil, "VirtualFS: Verified %d files against %s: %d changed, %d missing upstream, %d missing from the catalog",
+		res.Checked, origin, len(res.Changed), len(res.MissingUpstream), len(res.MissingFromCatalog))
+	return res, nil
+}
+
+// driftFrom returns the attributes in which src, the file in the
+// origin, differs from o. The modification times are compared within
+// window and only the hashes of types the catalog has stored.
+func (o *Object) driftFrom(ctx context.Context, src fs.Object, window time.Duration, types hash.Set) ([]string, error) {
+	var differs []string
+	if src.Size() >= 0 && src.Size() != o.size {
+		differs = append(differs, "size")
+	}
+	if window != fs.ModTimeNotSupported {
+		dt := src.ModTime(ctx).Sub(o.modTime)
+		if dt >= window || dt <= -window {
+			differs = append(differs, "modtime")
+		}
+	}
+	for _, t := range types.Array() {
+		sum := ""
+		if t == hash.MD5 {
+			if o.hasHash {
+				sum = o.hash
+			}
+		} else {
+			var err error
+			sum, err = o.fs.lookupHash(ctx, o.remote, t)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if sum == "" {
+			continue
+		}
+		srcSum, err := src.Hash(ctx, t)
+		if err != nil || srcSum == "" {
+			continue
+		}
+		if srcSum != sum {
+			differs = append(differs, t.String())
+		}
+	}
+	return differs, nil
+}
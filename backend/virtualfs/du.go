@@ -0,0 +1,203 @@
+package virtualfs
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Values for the format of the du command
+const (
+	duJSON = "json"
+	duNcdu = "ncdu"
+)
+
+// duCount is a number of files and their total size
+type duCount struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// duEntry is the usage of a directory and everything below it
+type duEntry struct {
+	Path    string  `json:"path"`
+	Cached  duCount `json:"cached"`  // live files with their content stored
+	Evicted duCount `json:"evicted"` // live files whose content has been evicted
+	Deleted duCount `json:"deleted"` // files kept in the catalog as deleted
+}
+
+// du returns the usage of dir and of every directory below it, in path
+// order. The files directly in each directory are counted by SQLite and
+// the counts added to the directories above.
+func (f *Fs) du(ctx context.Context, dir string) ([]*duEntry, error) {
+	if err := f.checkDirExists(ctx, dir); err != nil {
+		return nil, err
+	}
+	cond, args := inDir(dir)
+	usage := map[string]*duEntry{dir: {Path: dir}}
+	dirs, err := f.queryRemotes(ctx, `SELECT remote FROM files WHERE `+cond+` AND deleted = 0 AND is_dir = 1`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		usage[d] = &duEntry{Path: d}
+	}
+
+	rows, err := f.rdb.QueryContext(ctx, `SELECT parent, deleted, evicted, COUNT(*), COALESCE(SUM(size), 0) FROM files WHERE `+cond+` AND is_dir = 0 GROUP BY parent, deleted, evicted`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var parent string
+		var deleted, evicted bool
+		var count duCount
+		err = rows.Scan(&parent, &deleted, &evicted, &count.Files, &count.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		// Deleted files may be in directories which are gone too
+		for d := parent; ; d = parentDir(d) {
+			entry := usage[d]
+			if entry == nil {
+				entry = &duEntry{Path: d}
+				usage[d] = entry
+			}
+			total := &entry.Cached
+			if deleted {
+				total = &entry.Deleted
+			} else if evicted {
+				total = &entry.Evicted
+			}
+			total.Files += count.Files
+			total.Bytes += count.Bytes
+			if d == dir {
+				break
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*duEntry, 0, len(usage))
+	for _, entry := range usage {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
+}
+
+// checkDirExists returns fs.ErrorDirNotFound if dir isn't a live
+// directory of the catalog. The root always exists.
+func (f *Fs) checkDirExists(ctx context.Context, dir string) error {
+	if dir == "" {
+		return nil
+	}
+	var found bool
+	err := f.rdb.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE remote = ? AND is_dir = 1 AND deleted = 0)`, dir).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fs.ErrorDirNotFound
+	}
+	return nil
+}
+
+// ncduDir is a directory of an ncdu export being built
+type ncduDir struct {
+	name  string
+	files []map[string]interface{}
+	dirs  map[string]*ncduDir
+}
+
+// sub returns the directory name in d, adding it if it isn't there
+func (d *ncduDir) sub(name string) *ncduDir {
+	sub := d.dirs[name]
+	if sub == nil {
+		sub = &ncduDir{name: name, dirs: map[string]*ncduDir{}}
+		d.dirs[name] = sub
+	}
+	return sub
+}
+
+// export returns d in the nested array form of an ncdu export
+func (d *ncduDir) export() []interface{} {
+	out := []interface{}{map[string]interface{}{"name": d.name}}
+	for _, file := range d.files {
+		out = append(out, file)
+	}
+	names := make([]string, 0, len(d.dirs))
+	for name := range d.dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out = append(out, d.dirs[name].export())
+	}
+	return out
+}
+
+// duNcduDump returns the live files at or below dir as an ncdu export,
+// to be browsed with "ncdu -f". Evicted files take no disk space, so
+// ncdu shows what evicting has freed as the difference between their
+// apparent size and their disk usage.
+func (f *Fs) duNcduDump(ctx context.Context, dir string) (string, error) {
+	if err := f.checkDirExists(ctx, dir); err != nil {
+		return "", err
+	}
+	cond, args := inDir(dir)
+	objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE `+cond+` AND deleted = 0 ORDER BY remote`, args...)
+	if err != nil {
+		return "", err
+	}
+	root := &ncduDir{name: f.name + ":" + dir, dirs: map[string]*ncduDir{}}
+	for _, o := range objects {
+		d := root
+		rel := strings.TrimPrefix(o.remote, dir+"/")
+		if dir == "" {
+			rel = o.remote
+		}
+		parent, name := path.Split(rel)
+		for _, part := range strings.Split(strings.TrimSuffix(parent, "/"), "/") {
+			if part != "" {
+				d = d.sub(part)
+			}
+		}
+		if o.isDir {
+			d.sub(name)
+			continue
+		}
+		dsize := o.storedSize
+		if o.evicted {
+			dsize = 0
+		} else if dsize == 0 {
+			dsize = o.size
+		}
+		d.files = append(d.files, map[string]interface{}{
+			"name":  name,
+			"asize": o.size,
+			"dsize": dsize,
+			"mtime": o.modTime.Unix(),
+		})
+	}
+	dump, err := json.Marshal([]interface{}{1, 0, map[string]interface{}{
+		"progname":  "rclone",
+		"progver":   fs.Version,
+		"timestamp": time.Now().Unix(),
+	}, root.export()})
+	if err != nil {
+		return "", err
+	}
+	return string(dump) + "\n", nil
+}
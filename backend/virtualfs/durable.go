@@ -0,0 +1,43 @@
+package virtualfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// syncDir flushes the directory entries of the local directory dir to
+// disk so files renamed into it survive a power loss. Windows can't
+// open directories to flush them and makes renames durable itself.
+func syncDir(dir string) (err error) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fs.CheckClose(d, &err)
+	return d.Sync()
+}
+
+// syncPublished flushes the directory the content at key was published
+// into, if the store is local. Content in a content_remote is as
+// durable as that remote makes it.
+func (f *Fs) syncPublished(key string) error {
+	p, ok := f.localPath(key)
+	if !ok {
+		return nil
+	}
+	return syncDir(filepath.Dir(p))
+}
+
+// checkpoint copies the changes in the write ahead log into the
+// database file, leaving alone any readers still using them
+func (f *Fs) checkpoint(ctx context.Context) error {
+	_, err := f.db.ExecContext(ctx, `PRAGMA wal_checkpoint(PASSIVE)`)
+	return err
+}
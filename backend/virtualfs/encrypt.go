@@ -0,0 +1,106 @@
+package virtualfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rclone/rclone/backend/crypt"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/config/obscure"
+)
+
+// encryptedSuffix is added to the names of encrypted blobs
+const encryptedSuffix = ".enc"
+
+// newContentCipher makes the cipher used to encrypt content from the
+// options, returning nil if encryption isn't configured.
+//
+// It also returns the ID of the key, which is recorded against
+// encrypted content so a change of key can be spotted.
+func newContentCipher(opt *Options) (*crypt.Cipher, string, error) {
+	var password string
+	switch {
+	case opt.EncryptionPass != "" && opt.EncryptionKey != "":
+		return nil, "", errors.New("can't use both encryption_password and encryption_key_file")
+	case opt.EncryptionPass != "":
+		var err error
+		password, err = obscure.Reveal(opt.EncryptionPass)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to decrypt encryption_password: %w", err)
+		}
+	case opt.EncryptionKey != "":
+		data, err := os.ReadFile(opt.EncryptionKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read encryption_key_file: %w", err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+		if password == "" {
+			return nil, "", fmt.Errorf("encryption_key_file %q is empty", opt.EncryptionKey)
+		}
+	default:
+		return nil, "", nil
+	}
+	return cipherForPassword(password)
+}
+
+// cipherForPassword makes a content cipher and key ID for password
+func cipherForPassword(password string) (*crypt.Cipher, string, error) {
+	cipher, err := crypt.NewCipher(configmap.Simple{
+		"password":            obscure.MustObscure(password),
+		"filename_encryption": "off",
+		"filename_encoding":   "base32",
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to make content cipher: %w", err)
+	}
+	return cipher, keyID(password), nil
+}
+
+// keyID returns a short identifier for password which doesn't reveal it
+func keyID(password string) string {
+	sum := sha256.Sum256([]byte("virtualfs key id\x00" + password))
+	return hex.EncodeToString(sum[:8])
+}
+
+// encryptWriter encrypts what is written to it on to another writer
+type encryptWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// newEncryptWriter returns a writer which encrypts with cipher onto out
+//
+// It must be closed to flush the encrypted data.
+func newEncryptWriter(cipher *crypt.Cipher, out io.Writer) (*encryptWriter, error) {
+	pr, pw := io.Pipe()
+	in, err := cipher.EncryptData(pr)
+	if err != nil {
+		return nil, err
+	}
+	w := &encryptWriter{
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+	go func() {
+		_, err := io.Copy(out, in)
+		_ = pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// Write encrypts p
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close flushes the encrypted data and waits for it to be written
+func (w *encryptWriter) Close() error {
+	_ = w.pw.Close()
+	return <-w.done
+}
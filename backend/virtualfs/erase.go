@@ -0,0 +1,331 @@
+package virtualfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+)
+
+// erasedTables are the tables other than files which refer to a path,
+// all of which an erasure clears
+var erasedTables = []string{"hashes", "tags", "history", "journal", "audit", "partials", "ingests"}
+
+// erasureReceipt is recorded and returned by the erase command. It
+// doesn't name what was erased, which would defeat the point, but the
+// digest lets a list of the paths be checked against it later.
+type erasureReceipt struct {
+	ID          int64  `json:"id"`
+	Time        string `json:"time"`
+	Reference   string `json:"reference,omitempty"` // what the erasure was for, as given
+	Files       int    `json:"files"`               // the paths erased, deleted files and directories included
+	Bytes       int64  `json:"bytes"`               // the size of the live files erased
+	Overwritten bool   `json:"overwritten"`         // set if local content was overwritten before removal
+	Digest      string `json:"digest"`              // SHA-256 of the sorted paths erased, one per line
+}
+
+// erasePattern matches the paths erased for one argument of the
+// erase command: the path and everything below it, or the paths
+// matching it if it is a glob
+type erasePattern struct {
+	path string
+	glob *regexp.Regexp
+}
+
+// matches returns true if remote is erased by p
+func (p erasePattern) matches(remote string) bool {
+	if p.glob != nil {
+		return p.glob.MatchString(remote)
+	}
+	return remote == p.path || strings.HasPrefix(remote, p.path+"/")
+}
+
+// parseErasePatterns parses the arguments of the erase command
+func (f *Fs) parseErasePatterns(args []string) ([]erasePattern, error) {
+	patterns := make([]erasePattern, 0, len(args))
+	for _, arg := range args {
+		arg = strings.Trim(arg, "/")
+		if arg == "" {
+			return nil, errors.New("can't erase everything")
+		}
+		if !strings.ContainsAny(arg, globSpecial) {
+			patterns = append(patterns, erasePattern{path: arg})
+			continue
+		}
+		re, err := filter.GlobPathToRegexp(arg, f.opt.CaseInsensitive)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", arg, err)
+		}
+		patterns = append(patterns, erasePattern{glob: re})
+	}
+	return patterns, nil
+}
+
+// erasedFile is a path found to erase
+type erasedFile struct {
+	remote  string
+	live    bool // set if it is a file which hasn't been deleted
+	deleted bool // set if it is a deleted file, which may have a placeholder
+	isDir   bool
+}
+
+// erase removes every trace of the paths matching patterns: their
+// content, old versions and interrupted uploads, their rows in the
+// catalog and every mention of them in the history, change journal and
+// audit log. With overwrite the content is overwritten with zeros
+// before it is removed, if it is kept locally, and the catalog pages
+// freed are too. It records and returns a receipt.
+//
+// Files under legal hold or retention_period can't be erased.
+func (f *Fs) erase(ctx context.Context, patterns []erasePattern, reference string, overwrite bool) (*erasureReceipt, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	f.blobMu.Lock()
+	defer f.blobMu.Unlock()
+
+	if overwrite {
+		_, err := f.db.ExecContext(ctx, `PRAGMA secure_delete = ON`)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_, _ = f.db.ExecContext(context.WithoutCancel(ctx), `PRAGMA secure_delete = OFF`)
+		}()
+	}
+
+	now := time.Now()
+	var (
+		receipt    *erasureReceipt
+		erased     []erasedFile
+		removeKeys []string
+		partials   []string
+	)
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		receipt = &erasureReceipt{Time: formatTime(now.UTC().Truncate(time.Second)), Reference: reference, Overwritten: overwrite}
+		removeKeys, partials = nil, nil
+		var err error
+		erased, err = f.eraseMatches(ctx, tx, patterns)
+		if err != nil {
+			return err
+		}
+		digest := sha256.New()
+		for _, e := range erased {
+			_, _ = io.WriteString(digest, e.remote+"\n")
+			keys, size, err := f.eraseFile(ctx, tx, e, &partials)
+			if err != nil {
+				return err
+			}
+			removeKeys = append(removeKeys, keys...)
+			receipt.Bytes += size
+		}
+		receipt.Files = len(erased)
+		receipt.Digest = hex.EncodeToString(digest.Sum(nil))
+		res, err := tx.ExecContext(ctx, `INSERT INTO erasures (time, reference, files, bytes, overwritten, digest) VALUES (?, ?, ?, ?, ?, ?)`,
+			formatDBTime(now), nullString(reference), receipt.Files, receipt.Bytes, overwrite, receipt.Digest)
+		if err != nil {
+			return err
+		}
+		receipt.ID, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		return f.audit(ctx, tx, auditErase, "", fmt.Sprintf("receipt=%d files=%d", receipt.ID, receipt.Files))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range removeKeys {
+		if overwrite {
+			err = f.overwriteContent(key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to overwrite erased content: %w", err)
+			}
+		}
+		err = f.removeContent(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove erased content: %w", err)
+		}
+	}
+	for _, p := range partials {
+		if overwrite {
+			_ = overwriteFile(p)
+		}
+		_ = os.Remove(p)
+	}
+	// A directory sorts before everything in it, so this removes the
+	// deepest first
+	for i := len(erased) - 1; i >= 0; i-- {
+		e := erased[i]
+		f.objects.remove(e.remote)
+		switch {
+		case e.deleted:
+			err = f.removePlaceholder(ctx, e.remote)
+		case e.isDir:
+			err = f.store.rmdir(ctx, f.storePath(e.remote))
+			if err == fs.ErrorDirNotFound || err == fs.ErrorDirectoryNotEmpty {
+				err = nil
+			}
+		}
+		if err != nil {
+			fs.Errorf(nil, "VirtualFS: Failed to tidy up after erasing: %v", err)
+		}
+	}
+	if overwrite {
+		_, err = f.db.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`)
+		if err != nil {
+			fs.Errorf(nil, "VirtualFS: Failed to checkpoint catalog after erasing: %v", err)
+		}
+	}
+	fs.Infof(nil, "VirtualFS: Erased %d paths, %v, receipt %d", receipt.Files, fs.SizeSuffix(receipt.Bytes), receipt.ID)
+	return receipt, nil
+}
+
+// eraseMatches returns the paths anywhere in the catalog matching
+// patterns, sorted, refusing if any live file among them mustn't be
+// changed
+func (f *Fs) eraseMatches(ctx context.Context, tx *sql.Tx, patterns []erasePattern) ([]erasedFile, error) {
+	query := `SELECT remote FROM files UNION SELECT remote FROM versions`
+	for _, table := range erasedTables {
+		query += ` UNION SELECT remote FROM ` + table + ` WHERE remote IS NOT NULL`
+	}
+	remotes, err := queryRemotesTx(ctx, tx, query)
+	if err != nil {
+		return nil, err
+	}
+	var erased []erasedFile
+	for _, remote := range remotes {
+		if remote == "" {
+			continue
+		}
+		matched := false
+		for _, p := range patterns {
+			if p.matches(remote) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		e := erasedFile{remote: remote}
+		o := &Object{fs: f, remote: remote}
+		var ingestedAt sql.NullString
+		err = tx.QueryRowContext(ctx, `SELECT deleted, is_dir, held, ingested_at FROM files WHERE remote = ?`, remote).Scan(&o.deleted, &e.isDir, &o.held, &ingestedAt)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if err == nil && !e.isDir {
+			e.live, e.deleted = !o.deleted, o.deleted
+		}
+		if e.live {
+			o.ingestedAt = parseNullTime(ingestedAt)
+			err = o.checkChangeable()
+			if err != nil {
+				return nil, err
+			}
+		}
+		erased = append(erased, e)
+	}
+	sort.Slice(erased, func(i, j int) bool {
+		return erased[i].remote < erased[j].remote
+	})
+	return erased, nil
+}
+
+// eraseFile removes every row referring to e in tx, returning the keys
+// of the content to remove, the size of the file if it was live, and
+// adding the interrupted uploads of it to partials
+func (f *Fs) eraseFile(ctx context.Context, tx *sql.Tx, e erasedFile, partials *[]string) (removeKeys []string, size int64, err error) {
+	if e.live {
+		removeKeys, size, err = f.releaseContent(ctx, tx, e.remote)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	versionKeys, err := f.pruneVersions(ctx, tx, e.remote, math.MaxInt64)
+	if err != nil {
+		return nil, 0, err
+	}
+	removeKeys = append(removeKeys, versionKeys...)
+	paths, err := queryRemotesTx(ctx, tx, `SELECT path FROM partials WHERE remote = ?`, e.remote)
+	if err != nil {
+		return nil, 0, err
+	}
+	*partials = append(*partials, paths...)
+	_, err = tx.ExecContext(ctx, `DELETE FROM files WHERE remote = ?`, e.remote)
+	if err != nil {
+		return nil, 0, err
+	}
+	// After the files row, as deleting it adds to the history
+	for _, table := range erasedTables {
+		_, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE remote = ?`, e.remote)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to erase from %s: %w", table, err)
+		}
+	}
+	return removeKeys, size, nil
+}
+
+// overwriteContent overwrites the content at key with zeros if it is
+// kept locally or inline
+func (f *Fs) overwriteContent(key string) error {
+	if s, ok := f.store.(*inlineStore); ok {
+		err := s.overwrite(context.Background(), key)
+		if err != nil {
+			return err
+		}
+	}
+	p, ok := f.localPath(key)
+	if !ok {
+		return nil
+	}
+	err := overwriteFile(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// overwriteFile writes zeros over the whole of the file at p and
+// flushes them to disk
+func overwriteFile(p string) error {
+	out, err := os.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := out.Stat()
+	if err == nil {
+		_, err = io.CopyN(out, zeroReader{}, info.Size())
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// zeroReader reads an endless stream of zeros
+type zeroReader struct{}
+
+// Read fills p with zeros
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,148 @@
+package virtualfs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Events sent to virtualfs/events which aren't in the change journal.
+// Status changes are sent with the name of the new status as the event.
+const (
+	eventIngest = "ingest"
+	eventEvict  = "evict"
+)
+
+// eventBufferSize is how many events are kept for virtualfs/events
+const eventBufferSize = 10000
+
+// Limits of the virtualfs/events parameters
+const (
+	defaultEventsLimit   = 1000
+	defaultEventsTimeout = 30 * time.Second
+	maxEventsTimeout     = 10 * time.Minute
+)
+
+// eventEntry is one event returned by virtualfs/events
+type eventEntry struct {
+	Seq   int64  `json:"seq"`
+	Event string `json:"event"`
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Time  string `json:"time"`
+}
+
+// eventsResult is returned by virtualfs/events
+type eventsResult struct {
+	Events   []eventEntry `json:"events"`
+	Last     int64        `json:"last"`     // pass as since to carry on from here
+	Lost     bool         `json:"lost"`     // set if events after since were dropped before being read
+	Instance string       `json:"instance"` // changes when rclone restarts and numbering starts again
+}
+
+// eventStream holds the latest events of the remotes of one name, as
+// they happen in this process, numbered from 1 when rclone starts
+type eventStream struct {
+	mu   sync.Mutex
+	seq  int64
+	buf  []eventEntry  // the last eventBufferSize events, oldest first
+	wake chan struct{} // closed when the next event is added
+}
+
+var (
+	allEventsMu sync.Mutex
+	allEvents   = map[string]*eventStream{} // by remote name
+)
+
+// eventsFor returns the event stream of the remote called name
+func eventsFor(name string) *eventStream {
+	allEventsMu.Lock()
+	defer allEventsMu.Unlock()
+	s := allEvents[name]
+	if s == nil {
+		s = &eventStream{}
+		allEvents[name] = s
+	}
+	return s
+}
+
+// add sends event for the catalog path remote to whoever is waiting
+func (s *eventStream) add(event, remote string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	s.buf = append(s.buf, eventEntry{
+		Seq:   s.seq,
+		Event: event,
+		Path:  remote,
+		Size:  size,
+		Time:  formatTime(time.Now()),
+	})
+	if len(s.buf) > eventBufferSize {
+		s.buf = s.buf[len(s.buf)-eventBufferSize:]
+	}
+	if s.wake != nil {
+		close(s.wake)
+		s.wake = nil
+	}
+}
+
+// last returns the sequence number of the latest event
+func (s *eventStream) last() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seq
+}
+
+// after returns up to limit events after since, or if there aren't any
+// a channel closed once there are
+func (s *eventStream) after(since int64, limit int) (*eventsResult, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := &eventsResult{Events: []eventEntry{}, Instance: auditor.invocation}
+	if since > s.seq {
+		// From before a restart so start again
+		since, res.Lost = 0, true
+	}
+	res.Last = since
+	i := 0
+	if len(s.buf) > 0 {
+		first := s.buf[0].Seq
+		if since+1 < first {
+			res.Lost = true
+		} else {
+			i = int(since + 1 - first)
+		}
+	}
+	for ; i < len(s.buf) && len(res.Events) < limit; i++ {
+		res.Events = append(res.Events, s.buf[i])
+		res.Last = s.buf[i].Seq
+	}
+	if len(res.Events) > 0 || res.Lost {
+		return res, nil
+	}
+	if s.wake == nil {
+		s.wake = make(chan struct{})
+	}
+	return res, s.wake
+}
+
+// wait returns up to limit events after since, waiting up to timeout
+// for one to happen if there aren't any yet
+func (s *eventStream) wait(ctx context.Context, since int64, limit int, timeout time.Duration) *eventsResult {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		res, wake := s.after(since, limit)
+		if wake == nil {
+			return res
+		}
+		select {
+		case <-wake:
+		case <-timer.C:
+			return res
+		case <-ctx.Done():
+			return res
+		}
+	}
+}
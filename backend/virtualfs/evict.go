@@ -0,0 +1,312 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// hideEvicted returns true if o is left out of listings because its
+// content is evicted and evicted_read is set to not_found
+func (f *Fs) hideEvicted(o *Object) bool {
+	return o.evicted && !o.deleted && f.opt.EvictedRead == evictedReadNotFound
+}
+
+// evict removes the content of the object from the root directory
+// while keeping its metadata in the catalog.
+//
+// It returns the size of the content released, which is 0 if there
+// wasn't any.
+func (o *Object) evict(ctx context.Context) (freed int64, err error) {
+	return o.evictContent(ctx, false)
+}
+
+// errReingested is returned when content read is to be evicted but
+// the file has been ingested again since it was opened
+var errReingested = errors.New("file has been ingested again since it was opened")
+
+// evictContent evicts the content of the object, as evict does. With
+// unchanged set it is only evicted if the file hasn't been ingested
+// again since o was read from the catalog, errReingested being
+// returned if it has.
+func (o *Object) evictContent(ctx context.Context, unchanged bool) (freed int64, err error) {
+	o.fs.blobMu.Lock()
+	defer o.fs.blobMu.Unlock()
+
+	var removeKeys []string
+	err = o.fs.inTx(ctx, func(tx *sql.Tx) (err error) {
+		if unchanged {
+			var same bool
+			err = tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE remote = ? AND ingested_at = ? AND size = ? AND hash = ? AND deleted = 0)`,
+				o.remote, formatDBTime(o.ingestedAt), o.size, o.hash).Scan(&same)
+			if err != nil {
+				return err
+			}
+			if !same {
+				return errReingested
+			}
+		}
+		var held bool
+		err = tx.QueryRowContext(ctx, `SELECT held FROM files WHERE remote = ?`, o.remote).Scan(&held)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if held {
+			return errHeld
+		}
+		removeKeys, freed, err = o.fs.releaseContent(ctx, tx, o.remote)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE files SET evicted = 1 WHERE remote = ? AND deleted = 0`, o.remote)
+		if err != nil {
+			return err
+		}
+		return o.fs.audit(ctx, tx, auditEvict, o.remote, fmt.Sprintf("freed=%d", freed))
+	})
+	if err != nil {
+		return 0, err
+	}
+	o.fs.objects.remove(o.remote)
+	for _, key := range removeKeys {
+		err = o.fs.removeContent(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	o.evicted = true
+	o.fs.metrics.evicted.Add(1)
+	o.fs.events.add(eventEvict, o.remote, o.size)
+	o.fs.logOp(nil, "VirtualFS: Evicted content of %s", o.remote)
+	return freed, nil
+}
+
+// evictEntry is returned for each file evicted by the evict command
+type evictEntry struct {
+	Path  string `json:"path"`
+	Freed int64  `json:"freed"`
+}
+
+// evictFiles evicts the content of each of remotes, keeping their
+// metadata. Files which are claimed for processing or waiting to be
+// replicated are refused, as they are by automatic eviction.
+func (f *Fs) evictFiles(ctx context.Context, remotes []string) ([]evictEntry, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	entries := make([]evictEntry, 0, len(remotes))
+	for _, remote := range remotes {
+		obj, err := f.findObject(ctx, remote)
+		if err != nil {
+			return entries, fmt.Errorf("%s: %w", remote, err)
+		}
+		o := obj.(*Object)
+		if o.status == statusClaimed {
+			return entries, fmt.Errorf("%s: can't evict a file claimed for processing", remote)
+		}
+		if o.replStatus == replicationPending {
+			return entries, fmt.Errorf("%s: can't evict a file waiting to be replicated", remote)
+		}
+		if o.held {
+			return entries, fmt.Errorf("%s: can't evict a file under legal hold", remote)
+		}
+		entry := evictEntry{Path: o.remote}
+		if !o.evicted {
+			entry.Freed, err = o.evict(ctx)
+			if err != nil {
+				return entries, fmt.Errorf("%s: %w", remote, err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// isPartialRead returns true if options ask for less than the whole file
+func isPartialRead(options []fs.OpenOption) bool {
+	for _, option := range options {
+		switch option.(type) {
+		case *fs.RangeOption, *fs.SeekOption:
+			return true
+		}
+	}
+	return false
+}
+
+// onEOF calls done when it is closed after being read to the end
+type onEOF struct {
+	io.ReadCloser
+	size int64
+	read int64
+	eof  bool
+	done func()
+}
+
+// Read bytes from the underlying reader noting when it is exhausted
+//
+// Readers which stop after reading exactly the size of the object
+// never see io.EOF so reaching the size counts too.
+func (r *onEOF) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.read += int64(n)
+	if err == io.EOF || r.read >= r.size {
+		r.eof = true
+	}
+	return n, err
+}
+
+// Close the underlying reader, calling done if it was read in full
+func (r *onEOF) Close() error {
+	err := r.ReadCloser.Close()
+	if err != nil || !r.eof {
+		return err
+	}
+	r.done()
+	return nil
+}
+
+// evictAfterRead evicts the content of o now it has been read in full,
+// as long as it hasn't been ingested again since it was opened
+func (o *Object) evictAfterRead(ctx context.Context) {
+	// The reader may be closed as the transfer finishes
+	ctx = context.WithoutCancel(ctx)
+	_, err := o.evictContent(ctx, true)
+	if errors.Is(err, errReingested) {
+		o.fs.logOp(nil, "VirtualFS: Not evicting content of %s after read as it has changed", o.remote)
+		return
+	}
+	if err != nil {
+		fs.Errorf(nil, "VirtualFS: Failed to evict content of %s after read: %v", o.remote, err)
+	}
+}
+
+// touch records that the object's content was accessed now, counting
+// the access
+func (o *Object) touch(ctx context.Context) {
+	now := time.Now()
+
+	query := `UPDATE files SET last_access = ?, access_count = access_count + 1 WHERE remote = ?`
+	_, err := o.fs.db.ExecContext(ctx, query, formatDBTime(now), o.remote)
+	if err != nil {
+		fs.Errorf(nil, "VirtualFS: Failed to record access to %s: %v", o.remote, err)
+		return
+	}
+	o.fs.objects.remove(o.remote)
+	o.lastAccess = now
+	o.accessCount++
+}
+
+// Values for eviction_policy
+const (
+	evictionLRU = "lru"
+	evictionLFU = "lfu"
+)
+
+// evictionOrder returns the ORDER BY terms putting the files to evict
+// first by the eviction_policy
+func (f *Fs) evictionOrder() string {
+	if f.opt.EvictionPolicy == evictionLFU {
+		return `access_count, COALESCE(last_access, ingested_at)`
+	}
+	return `COALESCE(last_access, ingested_at)`
+}
+
+// ttlInterval returns how often to look for content older than ttl
+func ttlInterval(ttl time.Duration) time.Duration {
+	return min(max(ttl/10, time.Minute), time.Hour)
+}
+
+// cacheLowWater is the fraction of max_cache_size evicting stops at
+const cacheLowWater = 0.9
+
+// afterIngest is called once new content for o has been committed to the catalog
+func (f *Fs) afterIngest(ctx context.Context, o *Object) {
+	f.afterTierIngest(ctx, o)
+	if f.opt.MaxCacheSize > 0 && !o.evicted && f.cacheUsed.Add(o.size) > int64(f.opt.MaxCacheSize) {
+		err := f.enforceCacheSize(ctx)
+		if err != nil {
+			fs.Errorf(nil, "VirtualFS: Failed to enforce max_cache_size: %v", err)
+		}
+	}
+}
+
+// enforceCacheSize evicts the least used content until the total
+// stored is under the low water mark if it is over max_cache_size
+func (f *Fs) enforceCacheSize(ctx context.Context) error {
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+
+	var used int64
+	err := f.rdb.QueryRowContext(ctx, `SELECT COALESCE(SUM(size), 0) FROM files WHERE deleted = 0 AND is_dir = 0 AND evicted = 0`).Scan(&used)
+	if err != nil {
+		return err
+	}
+	f.cacheUsed.Store(used)
+	if used <= int64(f.opt.MaxCacheSize) {
+		return nil
+	}
+
+	target := int64(float64(f.opt.MaxCacheSize) * cacheLowWater)
+	freed, err := f.evictLeastUsed(ctx, "", "", used-target)
+	f.cacheUsed.Store(used - freed)
+	if err != nil {
+		return err
+	}
+	fs.Infof(nil, "VirtualFS: Evicted %v of content to keep under max_cache_size %v", fs.SizeSuffix(freed), f.opt.MaxCacheSize)
+	return nil
+}
+
+// evictLeastUsed evicts the least used content below dir by the
+// eviction_policy, apart from exclude, until at least need bytes have
+// been freed or there is nothing left to evict. It returns the number
+// of bytes freed.
+//
+// Files which are claimed for processing or under legal hold are never
+// evicted.
+func (f *Fs) evictLeastUsed(ctx context.Context, dir, exclude string, need int64) (freed int64, err error) {
+	cond, args := inDir(dir)
+	args = append(args, exclude)
+	return f.evictLeastUsedWhere(ctx, cond+` AND remote != ?`, args, need)
+}
+
+// evictLeastUsedWhere evicts the least used content of the files
+// matching cond with args, as evictLeastUsed does
+func (f *Fs) evictLeastUsedWhere(ctx context.Context, cond string, args []interface{}, need int64) (freed int64, err error) {
+	args = append(args, statusClaimed)
+
+	rows, err := f.rdb.QueryContext(ctx, `SELECT remote, size FROM files WHERE `+cond+` AND deleted = 0 AND is_dir = 0 AND evicted = 0 AND held = 0 AND status != ? AND COALESCE(replication_status, '') != 'pending' ORDER BY `+f.evictionOrder()+`, remote`, args...)
+	if err != nil {
+		return 0, err
+	}
+	var victims []*Object
+	for total := int64(0); total < need && rows.Next(); {
+		o := &Object{fs: f}
+		err = rows.Scan(&o.remote, &o.size)
+		if err != nil {
+			break
+		}
+		victims = append(victims, o)
+		total += o.size
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	_ = rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, o := range victims {
+		n, err := o.evict(ctx)
+		if err != nil {
+			return freed, err
+		}
+		freed += n
+	}
+	return freed, nil
+}
@@ -0,0 +1,45 @@
+package virtualfs
+
+import (
+	"context"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// originFingerprint returns the fingerprint the source gives the
+// content of src, or "" if it doesn't give one cheaply.
+//
+// This is the source's own preferred hash, such as the ETag of an S3
+// object, the QuickXorHash of a OneDrive file or the content hash of a
+// Dropbox file, so it changes whenever the content does. Sources which
+// have to read the content to hash it, such as local disks, have none.
+func originFingerprint(ctx context.Context, src fs.ObjectInfo) string {
+	srcFs := src.Fs()
+	if srcFs == nil || srcFs.Features().SlowHash {
+		return ""
+	}
+	t := srcFs.Hashes().GetOne()
+	if t == hash.None {
+		return ""
+	}
+	sum, err := src.Hash(ctx, t)
+	if err != nil || sum == "" {
+		return ""
+	}
+	return t.String() + ":" + sum
+}
+
+// fingerprintChanged compares the fingerprint src has now with the one
+// recorded when o was ingested. known is false if either is missing,
+// in which case changed means nothing.
+func (o *Object) fingerprintChanged(ctx context.Context, src fs.ObjectInfo) (changed, known bool) {
+	if o.fingerprint == "" {
+		return false, false
+	}
+	fingerprint := originFingerprint(ctx, src)
+	if fingerprint == "" {
+		return false, false
+	}
+	return fingerprint != o.fingerprint, true
+}
@@ -0,0 +1,117 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeNone is the unicode_normalization value leaving names as given
+const normalizeNone = "none"
+
+// normForms are the unicode normalization forms names can be put in
+var normForms = map[string]norm.Form{
+	"NFC":  norm.NFC,
+	"NFD":  norm.NFD,
+	"NFKC": norm.NFKC,
+	"NFKD": norm.NFKD,
+}
+
+// parseNormalization parses the unicode_normalization option into the
+// function names are normalized with
+func parseNormalization(name string) (func(string) string, error) {
+	if name == normalizeNone {
+		return func(s string) string { return s }, nil
+	}
+	form, ok := normForms[strings.ToUpper(name)]
+	if !ok {
+		return nil, fmt.Errorf("invalid unicode_normalization %q", name)
+	}
+	return form.String, nil
+}
+
+// foldKey returns the key column of remote, which is the same for
+// every remote differing only in case
+func foldKey(remote string) string {
+	return strings.ToLower(remote)
+}
+
+// lookupKey returns what remote is looked up by, which is its key if
+// case_insensitive is set
+func (f *Fs) lookupKey(remote string) string {
+	if f.opt.CaseInsensitive {
+		return foldKey(remote)
+	}
+	return remote
+}
+
+// fillKeys sets the key column of the rows which don't have one yet,
+// such as those written before it was added. It is run as the catalog
+// is opened, before anything else uses it.
+func (f *Fs) fillKeys() error {
+	rows, err := f.db.Query(`SELECT remote FROM files WHERE key = '' AND remote != ''`)
+	if err != nil {
+		return err
+	}
+	var remotes []string
+	for rows.Next() {
+		var remote string
+		err = rows.Scan(&remote)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		remotes = append(remotes, remote)
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil || len(remotes) == 0 {
+		return err
+	}
+
+	tx, err := f.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	for _, remote := range remotes {
+		_, err = tx.Exec(`UPDATE files SET key = ? WHERE remote = ?`, foldKey(remote), remote)
+		if err != nil {
+			return fmt.Errorf("failed to set key of %s: %w", remote, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// resolveCase returns remote spelt the way the catalog already has it
+// if case_insensitive is set, so a file or directory differing only in
+// case is written to the existing row
+//
+// A remote not in the catalog keeps its own name, with its directory
+// spelt the way the catalog has that.
+func (f *Fs) resolveCase(ctx context.Context, remote string) (string, error) {
+	if !f.opt.CaseInsensitive || remote == "" {
+		return remote, nil
+	}
+	var existing string
+	err := f.stmts.resolveKey.QueryRowContext(ctx, foldKey(remote)).Scan(&existing)
+	if err == nil {
+		return existing, nil
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+	dir, leaf := path.Split(remote)
+	if dir == "" {
+		return remote, nil
+	}
+	dir, err = f.resolveCase(ctx, strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, leaf), nil
+}
@@ -0,0 +1,61 @@
+package virtualfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+	"github.com/rclone/rclone/lib/diskusage"
+)
+
+// errInsufficientSpace is returned when a Put would leave less than min_free_space
+var errInsufficientSpace = errors.New("insufficient free space")
+
+// freeSpace returns the bytes available on the disk holding the root directory
+var freeSpace = func(dir string) (int64, error) {
+	info, err := diskusage.New(dir)
+	if err != nil {
+		return 0, err
+	}
+	return int64(info.Available), nil
+}
+
+// checkFreeSpace returns an error if storing size bytes at remote
+// would leave less than min_free_space on the disk.
+//
+// If free_space_action is evict then the least recently used content
+// is evicted to make room first.
+func (f *Fs) checkFreeSpace(ctx context.Context, remote string, size int64) error {
+	if f.opt.MinFreeSpace <= 0 {
+		return nil
+	}
+	avail, err := freeSpace(f.opt.RootDirectory)
+	if err == diskusage.ErrUnsupported {
+		fs.Debugf(nil, "VirtualFS: Can't check free space: %v", err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read free space: %w", err)
+	}
+	short := int64(f.opt.MinFreeSpace) - (avail - size)
+	if short <= 0 {
+		return nil
+	}
+	if f.opt.FreeAction == limitActionEvict {
+		fs.Logf(nil, "VirtualFS: Only %v free, evicting content to make room for %s", fs.SizeSuffix(avail), remote)
+		_, err = f.evictLeastUsed(ctx, "", remote, short)
+		if err != nil {
+			return fmt.Errorf("failed to evict to make room: %w", err)
+		}
+		avail, err = freeSpace(f.opt.RootDirectory)
+		if err != nil {
+			return fmt.Errorf("failed to read free space: %w", err)
+		}
+		if avail-size >= int64(f.opt.MinFreeSpace) {
+			return nil
+		}
+	}
+	return fserrors.NoRetryError(fmt.Errorf("%s: storing %v would leave %v free, less than min_free_space %v: %w",
+		remote, fs.SizeSuffix(size), fs.SizeSuffix(avail-size), f.opt.MinFreeSpace, errInsufficientSpace))
+}
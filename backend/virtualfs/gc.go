@@ -0,0 +1,116 @@
+package virtualfs
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// quarantineDir is the directory under the root where gc moves orphans to
+const quarantineDir = internalDir + "/quarantine"
+
+// gcMinAge is how old a content file must be for gc to remove it if not
+// told otherwise
+const gcMinAge = time.Hour
+
+// gcResult is the output of the gc command
+type gcResult struct {
+	Scanned     int      `json:"scanned"`
+	Orphans     []string `json:"orphans"`
+	Removed     int      `json:"removed"`
+	Quarantined int      `json:"quarantined"`
+}
+
+// gc finds content files under the root directory which no catalog
+// row refers to and removes them, or moves them into the quarantine
+// directory if quarantine is set.
+//
+// Files modified more recently than minAge are left alone as they may
+// belong to a Put which is still in progress.
+func (f *Fs) gc(ctx context.Context, quarantine bool, minAge time.Duration) (*gcResult, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	res := &gcResult{Orphans: []string{}}
+	err := f.store.walk(ctx, func(rel string, modTime time.Time) error {
+		res.Scanned++
+		if minAge > 0 && time.Since(modTime) < minAge {
+			return nil
+		}
+		if kept, err := f.isPartial(ctx, path.Base(rel)); err != nil || kept {
+			return err
+		}
+		referenced, err := f.isReferenced(ctx, rel)
+		if err != nil {
+			return err
+		}
+		if referenced {
+			return nil
+		}
+		res.Orphans = append(res.Orphans, f.displayKey(rel))
+		if quarantine {
+			if operations.SkipDestructive(ctx, rel, "quarantine orphaned content") {
+				return nil
+			}
+			err = f.store.move(ctx, rel, quarantineKey(rel))
+			if err != nil {
+				return fmt.Errorf("failed to quarantine %s: %w", rel, err)
+			}
+			fs.Infof(nil, "VirtualFS: Quarantined orphaned content file %s", rel)
+			res.Quarantined++
+			return nil
+		}
+		if operations.SkipDestructive(ctx, rel, "remove orphaned content") {
+			return nil
+		}
+		err = f.store.remove(ctx, rel)
+		if err != nil {
+			return fmt.Errorf("failed to remove %s: %w", rel, err)
+		}
+		fs.Infof(nil, "VirtualFS: Removed orphaned content file %s", rel)
+		res.Removed++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fs.Infof(nil, "VirtualFS: gc scanned %d files, found %d orphans", res.Scanned, len(res.Orphans))
+	return res, nil
+}
+
+// isReferenced returns true if the content file at key belongs to a
+// live row, blob or kept version or is the placeholder of a deleted row
+func (f *Fs) isReferenced(ctx context.Context, key string) (bool, error) {
+	var query string
+	var args []interface{}
+	disk, rel := splitDiskKey(key)
+	if blob, ok := blobHash(rel); ok {
+		query = `SELECT COUNT(*) FROM blobs WHERE hash = ? AND refcount > 0`
+		args = []interface{}{blob}
+	} else {
+		deletedRemote, deletedPath := "", ""
+		if strings.HasSuffix(rel, placeholderSuffix) {
+			deletedPath = strings.TrimSuffix(rel, placeholderSuffix)
+			deletedRemote = f.storeRemote(deletedPath)
+		}
+		query = `SELECT (SELECT COUNT(*) FROM versions WHERE disk = ? AND content_path = ?) + COUNT(*) FROM files WHERE (disk = ? AND ((remote = ? AND content_path IS NULL AND deleted = 0 AND is_dir = 0) OR (content_path = ? AND deleted = 0))) OR (remote = ? AND deleted = 1) OR (content_path = ? AND deleted = 1)`
+		args = []interface{}{disk, rel, disk, f.storeRemote(rel), rel, deletedRemote, deletedPath}
+		if f.opt.DeletionMode == deletionZeroByte {
+			// The empty file in place of a deleted file
+			query += ` OR (remote = ? AND deleted = 1 AND is_dir = 0)`
+			args = append(args, f.storeRemote(rel))
+		}
+	}
+
+	var count int
+	err := f.rdb.QueryRowContext(ctx, query, args...).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
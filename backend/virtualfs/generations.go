@@ -0,0 +1,169 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// generationEntry is a named generation of the catalog recorded by
+// the snapshot-create command
+type generationEntry struct {
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+	Time       string `json:"time"`
+}
+
+// generationFile is a file as it was at a past generation
+type generationFile struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime string `json:"modTime"`
+	MD5     string `json:"md5,omitempty"`
+}
+
+// createGeneration records the current generation of the catalog under
+// name, which defaults to the time now
+func (f *Fs) createGeneration(ctx context.Context, name string) (*generationEntry, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if name == "" {
+		name = now.UTC().Format(snapshotLayout)
+	}
+	if _, err := strconv.ParseInt(name, 10, 64); err == nil {
+		return nil, fmt.Errorf("generation name %q can't be a number", name)
+	}
+	e := &generationEntry{Name: name, Time: formatDBTime(now)}
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(generation), 0) FROM history`).Scan(&e.Generation)
+		if err != nil {
+			return err
+		}
+		var exists int
+		err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM generations WHERE name = ?`, name).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return fmt.Errorf("generation %q already exists", name)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO generations (name, generation, time) VALUES (?, ?, ?)`, name, e.Generation, formatDBTime(now))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// listGenerations returns the named generations, oldest first
+func (f *Fs) listGenerations(ctx context.Context) ([]generationEntry, error) {
+	rows, err := f.rdb.QueryContext(ctx, `SELECT name, generation, time FROM generations ORDER BY generation, time`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	entries := []generationEntry{}
+	for rows.Next() {
+		var e generationEntry
+		var created sql.NullString
+		err = rows.Scan(&e.Name, &e.Generation, &created)
+		if err != nil {
+			return nil, err
+		}
+		e.Time = formatTime(parseNullTime(created))
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// resolveGeneration returns the generation named by name, which is
+// either the name given to snapshot-create or a generation number
+func (f *Fs) resolveGeneration(ctx context.Context, name string) (int64, error) {
+	if generation, err := strconv.ParseInt(name, 10, 64); err == nil {
+		return generation, nil
+	}
+
+	var generation int64
+	err := f.rdb.QueryRowContext(ctx, `SELECT generation FROM generations WHERE name = ?`, name).Scan(&generation)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("no generation %q", name)
+	}
+	return generation, err
+}
+
+// queryHistory returns the files and directories matching match as
+// they were at the last change before the bound until, in path order.
+// Both take one argument from args, match taking the rest.
+func (f *Fs) queryHistory(ctx context.Context, until, match string, args ...interface{}) ([]*Object, error) {
+	// SQLite takes the other columns from the row with the MAX
+	rows, err := f.rdb.QueryContext(ctx, `SELECT remote, is_dir, size, hash, mod_time_ns FROM (
+		SELECT remote, is_dir, deleted, size, hash, mod_time_ns, MAX(generation)
+		FROM history WHERE `+until+` AND `+match+` GROUP BY remote
+	) WHERE deleted = 0 ORDER BY remote`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var objects []*Object
+	for rows.Next() {
+		o := &Object{fs: f}
+		var size sql.NullInt64
+		var hash sql.NullString
+		var modTime int64
+		err = rows.Scan(&o.remote, &o.isDir, &size, &hash, &modTime)
+		if err != nil {
+			return nil, err
+		}
+		o.size = size.Int64
+		o.hash = hash.String
+		o.hasHash = o.hash != ""
+		o.modTime = time.Unix(0, modTime)
+		objects = append(objects, o)
+	}
+	return objects, rows.Err()
+}
+
+// matchPrefix matches remotes at or below the directory given as its
+// argument with a trailing "/", or everything for ""
+const matchPrefix = `substr(remote, 1, length(?)) = ?`
+
+// dirPrefix returns the prefix of the remotes below dir
+func dirPrefix(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
+
+// filesAtGeneration returns the files at or below dir as they were at
+// generation, in path order
+func (f *Fs) filesAtGeneration(ctx context.Context, dir string, generation int64) ([]generationFile, error) {
+	prefix := dirPrefix(dir)
+	objects, err := f.queryHistory(ctx, `generation <= ?`, matchPrefix, generation, prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+	files := []generationFile{}
+	for _, o := range objects {
+		if o.isDir {
+			continue
+		}
+		files = append(files, generationFile{
+			Path:    o.remote,
+			Size:    o.size,
+			ModTime: formatTime(o.modTime),
+			MD5:     o.hash,
+		})
+	}
+	return files, nil
+}
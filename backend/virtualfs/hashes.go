@@ -0,0 +1,199 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// hashOrigin is the hash_types value standing for the hashes the
+// origin_remote supports
+const hashOrigin = "origin"
+
+// parseHashTypes parses the hash_types option, calling origin for the
+// hashes of the origin_remote if "origin" is given. origin is nil if
+// there is no origin_remote.
+//
+// "none" on its own turns hashing off.
+func parseHashTypes(names fs.CommaSepList, origin func() (hash.Set, error)) (hash.Set, error) {
+	var set hash.Set
+	for _, name := range names {
+		if name == hashOrigin {
+			if origin == nil {
+				return set, errors.New("invalid hash_types: origin needs origin_remote")
+			}
+			types, err := origin()
+			if err != nil {
+				return set, err
+			}
+			if types.Count() == 0 {
+				fs.Logf(nil, "VirtualFS: origin_remote supports no hashes so hash_types origin adds none")
+			}
+			set.Add(types.Array()...)
+			continue
+		}
+		var t hash.Type
+		err := t.Set(name)
+		if err != nil {
+			return set, fmt.Errorf("invalid hash_types: %w", err)
+		}
+		if t == hash.None {
+			if len(names) > 1 {
+				return set, errors.New("invalid hash_types: can't combine none with other hash types")
+			}
+			return hash.Set(hash.None), nil
+		}
+		set.Add(t)
+	}
+	return set, nil
+}
+
+// ingestHashes returns the hashes to compute while ingesting content
+func (f *Fs) ingestHashes() hash.Set {
+	set := f.hashes
+	if f.opt.ContentLayout == layoutCAS {
+		// Blobs are named by their MD5
+		set.Add(hash.MD5)
+	}
+	return set
+}
+
+// storeHashes replaces the hashes recorded for remote with sums
+func storeHashes(ctx context.Context, tx *sql.Tx, remote string, sums map[hash.Type]string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM hashes WHERE remote = ?`, remote)
+	if err != nil {
+		return err
+	}
+	for t, value := range sums {
+		_, err = tx.ExecContext(ctx, `INSERT INTO hashes (remote, type, value) VALUES (?, ?, ?)`, remote, t.String(), value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupHash returns the hash of type t recorded for remote, or "" if
+// there isn't one
+func (f *Fs) lookupHash(ctx context.Context, remote string, t hash.Type) (string, error) {
+	var value string
+	err := f.rdb.QueryRowContext(ctx, `SELECT value FROM hashes WHERE remote = ? AND type = ?`, remote, t.String()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// computeHash works out the hashes missing for the object from its
+// content, stores them in the catalog unless read_only is set and
+// returns the one of type t.
+//
+// If the content is no longer held it returns "" as there is nothing
+// to compute the hash from.
+func (o *Object) computeHash(ctx context.Context, t hash.Type) (sum string, err error) {
+	if o.evicted && !o.deleted && !o.isDir && o.fs.opt.OriginRemote != "" {
+		return o.originHash(ctx, t)
+	}
+	if o.deleted || o.evicted || o.isDir {
+		o.fs.logOp(nil, "VirtualFS: No hash available for remote %s", o.remote)
+		return "", nil
+	}
+	o.fs.logOp(nil, "VirtualFS: Computing hashes for remote %s", o.remote)
+	in, err := o.openContent(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to open content to hash: %w", err)
+	}
+	defer fs.CheckClose(in, &err)
+	multiHasher, err := hash.NewMultiHasherTypes(o.fs.hashes)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(multiHasher, in)
+	if err != nil {
+		return "", fmt.Errorf("failed to read content to hash: %w", err)
+	}
+	sums := multiHasher.Sums()
+	if o.fs.opt.ReadOnly {
+		return sums[t], nil
+	}
+
+	// Only record the hashes if the content is still the one hashed
+	stored := false
+	err = o.fs.inTx(ctx, func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM files WHERE remote = ? AND ingested_at = ? AND deleted = 0 AND evicted = 0`,
+			o.remote, formatDBTime(o.ingestedAt)).Scan(&n)
+		if err != nil || n == 0 {
+			return err
+		}
+		if md5, ok := sums[hash.MD5]; ok {
+			_, err = tx.ExecContext(ctx, `UPDATE files SET has_hash = 1, hash = ? WHERE remote = ?`, md5, o.remote)
+			if err != nil {
+				return err
+			}
+		}
+		stored = true
+		return storeHashes(ctx, tx, o.remote, sums)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store hashes: %w", err)
+	}
+	o.fs.objects.remove(o.remote)
+	if !stored {
+		fs.Debugf(nil, "VirtualFS: Not storing hashes of %s as it changed while being hashed", o.remote)
+	} else if md5, ok := sums[hash.MD5]; ok {
+		o.hasHash = true
+		o.hash = md5
+	}
+	return sums[t], nil
+}
+
+// originHash returns the hash of type t of the file in origin_remote
+// for an object whose content isn't held, storing it in the catalog
+// unless read_only is set, or "" if the origin doesn't have one.
+//
+// This lets providers' own hashes, such as quickxor for OneDrive, be
+// checked against without fetching the content back to work them out.
+func (o *Object) originHash(ctx context.Context, t hash.Type) (string, error) {
+	src, err := o.originObject(ctx)
+	if err != nil {
+		fs.Debugf(nil, "VirtualFS: No hash available for remote %s: %v", o.remote, err)
+		return "", nil
+	}
+	sum, err := src.Hash(ctx, t)
+	if errors.Is(err, hash.ErrUnsupported) || sum == "" {
+		o.fs.logOp(nil, "VirtualFS: No %v hash in origin_remote for remote %s", t, o.remote)
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read hash from origin_remote: %w", err)
+	}
+	if o.fs.opt.ReadOnly {
+		return sum, nil
+	}
+	err = o.fs.inTx(ctx, func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM files WHERE remote = ? AND ingested_at = ? AND deleted = 0`,
+			o.remote, formatDBTime(o.ingestedAt)).Scan(&n)
+		if err != nil || n == 0 {
+			return err
+		}
+		if t == hash.MD5 {
+			_, err = tx.ExecContext(ctx, `UPDATE files SET has_hash = 1, hash = ? WHERE remote = ?`, sum, o.remote)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO hashes (remote, type, value) VALUES (?, ?, ?)`, o.remote, t.String(), sum)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store hash: %w", err)
+	}
+	o.fs.objects.remove(o.remote)
+	return sum, nil
+}
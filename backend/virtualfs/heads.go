@@ -0,0 +1,66 @@
+package virtualfs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// maxHeadBytes is the most cache_head_bytes can be, as heads are kept
+// in the catalog
+const maxHeadBytes = 1 << 20
+
+// headOnly returns true if only the head of content of size bytes is
+// kept, as it is larger than cache_head_bytes. Streams of unknown size
+// are stored in full.
+func (f *Fs) headOnly(size int64) bool {
+	return f.opt.CacheHeadBytes > 0 && f.opt.StoreContent && size > int64(f.opt.CacheHeadBytes)
+}
+
+// headContent reads in for its size and hashes, keeping only its first
+// cache_head_bytes to be stored in the catalog
+func (f *Fs) headContent(ctx context.Context, in io.Reader) (*content, error) {
+	err := f.waitIngest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, f.opt.CacheHeadBytes)
+	n, err := io.ReadFull(in, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	c, err := f.discardContent(io.MultiReader(bytes.NewReader(head), in))
+	if err != nil {
+		return nil, err
+	}
+	c.head = head
+	return c, nil
+}
+
+// openHead opens the part of the object asked for by options from the
+// head kept in the catalog, returning false if it isn't all in there
+func (o *Object) openHead(ctx context.Context, options []fs.OpenOption) (io.ReadCloser, bool, error) {
+	if !o.evicted || o.headSize == 0 {
+		return nil, false, nil
+	}
+	offset, limit := decodeRange(o.size, options)
+	if offset < 0 || limit < 0 || offset+limit > o.headSize {
+		return nil, false, nil
+	}
+	var head []byte
+	err := o.fs.rdb.QueryRowContext(ctx, `SELECT head FROM files WHERE remote = ? AND ingested_at = ? AND deleted = 0 AND head IS NOT NULL`,
+		o.remote, formatDBTime(o.ingestedAt)).Scan(&head)
+	if err == sql.ErrNoRows || int64(len(head)) < offset+limit {
+		// The whole file has been fetched or replaced since
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	o.fs.logOp(nil, "VirtualFS: Reading %s from the head kept in the catalog", o.remote)
+	return io.NopCloser(bytes.NewReader(head[offset : offset+limit])), true, nil
+}
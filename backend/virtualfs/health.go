@@ -0,0 +1,144 @@
+package virtualfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/diskusage"
+	"github.com/rclone/rclone/lib/file"
+)
+
+// defaultHealthMaxWAL is the largest the write ahead log of the catalog
+// can be before the health command reports it, as it only grows that
+// big if checkpoints can't keep up or a reader holds one back
+const defaultHealthMaxWAL = fs.SizeSuffix(1 << 30)
+
+// Names of the checks made by the health command
+const (
+	healthDatabase = "database"
+	healthWritable = "writable"
+	healthRoot     = "root_directory"
+	healthFree     = "free_space"
+	healthWAL      = "wal"
+)
+
+// healthResult is returned by the health command
+type healthResult struct {
+	Healthy bool          `json:"healthy"` // set if every check passed
+	Checks  []healthCheck `json:"checks"`
+}
+
+// healthCheck is the result of one check made by the health command
+type healthCheck struct {
+	Name  string `json:"name"`
+	Path  string `json:"path,omitempty"`  // the file or directory checked
+	OK    bool   `json:"ok"`              // set if the check passed
+	Value int64  `json:"value,omitempty"` // bytes free or the size of the write ahead log
+	Limit int64  `json:"limit,omitempty"` // what value was checked against
+	Error string `json:"error,omitempty"` // why the check failed
+}
+
+// health checks the catalog can be read and, unless read_only, written,
+// that each local root directory is there and can be written with at
+// least minFree bytes free, and that the write ahead log of the catalog
+// is under maxWAL bytes. A negative minFree uses min_free_space.
+func (f *Fs) health(ctx context.Context, minFree, maxWAL fs.SizeSuffix) *healthResult {
+	if minFree < 0 {
+		minFree = f.opt.MinFreeSpace
+	}
+	res := &healthResult{Healthy: true, Checks: []healthCheck{}}
+	add := func(c healthCheck, err error) {
+		if err != nil {
+			c.Error = err.Error()
+		}
+		c.OK = err == nil
+		res.Healthy = res.Healthy && c.OK
+		res.Checks = append(res.Checks, c)
+	}
+
+	var n int64
+	err := f.rdb.QueryRowContext(ctx, `SELECT COUNT(*) FROM files WHERE remote = ''`).Scan(&n)
+	add(healthCheck{Name: healthDatabase, Path: f.dbFile}, err)
+	if !f.opt.ReadOnly {
+		add(healthCheck{Name: healthWritable, Path: f.dbFile}, f.checkDBWritable(ctx))
+	}
+
+	roots := f.localRoots()
+	if roots == nil {
+		roots = []string{f.opt.RootDirectory}
+	}
+	for _, root := range roots {
+		add(healthCheck{Name: healthRoot, Path: root}, f.checkRootWritable(root))
+		avail, err := freeSpace(root)
+		if err == diskusage.ErrUnsupported {
+			continue
+		}
+		if err == nil && avail < int64(minFree) {
+			err = fmt.Errorf("only %v free, less than %v", fs.SizeSuffix(avail), minFree)
+		}
+		add(healthCheck{Name: healthFree, Path: root, Value: avail, Limit: int64(minFree)}, err)
+	}
+
+	wal := f.dbFile + "-wal"
+	var size int64
+	info, err := os.Stat(wal)
+	if err == nil {
+		size = info.Size()
+		if size > int64(maxWAL) {
+			err = fmt.Errorf("write ahead log is %v, more than %v", fs.SizeSuffix(size), maxWAL)
+		}
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	add(healthCheck{Name: healthWAL, Path: wal, Value: size, Limit: int64(maxWAL)}, err)
+
+	if !res.Healthy {
+		fs.Errorf(nil, "VirtualFS: Health check failed")
+	}
+	return res
+}
+
+// checkDBWritable takes the write lock of the catalog, which is only
+// given if it can be written, and lets it go again without changing
+// anything
+func (f *Fs) checkDBWritable(ctx context.Context) error {
+	tx, err := f.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE files SET remote = remote WHERE 0`)
+	rollbackErr := tx.Rollback()
+	if err == nil {
+		err = rollbackErr
+	}
+	return err
+}
+
+// checkRootWritable checks root is a directory a file can be made in,
+// so a volume which has gone away or become read only is noticed
+func (f *Fs) checkRootWritable(root string) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
+	}
+	if f.opt.ReadOnly {
+		return nil
+	}
+	staging := filepath.Join(root, stagingDir)
+	err = file.MkdirAll(staging, 0755)
+	if err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(staging, "health-*")
+	if err != nil {
+		return err
+	}
+	_ = probe.Close()
+	return os.Remove(probe.Name())
+}
@@ -0,0 +1,99 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+)
+
+// errHeld is returned when the content of a file under legal hold
+// would be evicted
+var errHeld = errors.New("file is under legal hold")
+
+// checkChangeable returns a permission error if o mustn't be replaced
+// or removed, as it is under legal hold or retention_period
+func (o *Object) checkChangeable() error {
+	if o.held {
+		return fserrors.NoRetryError(fmt.Errorf("%s: under legal hold: %w", o.remote, fs.ErrorPermissionDenied))
+	}
+	return o.checkRetention()
+}
+
+// holdEntry is returned for each file put under or released from
+// legal hold
+type holdEntry struct {
+	Path string `json:"path"`
+	Held bool   `json:"held"`
+}
+
+// hold puts each of remotes under legal hold, or releases it if held
+// is false. A directory given holds or releases every file in it or
+// further down.
+func (f *Fs) hold(ctx context.Context, remotes []string, held bool) ([]holdEntry, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	detail := "released"
+	if held {
+		detail = "held"
+	}
+	var entries []holdEntry
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		entries = []holdEntry{}
+		for _, remote := range remotes {
+			files, err := f.holdTargets(ctx, tx, remote)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				_, err = tx.ExecContext(ctx, `UPDATE files SET held = ? WHERE remote = ?`, held, file)
+				if err != nil {
+					return err
+				}
+				err = f.audit(ctx, tx, auditHold, file, detail)
+				if err != nil {
+					return err
+				}
+				entries = append(entries, holdEntry{Path: file, Held: held})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		f.objects.remove(e.Path)
+	}
+	if held {
+		fs.Infof(nil, "VirtualFS: Put %d files under legal hold", len(entries))
+	} else {
+		fs.Infof(nil, "VirtualFS: Released %d files from legal hold", len(entries))
+	}
+	return entries, nil
+}
+
+// holdTargets returns the live file remote, or the files below it if it
+// is a directory
+func (f *Fs) holdTargets(ctx context.Context, tx *sql.Tx, remote string) ([]string, error) {
+	files, err := queryRemotesTx(ctx, tx, `SELECT remote FROM files WHERE remote = ? AND deleted = 0 AND is_dir = 0`, remote)
+	if err != nil || len(files) > 0 {
+		return files, err
+	}
+	if remote != "" {
+		var found bool
+		err = tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE remote = ? AND deleted = 0 AND is_dir = 1)`, remote).Scan(&found)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: file not found", remote)
+		}
+	}
+	cond, args := inDir(remote)
+	return queryRemotesTx(ctx, tx, `SELECT remote FROM files WHERE `+cond+` AND deleted = 0 AND is_dir = 0 ORDER BY remote`, args...)
+}
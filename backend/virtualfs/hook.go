@@ -0,0 +1,162 @@
+package virtualfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"golang.org/x/sync/errgroup"
+)
+
+// hookCursor names the cursor recording the last change run through
+// the on_ingest_command
+const hookCursor = "on_ingest"
+
+// hookInterval is how often the journal is checked for new files if
+// nothing wakes the hook runner
+const hookInterval = time.Minute
+
+// wakeHook tells the hook runner there are new files
+func (f *Fs) wakeHook() {
+	if f.hookWake == nil {
+		return
+	}
+	select {
+	case f.hookWake <- struct{}{}:
+	default:
+	}
+}
+
+// runHooks runs the on_ingest_command for each file in the namespace
+// created or updated since the last run, on_ingest_concurrency at a
+// time. The cursor is only moved up to the first change the command
+// fails for, so it and those after it are run again on the next pass.
+func (f *Fs) runHooks(ctx context.Context) error {
+	seq, err := f.readCursor(ctx, hookCursor)
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := f.changes(ctx, strconv.FormatInt(seq, 10), notifyBatch)
+		if err != nil {
+			return err
+		}
+		var g errgroup.Group
+		g.SetLimit(max(f.opt.OnIngestConcurrency, 1))
+		errs := make([]error, len(res.Changes))
+		for i, change := range res.Changes {
+			if change.Event == eventDelete || change.Event == eventRename || !f.inNamespace(change.Path) {
+				continue
+			}
+			i, change := i, change
+			g.Go(func() error {
+				errs[i] = f.runHook(ctx, change)
+				return nil
+			})
+		}
+		_ = g.Wait()
+		if ctx.Err() != nil {
+			return nil
+		}
+		// Carry on from just before the first change which failed
+		var failed error
+		for i, err := range errs {
+			if err != nil {
+				failed = err
+				break
+			}
+			seq = res.Changes[i].Seq
+		}
+		if failed == nil {
+			seq = res.Last
+		}
+		err = f.writeCursor(ctx, hookCursor, seq)
+		if err != nil {
+			return err
+		}
+		if failed != nil {
+			return failed
+		}
+		if !res.More {
+			return nil
+		}
+	}
+}
+
+// runHook runs the on_ingest_command for change, evicting the content
+// afterwards if it succeeds and on_ingest_evict is set. It returns an
+// error if the command couldn't be run for the file or failed.
+func (f *Fs) runHook(ctx context.Context, change changeEntry) error {
+	objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE remote = ? AND deleted = 0 AND is_dir = 0`, change.Path)
+	if err != nil {
+		return fmt.Errorf("failed to look up %s for on_ingest_command: %w", change.Path, err)
+	}
+	if len(objects) == 0 {
+		// Gone since so nothing to do
+		return nil
+	}
+	o := objects[0]
+
+	args := append(append([]string{}, f.opt.OnIngestCommand[1:]...), change.Path)
+	cmd := exec.CommandContext(ctx, f.opt.OnIngestCommand[0], args...)
+	cmd.Env = append(os.Environ(),
+		"VIRTUALFS_REMOTE="+change.Path,
+		"VIRTUALFS_FILE="+f.plainContentFile(o),
+		"VIRTUALFS_EVENT="+change.Event,
+		"VIRTUALFS_SIZE="+strconv.FormatInt(change.Size, 10),
+		"VIRTUALFS_HASH="+change.Hash,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("command failed for %s: %w: %s", change.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	f.logOp(nil, "VirtualFS: on_ingest_command succeeded for %s", change.Path)
+	if !f.opt.OnIngestEvict {
+		return nil
+	}
+	// Leave content ingested since the command started for its own run
+	later, err := f.queryRemotes(ctx, `SELECT remote FROM journal WHERE remote = ? AND seq > ? LIMIT 1`, change.Path, change.Seq)
+	if err == nil && len(later) == 0 {
+		_, err = o.evict(ctx)
+	}
+	if errors.Is(err, errHeld) {
+		f.logOp(nil, "VirtualFS: Not evicting %s after on_ingest_command as it is under legal hold", change.Path)
+	} else if err != nil {
+		fs.Errorf(nil, "VirtualFS: Failed to evict content of %s after on_ingest_command: %v", change.Path, err)
+	}
+	return nil
+}
+
+// plainContentFile returns the local file holding the content of o if
+// it can be read as it is, or "" if it isn't stored like that
+func (f *Fs) plainContentFile(o *Object) string {
+	if o.evicted || o.compression != "" || o.keyID != "" || o.chunked() {
+		return ""
+	}
+	p, _ := f.localPath(o.contentKey())
+	return p
+}
+
+// checkHookCommand checks the on_ingest_command option
+func checkHookCommand(command fs.SpaceSepList) error {
+	if len(command) == 0 {
+		return nil
+	}
+	_, err := exec.LookPath(command[0])
+	if err != nil {
+		return fmt.Errorf("invalid on_ingest_command: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package virtualfs
+
+import (
+	"context"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// ingestFiltered returns true if src, to be uploaded to remote, is
+// dropped by the ingest filters rather than ingested
+func (f *Fs) ingestFiltered(ctx context.Context, remote string, src fs.ObjectInfo) bool {
+	if len(f.ingestInclude) > 0 && !matchAny(f.ingestInclude, remote) {
+		fs.Debugf(src, "VirtualFS: Not ingesting %s as it doesn't match ingest_include", remote)
+		return true
+	}
+	if matchAny(f.ingestExclude, remote) {
+		fs.Debugf(src, "VirtualFS: Not ingesting %s as it matches ingest_exclude", remote)
+		return true
+	}
+	if f.opt.IngestMinAge > 0 || f.opt.IngestMaxAge > 0 {
+		age := time.Since(src.ModTime(ctx))
+		if f.opt.IngestMinAge > 0 && age < time.Duration(f.opt.IngestMinAge) {
+			fs.Debugf(src, "VirtualFS: Not ingesting %s as it is newer than ingest_min_age", remote)
+			return true
+		}
+		if f.opt.IngestMaxAge > 0 && age > time.Duration(f.opt.IngestMaxAge) {
+			fs.Debugf(src, "VirtualFS: Not ingesting %s as it is older than ingest_max_age", remote)
+			return true
+		}
+	}
+	return false
+}
+
+// droppedObject returns the Object a Put of src to remote which was
+// dropped by the ingest filters returns. It looks like what was
+// uploaded but is in neither the catalog nor the object cache.
+func (f *Fs) droppedObject(ctx context.Context, remote string, src fs.ObjectInfo) *Object {
+	o := &Object{
+		fs:      f,
+		remote:  remote,
+		size:    src.Size(),
+		modTime: src.ModTime(ctx),
+		status:  statusPending,
+	}
+	if md5, err := src.Hash(ctx, hash.MD5); err == nil && md5 != "" {
+		o.hasHash, o.hash = true, md5
+	}
+	return o
+}
@@ -0,0 +1,162 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// beginIngest records in the ingest journal, if ingest_journal is set,
+// that content for remote is being written to the temporary file tmp,
+// returning the ID of the entry or 0 if none was recorded
+func (f *Fs) beginIngest(ctx context.Context, remote, tmp string) (id int64, err error) {
+	if !f.opt.IngestJournal {
+		return 0, nil
+	}
+	err = f.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `INSERT INTO ingests (remote, tmp, started_at) VALUES (?, ?, ?)`, remote, tmp, formatDBTime(time.Now()))
+		if err != nil {
+			return err
+		}
+		id, err = res.LastInsertId()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to record ingest of %s: %w", remote, err)
+	}
+	return id, nil
+}
+
+// publishingIngest records in the ingest journal entry id that its
+// content is about to be moved into the store at key
+func (f *Fs) publishingIngest(ctx context.Context, id int64, key string) error {
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `UPDATE ingests SET key = ? WHERE id = ?`, key, id)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record publishing content: %w", err)
+	}
+	return nil
+}
+
+// completeIngest removes the ingest journal entry id in tx, the
+// transaction recording what it ingested
+func completeIngest(ctx context.Context, tx *sql.Tx, id int64) error {
+	if id == 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM ingests WHERE id = ?`, id)
+	return err
+}
+
+// endIngest removes the ingest journal entry id of an ingest which
+// isn't going to be recorded, after cleaning up after itself
+func (f *Fs) endIngest(ctx context.Context, id int64) {
+	// The ingest may have failed as it was cancelled
+	ctx = context.WithoutCancel(ctx)
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		return completeIngest(ctx, tx, id)
+	})
+	if err != nil {
+		fs.Errorf(nil, "VirtualFS: Failed to remove ingest journal entry %d: %v", id, err)
+	}
+}
+
+// recoverIngests rolls back each ingest in the ingest journal which
+// started before cutoff but was never recorded, as the process doing it
+// crashed, returning how many there were.
+//
+// An interrupted upload kept by resume_partial is left to be resumed.
+// Otherwise the temporary file is removed. Content which had been moved
+// into the store is removed if nothing in the catalog refers to it, or
+// the file it replaced is flagged corrupt, as the catalog still
+// describes the content it overwrote, so scrub or repair deal with it.
+func (f *Fs) recoverIngests(ctx context.Context, cutoff time.Time) (int, error) {
+	rows, err := f.rdb.QueryContext(ctx, `SELECT id, remote, tmp, key FROM ingests WHERE started_at < ? ORDER BY id`, formatDBTime(cutoff))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read ingest journal: %w", err)
+	}
+	type entry struct {
+		id          int64
+		remote, tmp string
+		key         sql.NullString
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		err = rows.Scan(&e.id, &e.remote, &e.tmp, &e.key)
+		if err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		entries = append(entries, e)
+	}
+	err = rows.Close()
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range entries {
+		kept, err := f.isPartial(ctx, filepath.Base(e.tmp))
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case kept:
+			fs.Infof(nil, "VirtualFS: Leaving interrupted ingest of %s to be resumed", e.remote)
+		case !e.key.Valid:
+			fs.Infof(nil, "VirtualFS: Rolling back interrupted ingest of %s", e.remote)
+		default:
+			err = f.rollbackPublished(ctx, e.remote, e.key.String)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if !kept {
+			err = os.Remove(e.tmp)
+			if err != nil && !os.IsNotExist(err) {
+				return 0, err
+			}
+		}
+		f.endIngest(ctx, e.id)
+	}
+	return len(entries), nil
+}
+
+// rollbackPublished deals with the content at key, moved into the store
+// for remote by an ingest which never recorded it
+func (f *Fs) rollbackPublished(ctx context.Context, remote, key string) error {
+	referenced, err := f.isReferenced(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !referenced {
+		fs.Infof(nil, "VirtualFS: Rolling back interrupted ingest of %s, removing its content", remote)
+		return f.removeContent(ctx, key)
+	}
+	_, rel := splitDiskKey(key)
+	if _, isBlob := blobHash(rel); isBlob {
+		// A blob is named after its content so it is what the catalog says
+		fs.Infof(nil, "VirtualFS: Rolling back interrupted ingest of %s, keeping its content shared with other files", remote)
+		return nil
+	}
+	fs.Logf(nil, "VirtualFS: Interrupted ingest of %s replaced its content, flagging it corrupt", remote)
+	err = f.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `UPDATE files SET corrupt = 1 WHERE remote = ? AND deleted = 0 AND evicted = 0`, remote)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	f.objects.remove(remote)
+	return nil
+}
@@ -0,0 +1,207 @@
+package virtualfs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// inlineStore keeps content no bigger than inline_max_size in the
+// catalog, in the inline_content table, and the rest in the store it
+// wraps. Content is looked for in the catalog first, so content stored
+// inline before inline_max_size was lowered or turned off can still be
+// read.
+type inlineStore struct {
+	base    contentStore
+	db      *sql.DB // writes
+	rdb     *sql.DB // reads
+	maxSize int64   // largest content published inline, 0 for none
+}
+
+// openInline wraps the store in an inlineStore if inline_max_size is
+// set or the catalog has content stored inline
+func (f *Fs) openInline(ctx context.Context) error {
+	if f.opt.InlineMaxSize <= 0 {
+		var inline bool
+		err := f.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM inline_content)`).Scan(&inline)
+		if err != nil || !inline {
+			return err
+		}
+	}
+	f.store = &inlineStore{base: f.store, db: f.db, rdb: f.rdb, maxSize: max(int64(f.opt.InlineMaxSize), 0)}
+	return nil
+}
+
+// baseStore returns the store content too big to be inline is kept in
+func (f *Fs) baseStore() contentStore {
+	if s, ok := f.store.(*inlineStore); ok {
+		return s.base
+	}
+	return f.store
+}
+
+// isInline returns true if the content at key is stored in the catalog
+func (f *Fs) isInline(key string) bool {
+	s, ok := f.store.(*inlineStore)
+	if !ok || key == "" {
+		return false
+	}
+	found, err := s.has(context.Background(), key)
+	return err == nil && found
+}
+
+// has returns true if the content at p is inline
+func (s *inlineStore) has(ctx context.Context, p string) (found bool, err error) {
+	err = s.rdb.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM inline_content WHERE key = ?)`, p).Scan(&found)
+	return found, err
+}
+
+// overwrite overwrites the content at p with zeros if it is inline
+func (s *inlineStore) overwrite(ctx context.Context, p string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE inline_content SET data = zeroblob(length(data)) WHERE key = ?`, p)
+	return err
+}
+
+func (s *inlineStore) stagingDir(dir string) string {
+	return s.base.stagingDir(dir)
+}
+
+// publish stores tmp inline if it is small enough, removing any content
+// at p in the base store, or else publishes it to the base store and
+// removes any inline content at p
+func (s *inlineStore) publish(ctx context.Context, tmp, p string) error {
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if info.Size() > s.maxSize {
+		return s.publishFile(ctx, tmp, p)
+	}
+	data, err := os.ReadFile(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT OR REPLACE INTO inline_content (key, data, mod_time) VALUES (?, ?, ?)`, p, data, formatDBTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to store content in the catalog: %w", err)
+	}
+	err = s.base.remove(ctx, p)
+	if err != nil {
+		return err
+	}
+	return os.Remove(tmp)
+}
+
+// publishFile publishes tmp to the base store whatever its size,
+// removing any inline content at p
+func (s *inlineStore) publishFile(ctx context.Context, tmp, p string) error {
+	err := s.base.publish(ctx, tmp, p)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `DELETE FROM inline_content WHERE key = ?`, p)
+	return err
+}
+
+func (s *inlineStore) open(ctx context.Context, p string) (io.ReadCloser, error) {
+	var data []byte
+	err := s.rdb.QueryRowContext(ctx, `SELECT data FROM inline_content WHERE key = ?`, p).Scan(&data)
+	if err == sql.ErrNoRows {
+		return s.base.open(ctx, p)
+	} else if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *inlineStore) exists(ctx context.Context, p string) (bool, error) {
+	found, err := s.has(ctx, p)
+	if err != nil || found {
+		return found, err
+	}
+	return s.base.exists(ctx, p)
+}
+
+func (s *inlineStore) remove(ctx context.Context, p string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM inline_content WHERE key = ?`, p)
+	if err != nil {
+		return err
+	}
+	return s.base.remove(ctx, p)
+}
+
+// move renames inline content in the catalog, and moves anything else
+// in the base store
+func (s *inlineStore) move(ctx context.Context, src, dst string) error {
+	found, err := s.has(ctx, src)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return s.base.move(ctx, src, dst)
+	}
+	_, err = s.db.ExecContext(ctx, `UPDATE OR REPLACE inline_content SET key = ? WHERE key = ?`, dst, src)
+	if err != nil {
+		return err
+	}
+	return s.base.remove(ctx, dst)
+}
+
+func (s *inlineStore) mkdir(ctx context.Context, dir string) error {
+	return s.base.mkdir(ctx, dir)
+}
+
+func (s *inlineStore) rmdir(ctx context.Context, dir string) error {
+	return s.base.rmdir(ctx, dir)
+}
+
+// walk calls fn for the content in the base store and then for that
+// inline, which is read first so fn is free to change it
+func (s *inlineStore) walk(ctx context.Context, fn func(p string, modTime time.Time) error) error {
+	err := s.base.walk(ctx, fn)
+	if err != nil {
+		return err
+	}
+	type inlineEntry struct {
+		key     string
+		modTime time.Time
+	}
+	var entries []inlineEntry
+	rows, err := s.rdb.QueryContext(ctx, `SELECT key, mod_time FROM inline_content ORDER BY key`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var key string
+		var modTime sql.NullString
+		err = rows.Scan(&key, &modTime)
+		if err != nil {
+			break
+		}
+		if _, rel := splitDiskKey(key); isReserved(rel) {
+			continue
+		}
+		entries = append(entries, inlineEntry{key: key, modTime: parseNullTime(modTime)})
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	_ = rows.Close()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = fn(entry.key, entry.modTime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the interfaces are satisfied
+var _ contentStore = (*inlineStore)(nil)
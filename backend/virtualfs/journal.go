@@ -0,0 +1,122 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Events recorded in the change journal
+const (
+	eventCreate = "create"
+	eventUpdate = "update"
+	eventDelete = "delete"
+	eventRename = "rename" // the file was moved here by the rewrite command
+)
+
+// defaultChangesLimit is how many changes the changes command returns
+// if not told otherwise
+const defaultChangesLimit = 1000
+
+// journalChange records event happening to remote in the change journal
+func (f *Fs) journalChange(ctx context.Context, tx *sql.Tx, remote, event string, size int64, hash string) error {
+	now := time.Now()
+	_, err := tx.StmtContext(ctx, f.stmts.journal).ExecContext(ctx, remote, event, size, nullString(hash), formatDBTime(now), now.UnixNano())
+	if err != nil {
+		return fmt.Errorf("failed to record change to %s: %w", remote, err)
+	}
+	return nil
+}
+
+// journalIngest records the ingest of o in the change journal as a
+// create or an update depending on whether it was there before. It
+// must be called before the row for o is written.
+func (f *Fs) journalIngest(ctx context.Context, tx *sql.Tx, o *Object) error {
+	event := eventCreate
+	var deleted bool
+	err := tx.QueryRowContext(ctx, `SELECT deleted FROM files WHERE remote = ? AND is_dir = 0`, o.remote).Scan(&deleted)
+	if err == nil && !deleted {
+		event = eventUpdate
+	} else if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	return f.journalChange(ctx, tx, o.remote, event, o.size, o.hash)
+}
+
+// afterChange is called once a change to remote has been committed to
+// the catalog and recorded in the journal
+func (f *Fs) afterChange(remote string) {
+	f.touchBookmark(remote)
+	f.wakeNotify()
+	f.wakeHook()
+}
+
+// changeEntry is one change returned by the changes command
+type changeEntry struct {
+	Seq   int64  `json:"seq"`
+	Path  string `json:"path"`
+	Event string `json:"event"`
+	Size  int64  `json:"size"`
+	Hash  string `json:"hash,omitempty"`
+	Time  string `json:"time"`
+}
+
+// changesResult is returned by the changes command
+type changesResult struct {
+	Changes []changeEntry `json:"changes"`
+	Last    int64         `json:"last"` // pass as since to carry on from here
+	More    bool          `json:"more"` // set if there are more changes after Last
+}
+
+// changes returns up to limit changes from the journal after since,
+// which is either a sequence number or a time
+func (f *Fs) changes(ctx context.Context, since string, limit int) (*changesResult, error) {
+	query := `SELECT seq, remote, event, size, hash, time FROM journal`
+	var args []interface{}
+	res := &changesResult{Changes: []changeEntry{}}
+	if since != "" {
+		if seq, err := strconv.ParseInt(since, 10, 64); err == nil {
+			query += ` WHERE seq > ?`
+			args = append(args, seq)
+			res.Last = seq
+		} else {
+			t, err := fs.ParseTime(since)
+			if err != nil {
+				return nil, fmt.Errorf("invalid since %q: need a sequence number or a time", since)
+			}
+			query += ` WHERE time >= ?`
+			args = append(args, formatDBTime(t))
+		}
+	}
+	query += ` ORDER BY seq LIMIT ?`
+	args = append(args, limit+1)
+
+	rows, err := f.rdb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		if len(res.Changes) == limit {
+			res.More = true
+			break
+		}
+		var e changeEntry
+		var hash, changeTime sql.NullString
+		err = rows.Scan(&e.Seq, &e.Path, &e.Event, &e.Size, &hash, &changeTime)
+		if err != nil {
+			return nil, err
+		}
+		e.Hash = hash.String
+		e.Time = formatTime(parseNullTime(changeTime))
+		res.Changes = append(res.Changes, e)
+		res.Last = e.Seq
+	}
+	return res, rows.Err()
+}
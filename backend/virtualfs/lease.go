@@ -0,0 +1,225 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// defaultLease is how long a worker's claim lasts if not told otherwise
+const defaultLease = 10 * time.Minute
+
+// claimQuery says which files a worker claims and for how long
+type claimQuery struct {
+	worker  string        // the worker claiming the files, if one is
+	lease   time.Duration // how long until the worker's claim expires
+	remotes []string      // the files to claim, if set
+	dir     string        // otherwise claim the next files at or below here
+	count   int           // the most files claimed from dir
+}
+
+// claimable is the condition for a file to be claimed by worker: it is
+// waiting to be processed, or claimed by a worker whose lease has run
+// out, or by this worker already, which renews the lease
+const claimable = `deleted = 0 AND is_dir = 0 AND (status IN ('pending', 'failed') OR (status = 'claimed' AND (claim_worker = ? OR claim_expires < ?)))`
+
+// claimFiles assigns files to q.worker until its lease expires, in one
+// transaction so that processors on different hosts sharing the
+// catalog never get the same file. Without a worker the files are
+// claimed until they are released or their status is changed.
+//
+// If q.remotes is set and any of them can't be claimed none are,
+// otherwise the next q.count files in dir by priority and then age are
+// claimed, which may be none.
+func (f *Fs) claimFiles(ctx context.Context, q claimQuery) ([]statusEntry, error) {
+	now := time.Now()
+	var expires time.Time
+	expiresArg := ""
+	if q.worker != "" {
+		expires = now.Add(q.lease)
+		expiresArg = formatDBTime(expires)
+	}
+	var entries []statusEntry
+	err := f.inTx(ctx, func(tx *sql.Tx) (err error) {
+		entries = []statusEntry{}
+		remotes := q.remotes
+		if len(remotes) == 0 {
+			cond, args := inDir(q.dir)
+			args = append(args, q.worker, formatDBTime(now), q.count)
+			remotes, err = queryRemotesTx(ctx, tx, `SELECT remote FROM files WHERE `+cond+` AND `+claimable+` ORDER BY priority DESC, ingested_at, remote LIMIT ?`, args...)
+			if err != nil {
+				return err
+			}
+		}
+		for _, remote := range remotes {
+			res, err := tx.ExecContext(ctx, `UPDATE files SET status = 'claimed', status_time = ?, claim_worker = ?, claim_expires = ? WHERE remote = ? AND `+claimable,
+				formatDBTime(now), nullString(q.worker), nullString(expiresArg), remote, q.worker, formatDBTime(now))
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				return claimError(ctx, tx, remote)
+			}
+			detail := statusClaimed
+			if q.worker != "" {
+				detail += " by " + q.worker
+			}
+			err = f.audit(ctx, tx, auditStatus, remote, detail)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, statusEntry{
+				Path:        remote,
+				Status:      statusClaimed,
+				StatusTime:  formatTime(now),
+				Worker:      q.worker,
+				LeaseExpiry: formatTime(expires),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		f.objects.remove(e.Path)
+		f.events.add(statusClaimed, e.Path, 0)
+	}
+	return entries, nil
+}
+
+// claimError says why remote couldn't be claimed
+func claimError(ctx context.Context, tx *sql.Tx, remote string) error {
+	var status string
+	var worker sql.NullString
+	err := tx.QueryRowContext(ctx, `SELECT status, claim_worker FROM files WHERE remote = ? AND deleted = 0 AND is_dir = 0`, remote).Scan(&status, &worker)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%s: file not found", remote)
+	} else if err != nil {
+		return err
+	}
+	if status == statusClaimed && worker.Valid {
+		return fmt.Errorf("%s: already claimed by %s", remote, worker.String)
+	}
+	return fmt.Errorf("%s: can't claim a file which is %s", remote, status)
+}
+
+// releaseFiles moves each of remotes claimed by worker back to pending
+// for another worker to claim, in one transaction. If worker isn't set
+// the files are released whoever claimed them.
+func (f *Fs) releaseFiles(ctx context.Context, remotes []string, worker string) ([]statusEntry, error) {
+	now := time.Now()
+	var entries []statusEntry
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		entries = make([]statusEntry, 0, len(remotes))
+		for _, remote := range remotes {
+			res, err := tx.ExecContext(ctx, `UPDATE files SET status = 'pending', status_time = ?, claim_worker = NULL, claim_expires = NULL WHERE remote = ? AND deleted = 0 AND is_dir = 0 AND status = 'claimed' AND (? = '' OR claim_worker = ?)`,
+				formatDBTime(now), remote, worker, worker)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				if worker == "" {
+					return fmt.Errorf("%s: not claimed", remote)
+				}
+				return fmt.Errorf("%s: not claimed by %s", remote, worker)
+			}
+			err = f.audit(ctx, tx, auditStatus, remote, statusPending)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, statusEntry{Path: remote, Status: statusPending, StatusTime: formatTime(now)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.objects.remove(remotes...)
+	for _, remote := range remotes {
+		f.events.add(statusPending, remote, 0)
+	}
+	return entries, nil
+}
+
+// parseClaimQuery reads the arguments and options of the claim command
+// when a worker is given
+func (f *Fs) parseClaimQuery(arg []string, opt map[string]string) (q claimQuery, err error) {
+	q.worker, q.remotes, q.count = opt["worker"], arg, 1
+	if q.worker == "" {
+		return q, errors.New("need a worker")
+	}
+	q.lease, err = parseLease(opt)
+	if err != nil {
+		return q, err
+	}
+	if len(arg) > 0 {
+		if _, ok := opt["dir"]; ok {
+			return q, errors.New("can't use dir with paths")
+		}
+		return q, nil
+	}
+	q.dir = f.nsPath(opt["dir"])
+	if v, ok := opt["count"]; ok {
+		q.count, err = strconv.Atoi(v)
+		if err != nil || q.count <= 0 {
+			return q, fmt.Errorf("invalid count %q", v)
+		}
+	}
+	return q, nil
+}
+
+// parseLease reads the lease option of the claim and next commands
+func parseLease(opt map[string]string) (time.Duration, error) {
+	v, ok := opt["lease"]
+	if !ok {
+		return defaultLease, nil
+	}
+	var lease fs.Duration
+	if err := lease.Set(v); err != nil || lease <= 0 {
+		return 0, fmt.Errorf("invalid lease %q", v)
+	}
+	return time.Duration(lease), nil
+}
+
+// errNothingWaiting is returned by the next command if there are no
+// files to claim
+var errNothingWaiting = errors.New("no files waiting to be processed")
+
+// nextEntry is returned by the next command
+type nextEntry struct {
+	statusEntry
+	Size  int64  `json:"size"`
+	Local string `json:"local,omitempty"` // the content on local disk, if it is held there as it is
+}
+
+// next claims the file in q.dir to process next, the highest priority
+// and then oldest waiting, so the catalog can be used as a work queue
+func (f *Fs) next(ctx context.Context, q claimQuery) (*nextEntry, error) {
+	q.remotes, q.count = nil, 1
+	entries, err := f.claimFiles(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errNothingWaiting
+	}
+	obj, err := f.findObject(ctx, entries[0].Path)
+	if err != nil {
+		return nil, err
+	}
+	o := obj.(*Object)
+	e := &nextEntry{statusEntry: entries[0], Size: o.size}
+	e.IngestTime, e.Priority = formatTime(o.ingestedAt), o.priority
+	e.Local = f.plainContentFile(o)
+	return e, nil
+}
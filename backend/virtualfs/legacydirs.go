@@ -0,0 +1,87 @@
+package virtualfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// legacyDirs are the directories under each root directory which held
+// what belongs to the backend itself before it was all kept in
+// internalDir, by their names there
+var legacyDirs = []string{"deleting", "versions", "snapshots", "quarantine", "staging"}
+
+// moveLegacyDirs moves the legacyDirs left under each root directory
+// by older versions into internalDir, where no remote path can be
+// stored. A directory the catalog has files in is left alone as it may
+// hold the content of a remote directory of the same name.
+func (f *Fs) moveLegacyDirs(ctx context.Context) error {
+	for _, name := range legacyDirs {
+		var used bool
+		err := f.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE remote = ? OR substr(remote, 1, ?) = ?)`, name, len(name)+1, name+"/").Scan(&used)
+		if err != nil {
+			return err
+		}
+		moved := false
+		for _, root := range f.localRoots() {
+			src := filepath.Join(root, name)
+			if _, err := os.Stat(src); os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if used {
+				fs.Logf(nil, "VirtualFS: Leaving %s where it is as the catalog has files stored there", src)
+				continue
+			}
+			dst := filepath.Join(root, internalDir, name)
+			err = moveDirInto(src, dst)
+			if err != nil {
+				return fmt.Errorf("failed to move %s to %s: %w", src, dst, err)
+			}
+			fs.Infof(nil, "VirtualFS: Moved %s to %s", src, dst)
+			moved = true
+		}
+		if moved {
+			// Kept versions record where their content is
+			_, err = f.db.ExecContext(ctx, `UPDATE versions SET content_path = ? || substr(content_path, ?) WHERE substr(content_path, 1, ?) = ?`,
+				internalDir+"/"+name, len(name)+1, len(name)+1, name+"/")
+			if err != nil {
+				return fmt.Errorf("failed to record the move of %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// moveDirInto moves the directory src to dst, or everything in it
+// into dst if there is a directory there already
+func moveDirInto(src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(dst); os.IsNotExist(err) {
+		return os.Rename(src, dst)
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		from, to := filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())
+		if _, err = os.Lstat(to); err == nil {
+			fs.Logf(nil, "VirtualFS: Leaving %s as %s is there already", from, to)
+			continue
+		}
+		err = os.Rename(from, to)
+		if err != nil {
+			return err
+		}
+	}
+	_ = os.Remove(src)
+	return nil
+}
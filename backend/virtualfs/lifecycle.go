@@ -0,0 +1,185 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Processing lifecycle states of a file.
+//
+// Every ingest (re)starts a file at pending. Consumers claim it, then
+// mark it processed or failed. Failed files may be claimed again and
+// any file may be reset back to pending.
+const (
+	statusPending   = "pending"
+	statusClaimed   = "claimed"
+	statusProcessed = "processed"
+	statusFailed    = "failed"
+)
+
+// statusFrom lists, for each target status, the states it may be reached from
+var statusFrom = map[string][]string{
+	statusPending:   {statusPending, statusClaimed, statusProcessed, statusFailed},
+	statusClaimed:   {statusPending, statusFailed},
+	statusProcessed: {statusPending, statusClaimed},
+	statusFailed:    {statusPending, statusClaimed},
+}
+
+// statusEntry describes the lifecycle state of one file
+type statusEntry struct {
+	Path       string `json:"path"`
+	Status     string `json:"status"`
+	StatusTime string `json:"statusTime,omitempty"`
+	IngestTime string `json:"ingestTime,omitempty"`
+	Priority   int    `json:"priority"`
+
+	Worker      string `json:"worker,omitempty"`      // the worker which claimed the file, if one did
+	LeaseExpiry string `json:"leaseExpiry,omitempty"` // when the worker's claim runs out
+}
+
+// formatTime formats t for command output, returning "" for the zero time
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// newStatusEntry makes a statusEntry for o
+func newStatusEntry(o *Object) statusEntry {
+	return statusEntry{
+		Path:       o.remote,
+		Status:     o.status,
+		StatusTime: formatTime(o.statusTime),
+		IngestTime: formatTime(o.ingestedAt),
+		Priority:   o.priority,
+	}
+}
+
+// checkStatus returns an error if status isn't a lifecycle state
+func checkStatus(status string) error {
+	if _, ok := statusFrom[status]; !ok {
+		return fmt.Errorf("unknown status %q", status)
+	}
+	return nil
+}
+
+// fileStatus returns the lifecycle state of each of remotes
+func (f *Fs) fileStatus(ctx context.Context, remotes []string) ([]statusEntry, error) {
+	entries := make([]statusEntry, 0, len(remotes))
+	for _, remote := range remotes {
+		obj, err := f.findObject(ctx, remote)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", remote, err)
+		}
+		entries = append(entries, newStatusEntry(obj.(*Object)))
+	}
+	return entries, nil
+}
+
+// listByStatus returns the live files at or below dir in the given
+// state, highest priority first then oldest ingest first
+func (f *Fs) listByStatus(ctx context.Context, dir, status string) ([]statusEntry, error) {
+	if err := checkStatus(status); err != nil {
+		return nil, err
+	}
+	cond, args := inDir(dir)
+	args = append(args, status)
+
+	query := `SELECT ` + objectColumns + ` FROM files WHERE ` + cond + ` AND status = ? AND deleted = 0 AND is_dir = 0 ORDER BY priority DESC, ingested_at, remote`
+	rows, err := f.rdb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	entries := []statusEntry{}
+	for rows.Next() {
+		o, err := f.scanObject(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, newStatusEntry(o))
+	}
+	return entries, rows.Err()
+}
+
+// setStatus moves each of remotes to status in a single transaction.
+//
+// If any of them can't make the transition none of them are changed.
+func (f *Fs) setStatus(ctx context.Context, remotes []string, status string) ([]statusEntry, error) {
+	if err := checkStatus(status); err != nil {
+		return nil, err
+	}
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	from := statusFrom[status]
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(from)), ", ")
+	query := `UPDATE files SET status = ?, status_time = ?, claim_worker = NULL, claim_expires = NULL WHERE remote = ? AND deleted = 0 AND is_dir = 0 AND status IN (` + placeholders + `)`
+	now := time.Now()
+
+	var entries []statusEntry
+	err := f.retryBusy(ctx, func() error {
+		tx, err := f.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() {
+			_ = tx.Rollback()
+		}()
+
+		entries = make([]statusEntry, 0, len(remotes))
+		for _, remote := range remotes {
+			args := []interface{}{status, formatDBTime(now), remote}
+			for _, s := range from {
+				args = append(args, s)
+			}
+			res, err := tx.ExecContext(ctx, query, args...)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				var current string
+				err = tx.QueryRowContext(ctx, `SELECT status FROM files WHERE remote = ? AND deleted = 0 AND is_dir = 0`, remote).Scan(&current)
+				if err == sql.ErrNoRows {
+					return fmt.Errorf("%s: file not found", remote)
+				} else if err != nil {
+					return err
+				}
+				return fmt.Errorf("%s: can't change status from %s to %s", remote, current, status)
+			}
+			err = f.audit(ctx, tx, auditStatus, remote, status)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, statusEntry{
+				Path:       remote,
+				Status:     status,
+				StatusTime: formatTime(now),
+			})
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.objects.remove(remotes...)
+	for _, remote := range remotes {
+		f.events.add(status, remote, 0)
+	}
+	return entries, nil
+}
@@ -0,0 +1,103 @@
+package virtualfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+const (
+	linkSuffix    = ".rclonelink" // suffix of symlinks translated by --links
+	maxLinkTarget = 4096          // longest link target recorded, as PATH_MAX
+)
+
+// errNotLink is returned when a file which isn't a symlink is where a
+// symlink would be made
+var errNotLink = errors.New("a file which isn't a symlink is in the way")
+
+// isLinkName returns true if remote is a translated symlink
+func isLinkName(remote string) bool {
+	return strings.HasSuffix(remote, linkSuffix) && remote != linkSuffix
+}
+
+// linkCapture records the content of a translated symlink as it is
+// ingested, up to maxLinkTarget bytes
+type linkCapture struct {
+	buf      bytes.Buffer
+	overflow bool
+}
+
+// Write implements io.Writer
+func (l *linkCapture) Write(p []byte) (int, error) {
+	if l.overflow || l.buf.Len()+len(p) > maxLinkTarget {
+		l.overflow = true
+		l.buf.Reset()
+		return len(p), nil
+	}
+	return l.buf.Write(p)
+}
+
+// target returns the link target captured, or "" if the content was
+// too long to be one
+func (l *linkCapture) target() string {
+	if l.overflow {
+		return ""
+	}
+	return l.buf.String()
+}
+
+// linkPath returns the local path a symlink for the translated
+// symlink remote is made at, or "" if links can't be made
+func (f *Fs) linkPath(remote string) string {
+	if !f.opt.MaterializeLinks || f.opt.ContentLayout != layoutMirror || !isLinkName(remote) {
+		return ""
+	}
+	p, _ := f.localPath(f.storePath(strings.TrimSuffix(remote, linkSuffix)))
+	return p
+}
+
+// materializeLink makes a real symlink to target alongside the
+// translated symlink remote if materialize_links is set, replacing any
+// symlink already there but never any other file
+func (f *Fs) materializeLink(remote, target string) {
+	p := f.linkPath(remote)
+	if p == "" || target == "" {
+		return
+	}
+	err := unmaterializeLink(p)
+	if err == nil {
+		err = os.Symlink(target, p)
+	}
+	if err != nil {
+		fs.Errorf(nil, "VirtualFS: Failed to make symlink for %s: %v", remote, err)
+	}
+}
+
+// removeLink removes the symlink made for the translated symlink remote
+func (f *Fs) removeLink(remote string) {
+	p := f.linkPath(remote)
+	if p == "" {
+		return
+	}
+	err := unmaterializeLink(p)
+	if err != nil && err != errNotLink {
+		fs.Errorf(nil, "VirtualFS: Failed to remove symlink for %s: %v", remote, err)
+	}
+}
+
+// unmaterializeLink removes the symlink at p if there is one
+func unmaterializeLink(p string) error {
+	info, err := os.Lstat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return errNotLink
+	}
+	return os.Remove(p)
+}
@@ -0,0 +1,116 @@
+package virtualfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Values for the link_local option
+const (
+	linkLocalOff      = "off"
+	linkLocalReflink  = "reflink"
+	linkLocalHardlink = "hardlink"
+)
+
+// errCantLink is returned when content can't be linked and has to be
+// copied instead
+var errCantLink = errors.New("can't link content")
+
+// localSource returns the path of src if it is a file of the local
+// backend which link_local could link to, or "" if it isn't. The file
+// has to match src so it is known to be the same one.
+func (f *Fs) localSource(ctx context.Context, src fs.ObjectInfo) string {
+	if f.opt.LinkLocal == linkLocalOff {
+		return ""
+	}
+	o := fs.UnWrapObjectInfo(src)
+	if o == nil {
+		return ""
+	}
+	srcFs, ok := o.Fs().(fs.Fs)
+	if !ok || !srcFs.Features().IsLocal {
+		return ""
+	}
+	p := filepath.Join(srcFs.Root(), filepath.FromSlash(o.Remote()))
+	info, err := os.Stat(p)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != o.Size() || !info.ModTime().Equal(o.ModTime(ctx)) {
+		return ""
+	}
+	return p
+}
+
+// canLinkContent returns true if content can be linked rather than
+// copied, which needs it stored as it is in a local directory
+func (f *Fs) canLinkContent() bool {
+	if f.opt.ContentLayout == layoutCAS || f.opt.Compress != compressNone || f.cipher != nil {
+		return false
+	}
+	_, ok := f.localPath("")
+	return ok
+}
+
+// linkContent links the local file into a new content file in dir,
+// reading in, which has the same bytes, for its hashes. It returns
+// errCantLink before reading anything if the file can't be linked.
+func (f *Fs) linkContent(ctx context.Context, dir, local string, in io.Reader) (c *content, err error) {
+	tmp, err := f.linkLocal(dir, local)
+	if err != nil {
+		fs.Debugf(nil, "VirtualFS: Can't %s %s, copying it instead: %v", f.opt.LinkLocal, local, err)
+		return nil, errCantLink
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp)
+		}
+	}()
+	c, err = f.discardContent(in)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != c.size {
+		return nil, fmt.Errorf("%s changed size while being linked", local)
+	}
+	c.discarded = false
+	c.tmp = tmp
+	c.storedSize = info.Size()
+	return c, nil
+}
+
+// linkLocal makes a new file in dir with the content of the file at
+// local without copying it, returning its path
+func (f *Fs) linkLocal(dir, local string) (tmp string, err error) {
+	out, err := os.CreateTemp(dir, incomingPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	tmp = out.Name()
+	if f.opt.LinkLocal == linkLocalReflink {
+		err = reflink(out, local)
+		closeErr := out.Close()
+		if err == nil {
+			err = closeErr
+		}
+	} else {
+		// The temporary file only reserved the name
+		_ = out.Close()
+		err = os.Remove(tmp)
+		if err == nil {
+			err = os.Link(local, tmp)
+		}
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
@@ -0,0 +1,40 @@
+package virtualfs
+
+import (
+	"github.com/rclone/rclone/fs"
+)
+
+// logOp logs what is happening to a single file or directory, at info
+// level if quiet_ops is off and debug level otherwise, so large syncs
+// aren't swamped by them
+func (f *Fs) logOp(o interface{}, text string, args ...interface{}) {
+	if f.opt.QuietOps {
+		fs.Debugf(o, text, args...)
+	} else {
+		fs.Infof(o, text, args...)
+	}
+}
+
+// logSummary logs how many files have been ingested, skipped, deleted
+// and evicted since the remote was made or last shut down, if any have
+func (f *Fs) logSummary() {
+	now := f.metrics.values()
+	defer func() {
+		f.metricsStart = now
+	}()
+	count := func(name string) int64 {
+		for i, n := range metricNames {
+			if n == name {
+				return now[i] - f.metricsStart[i]
+			}
+		}
+		return 0
+	}
+	ingested, reingested, skipped := count("ingested"), count("reingested"), count("skipped")
+	deleted, evicted := count("tombstoned"), count("evicted")
+	if ingested+reingested+skipped+deleted+evicted == 0 {
+		return
+	}
+	fs.Infof(f, "VirtualFS: Ingested %d new and %d changed files, skipped %d identical, deleted %d and evicted %d",
+		ingested, reingested, skipped, deleted, evicted)
+}
@@ -0,0 +1,81 @@
+package virtualfs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	placeholderSuffix = ".delete" // added to the name of a deleted file's placeholder
+	standInPrefixLen  = 32        // maximum bytes of an overlong name kept in its stand-in
+)
+
+// shortenPath replaces each name in the store path p too long to store
+// with a stand-in, the start of the name followed by "~" and the MD5 of
+// the whole name
+//
+// Names are shortened once they leave no room for placeholderSuffix,
+// so the placeholder of any file can be stored next to it.
+func (f *Fs) shortenPath(p string) string {
+	limit := f.opt.MaxNameLength - len(placeholderSuffix)
+	if f.opt.MaxNameLength <= 0 || len(p) <= limit {
+		return p
+	}
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		if len(part) > limit {
+			parts[i] = standInName(part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// standInName returns the name stored in place of the overlong name
+func standInName(name string) string {
+	prefix := name[:standInPrefixLen]
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	sum := md5.Sum([]byte(name))
+	return prefix + "~" + hex.EncodeToString(sum[:])
+}
+
+// placeholderKey returns the path in the store of the placeholder of
+// the deleted file remote
+func (f *Fs) placeholderKey(remote string) string {
+	return f.contentKey(remote, "") + placeholderSuffix
+}
+
+// placeholderTaken returns true if the content of a live file, one
+// named like remote with placeholderSuffix added, is stored where the
+// placeholder of remote goes
+func (f *Fs) placeholderTaken(ctx context.Context, remote string) (bool, error) {
+	name := remote + placeholderSuffix
+	if f.contentKey(name, "") != f.placeholderKey(remote) {
+		return false, nil
+	}
+
+	var count int
+	err := f.rdb.QueryRowContext(ctx, `SELECT COUNT(*) FROM files WHERE remote = ? AND deleted = 0 AND is_dir = 0 AND content_path IS NULL AND disk = 0`, name).Scan(&count)
+	return count > 0, err
+}
+
+// removePlaceholder removes the placeholder of the deleted file remote,
+// leaving alone a live file stored in its place, and the empty file
+// left in its place by the zero-byte deletion_mode
+func (f *Fs) removePlaceholder(ctx context.Context, remote string) error {
+	if f.opt.DeletionMode == deletionZeroByte {
+		err := f.removeContent(ctx, f.contentKey(remote, ""))
+		if err != nil {
+			return err
+		}
+	}
+	taken, err := f.placeholderTaken(ctx, remote)
+	if err != nil || taken {
+		return err
+	}
+	return f.removeContent(ctx, f.placeholderKey(remote))
+}
@@ -0,0 +1,163 @@
+package virtualfs
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Values for the format of the manifest command
+const (
+	manifestJSON    = "json"
+	manifestCSV     = "csv"
+	manifestParquet = "parquet"
+)
+
+// manifestColumns are the columns of a CSV manifest
+var manifestColumns = []string{"path", "size", "md5", "status", "mod_time", "ingest_time"}
+
+// manifest returns the live files at or below dir which were ingested
+// or changed after since, which is a journal sequence number or a time,
+// or all of them if since is "". The files are in path order, as JSON
+// entries or a CSV document depending on format, or written as a
+// Parquet file to output, a local or rclone path, which is returned.
+func (f *Fs) manifest(ctx context.Context, dir, since, format, output string) (interface{}, error) {
+	switch format {
+	case manifestJSON, manifestCSV:
+	case manifestParquet:
+		if output == "" {
+			return nil, errors.New("need an output path to write a parquet manifest")
+		}
+	default:
+		return nil, fmt.Errorf("invalid format %q", format)
+	}
+	cond, args := inDir(dir)
+	query := `SELECT ` + objectColumns + ` FROM files WHERE ` + cond + ` AND deleted = 0 AND is_dir = 0`
+	if since != "" {
+		if seq, err := strconv.ParseInt(since, 10, 64); err == nil {
+			query += ` AND remote IN (SELECT remote FROM journal WHERE seq > ?)`
+			args = append(args, seq)
+		} else {
+			t, err := fs.ParseTime(since)
+			if err != nil {
+				return nil, fmt.Errorf("invalid since %q: need a sequence number or a time", since)
+			}
+			query += ` AND remote IN (SELECT remote FROM journal WHERE time >= ?)`
+			args = append(args, formatDBTime(t))
+		}
+	}
+	query += ` ORDER BY remote`
+	objects, err := f.queryObjects(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if format == manifestParquet {
+		return f.writeParquetManifest(ctx, objects, output)
+	}
+	entries := make([]searchEntry, 0, len(objects))
+	for _, o := range objects {
+		entries = append(entries, newSearchEntry(o))
+	}
+	if format == manifestJSON {
+		return entries, nil
+	}
+	var out strings.Builder
+	w := csv.NewWriter(&out)
+	_ = w.Write(manifestColumns)
+	for _, e := range entries {
+		_ = w.Write([]string{e.Path, strconv.FormatInt(e.Size, 10), e.MD5, e.Status, e.ModTime, e.IngestTime})
+	}
+	w.Flush()
+	return out.String(), w.Error()
+}
+
+// writeParquetManifest writes objects to output as a Parquet file with
+// manifestParquetColumns and returns where it went
+func (f *Fs) writeParquetManifest(ctx context.Context, objects []*Object, output string) (string, error) {
+	remotes := make([]string, len(objects))
+	for i, o := range objects {
+		remotes[i] = o.remote
+	}
+	tags, err := f.tagsOf(ctx, remotes)
+	if err != nil {
+		return "", err
+	}
+	remote, err := isRemotePath(output)
+	if err != nil {
+		return "", err
+	}
+	dst := output
+	if remote {
+		tmp, err := os.CreateTemp("", "virtualfs-manifest-*.parquet")
+		if err != nil {
+			return "", fmt.Errorf("failed to create temporary manifest: %w", err)
+		}
+		dst = tmp.Name()
+		_ = tmp.Close()
+		defer func() { _ = os.Remove(dst) }()
+	} else {
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+		if err != nil {
+			return "", fmt.Errorf("failed to create manifest directory: %w", err)
+		}
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", fmt.Errorf("failed to create manifest: %w", err)
+	}
+	err = writeParquetObjects(out, objects, tags)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if remote {
+		err = uploadFile(ctx, dst, output)
+		if err != nil {
+			return "", err
+		}
+	}
+	fs.Infof(nil, "VirtualFS: Wrote manifest of %d files to %s", len(objects), output)
+	return output, nil
+}
+
+// writeParquetObjects writes objects with their tags as a Parquet file
+// to out. The modification times are in microseconds since the epoch,
+// the tags sorted and comma separated and the source "remote:path" if
+// it is known.
+func writeParquetObjects(out io.Writer, objects []*Object, tags map[string][]string) error {
+	w, err := newParquetWriter(out, []*parquetColumn{
+		{name: "path", kind: parquetByteArray, converted: parquetUTF8},
+		{name: "size", kind: parquetInt64, converted: parquetNone},
+		{name: "mtime", kind: parquetInt64, converted: parquetTimestampMicros},
+		{name: "hash", kind: parquetByteArray, converted: parquetUTF8},
+		{name: "status", kind: parquetByteArray, converted: parquetUTF8},
+		{name: "tags", kind: parquetByteArray, converted: parquetUTF8},
+		{name: "source", kind: parquetByteArray, converted: parquetUTF8},
+	})
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		source := ""
+		if o.sourceRemote != "" {
+			source = o.sourceRemote + ":" + o.sourcePath
+		}
+		err = w.add(o.remote, o.size, o.modTime.UnixMicro(), o.hash, o.status, strings.Join(tags[o.remote], ","), source)
+		if err != nil {
+			return err
+		}
+	}
+	return w.close()
+}
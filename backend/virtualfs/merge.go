@@ -0,0 +1,179 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configmap"
+)
+
+// Values for the conflict option of the merge command
+const (
+	mergeNewest = "newest"
+	mergeError  = "error"
+)
+
+// maxMergeConflicts is the most conflicting paths named in the error
+// returned when conflict is error
+const maxMergeConflicts = 10
+
+// mergeResult is the output of the merge command
+type mergeResult struct {
+	Merged    int      `json:"merged"`    // files copied in, with their content if it was given
+	Evicted   int      `json:"evicted"`   // of those, files merged without their content
+	Kept      int      `json:"kept"`      // files left as they were as they were newer here
+	Conflicts []string `json:"conflicts"` // files in both catalogs
+}
+
+// merge copies the live files and directories of the catalog at
+// dbPath into this one, with their content from contentDir, the root
+// directory of that catalog, if it is set or evicted otherwise.
+//
+// A file in both is replaced if the one merged in was modified later
+// when conflict is newest. If conflict is error nothing is merged if
+// any file is in both.
+func (f *Fs) merge(ctx context.Context, dbPath, contentDir, conflict string) (*mergeResult, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	if conflict != mergeNewest && conflict != mergeError {
+		return nil, fmt.Errorf("invalid conflict %q", conflict)
+	}
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, fmt.Errorf("failed to find catalog to merge: %w", err)
+	}
+	// Relative to where rclone was run rather than the config file
+	dbPath, err := filepath.Abs(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	root := contentDir
+	if root != "" {
+		root, err = filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Content is only read from here so it may as well be empty
+		tmp, err := os.MkdirTemp("", "rclone-virtualfs-merge")
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = os.RemoveAll(tmp)
+		}()
+		root = tmp
+	}
+	regInfo, err := fs.Find("virtualfs")
+	if err != nil {
+		return nil, err
+	}
+	m := configmap.Simple{"root_directory": root, "db_path": dbPath, "read_only": "true"}
+	srcFs, err := NewFs(ctx, f.name+"-merge", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", m))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open catalog to merge: %w", err)
+	}
+	src := srcFs.(*Fs)
+	defer func() {
+		_ = src.Shutdown(ctx)
+	}()
+	objects, err := src.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE deleted = 0 ORDER BY remote`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the conflicts before anything is changed
+	res := &mergeResult{Conflicts: []string{}}
+	existing := map[string]fs.Object{}
+	for _, o := range objects {
+		if o.isDir {
+			continue
+		}
+		dst, err := f.findObject(ctx, f.absPath(o.remote))
+		if err == fs.ErrorObjectNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		existing[o.remote] = dst
+		res.Conflicts = append(res.Conflicts, o.remote)
+	}
+	if conflict == mergeError && len(res.Conflicts) > 0 {
+		names := res.Conflicts
+		if len(names) > maxMergeConflicts {
+			names = names[:maxMergeConflicts]
+		}
+		return nil, fmt.Errorf("%d files are in both catalogs, nothing merged: %s", len(res.Conflicts), strings.Join(names, ", "))
+	}
+
+	for _, o := range objects {
+		if o.isDir {
+			err = f.ensureDirectory(f.absPath(o.remote))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if dst, ok := existing[o.remote]; ok && !o.modTime.After(dst.ModTime(ctx)) {
+			res.Kept++
+			continue
+		}
+		evicted, err := f.mergeObject(ctx, o, contentDir != "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge %s: %w", o.remote, err)
+		}
+		res.Merged++
+		if evicted {
+			res.Evicted++
+		}
+	}
+	fs.Infof(nil, "VirtualFS: Merged %d files from %s, kept %d newer here", res.Merged, dbPath, res.Kept)
+	return res, nil
+}
+
+// mergeObject copies o from the catalog being merged into this one,
+// with its content if withContent is set and it has some, returning
+// whether it was merged without its content
+func (f *Fs) mergeObject(ctx context.Context, o *Object, withContent bool) (evicted bool, err error) {
+	remote := f.absPath(o.remote)
+	if withContent && !o.evicted {
+		in, err := o.Open(ctx)
+		if err != nil {
+			return false, err
+		}
+		_, err = f.Put(ctx, in, o)
+		_ = in.Close()
+		if err != nil {
+			return false, err
+		}
+	} else {
+		err = f.ensureDirectoryStructure(remote)
+		if err != nil {
+			return false, err
+		}
+		n := *o
+		n.fs = f
+		n.remote = remote
+		n.evicted = true
+		n.contentPath = ""
+		err = f.commitContent(ctx, &n, &content{discarded: true, storedSize: o.storedSize})
+		if err != nil {
+			return false, err
+		}
+		evicted = true
+	}
+
+	// Carry over what the other catalog knew of the file beyond its content
+	err = f.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `UPDATE files SET status = ?, status_time = ?, priority = ?, source_remote = ?, source_path = ?, annotation = ? WHERE remote = ?`,
+			o.status, formatDBTime(o.statusTime), o.priority, nullString(o.sourceRemote), nullString(o.sourcePath), nullString(o.annotation), remote)
+		return err
+	})
+	f.objects.remove(remote)
+	return evicted, err
+}
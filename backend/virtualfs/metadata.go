@@ -0,0 +1,251 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// systemMetadataInfo describes the catalog state returned as metadata
+var systemMetadataInfo = map[string]fs.MetadataHelp{
+	"mtime": {
+		Help:    "Time of last modification",
+		Type:    "RFC 3339",
+		Example: "2006-01-02T15:04:05.999999999Z07:00",
+	},
+	"status": {
+		Help:     "Processing lifecycle state: pending, claimed, processed or failed",
+		Type:     "string",
+		Example:  "pending",
+		ReadOnly: true,
+	},
+	"status-time": {
+		Help:     "Time the status last changed",
+		Type:     "RFC 3339",
+		Example:  "2006-01-02T15:04:05.999999999Z07:00",
+		ReadOnly: true,
+	},
+	"ingest-time": {
+		Help:     "Time the content was last ingested",
+		Type:     "RFC 3339",
+		Example:  "2006-01-02T15:04:05.999999999Z07:00",
+		ReadOnly: true,
+	},
+	"processed": {
+		Help:     "Set if the status is processed, so the file has been dealt with",
+		Type:     "boolean",
+		Example:  "false",
+		ReadOnly: true,
+	},
+	"deleted": {
+		Help:     "Set if the file has been deleted and is only kept in the trash",
+		Type:     "boolean",
+		Example:  "false",
+		ReadOnly: true,
+	},
+	"evicted": {
+		Help:     "Set if the content has been evicted from the root directory",
+		Type:     "boolean",
+		Example:  "true",
+		ReadOnly: true,
+	},
+	"corrupt": {
+		Help:     "Set if scrubbing found the content doesn't match its hashes",
+		Type:     "boolean",
+		Example:  "false",
+		ReadOnly: true,
+	},
+	"link-target": {
+		Help:     "Target of a symlink translated by --links",
+		Type:     "string",
+		Example:  "../target",
+		ReadOnly: true,
+	},
+	"source-remote": {
+		Help:     "Name of the remote the file was ingested from",
+		Type:     "string",
+		Example:  "s3",
+		ReadOnly: true,
+	},
+	"source-path": {
+		Help:     "Path of the file on the remote it was ingested from",
+		Type:     "string",
+		Example:  "bucket/path/to/file.txt",
+		ReadOnly: true,
+	},
+	"annotation": {
+		Help:     "JSON recorded against the file by the annotate backend command",
+		Type:     "JSON",
+		Example:  `{"extracted":true}`,
+		ReadOnly: true,
+	},
+	"tags": {
+		Help:     "Comma separated tags added by the tag backend command",
+		Type:     "string",
+		Example:  "invoices,customer-42",
+		ReadOnly: true,
+	},
+	"mode": {
+		Help:    "File type and mode of the source",
+		Type:    "octal, unix style",
+		Example: "0100664",
+	},
+	"uid": {
+		Help:    "User ID of the owner of the source",
+		Type:    "decimal number",
+		Example: "500",
+	},
+	"gid": {
+		Help:    "Group ID of the owner of the source",
+		Type:    "decimal number",
+		Example: "500",
+	},
+	"last-access": {
+		Help:     "Time the content was last opened, or ingested if it hasn't been",
+		Type:     "RFC 3339",
+		Example:  "2006-01-02T15:04:05.999999999Z07:00",
+		ReadOnly: true,
+	},
+	"legal-hold": {
+		Help:     "Set if the hold backend command has put the file under legal hold",
+		Type:     "boolean",
+		Example:  "true",
+		ReadOnly: true,
+	},
+	"access-count": {
+		Help:     "How many times the content has been opened",
+		Type:     "int",
+		Example:  "3",
+		ReadOnly: true,
+	},
+	"content-ttl": {
+		Help:    "TTL of the content overriding content_ttl, off to keep it however old it gets or default to go back to content_ttl",
+		Type:    "Duration",
+		Example: "30d",
+	},
+	"stored-size": {
+		Help:     "Size of the content on disk, which differs from the size if compressed",
+		Type:     "int",
+		Example:  "1024",
+		ReadOnly: true,
+	},
+}
+
+// MimeType returns the content type the source gave the file, captured
+// with its metadata, or "" to have it worked out from its name
+func (o *Object) MimeType(ctx context.Context) string {
+	return o.posix["content-type"]
+}
+
+// Metadata returns the modification time and catalog state of the
+// object along with any permissions, ownership and xattrs captured
+// from the source
+func (o *Object) Metadata(ctx context.Context) (metadata fs.Metadata, err error) {
+	metadata.Merge(o.posix)
+	metadata.Set("mtime", o.modTime.Format(time.RFC3339Nano))
+	metadata.Set("status", o.status)
+	metadata.Set("processed", strconv.FormatBool(o.status == statusProcessed))
+	if !o.statusTime.IsZero() {
+		metadata.Set("status-time", formatTime(o.statusTime))
+	}
+	if !o.ingestedAt.IsZero() {
+		metadata.Set("ingest-time", formatTime(o.ingestedAt))
+	}
+	metadata.Set("deleted", strconv.FormatBool(o.deleted))
+	metadata.Set("evicted", strconv.FormatBool(o.evicted))
+	metadata.Set("corrupt", strconv.FormatBool(o.corrupt))
+	if o.linkTarget != "" {
+		metadata.Set("link-target", o.linkTarget)
+	}
+	if o.sourceRemote != "" {
+		metadata.Set("source-remote", o.sourceRemote)
+		metadata.Set("source-path", o.sourcePath)
+	}
+	if o.annotation != "" {
+		metadata.Set("annotation", o.annotation)
+	}
+	if !o.isDir {
+		tags, err := o.fs.tagsOf(ctx, []string{o.remote})
+		if err != nil {
+			return nil, err
+		}
+		if len(tags[o.remote]) > 0 {
+			metadata.Set("tags", strings.Join(tags[o.remote], ","))
+		}
+	}
+	if !o.isDir {
+		if !o.lastAccess.IsZero() {
+			metadata.Set("last-access", formatTime(o.lastAccess))
+		}
+		metadata.Set("access-count", strconv.FormatInt(o.accessCount, 10))
+		metadata.Set("legal-hold", strconv.FormatBool(o.held))
+		if o.hasTTL {
+			metadata.Set(ttlMetadataKey, formatTTL(o.ttl))
+		}
+	}
+	if !o.isDir && !o.evicted {
+		metadata.Set("stored-size", strconv.FormatInt(o.storedSize, 10))
+	}
+	return metadata, nil
+}
+
+// SetMetadata sets the modification time, TTL and the permissions,
+// ownership and xattrs of the object from metadata, leaving what it
+// doesn't mention alone. The rest of the catalog state can't be set.
+func (o *Object) SetMetadata(ctx context.Context, metadata fs.Metadata) error {
+	if err := o.fs.checkWritable(); err != nil {
+		return err
+	}
+	if o.deleted {
+		return errInTrash
+	}
+	if o.view != "" {
+		return errInView
+	}
+	if v, ok := metadata["mtime"]; ok {
+		modTime, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return fmt.Errorf("failed to parse metadata mtime: %w", err)
+		}
+		err = o.SetModTime(ctx, modTime)
+		if err != nil {
+			return err
+		}
+	}
+	if v, ok := metadata[ttlMetadataKey]; ok && !o.isDir {
+		_, err := o.fs.setTTL(ctx, []string{o.remote}, v)
+		if err != nil {
+			return err
+		}
+		o.ttl, o.hasTTL, _ = parseTTL(v)
+	}
+	posix := posixMetadata(metadata)
+	if len(posix) == 0 {
+		return nil
+	}
+	merged := fs.Metadata{}
+	merged.Merge(o.posix)
+	merged.Merge(posix)
+	stored, err := marshalPosix(merged)
+	if err != nil {
+		return fmt.Errorf("failed to store metadata: %w", err)
+	}
+	err = o.fs.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `UPDATE files SET posix_metadata = ? WHERE remote = ?`, stored, o.remote)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	o.fs.objects.remove(o.remote)
+	o.posix = merged
+	if !o.isDir && !o.evicted {
+		o.fs.applyPosix(o)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package virtualfs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+)
+
+// metrics counts what the backends of one remote name have done since
+// rclone started, to show whether skipping identical files and caching
+// are saving anything
+type metrics struct {
+	skipped     atomic.Int64 // uploads skipped as the file was identical
+	ingested    atomic.Int64 // new files ingested
+	reingested  atomic.Int64 // changed files ingested again
+	evicted     atomic.Int64 // contents evicted
+	refetched   atomic.Int64 // evicted contents read from the origin_remote
+	tombstoned  atomic.Int64 // files deleted
+	cacheHits   atomic.Int64 // lookups answered by the object cache
+	cacheMisses atomic.Int64 // lookups which needed a query
+}
+
+// metricNames are the names of the counters in core/stats and, with
+// metricsNamespace in front, in Prometheus, in the order they are in
+// values
+var metricNames = []string{"skipped", "ingested", "reingested", "evicted", "refetched", "tombstoned", "cacheHits", "cacheMisses"}
+
+// metricsNamespace starts the names of the Prometheus metrics
+const metricsNamespace = "rclone_virtualfs_"
+
+// values returns the counters in the order of metricNames
+func (m *metrics) values() []int64 {
+	return []int64{
+		m.skipped.Load(),
+		m.ingested.Load(),
+		m.reingested.Load(),
+		m.evicted.Load(),
+		m.refetched.Load(),
+		m.tombstoned.Load(),
+		m.cacheHits.Load(),
+		m.cacheMisses.Load(),
+	}
+}
+
+var (
+	allMetricsMu sync.Mutex
+	allMetrics   = map[string]*metrics{} // by remote name
+)
+
+// metricsFor returns the counters of the remote called name
+func metricsFor(name string) *metrics {
+	allMetricsMu.Lock()
+	defer allMetricsMu.Unlock()
+	m := allMetrics[name]
+	if m == nil {
+		m = &metrics{}
+		allMetrics[name] = m
+	}
+	return m
+}
+
+// eachMetrics calls fn with the counters of every remote, in name order
+func eachMetrics(fn func(name string, m *metrics)) {
+	allMetricsMu.Lock()
+	names := make([]string, 0, len(allMetrics))
+	for name := range allMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ms := make([]*metrics, len(names))
+	for i, name := range names {
+		ms[i] = allMetrics[name]
+	}
+	allMetricsMu.Unlock()
+	for i, name := range names {
+		fn(name, ms[i])
+	}
+}
+
+// statsExtra returns the counters of every remote for core/stats, or
+// nil if no virtualfs has been made
+func statsExtra() interface{} {
+	out := map[string]map[string]int64{}
+	eachMetrics(func(name string, m *metrics) {
+		counters := make(map[string]int64, len(metricNames))
+		for i, v := range m.values() {
+			counters[metricNames[i]] = v
+		}
+		out[name] = counters
+	})
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// collector serves the counters of every remote to Prometheus
+type collector struct {
+	descs []*prometheus.Desc
+}
+
+// newCollector makes a collector with a description for each counter
+func newCollector() *collector {
+	c := &collector{}
+	for _, name := range metricNames {
+		c.descs = append(c.descs, prometheus.NewDesc(metricsNamespace+prometheusName(name)+"_total",
+			"Number of "+metricHelp[name]+" by virtualfs", []string{"remote"}, nil))
+	}
+	return c
+}
+
+// metricHelp describes each counter for Prometheus
+var metricHelp = map[string]string{
+	"skipped":     "uploads skipped as the file was identical",
+	"ingested":    "new files ingested",
+	"reingested":  "changed files ingested again",
+	"evicted":     "contents evicted",
+	"refetched":   "evicted contents read back from the origin",
+	"tombstoned":  "files deleted",
+	"cacheHits":   "lookups answered by the object cache",
+	"cacheMisses": "lookups which needed a catalog query",
+}
+
+// prometheusName turns a camel case counter name into snake case
+func prometheusName(name string) string {
+	var out []byte
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'A' && c <= 'Z' {
+			out = append(out, '_')
+			c += 'a' - 'A'
+		}
+		out = append(out, c)
+	}
+	return string(out)
+}
+
+// Describe implements prometheus.Collector
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	eachMetrics(func(name string, m *metrics) {
+		for i, v := range m.values() {
+			ch <- prometheus.MustNewConstMetric(c.descs[i], prometheus.CounterValue, float64(v), name)
+		}
+	})
+}
+
+// countSkipped counts src as skipped as it is the same as the file
+// stored. It is counted as a check in the transfer stats too, so skips
+// show in --stats and core/stats as the checks they really were.
+func (f *Fs) countSkipped(ctx context.Context, src fs.ObjectInfo) {
+	f.metrics.skipped.Add(1)
+	accounting.Stats(ctx).NewCheckingTransfer(src, "skipped identical").Done(ctx, nil)
+}
+
+func init() {
+	accounting.AddStatsExtra("virtualfs", statsExtra)
+	prometheus.MustRegister(newCollector())
+}
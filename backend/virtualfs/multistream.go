@@ -0,0 +1,217 @@
+package virtualfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/lib/file"
+)
+
+// OpenChunkWriter returns a writer for a multi-stream upload of src to
+// remote, which --multi-thread-streams uses for large files when the
+// source can be read in ranges.
+//
+// The streams write their chunks into a temporary file at once, each
+// at its own offset. Content stored exactly as it is read is ingested
+// from there as it is, otherwise it is read back through Put once every
+// chunk is written.
+func (f *Fs) OpenChunkWriter(ctx context.Context, remote string, src fs.ObjectInfo, options ...fs.OpenOption) (info fs.ChunkWriterInfo, writer fs.ChunkWriter, err error) {
+	if err := f.checkWritable(); err != nil {
+		return info, nil, err
+	}
+	if _, ok := f.trashPath(f.normalize(remote)); ok {
+		return info, nil, errInTrash
+	}
+	if _, _, _, ok := f.viewPath(f.normalize(remote)); ok {
+		return info, nil, errInView
+	}
+	ci := fs.GetConfig(ctx)
+	info = fs.ChunkWriterInfo{
+		ChunkSize:   int64(ci.MultiThreadChunkSize),
+		Concurrency: ci.MultiThreadStreams,
+	}
+	for _, option := range options {
+		if o, ok := option.(*fs.ChunkOption); ok && o.ChunkSize > 0 {
+			info.ChunkSize = o.ChunkSize
+		}
+	}
+	w, err := f.newRangeWriter(ctx, fs.NewOverrideRemote(src, remote), info.ChunkSize, options)
+	if err != nil {
+		return info, nil, err
+	}
+	return info, w, nil
+}
+
+// canWriteAt returns true if content of size bytes for remote is stored
+// exactly as it is read, so it can be written out of order
+func (f *Fs) canWriteAt(remote string, size int64) bool {
+	return f.opt.StoreContent && size > 0 && f.opt.Compress == compressNone && f.cipher == nil &&
+		!(f.opt.MaxFileSize > 0 && size > int64(f.opt.MaxFileSize)) &&
+		!f.uncached(size) && !f.headOnly(size) && !f.chunkedSize(size) && !isLinkName(remote)
+}
+
+// rangeWriter writes the chunks of a multi-stream upload into a
+// temporary file, which is ingested once they are all written
+type rangeWriter struct {
+	f         *Fs
+	remote    string
+	src       fs.ObjectInfo
+	options   []fs.OpenOption
+	chunkSize int64
+	c         *content // the content being written
+	out       *os.File
+	release   func()
+	closeOnce sync.Once
+}
+
+// newRangeWriter makes the temporary file for src, allocating its space
+// up front if its size is known
+func (f *Fs) newRangeWriter(ctx context.Context, src fs.ObjectInfo, chunkSize int64, options []fs.OpenOption) (w *rangeWriter, err error) {
+	remote := f.absPath(f.normalize(src.Remote()))
+	size := src.Size()
+	if size >= 0 {
+		err = f.checkQuota(ctx, remote, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = f.checkFreeSpace(ctx, remote, max(size, 0))
+	if err != nil {
+		return nil, err
+	}
+	release, err := f.acquireWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+	contentPath, dir, disk, err := f.contentDir(remote)
+	if err != nil {
+		return nil, err
+	}
+	out, err := os.CreateTemp(dir, incomingPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	if !f.opt.NoPreAllocate && size > 0 {
+		err = file.PreAllocate(size, out)
+		if err == file.ErrDiskFull {
+			_ = out.Close()
+			_ = os.Remove(out.Name())
+			return nil, err
+		} else if err != nil {
+			fs.Debugf(nil, "VirtualFS: Failed to pre-allocate %s: %v", remote, err)
+		}
+	}
+	return &rangeWriter{
+		f:         f,
+		remote:    remote,
+		src:       src,
+		options:   options,
+		chunkSize: chunkSize,
+		c:         &content{path: contentPath, tmp: out.Name(), keyID: f.keyID, disk: disk},
+		out:       out,
+		release:   release,
+	}, nil
+}
+
+// WriteChunk writes chunkNumber from reader at its offset in the file
+func (w *rangeWriter) WriteChunk(ctx context.Context, chunkNumber int, reader io.ReadSeeker) (int64, error) {
+	out := io.NewOffsetWriter(w.out, int64(chunkNumber)*w.chunkSize)
+	n, err := w.f.copyContent(out, w.f.limitRate(ctx, reader))
+	if err != nil {
+		return -1, fmt.Errorf("failed to write chunk %d: %w", chunkNumber, err)
+	}
+	return n, nil
+}
+
+// finish lets another content file be written
+func (w *rangeWriter) finish() {
+	w.closeOnce.Do(w.release)
+}
+
+// Close ingests the file now every chunk is written
+func (w *rangeWriter) Close(ctx context.Context) (err error) {
+	defer func() {
+		_ = w.out.Close()
+		// Anything put didn't move into place is no longer wanted
+		w.c.removeTmp()
+	}()
+	w.finish()
+	info, err := w.out.Stat()
+	if err != nil {
+		return err
+	}
+	if w.src.Size() >= 0 && info.Size() != w.src.Size() {
+		return fmt.Errorf("multi-stream upload of %s wrote %d bytes, expecting %d", w.remote, info.Size(), w.src.Size())
+	}
+	if !w.f.canWriteAt(w.remote, info.Size()) {
+		// Store it the usual way now it is in one piece
+		_, err = w.f.put(ctx, io.NewSectionReader(w.out, 0, info.Size()), w.src, nil, w.options)
+		return err
+	}
+	err = w.f.waitIngest(ctx)
+	if err != nil {
+		return err
+	}
+	if w.src.Size() < 0 {
+		err = w.f.checkQuota(ctx, w.remote, info.Size())
+		if err != nil {
+			return err
+		}
+	}
+	if w.f.opt.DurableWrites {
+		err = w.out.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to flush content to disk: %w", err)
+		}
+	}
+	err = w.hash(info.Size())
+	if err != nil {
+		return err
+	}
+	err = w.out.Close()
+	if err != nil {
+		return err
+	}
+	_, err = w.f.put(ctx, nil, w.src, w.c, w.options)
+	return err
+}
+
+// hash reads the written file back to find its hashes
+func (w *rangeWriter) hash(size int64) error {
+	multiHasher, err := hash.NewMultiHasherTypes(w.f.ingestHashes())
+	if err != nil {
+		return fmt.Errorf("failed to create multi hasher: %w", err)
+	}
+	if w.f.ingestHashes().Count() > 0 {
+		_, err = w.f.copyContent(multiHasher, io.NewSectionReader(w.out, 0, size))
+		if err != nil {
+			return fmt.Errorf("failed to hash content: %w", err)
+		}
+	}
+	w.c.size = size
+	w.c.storedSize = size
+	w.c.md5 = multiHasher.Sums()[hash.MD5]
+	w.c.hashes = multiHasher.Sums()
+	if w.f.opt.ContentLayout == layoutCAS {
+		w.c.path = blobDir + "/" + blobName(w.c.md5, w.c.compression, w.c.keyID)
+	}
+	return nil
+}
+
+// Abort removes the file written so far
+func (w *rangeWriter) Abort(ctx context.Context) error {
+	w.finish()
+	_ = w.out.Close()
+	w.c.removeTmp()
+	return nil
+}
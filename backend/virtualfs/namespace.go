@@ -0,0 +1,122 @@
+package virtualfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkNamespace returns an error if ns can't be used as a namespace
+func checkNamespace(ns string) error {
+	if ns == "." || ns == ".." || ns == trashDir || ns == byStateDir || ns == byTagDir || strings.Contains(ns, "/") || isReserved(ns) {
+		return fmt.Errorf("invalid namespace %q: need a single name which isn't reserved", ns)
+	}
+	return nil
+}
+
+// rootPath returns the root of the remote as passed to NewFs, with the
+// namespace taken off
+func (f *Fs) rootPath() string {
+	if f.namespace == "" {
+		return f.root
+	}
+	if f.root == f.namespace {
+		return ""
+	}
+	return strings.TrimPrefix(f.root, f.namespace+"/")
+}
+
+// nsPath returns the catalog path of p, a path given to a command, in
+// the namespace
+func (f *Fs) nsPath(p string) string {
+	p = strings.Trim(p, "/")
+	if f.namespace == "" {
+		return p
+	}
+	if p == "" {
+		return f.namespace
+	}
+	return f.namespace + "/" + p
+}
+
+// Kinds of argument taken by the commands scoped to the namespace
+const (
+	nsAllPaths    = iota // every argument is a path
+	nsFirstPath          // the first argument is a path
+	nsOptionalDir        // there may be one argument, a directory
+	nsSecondDir          // there may be a directory after the first argument
+)
+
+// nsCommands are the commands which only see the files in the
+// namespace, by the arguments they take
+var nsCommands = map[string]int{
+	"status":             nsAllPaths,
+	"claim":              nsAllPaths,
+	"release":            nsAllPaths,
+	"annotate":           nsFirstPath,
+	"tag":                nsFirstPath,
+	"untag":              nsFirstPath,
+	"next":               nsOptionalDir,
+	"mark-processed":     nsAllPaths,
+	"mark-failed":        nsAllPaths,
+	"reset":              nsAllPaths,
+	"evict":              nsAllPaths,
+	"hold":               nsAllPaths,
+	"unhold":             nsAllPaths,
+	"set-ttl":            nsAllPaths,
+	"mark-synced":        nsAllPaths,
+	"sync-status":        nsOptionalDir,
+	"prune-empty-dirs":   nsOptionalDir,
+	"erase":              nsAllPaths,
+	"set-priority":       nsAllPaths,
+	"replication-status": nsAllPaths,
+	"versions":           nsAllPaths,
+	"get-version":        nsFirstPath,
+	"chunks":             nsFirstPath,
+	"pending":            nsOptionalDir,
+	"scrub":              nsOptionalDir,
+	"search":             nsOptionalDir,
+	"warm":               nsOptionalDir,
+	"manifest":           nsOptionalDir,
+	"du":                 nsOptionalDir,
+	"repair":             nsOptionalDir,
+	"wait-for-change":    nsOptionalDir,
+	"audit":              nsOptionalDir,
+	"snapshot-list":      nsSecondDir,
+	"verify-against":     nsSecondDir,
+}
+
+// nsArgs returns the arguments to run the command name with, the paths
+// in arg being put in the namespace. A command needing a directory
+// which isn't given one gets the namespace itself.
+func (f *Fs) nsArgs(name string, arg []string) []string {
+	kind, ok := nsCommands[name]
+	if !ok || f.namespace == "" {
+		return arg
+	}
+	out := append([]string(nil), arg...)
+	switch kind {
+	case nsAllPaths:
+		for i := range out {
+			out[i] = f.nsPath(out[i])
+		}
+	case nsFirstPath:
+		if len(out) > 0 {
+			out[0] = f.nsPath(out[0])
+		}
+	case nsOptionalDir:
+		if len(out) == 0 {
+			out = append(out, "")
+		}
+		out[0] = f.nsPath(out[0])
+	case nsSecondDir:
+		// Without any arguments the generations themselves are
+		// listed, which belong to the whole catalog
+		if len(out) == 1 {
+			out = append(out, "")
+		}
+		if len(out) > 1 {
+			out[1] = f.nsPath(out[1])
+		}
+	}
+	return out
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package virtualfs
+
+import "golang.org/x/sys/unix"
+
+// networkFilesystems are the statfs magic numbers of the network
+// filesystems SQLite's file locking can't be relied on over
+var networkFilesystems = map[int64]string{
+	0x6969:     "NFS",
+	0x517b:     "SMB",
+	0xff534d42: "CIFS",
+	0xfe534d42: "SMB2",
+	0x65735546: "FUSE",
+	0x564c:     "NCP",
+	0x5346414f: "AFS",
+	0x6b414653: "AFS",
+	0x01161970: "GFS2",
+	0x7461636f: "OCFS2",
+	0x47504653: "GPFS",
+	0x0bd00bd0: "Lustre",
+	0x00c36400: "CephFS",
+}
+
+// networkFilesystem returns the name of the network filesystem dir is
+// on, or "" if it isn't on one
+func networkFilesystem(dir string) string {
+	var st unix.Statfs_t
+	if unix.Statfs(dir, &st) != nil {
+		return ""
+	}
+	return networkFilesystems[int64(st.Type)&0xffffffff]
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package virtualfs
+
+// networkFilesystem returns the name of the network filesystem dir is
+// on, which isn't known on this OS, so always ""
+func networkFilesystem(dir string) string {
+	return ""
+}
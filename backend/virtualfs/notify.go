@@ -0,0 +1,168 @@
+package virtualfs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fshttp"
+)
+
+// notifyCursor names the cursor recording the last change notified
+const notifyCursor = "notify"
+
+// notifyInterval is how often undelivered notifications are retried
+const notifyInterval = time.Minute
+
+// notifyBatch is the most changes read from the journal at once
+const notifyBatch = 100
+
+// notifyRetries is how many times a notification is tried before
+// giving up until the next pass
+const notifyRetries = 5
+
+// notifyRetryDelay is the delay before the first retry, doubling each time
+var notifyRetryDelay = time.Second
+
+// wakeNotify tells the notifier there are changes to send
+func (f *Fs) wakeNotify() {
+	if f.notifyWake == nil {
+		return
+	}
+	select {
+	case f.notifyWake <- struct{}{}:
+	default:
+	}
+}
+
+// cursorName returns the name the cursor name is kept under, which is
+// different in each namespace as each only follows its own changes
+func (f *Fs) cursorName(name string) string {
+	if f.namespace == "" {
+		return name
+	}
+	return name + ":" + f.namespace
+}
+
+// inNamespace returns true if remote, a catalog path, is in the
+// namespace
+func (f *Fs) inNamespace(remote string) bool {
+	return f.namespace == "" || strings.HasPrefix(remote, f.namespace+"/")
+}
+
+// readCursor returns the sequence number saved in the cursor name,
+// starting it at the end of the journal if it doesn't exist yet. In a
+// namespace it starts where the cursor shared by every namespace got
+// to, if there is one.
+func (f *Fs) readCursor(ctx context.Context, name string) (seq int64, err error) {
+	err = f.inTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `SELECT seq FROM cursors WHERE name = ?`, f.cursorName(name)).Scan(&seq)
+		if err != sql.ErrNoRows {
+			return err
+		}
+		err = tx.QueryRowContext(ctx, `SELECT COALESCE((SELECT seq FROM cursors WHERE name = ?), (SELECT MAX(seq) FROM journal), 0)`, name).Scan(&seq)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO cursors (name, seq) VALUES (?, ?)`, f.cursorName(name), seq)
+		return err
+	})
+	return seq, err
+}
+
+// writeCursor saves seq in the cursor name
+func (f *Fs) writeCursor(ctx context.Context, name string, seq int64) error {
+	return f.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `UPDATE cursors SET seq = ? WHERE name = ?`, seq, f.cursorName(name))
+		return err
+	})
+}
+
+// notify POSTs each change in the namespace in the journal not yet
+// delivered to the notify_url, in order, stopping at the first which
+// can't be delivered so it is tried again on the next pass
+func (f *Fs) notify(ctx context.Context) error {
+	seq, err := f.readCursor(ctx, notifyCursor)
+	if err != nil {
+		return err
+	}
+	client := fshttp.NewClient(ctx)
+	for {
+		res, err := f.changes(ctx, strconv.FormatInt(seq, 10), notifyBatch)
+		if err != nil {
+			return err
+		}
+		for _, change := range res.Changes {
+			if !f.inNamespace(change.Path) {
+				continue
+			}
+			err = f.postChange(ctx, client, change)
+			if err != nil {
+				return fmt.Errorf("failed to notify %s of change to %s: %w", f.opt.NotifyURL, change.Path, err)
+			}
+			seq = change.Seq
+			err = f.writeCursor(ctx, notifyCursor, seq)
+			if err != nil {
+				return err
+			}
+		}
+		if seq != res.Last {
+			// Past the changes to other namespaces at the end
+			seq = res.Last
+			err = f.writeCursor(ctx, notifyCursor, seq)
+			if err != nil {
+				return err
+			}
+		}
+		if !res.More {
+			return nil
+		}
+	}
+}
+
+// postChange POSTs change to the notify_url, retrying on failure
+func (f *Fs) postChange(ctx context.Context, client *http.Client, change changeEntry) (err error) {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	delay := notifyRetryDelay
+	for try := 1; ; try++ {
+		err = postJSON(ctx, client, f.opt.NotifyURL, body)
+		if err == nil || try == notifyRetries {
+			return err
+		}
+		fs.Debugf(nil, "VirtualFS: Notification of change to %s failed, retrying in %v: %v", change.Path, delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// postJSON POSTs body to url as JSON, failing unless the response is 2xx
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP error %s", resp.Status)
+	}
+	return nil
+}
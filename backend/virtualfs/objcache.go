@@ -0,0 +1,147 @@
+package virtualfs
+
+import (
+	"container/list"
+	"sync"
+)
+
+// objectCache is a small LRU cache of the live objects read from the
+// catalog, and of the lookups which found nothing, so repeated lookups
+// of the same file don't each need a query.
+//
+// Objects must be removed once the write changing them has committed.
+// Reads don't wait for writes, so a read which started before a
+// removal may have found the row as it was, and what it found is only
+// added if nothing has been removed since the epoch taken before it.
+// A nil objectCache caches nothing.
+type objectCache struct {
+	mu       sync.Mutex
+	limit    int
+	removals uint64                     // the epoch, counting calls to remove and clear
+	keyOf    func(remote string) string // what remotes are looked up by
+	order    *list.List                 // most recently used at the front
+	items    map[string]*list.Element   // values are *cacheEntry
+}
+
+// cacheEntry is what the cache holds for key, o being nil if there is
+// no live object there
+type cacheEntry struct {
+	key string
+	o   *Object
+}
+
+// newObjectCache makes a cache holding up to limit objects, keyed by
+// keyOf of their remotes, or returns nil if limit is 0
+func newObjectCache(limit int, keyOf func(remote string) string) *objectCache {
+	if limit <= 0 {
+		return nil
+	}
+	return &objectCache{
+		limit: limit,
+		keyOf: keyOf,
+		order: list.New(),
+		items: make(map[string]*list.Element, limit),
+	}
+}
+
+// get returns a copy of the cached object at remote and true if the
+// lookup of remote is cached. The object is nil if remote was found
+// not to exist.
+func (c *objectCache) get(remote string) (*Object, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[c.keyOf(remote)]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	entry := e.Value.(*cacheEntry)
+	if entry.o == nil {
+		return nil, true
+	}
+	o := *entry.o
+	return &o, true
+}
+
+// epoch returns the epoch to pass to put and putMissing, to be taken
+// before reading what is put
+func (c *objectCache) epoch() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removals
+}
+
+// put caches a copy of o, read after epoch, dropping the least recently
+// used entry if the cache is full
+func (c *objectCache) put(o *Object, epoch uint64) {
+	if c == nil || o.deleted || o.isDir {
+		return
+	}
+	cached := *o
+	c.add(&cacheEntry{key: c.keyOf(o.remote), o: &cached}, epoch)
+}
+
+// putMissing caches that there was no live object at remote after
+// epoch
+func (c *objectCache) putMissing(remote string, epoch uint64) {
+	if c == nil {
+		return
+	}
+	c.add(&cacheEntry{key: c.keyOf(remote)}, epoch)
+}
+
+// add caches entry unless anything has been removed since epoch,
+// dropping the least recently used entry if the cache is full
+func (c *objectCache) add(entry *cacheEntry, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.removals != epoch {
+		return
+	}
+	if e, ok := c.items[entry.key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[entry.key] = c.order.PushFront(entry)
+	if c.order.Len() > c.limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// remove drops the objects at remotes from the cache
+func (c *objectCache) remove(remotes ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removals++
+	for _, remote := range remotes {
+		key := c.keyOf(remote)
+		if e, ok := c.items[key]; ok {
+			c.order.Remove(e)
+			delete(c.items, key)
+		}
+	}
+}
+
+// clear drops everything from the cache
+func (c *objectCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removals++
+	c.order.Init()
+	c.items = make(map[string]*list.Element, c.limit)
+}
@@ -0,0 +1,203 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// errNoContent is returned when content isn't held and can't be fetched
+var errNoContent = errors.New("content not held")
+
+// openFetching opens the content of the object, fetching it from the
+// origin_remote first if it isn't held
+func (o *Object) openFetching(ctx context.Context) (io.ReadCloser, error) {
+	if !o.evicted || o.deleted {
+		in, err := o.openContent(ctx)
+		if !errors.Is(err, os.ErrNotExist) || o.fs.opt.OriginRemote == "" {
+			return in, err
+		}
+		fs.Errorf(nil, "VirtualFS: Content of %s is missing", o.remote)
+	}
+	if !o.fs.opt.StoreContent || o.fs.uncached(o.size) {
+		// Nowhere to keep it, or too big to, so read straight from the origin
+		src, err := o.originObject(ctx)
+		if err != nil {
+			return nil, err
+		}
+		o.fs.metrics.refetched.Add(1)
+		return src.Open(ctx)
+	}
+	n, err := o.fetchFromOrigin(ctx, nil)
+	if errors.Is(err, errContentChanged) {
+		// Replaced while fetching so read whatever is there now
+		var obj fs.Object
+		obj, err = o.fs.findObject(ctx, o.remote)
+		if err == nil {
+			n = obj.(*Object)
+			if n.evicted {
+				err = fmt.Errorf("%s: %w", o.remote, errNoContent)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	*o = *n
+	return o.openContent(ctx)
+}
+
+// fetchFromOrigin downloads the content of the object from the
+// origin_remote, checking it against the stored hash, and puts it back
+// in the catalog, returning the updated object. If tr is set the bytes
+// read are accounted to it.
+func (o *Object) fetchFromOrigin(ctx context.Context, tr *accounting.Transfer) (n *Object, err error) {
+	f := o.fs
+	src, err := o.originObject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f.logOp(nil, "VirtualFS: Fetching content of %s from origin_remote", o.remote)
+	in, err := src.Open(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s in origin_remote: %w", o.remote, err)
+	}
+	if tr != nil {
+		in = tr.Account(ctx, in)
+	}
+	defer fs.CheckClose(in, &err)
+	f.metrics.refetched.Add(1)
+	c, err := f.writeContent(ctx, o.remote, in, o.size, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.size != o.size || (o.hasHash && c.md5 != "" && c.md5 != o.hash) {
+		err = fmt.Errorf("%s in origin_remote doesn't match the catalog", o.remote)
+		if f.opt.QuarantineCorrupt {
+			if qErr := o.quarantineFetched(ctx, c); qErr != nil {
+				fs.Errorf(nil, "VirtualFS: %v", qErr)
+			}
+		} else {
+			c.removeTmp()
+		}
+		return nil, err
+	}
+
+	// Only put the content back if the row is the one fetched for
+	ingestedAt := formatDBTime(o.ingestedAt)
+	c.rewrite = true
+	c.check = func(ctx context.Context, tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM files WHERE remote = ? AND ingested_at = ? AND deleted = 0`, o.remote, ingestedAt).Scan(&n)
+		if err == nil && n == 0 {
+			return errContentChanged
+		}
+		return err
+	}
+	n = o.withContent(c)
+	if !n.hasHash && c.md5 != "" {
+		// Recorded by overlay without a hash
+		n.hash, n.hasHash = c.md5, true
+	}
+	err = f.commitContent(ctx, n, c)
+	if err != nil {
+		return nil, err
+	}
+	f.afterIngest(ctx, n)
+	return n, nil
+}
+
+// originObject finds the object in the origin_remote, checking its size
+// matches the catalog
+func (o *Object) originObject(ctx context.Context) (fs.Object, error) {
+	f := o.fs
+	if f.opt.OriginRemote == "" {
+		return nil, fmt.Errorf("%s: %w and no origin_remote to fetch it from", o.remote, errNoContent)
+	}
+	origin, err := cache.Get(ctx, f.opt.OriginRemote)
+	if err != nil && err != fs.ErrorIsFile {
+		return nil, fmt.Errorf("failed to open origin_remote: %w", err)
+	}
+	src, err := origin.NewObject(ctx, o.remote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %s in origin_remote: %w", o.remote, err)
+	}
+	if src.Size() >= 0 && src.Size() != o.size {
+		return nil, fmt.Errorf("%s in origin_remote is %d bytes, expecting %d", o.remote, src.Size(), o.size)
+	}
+	return src, nil
+}
+
+// overlayObject records the file at the catalog path remote from the
+// origin_remote, if it is there and the catalog has never had anything
+// at remote, returning it with its content evicted so it is fetched
+// when first opened
+func (f *Fs) overlayObject(ctx context.Context, remote string) (fs.Object, error) {
+	if f.opt.ReadOnly {
+		return nil, fs.ErrorObjectNotFound
+	}
+	var known bool
+	err := f.rdb.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE remote = ?)`, remote).Scan(&known)
+	if err != nil {
+		return nil, err
+	}
+	if known {
+		return nil, fs.ErrorObjectNotFound
+	}
+	origin, err := cache.Get(ctx, f.opt.OriginRemote)
+	if err != nil && err != fs.ErrorIsFile {
+		return nil, fmt.Errorf("failed to open origin_remote: %w", err)
+	}
+	src, err := origin.NewObject(ctx, remote)
+	if errors.Is(err, fs.ErrorObjectNotFound) || errors.Is(err, fs.ErrorIsDir) {
+		return nil, fs.ErrorObjectNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to find %s in origin_remote: %w", remote, err)
+	}
+	if src.Size() < 0 {
+		fs.Debugf(nil, "VirtualFS: Not recording %s from origin_remote as its size is unknown", remote)
+		return nil, fs.ErrorObjectNotFound
+	}
+	err = f.ensureDirectoryStructure(remote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure directory structure: %w", err)
+	}
+	md5, _ := src.Hash(ctx, hash.MD5)
+	sums := map[hash.Type]string{}
+	for _, t := range f.hashes.Array() {
+		if sum, _ := src.Hash(ctx, t); sum != "" {
+			sums[t] = sum
+		}
+	}
+	now := time.Now()
+	o := &Object{
+		fs:          f,
+		remote:      remote,
+		size:        src.Size(),
+		modTime:     src.ModTime(ctx),
+		hasHash:     md5 != "",
+		hash:        md5,
+		status:      statusPending,
+		statusTime:  now,
+		ingestedAt:  now,
+		lastAccess:  now,
+		evicted:     true,
+		fingerprint: originFingerprint(ctx, src),
+	}
+	err = f.commitContent(ctx, o, &content{size: o.size, md5: md5, hashes: sums, discarded: true})
+	if err != nil {
+		return nil, err
+	}
+	fs.Infof(nil, "VirtualFS: Recorded %s from origin_remote", remote)
+	f.afterChange(remote)
+	return o, nil
+}
@@ -0,0 +1,311 @@
+package virtualfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The Parquet manifest is written by the little writer here rather
+// than a library as it only needs required columns of plain encoded
+// strings and integers without compression, which readers like Spark
+// and DuckDB load as they are.
+//
+// See https://parquet.apache.org/docs/file-format/ for the layout and
+// the Thrift definitions of the metadata.
+
+// parquetMagic starts and ends a Parquet file
+const parquetMagic = "PAR1"
+
+// parquetRowGroupRows is the most rows in each row group, so readers
+// can split large files between workers and the writer only buffers
+// a group at a time
+const parquetRowGroupRows = 128 * 1024
+
+// parquetRowGroupBytes is the most bytes buffered for a row group
+// before it is written out anyway
+const parquetRowGroupBytes = 64 * 1024 * 1024
+
+// Parquet physical types
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+)
+
+// Parquet converted types, parquetNone for none
+const (
+	parquetNone            = -1
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+)
+
+// Parquet values used in the metadata
+const (
+	parquetRequired     = 0 // FieldRepetitionType REQUIRED
+	parquetPlain        = 0 // Encoding PLAIN
+	parquetRLE          = 3 // Encoding RLE
+	parquetUncompressed = 0 // CompressionCodec UNCOMPRESSED
+	parquetDataPage     = 0 // PageType DATA_PAGE
+)
+
+// parquetColumn is a column of the file being written
+type parquetColumn struct {
+	name      string
+	kind      int32
+	converted int32
+	values    []byte         // plain encoded values of the row group being built
+	chunks    []parquetChunk // the chunks written, one per row group
+}
+
+// parquetChunk is where a column chunk was written
+type parquetChunk struct {
+	offset int64
+	size   int64
+}
+
+// parquetWriter writes rows of strings and int64s as a Parquet file
+type parquetWriter struct {
+	out     *bufio.Writer
+	written int64 // bytes written to out
+	columns []*parquetColumn
+	groups  []int64 // the rows in each row group written
+	rows    int64   // rows in the row group being built
+	total   int64   // rows written altogether
+}
+
+// newParquetWriter starts a Parquet file written to out with the
+// columns given, which must have the values given to each row in order
+func newParquetWriter(out io.Writer, columns []*parquetColumn) (*parquetWriter, error) {
+	w := &parquetWriter{out: bufio.NewWriter(out), columns: columns}
+	return w, w.write([]byte(parquetMagic))
+}
+
+// write writes p to the file
+func (w *parquetWriter) write(p []byte) error {
+	n, err := w.out.Write(p)
+	w.written += int64(n)
+	return err
+}
+
+// add adds a row of values, a string or int64 for each column
+func (w *parquetWriter) add(values ...interface{}) error {
+	if len(values) != len(w.columns) {
+		return fmt.Errorf("parquet row has %d values for %d columns", len(values), len(w.columns))
+	}
+	size := 0
+	for i, c := range w.columns {
+		switch v := values[i].(type) {
+		case string:
+			c.values = binary.LittleEndian.AppendUint32(c.values, uint32(len(v)))
+			c.values = append(c.values, v...)
+		case int64:
+			c.values = binary.LittleEndian.AppendUint64(c.values, uint64(v))
+		default:
+			return fmt.Errorf("can't write %T to parquet column %s", v, c.name)
+		}
+		size += len(c.values)
+	}
+	w.rows++
+	if w.rows >= parquetRowGroupRows || size >= parquetRowGroupBytes {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush writes the row group being built as a data page for each
+// column
+func (w *parquetWriter) flush() error {
+	if w.rows == 0 {
+		return nil
+	}
+	for _, c := range w.columns {
+		var t thriftWriter
+		t.begin()
+		t.i32(1, parquetDataPage)
+		t.i32(2, int32(len(c.values)))
+		t.i32(3, int32(len(c.values)))
+		t.beginField(5)
+		t.i32(1, int32(w.rows))
+		t.i32(2, parquetPlain)
+		t.i32(3, parquetRLE)
+		t.i32(4, parquetRLE)
+		t.end()
+		t.end()
+		chunk := parquetChunk{offset: w.written, size: int64(t.buf.Len() + len(c.values))}
+		err := w.write(t.buf.Bytes())
+		if err == nil {
+			err = w.write(c.values)
+		}
+		if err != nil {
+			return err
+		}
+		c.chunks = append(c.chunks, chunk)
+		c.values = c.values[:0]
+	}
+	w.groups = append(w.groups, w.rows)
+	w.total += w.rows
+	w.rows = 0
+	return nil
+}
+
+// close writes the rest of the rows and the footer describing them
+func (w *parquetWriter) close() error {
+	err := w.flush()
+	if err != nil {
+		return err
+	}
+	var t thriftWriter
+	t.begin()
+	t.i32(1, 1) // version
+	t.list(2, thriftStruct, len(w.columns)+1)
+	t.begin()
+	t.str(4, "schema")
+	t.i32(5, int32(len(w.columns)))
+	t.end()
+	for _, c := range w.columns {
+		t.begin()
+		t.i32(1, c.kind)
+		t.i32(3, parquetRequired)
+		t.str(4, c.name)
+		if c.converted != parquetNone {
+			t.i32(6, c.converted)
+		}
+		t.end()
+	}
+	t.i64(3, w.total)
+	t.list(4, thriftStruct, len(w.groups))
+	for i, rows := range w.groups {
+		var size int64
+		t.begin()
+		t.list(1, thriftStruct, len(w.columns))
+		for _, c := range w.columns {
+			chunk := c.chunks[i]
+			size += chunk.size
+			t.begin()
+			t.i64(2, chunk.offset)
+			t.beginField(3)
+			t.i32(1, c.kind)
+			t.list(2, thriftI32, 1)
+			t.varint(zigzag(parquetPlain))
+			t.list(3, thriftBinary, 1)
+			t.binary(c.name)
+			t.i32(4, parquetUncompressed)
+			t.i64(5, rows)
+			t.i64(6, chunk.size)
+			t.i64(7, chunk.size)
+			t.i64(9, chunk.offset)
+			t.end()
+			t.end()
+		}
+		t.i64(2, size)
+		t.i64(3, rows)
+		t.end()
+	}
+	t.str(6, "rclone virtualfs")
+	t.end()
+
+	err = w.write(t.buf.Bytes())
+	if err == nil {
+		err = w.write(binary.LittleEndian.AppendUint32(nil, uint32(t.buf.Len())))
+	}
+	if err == nil {
+		err = w.write([]byte(parquetMagic))
+	}
+	if err != nil {
+		return err
+	}
+	return w.out.Flush()
+}
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs with the Thrift compact protocol, which
+// the Parquet metadata is written in
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16 // the last field ID written in each struct being written
+}
+
+// zigzag encodes v so small negative numbers stay small
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+// varint writes v as a variable length integer
+func (t *thriftWriter) varint(v uint64) {
+	t.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+// binary writes s as a length followed by its bytes
+func (t *thriftWriter) binary(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+// field writes the header of field id of kind
+func (t *thriftWriter) field(id int16, kind byte) {
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.buf.WriteByte(kind)
+		t.varint(zigzag(int64(id)))
+	}
+	*last = id
+}
+
+// begin starts a struct, either a list element or after beginField
+func (t *thriftWriter) begin() {
+	t.last = append(t.last, 0)
+}
+
+// beginField starts the struct in field id
+func (t *thriftWriter) beginField(id int16) {
+	t.field(id, thriftStruct)
+	t.begin()
+}
+
+// end finishes the struct being written
+func (t *thriftWriter) end() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// i32 writes field id holding v
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+// i64 writes field id holding v
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+// str writes field id holding s
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.binary(s)
+}
+
+// list writes the header of field id holding n elements of kind,
+// which are written after it
+func (t *thriftWriter) list(id int16, kind byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | kind)
+	} else {
+		t.buf.WriteByte(0xf0 | kind)
+		t.varint(uint64(n))
+	}
+}
@@ -0,0 +1,65 @@
+package virtualfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/lib/env"
+	"github.com/rclone/rclone/lib/file"
+)
+
+// legacyRootDirectory was the default root_directory, which ended up
+// in whatever directory rclone was run from
+const legacyRootDirectory = "./virtualfs_data"
+
+// defaultRootDir is the directory in the rclone cache directory the
+// root directory of a remote without a root_directory is made in
+const defaultRootDir = "virtualfs"
+
+// expandPath expands a leading "~" and environment variables in p and
+// makes it relative to the directory of the rclone config file, if
+// there is one, rather than to wherever rclone was run from
+func expandPath(p string) string {
+	p = env.ShellExpand(p)
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	if configPath := config.GetConfigPath(); configPath != "" {
+		return filepath.Join(filepath.Dir(configPath), p)
+	}
+	return p
+}
+
+// defaultRootDirectory returns the root directory of the remote called
+// name when root_directory isn't set, in the rclone cache directory.
+//
+// A catalog left in legacyRootDirectory by an older version is used
+// where it is, so upgrading doesn't lose it.
+func defaultRootDirectory(name string) string {
+	if _, err := os.Stat(filepath.Join(legacyRootDirectory, dbName)); err == nil {
+		root, err := filepath.Abs(legacyRootDirectory)
+		if err == nil {
+			fs.Logf(nil, "VirtualFS: Using the catalog in %s, the old default root directory - set root_directory to it to keep using it from anywhere", root)
+			return root
+		}
+	}
+	name = strings.Trim(name, ":")
+	if name == "" {
+		name = "default"
+	}
+	return filepath.Join(config.GetCacheDir(), defaultRootDir, name)
+}
+
+// contentRoot returns the path to keep content under for the root
+// directory dir. Like the local backend it is made absolute and, on
+// Windows, an extended-length path, so content in trees deeper than 260
+// characters can be written.
+func contentRoot(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return file.UNCPath(dir)
+}
@@ -0,0 +1,151 @@
+package virtualfs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"runtime"
+	"strconv"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// posixKeys are the metadata keys of the permissions and ownership of
+// a file, as the local and sftp backends name them
+var posixKeys = map[string]struct{}{
+	"mode": {},
+	"uid":  {},
+	"gid":  {},
+}
+
+// unkeptKeys are the metadata keys of sources which aren't captured,
+// as the catalog has its own idea of them
+var unkeptKeys = map[string]struct{}{
+	"atime":       {},
+	"mtime":       {},
+	"btime":       {},
+	"rdev":        {},
+	"link-target": {},
+}
+
+// posixMetadata returns the permissions, ownership and xattrs from the
+// source metadata meta, or nil if there are none. Any key which isn't
+// a system key of the source or of this backend is taken to be an
+// xattr.
+func posixMetadata(meta fs.Metadata) fs.Metadata {
+	var kept fs.Metadata
+	for k, v := range meta {
+		if _, found := unkeptKeys[k]; found {
+			continue
+		}
+		if _, found := systemMetadataInfo[k]; found {
+			if _, found = posixKeys[k]; !found {
+				continue
+			}
+		}
+		kept.Set(k, v)
+	}
+	return kept
+}
+
+// isXattrKey returns true if the captured metadata key k is an xattr
+func isXattrKey(k string) bool {
+	_, found := posixKeys[k]
+	return !found
+}
+
+// marshalPosix returns meta as stored in the posix_metadata column
+func marshalPosix(meta fs.Metadata) (interface{}, error) {
+	if len(meta) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// unmarshalPosix reads the posix_metadata column
+func unmarshalPosix(s string) (meta fs.Metadata, err error) {
+	if s == "" {
+		return nil, nil
+	}
+	err = json.Unmarshal([]byte(s), &meta)
+	return meta, err
+}
+
+// posixPath returns the local path of the content of o which its
+// permissions, ownership and xattrs are applied to, or "" if they
+// can't be. Content shared between files or stored remotely is left
+// alone.
+func (f *Fs) posixPath(o *Object) string {
+	if f.opt.ContentLayout != layoutMirror || o.evicted || o.linkTarget != "" || o.chunked() {
+		return ""
+	}
+	p, _ := f.localPath(o.contentKey())
+	return p
+}
+
+// applyPosix applies the captured permissions, ownership and xattrs of
+// o to its content file. Failures are logged rather than returned as
+// the content is safely stored by then.
+func (f *Fs) applyPosix(o *Object) {
+	if len(o.posix) == 0 {
+		return
+	}
+	p := f.posixPath(o)
+	if p == "" {
+		return
+	}
+	if v, ok := o.posix["mode"]; ok {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err == nil {
+			err = os.Chmod(p, os.FileMode(mode).Perm())
+		}
+		if err != nil {
+			fs.Errorf(o, "VirtualFS: Failed to set permissions %q: %v", v, err)
+		}
+	}
+	if uid, gid, ok := o.ownership(); ok {
+		if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+			fs.Debugf(o, "VirtualFS: Ignoring ownership %d:%d on this OS", uid, gid)
+		} else if err := os.Chown(p, uid, gid); errors.Is(err, os.ErrPermission) {
+			fs.Debugf(o, "VirtualFS: Not permitted to set ownership %d:%d", uid, gid)
+		} else if err != nil {
+			fs.Errorf(o, "VirtualFS: Failed to set ownership %d:%d: %v", uid, gid, err)
+		}
+	}
+	xattrs := fs.Metadata{}
+	for k, v := range o.posix {
+		if isXattrKey(k) {
+			xattrs[k] = v
+		}
+	}
+	if len(xattrs) > 0 {
+		err := setXattrs(p, xattrs)
+		if err != nil {
+			fs.Errorf(o, "VirtualFS: Failed to set xattrs: %v", err)
+		}
+	}
+}
+
+// ownership returns the uid and gid captured for o, the gid being the
+// uid if only that was captured
+func (o *Object) ownership() (uid, gid int, ok bool) {
+	v, ok := o.posix["uid"]
+	if !ok {
+		return 0, 0, false
+	}
+	uid, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, 0, false
+	}
+	gid = uid
+	if v, ok := o.posix["gid"]; ok {
+		if gid, err = strconv.Atoi(v); err != nil {
+			return 0, 0, false
+		}
+	}
+	return uid, gid, true
+}
@@ -0,0 +1,61 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/rclone/rclone/fs"
+)
+
+var (
+	pragmaName  = regexp.MustCompile(`^[a-z_]+$`)
+	pragmaValue = regexp.MustCompile(`^(-?[0-9]+|[A-Za-z_]+)$`)
+)
+
+// parsePragmas turns the name=value pairs of db_pragmas into the
+// statements setting them. Values are limited to numbers and words so
+// nothing else can be run.
+func parsePragmas(pairs fs.CommaSepList) ([]string, error) {
+	var pragmas []string
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		if !ok || !pragmaName.MatchString(name) || !pragmaValue.MatchString(value) {
+			return nil, fmt.Errorf("invalid db_pragmas entry %q: want name=value", pair)
+		}
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA %s = %s", name, value))
+	}
+	return pragmas, nil
+}
+
+// pragmaConnector makes connections to a catalog, setting the pragmas
+// on each as the pool makes it
+type pragmaConnector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+// Connect makes a new connection
+func (c *pragmaConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+// Driver returns the driver the connections come from
+func (c *pragmaConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// openDB opens the catalog at dbPath, applying db_pragmas to every
+// connection. If reader is set the connections can only read it.
+func (f *Fs) openDB(dbPath string, reader bool) (*sql.DB, error) {
+	dsn := dbDSN(dbPath, &f.opt, reader)
+	if len(f.pragmas) == 0 {
+		return sql.Open("sqlite3", dsn)
+	}
+	return sql.OpenDB(&pragmaConnector{dsn: dsn, driver: pragmaDriver(f.pragmas)}), nil
+}
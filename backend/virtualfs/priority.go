@@ -0,0 +1,89 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+)
+
+// priorityRule gives the files matching a pattern a priority
+type priorityRule struct {
+	re       *regexp.Regexp
+	priority int
+}
+
+// parsePriorityRules parses the priority_rules option, a list of
+// glob:priority pairs
+func parsePriorityRules(list fs.CommaSepList) ([]priorityRule, error) {
+	rules := make([]priorityRule, 0, len(list))
+	for _, item := range list {
+		i := strings.LastIndex(item, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid priority rule %q: expecting glob:priority", item)
+		}
+		priority, err := strconv.Atoi(item[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority rule %q: %w", item, err)
+		}
+		re, err := filter.GlobPathToRegexp(item[:i], false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority rule %q: %w", item, err)
+		}
+		rules = append(rules, priorityRule{re: re, priority: priority})
+	}
+	return rules, nil
+}
+
+// rulePriority returns the priority the first of the priority_rules
+// remote matches gives it, and false if it matches none
+func (f *Fs) rulePriority(remote string) (int, bool) {
+	for _, rule := range f.priorityRules {
+		if rule.re.MatchString(remote) {
+			return rule.priority, true
+		}
+	}
+	return 0, false
+}
+
+// setPriority sets the priority of each of remotes in a single
+// transaction
+func (f *Fs) setPriority(ctx context.Context, remotes []string, priority int) ([]statusEntry, error) {
+	entries := make([]statusEntry, 0, len(remotes))
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		entries = entries[:0]
+		for _, remote := range remotes {
+			res, err := tx.ExecContext(ctx, `UPDATE files SET priority = ? WHERE remote = ? AND deleted = 0 AND is_dir = 0`, priority, remote)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return fmt.Errorf("%s: file not found", remote)
+			}
+			err = f.audit(ctx, tx, auditPriority, remote, strconv.Itoa(priority))
+			if err != nil {
+				return err
+			}
+			o, err := f.scanObject(tx.QueryRowContext(ctx, `SELECT `+objectColumns+` FROM files WHERE remote = ?`, remote))
+			if err != nil {
+				return err
+			}
+			entries = append(entries, newStatusEntry(o))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.objects.remove(remotes...)
+	return entries, nil
+}
@@ -0,0 +1,87 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// pruneEmptyDirs removes the directories below dir without a live
+// file in them or further down, deepest first, from the catalog and
+// the content store, returning those removed. Directories already
+// deleted are removed from the catalog too.
+//
+// If keepTombstones is set directories holding deleted files are kept,
+// so the files can still be found in the trash where they were. With
+// --dry-run nothing is removed.
+func (f *Fs) pruneEmptyDirs(ctx context.Context, dir string, keepTombstones bool) ([]string, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	dryRun := fs.GetConfig(ctx).DryRun
+	cond, args := inDir(dir)
+	dirs, err := f.queryRemotes(ctx, `SELECT remote FROM files WHERE is_dir = 1 AND `+cond+` ORDER BY LENGTH(remote) DESC, remote`, args...)
+	if err != nil {
+		return nil, err
+	}
+	// A directory is needed if it has files below it, not directories,
+	// as those are pruned first
+	needed := `is_dir = 0 AND deleted = 0`
+	if keepTombstones {
+		needed = `is_dir = 0`
+	}
+	pruned := []string{}
+	for _, d := range dirs {
+		if err := ctx.Err(); err != nil {
+			return pruned, err
+		}
+		subCond, subArgs := inDir(d)
+		var used bool
+		err = f.rdb.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE `+subCond+` AND `+needed+`)`, subArgs...).Scan(&used)
+		if err != nil {
+			return pruned, err
+		}
+		if used {
+			continue
+		}
+		if dryRun {
+			fs.Logf(nil, "VirtualFS: Not pruning empty directory %s as --dry-run is set", d)
+			pruned = append(pruned, d)
+			continue
+		}
+		err = f.removePlaceholders(ctx, d)
+		if err != nil {
+			return pruned, err
+		}
+		err = f.store.rmdir(ctx, f.storePath(d))
+		if err != nil && !errors.Is(err, fs.ErrorDirNotFound) {
+			// Such as files in it put there by something else
+			fs.Debugf(nil, "VirtualFS: Not pruning directory %s: %v", d, err)
+			continue
+		}
+		var n int64
+		err = f.inTx(ctx, func(tx *sql.Tx) error {
+			// Unless a file was put in it meanwhile
+			res, err := tx.ExecContext(ctx, `DELETE FROM files WHERE remote = ? AND is_dir = 1 AND NOT EXISTS(SELECT 1 FROM files WHERE `+subCond+` AND `+needed+`)`,
+				append([]interface{}{d}, subArgs...)...)
+			if err != nil {
+				return err
+			}
+			n, err = res.RowsAffected()
+			return err
+		})
+		if err != nil {
+			return pruned, err
+		}
+		if n > 0 {
+			f.objects.remove(d)
+			pruned = append(pruned, d)
+		}
+	}
+	if !dryRun {
+		fs.Infof(nil, "VirtualFS: Pruned %d empty directories", len(pruned))
+	}
+	return pruned, nil
+}
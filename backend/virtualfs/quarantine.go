@@ -0,0 +1,91 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// hideCorrupt returns true if o is left out of listings because its
+// content failed a hash check and quarantine_corrupt is set
+func (f *Fs) hideCorrupt(o *Object) bool {
+	return o.corrupt && !o.deleted && f.opt.QuarantineCorrupt
+}
+
+// quarantine moves the content of o, which has been flagged corrupt,
+// into the quarantine directory of its disk so it can't be read, and
+// records it as having no content until it is fetched again. Nothing
+// is done if o has been replaced since it was flagged.
+func (o *Object) quarantine(ctx context.Context) error {
+	f := o.fs
+	f.blobMu.Lock()
+	defer f.blobMu.Unlock()
+
+	var removeKeys []string
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		var found bool
+		err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE remote = ? AND ingested_at = ? AND corrupt = 1 AND deleted = 0)`,
+			o.remote, formatDBTime(o.ingestedAt)).Scan(&found)
+		if err != nil || !found {
+			return err
+		}
+		removeKeys, _, err = f.releaseContent(ctx, tx, o.remote)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE files SET evicted = 1 WHERE remote = ?`, o.remote)
+		if err != nil {
+			return err
+		}
+		return f.audit(ctx, tx, auditQuarantine, o.remote, "")
+	})
+	f.objects.remove(o.remote)
+	if err != nil {
+		return err
+	}
+	// Other files sharing the content keep it, so it is only moved aside
+	// once the last is flagged
+	for _, key := range removeKeys {
+		err = f.store.move(ctx, key, quarantineKey(key))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to quarantine %s: %w", o.remote, err)
+		}
+		fs.Errorf(nil, "VirtualFS: Quarantined content of %s in %s", o.remote, f.displayKey(quarantineKey(key)))
+	}
+	return nil
+}
+
+// quarantinedOriginSuffix is added to the name of content fetched from
+// the origin_remote when it is quarantined, so it doesn't replace the
+// content quarantined when the file was found corrupt
+const quarantinedOriginSuffix = ".origin"
+
+// quarantineFetched keeps content c fetched for o from the
+// origin_remote, which doesn't match the catalog, in the quarantine
+// directory and flags o corrupt
+func (o *Object) quarantineFetched(ctx context.Context, c *content) error {
+	f := o.fs
+	if c.chunks != nil {
+		// Chunks are named after their hashes so are checked by those
+		c.removeTmp()
+	} else {
+		key := quarantineKey(diskKey(c.disk, f.contentKey(o.remote, c.path))) + quarantinedOriginSuffix
+		err := f.store.publish(ctx, c.tmp, key)
+		if err != nil {
+			_ = os.Remove(c.tmp)
+			return fmt.Errorf("failed to quarantine %s: %w", o.remote, err)
+		}
+		fs.Errorf(nil, "VirtualFS: Quarantined content of %s fetched from origin_remote in %s", o.remote, f.displayKey(key))
+	}
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `UPDATE files SET corrupt = 1 WHERE remote = ? AND ingested_at = ? AND deleted = 0`, o.remote, formatDBTime(o.ingestedAt))
+		return err
+	})
+	f.objects.remove(o.remote)
+	return err
+}
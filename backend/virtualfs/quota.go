@@ -0,0 +1,91 @@
+package virtualfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+)
+
+// errQuotaExceeded is returned when a Put would take a directory over its quota
+var errQuotaExceeded = errors.New("directory quota exceeded")
+
+// quota limits the content stored at or below dir
+type quota struct {
+	dir   string
+	limit int64
+}
+
+// parseQuotas parses the quota option, a list of dir:size pairs
+func parseQuotas(list fs.CommaSepList) ([]quota, error) {
+	var quotas []quota
+	for _, item := range list {
+		i := strings.LastIndex(item, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid quota %q: expecting dir:size", item)
+		}
+		dir := strings.Trim(item[:i], "/")
+		if dir == "" {
+			return nil, fmt.Errorf("invalid quota %q: no directory - use max_cache_size to limit everything", item)
+		}
+		var limit fs.SizeSuffix
+		err := limit.Set(item[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota %q: %w", item, err)
+		}
+		quotas = append(quotas, quota{dir: dir, limit: int64(limit)})
+	}
+	return quotas, nil
+}
+
+// contains returns true if remote is below the quota's directory
+func (q quota) contains(remote string) bool {
+	return strings.HasPrefix(remote, q.dir+"/")
+}
+
+// quotaUsed returns the content bytes stored below dir, not counting
+// the current content of exclude
+func (f *Fs) quotaUsed(ctx context.Context, dir, exclude string) (used int64, err error) {
+	cond, args := inDir(dir)
+	args = append(args, exclude)
+
+	query := `SELECT COALESCE(SUM(size), 0) FROM files WHERE ` + cond + ` AND remote != ? AND deleted = 0 AND is_dir = 0 AND evicted = 0`
+	err = f.rdb.QueryRowContext(ctx, query, args...).Scan(&used)
+	return used, err
+}
+
+// checkQuota returns an error if storing size bytes at remote would
+// take any directory over its quota.
+//
+// If quota_action is evict then content in the directory is evicted
+// to make room first.
+func (f *Fs) checkQuota(ctx context.Context, remote string, size int64) error {
+	for _, q := range f.quotas {
+		if !q.contains(remote) {
+			continue
+		}
+		used, err := f.quotaUsed(ctx, q.dir, remote)
+		if err != nil {
+			return fmt.Errorf("failed to read quota usage: %w", err)
+		}
+		if used+size <= q.limit {
+			continue
+		}
+		if f.opt.QuotaAction == limitActionEvict && size <= q.limit {
+			freed, err := f.evictLeastUsed(ctx, q.dir, remote, used+size-q.limit)
+			if err != nil {
+				return fmt.Errorf("failed to evict to make room in %q: %w", q.dir, err)
+			}
+			used -= freed
+			if used+size <= q.limit {
+				continue
+			}
+		}
+		return fserrors.NoRetryError(fmt.Errorf("%s: storing %v would use %v of the %v allowed in %q: %w",
+			remote, fs.SizeSuffix(size), fs.SizeSuffix(used+size), fs.SizeSuffix(q.limit), q.dir, errQuotaExceeded))
+	}
+	return nil
+}
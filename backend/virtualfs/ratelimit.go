@@ -0,0 +1,85 @@
+package virtualfs
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+)
+
+// rateBurst is the smallest burst the ingest_bwlimit limiter allows,
+// so reads of a normal buffer size don't have to be split up
+const rateBurst = 64 * 1024
+
+// newIngestLimiters makes the limiters for ingest_bwlimit and
+// ingest_files_per_second, leaving them nil if there is no limit
+func (f *Fs) newIngestLimiters() {
+	if bwlimit := f.opt.IngestBwLimit; bwlimit > 0 {
+		f.bytesLimiter = rate.NewLimiter(rate.Limit(bwlimit), max(int(bwlimit), rateBurst))
+	}
+	if tps := f.opt.IngestFilesPerSec; tps > 0 {
+		f.filesLimiter = rate.NewLimiter(rate.Limit(tps), 1)
+	}
+}
+
+// newWriteLimiter makes the semaphore for max_concurrent_writes,
+// leaving it nil if there is no limit
+func (f *Fs) newWriteLimiter() {
+	if n := f.opt.MaxConcurrentWrites; n > 0 {
+		f.writes = semaphore.NewWeighted(int64(n))
+	}
+}
+
+// acquireWrite waits until max_concurrent_writes allows another
+// content file to be written, returning the function to call when it
+// has been
+func (f *Fs) acquireWrite(ctx context.Context) (release func(), err error) {
+	if f.writes == nil {
+		return func() {}, nil
+	}
+	err = f.writes.Acquire(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	return func() { f.writes.Release(1) }, nil
+}
+
+// waitIngest waits until ingest_files_per_second allows another file
+// to be ingested
+func (f *Fs) waitIngest(ctx context.Context) error {
+	if f.filesLimiter == nil {
+		return nil
+	}
+	return f.filesLimiter.Wait(ctx)
+}
+
+// limitRate returns in, read no faster than ingest_bwlimit allows
+func (f *Fs) limitRate(ctx context.Context, in io.Reader) io.Reader {
+	if f.bytesLimiter == nil {
+		return in
+	}
+	return &rateLimiter{ctx: ctx, limiter: f.bytesLimiter, in: in}
+}
+
+// rateLimiter waits for the limiter after every read
+type rateLimiter struct {
+	ctx     context.Context
+	limiter *rate.Limiter
+	in      io.Reader
+}
+
+// Read implements io.Reader
+func (r *rateLimiter) Read(p []byte) (n int, err error) {
+	if burst := r.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err = r.in.Read(p)
+	if n > 0 {
+		waitErr := r.limiter.WaitN(r.ctx, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
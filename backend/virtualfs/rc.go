@@ -0,0 +1,275 @@
+package virtualfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/rc"
+)
+
+const rcFsHelp = `
+This takes an "fs" parameter naming the virtualfs remote, such as
+"virtualfs:". A remote already in use, such as by a mount, is used
+rather than a new one being made.`
+
+const rcPathsHelp = `
+Pass the files as path=path/to/file. Any parameter key starting with
+path may be used, so several can be given, e.g.
+
+    rclone rc %s fs=virtualfs: path=a/one path2=b/two
+` + rcFsHelp
+
+func init() {
+	rc.Add(rc.Call{
+		Path:  "virtualfs/stats",
+		Fn:    rcStats,
+		Title: "Show a summary of a virtualfs catalog.",
+		Help: `
+This returns what the stats backend command does, along with the
+counters of what the remote has done since rclone started under
+"counters".
+
+    rclone rc virtualfs/stats fs=virtualfs:
+` + rcFsHelp,
+	})
+	rc.Add(rc.Call{
+		Path:  "virtualfs/health",
+		Fn:    rcHealth,
+		Title: "Check a virtualfs catalog and its root directories are usable.",
+		Help: `
+This returns what the health backend command does, with "healthy" set
+if every check passed. The optional "min-free" and "max-wal" parameters
+are the least free space each root directory must have and the largest
+the write ahead log of the catalog may be.
+
+    rclone rc virtualfs/health fs=virtualfs: min-free=10G
+` + rcFsHelp,
+	})
+	rc.Add(rc.Call{
+		Path:  "virtualfs/evict",
+		Fn:    rcEvict,
+		Title: "Evict the content of files in a virtualfs.",
+		Help: `
+This does what the evict backend command does, returning the bytes
+freed for each file under "files".
+` + fmt.Sprintf(rcPathsHelp, "virtualfs/evict"),
+	})
+	rc.Add(rc.Call{
+		Path:  "virtualfs/mark-processed",
+		Fn:    rcMarkProcessed,
+		Title: "Mark files in a virtualfs as processed.",
+		Help: `
+This does what the mark-processed backend command does, returning the
+new state of each file under "files".
+` + fmt.Sprintf(rcPathsHelp, "virtualfs/mark-processed"),
+	})
+	rc.Add(rc.Call{
+		Path:  "virtualfs/pending",
+		Fn:    rcPending,
+		Title: "List files in a virtualfs in a processing state.",
+		Help: `
+This does what the pending backend command does, returning the files
+under "files". The optional "dir" parameter limits the search to a
+directory and "status" picks the state to list, pending by default.
+
+    rclone rc virtualfs/pending fs=virtualfs: dir=incoming status=failed
+` + rcFsHelp,
+	})
+	rc.Add(rc.Call{
+		Path:  "virtualfs/events",
+		Fn:    rcEvents,
+		Title: "Wait for files in a virtualfs to be ingested, evicted, deleted or processed.",
+		Help: `
+This returns the events which have happened to the remote's files in
+this rclone since the one numbered "since", waiting up to "timeout" for
+one if there aren't any yet, so orchestration systems can react to them
+as they happen without polling.
+
+Each event has a sequence number "seq", the catalog "path" of the file,
+its "size" and "event", which is one of "ingest", "evict", "delete" or
+the status a file was moved to, such as "processed". Pass the "last"
+returned as "since" to wait for the next. Without "since" only events
+from now on are returned.
+
+The latest 10000 events of each remote name are kept. "lost" is set if
+any after "since" were dropped before they were read, or "since" is from
+before rclone restarted, when "instance" changes too and numbering
+starts again.
+
+The optional "limit" is the most events returned, 1000 by default, and
+"timeout" defaults to 30s.
+
+    rclone rc virtualfs/events fs=virtualfs: since=42 timeout=1m
+` + rcFsHelp,
+	})
+}
+
+// rcFs returns the virtualfs named by the "fs" parameter
+func rcFs(ctx context.Context, in rc.Params) (*Fs, error) {
+	f, err := rc.GetFs(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	vf, ok := f.(*Fs)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a virtualfs remote", f)
+	}
+	return vf, nil
+}
+
+// rcPaths returns the values of the parameters starting with "path"
+// in key order
+func rcPaths(in rc.Params) ([]string, error) {
+	var keys []string
+	for key := range in {
+		if strings.HasPrefix(key, "path") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, rc.NewErrParamInvalid(errors.New("need at least one path"))
+	}
+	sort.Strings(keys)
+	paths := make([]string, 0, len(keys))
+	for _, key := range keys {
+		p, err := in.GetString(key)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+func rcStats(ctx context.Context, in rc.Params) (out rc.Params, err error) {
+	f, err := rcFs(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	res, err := f.stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = rc.Reshape(&out, res)
+	if err != nil {
+		return nil, err
+	}
+	counters := rc.Params{}
+	for i, v := range f.metrics.values() {
+		counters[metricNames[i]] = v
+	}
+	out["counters"] = counters
+	return out, nil
+}
+
+func rcHealth(ctx context.Context, in rc.Params) (out rc.Params, err error) {
+	f, err := rcFs(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	minFree, maxWAL := fs.SizeSuffix(-1), defaultHealthMaxWAL
+	for key, v := range map[string]*fs.SizeSuffix{"min-free": &minFree, "max-wal": &maxWAL} {
+		s, err := in.GetString(key)
+		if rc.IsErrParamNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		err = v.Set(s)
+		if err != nil {
+			return nil, rc.NewErrParamInvalid(fmt.Errorf("invalid %s: %w", key, err))
+		}
+	}
+	err = rc.Reshape(&out, f.health(ctx, minFree, maxWAL))
+	return out, err
+}
+
+func rcEvict(ctx context.Context, in rc.Params) (out rc.Params, err error) {
+	f, err := rcFs(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := rcPaths(in)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := f.evictFiles(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
+	return rc.Params{"files": entries}, nil
+}
+
+func rcMarkProcessed(ctx context.Context, in rc.Params) (out rc.Params, err error) {
+	f, err := rcFs(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := rcPaths(in)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := f.setStatus(ctx, paths, statusProcessed)
+	if err != nil {
+		return nil, err
+	}
+	return rc.Params{"files": entries}, nil
+}
+
+func rcPending(ctx context.Context, in rc.Params) (out rc.Params, err error) {
+	f, err := rcFs(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := in.GetString("dir")
+	if rc.NotErrParamNotFound(err) {
+		return nil, err
+	}
+	status, err := in.GetString("status")
+	if rc.IsErrParamNotFound(err) {
+		status = statusPending
+	} else if err != nil {
+		return nil, err
+	}
+	entries, err := f.listByStatus(ctx, dir, status)
+	if err != nil {
+		return nil, err
+	}
+	return rc.Params{"files": entries}, nil
+}
+
+func rcEvents(ctx context.Context, in rc.Params) (out rc.Params, err error) {
+	f, err := rcFs(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	since, err := in.GetInt64("since")
+	if rc.IsErrParamNotFound(err) {
+		since = f.events.last()
+	} else if err != nil {
+		return nil, err
+	}
+	limit, err := in.GetInt64("limit")
+	if rc.IsErrParamNotFound(err) {
+		limit = defaultEventsLimit
+	} else if err != nil {
+		return nil, err
+	} else if limit <= 0 {
+		return nil, rc.NewErrParamInvalid(errors.New("limit must be positive"))
+	}
+	timeout := defaultEventsTimeout
+	if _, ok := in["timeout"]; ok {
+		timeout, err = in.GetDuration("timeout")
+		if err != nil {
+			return nil, err
+		}
+	}
+	timeout = min(timeout, maxEventsTimeout)
+	res := f.events.wait(ctx, since, int(limit), timeout)
+	err = rc.Reshape(&out, res)
+	return out, err
+}
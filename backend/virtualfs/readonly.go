@@ -0,0 +1,29 @@
+package virtualfs
+
+import (
+	"fmt"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// checkWritable returns fs.ErrorPermissionDenied if read_only is set
+func (f *Fs) checkWritable() error {
+	if f.opt.ReadOnly {
+		return fs.ErrorPermissionDenied
+	}
+	return nil
+}
+
+// checkSchema checks the catalog is at the current schema version, as
+// it can't be migrated when read_only is set
+func (f *Fs) checkSchema() error {
+	var version int
+	err := f.db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version != len(migrations) {
+		return fmt.Errorf("catalog schema is version %d not %d: open it once without read_only to upgrade it", version, len(migrations))
+	}
+	return nil
+}
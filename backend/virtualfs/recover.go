@@ -0,0 +1,172 @@
+package virtualfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// recoverMinAge is how long a temporary file or placeholder must have
+// been left alone before recovery takes it to be left over by a crash
+// rather than being written by another process sharing the catalog
+const recoverMinAge = time.Hour
+
+// recoverResult counts what recoverCrash repaired
+type recoverResult struct {
+	incoming     int // temporary files of unfinished Puts removed
+	placeholders int // placeholders of files which weren't deleted removed
+	deleted      int // content of deleted files removed
+	ingests      int // uploads in the ingest journal rolled back
+}
+
+// recoverCrash cleans up after a previous run which didn't finish. It
+// removes the temporary files of Puts which never committed, the
+// placeholders written by deletions which never committed and the
+// content left behind by deletions which committed but didn't get to
+// remove it.
+//
+// Uploads in the ingest journal are rolled back first, so what they
+// left isn't taken for anything else.
+//
+// Only local content is checked, as looking at every file in a
+// content_remote would make opening the remote too slow.
+func (f *Fs) recoverCrash(ctx context.Context) error {
+	var res recoverResult
+	cutoff := time.Now().Add(-recoverMinAge)
+	var err error
+	res.ingests, err = f.recoverIngests(ctx, cutoff)
+	if err != nil {
+		return err
+	}
+	if _, ok := f.localPath(""); ok {
+		err = f.store.walk(ctx, func(rel string, modTime time.Time) error {
+			return f.recoverFile(ctx, rel, modTime, cutoff, &res)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to look for files left by a crash: %w", err)
+		}
+		for _, root := range f.localRoots() {
+			err = f.recoverStaging(ctx, filepath.Join(root, stagingDir), cutoff, &res)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to look for files left by a crash: %w", err)
+			}
+		}
+		err = f.recoverDeleted(ctx, &res)
+		if err != nil {
+			return err
+		}
+	} else if store, ok := f.baseStore().(*remoteStore); ok {
+		err = f.recoverStaging(ctx, store.staging, cutoff, &res)
+		if err != nil {
+			return fmt.Errorf("failed to look for files left by a crash: %w", err)
+		}
+	}
+	if res != (recoverResult{}) {
+		fs.Logf(nil, "VirtualFS: Recovered from a crash, rolling back %d uploads in the ingest journal and removing %d unfinished uploads, %d placeholders of files which weren't deleted and %d contents of deleted files",
+			res.ingests, res.incoming, res.placeholders, res.deleted)
+	}
+	return nil
+}
+
+// recoverFile removes the content file at rel if it was left by a
+// crash. Temporary files are written to the staging directory, but
+// older versions wrote them next to the content they were for.
+func (f *Fs) recoverFile(ctx context.Context, rel string, modTime, cutoff time.Time, res *recoverResult) error {
+	if modTime.After(cutoff) {
+		return nil
+	}
+	switch name := path.Base(rel); {
+	case strings.HasPrefix(name, incomingPrefix):
+		if kept, err := f.isPartial(ctx, name); err != nil || kept {
+			return err
+		}
+		fs.Infof(nil, "VirtualFS: Removing unfinished upload %s", f.displayKey(rel))
+		res.incoming++
+	case strings.HasSuffix(name, placeholderSuffix):
+		referenced, err := f.isReferenced(ctx, rel)
+		if err != nil || referenced {
+			return err
+		}
+		fs.Infof(nil, "VirtualFS: Removing placeholder %s of a file which wasn't deleted", f.displayKey(rel))
+		res.placeholders++
+	default:
+		return nil
+	}
+	return f.store.remove(ctx, rel)
+}
+
+// recoverDeleted removes the content of deleted files which is still
+// in the store
+func (f *Fs) recoverDeleted(ctx context.Context, res *recoverResult) error {
+	objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE deleted = 1 AND is_dir = 0 AND evicted = 0`)
+	if err != nil {
+		return fmt.Errorf("failed to read deleted files: %w", err)
+	}
+	for _, o := range objects {
+		if _, ok := blobHash(o.contentPath); ok || o.chunked() {
+			// Blobs are kept until nothing refers to them
+			continue
+		}
+		key := o.contentKey()
+		found, err := f.store.exists(ctx, key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		referenced, err := f.isReferenced(ctx, key)
+		if err != nil {
+			return err
+		}
+		if referenced {
+			continue
+		}
+		fs.Infof(nil, "VirtualFS: Removing content of deleted file %s", o.remote)
+		err = f.store.remove(ctx, key)
+		if err != nil {
+			return err
+		}
+		res.deleted++
+	}
+	return nil
+}
+
+// recoverStaging removes the temporary files in the staging directory
+// left by uploads which never finished
+func (f *Fs) recoverStaging(ctx context.Context, staging string, cutoff time.Time, res *recoverResult) error {
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), incomingPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+		if kept, err := f.isPartial(ctx, entry.Name()); err != nil {
+			return err
+		} else if kept {
+			continue
+		}
+		fs.Infof(nil, "VirtualFS: Removing unfinished upload %s", entry.Name())
+		err = os.Remove(filepath.Join(staging, entry.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		res.incoming++
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package virtualfs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink makes out share the blocks of the file at local, which must
+// be on the same filesystem, without copying them
+func reflink(out *os.File, local string) error {
+	in, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	return unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package virtualfs
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink makes out share the blocks of the file at local, which isn't
+// supported on this OS
+func reflink(out *os.File, local string) error {
+	return errors.New("reflinks aren't supported on this OS")
+}
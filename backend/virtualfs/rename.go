@@ -0,0 +1,54 @@
+package virtualfs
+
+import (
+	"context"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// renamedContent looks for a file already held whose size and MD5
+// match src, as happens when a file is renamed on the source, and if
+// it finds one copies its content for remote.
+//
+// It returns the content and the file it was copied from, or nil if
+// there is no match and the content must be read from the source.
+func (f *Fs) renamedContent(ctx context.Context, remote string, src fs.ObjectInfo) (*content, *Object) {
+	if src.Size() <= 0 {
+		return nil, nil
+	}
+	sum, err := src.Hash(ctx, hash.MD5)
+	if err != nil || sum == "" {
+		return nil, nil
+	}
+	matches, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE deleted = 0 AND is_dir = 0 AND evicted = 0 AND corrupt = 0 AND has_hash = 1 AND hash = ? AND size = ? AND remote != ? ORDER BY ingested_at DESC LIMIT 1`, sum, src.Size(), remote)
+	if err != nil {
+		fs.Errorf(nil, "VirtualFS: Failed to look for renames of %s: %v", remote, err)
+		return nil, nil
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	old := matches[0]
+	in, err := old.openContent(ctx)
+	if err != nil {
+		fs.Errorf(nil, "VirtualFS: Failed to open content of %s to copy to %s: %v", old.remote, remote, err)
+		return nil, nil
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	c, err := f.writeContent(ctx, remote, in, old.size, "", nil)
+	if err != nil {
+		fs.Errorf(nil, "VirtualFS: Failed to copy content of %s to %s: %v", old.remote, remote, err)
+		return nil, nil
+	}
+	if c.size != src.Size() || (c.md5 != "" && c.md5 != sum) {
+		// The held content doesn't match its catalog entry
+		c.removeTmp()
+		fs.Errorf(nil, "VirtualFS: Content of %s doesn't match the catalog, not copying it to %s", old.remote, remote)
+		return nil, nil
+	}
+	f.logOp(nil, "VirtualFS: Detected %s as a rename of %s, copied its content", remote, old.remote)
+	return c, old
+}
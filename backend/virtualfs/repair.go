@@ -0,0 +1,108 @@
+package virtualfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// repairResult is returned by the repair command
+type repairResult struct {
+	Checked  int             `json:"checked"`
+	Repaired []string        `json:"repaired"`
+	Failed   []repairFailure `json:"failed"`
+}
+
+// repairFailure is a file the repair command couldn't fix
+type repairFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// repair fetches the content of the files in dir flagged corrupt, or
+// whose content is missing, from the origin_remote again, checks it
+// against all their stored hashes and clears the flags.
+//
+// A file which can't be fetched, or whose content still doesn't match,
+// is left as it was and listed as failed.
+func (f *Fs) repair(ctx context.Context, dir string) (*repairResult, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	if f.opt.OriginRemote == "" {
+		return nil, errors.New("repair needs an origin_remote to fetch content from")
+	}
+	if err := f.checkDirExists(ctx, dir); err != nil {
+		return nil, err
+	}
+	cond, args := inDir(dir)
+	objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE `+cond+` AND deleted = 0 AND is_dir = 0 AND (corrupt = 1 OR evicted = 0) ORDER BY remote`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &repairResult{Repaired: []string{}, Failed: []repairFailure{}}
+	for _, o := range objects {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		res.Checked++
+		if !o.corrupt {
+			found, err := o.contentExists(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				continue
+			}
+		}
+		err = o.repair(ctx)
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if err != nil {
+			fs.Errorf(nil, "VirtualFS: Failed to repair %s: %v", o.remote, err)
+			res.Failed = append(res.Failed, repairFailure{Path: o.remote, Error: err.Error()})
+			continue
+		}
+		fs.Infof(nil, "VirtualFS: Repaired %s", o.remote)
+		res.Repaired = append(res.Repaired, o.remote)
+	}
+	if len(res.Repaired) > 0 || len(res.Failed) > 0 {
+		fs.Infof(nil, "VirtualFS: Repaired %d files, %d failed", len(res.Repaired), len(res.Failed))
+	}
+	return res, nil
+}
+
+// repair fetches the content of o from the origin_remote, flagging it
+// corrupt again if the content fetched doesn't match its stored hashes
+func (o *Object) repair(ctx context.Context) error {
+	f := o.fs
+	want, err := f.storedHashes(ctx, o)
+	if err != nil {
+		return err
+	}
+	n, err := o.fetchFromOrigin(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if len(want) == 0 {
+		return nil
+	}
+	corrupt, err := n.scrub(ctx, want, nil)
+	if err != nil {
+		return fmt.Errorf("failed to check content fetched: %w", err)
+	}
+	if !corrupt {
+		return f.markScrubbed(ctx, n, false)
+	}
+	err = f.markScrubbed(ctx, n, true)
+	if err == nil && f.opt.QuarantineCorrupt {
+		err = n.quarantine(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	return errors.New("content in origin_remote doesn't match the stored hashes")
+}
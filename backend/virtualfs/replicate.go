@@ -0,0 +1,184 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/object"
+)
+
+// Replication states of a file when mirror_remote is set
+const (
+	replicationPending = "pending"
+	replicationDone    = "done"
+	replicationFailed  = "failed"
+)
+
+// replicationInterval is how often failed replications are retried
+const replicationInterval = time.Minute
+
+// replicationBatch is the most files replicated per query
+const replicationBatch = 100
+
+// wakeReplication tells the replication worker there is work to do
+func (f *Fs) wakeReplication() {
+	if f.replicateWake == nil {
+		return
+	}
+	select {
+	case f.replicateWake <- struct{}{}:
+	default:
+	}
+}
+
+// replicate uploads every file waiting for replication to the
+// mirror_remote, retrying those which failed
+func (f *Fs) replicate(ctx context.Context) error {
+	mirror, err := cache.Get(ctx, f.opt.MirrorRemote)
+	if err != nil {
+		return fmt.Errorf("failed to open mirror_remote: %w", err)
+	}
+	// Only retry failures a while after they failed
+	retryCutoff := formatDBTime(time.Now().Add(-replicationInterval / 2))
+	done := map[string]bool{}
+	for {
+		objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE deleted = 0 AND is_dir = 0 AND (replication_status = ? OR (replication_status = ? AND replication_time < ?)) ORDER BY ingested_at, remote LIMIT ?`,
+			replicationPending, replicationFailed, retryCutoff, replicationBatch)
+		if err != nil {
+			return err
+		}
+		n := 0
+		for _, o := range objects {
+			if done[o.remote] {
+				continue
+			}
+			done[o.remote] = true
+			n++
+			if ctx.Err() != nil {
+				return nil
+			}
+			err = o.replicateTo(ctx, mirror)
+			if err != nil && ctx.Err() != nil {
+				return nil
+			}
+			err = f.setReplication(ctx, o, err)
+			if err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+}
+
+// replicateTo uploads the content of the object to mirror
+func (o *Object) replicateTo(ctx context.Context, mirror fs.Fs) (err error) {
+	if o.evicted {
+		return fmt.Errorf("%w before it was replicated", errNoContent)
+	}
+	in, err := o.openContent(ctx)
+	if err != nil {
+		return err
+	}
+	defer fs.CheckClose(in, &err)
+	var hashes map[hash.Type]string
+	if o.hasHash && o.hash != "" {
+		hashes = map[hash.Type]string{hash.MD5: o.hash}
+	}
+	src := object.NewStaticObjectInfo(o.remote, o.modTime, o.size, true, hashes, nil)
+	dst, err := mirror.NewObject(ctx, o.remote)
+	if err == nil {
+		err = dst.Update(ctx, in, src)
+	} else if errors.Is(err, fs.ErrorObjectNotFound) {
+		_, err = mirror.Put(ctx, in, src)
+	}
+	return err
+}
+
+// setReplication records the result of replicating the object, as
+// long as it hasn't been ingested again since
+func (f *Fs) setReplication(ctx context.Context, o *Object, replicateErr error) error {
+	status, errText := replicationDone, ""
+	if replicateErr != nil {
+		fs.Errorf(nil, "VirtualFS: Failed to replicate %s to mirror_remote: %v", o.remote, replicateErr)
+		status, errText = replicationFailed, replicateErr.Error()
+	} else {
+		f.logOp(nil, "VirtualFS: Replicated %s to mirror_remote", o.remote)
+	}
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `UPDATE files SET replication_status = ?, replication_time = ?, replication_error = ? WHERE remote = ? AND ingested_at = ?`,
+			status, formatDBTime(time.Now()), nullString(errText), o.remote, formatDBTime(o.ingestedAt))
+		return err
+	})
+	f.objects.remove(o.remote)
+	return err
+}
+
+// replicationEntry describes the replication state of one file
+type replicationEntry struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Time   string `json:"time,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// replicationSummary is returned by the replication-status command
+// when no files are given
+type replicationSummary struct {
+	Pending  int                `json:"pending"`
+	Done     int                `json:"done"`
+	Failed   int                `json:"failed"`
+	Failures []replicationEntry `json:"failures"`
+}
+
+// newReplicationEntry makes a replicationEntry for o
+func newReplicationEntry(o *Object) replicationEntry {
+	return replicationEntry{
+		Path:   o.remote,
+		Status: o.replStatus,
+		Time:   formatTime(o.replTime),
+		Error:  o.replError,
+	}
+}
+
+// replicationStatus returns the replication state of each of remotes,
+// or a summary of everything if there are none
+func (f *Fs) replicationStatus(ctx context.Context, remotes []string) (interface{}, error) {
+	if f.opt.MirrorRemote == "" {
+		return nil, errors.New("mirror_remote is not set")
+	}
+	if len(remotes) > 0 {
+		entries := make([]replicationEntry, 0, len(remotes))
+		for _, remote := range remotes {
+			obj, err := f.findObject(ctx, remote)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", remote, err)
+			}
+			entries = append(entries, newReplicationEntry(obj.(*Object)))
+		}
+		return entries, nil
+	}
+
+	res := &replicationSummary{Failures: []replicationEntry{}}
+	err := f.rdb.QueryRowContext(ctx, `SELECT
+		COALESCE(SUM(replication_status = ?), 0), COALESCE(SUM(replication_status = ?), 0), COALESCE(SUM(replication_status = ?), 0)
+		FROM files WHERE deleted = 0 AND is_dir = 0`, replicationPending, replicationDone, replicationFailed).Scan(&res.Pending, &res.Done, &res.Failed)
+	if err != nil {
+		return nil, err
+	}
+	failed, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE deleted = 0 AND is_dir = 0 AND replication_status = ? ORDER BY remote`, replicationFailed)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range failed {
+		res.Failures = append(res.Failures, newReplicationEntry(o))
+	}
+	return res, nil
+}
@@ -0,0 +1,205 @@
+package virtualfs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// canResume returns true if an upload of src to remote which fails
+// part way is kept to be resumed, as it is of known size and stored as
+// it is read
+func (f *Fs) canResume(remote string, src fs.ObjectInfo) bool {
+	return f.opt.ResumePartial > 0 && src != nil && src.Size() > 0 &&
+		f.opt.Compress == compressNone && f.cipher == nil && !isLinkName(remote)
+}
+
+// keepPartial records the written bytes of out, the content of src
+// being uploaded to remote, to be resumed if it is uploaded again,
+// returning true if it was recorded and out should be left in place
+func (f *Fs) keepPartial(ctx context.Context, remote string, src fs.ObjectInfo, out *os.File, written int64) bool {
+	if written <= 0 {
+		return false
+	}
+	// The upload may have been cancelled but what was written still
+	// needs recording
+	ctx = context.WithoutCancel(ctx)
+	err := out.Truncate(written)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		err = f.expirePartials(ctx)
+	}
+	if err == nil {
+		err = f.inTx(ctx, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO partials (remote, path, size, mod_time_ns, fingerprint, written, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				remote, out.Name(), src.Size(), src.ModTime(ctx).UnixNano(), originFingerprint(ctx, src), written, formatDBTime(time.Now()))
+			return err
+		})
+	}
+	if err != nil {
+		fs.Errorf(nil, "VirtualFS: Failed to keep interrupted upload of %s: %v", remote, err)
+		return false
+	}
+	fs.Infof(nil, "VirtualFS: Keeping %d of %d bytes of interrupted upload of %s to resume", written, src.Size(), remote)
+	return true
+}
+
+// takePartial returns the file an earlier upload of src to remote was
+// interrupted writing, if it was to dir, with its length, ready to
+// carry on writing. The file is nil if there is nothing to resume.
+//
+// Whatever was kept for remote is forgotten either way, so an upload
+// of something else to it removes what doesn't match.
+func (f *Fs) takePartial(ctx context.Context, remote, dir string, src fs.ObjectInfo) (out *os.File, written int64, err error) {
+	err = f.expirePartials(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	var (
+		p              string
+		size, modTime  int64
+		fingerprint    string
+		partialWritten int64
+	)
+	err = f.db.QueryRowContext(ctx, `SELECT path, size, mod_time_ns, fingerprint, written FROM partials WHERE remote = ?`, remote).Scan(&p, &size, &modTime, &fingerprint, &partialWritten)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	err = f.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `DELETE FROM partials WHERE remote = ?`, remote)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if size != src.Size() || modTime != src.ModTime(ctx).UnixNano() || fingerprint != originFingerprint(ctx, src) || filepath.Dir(p) != dir {
+		fs.Debugf(nil, "VirtualFS: Not resuming upload of %s as it has changed", remote)
+		_ = os.Remove(p)
+		return nil, 0, nil
+	}
+	out, err = os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		fs.Debugf(nil, "VirtualFS: Not resuming upload of %s: %v", remote, err)
+		return nil, 0, nil
+	}
+	err = out.Truncate(partialWritten)
+	if err == nil {
+		_, err = out.Seek(partialWritten, io.SeekStart)
+	}
+	if err != nil {
+		_ = out.Close()
+		_ = os.Remove(p)
+		return nil, 0, err
+	}
+	return out, partialWritten, nil
+}
+
+// resumeFrom returns what to read the content of src after written
+// bytes from, which have been kept in out already from in. It opens src
+// part way if it can, otherwise it reads the start of in again checking
+// it against out, keeping as much as matches, which it returns. The
+// caller must close what is returned, which leaves in open.
+func (f *Fs) resumeFrom(ctx context.Context, remote string, src fs.ObjectInfo, in io.Reader, out *os.File, written int64) (rest io.ReadCloser, kept int64, err error) {
+	if obj := fs.UnWrapObjectInfo(src); obj != nil {
+		rc, err := obj.Open(ctx, &fs.SeekOption{Offset: written})
+		if err == nil {
+			fs.Infof(nil, "VirtualFS: Resuming upload of %s from %d bytes", remote, written)
+			return struct {
+				io.Reader
+				io.Closer
+			}{f.limitRate(ctx, rc), rc}, written, nil
+		}
+		fs.Debugf(nil, "VirtualFS: Failed to open %s part way, reading it again: %v", remote, err)
+	}
+
+	// Read the start again, keeping as much as matches
+	buf := f.buffers.Get().(*[]byte)
+	defer f.buffers.Put(buf)
+	got := make([]byte, len(*buf))
+	for kept < written {
+		n := int(min(int64(len(*buf)), written-kept))
+		n, err = io.ReadFull(in, (*buf)[:n])
+		if err != nil {
+			return nil, written, fmt.Errorf("failed to read start of upload again: %w", err)
+		}
+		_, err = out.ReadAt(got[:n], kept)
+		if err != nil {
+			return nil, written, fmt.Errorf("failed to read interrupted upload: %w", err)
+		}
+		i := 0
+		for i < n && got[i] == (*buf)[i] {
+			i++
+		}
+		kept += int64(i)
+		if i < n {
+			// The rest of what was read is written after what matched
+			in = io.MultiReader(bytes.NewReader(bytes.Clone((*buf)[i:n])), in)
+			break
+		}
+	}
+	if kept < written {
+		fs.Infof(nil, "VirtualFS: Only %d of %d bytes kept of interrupted upload of %s match", kept, written, remote)
+		err = out.Truncate(kept)
+		if err == nil {
+			_, err = out.Seek(kept, io.SeekStart)
+		}
+		if err != nil {
+			return nil, written, err
+		}
+	} else {
+		fs.Infof(nil, "VirtualFS: Resuming upload of %s from %d bytes", remote, written)
+	}
+	return io.NopCloser(in), kept, nil
+}
+
+// isPartial returns true if the temporary file name is what was kept of
+// an interrupted upload
+func (f *Fs) isPartial(ctx context.Context, name string) (bool, error) {
+	if f.opt.ResumePartial <= 0 || !strings.HasPrefix(name, incomingPrefix) {
+		return false, nil
+	}
+	paths, err := f.queryRemotes(ctx, `SELECT path FROM partials`)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range paths {
+		if filepath.Base(p) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// expirePartials forgets the interrupted uploads kept for longer than
+// resume_partial, removing what was written of them
+func (f *Fs) expirePartials(ctx context.Context) error {
+	cutoff := formatDBTime(time.Now().Add(-time.Duration(f.opt.ResumePartial)))
+	paths, err := f.queryRemotes(ctx, `SELECT path FROM partials WHERE created_at < ?`, cutoff)
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	err = f.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `DELETE FROM partials WHERE created_at < ?`, cutoff)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		fs.Debugf(nil, "VirtualFS: Removing expired interrupted upload %s", p)
+		_ = os.Remove(p)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package virtualfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+)
+
+// checkRetention returns a permission error if o was ingested less
+// than retention_period ago, so mustn't be replaced or removed yet
+func (o *Object) checkRetention() error {
+	if o.fs.opt.RetentionPeriod <= 0 || o.ingestedAt.IsZero() {
+		return nil
+	}
+	until := o.ingestedAt.Add(time.Duration(o.fs.opt.RetentionPeriod))
+	if !time.Now().Before(until) {
+		return nil
+	}
+	return fserrors.NoRetryError(fmt.Errorf("%s: retained until %s: %w", o.remote, until.Format(time.RFC3339), fs.ErrorPermissionDenied))
+}
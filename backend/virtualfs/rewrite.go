@@ -0,0 +1,312 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// rewriteEntry is returned for each path renamed by the rewrite command
+type rewriteEntry struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// rewriteMove is content the rewrite command moves in the store
+type rewriteMove struct {
+	from, to string
+}
+
+// rewritePaths renames every file and directory in the catalog below
+// the namespace whose path matches re to re.ReplaceAllString of it,
+// with replace, in a single transaction. Everything below a directory
+// renamed goes with it.
+//
+// Content stored under the path of a file, as in the mirror layout, is
+// moved to the new path first and moved back if the catalog can't be
+// updated. Content recorded at its own path, in the other layouts, is
+// left where it is. Nothing is renamed if any new path is invalid or
+// already in the catalog.
+func (f *Fs) rewritePaths(ctx context.Context, re *regexp.Regexp, replace string) ([]rewriteEntry, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	f.blobMu.Lock()
+	defer f.blobMu.Unlock()
+
+	scope := f.nsPath("")
+	if scope != "" {
+		scope += "/"
+	}
+	// A pattern anchored at the start only needs the files starting
+	// with its literal prefix looked at
+	prefix := scope
+	if lit, _ := re.LiteralPrefix(); strings.HasPrefix(re.String(), "^") {
+		prefix += lit
+	}
+	objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE remote >= ? AND substr(remote, 1, ?) = ? ORDER BY remote`, prefix, len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	var renamed []*Object
+	var entries []rewriteEntry
+	seen := make(map[string]string)
+	renamedDirs := make(map[string]string)
+	for _, o := range objects {
+		// The rows are in order so directories come before what is
+		// in them
+		to, moved := "", false
+		for dir := parentDir(o.remote); dir != "" && !moved; dir = parentDir(dir) {
+			if dirTo, ok := renamedDirs[dir]; ok {
+				to, moved = dirTo+strings.TrimPrefix(o.remote, dir), true
+			}
+		}
+		rel := strings.TrimPrefix(o.remote, scope)
+		if re.MatchString(rel) {
+			own, err := checkRewritePath(re.ReplaceAllString(rel, replace))
+			if err != nil {
+				return nil, fmt.Errorf("can't rewrite %s: %w", rel, err)
+			}
+			own = scope + own
+			if moved && own != to {
+				return nil, fmt.Errorf("can't rewrite %s to %s as its directory is rewritten, moving it to %s", o.remote, own, to)
+			}
+			to = own
+		} else if !moved {
+			continue
+		}
+		if to == o.remote {
+			continue
+		}
+		if o.isDir {
+			renamedDirs[o.remote] = to
+		}
+		if other, ok := seen[f.lookupKey(to)]; ok {
+			return nil, fmt.Errorf("can't rewrite both %s and %s to %s", other, o.remote, to)
+		}
+		seen[f.lookupKey(to)] = o.remote
+		renamed = append(renamed, o)
+		entries = append(entries, rewriteEntry{From: o.remote, To: to})
+	}
+	if len(entries) == 0 {
+		return []rewriteEntry{}, nil
+	}
+	for _, entry := range entries {
+		clash, err := f.rewriteClash(ctx, f.rdb, entry.From, entry.To)
+		if err != nil {
+			return nil, err
+		}
+		if clash {
+			return nil, fmt.Errorf("can't rewrite %s to %s: it is already in the catalog", entry.From, entry.To)
+		}
+	}
+	if fs.GetConfig(ctx).DryRun {
+		for _, entry := range entries {
+			fs.Logf(nil, "VirtualFS: Not rewriting %s to %s as --dry-run is set", entry.From, entry.To)
+		}
+		return entries, nil
+	}
+
+	moves, contentPaths, err := f.rewriteContent(ctx, renamed, entries)
+	if err != nil {
+		return nil, err
+	}
+	err = f.inTx(ctx, func(tx *sql.Tx) error {
+		for i, o := range renamed {
+			to := entries[i].To
+			// Checked again as the catalog may have changed since
+			clash, err := f.rewriteClash(ctx, tx, o.remote, to)
+			if err != nil {
+				return err
+			}
+			if clash {
+				return fmt.Errorf("can't rewrite %s to %s: it is already in the catalog", o.remote, to)
+			}
+			_, err = tx.ExecContext(ctx, `UPDATE files SET remote = ?, parent = ?, key = ?, content_path = COALESCE(?, content_path) WHERE remote = ?`,
+				to, parentDir(to), foldKey(to), nullString(contentPaths[o.remote]), o.remote)
+			if err != nil {
+				return err
+			}
+			for _, table := range []string{"hashes", "tags", "versions", "chunks"} {
+				_, err = tx.ExecContext(ctx, `UPDATE `+table+` SET remote = ? WHERE remote = ?`, to, o.remote)
+				if err != nil {
+					return err
+				}
+			}
+			if !o.isDir && !o.deleted {
+				err = f.journalChange(ctx, tx, o.remote, eventDelete, o.size, o.hash)
+				if err == nil {
+					err = f.journalChange(ctx, tx, to, eventRename, o.size, o.hash)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			err = f.audit(ctx, tx, auditRewrite, to, "from="+o.remote)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		f.undoRewriteContent(ctx, moves)
+		return nil, err
+	}
+
+	dirs := make(map[string]struct{})
+	for i, o := range renamed {
+		to := entries[i].To
+		f.objects.remove(o.remote)
+		f.objects.remove(to)
+		if !o.deleted {
+			err = f.ensureDirectoryStructure(to)
+			if err != nil {
+				fs.Errorf(nil, "VirtualFS: Failed to add the directories above %s: %v", to, err)
+			}
+		}
+		if o.isDir && !o.deleted {
+			err = f.store.mkdir(ctx, f.storePath(to))
+			if err != nil {
+				fs.Errorf(nil, "VirtualFS: Failed to make directory %s: %v", to, err)
+			}
+		}
+		if o.isDir {
+			dirs[o.remote] = struct{}{}
+		} else {
+			dirs[parentDir(o.remote)] = struct{}{}
+		}
+		if o.linkTarget != "" && !o.deleted {
+			f.removeLink(o.remote)
+			f.materializeLink(to, o.linkTarget)
+		}
+		f.afterChange(o.remote)
+		f.afterChange(to)
+	}
+	f.removeRewrittenDirs(ctx, dirs)
+	fs.Infof(nil, "VirtualFS: Rewrote %d paths, moving the content of %d files", len(entries), len(moves))
+	return entries, nil
+}
+
+// checkRewritePath returns the path p a file is rewritten to cleaned up,
+// or an error if it can't be used
+func checkRewritePath(p string) (string, error) {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return "", errors.New("the new path is empty")
+	}
+	if cleaned := path.Clean(p); cleaned != p || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("the new path %q isn't clean", p)
+	}
+	if isReserved(p) {
+		return "", fmt.Errorf("the new path %q is reserved", p)
+	}
+	return p, nil
+}
+
+// rewriteClash returns true if there is already a row, live or not,
+// other than the one at from at remote in the catalog
+func (f *Fs) rewriteClash(ctx context.Context, q rowQuerier, from, remote string) (clash bool, err error) {
+	err = q.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE (remote = ? OR (? AND key = ?)) AND remote != ?)`, remote, f.opt.CaseInsensitive, foldKey(remote), from).Scan(&clash)
+	return clash, err
+}
+
+// rewriteContent moves the content of the files in renamed which is
+// stored under their paths to the paths in entries, returning the
+// moves made and the content paths to record for files whose new path
+// stands in for an overlong name. If a move fails those made are
+// undone.
+func (f *Fs) rewriteContent(ctx context.Context, renamed []*Object, entries []rewriteEntry) (moves []rewriteMove, contentPaths map[string]string, err error) {
+	contentPaths = make(map[string]string)
+	defer func() {
+		if err != nil {
+			f.undoRewriteContent(ctx, moves)
+			moves = nil
+		}
+	}()
+	move := func(from, to string) error {
+		found, err := f.store.exists(ctx, from)
+		if err != nil || !found {
+			return err
+		}
+		err = f.store.move(ctx, from, to)
+		if err != nil {
+			return fmt.Errorf("failed to move content %s to %s: %w", f.displayKey(from), f.displayKey(to), err)
+		}
+		moves = append(moves, rewriteMove{from: from, to: to})
+		return nil
+	}
+	for i, o := range renamed {
+		to := entries[i].To
+		switch {
+		case o.isDir || o.contentPath != "":
+			// Directories are remade after, the files in them having
+			// been moved, and other content stays put
+		case o.deleted:
+			// The placeholder or empty file in place of the file
+			err = move(f.placeholderKey(o.remote), f.placeholderKey(to))
+			if err == nil {
+				err = move(f.contentKey(o.remote, ""), f.contentKey(to, ""))
+			}
+		case o.evicted:
+			// Nothing held
+		default:
+			key := f.contentKey(to, "")
+			if key != f.encodePath(path.Clean(to)) {
+				contentPaths[o.remote] = key
+			}
+			err = move(o.contentKey(), diskKey(o.disk, key))
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return moves, contentPaths, nil
+}
+
+// undoRewriteContent moves the content moved by rewriteContent back
+func (f *Fs) undoRewriteContent(ctx context.Context, moves []rewriteMove) {
+	for i := len(moves) - 1; i >= 0; i-- {
+		err := f.store.move(ctx, moves[i].to, moves[i].from)
+		if err != nil {
+			fs.Errorf(nil, "VirtualFS: Failed to move content %s back to %s: %v", f.displayKey(moves[i].to), f.displayKey(moves[i].from), err)
+		}
+	}
+}
+
+// removeRewrittenDirs removes the directories in the store which files
+// were rewritten out of, and their parents, deepest first, if they are
+// empty and not in the catalog
+func (f *Fs) removeRewrittenDirs(ctx context.Context, dirs map[string]struct{}) {
+	all := make(map[string]struct{})
+	for dir := range dirs {
+		for ; dir != ""; dir = parentDir(dir) {
+			all[dir] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(all))
+	for dir := range all {
+		sorted = append(sorted, dir)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return strings.Count(sorted[i], "/") > strings.Count(sorted[j], "/")
+	})
+	for _, dir := range sorted {
+		var live bool
+		err := f.rdb.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE remote = ? AND is_dir = 1 AND deleted = 0)`, dir).Scan(&live)
+		if err != nil || live {
+			continue
+		}
+		err = f.store.rmdir(ctx, f.storePath(dir))
+		if err != nil && err != fs.ErrorDirNotFound {
+			fs.Debugf(nil, "VirtualFS: Leaving directory %s after rewrite: %v", dir, err)
+		}
+	}
+}
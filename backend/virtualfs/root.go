@@ -0,0 +1,55 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"path"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// absPath returns the path in the catalog of remote, which is relative
+// to the root of the remote
+func (f *Fs) absPath(remote string) string {
+	if f.root == "" {
+		return remote
+	}
+	if remote == "" {
+		return f.root
+	}
+	return f.root + "/" + remote
+}
+
+// relPath reverses absPath, returning the path relative to the root
+// of the remote of the catalog path p
+func (f *Fs) relPath(p string) string {
+	if f.root == "" {
+		return p
+	}
+	if p == f.root {
+		return ""
+	}
+	return strings.TrimPrefix(p, f.root+"/")
+}
+
+// findRoot points the root at its directory if it is a file,
+// returning fs.ErrorIsFile if it is
+func (f *Fs) findRoot(ctx context.Context) error {
+	if f.root == f.namespace {
+		return nil
+	}
+	var isFile bool
+	err := f.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE remote = ? AND is_dir = 0 AND deleted = 0)`, f.root).Scan(&isFile)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if !isFile {
+		return nil
+	}
+	f.root = path.Dir(f.root)
+	if f.root == "." {
+		f.root = ""
+	}
+	return fs.ErrorIsFile
+}
@@ -0,0 +1,130 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rclone/rclone/backend/crypt"
+	"github.com/rclone/rclone/fs"
+)
+
+// rotateResult is returned by the rotate-key command
+type rotateResult struct {
+	KeyID     string `json:"keyID"`
+	OldKeyID  string `json:"oldKeyID"`
+	Rotated   int    `json:"rotated"`
+	Failed    int    `json:"failed"`
+	Remaining int    `json:"remaining"`
+}
+
+// rotateKey re-encrypts content encrypted with oldPassword, or stored
+// unencrypted if that is "", with the configured key.
+//
+// Each file is rewritten and committed on its own so the rotation can
+// be interrupted and carried on later. If limit is > 0 at most that
+// many files are done in this run.
+func (f *Fs) rotateKey(ctx context.Context, oldPassword string, limit int) (*rotateResult, error) {
+	if f.cipher == nil {
+		return nil, errors.New("encryption is not configured so there is no key to rotate to")
+	}
+	var oldCipher *crypt.Cipher
+	oldKeyID := ""
+	if oldPassword != "" {
+		var err error
+		oldCipher, oldKeyID, err = cipherForPassword(oldPassword)
+		if err != nil {
+			return nil, err
+		}
+		if oldKeyID == f.keyID {
+			return nil, errors.New("old key is the same as the configured key")
+		}
+	}
+
+	res := &rotateResult{KeyID: f.keyID, OldKeyID: oldKeyID}
+	query := `SELECT ` + objectColumns + ` FROM files WHERE COALESCE(key_id, '') = ? AND deleted = 0 AND is_dir = 0 AND evicted = 0 ORDER BY remote`
+	var args = []interface{}{oldKeyID}
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	objects, err := f.queryObjects(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range objects {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		err = f.rekeyObject(ctx, o, oldCipher, oldKeyID)
+		if errors.Is(err, errContentChanged) {
+			fs.Debugf(nil, "VirtualFS: Skipping %s which changed during key rotation", o.remote)
+			continue
+		} else if err != nil {
+			fs.Errorf(nil, "VirtualFS: Failed to rotate key of %s: %v", o.remote, err)
+			res.Failed++
+			continue
+		}
+		res.Rotated++
+	}
+
+	err = f.rdb.QueryRowContext(ctx, `SELECT COUNT(*) FROM files WHERE COALESCE(key_id, '') = ? AND deleted = 0 AND is_dir = 0 AND evicted = 0`, oldKeyID).Scan(&res.Remaining)
+	if err != nil {
+		return nil, err
+	}
+	fs.Infof(nil, "VirtualFS: Rotated key of %d files, %d failed, %d remaining", res.Rotated, res.Failed, res.Remaining)
+	return res, nil
+}
+
+// rekeyObject rewrites the content of o, decrypting it with oldCipher
+// and encrypting it with the configured key
+func (f *Fs) rekeyObject(ctx context.Context, o *Object, oldCipher *crypt.Cipher, oldKeyID string) (err error) {
+	in, err := o.openContentWith(ctx, oldCipher)
+	if err != nil {
+		return err
+	}
+	defer fs.CheckClose(in, &err)
+	c, err := f.writeContent(ctx, o.remote, in, o.size, "", nil)
+	if err != nil {
+		return err
+	}
+	if c.md5 != o.hash && o.hasHash {
+		c.removeTmp()
+		return errors.New("content doesn't match its hash after decrypting - wrong old key?")
+	}
+	c.rewrite = true
+	c.check = func(ctx context.Context, tx *sql.Tx) error {
+		var keyID string
+		err := tx.QueryRowContext(ctx, `SELECT COALESCE(key_id, '') FROM files WHERE remote = ? AND deleted = 0 AND evicted = 0`, o.remote).Scan(&keyID)
+		if err == sql.ErrNoRows || (err == nil && keyID != oldKeyID) {
+			return errContentChanged
+		}
+		return err
+	}
+	return f.commitContent(ctx, o.withContent(c), c)
+}
+
+// readPasswordOpt reads a password from opt, given either directly as
+// name or in a file as name-file
+func readPasswordOpt(opt map[string]string, name string) (string, error) {
+	password, ok := opt[name]
+	file, fileOK := opt[name+"-file"]
+	switch {
+	case ok && fileOK:
+		return "", fmt.Errorf("can't use both %s and %s-file", name, name)
+	case fileOK:
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s-file: %w", name, err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+		if password == "" {
+			return "", fmt.Errorf("%s-file %q is empty", name, file)
+		}
+	}
+	return password, nil
+}
@@ -0,0 +1,300 @@
+package virtualfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+)
+
+// firstTierDisk is the disk number of the first content_routing tier
+// which isn't a root directory. Tiers are numbered from it in the
+// order they were first used, apart from the root directories, so
+// adding root directories or changing the rules never renumbers them.
+const firstTierDisk = 1000
+
+// route sends the content of the files matching a pattern to a tier
+type route struct {
+	glob string
+	re   *regexp.Regexp
+	dir  string // directory of the tier
+	disk int    // disk number of the tier, -1 if it can't be written to
+}
+
+// tierLimit limits the content kept in a tier
+type tierLimit struct {
+	dir   string
+	limit int64
+	disk  int          // disk number of the tier, -1 if it isn't in use
+	used  atomic.Int64 // estimate of the content bytes stored in the tier
+	mu    sync.Mutex   // held while enforcing the limit
+}
+
+// parseRoutes parses the content_routing option, a list of
+// glob:directory pairs. The glob ends at the first ":" so directories
+// such as "C:\bulk" can be given.
+func parseRoutes(list fs.CommaSepList) ([]route, error) {
+	routes := make([]route, 0, len(list))
+	for _, item := range list {
+		glob, dir, ok := strings.Cut(item, ":")
+		if !ok || glob == "" || dir == "" {
+			return nil, fmt.Errorf("invalid content_routing rule %q: expecting glob:directory", item)
+		}
+		re, err := filter.GlobPathToRegexp(glob, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content_routing rule %q: %w", item, err)
+		}
+		dir = expandPath(dir)
+		err = checkRootDirectory(dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content_routing rule %q: %w", item, err)
+		}
+		routes = append(routes, route{glob: glob, re: re, dir: contentRoot(dir), disk: -1})
+	}
+	return routes, nil
+}
+
+// parseTierLimits parses the tier_max_size option, a list of
+// directory:size pairs, each of which must be a directory of routes
+func parseTierLimits(list fs.CommaSepList, routes []route) ([]*tierLimit, error) {
+	var limits []*tierLimit
+	for _, item := range list {
+		i := strings.LastIndex(item, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid tier_max_size %q: expecting directory:size", item)
+		}
+		dir := contentRoot(expandPath(item[:i]))
+		var limit fs.SizeSuffix
+		err := limit.Set(item[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid tier_max_size %q: %w", item, err)
+		}
+		found := false
+		for _, r := range routes {
+			found = found || r.dir == dir
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid tier_max_size %q: %s isn't a content_routing directory", item, dir)
+		}
+		limits = append(limits, &tierLimit{dir: dir, limit: int64(limit), disk: -1})
+	}
+	return limits, nil
+}
+
+// routeDisk returns the disk of the tier the first of the routes
+// remote matches sends it to, and false if it matches none which can
+// be written to
+func (f *Fs) routeDisk(remote string) (int, bool) {
+	for _, r := range f.routes {
+		if r.re.MatchString(remote) {
+			return r.disk, r.disk >= 0
+		}
+	}
+	return 0, false
+}
+
+// openTiers gives the routes and tier limits their disk numbers,
+// recording tiers used for the first time in the catalog, and adds
+// every tier the catalog knows of to the store so content left on tiers
+// no longer routed to can still be read.
+//
+// A read only remote doesn't record new tiers, so routes to them are
+// left unused.
+func (f *Fs) openTiers(ctx context.Context) error {
+	store, ok := f.store.(*diskStore)
+	if !ok {
+		// Content may still be on tiers used before content_routing
+		// was removed
+		var n int
+		err := f.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM content_tiers`).Scan(&n)
+		if err != nil || n == 0 {
+			return err
+		}
+		local, ok := f.store.(*localStore)
+		if !ok {
+			return errors.New("catalog has content in content_routing tiers, which can't be used with a content_remote")
+		}
+		store = &diskStore{disks: []*localStore{local}}
+		f.store = store
+	}
+	store.tiers = make(map[int]*localStore)
+	tiers := make(map[string]int)
+	next := firstTierDisk
+	rows, err := f.db.QueryContext(ctx, `SELECT disk, directory FROM content_tiers`)
+	if err != nil {
+		return fmt.Errorf("failed to read content tiers: %w", err)
+	}
+	for rows.Next() {
+		var disk int
+		var dir string
+		err = rows.Scan(&disk, &dir)
+		if err != nil {
+			break
+		}
+		store.tiers[disk] = &localStore{root: dir}
+		tiers[dir] = disk
+		next = max(next, disk+1)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	_ = rows.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read content tiers: %w", err)
+	}
+
+	for i := range f.routes {
+		r := &f.routes[i]
+		for n, disk := range store.disks {
+			if disk.root == r.dir {
+				r.disk = n
+			}
+		}
+		if r.disk >= 0 {
+			continue
+		}
+		if disk, ok := tiers[r.dir]; ok {
+			r.disk = disk
+			continue
+		}
+		if f.opt.ReadOnly {
+			continue
+		}
+		_, err = f.db.ExecContext(ctx, `INSERT INTO content_tiers (disk, directory) VALUES (?, ?)`, next, r.dir)
+		if err != nil {
+			return fmt.Errorf("failed to record content tier %s: %w", r.dir, err)
+		}
+		fs.Infof(nil, "VirtualFS: Storing content routed to %s as tier %d", r.dir, next)
+		store.tiers[next] = &localStore{root: r.dir}
+		tiers[r.dir] = next
+		r.disk = next
+		next++
+	}
+	for _, limit := range f.tierLimits {
+		for _, r := range f.routes {
+			if r.dir == limit.dir {
+				limit.disk = r.disk
+			}
+		}
+	}
+	return nil
+}
+
+// afterTierIngest enforces the tier_max_size of the tier holding the
+// new content of o, if it has one
+func (f *Fs) afterTierIngest(ctx context.Context, o *Object) {
+	if o.evicted {
+		return
+	}
+	for _, limit := range f.tierLimits {
+		if limit.disk != o.disk || limit.disk < 0 {
+			continue
+		}
+		if limit.used.Add(o.size) > limit.limit {
+			err := f.enforceTierSize(ctx, limit)
+			if err != nil {
+				fs.Errorf(nil, "VirtualFS: Failed to enforce tier_max_size of %s: %v", limit.dir, err)
+			}
+		}
+		return
+	}
+}
+
+// enforceTierSize evicts the least used content of the tier of limit
+// until it is under the low water mark if it is over the limit
+func (f *Fs) enforceTierSize(ctx context.Context, limit *tierLimit) error {
+	limit.mu.Lock()
+	defer limit.mu.Unlock()
+
+	var used int64
+	err := f.rdb.QueryRowContext(ctx, `SELECT COALESCE(SUM(size), 0) FROM files WHERE disk = ? AND deleted = 0 AND is_dir = 0 AND evicted = 0`, limit.disk).Scan(&used)
+	if err != nil {
+		return err
+	}
+	limit.used.Store(used)
+	if used <= limit.limit {
+		return nil
+	}
+
+	target := int64(float64(limit.limit) * cacheLowWater)
+	freed, err := f.evictLeastUsedWhere(ctx, `disk = ?`, []interface{}{limit.disk}, used-target)
+	limit.used.Store(used - freed)
+	if err != nil {
+		return err
+	}
+	fs.Infof(nil, "VirtualFS: Evicted %v of content to keep %s under tier_max_size %v", fs.SizeSuffix(freed), limit.dir, fs.SizeSuffix(limit.limit))
+	return nil
+}
+
+// tierEntry is returned for each place content is kept by the tiers
+// command
+type tierEntry struct {
+	Directory string   `json:"directory"`
+	Tier      int      `json:"tier"`
+	Patterns  []string `json:"patterns,omitempty"`
+	Files     int64    `json:"files"`
+	Size      int64    `json:"size"`
+	MaxSize   int64    `json:"maxSize,omitempty"`
+}
+
+// listTiers returns the root directories and content_routing tiers
+// content is kept in, with the patterns routed to each and the live
+// content stored in them
+func (f *Fs) listTiers(ctx context.Context) ([]tierEntry, error) {
+	store, ok := f.baseStore().(*diskStore)
+	if !ok {
+		return nil, nil
+	}
+	entries := make(map[int]*tierEntry)
+	for n, disk := range store.disks {
+		entries[n] = &tierEntry{Directory: disk.root, Tier: n}
+	}
+	for n, disk := range store.tiers {
+		entries[n] = &tierEntry{Directory: disk.root, Tier: n}
+	}
+	for _, r := range f.routes {
+		if entry, ok := entries[r.disk]; ok {
+			entry.Patterns = append(entry.Patterns, r.glob)
+		}
+	}
+	for _, limit := range f.tierLimits {
+		if entry, ok := entries[limit.disk]; ok {
+			entry.MaxSize = limit.limit
+		}
+	}
+	rows, err := f.rdb.QueryContext(ctx, `SELECT disk, COUNT(*), COALESCE(SUM(size), 0) FROM files WHERE deleted = 0 AND is_dir = 0 AND evicted = 0 GROUP BY disk`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var disk int
+		var files, size int64
+		err = rows.Scan(&disk, &files, &size)
+		if err != nil {
+			break
+		}
+		if entry, ok := entries[disk]; ok {
+			entry.Files, entry.Size = files, size
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	_ = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]tierEntry, 0, len(entries))
+	for _, entry := range entries {
+		out = append(out, *entry)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Tier < out[j].Tier })
+	return out, nil
+}
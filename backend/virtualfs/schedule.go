@@ -0,0 +1,224 @@
+package virtualfs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// scheduleSearch is how far ahead a schedule is searched for a matching
+// minute before being taken as never matching, such as "0 0 31 2 *"
+const scheduleSearch = 5 * 366 * 24 * time.Hour
+
+// cronSchedule is a parsed cron expression of the minutes maintenance
+// may run in, each field a bit set of the values it matches
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool // the field was "*", for the day of month and week rule
+}
+
+// cronField describes one field of a cron expression
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // 0 and 7 are both Sunday
+}
+
+// parseSchedule parses a cron expression of five fields, minute, hour,
+// day of month, month and day of week, each "*", a number, a range
+// "a-b" or a comma separated list of them, optionally with a step "/n".
+//
+// As in cron, if both the day of month and week are given a day
+// matching either matches.
+func parseSchedule(s string) (*cronSchedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid schedule %q: want 5 fields, minute hour day-of-month month day-of-week", s)
+	}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", s, err)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	sched := &cronSchedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		anyDom: fields[2] == "*",
+		anyDow: fields[4] == "*",
+	}
+	if sched.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("invalid schedule %q: never matches", s)
+	}
+	return sched, nil
+}
+
+// parseCronField parses one field of a cron expression into a bit set
+func parseCronField(s string, field cronField) (set uint64, err error) {
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step in %s %q", field.name, part)
+			}
+		}
+		lo, hi := field.min, field.max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			lo, err = strconv.Atoi(from)
+			if err != nil {
+				return 0, fmt.Errorf("bad %s %q", field.name, part)
+			}
+			hi = lo
+			if isRange {
+				hi, err = strconv.Atoi(to)
+				if err != nil {
+					return 0, fmt.Errorf("bad %s %q", field.name, part)
+				}
+			} else if step != 1 {
+				// "a/n" runs from a to the end, as in cron
+				hi = field.max
+			}
+		}
+		if lo < field.min || hi > field.max || lo > hi {
+			return 0, fmt.Errorf("%s %q out of range %d-%d", field.name, part, field.min, field.max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// matchDay returns true if the day of t matches
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.anyDom && s.anyDow:
+		return true
+	case s.anyDom:
+		return dow
+	case s.anyDow:
+		return dom
+	}
+	return dom || dow
+}
+
+// matches returns true if the minute of t is in the schedule
+func (s *cronSchedule) matches(t time.Time) bool {
+	return s.month&(1<<uint(t.Month())) != 0 && s.matchDay(t) &&
+		s.hour&(1<<uint(t.Hour())) != 0 && s.minute&(1<<uint(t.Minute())) != 0
+}
+
+// next returns t if its minute is in the schedule, otherwise the start
+// of the next minute which is, or the zero time if there is none
+func (s *cronSchedule) next(t time.Time) time.Time {
+	if s.matches(t) {
+		return t
+	}
+	limit := t.Add(scheduleSearch)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// end returns the start of the first minute after t not in the
+// schedule, or the zero time if the schedule matches every minute
+func (s *cronSchedule) end(t time.Time) time.Time {
+	if s.anyDom && s.anyDow && s.minute == 1<<60-1 && s.hour == 1<<24-1 && s.month == 1<<13-2 {
+		return time.Time{}
+	}
+	limit := t.Add(scheduleSearch)
+	for t = t.Truncate(time.Minute).Add(time.Minute); t.Before(limit); t = t.Add(time.Minute) {
+		if !s.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// startMaintenance runs the heavy maintenance task fn every interval as
+// startBackground does, but if maintenance_schedule is set only in the
+// minutes it matches. A task due outside them waits for the next, and
+// one still running when they end is stopped, to carry on at the next.
+func (f *Fs) startMaintenance(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	if f.schedule == nil {
+		f.startBackground(name, interval, nil, fn)
+		return
+	}
+	f.bgWG.Add(1)
+	go func() {
+		defer f.bgWG.Done()
+		due := time.Now()
+		for {
+			at := f.schedule.next(due)
+			if at.IsZero() {
+				return
+			}
+			timer := time.NewTimer(time.Until(at))
+			select {
+			case <-f.bgCtx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			start := time.Now()
+			ctx, cancel := context.WithCancel(f.bgCtx)
+			stop := func() bool { return false }
+			if end := f.schedule.end(start); !end.IsZero() {
+				stop = time.AfterFunc(time.Until(end), cancel).Stop
+			}
+			err := fn(ctx)
+			stopped := ctx.Err() != nil
+			stop()
+			cancel()
+			switch {
+			case f.bgCtx.Err() != nil:
+				return
+			case stopped:
+				fs.Infof(nil, "VirtualFS: Background %s stopped at the end of maintenance_schedule", name)
+				due = time.Now()
+			case err != nil:
+				fs.Errorf(nil, "VirtualFS: Background %s failed: %v", name, err)
+				fallthrough
+			default:
+				due = start.Add(interval)
+			}
+		}
+	}()
+}
@@ -0,0 +1,608 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"time"
+)
+
+// migrations are applied in order to bring the catalog schema up to
+// date. The number of migrations applied is kept in the database's
+// user_version so each runs exactly once. Only ever append to this.
+var migrations = []string{
+	// 1: processing lifecycle
+	`ALTER TABLE files ADD COLUMN status TEXT NOT NULL DEFAULT 'pending';
+	ALTER TABLE files ADD COLUMN status_time DATETIME;
+	ALTER TABLE files ADD COLUMN ingested_at DATETIME;
+	CREATE INDEX IF NOT EXISTS idx_files_status ON files(status);`,
+	// 2: content eviction
+	`ALTER TABLE files ADD COLUMN evicted BOOLEAN NOT NULL DEFAULT 0;`,
+	// 3: last access time, existing files count as accessed now
+	`ALTER TABLE files ADD COLUMN last_access DATETIME;
+	UPDATE files SET last_access = strftime('%Y-%m-%dT%H:%M:%SZ', 'now') WHERE is_dir = 0;`,
+	// 4: content layouts and reference counted blobs
+	`ALTER TABLE files ADD COLUMN content_path TEXT;
+	CREATE INDEX IF NOT EXISTS idx_files_content_path ON files(content_path);
+	CREATE TABLE IF NOT EXISTS blobs (
+		hash TEXT PRIMARY KEY,
+		size INTEGER NOT NULL,
+		refcount INTEGER NOT NULL
+	);`,
+	// 5: compressed content
+	`ALTER TABLE files ADD COLUMN compression TEXT;
+	ALTER TABLE files ADD COLUMN stored_size INTEGER;`,
+	// 6: encrypted content
+	`ALTER TABLE files ADD COLUMN key_id TEXT;`,
+	// 7: hashes of every type computed
+	`CREATE TABLE IF NOT EXISTS hashes (
+		remote TEXT NOT NULL,
+		type TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (remote, type)
+	);
+	INSERT OR IGNORE INTO hashes (remote, type, value) SELECT remote, 'md5', hash FROM files WHERE has_hash = 1 AND hash != '';`,
+	// 8: content scrubbing
+	`ALTER TABLE files ADD COLUMN scrubbed_at DATETIME;
+	ALTER TABLE files ADD COLUMN corrupt BOOLEAN NOT NULL DEFAULT 0;`,
+	// 9: replication to mirror_remote
+	`ALTER TABLE files ADD COLUMN replication_status TEXT;
+	ALTER TABLE files ADD COLUMN replication_time DATETIME;
+	ALTER TABLE files ADD COLUMN replication_error TEXT;
+	CREATE INDEX IF NOT EXISTS idx_files_replication_status ON files(replication_status);`,
+	// 10: tombstone expiry, existing tombstones count as deleted now
+	`ALTER TABLE files ADD COLUMN deleted_at DATETIME;
+	UPDATE files SET deleted_at = strftime('%Y-%m-%dT%H:%M:%SZ', 'now') WHERE deleted = 1;
+	CREATE INDEX IF NOT EXISTS idx_files_deleted_at ON files(deleted_at);`,
+	// 11: fingerprint the source gave each file
+	`ALTER TABLE files ADD COLUMN origin_fingerprint TEXT;`,
+	// 12: change journal
+	`CREATE TABLE IF NOT EXISTS journal (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		remote TEXT NOT NULL,
+		event TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		hash TEXT,
+		time DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_journal_time ON journal(time);`,
+	// 13: last completed sync into each top level directory
+	`CREATE TABLE IF NOT EXISTS bookmarks (
+		dir TEXT PRIMARY KEY,
+		time DATETIME NOT NULL,
+		seq INTEGER NOT NULL
+	);`,
+	// 14: how far through the journal each consumer has got
+	`CREATE TABLE IF NOT EXISTS cursors (
+		name TEXT PRIMARY KEY,
+		seq INTEGER NOT NULL
+	);`,
+	// 15: parent directory of each row so listings read only the
+	// direct children. Trimming every character but "/" from the end
+	// leaves the parent with a trailing "/".
+	`ALTER TABLE files ADD COLUMN parent TEXT NOT NULL DEFAULT '';
+	UPDATE files SET parent = rtrim(rtrim(remote, replace(remote, '/', '')), '/');
+	CREATE INDEX IF NOT EXISTS idx_files_parent ON files(parent, deleted);`,
+	// 16: modification times as unix nanoseconds so they keep their
+	// full precision. Times out of the range nanoseconds can hold,
+	// and any which can't be parsed, become 0.
+	`ALTER TABLE files ADD COLUMN mod_time_ns INTEGER NOT NULL DEFAULT 0;
+	UPDATE files SET mod_time_ns = CASE
+		WHEN CAST(strftime('%s', mod_time) AS INTEGER) BETWEEN -9223372035 AND 9223372035
+		THEN CAST(strftime('%s', mod_time) AS INTEGER) * 1000000000
+		ELSE 0 END;
+	ALTER TABLE files DROP COLUMN mod_time;`,
+	// 17: bookkeeping times written in the local zone by older
+	// versions converted to UTC so they compare correctly as strings
+	`UPDATE files SET status_time = strftime('%Y-%m-%dT%H:%M:%SZ', status_time) WHERE status_time NOT LIKE '%Z' AND strftime('%s', status_time) IS NOT NULL;
+	UPDATE files SET ingested_at = strftime('%Y-%m-%dT%H:%M:%SZ', ingested_at) WHERE ingested_at NOT LIKE '%Z' AND strftime('%s', ingested_at) IS NOT NULL;
+	UPDATE files SET last_access = strftime('%Y-%m-%dT%H:%M:%SZ', last_access) WHERE last_access NOT LIKE '%Z' AND strftime('%s', last_access) IS NOT NULL;
+	UPDATE files SET scrubbed_at = strftime('%Y-%m-%dT%H:%M:%SZ', scrubbed_at) WHERE scrubbed_at NOT LIKE '%Z' AND strftime('%s', scrubbed_at) IS NOT NULL;
+	UPDATE files SET replication_time = strftime('%Y-%m-%dT%H:%M:%SZ', replication_time) WHERE replication_time NOT LIKE '%Z' AND strftime('%s', replication_time) IS NOT NULL;
+	UPDATE files SET deleted_at = strftime('%Y-%m-%dT%H:%M:%SZ', deleted_at) WHERE deleted_at NOT LIKE '%Z' AND strftime('%s', deleted_at) IS NOT NULL;
+	UPDATE journal SET time = strftime('%Y-%m-%dT%H:%M:%SZ', time) WHERE time NOT LIKE '%Z' AND strftime('%s', time) IS NOT NULL;
+	UPDATE bookmarks SET time = strftime('%Y-%m-%dT%H:%M:%SZ', time) WHERE time NOT LIKE '%Z' AND strftime('%s', time) IS NOT NULL;`,
+	// 18: case folded key of each row for case_insensitive lookups.
+	// SQLite only folds ASCII so fillKeys sets it afterwards.
+	`ALTER TABLE files ADD COLUMN key TEXT NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS idx_files_key ON files(key);`,
+	// 19: target of each translated symlink
+	`ALTER TABLE files ADD COLUMN link_target TEXT;`,
+	// 20: permissions, ownership and xattrs of the source as JSON
+	`ALTER TABLE files ADD COLUMN posix_metadata TEXT;`,
+	// 21: which of the root directories holds the content
+	`ALTER TABLE files ADD COLUMN disk INTEGER NOT NULL DEFAULT 0;`,
+	// 22: running totals of each top level directory kept up to date by
+	// triggers, "" being the files at the top. The rows are made without
+	// OR IGNORE as the upsert of the outer statement would override it.
+	`CREATE TABLE IF NOT EXISTS dir_totals (
+		dir TEXT PRIMARY KEY,
+		files INTEGER NOT NULL DEFAULT 0,
+		bytes INTEGER NOT NULL DEFAULT 0,
+		stored_bytes INTEGER NOT NULL DEFAULT 0,
+		evicted_files INTEGER NOT NULL DEFAULT 0,
+		evicted_bytes INTEGER NOT NULL DEFAULT 0,
+		deleted_files INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TRIGGER IF NOT EXISTS dir_totals_insert AFTER INSERT ON files BEGIN
+		INSERT INTO dir_totals (dir) SELECT CASE WHEN instr(NEW.remote, '/') > 0 THEN substr(NEW.remote, 1, instr(NEW.remote, '/') - 1) ELSE '' END WHERE NEW.is_dir = 0 AND NOT EXISTS (SELECT 1 FROM dir_totals WHERE dir = CASE WHEN instr(NEW.remote, '/') > 0 THEN substr(NEW.remote, 1, instr(NEW.remote, '/') - 1) ELSE '' END);
+		UPDATE dir_totals SET
+			files = files + (NEW.deleted = 0),
+			bytes = bytes + CASE WHEN NEW.deleted = 0 THEN NEW.size ELSE 0 END,
+			stored_bytes = stored_bytes + CASE WHEN NEW.deleted = 0 AND NEW.evicted = 0 THEN COALESCE(NEW.stored_size, NEW.size) ELSE 0 END,
+			evicted_files = evicted_files + (NEW.deleted = 0 AND NEW.evicted = 1),
+			evicted_bytes = evicted_bytes + CASE WHEN NEW.deleted = 0 AND NEW.evicted = 1 THEN NEW.size ELSE 0 END,
+			deleted_files = deleted_files + (NEW.deleted = 1)
+		WHERE dir = CASE WHEN instr(NEW.remote, '/') > 0 THEN substr(NEW.remote, 1, instr(NEW.remote, '/') - 1) ELSE '' END AND NEW.is_dir = 0;
+	END;
+	CREATE TRIGGER IF NOT EXISTS dir_totals_update AFTER UPDATE OF remote, size, deleted, is_dir, evicted, stored_size ON files BEGIN
+		INSERT INTO dir_totals (dir) SELECT CASE WHEN instr(OLD.remote, '/') > 0 THEN substr(OLD.remote, 1, instr(OLD.remote, '/') - 1) ELSE '' END WHERE OLD.is_dir = 0 AND NOT EXISTS (SELECT 1 FROM dir_totals WHERE dir = CASE WHEN instr(OLD.remote, '/') > 0 THEN substr(OLD.remote, 1, instr(OLD.remote, '/') - 1) ELSE '' END);
+		UPDATE dir_totals SET
+			files = files - (OLD.deleted = 0),
+			bytes = bytes - CASE WHEN OLD.deleted = 0 THEN OLD.size ELSE 0 END,
+			stored_bytes = stored_bytes - CASE WHEN OLD.deleted = 0 AND OLD.evicted = 0 THEN COALESCE(OLD.stored_size, OLD.size) ELSE 0 END,
+			evicted_files = evicted_files - (OLD.deleted = 0 AND OLD.evicted = 1),
+			evicted_bytes = evicted_bytes - CASE WHEN OLD.deleted = 0 AND OLD.evicted = 1 THEN OLD.size ELSE 0 END,
+			deleted_files = deleted_files - (OLD.deleted = 1)
+		WHERE dir = CASE WHEN instr(OLD.remote, '/') > 0 THEN substr(OLD.remote, 1, instr(OLD.remote, '/') - 1) ELSE '' END AND OLD.is_dir = 0;
+		INSERT INTO dir_totals (dir) SELECT CASE WHEN instr(NEW.remote, '/') > 0 THEN substr(NEW.remote, 1, instr(NEW.remote, '/') - 1) ELSE '' END WHERE NEW.is_dir = 0 AND NOT EXISTS (SELECT 1 FROM dir_totals WHERE dir = CASE WHEN instr(NEW.remote, '/') > 0 THEN substr(NEW.remote, 1, instr(NEW.remote, '/') - 1) ELSE '' END);
+		UPDATE dir_totals SET
+			files = files + (NEW.deleted = 0),
+			bytes = bytes + CASE WHEN NEW.deleted = 0 THEN NEW.size ELSE 0 END,
+			stored_bytes = stored_bytes + CASE WHEN NEW.deleted = 0 AND NEW.evicted = 0 THEN COALESCE(NEW.stored_size, NEW.size) ELSE 0 END,
+			evicted_files = evicted_files + (NEW.deleted = 0 AND NEW.evicted = 1),
+			evicted_bytes = evicted_bytes + CASE WHEN NEW.deleted = 0 AND NEW.evicted = 1 THEN NEW.size ELSE 0 END,
+			deleted_files = deleted_files + (NEW.deleted = 1)
+		WHERE dir = CASE WHEN instr(NEW.remote, '/') > 0 THEN substr(NEW.remote, 1, instr(NEW.remote, '/') - 1) ELSE '' END AND NEW.is_dir = 0;
+	END;
+	CREATE TRIGGER IF NOT EXISTS dir_totals_delete AFTER DELETE ON files BEGIN
+		INSERT INTO dir_totals (dir) SELECT CASE WHEN instr(OLD.remote, '/') > 0 THEN substr(OLD.remote, 1, instr(OLD.remote, '/') - 1) ELSE '' END WHERE OLD.is_dir = 0 AND NOT EXISTS (SELECT 1 FROM dir_totals WHERE dir = CASE WHEN instr(OLD.remote, '/') > 0 THEN substr(OLD.remote, 1, instr(OLD.remote, '/') - 1) ELSE '' END);
+		UPDATE dir_totals SET
+			files = files - (OLD.deleted = 0),
+			bytes = bytes - CASE WHEN OLD.deleted = 0 THEN OLD.size ELSE 0 END,
+			stored_bytes = stored_bytes - CASE WHEN OLD.deleted = 0 AND OLD.evicted = 0 THEN COALESCE(OLD.stored_size, OLD.size) ELSE 0 END,
+			evicted_files = evicted_files - (OLD.deleted = 0 AND OLD.evicted = 1),
+			evicted_bytes = evicted_bytes - CASE WHEN OLD.deleted = 0 AND OLD.evicted = 1 THEN OLD.size ELSE 0 END,
+			deleted_files = deleted_files - (OLD.deleted = 1)
+		WHERE dir = CASE WHEN instr(OLD.remote, '/') > 0 THEN substr(OLD.remote, 1, instr(OLD.remote, '/') - 1) ELSE '' END AND OLD.is_dir = 0;
+	END;
+	INSERT INTO dir_totals (dir, files, bytes, stored_bytes, evicted_files, evicted_bytes, deleted_files)
+		SELECT CASE WHEN instr(f.remote, '/') > 0 THEN substr(f.remote, 1, instr(f.remote, '/') - 1) ELSE '' END,
+			SUM(f.deleted = 0),
+			SUM(CASE WHEN f.deleted = 0 THEN f.size ELSE 0 END),
+			SUM(CASE WHEN f.deleted = 0 AND f.evicted = 0 THEN COALESCE(f.stored_size, f.size) ELSE 0 END),
+			SUM(f.deleted = 0 AND f.evicted = 1),
+			SUM(CASE WHEN f.deleted = 0 AND f.evicted = 1 THEN f.size ELSE 0 END),
+			SUM(f.deleted = 1)
+		FROM files AS f WHERE f.is_dir = 0 GROUP BY 1;`,
+	// 23: audit log
+	`CREATE TABLE IF NOT EXISTS audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time DATETIME NOT NULL,
+		op TEXT NOT NULL,
+		remote TEXT NOT NULL,
+		detail TEXT,
+		user TEXT,
+		host TEXT,
+		invocation TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_time ON audit(time);
+	CREATE INDEX IF NOT EXISTS idx_audit_remote ON audit(remote);`,
+	// 24: versions kept by keep_versions
+	`CREATE TABLE IF NOT EXISTS versions (
+		remote TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		mod_time_ns INTEGER NOT NULL,
+		hash TEXT NOT NULL,
+		ingested_at DATETIME,
+		replaced_at DATETIME NOT NULL,
+		content_path TEXT NOT NULL,
+		compression TEXT,
+		stored_size INTEGER NOT NULL,
+		key_id TEXT,
+		disk INTEGER NOT NULL,
+		posix_metadata TEXT,
+		PRIMARY KEY (remote, version)
+	);`,
+	// 25: generations, every change to what a row holds gets the next
+	// one in history from a trigger. The rows already there start
+	// history as of when they were ingested.
+	`CREATE TABLE IF NOT EXISTS history (
+		generation INTEGER PRIMARY KEY AUTOINCREMENT,
+		remote TEXT NOT NULL,
+		is_dir BOOLEAN NOT NULL,
+		deleted BOOLEAN NOT NULL,
+		size INTEGER,
+		mod_time_ns INTEGER NOT NULL,
+		hash TEXT,
+		time DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_history_remote ON history(remote, generation);
+	CREATE INDEX IF NOT EXISTS idx_history_time ON history(time);
+	CREATE TABLE IF NOT EXISTS generations (
+		name TEXT PRIMARY KEY,
+		generation INTEGER NOT NULL,
+		time DATETIME NOT NULL
+	);
+	INSERT INTO history (remote, is_dir, deleted, size, mod_time_ns, hash, time)
+		SELECT remote, is_dir, 0, size, mod_time_ns, hash,
+			COALESCE(strftime('%Y-%m-%dT%H:%M:%fZ', ingested_at), strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+		FROM files WHERE deleted = 0 ORDER BY ingested_at;
+	CREATE TRIGGER IF NOT EXISTS history_insert AFTER INSERT ON files BEGIN
+		INSERT INTO history (remote, is_dir, deleted, size, mod_time_ns, hash, time)
+		VALUES (NEW.remote, NEW.is_dir, NEW.deleted, NEW.size, NEW.mod_time_ns, NEW.hash, strftime('%Y-%m-%dT%H:%M:%fZ', 'now'));
+	END;
+	CREATE TRIGGER IF NOT EXISTS history_update AFTER UPDATE OF remote, size, hash, mod_time_ns, deleted, is_dir ON files
+	WHEN OLD.remote IS NOT NEW.remote OR OLD.size IS NOT NEW.size OR OLD.hash IS NOT NEW.hash
+		OR OLD.mod_time_ns IS NOT NEW.mod_time_ns OR OLD.deleted IS NOT NEW.deleted OR OLD.is_dir IS NOT NEW.is_dir BEGIN
+		INSERT INTO history (remote, is_dir, deleted, size, mod_time_ns, hash, time)
+		SELECT OLD.remote, OLD.is_dir, 1, OLD.size, OLD.mod_time_ns, OLD.hash, strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+		WHERE OLD.remote IS NOT NEW.remote AND OLD.deleted = 0;
+		INSERT INTO history (remote, is_dir, deleted, size, mod_time_ns, hash, time)
+		VALUES (NEW.remote, NEW.is_dir, NEW.deleted, NEW.size, NEW.mod_time_ns, NEW.hash, strftime('%Y-%m-%dT%H:%M:%fZ', 'now'));
+	END;
+	CREATE TRIGGER IF NOT EXISTS history_delete AFTER DELETE ON files WHEN OLD.deleted = 0 BEGIN
+		INSERT INTO history (remote, is_dir, deleted, size, mod_time_ns, hash, time)
+		VALUES (OLD.remote, OLD.is_dir, 1, OLD.size, OLD.mod_time_ns, OLD.hash, strftime('%Y-%m-%dT%H:%M:%fZ', 'now'));
+	END;`,
+	// 26: processing priority
+	`ALTER TABLE files ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX IF NOT EXISTS idx_files_priority ON files(status, priority DESC, ingested_at);`,
+	// 27: where each file was ingested from
+	`ALTER TABLE files ADD COLUMN source_remote TEXT;
+	ALTER TABLE files ADD COLUMN source_path TEXT;`,
+	// 28: which worker has claimed each file and until when
+	`ALTER TABLE files ADD COLUMN claim_worker TEXT;
+	ALTER TABLE files ADD COLUMN claim_expires DATETIME;`,
+	// 29: what processing has recorded about each file
+	`ALTER TABLE files ADD COLUMN annotation TEXT;`,
+	// 30: tags grouping files across directories
+	`CREATE TABLE IF NOT EXISTS tags (
+		remote TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (remote, tag)
+	);
+	CREATE INDEX IF NOT EXISTS idx_tags_tag ON tags(tag);`,
+	// 31: the start of content otherwise dropped, kept by cache_head_bytes
+	`ALTER TABLE files ADD COLUMN head BLOB;`,
+	// 32: the pieces of content stored as chunks by chunk_size
+	`CREATE TABLE IF NOT EXISTS chunks (
+		remote TEXT NOT NULL,
+		idx INTEGER NOT NULL,
+		start INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		md5 TEXT NOT NULL,
+		blob TEXT NOT NULL,
+		PRIMARY KEY (remote, idx)
+	);`,
+	// 33: interrupted uploads kept to be resumed by resume_partial
+	`CREATE TABLE IF NOT EXISTS partials (
+		remote TEXT PRIMARY KEY,
+		path TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		mod_time_ns INTEGER NOT NULL,
+		fingerprint TEXT NOT NULL,
+		written INTEGER NOT NULL,
+		created_at TEXT NOT NULL
+	);`,
+	// 34: how many times each file has been opened, for eviction_policy lfu
+	`ALTER TABLE files ADD COLUMN access_count INTEGER NOT NULL DEFAULT 0;`,
+	// 35: legal hold set by the hold command
+	`ALTER TABLE files ADD COLUMN held BOOLEAN NOT NULL DEFAULT 0;`,
+	// 36: receipts recorded by the erase command
+	`CREATE TABLE IF NOT EXISTS erasures (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time DATETIME NOT NULL,
+		reference TEXT,
+		files INTEGER NOT NULL,
+		bytes INTEGER NOT NULL,
+		overwritten BOOLEAN NOT NULL,
+		digest TEXT NOT NULL
+	);`,
+	// 37: ingests under way, recorded by ingest_journal
+	`CREATE TABLE IF NOT EXISTS ingests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		remote TEXT NOT NULL,
+		tmp TEXT NOT NULL,
+		key TEXT,
+		started_at DATETIME NOT NULL
+	);`,
+	// 38: TTL of a file overriding content_ttl, NULL if it has none
+	`ALTER TABLE files ADD COLUMN ttl_ns INTEGER;`,
+	// 39: when the sync of a directory was marked finished, NULL if it
+	// never was
+	`ALTER TABLE files ADD COLUMN synced_at DATETIME;`,
+	// 40: directories of the content_routing tiers, by the disk number
+	// of the content on them
+	`CREATE TABLE IF NOT EXISTS content_tiers (
+		disk INTEGER PRIMARY KEY,
+		directory TEXT NOT NULL UNIQUE
+	);`,
+	// 41: content stored in the catalog as it is no bigger than
+	// inline_max_size, by its key in the store
+	`CREATE TABLE IF NOT EXISTS inline_content (
+		key TEXT PRIMARY KEY,
+		data BLOB NOT NULL,
+		mod_time DATETIME NOT NULL
+	);`,
+	// 42: when each change in the journal happened in nanoseconds, so
+	// changes made just after a directory is marked synced can be told
+	// from those made just before
+	`ALTER TABLE journal ADD COLUMN time_ns INTEGER;
+	UPDATE journal SET time_ns = CAST(strftime('%s', time) AS INTEGER) * 1000000000;
+	CREATE INDEX IF NOT EXISTS idx_journal_time_ns ON journal(time_ns);`,
+}
+
+// createTables creates the necessary tables in the SQLite database
+// and migrates them to the current schema
+func (f *Fs) createTables() error {
+	if f.opt.ReadOnly {
+		return f.checkSchema()
+	}
+
+	_, err := f.db.Exec(`
+		CREATE TABLE IF NOT EXISTS files (
+			remote TEXT PRIMARY KEY,
+			size INTEGER,
+			mod_time DATETIME,
+			has_hash BOOLEAN,
+			hash TEXT,
+			deleted BOOLEAN,
+			is_dir BOOLEAN
+		);
+		CREATE INDEX IF NOT EXISTS idx_files_remote ON files(remote);
+		CREATE INDEX IF NOT EXISTS idx_files_deleted ON files(deleted);
+	`)
+	if err != nil {
+		return err
+	}
+
+	for more := true; more; {
+		more, err = f.migrateNext()
+		if err != nil {
+			return err
+		}
+	}
+	err = f.fillKeys()
+	if err != nil {
+		return fmt.Errorf("failed to fill in keys: %w", err)
+	}
+	return f.createViews()
+}
+
+// migrateNext applies the migration after the schema version of the
+// catalog, returning false if it is up to date.
+//
+// The version is read in the same transaction as the migration is
+// applied, so processes opening the catalog together apply each
+// migration once.
+func (f *Fs) migrateNext() (bool, error) {
+	tx, err := f.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	var version int
+	err = tx.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		return false, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version >= len(migrations) {
+		return false, nil
+	}
+	err = applyMigration(tx, version)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to migrate schema to version %d: %w", version+1, err)
+	}
+	return true, nil
+}
+
+// applyMigration applies migrations[version] in tx
+func applyMigration(tx *sql.Tx, version int) error {
+	_, err := tx.Exec(migrations[version])
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1))
+	return err
+}
+
+// inTx runs fn in a write transaction, committing it if fn succeeds
+//
+// Transactions queue for the one connection which writes, so fn must
+// only use tx, never f.db, or it waits for itself.
+//
+// If batch_size is set fn may share the transaction with others, in a
+// savepoint of its own, and inTx returns once they are all committed.
+//
+// fn is run again in a new transaction if the catalog stays busy for
+// longer than busy_timeout, so it mustn't depend on running only once.
+func (f *Fs) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
+	if f.batch != nil {
+		req := batchRequest{ctx: ctx, fn: fn, done: make(chan error, 1)}
+		select {
+		case f.batch <- req:
+			return <-req.done
+		case <-f.bgCtx.Done():
+			// Batcher stopped so run it here
+		}
+	}
+
+	return f.retryBusy(ctx, func() error {
+		tx, err := f.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer func() {
+			_ = tx.Rollback()
+		}()
+		err = fn(tx)
+		if err != nil {
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return nil
+	})
+}
+
+// objectColumns are the columns read by scanObject, in order
+const objectColumns = `remote, size, mod_time_ns, has_hash, hash, deleted, is_dir, status, status_time, ingested_at, evicted, last_access, content_path, compression, stored_size, key_id, corrupt, replication_status, replication_time, replication_error, origin_fingerprint, link_target, posix_metadata, disk, priority, source_remote, source_path, annotation, COALESCE(LENGTH(head), 0), access_count, held, ttl_ns`
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanObject reads an Object from a row selected with objectColumns
+func (f *Fs) scanObject(row rowScanner) (*Object, error) {
+	o := &Object{fs: f}
+	var modTime int64
+	var statusTime, ingestedAt, lastAccess, contentPath, compression, keyID sql.NullString
+	var replStatus, replTime, replError, fingerprint, linkTarget, posix, sourceRemote, sourcePath, annotation sql.NullString
+	var storedSize, ttl sql.NullInt64
+	err := row.Scan(&o.remote, &o.size, &modTime, &o.hasHash, &o.hash, &o.deleted, &o.isDir, &o.status, &statusTime, &ingestedAt, &o.evicted, &lastAccess, &contentPath, &compression, &storedSize, &keyID, &o.corrupt, &replStatus, &replTime, &replError, &fingerprint, &linkTarget, &posix, &o.disk, &o.priority, &sourceRemote, &sourcePath, &annotation, &o.headSize, &o.accessCount, &o.held, &ttl)
+	if err != nil {
+		return nil, err
+	}
+	o.modTime = time.Unix(0, modTime)
+	o.statusTime = parseNullTime(statusTime)
+	o.ingestedAt = parseNullTime(ingestedAt)
+	o.lastAccess = parseNullTime(lastAccess)
+	o.contentPath = contentPath.String
+	o.compression = compression.String
+	o.keyID = keyID.String
+	o.replStatus = replStatus.String
+	o.replTime = parseNullTime(replTime)
+	o.replError = replError.String
+	o.fingerprint = fingerprint.String
+	o.linkTarget = linkTarget.String
+	o.sourceRemote = sourceRemote.String
+	o.sourcePath = sourcePath.String
+	o.annotation = annotation.String
+	o.posix, err = unmarshalPosix(posix.String)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata of %s: %w", o.remote, err)
+	}
+	o.ttl, o.hasTTL = time.Duration(ttl.Int64), ttl.Valid
+	o.storedSize = o.size
+	if storedSize.Valid {
+		o.storedSize = storedSize.Int64
+	}
+	return o, nil
+}
+
+// formatDBTime formats t for the bookkeeping time columns.
+//
+// These are always UTC with a fixed width so they can be compared as
+// strings in SQL.
+func formatDBTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// parseNullTime parses a nullable time column, returning the zero time for NULL
+func parseNullTime(s sql.NullString) time.Time {
+	if !s.Valid {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339, s.String)
+	return t
+}
+
+// parentDir returns the directory remote is in as stored in the parent
+// column, with "" for the root
+func parentDir(remote string) string {
+	dir := path.Dir(remote)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// inDir returns an SQL condition and its arguments selecting the rows
+// strictly below dir. An empty dir selects everything.
+func inDir(dir string) (string, []interface{}) {
+	if dir == "" {
+		return "1", nil
+	}
+	// "0" is the character after "/" so this is a range scan of the
+	// keys starting with dir + "/"
+	return "remote > ? AND remote < ?", []interface{}{dir + "/", dir + "0"}
+}
+
+// queryObjects runs query, which must select objectColumns, and
+// returns the objects found
+func (f *Fs) queryObjects(ctx context.Context, query string, args ...interface{}) ([]*Object, error) {
+	rows, err := f.rdb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var objects []*Object
+	for rows.Next() {
+		o, err := f.scanObject(rows)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+	}
+	return objects, rows.Err()
+}
+
+// queryRemotes runs query, which must select a single remote column,
+// and returns the results
+func (f *Fs) queryRemotes(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := f.rdb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var remotes []string
+	for rows.Next() {
+		var remote string
+		err = rows.Scan(&remote)
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, remote)
+	}
+	return remotes, rows.Err()
+}
+
+// queryRemotesTx returns the first column of the rows query returns
+// within tx
+func queryRemotesTx(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var remotes []string
+	for rows.Next() {
+		var remote string
+		err = rows.Scan(&remote)
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, remote)
+	}
+	return remotes, rows.Err()
+}
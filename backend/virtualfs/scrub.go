@@ -0,0 +1,191 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"golang.org/x/time/rate"
+)
+
+// scrubResult is returned by the scrub command
+type scrubResult struct {
+	Scanned    int      `json:"scanned"`
+	Verified   int      `json:"verified"`
+	Unverified int      `json:"unverified"`
+	Corrupt    []string `json:"corrupt"`
+	Missing    []string `json:"missing"`
+}
+
+// scrub re-reads the content of the files in dir not scrubbed since
+// cutoff, comparing it against their stored hashes.
+//
+// Files whose content doesn't match are flagged corrupt in the catalog.
+// Reading is limited to bwlimit bytes per second if that is > 0.
+func (f *Fs) scrub(ctx context.Context, dir string, cutoff time.Time, bwlimit fs.SizeSuffix) (*scrubResult, error) {
+	cond, args := inDir(dir)
+	args = append(args, formatDBTime(cutoff))
+	objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE `+cond+` AND deleted = 0 AND is_dir = 0 AND evicted = 0 AND (scrubbed_at IS NULL OR scrubbed_at < ?) ORDER BY scrubbed_at, remote`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var limiter *rate.Limiter
+	if bwlimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(bwlimit), max(int(bwlimit), scrubBufferSize))
+	}
+	res := &scrubResult{Corrupt: []string{}, Missing: []string{}}
+	for _, o := range objects {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		res.Scanned++
+		want, err := f.storedHashes(ctx, o)
+		if err != nil {
+			return nil, err
+		}
+		if len(want) == 0 {
+			res.Unverified++
+			continue
+		}
+		corrupt, err := o.scrub(ctx, want, limiter)
+		if errors.Is(err, os.ErrNotExist) {
+			fs.Errorf(nil, "VirtualFS: Scrub found content of %s missing", o.remote)
+			res.Missing = append(res.Missing, o.remote)
+			continue
+		} else if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if err != nil {
+			fs.Errorf(nil, "VirtualFS: Scrub failed to read %s: %v", o.remote, err)
+			corrupt = true
+		}
+		err = f.markScrubbed(ctx, o, corrupt)
+		if err != nil {
+			return nil, err
+		}
+		if corrupt && f.opt.QuarantineCorrupt {
+			err = o.quarantine(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if corrupt {
+			res.Corrupt = append(res.Corrupt, o.remote)
+		} else {
+			res.Verified++
+		}
+	}
+	if res.Scanned > 0 {
+		fs.Infof(nil, "VirtualFS: Scrubbed %d files, %d corrupt, %d missing", res.Scanned, len(res.Corrupt), len(res.Missing))
+	}
+	return res, nil
+}
+
+// scrubBufferSize is the size of the reads done while scrubbing
+const scrubBufferSize = 64 * 1024
+
+// scrub reads the content of the object returning true if it doesn't
+// match the hashes in want
+func (o *Object) scrub(ctx context.Context, want map[hash.Type]string, limiter *rate.Limiter) (corrupt bool, err error) {
+	in, err := o.openContent(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer fs.CheckClose(in, &err)
+
+	var set hash.Set
+	for t := range want {
+		set.Add(t)
+	}
+	multiHasher, err := hash.NewMultiHasherTypes(set)
+	if err != nil {
+		return false, err
+	}
+	buf := make([]byte, scrubBufferSize)
+	var size int64
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			_, _ = multiHasher.Write(buf[:n])
+			size += int64(n)
+			if limiter != nil {
+				waitErr := limiter.WaitN(ctx, n)
+				if waitErr != nil {
+					return false, waitErr
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return false, err
+		}
+	}
+	if size != o.size {
+		fs.Errorf(nil, "VirtualFS: Scrub found %s is %d bytes, expecting %d", o.remote, size, o.size)
+		return true, nil
+	}
+	for t, sum := range multiHasher.Sums() {
+		if sum != want[t] {
+			fs.Errorf(nil, "VirtualFS: Scrub found %v mismatch for %s: got %s, expecting %s", t, o.remote, sum, want[t])
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// storedHashes returns the hashes recorded for the object
+func (f *Fs) storedHashes(ctx context.Context, o *Object) (map[hash.Type]string, error) {
+	sums := map[hash.Type]string{}
+	if o.hasHash && o.hash != "" {
+		sums[hash.MD5] = o.hash
+	}
+
+	rows, err := f.rdb.QueryContext(ctx, `SELECT type, value FROM hashes WHERE remote = ?`, o.remote)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var name, value string
+		err = rows.Scan(&name, &value)
+		if err != nil {
+			return nil, err
+		}
+		var t hash.Type
+		if t.Set(name) == nil && hash.Supported().Contains(t) {
+			sums[t] = value
+		}
+	}
+	return sums, rows.Err()
+}
+
+// markScrubbed records that the object has been scrubbed, flagging it
+// corrupt if set
+func (f *Fs) markScrubbed(ctx context.Context, o *Object, corrupt bool) error {
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `UPDATE files SET scrubbed_at = ?, corrupt = ? WHERE remote = ? AND ingested_at = ?`,
+			formatDBTime(time.Now()), corrupt, o.remote, formatDBTime(o.ingestedAt))
+		return err
+	})
+	f.objects.remove(o.remote)
+	return err
+}
+
+// scrubExpired is the background scrubber, checking each file once
+// every scrub_interval
+func (f *Fs) scrubExpired(ctx context.Context) error {
+	_, err := f.scrub(ctx, "", time.Now().Add(-time.Duration(f.opt.ScrubInterval)), f.opt.ScrubBwLimit)
+	if err != nil {
+		return fmt.Errorf("scrub failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package virtualfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+)
+
+// defaultSearchLimit is how many matches the search command returns if
+// not told otherwise
+const defaultSearchLimit = 1000
+
+// globSpecial are the characters with a meaning in a glob
+const globSpecial = `*?[]{}\`
+
+// searchQuery selects the files the search command returns
+type searchQuery struct {
+	dir         string         // files at or below this directory
+	glob        *regexp.Regexp // files whose path matches this, if set
+	suffix      string         // literal end of the glob, to narrow the query with
+	minSize     int64          // files at least this big
+	maxSize     int64          // files no bigger than this, if not negative
+	status      string         // files in this lifecycle state, if set
+	unprocessed bool           // files not yet processed
+	md5         string         // files with this MD5, if set
+	source      string         // files ingested from this remote, if set
+	tag         string         // files with this tag, if set
+	evicted     bool           // files whose content is evicted
+	minAccesses int64          // files opened at least this many times
+	maxAccesses int64          // files opened no more than this many times, if not negative
+	idle        time.Duration  // files not opened for this long, if set
+	limit       int            // the most files to return, 0 for all
+}
+
+// searchEntry is one file found by the search command
+type searchEntry struct {
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	ModTime    string `json:"modTime"`
+	MD5        string `json:"md5,omitempty"`
+	Status     string `json:"status"`
+	IngestTime string `json:"ingestTime,omitempty"`
+	Source     string `json:"source,omitempty"`
+	SourcePath string `json:"sourcePath,omitempty"`
+	LastAccess string `json:"lastAccess,omitempty"`
+	Accesses   int64  `json:"accessCount"`
+
+	Annotation json.RawMessage `json:"annotation,omitempty"`
+	Tags       []string        `json:"tags,omitempty"`
+}
+
+// newSearchEntry makes a searchEntry for o
+func newSearchEntry(o *Object) searchEntry {
+	return searchEntry{
+		Path:       o.remote,
+		Size:       o.size,
+		ModTime:    formatTime(o.modTime),
+		MD5:        o.hash,
+		Status:     o.status,
+		IngestTime: formatTime(o.ingestedAt),
+		Source:     o.sourceRemote,
+		SourcePath: o.sourcePath,
+		LastAccess: formatTime(o.lastAccess),
+		Accesses:   o.accessCount,
+		Annotation: annotationJSON(o.annotation),
+	}
+}
+
+// searchResult is returned by the search command
+type searchResult struct {
+	Matches []searchEntry `json:"matches"`
+	More    bool          `json:"more"` // set if there are more matches than the limit
+}
+
+// parseSearchQuery reads the options of the search command
+func (f *Fs) parseSearchQuery(arg []string, opt map[string]string) (q searchQuery, err error) {
+	q.limit = defaultSearchLimit
+	q.maxSize = -1
+	q.maxAccesses = -1
+	if len(arg) > 1 {
+		return q, errors.New("search takes at most one directory argument")
+	}
+	if len(arg) == 1 {
+		q.dir = strings.Trim(arg[0], "/")
+	}
+	if v, ok := opt["glob"]; ok {
+		q.glob, err = filter.GlobPathToRegexp(v, f.opt.CaseInsensitive)
+		if err != nil {
+			return q, fmt.Errorf("invalid glob %q: %w", v, err)
+		}
+		if !f.opt.CaseInsensitive {
+			q.suffix = v[strings.LastIndexAny(v, globSpecial)+1:]
+		}
+	}
+	for name, size := range map[string]*int64{"min-size": &q.minSize, "max-size": &q.maxSize} {
+		if v, ok := opt[name]; ok {
+			var s fs.SizeSuffix
+			err = s.Set(v)
+			if err != nil {
+				return q, fmt.Errorf("invalid %s %q: %w", name, v, err)
+			}
+			*size = int64(s)
+		}
+	}
+	if v, ok := opt["status"]; ok {
+		err = checkStatus(v)
+		if err != nil {
+			return q, err
+		}
+		q.status = v
+	}
+	q.unprocessed, err = optBool(opt, "unprocessed")
+	if err != nil {
+		return q, err
+	}
+	q.md5 = strings.ToLower(opt["md5"])
+	q.source = strings.TrimSuffix(opt["source"], ":")
+	if v, ok := opt["tag"]; ok {
+		err = checkTag(v)
+		if err != nil {
+			return q, err
+		}
+		q.tag = v
+	}
+	for name, n := range map[string]*int64{"min-accesses": &q.minAccesses, "max-accesses": &q.maxAccesses} {
+		if v, ok := opt[name]; ok {
+			*n, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || *n < 0 {
+				return q, fmt.Errorf("invalid %s %q", name, v)
+			}
+		}
+	}
+	if v, ok := opt["idle"]; ok {
+		d, err := fs.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return q, fmt.Errorf("invalid idle %q", v)
+		}
+		q.idle = d
+	}
+	if v, ok := opt["limit"]; ok {
+		q.limit, err = strconv.Atoi(v)
+		if err != nil || q.limit <= 0 {
+			return q, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	return q, nil
+}
+
+// likeEscaper escapes the characters LIKE treats specially
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// search returns the live files matching q in path order
+func (f *Fs) search(ctx context.Context, q searchQuery) (*searchResult, error) {
+	objects, more, err := f.searchObjects(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	res := &searchResult{Matches: make([]searchEntry, len(objects)), More: more}
+	remotes := make([]string, len(objects))
+	for i, o := range objects {
+		res.Matches[i] = newSearchEntry(o)
+		remotes[i] = o.remote
+	}
+	tags, err := f.tagsOf(ctx, remotes)
+	if err != nil {
+		return nil, err
+	}
+	for i := range res.Matches {
+		res.Matches[i].Tags = tags[res.Matches[i].Path]
+	}
+	return res, nil
+}
+
+// searchObjects returns the live files matching q in path order, and
+// whether there are more than its limit. Everything but the glob is
+// matched by the query, which the literal end of the glob narrows down
+// first.
+func (f *Fs) searchObjects(ctx context.Context, q searchQuery) (objects []*Object, more bool, err error) {
+	cond, args := inDir(q.dir)
+	query := `SELECT ` + objectColumns + ` FROM files WHERE ` + cond + ` AND deleted = 0 AND is_dir = 0 AND size >= ?`
+	args = append(args, q.minSize)
+	if q.maxSize >= 0 {
+		query += ` AND size <= ?`
+		args = append(args, q.maxSize)
+	}
+	if q.status != "" {
+		query += ` AND status = ?`
+		args = append(args, q.status)
+	}
+	if q.unprocessed {
+		query += ` AND status != ?`
+		args = append(args, statusProcessed)
+	}
+	if q.md5 != "" {
+		query += ` AND hash = ?`
+		args = append(args, q.md5)
+	}
+	if q.source != "" {
+		query += ` AND source_remote = ?`
+		args = append(args, q.source)
+	}
+	if q.tag != "" {
+		query += ` AND remote IN (SELECT remote FROM tags WHERE tag = ?)`
+		args = append(args, q.tag)
+	}
+	if q.evicted {
+		query += ` AND evicted = 1`
+	}
+	if q.minAccesses > 0 {
+		query += ` AND access_count >= ?`
+		args = append(args, q.minAccesses)
+	}
+	if q.maxAccesses >= 0 {
+		query += ` AND access_count <= ?`
+		args = append(args, q.maxAccesses)
+	}
+	if q.idle > 0 {
+		query += ` AND COALESCE(last_access, ingested_at) < ?`
+		args = append(args, formatDBTime(time.Now().Add(-q.idle)))
+	}
+	if q.suffix != "" {
+		// LIKE ignores the case of ASCII so this only narrows
+		query += ` AND remote LIKE ? ESCAPE '\'`
+		args = append(args, "%"+likeEscaper.Replace(q.suffix))
+	}
+	query += ` ORDER BY remote`
+
+	rows, err := f.rdb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		o, err := f.scanObject(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		if q.glob != nil && !q.glob.MatchString(o.remote) {
+			continue
+		}
+		if q.limit > 0 && len(objects) == q.limit {
+			more = true
+			break
+		}
+		objects = append(objects, o)
+	}
+	return objects, more, rows.Err()
+}
@@ -0,0 +1,78 @@
+package virtualfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+)
+
+// Values for the max_file_size_action option
+const (
+	sizeActionError    = "error"
+	sizeActionMetadata = "metadata"
+)
+
+// errFileTooLarge is returned when a Put is larger than max_file_size
+var errFileTooLarge = errors.New("file is larger than max_file_size")
+
+// fileTooLarge returns the error for a Put of size bytes at remote
+// being larger than max_file_size
+func (f *Fs) fileTooLarge(remote string, size int64) error {
+	return fserrors.NoRetryError(fmt.Errorf("%s: %v is over the %v allowed: %w",
+		remote, fs.SizeSuffix(size), f.opt.MaxFileSize, errFileTooLarge))
+}
+
+// checkFileSize returns an error if a Put of size bytes at remote is
+// larger than max_file_size, or true if only its metadata should be
+// recorded. Streams of unknown size are checked by limitSize as they
+// are written.
+func (f *Fs) checkFileSize(remote string, size int64) (metadataOnly bool, err error) {
+	if f.opt.MaxFileSize > 0 && size > int64(f.opt.MaxFileSize) {
+		if f.opt.MaxFileSizeAction == sizeActionMetadata {
+			fs.Logf(nil, "VirtualFS: %s: %v is over the %v allowed so only recording its metadata", remote, fs.SizeSuffix(size), f.opt.MaxFileSize)
+			return true, nil
+		}
+		return false, f.fileTooLarge(remote, size)
+	}
+	if f.uncached(size) {
+		fs.Debugf(nil, "VirtualFS: %s: %v is over cache_max_size so only recording its metadata", remote, fs.SizeSuffix(size))
+		return true, nil
+	}
+	return false, nil
+}
+
+// uncached returns true if content of size bytes is larger than
+// cache_max_size so isn't kept
+func (f *Fs) uncached(size int64) bool {
+	return f.opt.CacheMaxSize > 0 && size > int64(f.opt.CacheMaxSize)
+}
+
+// limitSize returns in, failing once more than max_file_size has been
+// read from it if that is set
+func (f *Fs) limitSize(remote string, in io.Reader) io.Reader {
+	if f.opt.MaxFileSize <= 0 {
+		return in
+	}
+	return &sizeLimiter{f: f, remote: remote, in: in}
+}
+
+// sizeLimiter fails reads once more than max_file_size has been read
+type sizeLimiter struct {
+	f      *Fs
+	remote string
+	in     io.Reader
+	read   int64
+}
+
+// Read implements io.Reader
+func (l *sizeLimiter) Read(p []byte) (n int, err error) {
+	n, err = l.in.Read(p)
+	l.read += int64(n)
+	if l.read > int64(l.f.opt.MaxFileSize) {
+		return n, l.f.fileTooLarge(l.remote, l.read)
+	}
+	return n, err
+}
@@ -0,0 +1,269 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/fspath"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+const (
+	snapshotDir    = internalDir + "/snapshots" // directory under the root holding default snapshots
+	snapshotPrefix = "virtualfs-"               // prefix of generated snapshot names
+	snapshotSuffix = ".db"                      // suffix of generated snapshot names
+	snapshotLayout = "20060102-150405.000"      // time layout used in generated snapshot names
+)
+
+// snapshotName returns a timestamped file name for a snapshot taken at t
+func snapshotName(t time.Time) string {
+	return snapshotPrefix + t.UTC().Format(snapshotLayout) + snapshotSuffix
+}
+
+// isRemotePath returns true if p refers to an rclone remote rather than a local path
+func isRemotePath(p string) (bool, error) {
+	parsed, err := fspath.Parse(p)
+	if err != nil {
+		return false, err
+	}
+	return parsed.ConfigString != "", nil
+}
+
+// snapshot writes a consistent copy of the catalog to dst and returns where it went
+func (f *Fs) snapshot(ctx context.Context, dst string) (string, error) {
+	if dst == "" {
+		dst = filepath.Join(f.opt.RootDirectory, snapshotDir) + string(filepath.Separator)
+	}
+	if strings.HasSuffix(dst, "/") || strings.HasSuffix(dst, string(filepath.Separator)) {
+		dst += snapshotName(time.Now())
+	}
+	remote, err := isRemotePath(dst)
+	if err != nil {
+		return "", err
+	}
+	if !remote {
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+		if err != nil {
+			return "", fmt.Errorf("failed to create snapshot directory: %w", err)
+		}
+		err = f.backupToFile(ctx, dst)
+		if err != nil {
+			return "", err
+		}
+		fs.Infof(nil, "VirtualFS: Wrote snapshot of catalog to %s", dst)
+		return dst, nil
+	}
+
+	tmp, err := os.CreateTemp("", "virtualfs-snapshot-*.db")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary snapshot: %w", err)
+	}
+	tmpPath := tmp.Name()
+	_ = tmp.Close()
+	defer func() {
+		_ = os.Remove(tmpPath)
+	}()
+	err = f.backupToFile(ctx, tmpPath)
+	if err != nil {
+		return "", err
+	}
+	err = uploadFile(ctx, tmpPath, dst)
+	if err != nil {
+		return "", err
+	}
+	fs.Infof(nil, "VirtualFS: Wrote snapshot of catalog to %s", dst)
+	return dst, nil
+}
+
+// restoreDB replaces the live catalog with the snapshot at src
+func (f *Fs) restoreDB(ctx context.Context, src string) (string, error) {
+	if err := f.checkWritable(); err != nil {
+		return "", err
+	}
+	if src == "" {
+		latest, err := f.latestSnapshot()
+		if err != nil {
+			return "", err
+		}
+		src = latest
+	}
+	localPath, cleanup, err := fetchSnapshot(ctx, src)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	snap, err := openSnapshot(ctx, localPath)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = snap.Close()
+	}()
+
+	err = copyDatabase(ctx, f.db, snap)
+	f.objects.clear()
+	if err != nil {
+		return "", fmt.Errorf("failed to restore catalog: %w", err)
+	}
+
+	// Bring snapshots written by older versions up to date
+	err = f.createTables()
+	if err != nil {
+		return "", fmt.Errorf("failed to create tables: %w", err)
+	}
+	fs.Infof(nil, "VirtualFS: Restored catalog from %s", src)
+	return src, nil
+}
+
+// fetchSnapshot returns a local path to read the snapshot at src
+// from, downloading it first if it is a remote path. cleanup removes
+// anything downloaded.
+func fetchSnapshot(ctx context.Context, src string) (localPath string, cleanup func(), err error) {
+	cleanup = func() {}
+	remote, err := isRemotePath(src)
+	if err != nil || !remote {
+		return src, cleanup, err
+	}
+	tmp, err := os.CreateTemp("", "virtualfs-restore-*.db")
+	if err != nil {
+		return "", cleanup, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	localPath = tmp.Name()
+	_ = tmp.Close()
+	cleanup = func() {
+		_ = os.Remove(localPath)
+	}
+	err = downloadFile(ctx, src, localPath)
+	if err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	return localPath, cleanup, nil
+}
+
+// latestSnapshot returns the path of the newest snapshot in the default snapshot directory
+func (f *Fs) latestSnapshot() (string, error) {
+	dir := filepath.Join(f.opt.RootDirectory, snapshotDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read snapshot directory: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, snapshotSuffix) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no snapshots found in %s", dir)
+	}
+	sort.Strings(names)
+	return filepath.Join(dir, names[len(names)-1]), nil
+}
+
+// backupToFile writes a consistent copy of the catalog to the local file dst
+func (f *Fs) backupToFile(ctx context.Context, dst string) error {
+	dstDB, err := sql.Open("sqlite3", dst)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer func() {
+		_ = dstDB.Close()
+	}()
+
+	err = copyDatabase(ctx, dstDB, f.rdb)
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// openSnapshot opens the snapshot at p and checks it is a usable catalog
+func openSnapshot(ctx context.Context, p string) (*sql.DB, error) {
+	if _, err := os.Stat(p); err != nil {
+		return nil, fmt.Errorf("failed to find snapshot: %w", err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+p+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	var result string
+	err = db.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&result)
+	if err == nil && result != "ok" {
+		err = fmt.Errorf("integrity check failed: %s", result)
+	}
+	if err == nil {
+		var count int
+		err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'files'`).Scan(&count)
+		if err == nil && count == 0 {
+			err = errors.New("not a virtualfs catalog")
+		}
+	}
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("invalid snapshot %s: %w", p, err)
+	}
+	return db, nil
+}
+
+// uploadFile copies the local file src to the rclone path dst
+func uploadFile(ctx context.Context, src, dst string) (err error) {
+	parent, leaf, err := fspath.Split(dst)
+	if err != nil {
+		return err
+	}
+	fdst, err := cache.Get(ctx, parent)
+	if err != nil {
+		return fmt.Errorf("failed to open destination %q: %w", parent, err)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fs.CheckClose(in, &err)
+	_, err = operations.Rcat(ctx, fdst, leaf, in, time.Now(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to upload to %q: %w", dst, err)
+	}
+	return nil
+}
+
+// downloadFile copies the rclone path src to the local file dst
+func downloadFile(ctx context.Context, src, dst string) (err error) {
+	parent, leaf, err := fspath.Split(src)
+	if err != nil {
+		return err
+	}
+	fsrc, err := cache.Get(ctx, parent)
+	if err != nil {
+		return fmt.Errorf("failed to open source %q: %w", parent, err)
+	}
+	obj, err := fsrc.NewObject(ctx, leaf)
+	if err != nil {
+		return fmt.Errorf("failed to find %q: %w", src, err)
+	}
+	in, err := obj.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer fs.CheckClose(in, &err)
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer fs.CheckClose(out, &err)
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,22 @@
+package virtualfs
+
+import (
+	"path"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/object"
+)
+
+// sourceOf returns the name of the remote src comes from and its path
+// there, or "" for both if it isn't from one, as for rcat.
+//
+// The path is from the root of the remote rather than of the Fs being
+// copied from, so the same file copied from different directories of
+// a remote gets the same path.
+func sourceOf(src fs.ObjectInfo) (remote, srcPath string) {
+	srcFs := src.Fs()
+	if srcFs == nil || srcFs == object.MemoryFs || srcFs.Name() == "" {
+		return "", ""
+	}
+	return srcFs.Name(), path.Join(srcFs.Root(), src.Remote())
+}
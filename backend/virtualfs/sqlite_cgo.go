@@ -0,0 +1,84 @@
+//go:build cgo
+
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// isBusy returns true if err is SQLite finding another connection,
+// most likely in another process, holding the lock it needs
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrBusy
+}
+
+// isCorrupt returns true if err is SQLite saying the database is
+// damaged or isn't one at all
+func isCorrupt(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrCorrupt || sqliteErr.Code == sqlite3.ErrNotADB)
+}
+
+// pragmaDriver returns a driver running pragmas on each connection it
+// makes
+func pragmaDriver(pragmas []string) *sqlite3.SQLiteDriver {
+	return &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for _, pragma := range pragmas {
+				_, err := conn.Exec(pragma, nil)
+				if err != nil {
+					return fmt.Errorf("failed to set %q: %w", pragma, err)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// copyDatabase copies the whole of src into dst using the SQLite online backup API
+func copyDatabase(ctx context.Context, dst, src *sql.DB) error {
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dstConn.Close()
+	}()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = srcConn.Close()
+	}()
+
+	return dstConn.Raw(func(dstDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			dstSQLite, ok := dstDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("destination is not an SQLite connection")
+			}
+			srcSQLite, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("source is not an SQLite connection")
+			}
+			backup, err := dstSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return err
+			}
+			// Copy all pages in a single step so the copy is consistent
+			_, err = backup.Step(-1)
+			if err != nil {
+				_ = backup.Close()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
@@ -0,0 +1,37 @@
+//go:build !cgo
+
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// errNoCgo is returned by what needs the SQLite C library, which isn't
+// there in builds without cgo
+var errNoCgo = errors.New("SQLite needs rclone to be built with cgo")
+
+// isBusy returns false as there is no SQLite to be busy without cgo
+func isBusy(err error) bool {
+	return false
+}
+
+// isCorrupt returns false as there is no SQLite to find the database
+// damaged without cgo
+func isCorrupt(err error) bool {
+	return false
+}
+
+// pragmaDriver returns the driver, which can't make connections to
+// run pragmas on without cgo
+func pragmaDriver(pragmas []string) *sqlite3.SQLiteDriver {
+	return &sqlite3.SQLiteDriver{}
+}
+
+// copyDatabase copies the whole of src into dst, which needs cgo
+func copyDatabase(ctx context.Context, dst, src *sql.DB) error {
+	return errNoCgo
+}
@@ -0,0 +1,63 @@
+package virtualfs
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Hot queries, prepared once by prepareStatements
+const (
+	newObjectQuery    = `SELECT ` + objectColumns + ` FROM files WHERE remote = ?`
+	newObjectKeyQuery = `SELECT ` + objectColumns + ` FROM files WHERE key = ? AND deleted = 0 AND is_dir = 0 ORDER BY remote LIMIT 1`
+	resolveKeyQuery   = `SELECT remote FROM files WHERE key = ? ORDER BY deleted, remote LIMIT 1`
+	listDirQuery      = `SELECT ` + objectColumns + ` FROM files WHERE parent = ? AND deleted = 0`
+	removeQuery       = `UPDATE files SET deleted = 1, mod_time_ns = ?, deleted_at = ? WHERE remote = ?`
+	journalQuery      = `INSERT INTO journal (remote, event, size, hash, time, time_ns) VALUES (?, ?, ?, ?, ?, ?)`
+	upsertQuery       = `INSERT INTO files (remote, size, mod_time_ns, has_hash, hash, deleted, is_dir, status, status_time, ingested_at, evicted, last_access, content_path, compression, stored_size, key_id, replication_status, origin_fingerprint, link_target, posix_metadata, disk, parent, key, priority, source_remote, source_path, head)
+		VALUES (?, ?, ?, ?, ?, 0, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(remote) DO UPDATE SET size = excluded.size, mod_time_ns = excluded.mod_time_ns, has_hash = excluded.has_hash, hash = excluded.hash,
+			deleted = 0, is_dir = 0, status = excluded.status, status_time = excluded.status_time, ingested_at = excluded.ingested_at,
+			evicted = excluded.evicted, last_access = excluded.last_access, content_path = excluded.content_path,
+			compression = excluded.compression, stored_size = excluded.stored_size, key_id = excluded.key_id,
+			scrubbed_at = NULL, corrupt = 0, deleted_at = NULL, origin_fingerprint = excluded.origin_fingerprint,
+			link_target = excluded.link_target, posix_metadata = excluded.posix_metadata,
+			disk = excluded.disk, source_remote = excluded.source_remote, source_path = excluded.source_path,
+			head = excluded.head,
+			replication_status = CASE WHEN ? THEN files.replication_status ELSE excluded.replication_status END,
+			priority = CASE WHEN ? THEN excluded.priority ELSE files.priority END`
+)
+
+// statements holds the prepared hot statements
+type statements struct {
+	newObject    *sql.Stmt
+	newObjectKey *sql.Stmt
+	resolveKey   *sql.Stmt
+	listDir      *sql.Stmt
+	remove       *sql.Stmt
+	journal      *sql.Stmt
+	upsert       *sql.Stmt
+}
+
+// prepareStatements prepares the hot statements once the schema is up
+// to date, those which only read on the pool of readers
+func (f *Fs) prepareStatements() (err error) {
+	for _, stmt := range []struct {
+		p     **sql.Stmt
+		db    *sql.DB
+		query string
+	}{
+		{&f.stmts.newObject, f.rdb, newObjectQuery},
+		{&f.stmts.newObjectKey, f.rdb, newObjectKeyQuery},
+		{&f.stmts.resolveKey, f.rdb, resolveKeyQuery},
+		{&f.stmts.listDir, f.rdb, listDirQuery},
+		{&f.stmts.remove, f.db, removeQuery},
+		{&f.stmts.journal, f.db, journalQuery},
+		{&f.stmts.upsert, f.db, upsertQuery},
+	} {
+		*stmt.p, err = stmt.db.Prepare(stmt.query)
+		if err != nil {
+			return fmt.Errorf("failed to prepare %q: %w", stmt.query, err)
+		}
+	}
+	return nil
+}
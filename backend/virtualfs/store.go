@@ -0,0 +1,269 @@
+package virtualfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/object"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/walk"
+	"github.com/rclone/rclone/lib/file"
+)
+
+// stagingDir is the directory under each root directory where content
+// is written before being moved into the store or uploaded to a
+// content_remote, so the content tree never has partial files in it
+const stagingDir = internalDir + "/staging"
+
+// contentStore is where the content files live. Paths are slash
+// separated and relative to the top of the store.
+//
+// Content is always written to a local file first, in the directory
+// returned by stagingDir, and then moved into the store by publish.
+type contentStore interface {
+	// stagingDir returns the local directory to write new content
+	// for the store directory dir in
+	stagingDir(dir string) string
+	// publish moves the local file tmp into the store at p
+	publish(ctx context.Context, tmp, p string) error
+	// open opens the content at p, returning an error matching
+	// os.ErrNotExist if there isn't any
+	open(ctx context.Context, p string) (io.ReadCloser, error)
+	// exists returns true if there is content at p
+	exists(ctx context.Context, p string) (bool, error)
+	// remove removes the content at p if there is any
+	remove(ctx context.Context, p string) error
+	// move moves the content at src to dst
+	move(ctx context.Context, src, dst string) error
+	// mkdir makes the directory dir
+	mkdir(ctx context.Context, dir string) error
+	// rmdir removes the empty directory dir, returning
+	// fs.ErrorDirNotFound if it doesn't exist
+	rmdir(ctx context.Context, dir string) error
+	// walk calls fn for every content file in the store, skipping
+	// the reserved names
+	walk(ctx context.Context, fn func(p string, modTime time.Time) error) error
+}
+
+// localStore keeps content in a local directory
+type localStore struct {
+	root string
+}
+
+// path returns the local path of p
+func (s *localStore) path(p string) string {
+	return filepath.Join(s.root, filepath.FromSlash(p))
+}
+
+// stagingDir returns the staging directory of the store, which is on
+// the same filesystem as its content so publish is a rename
+func (s *localStore) stagingDir(dir string) string {
+	return filepath.Join(s.root, stagingDir)
+}
+
+func (s *localStore) publish(ctx context.Context, tmp, p string) error {
+	dst := s.path(p)
+	err := file.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func (s *localStore) open(ctx context.Context, p string) (io.ReadCloser, error) {
+	return os.Open(s.path(p))
+}
+
+func (s *localStore) exists(ctx context.Context, p string) (bool, error) {
+	_, err := os.Stat(s.path(p))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *localStore) remove(ctx context.Context, p string) error {
+	err := os.Remove(s.path(p))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localStore) move(ctx context.Context, src, dst string) error {
+	dstPath := s.path(dst)
+	err := file.MkdirAll(filepath.Dir(dstPath), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(s.path(src), dstPath)
+}
+
+func (s *localStore) mkdir(ctx context.Context, dir string) error {
+	return file.MkdirAll(s.path(dir), 0755)
+}
+
+func (s *localStore) rmdir(ctx context.Context, dir string) error {
+	err := os.Remove(s.path(dir))
+	if os.IsNotExist(err) {
+		return fs.ErrorDirNotFound
+	}
+	return err
+}
+
+func (s *localStore) walk(ctx context.Context, fn func(p string, modTime time.Time) error) error {
+	return filepath.WalkDir(s.root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if isReserved(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(rel, info.ModTime())
+	})
+}
+
+// remoteStore keeps content in an rclone remote
+type remoteStore struct {
+	f       fs.Fs
+	staging string // local directory new content is written to
+}
+
+func (s *remoteStore) stagingDir(dir string) string {
+	return s.staging
+}
+
+func (s *remoteStore) publish(ctx context.Context, tmp, p string) (err error) {
+	in, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer fs.CheckClose(in, &err)
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	src := object.NewStaticObjectInfo(p, info.ModTime(), info.Size(), true, nil, nil)
+	dst, err := s.f.NewObject(ctx, p)
+	if err == nil {
+		err = dst.Update(ctx, in, src)
+	} else if errors.Is(err, fs.ErrorObjectNotFound) {
+		_, err = s.f.Put(ctx, in, src)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload content to content_remote: %w", err)
+	}
+	return os.Remove(tmp)
+}
+
+// object finds the object at p, returning an error matching
+// os.ErrNotExist if there isn't one
+func (s *remoteStore) object(ctx context.Context, p string) (fs.Object, error) {
+	o, err := s.f.NewObject(ctx, p)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return nil, fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	return o, err
+}
+
+func (s *remoteStore) open(ctx context.Context, p string) (io.ReadCloser, error) {
+	o, err := s.object(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return o.Open(ctx)
+}
+
+func (s *remoteStore) exists(ctx context.Context, p string) (bool, error) {
+	_, err := s.object(ctx, p)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *remoteStore) remove(ctx context.Context, p string) error {
+	o, err := s.object(ctx, p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return o.Remove(ctx)
+}
+
+func (s *remoteStore) move(ctx context.Context, src, dst string) error {
+	o, err := s.object(ctx, src)
+	if err != nil {
+		return err
+	}
+	_, err = operations.Move(ctx, s.f, nil, dst, o)
+	return err
+}
+
+func (s *remoteStore) mkdir(ctx context.Context, dir string) error {
+	return s.f.Mkdir(ctx, dir)
+}
+
+func (s *remoteStore) rmdir(ctx context.Context, dir string) error {
+	return s.f.Rmdir(ctx, dir)
+}
+
+func (s *remoteStore) walk(ctx context.Context, fn func(p string, modTime time.Time) error) error {
+	return walk.ListR(ctx, s.f, "", true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+		for _, entry := range entries {
+			o, ok := entry.(fs.Object)
+			if !ok || isReserved(o.Remote()) {
+				continue
+			}
+			err := fn(o.Remote(), o.ModTime(ctx))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// contentKey returns the path in the content store of the content of
+// remote stored at contentPath
+//
+// Content stored at its remote path has the name encoded by storePath
+// so it can be stored whatever characters it has.
+func (f *Fs) contentKey(remote, contentPath string) string {
+	if contentPath == "" {
+		return f.storePath(path.Clean(remote))
+	}
+	return contentPath
+}
+
+// Check the interfaces are satisfied
+var (
+	_ contentStore = (*localStore)(nil)
+	_ contentStore = (*remoteStore)(nil)
+)
@@ -0,0 +1,117 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// syncMarker is returned for each directory marked as synced
+type syncMarker struct {
+	Path     string `json:"path"`
+	SyncedAt string `json:"synced_at"` // when the sync of it finished
+	// Complete is false if anything in the directory or further down
+	// was ingested, removed or renamed at or after SyncedAt, by the
+	// change journal
+	Complete  bool   `json:"complete"`
+	ChangedAt string `json:"changed_at,omitempty"` // the last change after SyncedAt, if any
+}
+
+// markSynced records that the sync of each of dirs finished at at, or
+// forgets it if clear is set, returning the markers of dirs
+func (f *Fs) markSynced(ctx context.Context, dirs []string, at time.Time, clear bool) ([]syncMarker, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	// Kept to the nanosecond as a file ingested straight after the
+	// sync finished must still count
+	value := sql.NullString{String: at.UTC().Format(time.RFC3339Nano), Valid: !clear}
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		for _, dir := range dirs {
+			if dir == "" {
+				return fmt.Errorf("the top of the remote can't be marked synced, only directories in it")
+			}
+			res, err := tx.ExecContext(ctx, `UPDATE files SET synced_at = ? WHERE remote = ? AND is_dir = 1 AND deleted = 0`, value, dir)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return fmt.Errorf("%s: %w", dir, fs.ErrorDirNotFound)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if clear {
+		fs.Infof(nil, "VirtualFS: Cleared sync markers of %d directories", len(dirs))
+		return []syncMarker{}, nil
+	}
+	fs.Infof(nil, "VirtualFS: Marked %d directories synced at %s", len(dirs), value.String)
+	markers := []syncMarker{}
+	for _, dir := range dirs {
+		found, err := f.syncStatus(ctx, dir, false)
+		if err != nil {
+			return nil, err
+		}
+		markers = append(markers, found...)
+	}
+	return markers, nil
+}
+
+// syncStatus returns the marker of dir and, if below is set, of every
+// directory marked synced further down, saying whether anything in each
+// has changed since its sync finished
+func (f *Fs) syncStatus(ctx context.Context, dir string, below bool) ([]syncMarker, error) {
+	query, args := `SELECT remote, synced_at FROM files WHERE is_dir = 1 AND deleted = 0 AND synced_at IS NOT NULL AND remote = ?`, []interface{}{dir}
+	if below {
+		cond, inArgs := inDir(dir)
+		query += ` UNION SELECT remote, synced_at FROM files WHERE is_dir = 1 AND deleted = 0 AND synced_at IS NOT NULL AND ` + cond
+		args = append(args, inArgs...)
+	}
+	rows, err := f.rdb.QueryContext(ctx, query+` ORDER BY remote`, args...)
+	if err != nil {
+		return nil, err
+	}
+	markers := []syncMarker{}
+	for rows.Next() {
+		var m syncMarker
+		err = rows.Scan(&m.Path, &m.SyncedAt)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		markers = append(markers, m)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	for i := range markers {
+		m := &markers[i]
+		syncedAt, err := time.Parse(time.RFC3339Nano, m.SyncedAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sync marker of %s: %w", m.Path, err)
+		}
+		cond, inArgs := inDir(m.Path)
+		var changed sql.NullInt64
+		err = f.rdb.QueryRowContext(ctx, `SELECT MAX(time_ns) FROM journal WHERE time_ns >= ? AND `+cond, append([]interface{}{syncedAt.UnixNano()}, inArgs...)...).Scan(&changed)
+		if err != nil {
+			return nil, err
+		}
+		m.Complete = !changed.Valid
+		if !m.Complete {
+			m.ChangedAt = time.Unix(0, changed.Int64).UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return markers, nil
+}
@@ -0,0 +1,115 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxTagLength is the longest tag which may be given
+const maxTagLength = 256
+
+// tagsBatch is the most files whose tags are read in one query
+const tagsBatch = 500
+
+// tagEntry is returned by the tag and untag commands for each file
+type tagEntry struct {
+	Path string   `json:"path"`
+	Tags []string `json:"tags"`
+}
+
+// checkTag returns an error if tag can't be used
+func checkTag(tag string) error {
+	// Each tag is a directory of the .by-tag view so has to be a name
+	if tag == "" || tag == "." || tag == ".." || strings.TrimSpace(tag) != tag || strings.ContainsAny(tag, ",/") {
+		return fmt.Errorf("invalid tag %q", tag)
+	}
+	if len(tag) > maxTagLength {
+		return fmt.Errorf("tag %q is longer than %d bytes", tag, maxTagLength)
+	}
+	return nil
+}
+
+// tagFiles adds tags to the file at the catalog path remote, or takes
+// them away if untag is set, returning the tags it has afterwards
+func (f *Fs) tagFiles(ctx context.Context, remote string, tags []string, untag bool) (*tagEntry, error) {
+	if len(tags) == 0 {
+		return nil, errors.New("need at least one tag")
+	}
+	for _, tag := range tags {
+		if err := checkTag(tag); err != nil {
+			return nil, err
+		}
+	}
+	query, op := `INSERT OR IGNORE INTO tags (remote, tag) VALUES (?, ?)`, auditTag
+	if untag {
+		query, op = `DELETE FROM tags WHERE remote = ? AND tag = ?`, auditUntag
+	}
+	err := f.inTx(ctx, func(tx *sql.Tx) error {
+		var found bool
+		err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE remote = ? AND deleted = 0 AND is_dir = 0)`, remote).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("%s: file not found", remote)
+		}
+		for _, tag := range tags {
+			_, err = tx.ExecContext(ctx, query, remote, tag)
+			if err != nil {
+				return err
+			}
+		}
+		return f.audit(ctx, tx, op, remote, strings.Join(tags, ","))
+	})
+	if err != nil {
+		return nil, err
+	}
+	all, err := f.tagsOf(ctx, []string{remote})
+	if err != nil {
+		return nil, err
+	}
+	return &tagEntry{Path: remote, Tags: append([]string{}, all[remote]...)}, nil
+}
+
+// tagsOf returns the tags of each of remotes which has any, in tag order
+func (f *Fs) tagsOf(ctx context.Context, remotes []string) (map[string][]string, error) {
+	tags := map[string][]string{}
+	for len(remotes) > 0 {
+		n := min(len(remotes), tagsBatch)
+		args := make([]interface{}, n)
+		for i, remote := range remotes[:n] {
+			args[i] = remote
+		}
+		remotes = remotes[n:]
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+		rows, err := f.rdb.QueryContext(ctx, `SELECT remote, tag FROM tags WHERE remote IN (`+placeholders+`) ORDER BY remote, tag`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var remote, tag string
+			err = rows.Scan(&remote, &tag)
+			if err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+			tags[remote] = append(tags[remote], tag)
+		}
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// taggedFiles returns the live files at or below dir with tag
+func (f *Fs) taggedFiles(ctx context.Context, dir, tag string) ([]string, error) {
+	cond, args := inDir(dir)
+	args = append(args, tag)
+	return f.queryRemotes(ctx, `SELECT remote FROM files WHERE `+cond+` AND deleted = 0 AND is_dir = 0 AND remote IN (SELECT remote FROM tags WHERE tag = ?) ORDER BY remote`, args...)
+}
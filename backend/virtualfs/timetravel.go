@@ -0,0 +1,114 @@
+package virtualfs
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// historyLayout is the layout the history triggers write times in, so
+// a time formatted with it compares with them as a string
+const historyLayout = "2006-01-02T15:04:05.000Z"
+
+// historyBound returns the bound on history for the at option
+func (f *Fs) historyBound() string {
+	return time.Time(f.opt.At).UTC().Format(historyLayout)
+}
+
+// pastObject fills in where the content of o, a file as it was at the
+// at time, is held. That is the live file if it hasn't changed since,
+// else a version kept by keep_versions. If neither has it o is marked
+// evicted.
+func (f *Fs) pastObject(ctx context.Context, o *Object) (*Object, error) {
+	live, err := f.findObject(ctx, o.remote)
+	if err == nil {
+		if l := live.(*Object); l.hash == o.hash && l.size == o.size {
+			past := *l
+			past.modTime = o.modTime
+			return &past, nil
+		}
+	} else if err != fs.ErrorObjectNotFound {
+		return nil, err
+	}
+	versions, _, err := f.queryVersions(ctx, o.remote)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if v := versions[i]; v.hash == o.hash && v.size == o.size {
+			v.modTime = o.modTime
+			return v, nil
+		}
+	}
+	o.evicted = true
+	return o, nil
+}
+
+// listAt lists dir as it was at the at time. Directories are shown if
+// they were made or anything below them existed then.
+func (f *Fs) listAt(ctx context.Context, dir string) (entries fs.DirEntries, err error) {
+	prefix := dirPrefix(dir)
+	objects, err := f.queryHistory(ctx, `time <= ?`, matchPrefix, f.historyBound(), prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 && dir != "" {
+		return nil, fs.ErrorDirNotFound
+	}
+	seen := map[string]bool{}
+	for _, o := range objects {
+		if o.remote == dir {
+			continue
+		}
+		rest := strings.TrimPrefix(o.remote, prefix)
+		if i := strings.IndexByte(rest, '/'); i >= 0 || o.isDir {
+			if i >= 0 {
+				rest = rest[:i]
+			}
+			sub := path.Join(dir, rest)
+			if !seen[sub] {
+				seen[sub] = true
+				entries = append(entries, fs.NewDir(f.relPath(sub), o.modTime))
+			}
+			continue
+		}
+		past, err := f.pastObject(ctx, o)
+		if err != nil {
+			return nil, err
+		}
+		if f.hideEvicted(past) {
+			continue
+		}
+		entries = append(entries, past)
+	}
+	return entries, nil
+}
+
+// newObjectAt finds the file at remote as it was at the at time
+func (f *Fs) newObjectAt(ctx context.Context, remote string) (fs.Object, error) {
+	objects, err := f.queryHistory(ctx, `time <= ?`, `remote = ?`, f.historyBound(), remote)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 || objects[0].isDir {
+		return nil, fs.ErrorObjectNotFound
+	}
+	past, err := f.pastObject(ctx, objects[0])
+	if err == nil && f.hideEvicted(past) {
+		return nil, fs.ErrorObjectNotFound
+	}
+	return past, err
+}
+
+// checkPastContent returns an error for opening o if it is a file as it
+// was at the at time whose content is no longer held
+func (o *Object) checkPastContent() error {
+	if !o.fs.opt.At.IsSet() || !o.evicted {
+		return nil
+	}
+	return fmt.Errorf("%s: %w as it was at %v", o.remote, errNoContent, o.fs.opt.At)
+}
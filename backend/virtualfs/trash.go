@@ -0,0 +1,191 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// trashDir is the synthetic directory deleted files are listed in
+const trashDir = ".trash"
+
+// errInTrash is returned when trying to change a file in the trash
+var errInTrash = errors.New("files in the trash can't be changed")
+
+// trashPath returns the path inside the trash of remote and true if
+// remote is in the trash directory
+func (f *Fs) trashPath(remote string) (string, bool) {
+	if !f.showTrash() {
+		return "", false
+	}
+	if remote == trashDir {
+		return "", true
+	}
+	return strings.CutPrefix(remote, trashDir+"/")
+}
+
+// showTrash returns true if the trash directory is shown, which it is
+// only at the top of the catalog
+func (f *Fs) showTrash() bool {
+	return f.opt.ShowTrash && f.root == ""
+}
+
+// hasTrash returns true if there are any deleted files to list in the trash
+func (f *Fs) hasTrash(ctx context.Context) (bool, error) {
+	var found bool
+	err := f.rdb.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE deleted = 1 AND is_dir = 0)`).Scan(&found)
+	return found, err
+}
+
+// listTrash lists the deleted files in dir of the trash, along with
+// the directories needed to reach those further down
+func (f *Fs) listTrash(ctx context.Context, dir string) (entries fs.DirEntries, err error) {
+	return f.listSelected(ctx, trashDir, dir, `deleted = 1 AND is_dir = 0`)
+}
+
+// listSelected lists the files selected by cond in dir of the
+// synthetic directory top, along with the directories needed to reach
+// those further down. The files are listed under top at their paths in
+// the catalog.
+func (f *Fs) listSelected(ctx context.Context, top, dir, cond string, args ...interface{}) (entries fs.DirEntries, err error) {
+	dirCond, dirArgs := inDir(dir)
+	objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE `+cond+` AND `+dirCond, append(args, dirArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	dirTimes := map[string]time.Time{}
+	for _, o := range objects {
+		if f.hideEvicted(o) || f.hideCorrupt(o) {
+			continue
+		}
+		o.view = top
+		rel := o.remote
+		if dir != "" {
+			rel = strings.TrimPrefix(rel, dir+"/")
+		}
+		first, _, isDeeper := strings.Cut(rel, "/")
+		if !isDeeper {
+			entries = append(entries, o)
+			continue
+		}
+		modTime, seen := dirTimes[first]
+		if !seen {
+			dirs = append(dirs, first)
+		}
+		if !seen || o.modTime.After(modTime) {
+			dirTimes[first] = o.modTime
+		}
+	}
+	for _, d := range dirs {
+		entries = append(entries, fs.NewDir(path.Join(top, dir, d), dirTimes[d]))
+	}
+	if dir != "" && len(entries) == 0 {
+		return nil, fs.ErrorDirNotFound
+	}
+	return entries, nil
+}
+
+// newTrashObject finds the deleted file at remote in the trash
+func (f *Fs) newTrashObject(ctx context.Context, remote string) (fs.Object, error) {
+	objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE remote = ? AND deleted = 1 AND is_dir = 0`, remote)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, fs.ErrorObjectNotFound
+	}
+	return objects[0], nil
+}
+
+// purgeDeleted forgets every file deleted longer ago than the
+// deleted_retention, removing its placeholder
+func (f *Fs) purgeDeleted(ctx context.Context) error {
+	cutoff := formatDBTime(time.Now().Add(-time.Duration(f.opt.DeletedRetention)))
+	remotes, err := f.queryRemotes(ctx, `SELECT remote FROM files WHERE deleted = 1 AND is_dir = 0 AND deleted_at < ?`, cutoff)
+	if err != nil {
+		return err
+	}
+	purged := 0
+	for _, remote := range remotes {
+		if ctx.Err() != nil {
+			return nil
+		}
+		var n int64
+		err = f.inTx(ctx, func(tx *sql.Tx) error {
+			// Check again in case it has been put back since
+			res, err := tx.ExecContext(ctx, `DELETE FROM files WHERE remote = ? AND deleted = 1 AND deleted_at < ?`, remote, cutoff)
+			if err != nil {
+				return err
+			}
+			n, err = res.RowsAffected()
+			if err != nil || n == 0 {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `DELETE FROM hashes WHERE remote = ?`, remote)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `DELETE FROM tags WHERE remote = ?`, remote)
+			return err
+		})
+		if err == nil && n > 0 {
+			err = f.removePlaceholder(ctx, remote)
+			purged++
+		}
+		if err != nil {
+			fs.Errorf(nil, "VirtualFS: Failed to purge deleted file %s: %v", remote, err)
+		}
+	}
+	if purged > 0 {
+		fs.Infof(nil, "VirtualFS: Purged %d files deleted more than %v ago", purged, f.opt.DeletedRetention)
+	}
+
+	// Directories have no placeholders so go in one
+	var n int64
+	err = f.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `DELETE FROM files WHERE deleted = 1 AND is_dir = 1 AND deleted_at < ?`, cutoff)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to purge deleted directories: %w", err)
+	}
+	if n > 0 {
+		fs.Infof(nil, "VirtualFS: Purged %d directories removed more than %v ago", n, f.opt.DeletedRetention)
+	}
+	if f.opt.AutoVacuum && (purged > 0 || n > 0) {
+		err = f.incrementalVacuum(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to vacuum catalog: %w", err)
+		}
+	}
+	return nil
+}
+
+// removePlaceholders removes the placeholders of the files deleted
+// from dir so it can be removed from the store. The deletions are
+// still kept in the catalog.
+func (f *Fs) removePlaceholders(ctx context.Context, dir string) error {
+	remotes, err := f.queryRemotes(ctx, `SELECT remote FROM files WHERE parent = ? AND deleted = 1 AND is_dir = 0`, dir)
+	if err != nil {
+		return err
+	}
+	for _, remote := range remotes {
+		err = f.removePlaceholder(ctx, remote)
+		if err != nil {
+			return fmt.Errorf("failed to remove placeholder of %s: %w", remote, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+const (
+	ttlMetadataKey = "content-ttl" // metadata setting the TTL of a file
+	ttlDefault     = "default"     // TTL value going back to content_ttl
+	ttlOff         = "off"         // TTL value keeping content however old it is
+)
+
+// ttlCheckEvery is how often TTL eviction looks for expired content
+// when content_ttl isn't set, for the files with TTLs of their own
+const ttlCheckEvery = 10 * time.Hour
+
+// parseTTL parses the TTL s given to a file, returning false for
+// "default", which has the file go back to content_ttl. A TTL of "off"
+// or 0 keeps the content however old it gets.
+func parseTTL(s string) (ttl time.Duration, set bool, err error) {
+	switch s {
+	case ttlDefault, "":
+		return 0, false, nil
+	case ttlOff:
+		return 0, true, nil
+	}
+	ttl, err = fs.ParseDuration(s)
+	if err != nil || ttl < 0 {
+		return 0, false, fmt.Errorf("invalid TTL %q: want a duration, %q or %q", s, ttlOff, ttlDefault)
+	}
+	return ttl, true, nil
+}
+
+// formatTTL formats the TTL of a file for its metadata
+func formatTTL(ttl time.Duration) string {
+	if ttl == 0 {
+		return ttlOff
+	}
+	return fs.Duration(ttl).String()
+}
+
+// ttlEntry is returned for each file given a TTL
+type ttlEntry struct {
+	Path string `json:"path"`
+	TTL  string `json:"ttl"` // the TTL, "off" or "default"
+}
+
+// setTTL gives each of remotes the TTL s, overriding content_ttl, or
+// has it go back to content_ttl if s is "default". A directory given
+// sets every file in it or further down.
+func (f *Fs) setTTL(ctx context.Context, remotes []string, s string) ([]ttlEntry, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	ttl, set, err := parseTTL(s)
+	if err != nil {
+		return nil, err
+	}
+	value, shown := sql.NullInt64{Int64: int64(ttl), Valid: set}, ttlDefault
+	if set {
+		shown = formatTTL(ttl)
+	}
+	var entries []ttlEntry
+	err = f.inTx(ctx, func(tx *sql.Tx) error {
+		entries = []ttlEntry{}
+		for _, remote := range remotes {
+			files, err := f.holdTargets(ctx, tx, remote)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				_, err = tx.ExecContext(ctx, `UPDATE files SET ttl_ns = ? WHERE remote = ?`, value, file)
+				if err != nil {
+					return err
+				}
+				entries = append(entries, ttlEntry{Path: file, TTL: shown})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		f.objects.remove(e.Path)
+	}
+	fs.Infof(nil, "VirtualFS: Set TTL of %d files to %s", len(entries), shown)
+	return entries, nil
+}
+
+// evictExpired evicts the content of every file not ingested or
+// accessed within its TTL, content_ttl unless it has one of its own
+func (f *Fs) evictExpired(ctx context.Context) error {
+	const expirable = `deleted = 0 AND is_dir = 0 AND evicted = 0 AND held = 0 AND status != ? AND COALESCE(replication_status, '') != 'pending'`
+	var remotes []string
+	if f.opt.ContentTTL > 0 {
+		cutoff := time.Now().Add(-time.Duration(f.opt.ContentTTL))
+		var err error
+		remotes, err = f.queryRemotes(ctx, `SELECT remote FROM files WHERE `+expirable+` AND ttl_ns IS NULL AND COALESCE(last_access, ingested_at) < ?`, statusClaimed, formatDBTime(cutoff))
+		if err != nil {
+			return err
+		}
+	}
+	own, err := f.expiredOwnTTL(ctx, `SELECT remote, ttl_ns, COALESCE(last_access, ingested_at) FROM files WHERE `+expirable+` AND ttl_ns > 0`, statusClaimed)
+	if err != nil {
+		return err
+	}
+	remotes = append(remotes, own...)
+	for _, remote := range remotes {
+		if ctx.Err() != nil {
+			return nil
+		}
+		o := &Object{fs: f, remote: remote}
+		_, err = o.evict(ctx)
+		if err != nil {
+			fs.Errorf(nil, "VirtualFS: Failed to evict expired content of %s: %v", remote, err)
+		}
+	}
+	if len(remotes) > 0 {
+		fs.Infof(nil, "VirtualFS: Evicted content of %d files older than their TTL", len(remotes))
+	}
+	return nil
+}
+
+// expiredOwnTTL returns the files selected by query, with their TTL
+// and when they were last used, which haven't been used within it
+func (f *Fs) expiredOwnTTL(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := f.rdb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	now := time.Now()
+	var remotes []string
+	for rows.Next() {
+		var remote string
+		var ttl int64
+		var used sql.NullString
+		err = rows.Scan(&remote, &ttl, &used)
+		if err != nil {
+			return nil, err
+		}
+		if t := parseNullTime(used); !t.IsZero() && now.Sub(t) > time.Duration(ttl) {
+			remotes = append(remotes, remote)
+		}
+	}
+	return remotes, rows.Err()
+}
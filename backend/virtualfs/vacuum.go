@@ -0,0 +1,61 @@
+package virtualfs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// autoVacuumIncremental is the auto_vacuum pragma's value for incremental
+const autoVacuumIncremental = 2
+
+// setAutoVacuum turns on incremental auto-vacuum for the catalog. A
+// catalog which already has tables only changes over when vacuumed, so
+// the first open with auto_vacuum set rewrites it, which takes a while
+// for a large one.
+func (f *Fs) setAutoVacuum(ctx context.Context) error {
+	// The pragma has to be on the connection doing the VACUUM
+	conn, err := f.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	var mode int
+	err = conn.QueryRowContext(ctx, `PRAGMA auto_vacuum`).Scan(&mode)
+	if err != nil {
+		return err
+	}
+	if mode == autoVacuumIncremental {
+		return nil
+	}
+	fs.Infof(nil, "VirtualFS: Vacuuming catalog to turn on auto_vacuum")
+	_, err = conn.ExecContext(ctx, `PRAGMA auto_vacuum = INCREMENTAL; VACUUM`)
+	if err != nil {
+		return fmt.Errorf("failed to turn on auto_vacuum: %w", err)
+	}
+	return nil
+}
+
+// incrementalVacuum gives the pages freed in the catalog back to the
+// file system
+func (f *Fs) incrementalVacuum(ctx context.Context) error {
+	// A page is freed each step so it has to be read to the end
+	rows, err := f.db.QueryContext(ctx, `PRAGMA incremental_vacuum`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	return err
+}
+
+// analyze updates the statistics SQLite plans queries with
+func (f *Fs) analyze(ctx context.Context) error {
+	_, err := f.db.ExecContext(ctx, `ANALYZE`)
+	return err
+}
@@ -0,0 +1,81 @@
+package virtualfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// systemDirectories are directories which are never used as a root
+// directory, as content, placeholders and the staging directory would
+// be written all through them
+var systemDirectories = []string{"/bin", "/boot", "/dev", "/etc", "/lib", "/lib64", "/proc", "/sbin", "/sys", "/usr", "/var"}
+
+// checkRootDirectory returns an error if dir is somewhere content must
+// never be kept: the top of a filesystem, the home directory or a
+// system directory
+func checkRootDirectory(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("invalid root_directory %q: %w", dir, err)
+	}
+	abs = filepath.Clean(abs)
+	if filepath.Dir(abs) == abs {
+		return fmt.Errorf("refusing to use the top of a filesystem %q as root_directory", dir)
+	}
+	if home, err := os.UserHomeDir(); err == nil && abs == filepath.Clean(home) {
+		return fmt.Errorf("refusing to use the home directory %q as root_directory: use a directory in it", dir)
+	}
+	if runtime.GOOS != "windows" {
+		for _, system := range systemDirectories {
+			if abs == system {
+				return fmt.Errorf("refusing to use the system directory %q as root_directory", dir)
+			}
+		}
+	}
+	return nil
+}
+
+// checkDirWritable returns an error if a file can't be made in dir
+func checkDirWritable(dir string) error {
+	// Named like the catalog so it is never taken for content
+	tmp, err := os.CreateTemp(dir, dbName+"-writable-*")
+	if err != nil {
+		return fmt.Errorf("root directory %q isn't writable: %w", dir, err)
+	}
+	_ = tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// warnNetworkFilesystem logs a warning if the catalog in dir is on a
+// network filesystem, where SQLite's locking can't be relied on
+func warnNetworkFilesystem(dir string) {
+	if kind := networkFilesystem(dir); kind != "" {
+		fs.Logf(nil, "VirtualFS: The catalog in %s is on a %s filesystem where SQLite's file locking is unreliable - only use it from one rclone at a time, or set db_path to local storage", dir, kind)
+	}
+}
+
+// checkOptionConflicts returns an error if options are set together
+// which can't work together
+func checkOptionConflicts(opt *Options) error {
+	if !opt.StoreContent {
+		// Nothing is kept for these to act on
+		switch {
+		case opt.ScrubInterval > 0:
+			return errors.New("scrub_interval can't be used with store_content false as there is no content to verify")
+		case opt.Compress != compressNone:
+			return errors.New("compress can't be used with store_content false as there is no content to compress")
+		case opt.EncryptionPass != "" || opt.EncryptionKey != "":
+			return errors.New("encryption can't be used with store_content false as there is no content to encrypt")
+		case opt.ContentRemote != "":
+			return errors.New("content_remote can't be used with store_content false as there is no content to keep in it")
+		case opt.ChunkSize > 0:
+			return errors.New("chunk_size can't be used with store_content false as there is no content to chunk")
+		}
+	}
+	return nil
+}
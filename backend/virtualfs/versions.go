@@ -0,0 +1,237 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/fspath"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// versionDir is the directory under the root holding the content of
+// the versions kept by keep_versions
+const versionDir = internalDir + "/versions"
+
+// keptVersion is the content of a file set aside by keepVersion before
+// it is replaced
+type keptVersion struct {
+	old         *Object // the row being replaced
+	version     int64   // number of the version
+	contentPath string  // where the content is kept, relative to its disk
+	moved       bool    // set if the content was moved to contentPath
+}
+
+// versionEntry describes one version of a file kept by keep_versions
+type versionEntry struct {
+	Version    int64  `json:"version"`
+	Size       int64  `json:"size"`
+	ModTime    string `json:"modTime"`
+	MD5        string `json:"md5,omitempty"`
+	IngestedAt string `json:"ingestedAt,omitempty"`
+	ReplacedAt string `json:"replacedAt"`
+}
+
+// keepVersion sets aside the content of the live file at remote as a
+// version before it is replaced, if keep_versions is set. Content in
+// a blob stays where it is, anything else is moved into versionDir.
+//
+// It must be called with blobMu held, before the new content is put
+// in place.
+func (f *Fs) keepVersion(ctx context.Context, remote string) (*keptVersion, error) {
+	if f.opt.KeepVersions <= 0 {
+		return nil, nil
+	}
+	objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE remote = ? AND deleted = 0 AND is_dir = 0 AND evicted = 0`, remote)
+	if err != nil || len(objects) == 0 {
+		return nil, err
+	}
+	v := &keptVersion{old: objects[0]}
+	err = f.rdb.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) + 1 FROM versions WHERE remote = ?`, remote).Scan(&v.version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to number version: %w", err)
+	}
+	if _, ok := blobHash(v.old.contentPath); ok {
+		v.contentPath = v.old.contentPath
+		return v, nil
+	}
+	key := v.old.contentKey()
+	_, rel := splitDiskKey(key)
+	v.contentPath = path.Join(versionDir, rel, strconv.FormatInt(v.version, 10))
+	err = f.store.move(ctx, key, diskKey(v.old.disk, v.contentPath))
+	if errors.Is(err, os.ErrNotExist) {
+		fs.Debugf(nil, "VirtualFS: No content of %s to keep a version of", remote)
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to keep version of %s: %w", remote, err)
+	}
+	v.moved = true
+	return v, nil
+}
+
+// undo puts content set aside by keepVersion back, for when the new
+// content isn't committed
+func (v *keptVersion) undo(ctx context.Context) {
+	if v == nil || !v.moved {
+		return
+	}
+	f := v.old.fs
+	err := f.store.move(ctx, diskKey(v.old.disk, v.contentPath), v.old.contentKey())
+	if err != nil {
+		fs.Errorf(nil, "VirtualFS: Failed to put back content of %s: %v", v.old.remote, err)
+	}
+}
+
+// recordVersion records the version set aside by keepVersion in tx and
+// forgets the versions of the file past keep_versions, returning the
+// keys of their content to remove once tx commits
+func (f *Fs) recordVersion(ctx context.Context, tx *sql.Tx, v *keptVersion) (remove []string, err error) {
+	if v == nil {
+		return nil, nil
+	}
+	o := v.old
+	posix, err := marshalPosix(o.posix)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO versions (remote, version, size, mod_time_ns, hash, ingested_at, replaced_at, content_path, compression, stored_size, key_id, disk, posix_metadata) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		o.remote, v.version, o.size, o.modTime.UnixNano(), o.hash, formatDBTime(o.ingestedAt), formatDBTime(time.Now()), v.contentPath,
+		nullString(o.compression), o.storedSize, nullString(o.keyID), o.disk, posix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record version: %w", err)
+	}
+	if blob, ok := blobHash(v.contentPath); ok {
+		// The version keeps the reference the row is about to drop
+		_, err = tx.ExecContext(ctx, `UPDATE blobs SET refcount = refcount + 1 WHERE hash = ?`, blob)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f.pruneVersions(ctx, tx, o.remote, v.version-int64(f.opt.KeepVersions))
+}
+
+// pruneVersions forgets the versions of remote numbered up to and
+// including last, returning the keys of their content to remove once
+// tx commits
+func (f *Fs) pruneVersions(ctx context.Context, tx *sql.Tx, remote string, last int64) (remove []string, err error) {
+	rows, err := tx.QueryContext(ctx, `SELECT content_path, disk FROM versions WHERE remote = ? AND version <= ?`, remote, last)
+	if err != nil {
+		return nil, err
+	}
+	type pruned struct {
+		contentPath string
+		disk        int
+	}
+	var prune []pruned
+	for rows.Next() {
+		var p pruned
+		err = rows.Scan(&p.contentPath, &p.disk)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		prune = append(prune, p)
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, p := range prune {
+		if blob, ok := blobHash(p.contentPath); ok {
+			unused, err := dropBlobRef(ctx, tx, blob)
+			if err != nil {
+				return nil, err
+			}
+			if !unused {
+				continue
+			}
+		}
+		remove = append(remove, diskKey(p.disk, p.contentPath))
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM versions WHERE remote = ? AND version <= ?`, remote, last)
+	return remove, err
+}
+
+// queryVersions returns the versions kept of remote, oldest first
+func (f *Fs) queryVersions(ctx context.Context, remote string) ([]*Object, []versionEntry, error) {
+	rows, err := f.rdb.QueryContext(ctx, `SELECT version, size, mod_time_ns, hash, ingested_at, replaced_at, content_path, compression, stored_size, key_id, disk FROM versions WHERE remote = ? ORDER BY version`, remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var objects []*Object
+	entries := []versionEntry{}
+	for rows.Next() {
+		o := &Object{fs: f, remote: remote}
+		var e versionEntry
+		var modTime int64
+		var ingestedAt, replacedAt, compression, keyID sql.NullString
+		err = rows.Scan(&e.Version, &o.size, &modTime, &o.hash, &ingestedAt, &replacedAt, &o.contentPath, &compression, &o.storedSize, &keyID, &o.disk)
+		if err != nil {
+			return nil, nil, err
+		}
+		o.modTime = time.Unix(0, modTime)
+		o.hasHash = o.hash != ""
+		o.compression = compression.String
+		o.keyID = keyID.String
+		o.ingestedAt = parseNullTime(ingestedAt)
+		e.Size = o.size
+		e.ModTime = formatTime(o.modTime)
+		e.MD5 = o.hash
+		e.IngestedAt = formatTime(o.ingestedAt)
+		e.ReplacedAt = formatTime(parseNullTime(replacedAt))
+		objects = append(objects, o)
+		entries = append(entries, e)
+	}
+	return objects, entries, rows.Err()
+}
+
+// versions lists the versions kept of remote, oldest first
+func (f *Fs) versions(ctx context.Context, remote string) ([]versionEntry, error) {
+	_, entries, err := f.queryVersions(ctx, remote)
+	return entries, err
+}
+
+// getVersion copies the content of the given version of remote to the
+// local path or rclone path dst, returning dst
+func (f *Fs) getVersion(ctx context.Context, remote string, version int64, dst string) (string, error) {
+	objects, entries, err := f.queryVersions(ctx, remote)
+	if err != nil {
+		return "", err
+	}
+	var o *Object
+	for i, e := range entries {
+		if e.Version == version {
+			o = objects[i]
+		}
+	}
+	if o == nil {
+		return "", fmt.Errorf("%s has no version %d", remote, version)
+	}
+	parent, leaf, err := fspath.Split(dst)
+	if err != nil {
+		return "", err
+	}
+	fdst, err := cache.Get(ctx, parent)
+	if err != nil && err != fs.ErrorIsFile {
+		return "", fmt.Errorf("failed to open destination %q: %w", parent, err)
+	}
+	in, err := o.openContent(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to open version %d of %s: %w", version, remote, err)
+	}
+	_, err = operations.Rcat(ctx, fdst, leaf, in, o.modTime, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to write to %q: %w", dst, err)
+	}
+	return dst, nil
+}
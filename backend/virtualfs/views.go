@@ -0,0 +1,121 @@
+package virtualfs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// viewsVersion is the version of the contract the views below keep.
+// Columns may be added to a view without changing it, but anything
+// which would break a reader of the views, like removing or renaming
+// a column or changing what it means, needs a new version.
+const viewsVersion = 1
+
+// views are the read only views of the catalog for other programs to
+// query. They are made again whenever the catalog is opened for
+// writing so they always match the current schema, whatever the
+// migrations have done to the tables underneath.
+var views = []struct {
+	name  string
+	query string
+}{{
+	name:  "v_info",
+	query: fmt.Sprintf(`SELECT %d AS contract_version`, viewsVersion),
+}, {
+	name: "v_files",
+	query: `SELECT
+		remote AS path,
+		parent AS dir,
+		size,
+		strftime('%Y-%m-%dT%H:%M:%SZ', mod_time_ns / 1000000000, 'unixepoch') AS mod_time,
+		mod_time_ns,
+		NULLIF(hash, '') AS md5,
+		status,
+		status_time,
+		ingested_at,
+		last_access,
+		access_count,
+		evicted,
+		corrupt,
+		replication_status,
+		priority,
+		source_remote,
+		source_path,
+		annotation
+	FROM files WHERE deleted = 0 AND is_dir = 0`,
+}, {
+	name: "v_dirs",
+	query: `SELECT
+		remote AS path,
+		parent AS dir
+	FROM files WHERE deleted = 0 AND is_dir = 1`,
+}, {
+	name: "v_deleted_dirs",
+	query: `SELECT
+		remote AS path,
+		parent AS dir,
+		deleted_at
+	FROM files WHERE deleted = 1 AND is_dir = 1`,
+}, {
+	name: "v_changes",
+	query: `SELECT
+		seq,
+		remote AS path,
+		event,
+		size,
+		hash AS md5,
+		time
+	FROM journal`,
+}}
+
+// createViews makes the views in views again, in one transaction so
+// other readers never see them missing
+func (f *Fs) createViews() error {
+	tx, err := f.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, v := range views {
+		_, err = tx.Exec(`DROP VIEW IF EXISTS ` + v.name + `; CREATE VIEW ` + v.name + ` AS ` + v.query)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to create view %s: %w", v.name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// viewsResult is returned by the views command
+type viewsResult struct {
+	Version int                 `json:"version"`
+	Views   map[string][]string `json:"views"` // the columns of each view
+}
+
+// describeViews returns the contract version and the columns of each
+// view
+func (f *Fs) describeViews(ctx context.Context) (*viewsResult, error) {
+	res := &viewsResult{Version: viewsVersion, Views: map[string][]string{}}
+	for _, v := range views {
+		rows, err := f.rdb.QueryContext(ctx, `SELECT name FROM pragma_table_info(?)`, v.name)
+		if err != nil {
+			return nil, err
+		}
+		columns := []string{}
+		for rows.Next() {
+			var name sql.NullString
+			err = rows.Scan(&name)
+			if err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+			columns = append(columns, name.String)
+		}
+		_ = rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		res.Views[v.name] = columns
+	}
+	return res, nil
+}
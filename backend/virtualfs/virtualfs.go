@@ -14,19 +14,33 @@ package virtualfs
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/rclone/rclone/backend/crypt"
 	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/config"
 	"github.com/rclone/rclone/fs/config/configmap"
 	"github.com/rclone/rclone/fs/config/configstruct"
+	"github.com/rclone/rclone/fs/fserrors"
 	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/lib/encoder"
+	"github.com/rclone/rclone/lib/file"
+	"github.com/rclone/rclone/lib/readers"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 )
 
 func init() {
@@ -34,28 +48,1587 @@ func init() {
 		Name:        "virtualfs",
 		Description: "Virtual Filesystem Backend",
 		NewFs:       NewFs,
+		Config:      Config,
+		CommandHelp: commandHelp,
+		MetadataInfo: &fs.MetadataInfo{
+			System: systemMetadataInfo,
+			Help: `The catalog state of each file is returned as read only system
+metadata, so it can be seen with "rclone lsjson --metadata".
+
+With --metadata the permissions, ownership and xattrs of files from
+local or sftp sources are kept in the catalog and applied to the
+content files of the mirror layout in a local root directory. Other
+user metadata is kept as xattrs. A "content-type" from the source, such
+as an S3 bucket, is given as the MIME type of the file, so rclone serve
+s3 and http serve it with the type it was uploaded with.`,
+		},
 		Options: []fs.Option{{
-			Name:     "root_directory",
-			Help:     "Root directory where content and metadata are stored.",
-			Default:  "./virtualfs_data",
+			Name: "root_directory",
+			Help: `Root directory where content and metadata are stored.
+
+This can be a comma separated list of directories, for example on
+several scratch disks, to spread the content across. The catalog and
+the directory structure are kept in the first. Directories can be added
+to the end of the list later but not removed or reordered.
+
+Several directories can't be used with the cas content layout or a
+content_remote.
+
+Content is written to the "staging" directory in each directory and
+only moved into place once it is complete and about to be recorded in
+the catalog, so tools scanning the directories never see partial files.
+
+The top of a filesystem, the home directory and system directories
+such as /etc are refused, as are directories which can't be written to
+unless read_only is set.
+
+Leave blank to keep everything in a directory named after the remote
+in the rclone cache directory. A catalog left in ./virtualfs_data, the
+old default, is still used while that is where rclone is run from.
+
+A leading ~ is expanded to the home directory and environment variables
+such as ${HOME} are expanded. A relative path is relative to the
+directory of the rclone config file rather than wherever rclone is run
+from.`,
+			Default:  "",
 			Advanced: false,
+		}, {
+			Name: "root_distribution",
+			Help: `How content is spread across several root directories.
+
+The catalog records which directory each file is in, so this can be
+changed at any time.`,
+			Default: distributeHash,
+			Examples: []fs.OptionExample{{
+				Value: distributeHash,
+				Help:  "Choose from the hash of the path, so a file always goes in the same one.",
+			}, {
+				Value: distributeFree,
+				Help:  "Choose the one with the most free space.",
+			}},
+			Advanced: true,
+		}, {
+			Name: "db_path",
+			Help: `Path of the catalog database.
+
+By default the catalog is kept in the root directory with the content.
+Set this to keep it elsewhere, for example on faster storage or on a
+volume which cleaning up the content can't touch. The directory is made
+if it doesn't exist.
+
+It is expanded the same as root_directory.
+
+Snapshots are still taken into the root directory by default.`,
+			Default:  "",
+			Advanced: true,
+		}, {
+			Name: "read_only",
+			Help: `Open the catalog read only.
+
+Uploads, deletions, directory changes and the backend commands which
+change anything fail with permission denied, so processing jobs can
+read the files while a single ingest job owns the writes. Reading a
+file doesn't record the access or evict it, and nothing runs in the
+background.
+
+The catalog must have been opened without this once by this version of
+rclone first, so its schema is up to date.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "evict_after_read",
+			Help: `Remove the content of a file once it has been read in full.
+
+When a file is opened and read right to the end, its content is
+deleted from the root directory when it is closed. The metadata is
+kept so the file is not ingested again, which suits pipelines which
+pull each file once and process it elsewhere.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "store_content",
+			Help: `Keep the content of files ingested.
+
+If false only the size, modification time and hashes of each file are
+recorded, with the content hashed as it streams in and then thrown
+away. Use this to catalog a remote without storing it, for change
+detection or building an inventory.
+
+Files catalogued like this are treated as evicted, so reading them
+needs origin_remote to be set.`,
+			Default:  true,
+			Advanced: true,
+		}, {
+			Name: "delete_placeholders",
+			Help: `Write a placeholder file when a file is deleted.
+
+By default deleting a file leaves an empty "<name>.delete" file in its
+place in the content directory. Set this to false to keep the deletion
+only in the catalog, so the content directory holds live files alone.
+A file which is itself named "<name>.delete" is never overwritten by a
+placeholder.
+
+Setting this to false is the same as setting deletion_mode to hidden.`,
+			Default:  true,
+			Advanced: true,
+		}, {
+			Name: "show_trash",
+			Help: `List deleted files in a ".trash" directory.
+
+Deleted files are normally hidden from listings, only recorded in the
+catalog. If set, they are listed under a synthetic ".trash" directory at
+the root, at their original paths, so that consumers of the remote can
+discover deletions. Each has a size of 0 and the time it was deleted as
+its modification time.
+
+The trash can't be written to. Exclude it when syncing from the remote
+with --exclude "/.trash/**". It is only listed when the remote is used
+without a path, at the top of the catalog.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "deleted_retention",
+			Help: `Forget deleted files and directories after this long.
+
+Deleted files are kept in the catalog, along with any "<name>.delete"
+placeholder, and so are removed directories, so that consumers of the
+remote can see they have gone. If
+set, a background pass purges them once they have been deleted for
+longer than this. Set it to longer than the slowest consumer takes to
+notice a deletion.
+
+Set to 0 to keep deleted files forever.`,
+			Default:  fs.Duration(0),
+			Advanced: true,
+		}, {
+			Name: "detect_renames",
+			Help: `Copy content already held for files renamed on the source.
+
+If set, a file being ingested whose size and MD5 match a file whose
+content is already held is treated as a rename. Its content is copied
+from the file held instead of being read from the source, and it keeps
+that file's processing status rather than going back to pending.
+
+This only works if the source supports MD5 and the old name is still
+present when the new one is ingested, so don't use --delete-before.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "ingest_compare",
+			Help: `What to compare to decide whether a file has changed.
+
+When a file which is already in the catalog is uploaded again it is
+only ingested if it has changed. This is "auto" or a "+" separated list
+of the attributes to compare, any of which differing means the file
+has changed:
+
+- size: the size
+- modtime: the modification time, to within modify_window
+- hash: a hash supported by both the source and this remote
+- fingerprint: the hash the source identifies the content by when
+  it is cheap to read, such as an S3 ETag
+
+Attributes the source doesn't support, such as a hash type, are left
+out, so with none left a file is never ingested again. A file whose
+hash the source supports but can't give counts as changed.`,
+			Default:  compareAuto,
+			Advanced: true,
+			Examples: []fs.OptionExample{{
+				Value: compareAuto,
+				Help:  "Compare the fingerprint if the source has one, otherwise size+modtime+hash.",
+			}, {
+				Value: "size+modtime+hash",
+				Help:  "Compare everything the source has except the fingerprint.",
+			}, {
+				Value: "size+modtime",
+				Help:  "Compare size and modification time, never reading hashes.",
+			}, {
+				Value: compareHash,
+				Help:  "Only compare hashes, ignoring modification times.",
+			}},
+		}, {
+			Name: "always_reingest",
+			Help: `Comma separated list of patterns of files to always ingest again.
+
+Files matching any of these are ingested every time they are uploaded,
+whatever ingest_compare says. Use this for files on the source known to
+change without their size or modification time changing, such as
+databases.
+
+The patterns are globs as used by --include, so "*.db" matches in any
+directory and "/state/**" everything under the top level "state".`,
+			Default:  fs.CommaSepList{},
+			Advanced: true,
+		}, {
+			Name: "case_insensitive",
+			Help: `Treat names differing only in case as the same file.
+
+Set this if the sources synced in or the content store are case
+insensitive. Looking up a file finds it whatever the case it is given
+in, and uploading a file or making a directory which exists in another
+case updates the existing one, keeping the name it already has.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "unicode_normalization",
+			Help: `Unicode normalization form to put names in.
+
+Sources can spell the same name with different sequences of unicode
+characters, macOS for instance sending decomposed (NFD) names where
+Linux sends composed (NFC) ones, making two files of one. Set this to
+put every name in the same form before it is looked up or written.
+
+Names already in the catalog aren't changed.`,
+			Default:  normalizeNone,
+			Advanced: true,
+			Examples: []fs.OptionExample{{
+				Value: normalizeNone,
+				Help:  "Use names as given.",
+			}, {
+				Value: "NFC",
+				Help:  "Canonical composition, as most Linux and Windows sources use.",
+			}, {
+				Value: "NFD",
+				Help:  "Canonical decomposition, as macOS uses.",
+			}, {
+				Value: "NFKC",
+				Help:  "Compatibility composition.",
+			}, {
+				Value: "NFKD",
+				Help:  "Compatibility decomposition.",
+			}},
+		}, {
+			Name: "notify_url",
+			Help: `URL to POST a notification to for each change to a file.
+
+If set, each file created, updated or deleted is POSTed to this URL as a
+JSON object with the path, event ("create", "update" or "delete"),
+size, hash, time and the sequence number of the change in the journal.
+
+Notifications are sent in order, in the background. Each is retried
+with increasing delays and, if it still fails, tried again a minute
+later, so a consumer sees every change at least once. Changes made
+before this was first set aren't sent.`,
+			Advanced: true,
+		}, {
+			Name: "on_ingest_command",
+			Help: `Command to run for each file ingested.
+
+If set, this is run in the background for each file created or updated,
+with the path of the file in the remote added as the last argument. It
+is also given these environment variables:
+
+- VIRTUALFS_REMOTE: the path of the file in the remote
+- VIRTUALFS_FILE: the local file holding the content, if it is stored
+  as it is, otherwise empty
+- VIRTUALFS_EVENT: "create" or "update"
+- VIRTUALFS_SIZE: the size of the file
+- VIRTUALFS_HASH: the MD5 of the file, if known
+
+Arguments are separated by spaces and may be quoted. Failures are
+logged and the command is run again for the file, and the files after
+it, on the next pass, so later files wait until it succeeds. Files
+ingested before this was first set aren't run.`,
+			Default:  fs.SpaceSepList{},
+			Advanced: true,
+		}, {
+			Name:     "on_ingest_concurrency",
+			Help:     "How many on_ingest_command runs there may be at once.",
+			Default:  4,
+			Advanced: true,
+		}, {
+			Name: "on_ingest_evict",
+			Help: `Evict the content of a file once on_ingest_command succeeds for it.
+
+The metadata is kept. The content isn't evicted if the file has been
+ingested again since the command started.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "content_remote",
+			Help: `Remote to keep content files in instead of the root directory.
+
+This may be any rclone remote, such as a local path, S3 or SMB, for
+example "s3:bucket/staging". The catalog in the root directory still
+decides what exists, so listing and skipping identical files don't touch
+the content remote.
+
+New content is written to the "staging" directory under the root
+directory and uploaded from there, so min_free_space applies to that.
+
+If not set content is kept in the root directory.`,
+		}, {
+			Name: "mirror_remote",
+			Help: `Remote to replicate every ingested file to.
+
+If set, each file ingested is also uploaded to the same path in this
+remote by a background worker, giving a second copy of the staging
+tier. The replication state of each file is kept in the catalog and
+shown by the "replication-status" backend command. Failed uploads are
+retried every minute.
+
+Content waiting to be replicated is never evicted.`,
+		}, {
+			Name: "origin_remote",
+			Help: `Remote to fetch content from when it isn't held.
+
+When a file whose content has been evicted, or has gone missing, is
+opened it is downloaded from the same path in this remote, checked
+against the size and hash in the catalog, and stored again before being
+read. For example "s3:bucket/prefix".
+
+If not set opening such files fails.`,
+		}, {
+			Name: "batch_size",
+			Help: `Maximum number of catalog updates to commit in one transaction.
+
+Each file ingested or deleted updates the catalog in a transaction of
+its own, so a large sync with many transfers at once can be limited by
+how fast the disk can sync each commit. If this is more than 1, updates
+running at the same time are grouped into shared transactions, each
+still in a savepoint of its own so one failing doesn't undo the others.
+An update only returns once its transaction is committed.
+
+Set to 0 to commit each update on its own.`,
+			Default:  0,
+			Advanced: true,
+		}, {
+			Name: "batch_timeout",
+			Help: `How long to wait for more updates to fill a batch.
+
+Only used if batch_size is set. Longer waits make bigger batches when
+updates arrive slowly but add up to this much to each.`,
+			Default:  fs.Duration(10 * time.Millisecond),
+			Advanced: true,
+		}, {
+			Name: "object_cache_size",
+			Help: `Number of file entries to keep cached in memory.
+
+Looking up a file, as done before every upload to see whether it has
+changed, reads the catalog each time. Recently listed and looked up
+files, and lookups of files which don't exist, are kept in memory so
+large syncs need fewer queries. Entries are dropped as soon as the file
+changes.
+
+Set to 0 to disable the cache.`,
+			Default:  1000,
+			Advanced: true,
+		}, {
+			Name: "busy_timeout",
+			Help: `How long to wait for another process to unlock the catalog.
+
+Several rclone processes can use the same root directory at once, for
+example one syncing files in while another reads them out. Only one can
+write to the catalog at a time, the others waiting up to this long for
+it, and trying again with backoff for locked_timeout after that.`,
+			Default:  fs.Duration(5 * time.Second),
+			Advanced: true,
+		}, {
+			Name: "content_ttl",
+			Help: `Evict content which has not been ingested or read for this long.
+
+A background pass removes the content of files whose last ingest and
+last access are both older than this, keeping their metadata. Files
+which are claimed for processing are left alone.
+
+Files can be given a TTL of their own in place of this with the
+set-ttl backend command or the content-ttl metadata, so some can be
+kept while the rest are evicted or the other way round.
+
+Set to 0 to keep content until it is removed some other way.`,
+			Default:  fs.Duration(0),
+			Advanced: true,
+		}, {
+			Name: "content_layout",
+			Help: `How content files are laid out in the root directory.
+
+Changing this only affects content ingested afterwards, existing files
+stay where they are.`,
+			Default:  layoutMirror,
+			Advanced: true,
+			Examples: []fs.OptionExample{{
+				Value: layoutMirror,
+				Help:  "Store each file at its remote path.",
+			}, {
+				Value: layoutCAS,
+				Help: `Store each unique content once under blobs/<md5>.
+Files with the same content share one blob, which is reference counted
+and removed when nothing refers to it.`,
+			}, {
+				Value: layoutShard,
+				Help: `Store each file under shards/xx/yy/ named by the MD5 of its path.
+This keeps directories small however many files there are in one
+remote directory. The mapping is kept in the catalog.`,
+			}, {
+				Value: layoutID,
+				Help: `Store each file under ids/xx/yy/ named by a random ID.
+Content names have nothing of the remote path in them, so no name is
+too long, reserved or otherwise unstorable on the local filesystem and
+the content never has to follow the file's path. The mapping is kept
+in the catalog, which becomes the only way to find a file's content.`,
+			}},
+		}, {
+			Name: "compress",
+			Help: `Compress content as it is ingested.
+
+Content is decompressed transparently when read. The catalog records
+both the size of the file and the size stored on disk. Changing this
+only affects content ingested afterwards.
+
+max_cache_size and quota count the uncompressed size of files.`,
+			Default:  compressNone,
+			Advanced: true,
+			Examples: []fs.OptionExample{{
+				Value: compressNone,
+				Help:  "Store content as it is.",
+			}, {
+				Value: compressZstd,
+				Help:  "Compress content with zstd.",
+			}},
+		}, {
+			Name: "encryption_password",
+			Help: `Password to encrypt content files with.
+
+If set, content is encrypted as it is ingested using the same file
+format as the crypt backend and decrypted transparently when read.
+The catalog itself is not encrypted.
+
+Content ingested before this was set stays as it is. Content encrypted
+with a different password can't be read until the password is restored.`,
+			IsPassword: true,
+			Advanced:   true,
+		}, {
+			Name: "encryption_key_file",
+			Help: `File to read the password to encrypt content files with.
+
+Use this instead of encryption_password to keep the password out of the
+config file. The whole file, less any trailing new line, is used.`,
+			Advanced: true,
+		}, {
+			Name: "hash_types",
+			Help: `Comma separated list of hash types to compute on ingest.
+
+These are the hashes the remote supports, so that for example "rclone
+check" can compare against an origin which only has SHA-1 or SHA-256.
+Each extra type costs CPU on every ingest.
+
+Any hash rclone knows may be used, such as md5, sha1, sha256 and crc32,
+and the hashes of particular providers: quickxor for OneDrive and
+dropbox for Dropbox. Choose the hash of the remote files are copied
+from or checked against, so for example "rclone check virtualfs:
+onedrive:" compares checksums rather than sizes alone.
+
+Use "origin" to add the hashes origin_remote supports. A local origin
+supports every hash so name the ones wanted instead. The hashes of
+files whose content isn't held, after eviction or with store_content
+false, are read from origin_remote when asked for.
+
+Use "none" to turn hashing off for the fastest ingest of large files.
+The remote then supports no hashes, so syncs to it compare by size and
+modification time only. The cas content layout still computes the MD5
+it needs to name blobs.`,
+			Default:  fs.CommaSepList{"md5"},
+			Advanced: true,
+		}, {
+			Name: "scrub_interval",
+			Help: `How often to re-read content to check it against its hashes.
+
+If set, a background scrubber re-reads the content of every file once
+in this interval, comparing it with its stored hashes. Files which
+don't match are logged and flagged corrupt in the catalog and their
+"corrupt" metadata.
+
+The "scrub" backend command does the same on demand.
+
+Set to 0 to turn off the background scrubber.`,
+			Default:  fs.Duration(0),
+			Advanced: true,
+		}, {
+			Name: "scrub_bwlimit",
+			Help: `Maximum rate the scrubber reads content at, in bytes per second.
+
+Use this to stop scrubbing disturbing ingest. Set to 0 for no limit.`,
+			Default:  fs.SizeSuffix(0),
+			Advanced: true,
+		}, {
+			Name: "max_cache_size",
+			Help: `Maximum total size of the content kept in the root directory.
+
+When the content stored exceeds this, the least recently used files
+have their content evicted, keeping their metadata, until the total is
+below 90% of this size. Files which are claimed for processing are
+left alone.
+
+Set to 0 for no limit.`,
+			Default:  fs.SizeSuffix(0),
+			Advanced: true,
+		}, {
+			Name: "quota",
+			Help: `Per directory limits on the content stored.
+
+A comma separated list of dir:size pairs, eg
+
+    ingest/camera:50G,ingest/logs:10G
+
+Each limits the total content stored below that directory. What
+happens to a Put which would go over is set by quota_action.`,
+			Default:  fs.CommaSepList{},
+			Advanced: true,
+		}, {
+			Name:     "quota_action",
+			Help:     "What to do when a Put would exceed a directory quota.",
+			Default:  limitActionError,
+			Advanced: true,
+			Examples: []fs.OptionExample{{
+				Value: limitActionError,
+				Help:  "Fail the Put with a quota exceeded error.",
+			}, {
+				Value: limitActionEvict,
+				Help:  "Evict the least recently used content in that directory to make room.",
+			}},
+		}, {
+			Name: "min_free_space",
+			Help: `Minimum free space to leave on the disk holding the root directory.
+
+Before content is written the free space is checked and if storing the
+file would leave less than this, free_space_action decides what
+happens. This stops a sync filling the disk part way through.
+
+Set to 0 to not check.`,
+			Default:  fs.SizeSuffix(0),
+			Advanced: true,
+		}, {
+			Name:     "free_space_action",
+			Help:     "What to do when a Put would leave less than min_free_space.",
+			Default:  limitActionError,
+			Advanced: true,
+			Examples: []fs.OptionExample{{
+				Value: limitActionError,
+				Help:  "Fail the Put with an insufficient space error.",
+			}, {
+				Value: limitActionEvict,
+				Help:  "Evict the least recently used content to make room.",
+			}},
+		}, {
+			Name: config.ConfigEncoding,
+			Help: `The encoding of the names of content stored at the remote path.
+
+Names are kept as given in the catalog and only the content files in
+the root directory or content_remote are encoded, so names with
+characters the store can't hold, such as ":" on Windows or SMB, can
+still be stored. See the encoding section in the overview for more info.
+
+Existing content isn't renamed if this is changed, so set it before
+storing anything.`,
+			Advanced: true,
+			Default:  encoder.Base,
+		}, {
+			Name: "windows_names",
+			Help: `Store content under names Windows can create.
+
+Names Windows reserves for devices, such as "CON", "PRN" or "aux.txt",
+are stored with "‛" in front, and names ending in a dot or a space have
+that encoded as with the encoding option. Names in the catalog are kept
+as given.
+
+This is on by default on Windows. Set it when the root directory or
+content_remote is on Windows or SMB storage from another system.
+Existing content isn't renamed if this is changed.`,
+			Advanced: true,
+			Default:  runtime.GOOS == "windows",
+		}, {
+			Name: "max_name_length",
+			Help: `Maximum length in bytes of a name in the content store.
+
+Content whose remote path has a name too long for the store, leaving
+room for a ".delete" placeholder, is stored under a stand-in made from
+the start of the name and its MD5. The full name is kept in the catalog
+so names are never limited by the store.
+
+Set to 0 for no limit.`,
+			Advanced: true,
+			Default:  255,
+		}, {
+			Name: "materialize_links",
+			Help: `Make real symlinks for translated symlinks.
+
+Symlinks copied with --links arrive as files ending ".rclonelink"
+holding the link target, which is recorded in the catalog. If this is
+set a real symlink to the target is also made in the root directory,
+next to the ".rclonelink" file, for tools reading the root directly.
+
+Only used with the mirror content_layout and no content_remote.`,
+			Advanced: true,
+			Default:  false,
+		}, {
+			Name: "audit_log",
+			Help: `Record every upload, deletion, eviction and status change.
+
+Each is recorded in the catalog with the time, the user and host rclone
+ran as and an ID made for each run of rclone, which is logged at debug
+level when the remote starts. Use the audit backend command to read
+them. Nothing is ever removed from the audit log.`,
+			Advanced: true,
+			Default:  false,
+		}, {
+			Name: "quiet_ops",
+			Help: `Log each file operation at debug level rather than info.
+
+Every lookup, listing, upload and deletion is logged, which swamps the
+output of large syncs at info level. With this set, the default, only
+a summary of the files ingested, skipped, deleted and evicted is logged
+at info level when the remote is shut down. Turn it off to log each
+operation at info level as well.`,
+			Advanced: true,
+			Default:  true,
+		}, {
+			Name: "recover_on_start",
+			Help: `Clean up after a crash when the remote is opened.
+
+A run which is killed part way through can leave the temporary files of
+uploads which never finished, placeholders of deletions which never
+happened and the content of deleted files behind. With this set, the
+default, the content under the root directory is checked for these
+when the remote is opened and any found are removed and logged. Only
+files untouched for an hour are removed so uploads by other processes
+sharing the catalog are left alone.
+
+Checking means walking the whole root directory, so turn this off if
+that makes opening the remote too slow and run "rclone backend gc"
+now and again instead.`,
+			Advanced: true,
+			Default:  true,
+		}, {
+			Name: "durable_writes",
+			Help: `Make sure content is on disk before it is recorded in the catalog.
+
+With this set each content file and the directory it is moved into are
+flushed to disk before the catalog row is committed, every commit is
+flushed to disk and the write ahead log is checkpointed into the
+database afterwards. A power loss then can't leave rows pointing at
+content which is missing or truncated.
+
+This makes every upload wait for the disk, so is much slower for lots
+of small files.`,
+			Advanced: true,
+			Default:  false,
+		}, {
+			Name: "no_preallocate",
+			Help: `Disable preallocation of disk space for ingested content.
+
+The space for uncompressed content of known size is allocated before
+it is written, which helps prevent fragmentation and makes an upload
+which won't fit fail at once rather than when the disk fills. Some
+filesystems report the preallocated space as the size of the file, so
+use this flag to disable preallocation if sizes come out wrong.`,
+			Advanced: true,
+			Default:  false,
+		}, {
+			Name: "max_file_size",
+			Help: `Largest file whose content is stored.
+
+Puts of larger files are dealt with as max_file_size_action says, so a
+single unexpectedly huge file can't fill the disk. Streams of unknown
+size fail as soon as they pass the limit whatever the action.
+
+Set to 0 for no limit.`,
+			Default:  fs.SizeSuffix(0),
+			Advanced: true,
+		}, {
+			Name:     "max_file_size_action",
+			Help:     "What to do with a Put larger than max_file_size.",
+			Default:  sizeActionError,
+			Advanced: true,
+			Examples: []fs.OptionExample{{
+				Value: sizeActionError,
+				Help:  "Fail the Put with a file too large error.",
+			}, {
+				Value: sizeActionMetadata,
+				Help:  "Record the file's metadata without its content, as store_content = false does.",
+			}},
+		}, {
+			Name: "ingest_bwlimit",
+			Help: `Maximum rate content is stored at, in bytes per second.
+
+This limits the uploads into this remote alone, whatever --bwlimit is
+set to, so ingest can't starve other work reading from the same disk.
+Set to 0 for no limit.`,
+			Default:  fs.SizeSuffix(0),
+			Advanced: true,
+		}, {
+			Name: "ingest_files_per_second",
+			Help: `Maximum number of files ingested per second.
+
+Like ingest_bwlimit this limits this remote alone, stopping a sync of
+many small files hammering the catalog and disk. Fractions such as 0.5
+are allowed. Set to 0 for no limit.`,
+			Default:  0.0,
+			Advanced: true,
+		}, {
+			Name: "max_concurrent_writes",
+			Help: `Maximum number of content files written at once.
+
+Uploads past this wait for one of the others to finish. Many large
+files written in parallel to one spinning disk make it seek between
+them, which is slower than writing a few at a time. Set to 0 for no
+limit.`,
+			Default:  0,
+			Advanced: true,
+		}, {
+			Name: "copy_buffer_size",
+			Help: `Size of the buffers content is copied through when ingested.
+
+Buffers are reused between uploads, so larger ones cost little and cut
+the number of reads and writes for big files.`,
+			Default:  fs.SizeSuffix(1024 * 1024),
+			Advanced: true,
+		}, {
+			Name: "link_local",
+			Help: `Link files from the local backend into the store rather than copying them.
+
+When a file is uploaded from a local remote on the same filesystem as
+the root directory its content can be linked into place, which is far
+quicker for large files. The file is still read once for its hashes.
+If it can't be linked, say because it is on another filesystem, it is
+copied as usual. Content which is compressed, encrypted or stored in
+the cas layout or a content_remote is always copied.`,
+			Default:  linkLocalOff,
+			Advanced: true,
+			Examples: []fs.OptionExample{{
+				Value: linkLocalOff,
+				Help:  "Always copy content.",
+			}, {
+				Value: linkLocalReflink,
+				Help:  "Clone the file, sharing its blocks until either copy is changed. Needs Linux and a filesystem such as btrfs or XFS.",
+			}, {
+				Value: linkLocalHardlink,
+				Help:  "Hard link the file. The stored content and its permissions are shared with the source file, so only use this if sources are replaced rather than changed in place.",
+			}},
+		}, {
+			Name: "catalog_backup",
+			Help: `Directory or remote to back the catalog up to continuously.
+
+If set, a snapshot of the catalog is written here every
+catalog_backup_interval if it has changed since the last one, and once
+more when the remote is shut down, so the catalog survives the loss of
+the machine holding it. Restore one with the "restore-db" backend command.
+
+E.g. "s3:bucket/catalogs/staging" or "/mnt/backup/catalog".`,
+			Advanced: true,
+		}, {
+			Name:     "catalog_backup_interval",
+			Help:     "How often to check whether the catalog needs backing up to catalog_backup.",
+			Default:  fs.Duration(15 * time.Minute),
+			Advanced: true,
+		}, {
+			Name:     "catalog_backup_keep",
+			Help:     "How many snapshots to keep in catalog_backup, the oldest being removed first.",
+			Default:  24,
+			Advanced: true,
+		}, {
+			Name: "keep_versions",
+			Help: `How many previous versions of each file to keep.
+
+When a file is replaced its old content is kept as a version, up to
+this many per file, the oldest being forgotten first. Use the
+"versions" backend command to list them and "get-version" to copy one
+out. 0 keeps no versions.`,
+			Default:  0,
+			Advanced: true,
+		}, {
+			Name: "at",
+			Help: `Show the tree as it was at the time given.
+
+Files are listed with the size, modification time and hash they had
+then, including files since deleted. Their content can be read if it
+is still held, either as the file hasn't changed since or as a version
+kept by keep_versions.
+
+The parameter should be a date, "2006-01-02", datetime "2006-01-02
+15:04:05" or a duration for that long ago, eg "100d" or "1h".
+
+This implies read_only.
+
+See [the time option docs](/docs/#time-option) for valid formats.`,
+			Default:  fs.Time{},
+			Advanced: true,
+		}, {
+			Name: "priority_rules",
+			Help: `Processing priorities to give files as they are ingested.
+
+A comma separated list of glob:priority pairs, eg
+
+    *.urgent:10,/alerts/**:5,*.log:-1
+
+Each time a file is ingested it gets the priority of the first pattern
+it matches, or keeps the one it had if it matches none. New files
+start at 0. The "pending" command lists the highest priority first.
+The patterns are globs as used by --include.
+
+Use the "set-priority" command to change priorities later.`,
+			Default:  fs.CommaSepList{},
+			Advanced: true,
+		}, {
+			Name: "overlay",
+			Help: `Show files in the origin_remote which were never ingested.
+
+When a file isn't in the catalog, and never has been, it is looked up
+at the same path in the origin_remote. If it is there it is recorded
+in the catalog, with its content fetched when it is first opened, so
+the catalog fills in as files are asked for. Files deleted from the
+catalog aren't looked up again.
+
+Only files asked for by name are found this way, listings show the
+catalog alone.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "evicted_read",
+			Help: `How evicted files are shown to readers.
+
+By default evicted files are listed like any other and their content
+is fetched again from origin_remote when they are opened. Under rclone
+serve http or webdav that means a request for one waits for the fetch.
+
+Set to "not_found" to leave evicted files out of listings instead, so
+they can't be opened and the servers answer 404 for them. Only use
+this on remotes which are read from: a sync to the remote sees evicted
+files as missing and uploads them again.
+
+Set to "error" to list evicted files with the size, modification time
+and hashes in the catalog, as rclone serve s3 gives in listings and
+HEAD requests, but fail opening them rather than fetching them. Any
+head kept by cache_head_bytes can still be read.`,
+			Default:  evictedReadFetch,
+			Advanced: true,
+			Examples: []fs.OptionExample{{
+				Value: evictedReadFetch,
+				Help:  "List evicted files and fetch their content when opened.",
+			}, {
+				Value: evictedReadNotFound,
+				Help:  "Leave evicted files out, as if they weren't there.",
+			}, {
+				Value: evictedReadError,
+				Help:  "List evicted files but fail opening them.",
+			}},
+		}, {
+			Name: "deletion_mode",
+			Help: `How a deleted file is shown in the content directory.
+
+The deletion is always kept in the catalog. This decides what programs
+reading the content directory itself see in place of the file. Files
+deleted before this was changed keep what they were given.`,
+			Default:  deletionPlaceholder,
+			Advanced: true,
+			Examples: []fs.OptionExample{{
+				Value: deletionHidden,
+				Help:  "Nothing, the file is just removed.",
+			}, {
+				Value: deletionPlaceholder,
+				Help:  "An empty \"<name>.delete\" file next to where it was.",
+			}, {
+				Value: deletionZeroByte,
+				Help:  "An empty file in its place, under its own name.",
+			}},
+		}, {
+			Name: "maintenance_interval",
+			Help: `How often to run content_ttl eviction and deleted file expiry.
+
+Both run in the background while the remote is in use, such as under
+a long running mount or rcd. By default how often is worked out from
+content_ttl and deleted_retention, between once a minute and once an
+hour. Set this to run them on a fixed schedule instead.`,
+			Default:  fs.Duration(0),
+			Advanced: true,
+		}, {
+			Name: "gc_interval",
+			Help: `How often to remove content files not referenced by the catalog.
+
+If set, the same as the "gc" backend command is run in the background
+this often, leaving alone files modified in the last hour as they may
+belong to an upload in progress.
+
+Set to 0 to only remove them when "gc" is run.`,
+			Default:  fs.Duration(0),
+			Advanced: true,
+		}, {
+			Name: "checkpoint_interval",
+			Help: `How often to copy the write ahead log into the catalog.
+
+SQLite does this itself as the log grows, but only when nothing is
+reading the catalog. Under a busy mount the log can grow large, so
+this checkpoints it in the background this often as well.
+
+Set to 0 to leave it to SQLite.`,
+			Default:  fs.Duration(0),
+			Advanced: true,
+		}, {
+			Name: "startup_check",
+			Help: `How to check the catalog against the content when opening it.
+
+Discrepancies are logged, so drift between the two is noticed before
+anything reads bad data, but nothing is repaired. Use the "gc" and
+"scrub" backend commands for that.
+
+Both checks list every content file, which takes a while for a large
+content_remote.`,
+			Default:  startupCheckOff,
+			Advanced: true,
+			Examples: []fs.OptionExample{{
+				Value: startupCheckOff,
+				Help:  "Don't check.",
+			}, {
+				Value: startupCheckQuick,
+				Help:  "Count the files whose content is missing.",
+			}, {
+				Value: startupCheckFull,
+				Help:  "List the files whose content is missing and the content files not in the catalog.",
+			}},
+		}, {
+			Name: "db_check",
+			Help: `How to check the catalog database for damage when opening it.
+
+A damaged catalog otherwise shows up later as SQLite errors part way
+through a sync. What happens when damage is found is set by db_recover.`,
+			Default:  dbCheckOff,
+			Advanced: true,
+			Examples: []fs.OptionExample{{
+				Value: dbCheckOff,
+				Help:  "Don't check.",
+			}, {
+				Value: dbCheckQuick,
+				Help:  "Run SQLite's quick_check, which is fast but doesn't check indexes match their tables.",
+			}, {
+				Value: dbCheckIntegrity,
+				Help:  "Run SQLite's integrity_check, which reads the whole database.",
+			}},
+		}, {
+			Name: "db_recover",
+			Help: `What to do when db_check finds the catalog damaged.
+
+Unless this is "off" the damaged catalog is moved aside, next to it with
+"-corrupt-" and the time added to its name, and replaced. Changes made
+since the snapshot it is replaced with are lost, so consider setting
+startup_check too.`,
+			Default:  dbRecoverOff,
+			Advanced: true,
+			Examples: []fs.OptionExample{{
+				Value: dbRecoverOff,
+				Help:  "Fail to open the remote.",
+			}, {
+				Value: dbRecoverSnapshot,
+				Help:  "Restore the newest snapshot in the .virtualfs/snapshots directory or catalog_backup.",
+			}, {
+				Value: dbRecoverScan,
+				Help: `Rebuild the catalog from the files in the root directory.
+Only possible with the mirror layout without compression or encryption.
+File metadata other than size and modification time is lost.`,
+			}},
+		}, {
+			Name: "auto_vacuum",
+			Help: `Give the space freed in the catalog back to the file system.
+
+SQLite keeps the pages of deleted rows for reuse, so a catalog where
+many deletions are expired keeps the size it grew to. If set the free
+pages are given back after each deleted file expiry run.
+
+Turning this on for an existing catalog rewrites it once, the next time
+it is opened.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "analyze_interval",
+			Help: `How often to update the statistics SQLite plans queries with.
+
+As the catalog changes the statistics go out of date, leading to slow
+query plans. If set ANALYZE is run in the background this often.`,
+			Default:  fs.Duration(0),
+			Advanced: true,
+		}, {
+			Name: "db_pragmas",
+			Help: `SQLite pragmas to set on each connection to the catalog.
+
+A comma separated list of name=value pairs, e.g.
+"cache_size=-65536,mmap_size=268435456,temp_store=memory", to tune
+SQLite for the workload. Values must be numbers or single words.
+
+These are set after those virtualfs sets itself, so can override them,
+such as journal_mode, at the risk of breaking sharing the catalog.`,
+			Default:  fs.CommaSepList{},
+			Advanced: true,
+		}, {
+			Name: "async_delete",
+			Help: `Remove the content of deleted files in the background.
+
+Deleting a large file can take a while, holding up a sync deleting
+many. If set the content is renamed into the "deleting" directory of
+the root directory as the file is deleted, which is quick, and removed
+from there in the background. Anything left there, say by a crash, is
+removed when the remote is next used, and what is waiting is removed
+before rclone exits.
+
+Only content in local root directories is removed in the background,
+content_remote removes it as the file is deleted.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "namespace",
+			Help: `Keep the files of this remote in a namespace of a shared catalog.
+
+Several remotes may share one catalog and root directory, each with a
+namespace of its own, rather than each having a database of its own.
+Each sees only the files in its namespace, which are kept in the
+catalog below a top level directory of the namespace's name, with
+their content below that directory of the root directory in the mirror
+layout. Content stored by hash is shared between the namespaces.
+
+The backend commands taking paths only see the files in the
+namespace, their paths being relative to it, though paths they return
+include the namespace. Those working on the whole catalog, like stats,
+changes, gc and the snapshot commands, work on every namespace.
+
+A remote sharing the catalog without a namespace sees each namespace
+as a directory, for administering them all at once. The trash isn't
+shown in a namespace.`,
+			Advanced: true,
+		}, {
+			Name: "ingest_include",
+			Help: `Comma separated list of patterns of the only files to ingest.
+
+If set, uploads of files not matching any of these are dropped without
+anything being stored or cataloged, whatever filters the command
+uploading them used. The upload succeeds so a sync carries on, but the
+file is missing from the remote so is uploaded again by the next sync.
+
+The patterns are globs as used by --include, matched against the path
+in the catalog, so "*.jpg" matches in any directory.`,
+			Default:  fs.CommaSepList{},
+			Advanced: true,
+		}, {
+			Name: "ingest_exclude",
+			Help: `Comma separated list of patterns of files not to ingest.
+
+Uploads of files matching any of these are dropped as for
+ingest_include, for example "*.tmp,**/.thumbnails/**,Thumbs.db". A file
+matching both is dropped.`,
+			Default:  fs.CommaSepList{},
+			Advanced: true,
+		}, {
+			Name: "ingest_min_age",
+			Help: `Don't ingest files modified more recently than this.
+
+Uploads of files whose modification time is less than this long ago
+are dropped as for ingest_include, so files which may still be being
+written on the source are left for a later sync. 0 to ingest files
+however new.`,
+			Default:  fs.Duration(0),
+			Advanced: true,
+		}, {
+			Name: "ingest_max_age",
+			Help: `Don't ingest files modified longer ago than this.
+
+Uploads of files whose modification time is more than this long ago
+are dropped as for ingest_include. 0 to ingest files however old.`,
+			Default:  fs.Duration(0),
+			Advanced: true,
+		}, {
+			Name: "duplicate_window",
+			Help: `Skip uploads of the same content within this long of the last ingest.
+
+Some sources upload identical files again with a new modification time
+every run. If set, a file of the same size and hash as the one already
+ingested within this long is taken to be the same file whatever its
+modification time, so isn't ingested again, only its new modification
+time recorded. The source must support a hash virtualfs computes.
+0 to compare as ingest_compare says however recently the file was
+ingested.`,
+			Default:  fs.Duration(0),
+			Advanced: true,
+		}, {
+			Name: "quarantine_corrupt",
+			Help: `Quarantine content which doesn't match its stored hashes.
+
+Normally files the scrubber finds corrupt are only flagged, and their
+content served as it is. If set, the content is moved into the
+quarantine directory of its disk and the file left out of listings
+until it is ingested again or repaired, so bad bytes are never served.
+
+Content fetched from origin_remote which doesn't match the catalog is
+also kept in the quarantine directory and the file flagged corrupt.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "virtual_views",
+			Help: `List files by state and tag in synthetic directories.
+
+If set, the root of the catalog also lists two read only directories
+made from queries of the catalog:
+
+- ".by-state/<status>/" holds the files in each processing state,
+  pending, claimed, processed and failed
+- ".by-tag/<tag>/" holds the files with each tag
+
+Files keep their paths below these, so any rclone command can work on
+a slice of the catalog, for example
+
+    rclone copy remote:.by-state/processed/ /export
+
+The views can't be written to. Exclude them when syncing from the
+remote with --exclude "/.by-*/**". Like the trash they are only listed
+when the remote is used without a path.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "cache_max_size",
+			Help: `Largest file whose content is cached.
+
+Files larger than this have only their metadata recorded, as
+store_content = false does, while smaller ones are stored in full, so
+a few huge archives can't take up the whole disk. Unlike
+max_file_size this is not an error. If origin_remote is set, reads of
+the larger files are streamed from it without being kept.
+
+Streams of unknown size are always stored. Set to 0 to cache every
+file.`,
+			Default:  fs.SizeSuffix(0),
+			Advanced: true,
+		}, {
+			Name: "cache_head_bytes",
+			Help: `Only cache the first this many bytes of larger files.
+
+For pipelines which mostly sniff file types or read headers. Files
+larger than this have their first bytes kept in the catalog and the
+rest dropped, as store_content = false does, though their hashes are
+still taken from all of it. Reads within the head are served from the
+catalog. Other reads fetch the whole file from origin_remote, which
+is then cached as usual.
+
+Streams of unknown size are always stored. It can't be used with
+encryption and is at most 1 MiB. Set to 0 to cache whole files.`,
+			Default:  fs.SizeSuffix(0),
+			Advanced: true,
+		}, {
+			Name: "chunk_size",
+			Help: `Store files larger than this as chunks of this size.
+
+Each chunk is stored once, named after its MD5, in the blobs directory
+the cas content_layout uses, and its hash is recorded in the catalog.
+Versions of a slowly changing large file share the chunks which
+haven't changed, and a read of part of a file only opens the chunks
+it is in. Use the chunks command to list them.
+
+Changing it only affects files ingested afterwards. Streams of unknown
+size are stored whole. It can't be used with several root directories
+or keep_versions. Set to 0 to store every file whole.`,
+			Default:  fs.SizeSuffix(0),
+			Advanced: true,
+		}, {
+			Name: "resume_partial",
+			Help: `Keep what was written of an interrupted upload for this long.
+
+If an upload fails part way, because the source couldn't be read or
+the transfer was cancelled, what was written so far is kept rather
+than removed. When the same file, of the same size, modification time
+and hash if it is cheap to read, is uploaded to the same path again
+the upload carries on from where it stopped. The rest is read by
+opening the source part way if it can be, otherwise the start is read
+again and checked against what was kept.
+
+Only files of known size stored whole, without compression or
+encryption, are resumed. Set to 0 to start interrupted uploads again.`,
+			Default:  fs.Duration(0),
+			Advanced: true,
+		}, {
+			Name: "eviction_policy",
+			Help: `Which content to evict first when room is needed.
+
+Used when max_cache_size, a quota or min_free_space has to evict
+content to make room. Every open of a file records when it was and
+counts it, as the last-access and access-count metadata show.`,
+			Default: evictionLRU,
+			Examples: []fs.OptionExample{{
+				Value: evictionLRU,
+				Help:  "Evict the least recently opened or ingested files first",
+			}, {
+				Value: evictionLFU,
+				Help:  "Evict the least often opened files first, so files read again and again are kept",
+			}},
+			Advanced: true,
+		}, {
+			Name: "list_changed_since",
+			Help: `Only list the files changed since this point.
+
+Listings leave out the files which haven't been ingested since, so
+"rclone copy virtualfs: dest:" copies just what is new. Directories are
+still listed so the files further down can be found.
+
+The parameter is a change journal sequence number, a time as for the
+"at" option or "bookmark" for the changes since the bookmark of each
+top level directory, as the "changes" command shows. Given a time,
+files with a modification time after it are listed too. A directory
+without a bookmark is listed in full. Bookmark after each export with
+the "bookmark" command to carry on from there next time.`,
+			Advanced: true,
+		}, {
+			Name: "delta",
+			Help: `Only list the files waiting to be processed, marking them processed once read.
+
+Listings leave out every file which isn't pending, and each file opened
+and read right to the end is marked processed when it is closed. Each
+run of "rclone copy virtualfs: dest:" then copies only what arrived or
+changed since the last one, so the remote is a change feed which
+drains itself. A file ingested again while it was being read stays
+pending.
+
+Consumers can still claim, fail and reset files with the status
+commands. This can't be used with read_only.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "hard_delete",
+			Help: `Forget deleted files altogether rather than keeping their deletion.
+
+Removing a file deletes its content and its row in the catalog, hashes
+and tags included, so the remote behaves like a plain cached mirror.
+Deleted files don't go in the trash and no placeholder is left in
+their place whatever deletion_mode says. Removed directories are
+forgotten too.
+
+The change journal still records each deletion.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "retention_period",
+			Help: `Refuse to replace or remove files ingested less than this long ago.
+
+Updating, overwriting, removing, purging or setting the modification
+time of a file within this time of its ingest fails with a permission
+error, which isn't retried, so data can't be altered before it is
+archived. Once the period is up the file can be changed as usual. 0 allows changes at any time.`,
+			Default:  fs.Duration(0),
+			Advanced: true,
+		}, {
+			Name: "locked_timeout",
+			Help: `How long to keep trying to write to a catalog another process has locked.
+
+A write which can't get the lock of the catalog within busy_timeout is
+tried again, waiting longer each time up to 5s between tries, so
+another process holding the catalog for a while, for example to back
+it up, only slows a long sync down rather than failing it. Once the
+catalog has been locked for this long the write fails with an error
+saying so.
+
+Set to 0 to fail as soon as busy_timeout is up.`,
+			Default:  fs.Duration(5 * time.Minute),
+			Advanced: true,
+		}, {
+			Name: "ingest_journal",
+			Help: `Record each upload in the catalog before its content is written.
+
+An entry is added to the ingest journal when an upload starts, noted
+when its content is moved into place and removed in the same commit as
+the file is recorded. After a crash recover_on_start then knows exactly
+which uploads didn't finish and rolls each back: its temporary file is
+removed unless resume_partial kept it to resume, content moved into
+place for a new file is removed, and a file whose content was replaced
+but not recorded is flagged corrupt for scrub or repair.
+
+This costs two more catalog writes for each upload.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "modify_window",
+			Help: `Largest difference in modification times which counts as the same.
+
+When ingest_compare compares modification times, a file uploaded again
+whose modification time is within this of the one in the catalog
+hasn't changed. It is also reported as the precision of the remote, so
+rclone sync and check compare modification times the same way.
+
+Set this to 2s for sources such as FAT formatted disks or SMB shares
+backed by them, which only keep modification times to 2 seconds, or
+every upload from them is ingested again. Leave at 0 to compare
+modification times exactly.`,
+			Default:  fs.Duration(0),
+			Advanced: true,
+		}, {
+			Name: "maintenance_schedule",
+			Help: `Cron expression of when heavy maintenance may run.
+
+If set, content_ttl eviction, deleted file expiry and scrubbing only
+run in the background in the minutes this matches, so their I/O can
+be kept out of working hours. They are still due as often as before:
+one due outside the schedule waits for the next minute in it, and one
+still running when the schedule stops matching is stopped and carries
+on next time.
+
+The expression has the five fields of cron: minute, hour, day of
+month, month and day of week (0 or 7 is Sunday), each "*", a number, a
+range such as "2-5" or a comma separated list of them, optionally
+followed by a step such as "*/15". For example "* 2-5 * * *" lets
+maintenance run from 02:00 to 06:00 each night and "* * * * 6,0" only
+at weekends, in local time.
+
+The backend commands running these, such as "evict" and "scrub", run
+straight away whatever the schedule.`,
+			Advanced: true,
+		}, {
+			Name: "conflict_policy",
+			Help: `What to do when two uploads write the same file at once.
+
+If another upload, such as a second ingest job or rclone process, is
+committed to a file while it is being written, this decides which is
+kept. It is checked in the same transaction that records the file, so
+the catalog and content always agree on which one won.`,
+			Default: conflictOverwrite,
+			Examples: []fs.OptionExample{{
+				Value: conflictOverwrite,
+				Help:  "The last to finish replaces the other.",
+			}, {
+				Value: conflictNewestWins,
+				Help:  "The one with the newer modification time is kept.",
+			}, {
+				Value: conflictError,
+				Help:  "The last to finish fails with an error and is thrown away.",
+			}, {
+				Value: conflictKeepBoth,
+				Help:  "The last to finish is kept as \"<name>-conflict-N.<ext>\".",
+			}},
+			Advanced: true,
+		}, {
+			Name: "content_routing",
+			Help: `Directories to store the content of matching files in.
+
+A comma separated list of glob:directory pairs, eg
+
+    *.mp4:/mnt/bulk,*.json:/mnt/nvme
+
+New content of a file goes to the directory of the first pattern it
+matches, and is spread across the root directories as usual if it
+matches none. The patterns are globs as used by --include.
+
+Each directory is a storage tier. The catalog records which tier holds
+each file, so rules can be changed or removed later without moving
+content already stored, and a directory stays in use while it holds
+any. A directory can also be one of the root directories.
+
+These can't be used with the cas content layout, a content_remote or
+chunk_size.`,
+			Default:  fs.CommaSepList{},
+			Advanced: true,
+		}, {
+			Name: "tier_max_size",
+			Help: `Limits on the content kept in each content_routing directory.
+
+A comma separated list of directory:size pairs, eg
+
+    /mnt/nvme:200G,/mnt/bulk:10T
+
+When ingesting takes a directory over its limit the least used
+content in it, by the eviction_policy, is evicted until it is 10%
+under, as max_cache_size does for all the content.`,
+			Default:  fs.CommaSepList{},
+			Advanced: true,
+		}, {
+			Name: "inline_max_size",
+			Help: `Store content up to this size in the catalog.
+
+Files no bigger than this, after any compression and encryption, have
+their content kept in the catalog database rather than as a file of
+their own. Ingesting millions of tiny files then doesn't use millions
+of inodes, or write and sync a file for each. Reading them is served
+from the catalog.
+
+Content stored inline isn't in the root directory, so tools reading
+the content tree directly, the mirror layout and on_ingest_command
+don't see it as a file. It stays inline if this is lowered or turned
+off later, until the file is ingested again or deleted.
+
+Set to 0 to store all content as files.`,
+			Default:  fs.SizeSuffix(0),
+			Advanced: true,
 		}},
 	})
 }
 
 // Options defines the configuration for this backend
 type Options struct {
-	RootDirectory string `config:"root_directory"`
+	RootDirectory       string               `config:"root_directory"`
+	Distribution        string               `config:"root_distribution"`
+	DBPath              string               `config:"db_path"`
+	ReadOnly            bool                 `config:"read_only"`
+	EvictAfterRead      bool                 `config:"evict_after_read"`
+	ContentTTL          fs.Duration          `config:"content_ttl"`
+	ContentLayout       string               `config:"content_layout"`
+	Compress            string               `config:"compress"`
+	EncryptionPass      string               `config:"encryption_password"`
+	EncryptionKey       string               `config:"encryption_key_file"`
+	HashTypes           fs.CommaSepList      `config:"hash_types"`
+	ScrubInterval       fs.Duration          `config:"scrub_interval"`
+	ScrubBwLimit        fs.SizeSuffix        `config:"scrub_bwlimit"`
+	OriginRemote        string               `config:"origin_remote"`
+	ContentRemote       string               `config:"content_remote"`
+	MirrorRemote        string               `config:"mirror_remote"`
+	StoreContent        bool                 `config:"store_content"`
+	DeletePlaceholders  bool                 `config:"delete_placeholders"`
+	ShowTrash           bool                 `config:"show_trash"`
+	DeletedRetention    fs.Duration          `config:"deleted_retention"`
+	DetectRenames       bool                 `config:"detect_renames"`
+	IngestCompare       string               `config:"ingest_compare"`
+	AlwaysReingest      fs.CommaSepList      `config:"always_reingest"`
+	CaseInsensitive     bool                 `config:"case_insensitive"`
+	Normalization       string               `config:"unicode_normalization"`
+	NotifyURL           string               `config:"notify_url"`
+	OnIngestCommand     fs.SpaceSepList      `config:"on_ingest_command"`
+	OnIngestConcurrency int                  `config:"on_ingest_concurrency"`
+	OnIngestEvict       bool                 `config:"on_ingest_evict"`
+	BatchSize           int                  `config:"batch_size"`
+	BatchTimeout        fs.Duration          `config:"batch_timeout"`
+	ObjectCacheSize     int                  `config:"object_cache_size"`
+	BusyTimeout         fs.Duration          `config:"busy_timeout"`
+	MaxCacheSize        fs.SizeSuffix        `config:"max_cache_size"`
+	Quota               fs.CommaSepList      `config:"quota"`
+	QuotaAction         string               `config:"quota_action"`
+	MinFreeSpace        fs.SizeSuffix        `config:"min_free_space"`
+	FreeAction          string               `config:"free_space_action"`
+	Enc                 encoder.MultiEncoder `config:"encoding"`
+	WindowsNames        bool                 `config:"windows_names"`
+	MaxNameLength       int                  `config:"max_name_length"`
+	MaterializeLinks    bool                 `config:"materialize_links"`
+	AuditLog            bool                 `config:"audit_log"`
+	QuietOps            bool                 `config:"quiet_ops"`
+	RecoverOnStart      bool                 `config:"recover_on_start"`
+	DurableWrites       bool                 `config:"durable_writes"`
+	NoPreAllocate       bool                 `config:"no_preallocate"`
+	MaxFileSize         fs.SizeSuffix        `config:"max_file_size"`
+	MaxFileSizeAction   string               `config:"max_file_size_action"`
+	IngestBwLimit       fs.SizeSuffix        `config:"ingest_bwlimit"`
+	IngestFilesPerSec   float64              `config:"ingest_files_per_second"`
+	MaxConcurrentWrites int                  `config:"max_concurrent_writes"`
+	CopyBufferSize      fs.SizeSuffix        `config:"copy_buffer_size"`
+	LinkLocal           string               `config:"link_local"`
+	CatalogBackup       string               `config:"catalog_backup"`
+	CatalogBackupEvery  fs.Duration          `config:"catalog_backup_interval"`
+	CatalogBackupKeep   int                  `config:"catalog_backup_keep"`
+	KeepVersions        int                  `config:"keep_versions"`
+	At                  fs.Time              `config:"at"`
+	PriorityRules       fs.CommaSepList      `config:"priority_rules"`
+	Overlay             bool                 `config:"overlay"`
+	EvictedRead         string               `config:"evicted_read"`
+	DeletionMode        string               `config:"deletion_mode"`
+	MaintenanceInterval fs.Duration          `config:"maintenance_interval"`
+	GCInterval          fs.Duration          `config:"gc_interval"`
+	CheckpointInterval  fs.Duration          `config:"checkpoint_interval"`
+	StartupCheck        string               `config:"startup_check"`
+	DBCheck             string               `config:"db_check"`
+	DBRecover           string               `config:"db_recover"`
+	AutoVacuum          bool                 `config:"auto_vacuum"`
+	AnalyzeInterval     fs.Duration          `config:"analyze_interval"`
+	DBPragmas           fs.CommaSepList      `config:"db_pragmas"`
+	AsyncDelete         bool                 `config:"async_delete"`
+	Namespace           string               `config:"namespace"`
+	IngestInclude       fs.CommaSepList      `config:"ingest_include"`
+	IngestExclude       fs.CommaSepList      `config:"ingest_exclude"`
+	IngestMinAge        fs.Duration          `config:"ingest_min_age"`
+	IngestMaxAge        fs.Duration          `config:"ingest_max_age"`
+	DuplicateWindow     fs.Duration          `config:"duplicate_window"`
+	QuarantineCorrupt   bool                 `config:"quarantine_corrupt"`
+	VirtualViews        bool                 `config:"virtual_views"`
+	CacheMaxSize        fs.SizeSuffix        `config:"cache_max_size"`
+	CacheHeadBytes      fs.SizeSuffix        `config:"cache_head_bytes"`
+	ChunkSize           fs.SizeSuffix        `config:"chunk_size"`
+	ResumePartial       fs.Duration          `config:"resume_partial"`
+	EvictionPolicy      string               `config:"eviction_policy"`
+	ListChangedSince    string               `config:"list_changed_since"`
+	Delta               bool                 `config:"delta"`
+	HardDelete          bool                 `config:"hard_delete"`
+	RetentionPeriod     fs.Duration          `config:"retention_period"`
+	LockedTimeout       fs.Duration          `config:"locked_timeout"`
+	IngestJournal       bool                 `config:"ingest_journal"`
+	ModifyWindow        fs.Duration          `config:"modify_window"`
+	MaintenanceSchedule string               `config:"maintenance_schedule"`
+	ConflictPolicy      string               `config:"conflict_policy"`
+	ContentRouting      fs.CommaSepList      `config:"content_routing"`
+	TierMaxSize         fs.CommaSepList      `config:"tier_max_size"`
+	InlineMaxSize       fs.SizeSuffix        `config:"inline_max_size"`
 }
 
+// Values for the quota_action and free_space_action options
+const (
+	limitActionError = "error"
+	limitActionEvict = "evict"
+)
+
+// Values for the evicted_read option
+const (
+	evictedReadFetch    = "fetch"
+	evictedReadNotFound = "not_found"
+	evictedReadError    = "error"
+)
+
+// Values for the deletion_mode option
+const (
+	deletionHidden      = "hidden"
+	deletionPlaceholder = "placeholder"
+	deletionZeroByte    = "zero-byte"
+)
+
 // Fs represents the virtual filesystem
 type Fs struct {
-	name     string       // name of this remote
-	root     string       // the path we are working on
-	opt      Options      // options
-	features *fs.Features // optional features
-	db       *sql.DB      // SQLite database connection
-	dbLock   sync.RWMutex // read-write lock for database operations
+	name      string       // name of this remote
+	root      string       // the path we are working on, in the namespace
+	namespace string       // top level directory holding the files of this remote, "" if none
+	opt       Options      // options
+	features  *fs.Features // optional features
+	db        *sql.DB      // SQLite database connection
+	dbFile    string       // path of the database
+	rdb       *sql.DB      // pool of read only connections to the catalog
+	pragmas   []string     // statements setting db_pragmas on each connection
+
+	bgCtx    context.Context    // cancelled to stop background tasks
+	bgCancel context.CancelFunc // stops background tasks
+	bgWG     sync.WaitGroup     // running background tasks
+	schedule *cronSchedule      // parsed maintenance_schedule, nil if not set
+
+	cacheUsed atomic.Int64 // estimate of the content bytes stored
+	cacheMu   sync.Mutex   // held while enforcing max_cache_size
+	quotas    []quota      // parsed quota option
+	blobMu    sync.Mutex   // held while blob references change
+	removals  removeQueue  // files waiting to be tombstoned together
+
+	cipher        *crypt.Cipher        // encrypts content if set
+	keyID         string               // ID of the key used by cipher
+	hashes        hash.Set             // hash types computed on ingest
+	compare       ingestCompare        // what is compared to decide whether to ingest again
+	reingest      []*regexp.Regexp     // parsed always_reingest patterns
+	ingestInclude []*regexp.Regexp     // parsed ingest_include patterns
+	ingestExclude []*regexp.Regexp     // parsed ingest_exclude patterns
+	normalize     func(string) string  // puts names in the unicode_normalization form
+	store         contentStore         // where the content files are kept
+	enc           encoder.MultiEncoder // encodes names stored under their remote path
+
+	stmts         statements          // prepared hot statements
+	replicateWake chan struct{}       // wakes the replication worker
+	deleteWake    chan struct{}       // wakes the deletion worker if async_delete is set
+	deleteSeq     atomic.Int64        // numbers the content moved aside for deletion
+	notifyWake    chan struct{}       // wakes the notifier
+	hookWake      chan struct{}       // wakes the on_ingest_command runner
+	batch         chan batchRequest   // transactions for the batcher if batch_size is set
+	objects       *objectCache        // recently used objects, nil if not caching
+	metrics       *metrics            // counters shared by remotes of this name
+	events        *eventStream        // events shared by remotes of this name
+	metricsStart  []int64             // metrics when this was made, for the summary logged at shutdown
+	bytesLimiter  *rate.Limiter       // limits ingest_bwlimit, nil if unlimited
+	filesLimiter  *rate.Limiter       // limits ingest_files_per_second, nil if unlimited
+	writes        *semaphore.Weighted // limits max_concurrent_writes, nil if unlimited
+	buffers       *sync.Pool          // buffers of copy_buffer_size to copy content with
+	priorityRules []priorityRule      // parsed priority_rules
+	routes        []route             // parsed content_routing
+	tierLimits    []*tierLimit        // parsed tier_max_size
+	changedSince  *changedSince       // parsed list_changed_since, nil if not set
+
+	touchedMu sync.Mutex          // protects touched
+	touched   map[string]struct{} // bookmarks of the directories changed
 }
 
 // Object represents a file object in the virtual filesystem
@@ -68,6 +1641,40 @@ type Object struct {
 	hash    string
 	deleted bool
 	isDir   bool
+
+	status      string    // processing lifecycle state
+	statusTime  time.Time // when status last changed
+	ingestedAt  time.Time // when the content was last ingested
+	evicted     bool      // set if the content has been removed but the metadata kept
+	lastAccess  time.Time // when the content was last opened or ingested
+	accessCount int64     // how many times the content has been opened
+
+	contentPath string // content location relative to the root directory if not the remote path
+	compression string // how the content is compressed, "" if it isn't
+	storedSize  int64  // size of the content on disk
+	keyID       string // ID of the key the content is encrypted with, "" if it isn't
+	corrupt     bool   // set if scrubbing found the content doesn't match its hashes
+
+	replStatus string    // replication state if mirror_remote is set
+	replTime   time.Time // when replication last ran
+	replError  string    // why replication last failed
+
+	fingerprint string      // what the source identified the content by when ingested, "" if unknown
+	linkTarget  string      // target of a translated symlink, "" if it isn't one
+	posix       fs.Metadata // permissions, ownership and xattrs of the source, nil if not captured
+	disk        int         // which of the root directories or tiers holds the content
+	priority    int         // processing priority, higher first
+
+	sourceRemote string // name of the remote the file was ingested from, "" if unknown
+	sourcePath   string // path of the file on sourceRemote
+	annotation   string // JSON recorded by the annotate command, "" if none
+	headSize     int64  // bytes of the start of the content kept in the catalog by cache_head_bytes
+	held         bool   // set if the hold command has put the file under legal hold
+
+	ttl    time.Duration // TTL overriding content_ttl, 0 to keep the content, if hasTTL
+	hasTTL bool          // set if the file has a TTL of its own
+
+	view string // the virtual view the file was found in, "" if none
 }
 
 // NewFs constructs an Fs from the path, container:path
@@ -80,11 +1687,38 @@ func NewFs(ctx context.Context, name, root string, m configmap.Mapper) (fs.Fs, e
 	if err != nil {
 		return nil, err
 	}
+	if opt.At.IsSet() {
+		// The past can't be changed
+		opt.ReadOnly = true
+	}
 
-	// Create root directory if it doesn't exist
-	err = os.MkdirAll(opt.RootDirectory, 0755)
+	roots, err := parseRootDirectories(name, opt.RootDirectory)
+	if err != nil {
+		return nil, err
+	}
+	opt.RootDirectory = roots[0]
+	opt.DBPath = expandPath(opt.DBPath)
+
+	// Create root directories if they don't exist
+	for _, dir := range roots {
+		err = checkRootDirectory(dir)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create root directory: %w", err)
+		}
+		if !opt.ReadOnly {
+			err = checkDirWritable(dir)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = checkOptionConflicts(opt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create root directory: %w", err)
+		return nil, err
 	}
 
 	f := &Fs{
@@ -92,288 +1726,897 @@ func NewFs(ctx context.Context, name, root string, m configmap.Mapper) (fs.Fs, e
 		root: root,
 		opt:  *opt,
 	}
+	if opt.BusyTimeout < 0 {
+		return nil, fmt.Errorf("invalid busy_timeout %v", opt.BusyTimeout)
+	}
+	if opt.LockedTimeout < 0 {
+		return nil, fmt.Errorf("invalid locked_timeout %v", opt.LockedTimeout)
+	}
+	if opt.ModifyWindow < 0 {
+		return nil, fmt.Errorf("invalid modify_window %v", opt.ModifyWindow)
+	}
+	if opt.MaintenanceSchedule != "" {
+		f.schedule, err = parseSchedule(opt.MaintenanceSchedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance_schedule: %w", err)
+		}
+	}
+	if opt.ObjectCacheSize < 0 {
+		return nil, fmt.Errorf("invalid object_cache_size %d", opt.ObjectCacheSize)
+	}
+	f.objects = newObjectCache(opt.ObjectCacheSize, f.lookupKey)
+	f.metrics = metricsFor(name)
+	f.events = eventsFor(name)
+	f.metricsStart = f.metrics.values()
+	if opt.MaxConcurrentWrites < 0 {
+		return nil, fmt.Errorf("invalid max_concurrent_writes %d", opt.MaxConcurrentWrites)
+	}
+	if opt.CopyBufferSize <= 0 {
+		return nil, fmt.Errorf("invalid copy_buffer_size %v", opt.CopyBufferSize)
+	}
+	f.newIngestLimiters()
+	f.newWriteLimiter()
+	f.newBufferPool()
+	f.quotas, err = parseQuotas(opt.Quota)
+	if err != nil {
+		return nil, err
+	}
+	f.priorityRules, err = parsePriorityRules(opt.PriorityRules)
+	if err != nil {
+		return nil, err
+	}
+	f.changedSince, err = parseChangedSince(opt.ListChangedSince)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Delta && opt.ReadOnly {
+		return nil, errors.New("delta can't be used with read_only as reading marks files processed")
+	}
+	switch opt.ContentLayout {
+	case layoutMirror, layoutCAS, layoutShard, layoutID:
+	default:
+		return nil, fmt.Errorf("invalid content_layout %q", opt.ContentLayout)
+	}
+	switch opt.ConflictPolicy {
+	case conflictOverwrite, conflictNewestWins, conflictError, conflictKeepBoth:
+	default:
+		return nil, fmt.Errorf("invalid conflict_policy %q", opt.ConflictPolicy)
+	}
+	switch opt.Compress {
+	case compressNone, compressZstd:
+	default:
+		return nil, fmt.Errorf("invalid compress %q", opt.Compress)
+	}
+	f.cipher, f.keyID, err = newContentCipher(opt)
+	if err != nil {
+		return nil, err
+	}
+	var originHashes func() (hash.Set, error)
+	if opt.OriginRemote != "" {
+		originHashes = func() (hash.Set, error) {
+			origin, err := cache.Get(ctx, opt.OriginRemote)
+			if err != nil && err != fs.ErrorIsFile {
+				return 0, fmt.Errorf("failed to open origin_remote: %w", err)
+			}
+			return origin.Hashes(), nil
+		}
+	}
+	f.hashes, err = parseHashTypes(opt.HashTypes, originHashes)
+	if err != nil {
+		return nil, err
+	}
+	f.enc = storeEncoder(opt)
+	f.normalize, err = parseNormalization(opt.Normalization)
+	if err != nil {
+		return nil, err
+	}
+	f.root = f.normalize(strings.Trim(path.Clean("/"+root), "/"))
+	if opt.Namespace != "" {
+		err = checkNamespace(opt.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		f.namespace = f.normalize(opt.Namespace)
+		f.root = path.Join(f.namespace, f.root)
+	}
+	f.compare, err = parseIngestCompare(opt.IngestCompare)
+	if err != nil {
+		return nil, err
+	}
+	f.reingest, err = parseGlobs("always_reingest", opt.AlwaysReingest)
+	if err != nil {
+		return nil, err
+	}
+	f.ingestInclude, err = parseGlobs("ingest_include", opt.IngestInclude)
+	if err != nil {
+		return nil, err
+	}
+	f.ingestExclude, err = parseGlobs("ingest_exclude", opt.IngestExclude)
+	if err != nil {
+		return nil, err
+	}
+	switch opt.Distribution {
+	case distributeHash, distributeFree:
+	default:
+		return nil, fmt.Errorf("invalid root_distribution %q", opt.Distribution)
+	}
+	f.routes, err = parseRoutes(opt.ContentRouting)
+	if err != nil {
+		return nil, err
+	}
+	f.tierLimits, err = parseTierLimits(opt.TierMaxSize, f.routes)
+	if err != nil {
+		return nil, err
+	}
+	f.store = &localStore{root: contentRoot(opt.RootDirectory)}
+	if len(roots) > 1 || len(f.routes) > 0 {
+		if opt.ContentLayout == layoutCAS || opt.ContentRemote != "" || opt.ChunkSize > 0 {
+			return nil, errors.New("several root directories or content_routing can't be used with the cas content_layout, a content_remote or chunk_size")
+		}
+		disks := &diskStore{}
+		for _, dir := range roots {
+			disks.disks = append(disks.disks, &localStore{root: contentRoot(dir)})
+		}
+		f.store = disks
+	}
+	if opt.ContentRemote != "" {
+		contentFs, err := cache.Get(ctx, opt.ContentRemote)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open content_remote: %w", err)
+		}
+		staging := filepath.Join(contentRoot(opt.RootDirectory), stagingDir)
+		err = file.MkdirAll(staging, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create staging directory: %w", err)
+		}
+		f.store = &remoteStore{f: contentFs, staging: staging}
+	}
+	for name, action := range map[string]string{"quota_action": opt.QuotaAction, "free_space_action": opt.FreeAction} {
+		switch action {
+		case limitActionError, limitActionEvict:
+		default:
+			return nil, fmt.Errorf("invalid %s %q", name, action)
+		}
+	}
+	if opt.CatalogBackup != "" && (opt.CatalogBackupEvery <= 0 || opt.CatalogBackupKeep < 1) {
+		return nil, fmt.Errorf("invalid catalog_backup_interval %v or catalog_backup_keep %d", opt.CatalogBackupEvery, opt.CatalogBackupKeep)
+	}
+	switch opt.EvictedRead {
+	case evictedReadFetch, evictedReadNotFound, evictedReadError:
+	default:
+		return nil, fmt.Errorf("invalid evicted_read %q", opt.EvictedRead)
+	}
+	switch opt.DeletionMode {
+	case deletionHidden, deletionZeroByte:
+	case deletionPlaceholder:
+		if !opt.DeletePlaceholders {
+			f.opt.DeletionMode = deletionHidden
+		}
+	default:
+		return nil, fmt.Errorf("invalid deletion_mode %q", opt.DeletionMode)
+	}
+	if opt.HardDelete {
+		// Nothing is left to show where a file was
+		f.opt.DeletionMode = deletionHidden
+	}
+	switch opt.StartupCheck {
+	case startupCheckOff, startupCheckQuick, startupCheckFull:
+	default:
+		return nil, fmt.Errorf("invalid startup_check %q", opt.StartupCheck)
+	}
+	switch opt.DBCheck {
+	case dbCheckOff, dbCheckQuick, dbCheckIntegrity:
+	default:
+		return nil, fmt.Errorf("invalid db_check %q", opt.DBCheck)
+	}
+	switch opt.DBRecover {
+	case dbRecoverOff, dbRecoverSnapshot, dbRecoverScan:
+	default:
+		return nil, fmt.Errorf("invalid db_recover %q", opt.DBRecover)
+	}
+	if opt.Overlay && opt.OriginRemote == "" {
+		return nil, errors.New("overlay needs origin_remote")
+	}
+	if opt.CacheHeadBytes > maxHeadBytes {
+		return nil, fmt.Errorf("cache_head_bytes can't be more than %v", fs.SizeSuffix(maxHeadBytes))
+	}
+	if opt.CacheHeadBytes > 0 && (opt.EncryptionPass != "" || opt.EncryptionKey != "") {
+		return nil, errors.New("cache_head_bytes can't be used with encryption as the heads are kept in the catalog")
+	}
+	if opt.KeepVersions < 0 {
+		return nil, fmt.Errorf("invalid keep_versions %d", opt.KeepVersions)
+	}
+	if opt.ChunkSize > 0 && opt.KeepVersions > 0 {
+		return nil, errors.New("chunk_size can't be used with keep_versions")
+	}
+	switch opt.LinkLocal {
+	case linkLocalOff, linkLocalReflink, linkLocalHardlink:
+	default:
+		return nil, fmt.Errorf("invalid link_local %q", opt.LinkLocal)
+	}
+	switch opt.MaxFileSizeAction {
+	case sizeActionError, sizeActionMetadata:
+	default:
+		return nil, fmt.Errorf("invalid max_file_size_action %q", opt.MaxFileSizeAction)
+	}
+	switch opt.EvictionPolicy {
+	case evictionLRU, evictionLFU:
+	default:
+		return nil, fmt.Errorf("invalid eviction_policy %q", opt.EvictionPolicy)
+	}
 	f.features = (&fs.Features{
 		CanHaveEmptyDirectories: true,
+		CaseInsensitive:         opt.CaseInsensitive,
+		ReadMetadata:            true,
+		WriteMetadata:           true,
+		UserMetadata:            true,
 	}).Fill(ctx, f)
 
 	// Initialize SQLite database
-	dbPath := path.Join(opt.RootDirectory, "virtualfs.db")
-	db, err := sql.Open("sqlite3", dbPath)
+	dbPath, err := f.dbPath()
+	if err != nil {
+		return nil, err
+	}
+	f.dbFile = dbPath
+	warnNetworkFilesystem(filepath.Dir(dbPath))
+	f.pragmas, err = parsePragmas(opt.DBPragmas)
+	if err != nil {
+		return nil, err
+	}
+	db, err := f.openDB(dbPath, false)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
+	rebuild := false
+	if opt.DBCheck != dbCheckOff {
+		db, rebuild, err = f.checkCatalog(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Writes from this process go through one connection while reads
+	// use a pool of their own, so the write ahead log lets them carry
+	// on while a long write is in progress
+	db.SetMaxOpenConns(1)
 	f.db = db
+	f.rdb, err = f.openDB(dbPath, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
 
 	// Create tables if they don't exist
 	err = f.createTables()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create tables: %w", err)
 	}
+	err = f.prepareStatements()
+	if err != nil {
+		return nil, err
+	}
+	err = f.checkDisks(len(roots))
+	if err != nil {
+		return nil, err
+	}
+	err = f.openTiers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = f.openInline(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !opt.ReadOnly {
+		err = f.moveLegacyDirs(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rebuild {
+		err = f.rebuildCatalog(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rebuild catalog: %w", err)
+		}
+	}
+	if f.namespace != "" && !opt.ReadOnly {
+		// So the top of the namespace can be listed before anything
+		// has been put in it
+		err = f.ensureDirectory(f.namespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rootErr := f.findRoot(ctx)
+	if rootErr != nil && rootErr != fs.ErrorIsFile {
+		return nil, rootErr
+	}
+	if opt.AuditLog {
+		fs.Debugf(nil, "VirtualFS: Auditing as invocation %s", auditor.invocation)
+	}
 
-	fs.Infof(nil, "VirtualFS: Successfully initialized filesystem at '%s'", opt.RootDirectory)
-	return f, nil
-}
-
-// createTables creates the necessary tables in the SQLite database
-func (f *Fs) createTables() error {
-	f.dbLock.Lock()
-	defer f.dbLock.Unlock()
-
-	_, err := f.db.Exec(`
-		CREATE TABLE IF NOT EXISTS files (
-			remote TEXT PRIMARY KEY,
-			size INTEGER,
-			mod_time DATETIME,
-			has_hash BOOLEAN,
-			hash TEXT,
-			deleted BOOLEAN,
-			is_dir BOOLEAN
-		);
-		CREATE INDEX IF NOT EXISTS idx_files_remote ON files(remote);
-		CREATE INDEX IF NOT EXISTS idx_files_deleted ON files(deleted);
-	`)
-	return err
-}
-
-// ensureDirectoryStructure ensures that all parent directories of a given path exist in the database
-func (f *Fs) ensureDirectoryStructure(remote string) error {
-	f.dbLock.Lock()
-	defer f.dbLock.Unlock()
+	if opt.StartupCheck != startupCheckOff {
+		err = f.startupCheck(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("startup check failed: %w", err)
+		}
+	}
 
-	// Split the path into parts and ensure each directory exists
-	parts := strings.Split(path.Dir(remote), "/")
-	currentPath := ""
-	tx, err := f.db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+	f.bgCtx, f.bgCancel = context.WithCancel(context.Background())
+	if opt.ReadOnly {
+		// Nothing which writes is started
+		fs.Infof(nil, "VirtualFS: Opened filesystem at '%s' read only", opt.RootDirectory)
+		return f, rootErr
 	}
-	defer tx.Rollback()
 
-	for _, part := range parts {
-		if part == "" {
+	if opt.AutoVacuum {
+		err = f.setAutoVacuum(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opt.RecoverOnStart {
+		err = f.recoverCrash(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opt.MaxCacheSize > 0 {
+		err = f.enforceCacheSize(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to enforce max_cache_size: %w", err)
+		}
+	}
+	for _, limit := range f.tierLimits {
+		if limit.disk < 0 {
 			continue
 		}
-		currentPath = path.Join(currentPath, part)
-		query := `INSERT OR IGNORE INTO files (remote, size, mod_time, has_hash, hash, deleted, is_dir) VALUES (?, 0, ?, 0, '', 0, 1)`
-		_, err := tx.Exec(query, currentPath, time.Now().Format(time.RFC3339))
+		err = f.enforceTierSize(ctx, limit)
 		if err != nil {
-			return fmt.Errorf("failed to insert directory %s: %w", currentPath, err)
+			return nil, fmt.Errorf("failed to enforce tier_max_size of %s: %w", limit.dir, err)
 		}
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+	if opt.NotifyURL != "" {
+		// Start the cursor now so changes from here on are all sent
+		_, err = f.readCursor(ctx, notifyCursor)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read notification cursor: %w", err)
+		}
+	}
+	if len(opt.OnIngestCommand) > 0 {
+		err = checkHookCommand(opt.OnIngestCommand)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.readCursor(ctx, hookCursor)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read on_ingest_command cursor: %w", err)
+		}
 	}
 
-	return nil
+	if opt.BatchSize > 1 {
+		f.startBatcher()
+	}
+	// Always run, as files can be given TTLs of their own by set-ttl at
+	// any time even without content_ttl
+	ttl := time.Duration(opt.ContentTTL)
+	if ttl <= 0 {
+		ttl = ttlCheckEvery
+	}
+	f.startMaintenance("content TTL eviction", f.maintenanceInterval(ttl), f.evictExpired)
+	if opt.DeletedRetention > 0 {
+		f.startMaintenance("deleted file expiry", f.maintenanceInterval(time.Duration(opt.DeletedRetention)), f.purgeDeleted)
+	}
+	if opt.GCInterval > 0 {
+		f.startBackground("gc", time.Duration(opt.GCInterval), nil, f.gcOrphans)
+	}
+	if opt.CheckpointInterval > 0 {
+		f.startBackground("checkpoint", time.Duration(opt.CheckpointInterval), nil, f.checkpoint)
+	}
+	if opt.AnalyzeInterval > 0 {
+		f.startBackground("analyze", time.Duration(opt.AnalyzeInterval), nil, f.analyze)
+	}
+	if opt.ScrubInterval > 0 {
+		f.startMaintenance("scrub", ttlInterval(time.Duration(opt.ScrubInterval)), f.scrubExpired)
+	}
+	if opt.MirrorRemote != "" {
+		f.replicateWake = make(chan struct{}, 1)
+		f.startBackground("replication", replicationInterval, f.replicateWake, f.replicate)
+	}
+	if opt.NotifyURL != "" {
+		f.notifyWake = make(chan struct{}, 1)
+		f.startBackground("notification", notifyInterval, f.notifyWake, f.notify)
+	}
+	if opt.CatalogBackup != "" {
+		f.startBackground("catalog backup", time.Duration(opt.CatalogBackupEvery), nil, f.backupCatalog)
+	}
+	if opt.AsyncDelete && len(f.localRoots()) > 0 {
+		f.deleteWake = make(chan struct{}, 1)
+		f.startBackground("deletion", deleteInterval, f.deleteWake, f.deleteAside)
+	}
+	if len(opt.OnIngestCommand) > 0 {
+		f.hookWake = make(chan struct{}, 1)
+		f.startBackground("on_ingest_command", hookInterval, f.hookWake, f.runHooks)
+	}
+
+	fs.Infof(nil, "VirtualFS: Successfully initialized filesystem at '%s'", opt.RootDirectory)
+	return f, rootErr
+}
+
+// ensureDirectoryStructure ensures that all parent directories of a given path exist in the database
+func (f *Fs) ensureDirectoryStructure(remote string) error {
+	return f.ensureDirectory(path.Dir(remote))
+}
+
+// ensureDirectory ensures that dir and all its parents exist in the
+// database, bringing back any which were deleted
+func (f *Fs) ensureDirectory(dir string) error {
+	// Split the path into parts and ensure each directory exists
+	parts := strings.Split(dir, "/")
+	return f.inTx(context.Background(), func(tx *sql.Tx) error {
+		currentPath := ""
+		for _, part := range parts {
+			if part == "" || part == "." {
+				continue
+			}
+			currentPath = path.Join(currentPath, part)
+			query := `INSERT INTO files (remote, size, mod_time_ns, has_hash, hash, deleted, is_dir, parent, key) VALUES (?, 0, ?, 0, '', 0, 1, ?, ?)
+				ON CONFLICT(remote) DO UPDATE SET size = 0, mod_time_ns = excluded.mod_time_ns, has_hash = 0, hash = '', deleted = 0, is_dir = 1, deleted_at = NULL
+				WHERE files.deleted = 1`
+			_, err := tx.Exec(query, currentPath, time.Now().UnixNano(), parentDir(currentPath), foldKey(currentPath))
+			if err != nil {
+				return fmt.Errorf("failed to insert directory %s: %w", currentPath, err)
+			}
+		}
+		return nil
+	})
 }
 
 // List the objects and directories in dir into entries
 func (f *Fs) List(ctx context.Context, dir string) (entries fs.DirEntries, err error) {
-	fs.Infof(nil, "VirtualFS: Listing contents of directory: %s", dir)
-	f.dbLock.RLock()
-	defer f.dbLock.RUnlock()
-
-	var query string
-	var args []interface{}
-	if dir == "" {
-		query = `SELECT remote, size, mod_time, has_hash, hash, deleted, is_dir FROM files WHERE remote NOT LIKE '%/%' AND deleted = 0`
-	} else {
-		query = `SELECT remote, size, mod_time, has_hash, hash, deleted, is_dir FROM files WHERE remote LIKE ? AND deleted = 0`
-		args = append(args, dir+"/%")
+	f.logOp(nil, "VirtualFS: Listing contents of directory: %s", dir)
+	dir = f.normalize(dir)
+	if trashDir, ok := f.trashPath(dir); ok {
+		return f.listTrash(ctx, trashDir)
+	}
+	if top, key, rest, ok := f.viewPath(dir); ok {
+		return f.listView(ctx, top, key, rest)
+	}
+	if dir == "" && f.showViews() {
+		entries = append(entries, fs.NewDir(byStateDir, time.Time{}), fs.NewDir(byTagDir, time.Time{}))
+	}
+	if dir == "" && f.showTrash() {
+		found, err := f.hasTrash(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			entries = append(entries, fs.NewDir(trashDir, time.Time{}))
+		}
+	}
+	if f.opt.At.IsSet() {
+		return f.listAt(ctx, f.absPath(dir))
+	}
+	dir, err = f.resolveCase(ctx, f.absPath(dir))
+	if err != nil {
+		return nil, err
 	}
 
-	rows, err := f.db.Query(query, args...)
+	changed, err := f.changedIn(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	epoch := f.objects.epoch()
+	rows, err := f.stmts.listDir.QueryContext(ctx, dir)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	var dirs []*fs.Dir
 	for rows.Next() {
-		var o Object
-		var modTime string
-		err := rows.Scan(&o.remote, &o.size, &modTime, &o.hasHash, &o.hash, &o.deleted, &o.isDir)
+		o, err := f.scanObject(rows)
 		if err != nil {
 			return nil, err
 		}
-		o.fs = f
-		o.modTime, _ = time.Parse(time.RFC3339, modTime)
-		if dir == "" || path.Dir(o.remote) == dir {
-			if o.isDir {
-				entries = append(entries, fs.NewDir(o.remote, o.modTime))
-			} else {
-				entries = append(entries, &o)
+		if o.isDir {
+			d := fs.NewDir(f.relPath(o.remote), o.modTime)
+			dirs = append(dirs, d)
+			entries = append(entries, d)
+		} else {
+			f.objects.put(o, epoch)
+			if f.hideEvicted(o) || f.hideCorrupt(o) {
+				continue
 			}
+			if _, ok := changed[o.remote]; (changed != nil && !ok) || f.hideProcessed(o) {
+				continue
+			}
+			entries = append(entries, o)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(dirs) > 0 {
+		totals, err := f.dirTotals(ctx, dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to total directory sizes: %w", err)
+		}
+		for _, d := range dirs {
+			total := totals[f.absPath(d.Remote())]
+			d.SetSize(total.size).SetItems(total.items)
+		}
+	}
+
+	// An empty listing may be of a directory which doesn't exist
+	if len(entries) == 0 && dir != "" {
+		var found bool
+		err = f.rdb.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE remote = ? AND is_dir = 1 AND deleted = 0)`, dir).Scan(&found)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			f.logOp(nil, "VirtualFS: Directory not found: %s", dir)
+			return nil, fs.ErrorDirNotFound
 		}
 	}
 
-	fs.Infof(nil, "VirtualFS: Listed %d entries in directory: %s", len(entries), dir)
-	return entries, rows.Err()
+	f.logOp(nil, "VirtualFS: Listed %d entries in directory: %s", len(entries), dir)
+	return entries, nil
 }
 
 // NewObject finds the Object at remote
 func (f *Fs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
-	f.dbLock.RLock()
-	defer f.dbLock.RUnlock()
-
-	query := `SELECT size, mod_time, has_hash, hash, deleted, is_dir FROM files WHERE remote = ?`
-	var o Object
-	var modTime string
-	err := f.db.QueryRow(query, remote).Scan(&o.size, &modTime, &o.hasHash, &o.hash, &o.deleted, &o.isDir)
-	if err == sql.ErrNoRows || o.deleted || o.isDir {
-		fs.Infof(nil, "VirtualFS: Object not found for remote %s", remote)
+	remote = f.normalize(remote)
+	if trashRemote, ok := f.trashPath(remote); ok {
+		return f.newTrashObject(ctx, trashRemote)
+	}
+	if top, key, rest, ok := f.viewPath(remote); ok {
+		return f.newViewObject(ctx, top, key, rest)
+	}
+	if f.opt.At.IsSet() {
+		return f.newObjectAt(ctx, f.absPath(remote))
+	}
+	o, err := f.findObject(ctx, f.absPath(remote))
+	if err == fs.ErrorObjectNotFound && f.opt.Overlay {
+		return f.overlayObject(ctx, f.absPath(remote))
+	}
+	if err == nil && (f.hideEvicted(o.(*Object)) || f.hideCorrupt(o.(*Object))) {
+		return nil, fs.ErrorObjectNotFound
+	}
+	return o, err
+}
+
+// findObject finds the Object at the catalog path remote
+func (f *Fs) findObject(ctx context.Context, remote string) (fs.Object, error) {
+	if o, ok := f.objects.get(remote); ok {
+		f.metrics.cacheHits.Add(1)
+		if o == nil {
+			return nil, fs.ErrorObjectNotFound
+		}
+		return o, nil
+	} else if f.objects != nil {
+		f.metrics.cacheMisses.Add(1)
+	}
+
+	lookup := f.stmts.newObject
+	if f.opt.CaseInsensitive {
+		lookup = f.stmts.newObjectKey
+	}
+	epoch := f.objects.epoch()
+	o, err := f.scanObject(lookup.QueryRowContext(ctx, f.lookupKey(remote)))
+	if err == sql.ErrNoRows || (err == nil && (o.deleted || o.isDir)) {
+		f.logOp(nil, "VirtualFS: Object not found for remote %s", remote)
+		f.objects.putMissing(remote, epoch)
 		return nil, fs.ErrorObjectNotFound
 	}
 	if err != nil {
 		fs.Errorf(nil, "VirtualFS: Error querying object for remote %s: %v", remote, err)
 		return nil, err
 	}
-	o.fs = f
-	o.remote = remote
-	o.modTime, _ = time.Parse(time.RFC3339, modTime)
-	fs.Infof(nil, "VirtualFS: Object found for remote %s", remote)
-	return &o, nil
+	f.logOp(nil, "VirtualFS: Object found for remote %s", remote)
+	f.objects.put(o, epoch)
+	return o, nil
 }
 
 // Put the object
 func (f *Fs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
-	remote := src.Remote()
-	fs.Infof(nil, "VirtualFS: Put called for remote %s", remote)
+	return f.put(ctx, in, src, nil, options)
+}
 
-	existingObj, err := f.NewObject(ctx, remote)
+// put is Put with the content of src written to written already if it
+// is set, as it is by a multi-stream upload, in which case in is unused
+func (f *Fs) put(ctx context.Context, in io.Reader, src fs.ObjectInfo, written *content, options []fs.OpenOption) (fs.Object, error) {
+	remote := f.normalize(src.Remote())
+	f.logOp(nil, "VirtualFS: Put called for remote %s", remote)
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	if _, ok := f.trashPath(remote); ok {
+		return nil, errInTrash
+	}
+	if _, _, _, ok := f.viewPath(remote); ok {
+		return nil, errInView
+	}
+	remote = f.absPath(remote)
+	if isInternal(remote) {
+		return nil, errReserved
+	}
+
+	existingObj, err := f.findObject(ctx, remote)
 	if err != nil && err != fs.ErrorObjectNotFound {
 		return nil, err
 	}
 
-	shouldUpdate := true
+	if f.ingestFiltered(ctx, remote, src) {
+		if err == nil {
+			return existingObj, nil
+		}
+		return f.droppedObject(ctx, remote, src), nil
+	}
+	if err == nil && !existingObj.(*Object).changedFrom(ctx, src) {
+		f.logOp(f, "Skipping identical file: %s", remote)
+		f.countSkipped(ctx, src)
+		return existingObj, nil
+	}
 	if err == nil {
-		shouldUpdate = false
-		if src.Size() != existingObj.Size() {
-			shouldUpdate = true
-		} else if !src.ModTime(ctx).Equal(existingObj.ModTime(ctx)) {
-			shouldUpdate = true
-		} else {
-			srcSupportsMD5 := src.Fs().Hashes().Contains(hash.MD5) && f.Hashes().Contains(hash.MD5)
-			if srcSupportsMD5 {
-				hashSrc, _ := src.Hash(ctx, hash.MD5)
-				if hashSrc != existingObj.(*Object).hash {
-					shouldUpdate = true
-				}
-			}
+		skip, err := existingObj.(*Object).skipDuplicate(ctx, src)
+		if err != nil || skip {
+			return existingObj, err
 		}
-
-		if !shouldUpdate {
-			fs.Infof(f, "Skipping identical file: %s", remote)
-			return existingObj, nil
+		err = existingObj.(*Object).checkChangeable()
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	filePath := f.fullPath(remote)
+	f.logOp(nil, "VirtualFS: Put called for remote %s", remote)
 
-	fs.Infof(nil, "VirtualFS: Put called for remote %s", remote)
-
-	// Ensure directory structure exists in the database
-	err = f.ensureDirectoryStructure(remote)
-	if err != nil {
-		return nil, fmt.Errorf("failed to ensure directory structure: %w", err)
+	// Write to the existing row however its name is spelt
+	exists := err == nil
+	if exists {
+		remote = existingObj.(*Object).remote
+	} else {
+		remote, err = f.resolveCase(ctx, remote)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Create parent directories in filesystem
-	err = os.MkdirAll(path.Dir(filePath), 0755)
+	o, err := f.ingest(ctx, remote, in, src, written, options)
 	if err != nil {
 		return nil, err
 	}
+	if exists {
+		f.metrics.reingested.Add(1)
+	} else {
+		f.metrics.ingested.Add(1)
+	}
+	f.events.add(eventIngest, o.remote, o.size)
+	return o, nil
+}
 
-	outFile, err := os.Create(filePath)
+// ingest stores the content read from in at remote, or that written
+// already if it is set, and records it in the catalog, returning the
+// new Object
+//
+// If --metadata is in use the permissions, ownership and xattrs of src
+// are captured too.
+func (f *Fs) ingest(ctx context.Context, remote string, in io.Reader, src fs.ObjectInfo, written *content, options []fs.OpenOption) (*Object, error) {
+	meta, err := fs.GetMetadataOptions(ctx, f, src, options)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	modTime := src.ModTime(ctx)
+	if v, ok := meta["mtime"]; ok {
+		// The mtime in the metadata takes precedence
+		modTime, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse metadata mtime: %w", err)
+		}
+	}
+	ttl, hasTTL := meta[ttlMetadataKey]
+	if hasTTL {
+		if _, _, err = parseTTL(ttl); err != nil {
+			return nil, fmt.Errorf("failed to parse metadata %s: %w", ttlMetadataKey, err)
+		}
 	}
-	defer outFile.Close()
 
-	// Compute hash while copying
-	multiHasher, err := hash.NewMultiHasherTypes(hash.NewHashSet(hash.MD5))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create multi hasher: %w", err)
+	// What the file was before writing, to tell if another upload
+	// commits to it first
+	var base string
+	if f.opt.ConflictPolicy != conflictOverwrite {
+		base, err = rowVersion(ctx, f.rdb, remote)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read catalog: %w", err)
+		}
 	}
-	teeReader := io.TeeReader(in, multiHasher)
 
-	// Copy the content and compute hash
-	size, err := io.Copy(outFile, teeReader)
+	// Ensure directory structure exists in the database
+	err = f.ensureDirectoryStructure(remote)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to ensure directory structure: %w", err)
+	}
+
+	c := written
+	var renamed *Object
+	if c == nil && f.opt.DetectRenames {
+		c, renamed = f.renamedContent(ctx, remote, src)
+	}
+	var link *linkCapture
+	if isLinkName(remote) {
+		link = &linkCapture{}
+		in = io.TeeReader(in, link)
+	}
+	if c == nil && f.headOnly(src.Size()) {
+		c, err = f.headContent(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+	} else if c == nil {
+		c, err = f.writeContent(ctx, remote, in, src.Size(), f.localSource(ctx, src), src)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Get the computed hash
-	hashSum := multiHasher.Sums()[hash.MD5]
-	hasHash := hashSum != ""
+	now := time.Now()
+	o := &Object{
+		fs:          f,
+		remote:      remote,
+		size:        c.size,
+		modTime:     modTime,
+		hasHash:     c.md5 != "",
+		hash:        c.md5,
+		deleted:     false,
+		isDir:       false,
+		status:      statusPending,
+		statusTime:  now,
+		ingestedAt:  now,
+		lastAccess:  now,
+		evicted:     c.discarded,
+		contentPath: c.path,
+		compression: c.compression,
+		storedSize:  c.storedSize,
+		keyID:       c.keyID,
+		disk:        c.disk,
+		headSize:    int64(len(c.head)),
+		fingerprint: originFingerprint(ctx, src),
+		posix:       posixMetadata(meta),
+	}
+	o.sourceRemote, o.sourcePath = sourceOf(src)
+	if renamed != nil {
+		// Carry the processing state over from the old name
+		o.status = renamed.status
+		o.statusTime = renamed.statusTime
+		if link != nil {
+			o.linkTarget = renamed.linkTarget
+		}
+	} else if link != nil {
+		o.linkTarget = link.target()
+	}
 
 	// Create or update metadata in database
-	f.dbLock.Lock()
-	defer f.dbLock.Unlock()
-
-	query := `INSERT OR REPLACE INTO files (remote, size, mod_time, has_hash, hash, deleted, is_dir) VALUES (?, ?, ?, ?, ?, ?, ?)`
-	_, err = f.db.Exec(query, remote, size, src.ModTime(ctx).Format(time.RFC3339), hasHash, hashSum, false, false)
-	if err != nil {
+	c.check = f.conflictCheck(o, base)
+	err = f.commitContent(ctx, o, c)
+	if errors.Is(err, errConflictOlder) {
+		fs.Infof(nil, "VirtualFS: Not replacing %s written by another upload as it is newer", remote)
+		existing, err := f.findObject(ctx, remote)
+		if err != nil {
+			return nil, err
+		}
+		return existing.(*Object), nil
+	} else if err != nil {
 		return nil, err
 	}
+	// keep-both may have renamed the file
+	remote = o.remote
+	if hasTTL {
+		_, err = f.setTTL(ctx, []string{remote}, ttl)
+		if err != nil {
+			return nil, err
+		}
+		o.ttl, o.hasTTL, _ = parseTTL(ttl)
+	} else {
+		// A file uploaded again keeps its TTL
+		var kept sql.NullInt64
+		err = f.rdb.QueryRowContext(ctx, `SELECT ttl_ns FROM files WHERE remote = ?`, remote).Scan(&kept)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TTL: %w", err)
+		}
+		o.ttl, o.hasTTL = time.Duration(kept.Int64), kept.Valid
+	}
 
-	// Return object
-	return &Object{
-		fs:      f,
-		remote:  remote,
-		size:    size,
-		modTime: src.ModTime(ctx),
-		hasHash: hasHash,
-		hash:    hashSum,
-		deleted: false,
-		isDir:   false,
-	}, nil
+	if link != nil {
+		f.materializeLink(remote, o.linkTarget)
+	}
+	f.afterChange(remote)
+	f.afterIngest(ctx, o)
+	return o, nil
 }
 
 // Mkdir creates the container if it doesn't exist
 func (f *Fs) Mkdir(ctx context.Context, dir string) error {
-	fs.Infof(nil, "VirtualFS: Mkdir called for directory %s", dir)
-	dirPath := f.fullPath(dir)
-	err := os.MkdirAll(dirPath, 0755)
+	f.logOp(nil, "VirtualFS: Mkdir called for directory %s", dir)
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
+	dir, err := f.resolveCase(ctx, f.absPath(f.normalize(dir)))
+	if err != nil {
+		return err
+	}
+	if isInternal(dir) {
+		return errReserved
+	}
+	err = f.store.mkdir(ctx, f.storePath(dir))
 	if err != nil {
 		return err
 	}
 
-	return f.ensureDirectoryStructure(dir)
+	return f.ensureDirectory(dir)
 }
 
 // Rmdir removes a directory if it's empty
 func (f *Fs) Rmdir(ctx context.Context, dir string) error {
-	fs.Infof(nil, "VirtualFS: Rmdir called for directory %s", dir)
-	dirPath := f.fullPath(dir)
-	err := os.Remove(dirPath)
-	if os.IsNotExist(err) {
-		return fs.ErrorDirNotFound
+	f.logOp(nil, "VirtualFS: Rmdir called for directory %s", dir)
+	if err := f.checkWritable(); err != nil {
+		return err
 	}
+	dir, err := f.resolveCase(ctx, f.absPath(f.normalize(dir)))
 	if err != nil {
 		return err
 	}
 
-	f.dbLock.Lock()
-	defer f.dbLock.Unlock()
-
-	// Check if the directory is empty in the database
-	query := `SELECT COUNT(*) FROM files WHERE remote LIKE ? AND remote != ? AND deleted = 0`
+	// Check the directory is empty in the catalog before the store is touched
 	var count int
-	err = f.db.QueryRow(query, dir+"/%", dir).Scan(&count)
+	err = f.rdb.QueryRowContext(ctx, `SELECT COUNT(*) FROM files WHERE substr(remote, 1, ?) = ? AND deleted = 0`, len(dir)+1, dir+"/").Scan(&count)
 	if err != nil {
 		return err
 	}
-
 	if count > 0 {
-		return fmt.Errorf("directory not empty")
+		return fs.ErrorDirectoryNotEmpty
 	}
 
-	// Remove the directory from the database
-	query = `DELETE FROM files WHERE remote = ? AND is_dir = 1`
-	_, err = f.db.Exec(query, dir)
-	return err
+	err = f.removePlaceholders(ctx, dir)
+	if err != nil {
+		return err
+	}
+	err = f.store.rmdir(ctx, f.storePath(dir))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return f.inTx(ctx, func(tx *sql.Tx) error {
+		return f.removeDir(ctx, tx, dir, now)
+	})
+}
+
+// DirSetModTime sets the modification time of the directory dir,
+// returning fs.ErrorDirNotFound if it isn't in the catalog
+func (f *Fs) DirSetModTime(ctx context.Context, dir string, modTime time.Time) error {
+	f.logOp(nil, "VirtualFS: DirSetModTime called for directory %s", dir)
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
+	dir, err := f.resolveCase(ctx, f.absPath(f.normalize(dir)))
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		// The top of the catalog has no row to keep it in
+		return nil
+	}
+	return f.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE files SET mod_time_ns = ? WHERE remote = ? AND is_dir = 1 AND deleted = 0`, modTime.UnixNano(), dir)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err == nil && n == 0 {
+			err = fs.ErrorDirNotFound
+		}
+		return err
+	})
 }
 
 // Name returns the name of the remote
@@ -383,7 +2626,7 @@ func (f *Fs) Name() string {
 
 // Root returns the root of the remote
 func (f *Fs) Root() string {
-	return f.root
+	return f.rootPath()
 }
 
 // String converts this Fs to a string
@@ -391,14 +2634,24 @@ func (f *Fs) String() string {
 	return fmt.Sprintf("Virtual Filesystem at '%s'", f.opt.RootDirectory)
 }
 
-// Precision returns the precision of the remote
+// Precision returns the precision of the remote, modify_window if it
+// is set
 func (f *Fs) Precision() time.Duration {
+	if f.opt.ModifyWindow > 0 {
+		return time.Duration(f.opt.ModifyWindow)
+	}
 	return time.Nanosecond
 }
 
 // Hashes returns the supported hash types
 func (f *Fs) Hashes() hash.Set {
-	return hash.Set(hash.MD5)
+	return f.hashes
+}
+
+// DirCacheFlush drops the files cached from the catalog, so changes to
+// it made by other programs are seen by the next lookup
+func (f *Fs) DirCacheFlush() {
+	f.objects.clear()
 }
 
 // Features returns the optional features of this Fs
@@ -406,9 +2659,51 @@ func (f *Fs) Features() *fs.Features {
 	return f.features
 }
 
-// fullPath returns the full path for a given remote path
-func (f *Fs) fullPath(remote string) string {
-	return path.Join(f.opt.RootDirectory, remote)
+// dbName is the name of the catalog database in the root directory
+const dbName = "virtualfs.db"
+
+// dbPath returns the path of the catalog database, making the
+// directory it is in if db_path is set
+func (f *Fs) dbPath() (string, error) {
+	inRoot := filepath.Join(f.opt.RootDirectory, dbName)
+	if f.opt.DBPath == "" {
+		return inRoot, nil
+	}
+	err := os.MkdirAll(filepath.Dir(f.opt.DBPath), 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create db_path directory: %w", err)
+	}
+	if _, err := os.Stat(f.opt.DBPath); os.IsNotExist(err) {
+		if _, err := os.Stat(inRoot); err == nil {
+			fs.Logf(nil, "VirtualFS: Starting a new catalog at %s, the one in the root directory is not used - move it there to keep it", f.opt.DBPath)
+		}
+	}
+	return f.opt.DBPath, nil
+}
+
+// internalDir is the directory under each root directory holding what
+// belongs to the backend itself, which no remote path can be stored in
+const internalDir = ".virtualfs"
+
+// errReserved is returned when trying to store a file where the
+// backend keeps its own files
+var errReserved = errors.New("paths in " + internalDir + " are reserved for the backend")
+
+// isInternal returns true if rel, a slash separated path relative to
+// the root directory, is in internalDir
+func isInternal(rel string) bool {
+	first, _, _ := strings.Cut(rel, "/")
+	return first == internalDir
+}
+
+// isReserved returns true if rel, a slash separated path relative to
+// the root directory, belongs to the backend itself rather than to
+// the content of a remote file
+func isReserved(rel string) bool {
+	if isInternal(rel) {
+		return true
+	}
+	return rel == dbName || strings.HasPrefix(rel, dbName+"-")
 }
 
 // ===== Object Methods =====
@@ -420,20 +2715,26 @@ func (o *Object) Fs() fs.Info {
 
 // Remote returns the remote path
 func (o *Object) Remote() string {
-	if o.deleted {
-		return o.remote + ".delete"
+	if o.view != "" {
+		return path.Join(o.view, o.remote)
 	}
-	return o.remote
+	if o.deleted && o.fs.showTrash() {
+		return path.Join(trashDir, o.remote)
+	}
+	return o.fs.relPath(o.remote)
 }
 
 // String returns a string representation of the object
 func (o *Object) String() string {
+	if o == nil {
+		return "<nil>"
+	}
 	return o.Remote()
 }
 
 // ModTime returns the modification time of the object
 func (o *Object) ModTime(ctx context.Context) time.Time {
-	fs.Infof(nil, "VirtualFS: Getting mod time %v for remote %s", o.modTime, o.remote)
+	o.fs.logOp(nil, "VirtualFS: Getting mod time %v for remote %s", o.modTime, o.remote)
 	return o.modTime
 }
 
@@ -443,142 +2744,211 @@ func (o *Object) Size() int64 {
 	if o.deleted {
 		size = 0
 	}
-	fs.Infof(nil, "VirtualFS: Getting size %d for remote %s", size, o.remote)
+	o.fs.logOp(nil, "VirtualFS: Getting size %d for remote %s", size, o.remote)
 	return size
 }
 
-// Hash returns the MD5 hash of the object
+// Hash returns the requested hash of the object
 func (o *Object) Hash(ctx context.Context, t hash.Type) (string, error) {
-	if t != hash.MD5 {
+	if !o.fs.hashes.Contains(t) {
 		return "", hash.ErrUnsupported
 	}
+	if o.deleted {
+		return "", nil
+	}
+	if t != hash.MD5 {
+		sum, err := o.fs.lookupHash(ctx, o.remote, t)
+		if err != nil || sum != "" {
+			return sum, err
+		}
+		return o.computeHash(ctx, t)
+	}
 	if o.hasHash {
-		fs.Infof(nil, "VirtualFS: Getting hash %v for remote %s", o.hash, o.remote)
+		o.fs.logOp(nil, "VirtualFS: Getting hash %v for remote %s", o.hash, o.remote)
 		return o.hash, nil
 	}
-	fs.Infof(nil, "VirtualFS: No hash available for remote %s", o.remote)
-	return "", nil
+	return o.computeHash(ctx, t)
 }
 
 // Open opens the file for reading
 func (o *Object) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadCloser, error) {
-	return os.Open(o.fs.fullPath(o.remote))
+	if o.deleted {
+		// Deleted files in the trash are empty
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if o.linkTarget != "" {
+		// The catalog holds all of a translated symlink
+		return readRange(io.NopCloser(strings.NewReader(o.linkTarget)), int64(len(o.linkTarget)), options)
+	}
+	if err := o.checkPastContent(); err != nil {
+		return nil, err
+	}
+	if in, ok, err := o.openHead(ctx, options); ok || err != nil {
+		return in, err
+	}
+	if o.evicted && o.fs.opt.EvictedRead == evictedReadError {
+		return nil, fserrors.NoRetryError(fmt.Errorf("%s: %w as it is evicted", o.remote, errNoContent))
+	}
+	partial := isPartialRead(options)
+	var in io.ReadCloser
+	var err error
+	if o.chunked() && !o.evicted {
+		// Only the chunks the range is in are read
+		offset, limit := decodeRange(o.size, options)
+		in, err = o.openChunks(ctx, o.fs.cipher, offset, limit)
+		options = nil
+	} else {
+		in, err = o.openFetching(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !o.fs.opt.ReadOnly {
+		o.touch(ctx)
+		if o.fs.opt.EvictAfterRead && !partial && !o.held {
+			in = &onEOF{ReadCloser: in, size: o.size, done: func() { o.evictAfterRead(ctx) }}
+		}
+		if o.fs.opt.Delta && o.status == statusPending && !partial {
+			in = &onEOF{ReadCloser: in, size: o.size, done: func() { o.markRead(ctx) }}
+		}
+	}
+	return readRange(in, o.size, options)
+}
+
+// readRange returns the part of in, which is size bytes long, asked
+// for by the Range or Seek in options. Plain content in a local
+// directory is seeked in, so reads at random offsets like those of
+// rclone mount don't read everything before them.
+func readRange(in io.ReadCloser, size int64, options []fs.OpenOption) (io.ReadCloser, error) {
+	offset, limit := decodeRange(size, options)
+	if file, ok := in.(*os.File); ok && offset > 0 {
+		_, err := file.Seek(offset, io.SeekStart)
+		if err != nil {
+			_ = in.Close()
+			return nil, err
+		}
+	} else if offset > 0 {
+		_, err := io.CopyN(io.Discard, in, offset)
+		if err != nil && err != io.EOF {
+			_ = in.Close()
+			return nil, err
+		}
+	}
+	if limit >= 0 {
+		return readers.NewLimitedReadCloser(in, limit), nil
+	}
+	return in, nil
+}
+
+// decodeRange returns the offset and length, -1 for everything after
+// it, of the part of content size bytes long asked for by options
+func decodeRange(size int64, options []fs.OpenOption) (offset, limit int64) {
+	offset, limit = 0, -1
+	for _, option := range options {
+		switch x := option.(type) {
+		case *fs.RangeOption:
+			offset, limit = x.Decode(size)
+		case *fs.SeekOption:
+			offset, limit = x.Offset, -1
+		default:
+			if option.Mandatory() {
+				fs.Logf(nil, "VirtualFS: Unsupported mandatory option: %v", option)
+			}
+		}
+	}
+	return offset, limit
 }
 
 // Remove removes the object
 func (o *Object) Remove(ctx context.Context) error {
-	fs.Infof(nil, "VirtualFS: Remove called for remote %s", o.remote)
-
-	// Remove content
-	err := os.Remove(o.fs.fullPath(o.remote))
-	if err != nil && !os.IsNotExist(err) {
+	o.fs.logOp(nil, "VirtualFS: Remove called for remote %s", o.remote)
+	if err := o.fs.checkWritable(); err != nil {
 		return err
 	}
-
-	// Create a .delete placeholder file to indicate deletion
-	deletePath := o.fs.fullPath(o.remote + ".delete")
-	deleteFile, err := os.Create(deletePath)
-	if err != nil {
-		return fmt.Errorf("failed to create delete placeholder: %w", err)
+	if o.deleted {
+		return errInTrash
+	}
+	if o.view != "" {
+		return errInView
+	}
+	if err := o.checkChangeable(); err != nil {
+		return err
 	}
-	deleteFile.Close()
-
-	// Update metadata in database
-	o.fs.dbLock.Lock()
-	defer o.fs.dbLock.Unlock()
 
-	query := `UPDATE files SET deleted = 1, mod_time = ? WHERE remote = ?`
-	_, err = o.fs.db.Exec(query, time.Now().Format(time.RFC3339), o.remote)
+	err := o.writeDeletePlaceholder(ctx)
 	if err != nil {
 		return err
 	}
-
-	o.deleted = true
-
-	return nil
+	return o.fs.removeQueued(ctx, o)
 }
 
 // SetModTime sets the modification time of the object
 func (o *Object) SetModTime(ctx context.Context, modTime time.Time) error {
-	fs.Infof(nil, "VirtualFS: SetModTime called for remote %s", o.remote)
-	o.fs.dbLock.Lock()
-	defer o.fs.dbLock.Unlock()
+	o.fs.logOp(nil, "VirtualFS: SetModTime called for remote %s", o.remote)
+	if err := o.fs.checkWritable(); err != nil {
+		return err
+	}
+	if o.deleted {
+		return errInTrash
+	}
+	if o.view != "" {
+		return errInView
+	}
+	if err := o.checkChangeable(); err != nil {
+		return err
+	}
 
-	query := `UPDATE files SET mod_time = ? WHERE remote = ?`
-	_, err := o.fs.db.Exec(query, modTime.Format(time.RFC3339), o.remote)
+	err := o.fs.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `UPDATE files SET mod_time_ns = ? WHERE remote = ?`, modTime.UnixNano(), o.remote)
+		if err != nil {
+			return err
+		}
+		return o.fs.journalChange(ctx, tx, o.remote, eventUpdate, o.size, o.hash)
+	})
 	if err != nil {
 		return err
 	}
+	o.fs.objects.remove(o.remote)
 	o.modTime = modTime
+	o.fs.afterChange(o.remote)
 	return nil
 }
 
 // Update updates the object with new content
 func (o *Object) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) error {
-	fs.Infof(nil, "VirtualFS: Update called for remote %s", o.remote)
-
-	shouldUpdate := true
-	if o.size == src.Size() {
-		srcSupportsMD5 := src.Fs().Hashes().Contains(hash.MD5) && o.fs.Hashes().Contains(hash.MD5)
-		hashh, _ := src.Hash(ctx, hash.MD5)
-		if !srcSupportsMD5 || hashh == o.hash {
-			if !src.ModTime(ctx).Equal(o.ModTime(ctx)) {
-				shouldUpdate = false
-			}
-		}
+	o.fs.logOp(nil, "VirtualFS: Update called for remote %s", o.remote)
+	if err := o.fs.checkWritable(); err != nil {
+		return err
+	}
+	if o.deleted {
+		return errInTrash
+	}
+	if o.view != "" {
+		return errInView
 	}
 
-	if !shouldUpdate {
-		fs.Infof(o.fs, "Skipping identical file: %s", o.remote)
+	if o.fs.ingestFiltered(ctx, o.remote, src) {
 		return nil
 	}
-
-	filePath := o.fs.fullPath(o.remote)
-	err := os.MkdirAll(path.Dir(filePath), 0755)
-	if err != nil {
-		return err
+	if !o.changedFrom(ctx, src) {
+		o.fs.logOp(o.fs, "Skipping identical file: %s", o.remote)
+		o.fs.countSkipped(ctx, src)
+		return nil
 	}
-
-	outFile, err := os.Create(filePath)
-	if err != nil {
+	if skip, err := o.skipDuplicate(ctx, src); err != nil || skip {
 		return err
 	}
-	defer outFile.Close()
-
-	// Compute hash while copying
-	multiHasher, err := hash.NewMultiHasherTypes(hash.NewHashSet(hash.MD5))
-	if err != nil {
-		return fmt.Errorf("failed to create multi hasher: %w", err)
-	}
-	teeReader := io.TeeReader(in, multiHasher)
-
-	// Copy the content and compute hash
-	size, err := io.Copy(outFile, teeReader)
-	if err != nil {
+	if err := o.checkChangeable(); err != nil {
 		return err
 	}
 
-	// Get the computed hash
-	hashSum := multiHasher.Sums()[hash.MD5]
-	hasHash := hashSum != ""
-
-	// Update metadata in database
-	o.fs.dbLock.Lock()
-	defer o.fs.dbLock.Unlock()
-
-	query := `UPDATE files SET size = ?, mod_time = ?, has_hash = ?, hash = ?, deleted = 0, is_dir = 0 WHERE remote = ?`
-	_, err = o.fs.db.Exec(query, size, src.ModTime(ctx).Format(time.RFC3339), hasHash, hashSum, o.remote)
+	n, err := o.fs.ingest(ctx, o.remote, in, src, nil, options)
 	if err != nil {
 		return err
 	}
-
-	o.size = size
-	o.modTime = src.ModTime(ctx)
-	o.hasHash = hasHash
-	o.hash = hashSum
-	o.deleted = false
-	o.isDir = false
-
+	o.fs.metrics.reingested.Add(1)
+	o.fs.events.add(eventIngest, n.remote, n.size)
+	*o = *n
 	return nil
 }
 
@@ -589,7 +2959,15 @@ func (o *Object) Storable() bool {
 
 // Verify that all the interfaces are implemented correctly
 var (
-	_ fs.Fs       = (*Fs)(nil)
-	_ fs.Object   = (*Object)(nil)
-	_ fs.DirEntry = (*Object)(nil)
+	_ fs.Fs              = (*Fs)(nil)
+	_ fs.Commander       = (*Fs)(nil)
+	_ fs.DirCacheFlusher = (*Fs)(nil)
+	_ fs.DirSetModTimer  = (*Fs)(nil)
+	_ fs.Purger          = (*Fs)(nil)
+	_ fs.OpenChunkWriter = (*Fs)(nil)
+	_ fs.Object          = (*Object)(nil)
+	_ fs.Metadataer      = (*Object)(nil)
+	_ fs.SetMetadataer   = (*Object)(nil)
+	_ fs.MimeTyper       = (*Object)(nil)
+	_ fs.DirEntry        = (*Object)(nil)
 )
@@ -0,0 +1,5545 @@
+package virtualfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	_ "github.com/rclone/rclone/backend/local"
+	_ "github.com/rclone/rclone/backend/memory"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/config/obscure"
+	"github.com/rclone/rclone/fs/fserrors"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/object"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/rc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestFs makes a virtualfs in a temporary directory with the extra config given
+func newTestFs(t *testing.T, config configmap.Simple) *Fs {
+	m := configmap.Simple{
+		"root_directory": t.TempDir(),
+	}
+	for k, v := range config {
+		m[k] = v
+	}
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	f, err := NewFs(context.Background(), "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", m))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.(*Fs).Shutdown(context.Background()))
+	})
+	return f.(*Fs)
+}
+
+// putTestFile uploads contents to remote in f
+func putTestFile(t *testing.T, f *Fs, remote, contents string) fs.Object {
+	ctx := context.Background()
+	src := object.NewStaticObjectInfo(remote, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), int64(len(contents)), true, nil, nil)
+	o, err := f.Put(ctx, bytes.NewBufferString(contents), src)
+	require.NoError(t, err)
+	return o
+}
+
+// listNames returns the names of the entries in dir
+func listNames(t *testing.T, f *Fs, dir string) []string {
+	entries, err := f.List(context.Background(), dir)
+	require.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Remote())
+	}
+	return names
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "one.txt", "one")
+
+	snap, err := f.snapshot(ctx, "")
+	require.NoError(t, err)
+	assert.FileExists(t, snap)
+
+	putTestFile(t, f, "two.txt", "two")
+	assert.ElementsMatch(t, []string{"one.txt", "two.txt"}, listNames(t, f, ""))
+
+	// A user file named like a newer snapshot isn't restored
+	putTestFile(t, f, "snapshots/virtualfs-29990101-000000.000.db", "not a snapshot")
+
+	restored, err := f.restoreDB(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, snap, restored)
+	assert.Equal(t, []string{"one.txt"}, listNames(t, f, ""))
+
+	dst := filepath.Join(t.TempDir(), "backups") + "/"
+	snap, err = f.snapshot(ctx, dst)
+	require.NoError(t, err)
+	assert.FileExists(t, snap)
+
+	out, err := f.Command(ctx, "backup-db", []string{filepath.Join(t.TempDir(), "catalog.db")}, nil)
+	require.NoError(t, err)
+	assert.FileExists(t, out.(string))
+	_, err = f.Command(ctx, "backup-db", []string{"a", "b"}, nil)
+	assert.ErrorContains(t, err, "backup-db takes at most one")
+
+	_, err = f.restoreDB(ctx, filepath.Join(f.opt.RootDirectory, "one.txt"))
+	assert.Error(t, err)
+}
+
+func TestCatalogBackup(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	snapshots := func() []string {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+	f := newTestFs(t, configmap.Simple{"catalog_backup": dir, "catalog_backup_keep": "2", "catalog_backup_interval": "1h"})
+
+	// One is written at once, then only when the catalog changes
+	assert.Eventually(t, func() bool { return len(snapshots()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, f.backupCatalog(ctx))
+	assert.Len(t, snapshots(), 1)
+
+	for _, name := range []string{"a", "b"} {
+		time.Sleep(10 * time.Millisecond)
+		putTestFile(t, f, name, name)
+		require.NoError(t, f.backupCatalog(ctx))
+	}
+	names := snapshots()
+	require.Len(t, names, 2)
+
+	snap, err := openSnapshot(ctx, filepath.Join(dir, names[1]))
+	require.NoError(t, err)
+	defer func() {
+		_ = snap.Close()
+	}()
+	var count int
+	require.NoError(t, snap.QueryRowContext(ctx, `SELECT COUNT(*) FROM files WHERE is_dir = 0`).Scan(&count))
+	assert.Equal(t, 2, count)
+}
+
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "keep.txt", "keep")
+	o := putTestFile(t, f, "gone.txt", "gone")
+	require.NoError(t, o.Remove(ctx))
+	orphan := filepath.Join(f.opt.RootDirectory, "dir", "orphan.txt")
+	require.NoError(t, os.MkdirAll(filepath.Dir(orphan), 0755))
+	require.NoError(t, os.WriteFile(orphan, []byte("orphan"), 0644))
+	_, err := f.snapshot(ctx, "")
+	require.NoError(t, err)
+
+	// Recent files are left alone
+	res, err := f.gc(ctx, false, time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, res.Orphans)
+
+	res, err = f.gc(ctx, true, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dir/orphan.txt"}, res.Orphans)
+	assert.Equal(t, 1, res.Quarantined)
+	assert.NoFileExists(t, orphan)
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, quarantineDir, "dir", "orphan.txt"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "keep.txt"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "gone.txt.delete"))
+
+	require.NoError(t, os.WriteFile(orphan, []byte("orphan"), 0644))
+	res, err = f.gc(ctx, false, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Removed)
+	assert.NoFileExists(t, orphan)
+
+	// Directories named like the backend's own are ordinary content
+	for _, name := range legacyDirs {
+		putTestFile(t, f, name+"/user.txt", "user")
+		orphan = filepath.Join(f.opt.RootDirectory, name, "orphan.txt")
+		require.NoError(t, os.WriteFile(orphan, []byte("orphan"), 0644))
+	}
+	res, err = f.gc(ctx, false, 0)
+	require.NoError(t, err)
+	assert.Equal(t, len(legacyDirs), res.Removed)
+	for _, name := range legacyDirs {
+		assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, name, "orphan.txt"))
+		assert.FileExists(t, filepath.Join(f.opt.RootDirectory, name, "user.txt"))
+	}
+}
+
+func TestRecoverCrash(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "dir/live.txt", "live")
+	o := putTestFile(t, f, "dir/gone.txt", "gone")
+	require.NoError(t, o.Remove(ctx))
+
+	root := f.opt.RootDirectory
+	old := time.Now().Add(-2 * recoverMinAge)
+	leftovers := map[string]string{
+		"dir/" + incomingPrefix + "123":    "half written",
+		"dir/live.txt" + placeholderSuffix: "",
+		"dir/gone.txt":                     "gone",
+	}
+	for name, contents := range leftovers {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.WriteFile(p, []byte(contents), 0644))
+		require.NoError(t, os.Chtimes(p, old, old))
+	}
+	recent := filepath.Join(root, "dir", incomingPrefix+"456")
+	require.NoError(t, os.WriteFile(recent, []byte("still writing"), 0644))
+
+	require.NoError(t, f.recoverCrash(ctx))
+	for name := range leftovers {
+		assert.NoFileExists(t, filepath.Join(root, filepath.FromSlash(name)), name)
+	}
+	assert.FileExists(t, recent)
+	assert.FileExists(t, filepath.Join(root, "dir", "live.txt"))
+	assert.FileExists(t, filepath.Join(root, "dir", "gone.txt"+placeholderSuffix))
+
+	o, err := f.NewObject(ctx, "dir/live.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), o.Size())
+}
+
+func TestDurableWrites(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"durable_writes": "true"})
+	var synchronous int
+	require.NoError(t, f.db.QueryRowContext(ctx, `PRAGMA synchronous`).Scan(&synchronous))
+	assert.Equal(t, 2, synchronous, "FULL")
+
+	putTestFile(t, f, "dir/file.txt", "durable")
+	got, err := os.ReadFile(filepath.Join(f.opt.RootDirectory, "dir", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "durable", string(got))
+	o, err := f.NewObject(ctx, "dir/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), o.Size())
+}
+
+func TestPreAllocate(t *testing.T) {
+	ctx := context.Background()
+	for _, noPreAllocate := range []string{"false", "true"} {
+		f := newTestFs(t, configmap.Simple{"no_preallocate": noPreAllocate})
+		contents := strings.Repeat("x", 1<<20)
+		putTestFile(t, f, "big.bin", contents)
+		info, err := os.Stat(filepath.Join(f.opt.RootDirectory, "big.bin"))
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(contents)), info.Size(), noPreAllocate)
+		o, err := f.NewObject(ctx, "big.bin")
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(contents)), o.Size(), noPreAllocate)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "dir/a.txt", "a")
+	putTestFile(t, f, "dir/b.txt", "b")
+
+	pending, err := f.listByStatus(ctx, "dir", statusPending)
+	require.NoError(t, err)
+	assert.Len(t, pending, 2)
+
+	_, err = f.setStatus(ctx, []string{"dir/a.txt"}, statusClaimed)
+	require.NoError(t, err)
+	_, err = f.setStatus(ctx, []string{"dir/b.txt", "dir/a.txt"}, statusClaimed)
+	assert.ErrorContains(t, err, "can't change status from claimed to claimed")
+	entries, err := f.fileStatus(ctx, []string{"dir/b.txt"})
+	require.NoError(t, err)
+	assert.Equal(t, statusPending, entries[0].Status)
+
+	_, err = f.setStatus(ctx, []string{"dir/a.txt"}, statusProcessed)
+	require.NoError(t, err)
+	o, err := f.NewObject(ctx, "dir/a.txt")
+	require.NoError(t, err)
+	metadata, err := o.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, statusProcessed, metadata["status"])
+
+	// Re-ingesting changed content starts the lifecycle again
+	putTestFile(t, f, "dir/a.txt", "changed")
+	entries, err = f.fileStatus(ctx, []string{"dir/a.txt"})
+	require.NoError(t, err)
+	assert.Equal(t, statusPending, entries[0].Status)
+}
+
+func TestMigrateLegacySchema(t *testing.T) {
+	root := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(root, dbName))
+	require.NoError(t, err)
+	_, err = db.Exec(`
+		CREATE TABLE files (remote TEXT PRIMARY KEY, size INTEGER, mod_time DATETIME, has_hash BOOLEAN, hash TEXT, deleted BOOLEAN, is_dir BOOLEAN);
+		INSERT INTO files VALUES ('old.txt', 3, '2024-01-02T03:04:05Z', 1, 'acbd18db4cc2f85cedef654fccc4a4d8', 0, 0);
+		INSERT INTO files VALUES ('a', 0, '2024-01-02T03:04:05Z', 0, '', 0, 1);
+		INSERT INTO files VALUES ('a/b.c', 0, '2024-01-02T03:04:05Z', 0, '', 0, 1);
+		INSERT INTO files VALUES ('a/b.c/d.txt', 3, '2024-01-02T05:04:05+02:00', 1, 'acbd18db4cc2f85cedef654fccc4a4d8', 0, 0);
+	`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	f := newTestFs(t, configmap.Simple{"root_directory": root})
+	o, err := f.NewObject(context.Background(), "old.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), o.Size())
+	assert.Equal(t, statusPending, o.(*Object).status)
+	assert.ElementsMatch(t, []string{"a", "old.txt"}, listNames(t, f, ""))
+	assert.Equal(t, []string{"a/b.c/d.txt"}, listNames(t, f, "a/b.c"))
+
+	// Modification times are converted whatever their zone
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.True(t, modTime.Equal(o.ModTime(context.Background())))
+	o, err = f.NewObject(context.Background(), "a/b.c/d.txt")
+	require.NoError(t, err)
+	assert.True(t, modTime.Equal(o.ModTime(context.Background())))
+}
+
+func TestEvictAfterRead(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"evict_after_read": "true"})
+	o := putTestFile(t, f, "file.txt", "hello world")
+	contentPath := filepath.Join(f.opt.RootDirectory, "file.txt")
+
+	// A partial read leaves the content alone
+	in, err := o.Open(ctx, &fs.RangeOption{Start: 0, End: 4})
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.FileExists(t, contentPath)
+
+	in, err = o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+	require.NoError(t, in.Close())
+	assert.NoFileExists(t, contentPath)
+
+	o, err = f.NewObject(ctx, "file.txt")
+	require.NoError(t, err)
+	assert.True(t, o.(*Object).evicted)
+	assert.Equal(t, int64(11), o.Size())
+
+	// Content ingested while the file was being read is kept, even if
+	// the read is closed once its context is cancelled
+	o = putTestFile(t, f, "other.txt", "first")
+	rctx, cancel := context.WithCancel(ctx)
+	in, err = o.Open(rctx)
+	require.NoError(t, err)
+	_, err = io.ReadAll(in)
+	require.NoError(t, err)
+	putTestFile(t, f, "other.txt", "second")
+	cancel()
+	require.NoError(t, in.Close())
+	o, err = f.NewObject(ctx, "other.txt")
+	require.NoError(t, err)
+	assert.False(t, o.(*Object).evicted)
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "other.txt"))
+}
+
+func TestContentTTL(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"content_ttl": "1h"})
+	putTestFile(t, f, "old.txt", "old")
+	putTestFile(t, f, "claimed.txt", "claimed")
+	putTestFile(t, f, "new.txt", "new")
+	_, err := f.setStatus(ctx, []string{"claimed.txt"}, statusClaimed)
+	require.NoError(t, err)
+	_, err = f.db.Exec(`UPDATE files SET last_access = ? WHERE remote != 'new.txt'`, formatDBTime(time.Now().Add(-2*time.Hour)))
+	require.NoError(t, err)
+
+	require.NoError(t, f.evictExpired(ctx))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "old.txt"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "claimed.txt"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "new.txt"))
+	o, err := f.NewObject(ctx, "old.txt")
+	require.NoError(t, err)
+	assert.True(t, o.(*Object).evicted)
+}
+
+func TestMaxCacheSize(t *testing.T) {
+	f := newTestFs(t, configmap.Simple{"max_cache_size": "100B"})
+	for i, name := range []string{"a", "b", "c"} {
+		putTestFile(t, f, name, strings.Repeat("x", 40))
+		_, err := f.db.Exec(`UPDATE files SET last_access = ? WHERE remote = ?`, formatDBTime(time.Now().Add(time.Duration(i-10)*time.Minute)), name)
+		require.NoError(t, err)
+	}
+	// 120 bytes is over the limit so the oldest is evicted to reach 90
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "a"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "b"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "c"))
+	assert.Equal(t, int64(80), f.cacheUsed.Load())
+	assert.Equal(t, []string{"a", "b", "c"}, listNames(t, f, ""))
+}
+
+func TestParseQuotas(t *testing.T) {
+	quotas, err := parseQuotas(fs.CommaSepList{"ingest/camera/:50G", "logs:10k"})
+	require.NoError(t, err)
+	assert.Equal(t, []quota{{dir: "ingest/camera", limit: 50 << 30}, {dir: "logs", limit: 10 << 10}}, quotas)
+	for _, bad := range []string{"nocolon", ":10G", "dir:potato"} {
+		_, err = parseQuotas(fs.CommaSepList{bad})
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+	src := func(remote string, size int64) *object.StaticObjectInfo {
+		return object.NewStaticObjectInfo(remote, time.Now(), size, true, nil, nil)
+	}
+
+	f := newTestFs(t, configmap.Simple{"quota": "limited:10B"})
+	putTestFile(t, f, "limited/a", "12345")
+	putTestFile(t, f, "other/big", "123456789012345")
+	// Replacing a file only counts its new size
+	putTestFile(t, f, "limited/a", "123456")
+	_, err := f.Put(ctx, strings.NewReader("12345"), src("limited/b", 5))
+	assert.ErrorIs(t, err, errQuotaExceeded)
+	_, err = f.Put(ctx, strings.NewReader("12345"), src("limited/b", -1))
+	assert.ErrorIs(t, err, errQuotaExceeded)
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "limited", "b"))
+
+	f = newTestFs(t, configmap.Simple{"quota": "limited:10B", "quota_action": "evict"})
+	putTestFile(t, f, "limited/a", "123456")
+	putTestFile(t, f, "limited/b", "12345")
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "limited", "a"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "limited", "b"))
+	_, err = f.Put(ctx, strings.NewReader("12345678901"), src("limited/c", 11))
+	assert.ErrorIs(t, err, errQuotaExceeded)
+}
+
+func TestMaxFileSize(t *testing.T) {
+	ctx := context.Background()
+	src := func(remote string, size int64) *object.StaticObjectInfo {
+		return object.NewStaticObjectInfo(remote, time.Now(), size, true, nil, nil)
+	}
+
+	f := newTestFs(t, configmap.Simple{"max_file_size": "10B"})
+	putTestFile(t, f, "small", "1234567890")
+	_, err := f.Put(ctx, strings.NewReader("12345678901"), src("big", 11))
+	assert.ErrorIs(t, err, errFileTooLarge)
+	assert.True(t, fserrors.IsNoRetryError(err))
+	_, err = f.Put(ctx, strings.NewReader("12345678901"), src("stream", -1))
+	assert.ErrorIs(t, err, errFileTooLarge)
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "stream"))
+	assert.Equal(t, []string{"small"}, listNames(t, f, ""))
+
+	f = newTestFs(t, configmap.Simple{"max_file_size": "10B", "max_file_size_action": "metadata"})
+	o, err := f.Put(ctx, strings.NewReader("12345678901"), src("big", 11))
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), o.Size())
+	assert.True(t, o.(*Object).evicted)
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "big"))
+}
+
+func TestIngestRateLimits(t *testing.T) {
+	f := newTestFs(t, configmap.Simple{"ingest_files_per_second": "20"})
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		putTestFile(t, f, "file"+strconv.Itoa(i), "x")
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	// The first 100 KiB is allowed at once, the next waits a second
+	f = newTestFs(t, configmap.Simple{"ingest_bwlimit": "100Ki"})
+	start = time.Now()
+	putTestFile(t, f, "big", strings.Repeat("x", 150*1024))
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestMaxConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"max_concurrent_writes": "1"})
+
+	// Hold the only write open part way through
+	pr, pw := io.Pipe()
+	first := make(chan error)
+	go func() {
+		_, err := f.Put(ctx, pr, object.NewStaticObjectInfo("first", time.Now(), -1, true, nil, nil))
+		first <- err
+	}()
+	_, err := pw.Write([]byte("part"))
+	require.NoError(t, err)
+
+	second := make(chan error)
+	go func() {
+		_, err := f.Put(ctx, strings.NewReader("second"), object.NewStaticObjectInfo("second", time.Now(), 6, true, nil, nil))
+		second <- err
+	}()
+	select {
+	case <-second:
+		t.Fatal("second write didn't wait for the first")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, pw.Close())
+	require.NoError(t, <-first)
+	require.NoError(t, <-second)
+	assert.Equal(t, []string{"first", "second"}, listNames(t, f, ""))
+}
+
+// readSizes records the size of the largest read made of it
+type readSizes struct {
+	io.Reader
+	largest int
+}
+
+func (r *readSizes) Read(p []byte) (int, error) {
+	r.largest = max(r.largest, len(p))
+	return r.Reader.Read(p)
+}
+
+func TestCopyBufferSize(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"copy_buffer_size": "4Ki"})
+	contents := strings.Repeat("0123456789", 10000)
+	in := &readSizes{Reader: strings.NewReader(contents)}
+	_, err := f.Put(ctx, in, object.NewStaticObjectInfo("file", time.Now(), int64(len(contents)), true, nil, nil))
+	require.NoError(t, err)
+	assert.Equal(t, 4096, in.largest)
+	got, err := os.ReadFile(filepath.Join(f.opt.RootDirectory, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, contents, string(got))
+}
+
+func TestLinkLocal(t *testing.T) {
+	ctx := context.Background()
+	srcDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "file.txt"), []byte("linked"), 0644))
+	srcFs, err := fs.NewFs(ctx, srcDir)
+	require.NoError(t, err)
+
+	for _, mode := range []string{linkLocalOff, linkLocalReflink, linkLocalHardlink} {
+		f := newTestFs(t, configmap.Simple{"link_local": mode, "root_directory": filepath.Join(filepath.Dir(srcDir), mode)})
+		src, err := srcFs.NewObject(ctx, "file.txt")
+		require.NoError(t, err)
+		in, err := src.Open(ctx)
+		require.NoError(t, err)
+		o, err := f.Put(ctx, in, src)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		assert.Equal(t, int64(6), o.Size(), mode)
+		md5, err := o.Hash(ctx, hash.MD5)
+		require.NoError(t, err)
+		assert.Equal(t, "d48e37bc19b9fe2c72923c30fd7a4152", md5, mode)
+
+		stored := filepath.Join(f.opt.RootDirectory, "file.txt")
+		got, err := os.ReadFile(stored)
+		require.NoError(t, err)
+		assert.Equal(t, "linked", string(got), mode)
+		srcInfo, err := os.Stat(filepath.Join(srcDir, "file.txt"))
+		require.NoError(t, err)
+		storedInfo, err := os.Stat(stored)
+		require.NoError(t, err)
+		assert.Equal(t, mode == linkLocalHardlink, os.SameFile(srcInfo, storedInfo), mode)
+	}
+}
+
+func TestMinFreeSpace(t *testing.T) {
+	ctx := context.Background()
+	oldFreeSpace := freeSpace
+	defer func() { freeSpace = oldFreeSpace }()
+
+	// Pretend the disk is 100 bytes in size
+	var f *Fs
+	freeSpace = func(dir string) (int64, error) {
+		used, err := f.quotaUsed(ctx, "", "")
+		return 100 - used, err
+	}
+
+	f = newTestFs(t, configmap.Simple{"min_free_space": "50B"})
+	putTestFile(t, f, "a", strings.Repeat("x", 30))
+	src := object.NewStaticObjectInfo("b", time.Now(), 30, true, nil, nil)
+	_, err := f.Put(ctx, strings.NewReader(strings.Repeat("x", 30)), src)
+	assert.ErrorIs(t, err, errInsufficientSpace)
+
+	f = newTestFs(t, configmap.Simple{"min_free_space": "50B", "free_space_action": "evict"})
+	putTestFile(t, f, "a", strings.Repeat("x", 30))
+	putTestFile(t, f, "b", strings.Repeat("x", 30))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "a"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "b"))
+}
+
+func TestContentAddressable(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"content_layout": "cas"})
+	refcount := func(md5 string) (n int) {
+		err := f.db.QueryRow(`SELECT refcount FROM blobs WHERE hash = ?`, md5).Scan(&n)
+		if err == sql.ErrNoRows {
+			return 0
+		}
+		require.NoError(t, err)
+		return n
+	}
+	a := putTestFile(t, f, "a", "same")
+	b := putTestFile(t, f, "dir/b", "same")
+	sum, err := a.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	blob := filepath.Join(f.opt.RootDirectory, blobDir, sum)
+	assert.FileExists(t, blob)
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "a"))
+	assert.Equal(t, 2, refcount(sum))
+
+	in, err := b.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "same", string(data))
+
+	// Dropping one reference keeps the blob
+	require.NoError(t, a.Remove(ctx))
+	assert.FileExists(t, blob)
+	assert.Equal(t, 1, refcount(sum))
+
+	// Replacing the last reference removes it
+	putTestFile(t, f, "dir/b", "different")
+	assert.NoFileExists(t, blob)
+	assert.Equal(t, 0, refcount(sum))
+
+	b, err = f.NewObject(ctx, "dir/b")
+	require.NoError(t, err)
+	_, err = b.(*Object).evict(ctx)
+	require.NoError(t, err)
+	entries, err := os.ReadDir(filepath.Join(f.opt.RootDirectory, blobDir))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	res, err := f.gc(ctx, false, 0)
+	require.NoError(t, err)
+	assert.Empty(t, res.Orphans)
+}
+
+func TestShardedLayout(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"content_layout": "sharded"})
+	o := putTestFile(t, f, "dir/file.txt", "sharded")
+	p := shardPath("dir/file.txt")
+	assert.Regexp(t, `^shards/[0-9a-f]{2}/[0-9a-f]{2}/[0-9a-f]{32}$`, p)
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, filepath.FromSlash(p)))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "dir", "file.txt"))
+
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "sharded", string(data))
+
+	res, err := f.gc(ctx, false, 0)
+	require.NoError(t, err)
+	assert.Empty(t, res.Orphans)
+
+	require.NoError(t, o.Remove(ctx))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, filepath.FromSlash(p)))
+}
+
+func TestCompress(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"compress": "zstd"})
+	contents := strings.Repeat("compressible ", 1000)
+	putTestFile(t, f, "log.txt", contents)
+
+	o, err := f.NewObject(ctx, "log.txt")
+	require.NoError(t, err)
+	obj := o.(*Object)
+	assert.Equal(t, int64(len(contents)), obj.Size())
+	assert.Equal(t, compressZstd, obj.compression)
+	assert.Less(t, obj.storedSize, obj.Size())
+	info, err := os.Stat(filepath.Join(f.opt.RootDirectory, "log.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, obj.storedSize, info.Size())
+
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, contents, string(data))
+
+	// Compressed and uncompressed blobs of the same content are kept apart
+	f = newTestFs(t, configmap.Simple{"compress": "zstd", "content_layout": "cas"})
+	o = putTestFile(t, f, "a", contents)
+	sum, err := o.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, blobDir, sum+zstdSuffix))
+}
+
+func TestEncryption(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	contents := strings.Repeat("top secret ", 100)
+	readAll := func(o fs.Object) (string, error) {
+		in, err := o.Open(ctx)
+		if err != nil {
+			return "", err
+		}
+		data, err := io.ReadAll(in)
+		require.NoError(t, in.Close())
+		return string(data), err
+	}
+
+	for _, compress := range []string{"none", "zstd"} {
+		f := newTestFs(t, configmap.Simple{
+			"root_directory":      root,
+			"encryption_password": obscure.MustObscure("potato"),
+			"compress":            compress,
+		})
+		o := putTestFile(t, f, "secret-"+compress, contents)
+		raw, err := os.ReadFile(filepath.Join(root, "secret-"+compress))
+		require.NoError(t, err)
+		assert.NotContains(t, string(raw), "top secret")
+		data, err := readAll(o)
+		require.NoError(t, err)
+		assert.Equal(t, contents, data)
+	}
+
+	// The same password from a key file reads it
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("potato\n"), 0600))
+	f := newTestFs(t, configmap.Simple{"root_directory": root, "encryption_key_file": keyFile})
+	o, err := f.NewObject(ctx, "secret-zstd")
+	require.NoError(t, err)
+	data, err := readAll(o)
+	require.NoError(t, err)
+	assert.Equal(t, contents, data)
+
+	// A different password doesn't
+	f = newTestFs(t, configmap.Simple{"root_directory": root, "encryption_password": obscure.MustObscure("carrot")})
+	o, err = f.NewObject(ctx, "secret-none")
+	require.NoError(t, err)
+	_, err = readAll(o)
+	assert.ErrorContains(t, err, "not configured")
+}
+
+func TestRotateKey(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	readAll := func(f *Fs, remote string) string {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return string(data)
+	}
+
+	f := newTestFs(t, configmap.Simple{"root_directory": root})
+	putTestFile(t, f, "plain", "plain text")
+	f = newTestFs(t, configmap.Simple{"root_directory": root, "encryption_password": obscure.MustObscure("old")})
+	putTestFile(t, f, "a", "aaa")
+	putTestFile(t, f, "b", "bbb")
+	_, err := f.setStatus(ctx, []string{"a"}, statusProcessed)
+	require.NoError(t, err)
+
+	f = newTestFs(t, configmap.Simple{"root_directory": root, "encryption_password": obscure.MustObscure("new")})
+	_, err = f.rotateKey(ctx, "wrong", 0)
+	require.NoError(t, err)
+	res, err := f.rotateKey(ctx, "old", 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Rotated)
+	assert.Equal(t, 1, res.Remaining)
+	res, err = f.rotateKey(ctx, "old", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Rotated)
+	assert.Equal(t, 0, res.Remaining)
+	res, err = f.rotateKey(ctx, "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Rotated)
+
+	assert.Equal(t, "aaa", readAll(f, "a"))
+	assert.Equal(t, "bbb", readAll(f, "b"))
+	assert.Equal(t, "plain text", readAll(f, "plain"))
+	o, err := f.NewObject(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, f.keyID, o.(*Object).keyID)
+	assert.Equal(t, statusProcessed, o.(*Object).status)
+	entries, err := os.ReadDir(root)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.False(t, strings.HasPrefix(entry.Name(), incomingPrefix), entry.Name())
+	}
+}
+
+func TestHashTypes(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"hash_types": "md5,sha1,sha256,crc32"})
+	assert.Equal(t, hash.NewHashSet(hash.MD5, hash.SHA1, hash.SHA256, hash.CRC32), f.Hashes())
+	o := putTestFile(t, f, "file", "hello")
+	for ht, want := range map[hash.Type]string{
+		hash.MD5:    "5d41402abc4b2a76b9719d911017c592",
+		hash.SHA1:   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		hash.SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		hash.CRC32:  "3610a686",
+	} {
+		got, err := o.Hash(ctx, ht)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, ht.String())
+	}
+	_, err := o.Hash(ctx, hash.Whirlpool)
+	assert.ErrorIs(t, err, hash.ErrUnsupported)
+
+	f = newTestFs(t, configmap.Simple{"hash_types": "sha256"})
+	o = putTestFile(t, f, "file", "hello")
+	_, err = o.Hash(ctx, hash.MD5)
+	assert.ErrorIs(t, err, hash.ErrUnsupported)
+
+	f = newTestFs(t, configmap.Simple{"hash_types": "none"})
+	assert.Equal(t, 0, f.Hashes().Count())
+	o = putTestFile(t, f, "file", "hello")
+	assert.False(t, o.(*Object).hasHash)
+	_, err = o.Hash(ctx, hash.MD5)
+	assert.ErrorIs(t, err, hash.ErrUnsupported)
+
+	for _, bad := range []string{"potato", "none,md5"} {
+		_, err = parseHashTypes(fs.CommaSepList(strings.Split(bad, ",")), nil)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestLazyHash(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	f := newTestFs(t, configmap.Simple{"root_directory": root, "hash_types": "none"})
+	putTestFile(t, f, "file", "hello")
+	putTestFile(t, f, "evicted", "hello")
+	o, err := f.NewObject(ctx, "evicted")
+	require.NoError(t, err)
+	_, err = o.(*Object).evict(ctx)
+	require.NoError(t, err)
+
+	f = newTestFs(t, configmap.Simple{"root_directory": root, "hash_types": "md5,sha1"})
+	o, err = f.NewObject(ctx, "file")
+	require.NoError(t, err)
+	sum, err := o.Hash(ctx, hash.SHA1)
+	require.NoError(t, err)
+	assert.Equal(t, "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", sum)
+
+	// Both hashes were stored
+	o, err = f.NewObject(ctx, "file")
+	require.NoError(t, err)
+	assert.True(t, o.(*Object).hasHash)
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", o.(*Object).hash)
+	sum, err = f.lookupHash(ctx, "file", hash.SHA1)
+	require.NoError(t, err)
+	assert.Equal(t, "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", sum)
+
+	// Evicted content can't be hashed
+	o, err = f.NewObject(ctx, "evicted")
+	require.NoError(t, err)
+	sum, err = o.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	assert.Equal(t, "", sum)
+}
+
+func TestScrub(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	putTestFile(t, f, "good", "good content")
+	putTestFile(t, f, "bad", "bad content")
+	putTestFile(t, f, "gone", "gone content")
+	require.NoError(t, os.WriteFile(filepath.Join(f.opt.RootDirectory, "bad"), []byte("bad CONTENT"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(f.opt.RootDirectory, "gone")))
+
+	res, err := f.scrub(ctx, "", time.Now(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Scanned)
+	assert.Equal(t, 1, res.Verified)
+	assert.Equal(t, []string{"bad"}, res.Corrupt)
+	assert.Equal(t, []string{"gone"}, res.Missing)
+
+	o, err := f.NewObject(ctx, "bad")
+	require.NoError(t, err)
+	metadata, err := o.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "true", metadata["corrupt"])
+
+	// Files scrubbed since the cutoff are left alone
+	res, err = f.scrub(ctx, "", time.Now().Add(-time.Hour), 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Scanned)
+
+	// Re-ingesting clears the flag
+	putTestFile(t, f, "bad", "new content")
+	o, err = f.NewObject(ctx, "bad")
+	require.NoError(t, err)
+	assert.False(t, o.(*Object).corrupt)
+}
+
+func TestOriginRemote(t *testing.T) {
+	ctx := context.Background()
+	origin := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(origin, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(origin, "dir", "file"), []byte("from origin"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(origin, "changed"), []byte("CHANGED"), 0644))
+
+	f := newTestFs(t, configmap.Simple{"origin_remote": origin})
+	putTestFile(t, f, "dir/file", "from origin")
+	putTestFile(t, f, "changed", "changed")
+	for _, remote := range []string{"dir/file", "changed"} {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		_, err = o.(*Object).evict(ctx)
+		require.NoError(t, err)
+	}
+	_, err := f.setStatus(ctx, []string{"dir/file"}, statusProcessed)
+	require.NoError(t, err)
+
+	o, err := f.NewObject(ctx, "dir/file")
+	require.NoError(t, err)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "from origin", string(data))
+
+	// The content is held again without changing the rest of the row
+	o, err = f.NewObject(ctx, "dir/file")
+	require.NoError(t, err)
+	assert.False(t, o.(*Object).evicted)
+	assert.Equal(t, statusProcessed, o.(*Object).status)
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "dir", "file"))
+
+	o, err = f.NewObject(ctx, "changed")
+	require.NoError(t, err)
+	_, err = o.Open(ctx)
+	assert.ErrorContains(t, err, "doesn't match")
+}
+
+func TestContentRemote(t *testing.T) {
+	ctx := context.Background()
+	store := t.TempDir()
+	f := newTestFs(t, configmap.Simple{"content_remote": store})
+	o := putTestFile(t, f, "dir/file", "remote content")
+	assert.FileExists(t, filepath.Join(store, "dir", "file"))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "dir", "file"))
+	entries, err := os.ReadDir(filepath.Join(f.opt.RootDirectory, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "remote content", string(data))
+
+	require.NoError(t, os.WriteFile(filepath.Join(store, "orphan"), []byte("orphan"), 0644))
+	res, err := f.gc(ctx, false, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"orphan"}, res.Orphans)
+	assert.NoFileExists(t, filepath.Join(store, "orphan"))
+
+	require.NoError(t, o.Remove(ctx))
+	assert.NoFileExists(t, filepath.Join(store, "dir", "file"))
+	assert.FileExists(t, filepath.Join(store, "dir", "file.delete"))
+}
+
+func TestMirrorRemote(t *testing.T) {
+	ctx := context.Background()
+	mirror := t.TempDir()
+	f := newTestFs(t, configmap.Simple{"mirror_remote": mirror, "max_cache_size": "1B"})
+	putTestFile(t, f, "dir/file", "replicated")
+
+	assert.Eventually(t, func() bool {
+		res, err := f.replicationStatus(ctx, nil)
+		require.NoError(t, err)
+		return res.(*replicationSummary).Done == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	data, err := os.ReadFile(filepath.Join(mirror, "dir", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "replicated", string(data))
+
+	res, err := f.replicationStatus(ctx, []string{"dir/file"})
+	require.NoError(t, err)
+	assert.Equal(t, replicationDone, res.([]replicationEntry)[0].Status)
+
+	// Content can only be evicted once it has been replicated
+	require.NoError(t, f.enforceCacheSize(ctx))
+	o, err := f.NewObject(ctx, "dir/file")
+	require.NoError(t, err)
+	assert.True(t, o.(*Object).evicted)
+}
+
+func TestStoreContent(t *testing.T) {
+	ctx := context.Background()
+	origin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(origin, "file"), []byte("metadata only"), 0644))
+
+	f := newTestFs(t, configmap.Simple{"store_content": "false", "origin_remote": origin})
+	putTestFile(t, f, "file", "metadata only")
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "file"))
+
+	o, err := f.NewObject(ctx, "file")
+	require.NoError(t, err)
+	assert.True(t, o.(*Object).evicted)
+	assert.Equal(t, int64(len("metadata only")), o.Size())
+	sum, err := o.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	assert.Equal(t, "0eef34a84ac7c00971791493b72d20d9", sum)
+
+	// Reads go straight to the origin and nothing is stored
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "metadata only", string(data))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "file"))
+}
+
+func TestDeletePlaceholders(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"delete_placeholders": "false"})
+	o := putTestFile(t, f, "gone.txt", "gone")
+	require.NoError(t, o.Remove(ctx))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "gone.txt"))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "gone.txt.delete"))
+
+	// The deletion is still recorded in the catalog
+	_, err := f.NewObject(ctx, "gone.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	var deleted bool
+	require.NoError(t, f.db.QueryRow(`SELECT deleted FROM files WHERE remote = ?`, "gone.txt").Scan(&deleted))
+	assert.True(t, deleted)
+}
+
+func TestShowTrash(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"show_trash": "true"})
+	putTestFile(t, f, "keep.txt", "keep")
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "no trash until something is deleted")
+
+	for _, remote := range []string{"gone.txt", "dir/sub/gone.txt"} {
+		o := putTestFile(t, f, remote, "gone")
+		require.NoError(t, o.Remove(ctx))
+		assert.Equal(t, path.Join(trashDir, remote), o.Remote())
+	}
+
+	entries, err = f.List(ctx, "")
+	require.NoError(t, err)
+	var remotes []string
+	for _, entry := range entries {
+		remotes = append(remotes, entry.Remote())
+	}
+	assert.ElementsMatch(t, []string{".trash", "keep.txt", "dir"}, remotes)
+
+	entries, err = f.List(ctx, trashDir)
+	require.NoError(t, err)
+	remotes = nil
+	for _, entry := range entries {
+		remotes = append(remotes, entry.Remote())
+	}
+	assert.ElementsMatch(t, []string{".trash/gone.txt", ".trash/dir"}, remotes)
+
+	entries, err = f.List(ctx, ".trash/dir/sub")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, ".trash/dir/sub/gone.txt", entries[0].Remote())
+	assert.Equal(t, int64(0), entries[0].Size())
+
+	o, err := f.NewObject(ctx, ".trash/gone.txt")
+	require.NoError(t, err)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	assert.Empty(t, data)
+	assert.ErrorIs(t, o.Remove(ctx), errInTrash)
+	_, err = f.NewObject(ctx, ".trash/keep.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = f.List(ctx, ".trash/missing")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+}
+
+func TestDeletedRetention(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"deleted_retention": "24h"})
+	for _, remote := range []string{"old.txt", "new.txt", "back.txt"} {
+		o := putTestFile(t, f, remote, remote)
+		require.NoError(t, o.Remove(ctx))
+	}
+	_, err := f.db.Exec(`UPDATE files SET deleted_at = ? WHERE remote != 'new.txt'`, formatDBTime(time.Now().Add(-48*time.Hour)))
+	require.NoError(t, err)
+	putTestFile(t, f, "back.txt", "back again")
+
+	require.NoError(t, f.purgeDeleted(ctx))
+	remotes, err := f.queryRemotes(ctx, `SELECT remote FROM files WHERE is_dir = 0`)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"new.txt", "back.txt"}, remotes)
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "old.txt.delete"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "new.txt.delete"))
+}
+
+func TestDetectRenames(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"detect_renames": "true"})
+	putTestFile(t, f, "old.txt", "renamed content")
+	_, err := f.setStatus(ctx, []string{"old.txt"}, statusProcessed)
+	require.NoError(t, err)
+
+	// The source isn't read as the content is already held
+	sums := map[hash.Type]string{hash.MD5: "2487717cb2f9834336ba264b7510a0de"}
+	src := object.NewStaticObjectInfo("new.txt", time.Now(), int64(len("renamed content")), true, sums, nil)
+	o, err := f.Put(ctx, iotest.ErrReader(errors.New("source read")), src)
+	require.NoError(t, err)
+	assert.Equal(t, statusProcessed, o.(*Object).status)
+	data, err := os.ReadFile(filepath.Join(f.opt.RootDirectory, "new.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "renamed content", string(data))
+
+	// Files which don't match are read from the source
+	sums[hash.MD5] = "00000000000000000000000000000000"
+	src = object.NewStaticObjectInfo("other.txt", time.Now(), int64(len("renamed content")), true, sums, nil)
+	_, err = f.Put(ctx, iotest.ErrReader(errors.New("source read")), src)
+	assert.ErrorContains(t, err, "source read")
+}
+
+func TestOriginFingerprint(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	origin, err := fs.NewFs(ctx, ":memory:"+t.Name())
+	require.NoError(t, err)
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	putOrigin := func(contents string) fs.Object {
+		src := object.NewStaticObjectInfo("file", modTime, int64(len(contents)), true, nil, nil)
+		o, err := origin.Put(ctx, bytes.NewBufferString(contents), src)
+		require.NoError(t, err)
+		return o
+	}
+
+	src := putOrigin("aaaa")
+	o, err := f.Put(ctx, bytes.NewBufferString("aaaa"), src)
+	require.NoError(t, err)
+	assert.Equal(t, "md5:74b87337454200d4d33f80c4663dc5e5", o.(*Object).fingerprint)
+
+	// Same size and modification time but different content
+	src = putOrigin("bbbb")
+	o, err = f.Put(ctx, bytes.NewBufferString("bbbb"), src)
+	require.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(f.opt.RootDirectory, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "bbbb", string(data))
+
+	// Unchanged content isn't read again whatever its modification time
+	require.NoError(t, src.SetModTime(ctx, modTime.Add(time.Hour)))
+	o, err = f.Put(ctx, iotest.ErrReader(errors.New("source read")), src)
+	require.NoError(t, err)
+	assert.Equal(t, "md5:65ba841e01d6db7733e90a5b7f9e6f80", o.(*Object).fingerprint)
+}
+
+func TestIngestCompare(t *testing.T) {
+	_, err := parseIngestCompare("size+colour")
+	assert.ErrorContains(t, err, "unknown attribute")
+
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"ingest_compare": "size"})
+	putTestFile(t, f, "file", "aaaa")
+
+	// Only the size is compared so new content of the same size is skipped
+	src := object.NewStaticObjectInfo("file", time.Now(), 4, true, nil, nil)
+	_, err = f.Put(ctx, iotest.ErrReader(errors.New("source read")), src)
+	require.NoError(t, err)
+
+	o := putTestFile(t, f, "file", "bbbbbb")
+	assert.Equal(t, int64(6), o.Size())
+}
+
+func TestAlwaysReingest(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"always_reingest": "*.db,/state/**", "ingest_compare": "size"})
+	for _, remote := range []string{"dir/app.db", "state/a/b", "other", "dir/state/c"} {
+		putTestFile(t, f, remote, "aaaa")
+		src := object.NewStaticObjectInfo(remote, time.Now(), 4, true, nil, nil)
+		_, err := f.Put(ctx, bytes.NewBufferString("bbbb"), src)
+		require.NoError(t, err)
+	}
+	for remote, want := range map[string]string{"dir/app.db": "bbbb", "state/a/b": "bbbb", "other": "aaaa", "dir/state/c": "aaaa"} {
+		data, err := os.ReadFile(filepath.Join(f.opt.RootDirectory, remote))
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data), remote)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "a", "a")
+	o := putTestFile(t, f, "b", "b")
+	putTestFile(t, f, "a", "aa")
+	require.NoError(t, o.Remove(ctx))
+	putTestFile(t, f, "b", "bbb")
+
+	res, err := f.changes(ctx, "", 3)
+	require.NoError(t, err)
+	require.Len(t, res.Changes, 3)
+	assert.True(t, res.More)
+	var events []string
+	for _, change := range res.Changes {
+		events = append(events, change.Path+" "+change.Event)
+	}
+	assert.Equal(t, []string{"a create", "b create", "a update"}, events)
+
+	res, err = f.changes(ctx, strconv.FormatInt(res.Last, 10), 10)
+	require.NoError(t, err)
+	require.Len(t, res.Changes, 2)
+	assert.False(t, res.More)
+	assert.Equal(t, eventDelete, res.Changes[0].Event)
+	assert.Equal(t, eventCreate, res.Changes[1].Event)
+	assert.Equal(t, int64(3), res.Changes[1].Size)
+
+	res, err = f.changes(ctx, "1h", 10)
+	require.NoError(t, err)
+	assert.Len(t, res.Changes, 5)
+	_, err = f.changes(ctx, "yesterday-ish", 10)
+	assert.Error(t, err)
+}
+
+func TestBookmarks(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "photos/a.jpg", "a")
+	putTestFile(t, f, "top.txt", "top")
+	require.NoError(t, f.bookmarkTouched(ctx))
+
+	res, err := f.stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), res.Files)
+	assert.Equal(t, int64(2), res.LastSeq)
+	require.Len(t, res.Bookmarks, 2)
+	assert.Equal(t, rootBookmark, res.Bookmarks[0].Dir)
+	assert.Equal(t, "photos", res.Bookmarks[1].Dir)
+	assert.Equal(t, int64(2), res.Bookmarks[1].Seq)
+
+	putTestFile(t, f, "photos/b.jpg", "b")
+	out, err := f.Command(ctx, "changes", nil, map[string]string{"bookmark": "photos"})
+	require.NoError(t, err)
+	changes := out.(*changesResult).Changes
+	require.Len(t, changes, 1)
+	assert.Equal(t, "photos/b.jpg", changes[0].Path)
+
+	_, err = f.Command(ctx, "changes", nil, map[string]string{"bookmark": "docs"})
+	assert.ErrorContains(t, err, "no bookmark")
+}
+
+func TestNotifyURL(t *testing.T) {
+	oldDelay := notifyRetryDelay
+	notifyRetryDelay = time.Millisecond
+	t.Cleanup(func() { notifyRetryDelay = oldDelay })
+
+	var mu sync.Mutex
+	var got []changeEntry
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var change changeEntry
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&change))
+		got = append(got, change)
+	}))
+	t.Cleanup(server.Close)
+
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"notify_url": server.URL})
+	o := putTestFile(t, f, "dir/file", "contents")
+	require.NoError(t, o.Remove(ctx))
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "dir/file", got[0].Path)
+	assert.Equal(t, eventCreate, got[0].Event)
+	assert.Equal(t, int64(8), got[0].Size)
+	assert.Equal(t, eventDelete, got[1].Event)
+
+	// Namespaces sharing a catalog each notify their own changes
+	paths := make(map[string][]string)
+	root := t.TempDir()
+	fss := make(map[string]*Fs)
+	for _, ns := range []string{"alpha", "beta"} {
+		ns := ns
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var change changeEntry
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&change))
+			mu.Lock()
+			defer mu.Unlock()
+			paths[ns] = append(paths[ns], change.Path)
+		}))
+		t.Cleanup(server.Close)
+		fss[ns] = newTestFs(t, configmap.Simple{"root_directory": root, "namespace": ns, "notify_url": server.URL})
+	}
+	mu.Unlock()
+	putTestFile(t, fss["alpha"], "a.txt", "a")
+	putTestFile(t, fss["beta"], "b.txt", "b")
+	putTestFile(t, fss["alpha"], "c.txt", "c")
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(paths["alpha"]) == 2 && len(paths["beta"]) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []string{"alpha/a.txt", "alpha/c.txt"}, paths["alpha"])
+	assert.Equal(t, []string{"beta/b.txt"}, paths["beta"])
+	names, err := fss["alpha"].queryRemotes(ctx, `SELECT name FROM cursors ORDER BY name`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"notify:alpha", "notify:beta"}, names)
+}
+
+func TestOnIngestCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell")
+	}
+	out := t.TempDir()
+	script := filepath.Join(out, "hook.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\ncp \"$VIRTUALFS_FILE\" \""+out+"/$VIRTUALFS_EVENT-$(basename \"$1\")\"\n"), 0755))
+
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"on_ingest_command": script, "on_ingest_evict": "true"})
+	putTestFile(t, f, "dir/file.txt", "hooked")
+	copied := filepath.Join(out, "create-file.txt")
+	assert.Eventually(t, func() bool {
+		o, err := f.NewObject(ctx, "dir/file.txt")
+		return err == nil && o.(*Object).evicted
+	}, 5*time.Second, 10*time.Millisecond)
+	data, err := os.ReadFile(copied)
+	require.NoError(t, err)
+	assert.Equal(t, "hooked", string(data))
+
+	// Only files in the namespace are run through its command
+	root := t.TempDir()
+	a := newTestFs(t, configmap.Simple{"root_directory": root, "namespace": "alpha", "on_ingest_command": script})
+	b := newTestFs(t, configmap.Simple{"root_directory": root, "namespace": "beta"})
+	putTestFile(t, b, "other.txt", "other")
+	putTestFile(t, a, "mine.txt", "mine")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(out, "create-mine.txt"))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoFileExists(t, filepath.Join(out, "create-other.txt"))
+
+	// A file the command fails for is run again
+	retry := filepath.Join(out, "retry.sh")
+	require.NoError(t, os.WriteFile(retry, []byte("#!/bin/sh\nif [ ! -e \""+out+"/failed\" ]; then touch \""+out+"/failed\"; exit 1; fi\n"+
+		"cp \"$VIRTUALFS_FILE\" \""+out+"/$VIRTUALFS_EVENT-$(basename \"$1\")\"\n"), 0755))
+	f = newTestFs(t, configmap.Simple{"on_ingest_command": retry})
+	putTestFile(t, f, "retried.txt", "retried")
+	assert.Eventually(t, func() bool {
+		f.wakeHook()
+		_, err := os.Stat(filepath.Join(out, "create-retried.txt"))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.FileExists(t, filepath.Join(out, "failed"))
+}
+
+func TestBatchCommit(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"batch_size": "8", "batch_timeout": "50ms"})
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f.inTx(ctx, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `INSERT INTO cursors (name, seq) VALUES (?, ?)`, strconv.Itoa(i), i)
+				if err == nil && i%3 == 0 {
+					err = errors.New("fail")
+				}
+				return err
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	// Only the updates which failed are undone
+	names, err := f.queryRemotes(ctx, `SELECT name FROM cursors ORDER BY seq`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2", "4", "5", "7", "8"}, names)
+	for i, err := range errs {
+		if i%3 == 0 {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+
+	putTestFile(t, f, "dir/file", "batched")
+	assert.Equal(t, []string{"dir/file"}, listNames(t, f, "dir"))
+}
+
+func TestObjectCache(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"object_cache_size": "2"})
+	putTestFile(t, f, "a", "one")
+	putTestFile(t, f, "b", "two")
+	putTestFile(t, f, "c", "three")
+
+	// Lookups are served from the cache once it has been filled
+	_, err := f.NewObject(ctx, "a")
+	require.NoError(t, err)
+	_, err = f.db.Exec(`UPDATE files SET size = 99 WHERE remote = 'a'`)
+	require.NoError(t, err)
+	o, err := f.NewObject(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), o.Size())
+
+	// Changing the object returned doesn't change the cached one
+	o.(*Object).size = 42
+	o, err = f.NewObject(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), o.Size())
+
+	// Writes invalidate the cache
+	require.NoError(t, o.SetModTime(ctx, time.Unix(1e9, 0)))
+	o, err = f.NewObject(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(99), o.Size())
+	require.NoError(t, o.Remove(ctx))
+	_, err = f.NewObject(ctx, "a")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+
+	// Listing fills the cache, dropping the least recently used
+	assert.Equal(t, []string{"b", "c"}, listNames(t, f, ""))
+	assert.Len(t, f.objects.items, 2)
+	_, ok := f.objects.get("b")
+	assert.True(t, ok)
+
+	// Lookups finding nothing are cached until the file is written
+	_, err = f.NewObject(ctx, "new")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+	o, ok = f.objects.get("new")
+	assert.True(t, ok)
+	assert.Nil(t, o)
+	putTestFile(t, f, "new", "four")
+	o, err = f.NewObject(ctx, "new")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), o.Size())
+
+	disabled := newTestFs(t, configmap.Simple{"object_cache_size": "0"})
+	assert.Nil(t, disabled.objects)
+	putTestFile(t, disabled, "a", "one")
+	_, err = disabled.NewObject(ctx, "a")
+	assert.NoError(t, err)
+}
+
+func TestListDirNotFound(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "dir/file", "contents")
+	require.NoError(t, f.Mkdir(ctx, "empty"))
+
+	_, err := f.List(ctx, "typo")
+	assert.Equal(t, fs.ErrorDirNotFound, err)
+	_, err = f.List(ctx, "dir/file")
+	assert.Equal(t, fs.ErrorDirNotFound, err)
+
+	entries, err := f.List(ctx, "empty")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	entries, err = f.List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestDirTotals(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "top.txt", "12345")
+	putTestFile(t, f, "a/one", "1")
+	putTestFile(t, f, "a/b/two", "22")
+	putTestFile(t, f, "a/b/c/three", "333")
+	putTestFile(t, f, "a0/four", "4444")
+	putTestFile(t, f, "ä/five", "55555")
+	putTestFile(t, f, "ä/ö/six", "666666")
+	require.NoError(t, f.Mkdir(ctx, "empty"))
+	require.NoError(t, putTestFile(t, f, "a/b/gone", "gone").Remove(ctx))
+
+	dirTotals := func(dir string) map[string][2]int64 {
+		entries, err := f.List(ctx, dir)
+		require.NoError(t, err)
+		totals := map[string][2]int64{}
+		for _, entry := range entries {
+			if d, ok := entry.(fs.Directory); ok {
+				totals[d.Remote()] = [2]int64{d.Items(), d.Size()}
+			}
+		}
+		return totals
+	}
+	assert.Equal(t, map[string][2]int64{
+		"a":     {3, 6},
+		"a0":    {1, 4},
+		"ä":     {2, 11},
+		"empty": {0, 0},
+	}, dirTotals(""))
+	assert.Equal(t, map[string][2]int64{"a/b": {2, 5}}, dirTotals("a"))
+	assert.Equal(t, map[string][2]int64{"ä/ö": {1, 6}}, dirTotals("ä"))
+}
+
+func TestModTimePrecision(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"object_cache_size": "0"})
+	modTime := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	src := object.NewStaticObjectInfo("file", modTime, 4, true, nil, nil)
+	_, err := f.Put(ctx, strings.NewReader("data"), src)
+	require.NoError(t, err)
+
+	o, err := f.NewObject(ctx, "file")
+	require.NoError(t, err)
+	assert.True(t, modTime.Equal(o.ModTime(ctx)), "got %v", o.ModTime(ctx))
+
+	// Changes of less than a second are kept
+	modTime = modTime.Add(time.Millisecond)
+	require.NoError(t, o.SetModTime(ctx, modTime))
+	o, err = f.NewObject(ctx, "file")
+	require.NoError(t, err)
+	assert.True(t, modTime.Equal(o.ModTime(ctx)), "got %v", o.ModTime(ctx))
+}
+
+func TestMigrateLocalTimes(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "file", "data")
+	_, err := f.db.Exec(`UPDATE files SET status_time = '2024-01-02T05:04:05+02:00', ingested_at = 'garbage' WHERE remote = 'file'`)
+	require.NoError(t, err)
+
+	tx, err := f.db.Begin()
+	require.NoError(t, err)
+	require.NoError(t, applyMigration(tx, 16))
+	require.NoError(t, tx.Commit())
+	var statusTime, ingestedAt string
+	err = f.db.QueryRowContext(ctx, `SELECT CAST(status_time AS TEXT), CAST(ingested_at AS TEXT) FROM files WHERE remote = 'file'`).Scan(&statusTime, &ingestedAt)
+	require.NoError(t, err)
+	assert.Equal(t, "2024-01-02T03:04:05Z", statusTime)
+	assert.Equal(t, "garbage", ingestedAt)
+}
+
+func TestEncoding(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"encoding": "Colon,Question,RightSpace"})
+	putTestFile(t, f, "a:b?/c ", "contents")
+	gone := putTestFile(t, f, "gone:", "gone")
+	require.NoError(t, gone.Remove(ctx))
+
+	// Content is stored under the encoded name, the catalog keeps the original
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "a：b？", "c␠"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "gone：.delete"))
+	assert.Equal(t, []string{"a:b?/c "}, listNames(t, f, "a:b?"))
+	o, err := f.NewObject(ctx, "a:b?/c ")
+	require.NoError(t, err)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "contents", string(data))
+
+	// gc still finds the content belongs to the catalog
+	res, err := f.gc(ctx, false, 0)
+	require.NoError(t, err)
+	assert.Empty(t, res.Orphans)
+
+	require.NoError(t, f.Mkdir(ctx, "new?"))
+	assert.DirExists(t, filepath.Join(f.opt.RootDirectory, "new？"))
+	require.NoError(t, f.Rmdir(ctx, "new?"))
+	assert.NoDirExists(t, filepath.Join(f.opt.RootDirectory, "new？"))
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"case_insensitive": "true"})
+	assert.True(t, f.Features().CaseInsensitive)
+	putTestFile(t, f, "Dir/File.txt", "one")
+
+	o, err := f.NewObject(ctx, "dir/file.TXT")
+	require.NoError(t, err)
+	assert.Equal(t, "Dir/File.txt", o.Remote())
+
+	// Uploads in another case update the existing file and directory
+	o = putTestFile(t, f, "DIR/FILE.TXT", "changed")
+	assert.Equal(t, "Dir/File.txt", o.Remote())
+	o = putTestFile(t, f, "dir/other.txt", "two")
+	assert.Equal(t, "Dir/other.txt", o.Remote())
+	assert.Equal(t, []string{"Dir"}, listNames(t, f, ""))
+	assert.ElementsMatch(t, []string{"Dir/File.txt", "Dir/other.txt"}, listNames(t, f, "dIR"))
+	o, err = f.NewObject(ctx, "dir/FILE.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), o.Size())
+
+	require.NoError(t, f.Mkdir(ctx, "dir/Sub"))
+	assert.ElementsMatch(t, []string{"Dir/File.txt", "Dir/Sub", "Dir/other.txt"}, listNames(t, f, "dir"))
+
+	// Without the option case matters
+	g := newTestFs(t, nil)
+	putTestFile(t, g, "File.txt", "one")
+	_, err = g.NewObject(ctx, "file.txt")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+}
+
+func TestUnicodeNormalization(t *testing.T) {
+	ctx := context.Background()
+	const nfc, nfd = "caf\u00e9/r\u00e9sum\u00e9", "cafe\u0301/re\u0301sume\u0301"
+	f := newTestFs(t, configmap.Simple{"unicode_normalization": "NFC"})
+	putTestFile(t, f, nfd, "one")
+	o := putTestFile(t, f, nfc, "one")
+	assert.Equal(t, nfc, o.Remote())
+	assert.Equal(t, []string{nfc}, listNames(t, f, path.Dir(nfd)))
+	_, err := f.NewObject(ctx, nfd)
+	assert.NoError(t, err)
+
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	m := configmap.Simple{"root_directory": t.TempDir(), "unicode_normalization": "NFX"}
+	_, err = NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", m))
+	assert.ErrorContains(t, err, "unicode_normalization")
+}
+
+func TestWindowsNames(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"CON", "‛CON"},
+		{"aux.txt", "‛aux.txt"},
+		{"com1.tar.gz", "‛com1.tar.gz"},
+		{"‛NUL", "‛‛NUL"},
+		{"console", "console"},
+		{"COM0", "COM0"},
+		{"‛file", "‛file"},
+	} {
+		got := escapeWindowsName(test.in)
+		assert.Equal(t, test.want, got, test.in)
+		assert.Equal(t, test.in, unescapeWindowsName(got), test.in)
+	}
+
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"windows_names": "true"})
+	putTestFile(t, f, "PRN/aux.txt", "one")
+	putTestFile(t, f, "dir/trailing. ", "two")
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "‛PRN", "‛aux.txt"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "dir", "trailing.␠"))
+	assert.Equal(t, []string{"PRN/aux.txt"}, listNames(t, f, "PRN"))
+	o, err := f.NewObject(ctx, "dir/trailing. ")
+	require.NoError(t, err)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "two", string(data))
+
+	res, err := f.gc(ctx, false, 0)
+	require.NoError(t, err)
+	assert.Empty(t, res.Orphans)
+}
+
+func TestLongNames(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"max_name_length": "48"})
+	long := strings.Repeat("é", 30)
+	remote := long + "/" + long + ".txt"
+	putTestFile(t, f, remote, "contents")
+	gone := putTestFile(t, f, long+"/gone-"+long, "gone")
+
+	standIn := standInName(long)
+	assert.Equal(t, strings.Repeat("é", 16)+"~", standIn[:33])
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, standIn, standInName(long+".txt")))
+	assert.ElementsMatch(t, []string{remote, long + "/gone-" + long}, listNames(t, f, long))
+	o, err := f.NewObject(ctx, remote)
+	require.NoError(t, err)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "contents", string(data))
+
+	require.NoError(t, gone.Remove(ctx))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, standIn, standInName("gone-"+long)+placeholderSuffix))
+	res, err := f.gc(ctx, false, 0)
+	require.NoError(t, err)
+	assert.Empty(t, res.Orphans)
+
+	// Names which fit are stored as they are
+	putTestFile(t, f, "short.txt", "short")
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "short.txt"))
+}
+
+func TestSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("making symlinks needs privileges on Windows")
+	}
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"materialize_links": "true"})
+	o := putTestFile(t, f, "dir/link.rclonelink", "../target")
+	assert.Equal(t, "../target", o.(*Object).linkTarget)
+	putTestFile(t, f, "plain.rclonelink", strings.Repeat("x", maxLinkTarget+1))
+
+	// The symlink is made alongside and the target read back from the catalog
+	linkPath := filepath.Join(f.opt.RootDirectory, "dir", "link")
+	target, err := os.Readlink(linkPath)
+	require.NoError(t, err)
+	assert.Equal(t, "../target", target)
+	require.NoError(t, os.Remove(filepath.Join(f.opt.RootDirectory, "dir", "link.rclonelink")))
+	o, err = f.NewObject(ctx, "dir/link.rclonelink")
+	require.NoError(t, err)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "../target", string(data))
+	metadata, err := o.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "../target", metadata["link-target"])
+
+	// Content too long to be a target isn't one
+	o, err = f.NewObject(ctx, "plain.rclonelink")
+	require.NoError(t, err)
+	assert.Equal(t, "", o.(*Object).linkTarget)
+
+	// Changing the target replaces the symlink and removing it removes it
+	o = putTestFile(t, f, "dir/link.rclonelink", "elsewhere")
+	target, err = os.Readlink(linkPath)
+	require.NoError(t, err)
+	assert.Equal(t, "elsewhere", target)
+	require.NoError(t, o.Remove(ctx))
+	_, err = os.Lstat(linkPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPosixMetadata(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	meta := fs.Metadata{
+		"mode":    "100640",
+		"uid":     strconv.Itoa(os.Getuid()),
+		"gid":     strconv.Itoa(os.Getgid()),
+		"mtime":   "2024-01-02T03:04:05Z",
+		"comment": "hello",
+	}
+	src := object.NewStaticObjectInfo("dir/file.txt", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), 4, true, nil, nil).WithMetadata(meta)
+
+	// Without --metadata nothing is captured
+	o, err := f.Put(ctx, strings.NewReader("data"), src)
+	require.NoError(t, err)
+	got, err := o.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.NotContains(t, got, "mode")
+
+	ctx, ci := fs.AddConfig(ctx)
+	ci.Metadata = true
+	src = object.NewStaticObjectInfo("dir/file.txt", time.Date(2024, 1, 3, 3, 4, 5, 0, time.UTC), 4, true, nil, nil).WithMetadata(meta)
+	_, err = f.Put(ctx, strings.NewReader("more"), src)
+	require.NoError(t, err)
+
+	f.objects.clear()
+	o, err = f.NewObject(ctx, "dir/file.txt")
+	require.NoError(t, err)
+	got, err = o.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	for _, k := range []string{"mode", "uid", "gid", "comment"} {
+		assert.Equal(t, meta[k], got[k], k)
+	}
+	assert.NotContains(t, o.(*Object).posix, "mtime")
+	assert.Equal(t, meta["mtime"], got["mtime"])
+	assert.Equal(t, statusPending, got["status"])
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filepath.Join(f.opt.RootDirectory, "dir", "file.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	}
+}
+
+func TestSharedCatalog(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	one := newTestFs(t, configmap.Simple{"root_directory": root})
+	two := newTestFs(t, configmap.Simple{"root_directory": root, "busy_timeout": "10ms"})
+
+	var wg sync.WaitGroup
+	for i, f := range []*Fs{one, two} {
+		i, f := i, f
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				putTestFile(t, f, "dir/"+strconv.Itoa(i)+"-"+strconv.Itoa(j), "data")
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, listNames(t, one, "dir"), 40)
+	_, err := one.NewObject(ctx, "dir/1-19")
+	assert.NoError(t, err)
+
+	// Hold the write lock from elsewhere for longer than busy_timeout
+	db, err := sql.Open("sqlite3", filepath.Join(root, dbName))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	conn, err := db.Conn(ctx)
+	require.NoError(t, err)
+	_, err = conn.ExecContext(ctx, `BEGIN IMMEDIATE`)
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = conn.ExecContext(ctx, `COMMIT`)
+		_ = conn.Close()
+	}()
+	putTestFile(t, two, "after", "data")
+	_, err = one.NewObject(ctx, "after")
+	assert.NoError(t, err)
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	rw := newTestFs(t, configmap.Simple{"root_directory": root})
+	putTestFile(t, rw, "dir/file.txt", "contents")
+
+	f := newTestFs(t, configmap.Simple{"root_directory": root, "read_only": "true"})
+	assert.Equal(t, []string{"dir/file.txt"}, listNames(t, f, "dir"))
+	o, err := f.NewObject(ctx, "dir/file.txt")
+	require.NoError(t, err)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "contents", string(data))
+	assert.Equal(t, o.(*Object).lastAccess, o.(*Object).ingestedAt)
+
+	src := object.NewStaticObjectInfo("new.txt", time.Now(), 3, true, nil, nil)
+	_, err = f.Put(ctx, strings.NewReader("new"), src)
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, o.Update(ctx, strings.NewReader("new"), src), fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, o.SetModTime(ctx, time.Now()), fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, o.Remove(ctx), fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, f.Mkdir(ctx, "other"), fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, f.Rmdir(ctx, "dir"), fs.ErrorPermissionDenied)
+	_, err = f.Command(ctx, "mark-processed", []string{"dir/file.txt"}, nil)
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+	_, err = f.db.Exec(`DELETE FROM files`)
+	assert.Error(t, err)
+
+	// A catalog which isn't there can't be made
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	_, err = NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", configmap.Simple{"root_directory": t.TempDir(), "read_only": "true"}))
+	assert.ErrorContains(t, err, "without read_only")
+}
+
+func TestDBPath(t *testing.T) {
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "meta", "catalog.db")
+	f := newTestFs(t, configmap.Simple{"db_path": dbPath})
+	putTestFile(t, f, "file.txt", "contents")
+
+	assert.FileExists(t, dbPath)
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, dbName))
+	assert.Equal(t, []string{"file.txt"}, listNames(t, f, ""))
+	res, err := f.gc(ctx, false, 0)
+	require.NoError(t, err)
+	assert.Empty(t, res.Orphans)
+}
+
+func TestRootDirectories(t *testing.T) {
+	ctx := context.Background()
+	roots := []string{t.TempDir(), t.TempDir()}
+	f := newTestFs(t, configmap.Simple{"root_directory": strings.Join(roots, ",")})
+	assert.Equal(t, roots[0], f.opt.RootDirectory)
+	assert.FileExists(t, filepath.Join(roots[0], dbName))
+
+	used := map[int]bool{}
+	for i := 0; i < 20; i++ {
+		remote := "dir/file" + strconv.Itoa(i)
+		o := putTestFile(t, f, remote, remote)
+		disk := o.(*Object).disk
+		used[disk] = true
+		assert.FileExists(t, filepath.Join(roots[disk], "dir", "file"+strconv.Itoa(i)))
+		assert.NoFileExists(t, filepath.Join(roots[1-disk], "dir", "file"+strconv.Itoa(i)))
+
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		assert.Equal(t, disk, o.(*Object).disk)
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		assert.Equal(t, remote, string(data))
+	}
+	assert.Len(t, used, 2, "content should be spread across both")
+
+	// gc looks in every root directory
+	require.NoError(t, os.WriteFile(filepath.Join(roots[1], "orphan"), []byte("x"), 0666))
+	res, err := f.gc(ctx, false, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.ToSlash(filepath.Join(roots[1], "orphan"))}, res.Orphans)
+
+	// Removing files removes the content wherever it is
+	for i := 0; i < 20; i++ {
+		o, err := f.NewObject(ctx, "dir/file"+strconv.Itoa(i))
+		require.NoError(t, err)
+		require.NoError(t, o.Remove(ctx))
+	}
+	for _, root := range roots {
+		matches, err := filepath.Glob(filepath.Join(root, "dir", "file*"))
+		require.NoError(t, err)
+		for _, match := range matches {
+			assert.True(t, strings.HasSuffix(match, placeholderSuffix), match)
+		}
+	}
+
+	// The catalog remembers content was put in the second
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	_, err = NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", configmap.Simple{"root_directory": roots[0]}))
+	assert.ErrorContains(t, err, "only 1 are configured")
+}
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	putTestFile(t, f, "top.txt", "12345")
+	putTestFile(t, f, "a/one", "1")
+	putTestFile(t, f, "a/b/two", "22")
+	evicted := putTestFile(t, f, "a/three", "333")
+	gone := putTestFile(t, f, "c/gone", "4444")
+	require.NoError(t, f.Mkdir(ctx, "empty"))
+	_, err := evicted.(*Object).evict(ctx)
+	require.NoError(t, err)
+	require.NoError(t, gone.Remove(ctx))
+	// Reingesting replaces the totals of the old content
+	putTestFile(t, f, "a/one", "one")
+
+	total, dirs, err := f.usage(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, dirUsage{Files: 4, Bytes: 13, StoredBytes: 10, EvictedFiles: 1, EvictedBytes: 3, Deleted: 1}, total)
+	assert.Equal(t, []dirUsage{
+		{Dir: "/", Files: 1, Bytes: 5, StoredBytes: 5},
+		{Dir: "a", Files: 3, Bytes: 8, StoredBytes: 5, EvictedFiles: 1, EvictedBytes: 3},
+		{Dir: "c", Deleted: 1},
+	}, dirs)
+
+	usage, err := f.About(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), *usage.Used)
+	assert.Equal(t, int64(4), *usage.Objects)
+
+	res, err := f.stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), res.Files)
+	assert.Equal(t, int64(1), res.Deleted)
+	assert.Equal(t, int64(13), res.Bytes)
+	assert.Len(t, res.Dirs, 3)
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"ingest_compare": "size"})
+	before := f.metrics.values()
+	delta := func() map[string]int64 {
+		out := map[string]int64{}
+		for i, v := range f.metrics.values() {
+			if d := v - before[i]; d != 0 {
+				out[metricNames[i]] = d
+			}
+		}
+		return out
+	}
+
+	putTestFile(t, f, "file.txt", "1")
+	putTestFile(t, f, "file.txt", "1")
+	o := putTestFile(t, f, "file.txt", "22")
+	_, err := f.NewObject(ctx, "file.txt")
+	require.NoError(t, err)
+	_, err = o.(*Object).evict(ctx)
+	require.NoError(t, err)
+	require.NoError(t, o.Remove(ctx))
+	assert.Equal(t, map[string]int64{
+		"ingested":    1,
+		"skipped":     1,
+		"reingested":  1,
+		"evicted":     1,
+		"tombstoned":  1,
+		"cacheHits":   1,
+		"cacheMisses": 3,
+	}, delta())
+
+	stats, err := accounting.GlobalStats().RemoteStats()
+	require.NoError(t, err)
+	extra, ok := stats["virtualfs"].(map[string]map[string]int64)
+	require.True(t, ok)
+	assert.Equal(t, f.metrics.tombstoned.Load(), extra["virtualfs"]["tombstoned"])
+	assert.Equal(t, "rclone_virtualfs_cache_hits_total", metricsNamespace+prometheusName("cacheHits")+"_total")
+}
+
+func TestRc(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	putTestFile(t, f, "dir/one", "1")
+	putTestFile(t, f, "dir/two", "22")
+	cache.Put("rctest:", f)
+	t.Cleanup(cache.Clear)
+
+	call := func(path string, in rc.Params) rc.Params {
+		t.Helper()
+		out, err := rc.Calls.Get(path).Fn(ctx, in)
+		require.NoError(t, err)
+		return out
+	}
+
+	out := call("virtualfs/mark-processed", rc.Params{"fs": "rctest:", "path": "dir/one"})
+	assert.Equal(t, statusProcessed, out["files"].([]statusEntry)[0].Status)
+
+	out = call("virtualfs/pending", rc.Params{"fs": "rctest:", "dir": "dir"})
+	entries := out["files"].([]statusEntry)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "dir/two", entries[0].Path)
+
+	out = call("virtualfs/evict", rc.Params{"fs": "rctest:", "path": "dir/two", "path2": "dir/one"})
+	assert.Equal(t, []evictEntry{{Path: "dir/two", Freed: 2}, {Path: "dir/one", Freed: 1}}, out["files"])
+
+	out = call("virtualfs/stats", rc.Params{"fs": "rctest:"})
+	assert.EqualValues(t, 2, out["evictedFiles"])
+	assert.Contains(t, out["counters"], "evicted")
+
+	_, err := rc.Calls.Get("virtualfs/evict").Fn(ctx, rc.Params{"fs": "rctest:"})
+	assert.ErrorContains(t, err, "need at least one path")
+}
+
+func TestAuditLog(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"audit_log": "true"})
+	putTestFile(t, f, "dir/one", "1")
+	two := putTestFile(t, f, "dir/two", "22")
+	putTestFile(t, f, "other", "333")
+	_, err := f.setStatus(ctx, []string{"dir/one"}, statusProcessed)
+	require.NoError(t, err)
+	_, err = f.evictFiles(ctx, []string{"dir/one"})
+	require.NoError(t, err)
+	require.NoError(t, two.Remove(ctx))
+
+	entries, err := f.auditLog(ctx, auditQuery{remote: "dir", limit: 10})
+	require.NoError(t, err)
+	var got []string
+	for _, e := range entries {
+		assert.Equal(t, auditor.invocation, e.Invocation)
+		got = append(got, e.Op+" "+e.Path+" "+e.Detail)
+	}
+	assert.Equal(t, []string{
+		"put dir/one size=1",
+		"put dir/two size=2",
+		"status dir/one processed",
+		"evict dir/one freed=1",
+		"remove dir/two ",
+	}, got)
+
+	entries, err = f.auditLog(ctx, auditQuery{op: auditPut, limit: 2})
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	_, err = parseAuditQuery(nil, map[string]string{"limit": "0"})
+	assert.ErrorContains(t, err, "invalid limit")
+
+	// Nothing is recorded unless asked for
+	f = newTestFs(t, configmap.Simple{})
+	putTestFile(t, f, "file", "1")
+	entries, err = f.auditLog(ctx, auditQuery{limit: 10})
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestQuietOps(t *testing.T) {
+	ci := fs.GetConfig(context.Background())
+	oldLevel, oldOutput := ci.LogLevel, fs.LogOutput
+	defer func() {
+		ci.LogLevel, fs.LogOutput = oldLevel, oldOutput
+	}()
+	ci.LogLevel = fs.LogLevelDebug
+	var mu sync.Mutex
+	logged := map[string]fs.LogLevel{}
+	fs.LogOutput = func(level fs.LogLevel, text string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Contains(text, "Put called") {
+			logged["put"] = level
+		} else if strings.Contains(text, "Ingested") {
+			logged["summary"] = level
+			logged[text[strings.Index(text, "Ingested"):]] = level
+		}
+	}
+
+	f := newTestFs(t, configmap.Simple{})
+	putTestFile(t, f, "one", "1")
+	putTestFile(t, f, "one", "22")
+	require.NoError(t, f.Shutdown(context.Background()))
+	assert.Equal(t, fs.LogLevelDebug, logged["put"])
+	assert.Equal(t, fs.LogLevelInfo, logged["summary"])
+	assert.Contains(t, logged, "Ingested 1 new and 1 changed files, skipped 0 identical, deleted 0 and evicted 0")
+
+	f = newTestFs(t, configmap.Simple{"quiet_ops": "false"})
+	putTestFile(t, f, "one", "1")
+	assert.Equal(t, fs.LogLevelInfo, logged["put"])
+}
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	for _, layout := range []string{layoutMirror, layoutCAS} {
+		t.Run(layout, func(t *testing.T) {
+			f := newTestFs(t, configmap.Simple{"keep_versions": "2", "content_layout": layout})
+			for _, contents := range []string{"one", "two", "three", "four"} {
+				putTestFile(t, f, "dir/file.txt", contents)
+			}
+
+			out, err := f.Command(ctx, "versions", []string{"dir/file.txt"}, nil)
+			require.NoError(t, err)
+			entries := out.([]versionEntry)
+			require.Len(t, entries, 2)
+			assert.Equal(t, int64(2), entries[0].Version)
+			assert.Equal(t, int64(3), entries[1].Version)
+			assert.Equal(t, int64(len("two")), entries[0].Size)
+
+			dst := filepath.Join(t.TempDir(), "old.txt")
+			_, err = f.Command(ctx, "get-version", []string{"dir/file.txt", dst}, map[string]string{"version": "2"})
+			require.NoError(t, err)
+			got, err := os.ReadFile(dst)
+			require.NoError(t, err)
+			assert.Equal(t, "two", string(got))
+
+			_, err = f.Command(ctx, "get-version", []string{"dir/file.txt", dst}, map[string]string{"version": "1"})
+			assert.Error(t, err)
+
+			// The live file is the newest, and only the versions kept
+			// and the live file have content left
+			o, err := f.NewObject(ctx, "dir/file.txt")
+			require.NoError(t, err)
+			in, err := o.Open(ctx)
+			require.NoError(t, err)
+			live, err := io.ReadAll(in)
+			require.NoError(t, in.Close())
+			require.NoError(t, err)
+			assert.Equal(t, "four", string(live))
+			var files int
+			require.NoError(t, filepath.WalkDir(f.opt.RootDirectory, func(p string, d os.DirEntry, err error) error {
+				if err == nil && !d.IsDir() && !strings.HasPrefix(p, f.dbFile) {
+					files++
+				}
+				return err
+			}))
+			assert.Equal(t, 3, files)
+		})
+	}
+
+	// Kept versions and files at remote paths like theirs don't
+	// overwrite each other
+	root := t.TempDir()
+	f := newTestFs(t, configmap.Simple{"root_directory": root, "keep_versions": "2"})
+	getVersion := func(f *Fs, remote string) string {
+		dst := filepath.Join(t.TempDir(), "old.txt")
+		_, err := f.Command(ctx, "get-version", []string{remote, dst}, map[string]string{"version": "1"})
+		require.NoError(t, err)
+		got, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		return string(got)
+	}
+	putTestFile(t, f, "a.txt", "one")
+	putTestFile(t, f, "versions/a.txt/1", "user data")
+	putTestFile(t, f, "a.txt", "two")
+	assert.Equal(t, "one", getVersion(f, "a.txt"))
+	got, err := os.ReadFile(filepath.Join(root, "versions", "a.txt", "1"))
+	require.NoError(t, err)
+	assert.Equal(t, "user data", string(got))
+
+	// Versions kept where older versions kept them are moved
+	root = t.TempDir()
+	f = newTestFs(t, configmap.Simple{"root_directory": root, "keep_versions": "2"})
+	putTestFile(t, f, "b.txt", "one")
+	putTestFile(t, f, "b.txt", "two")
+	require.NoError(t, os.Rename(filepath.Join(root, versionDir), filepath.Join(root, "versions")))
+	_, err = f.db.Exec(`UPDATE versions SET content_path = substr(content_path, ?)`, len(internalDir)+2)
+	require.NoError(t, err)
+	f = newTestFs(t, configmap.Simple{"root_directory": root, "keep_versions": "2"})
+	assert.Equal(t, "one", getVersion(f, "b.txt"))
+	assert.NoDirExists(t, filepath.Join(root, "versions"))
+}
+
+func TestGenerations(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "dir/a.txt", "a")
+	b := putTestFile(t, f, "dir/b.txt", "b")
+	c := putTestFile(t, f, "c.txt", "c")
+
+	out, err := f.Command(ctx, "snapshot-create", []string{"before"}, nil)
+	require.NoError(t, err)
+	before := out.(*generationEntry)
+	assert.Equal(t, "before", before.Name)
+	_, err = f.Command(ctx, "snapshot-create", []string{"before"}, nil)
+	assert.Error(t, err)
+
+	putTestFile(t, f, "dir/a.txt", "changed")
+	require.NoError(t, b.Remove(ctx))
+	require.NoError(t, c.Remove(ctx))
+	putTestFile(t, f, "dir/c.txt", "c")
+
+	out, err = f.Command(ctx, "snapshot-list", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []generationEntry{*before}, out)
+
+	paths := func(name string, arg ...string) map[string]int64 {
+		out, err := f.Command(ctx, "snapshot-list", append([]string{name}, arg...), nil)
+		require.NoError(t, err)
+		got := map[string]int64{}
+		for _, file := range out.([]generationFile) {
+			got[file.Path] = file.Size
+		}
+		return got
+	}
+	assert.Equal(t, map[string]int64{"dir/a.txt": 1, "dir/b.txt": 1, "c.txt": 1}, paths("before"))
+	assert.Equal(t, map[string]int64{"dir/a.txt": 1, "dir/b.txt": 1}, paths("before", "dir"))
+	assert.Equal(t, paths("before"), paths(strconv.FormatInt(before.Generation, 10)))
+
+	out, err = f.Command(ctx, "snapshot-create", nil, nil)
+	require.NoError(t, err)
+	after := out.(*generationEntry)
+	assert.Greater(t, after.Generation, before.Generation)
+	assert.Equal(t, map[string]int64{"dir/a.txt": 7, "dir/c.txt": 1}, paths(after.Name))
+}
+
+func TestAt(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"keep_versions": "1"})
+	putTestFile(t, f, "dir/a.txt", "one")
+	b := putTestFile(t, f, "b.txt", "b")
+	time.Sleep(10 * time.Millisecond)
+	at := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	putTestFile(t, f, "dir/a.txt", "three")
+	require.NoError(t, b.Remove(ctx))
+	putTestFile(t, f, "c.txt", "c")
+
+	past := newTestFs(t, configmap.Simple{"root_directory": f.opt.RootDirectory, "at": at.Format(time.RFC3339Nano)})
+	assert.Equal(t, []string{"b.txt", "dir"}, listNames(t, past, ""))
+	assert.Equal(t, []string{"dir/a.txt"}, listNames(t, past, "dir"))
+	_, err := past.List(ctx, "missing")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+
+	// The old content of a is a version, b's is gone
+	o, err := past.NewObject(ctx, "dir/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), o.Size())
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	got, err := io.ReadAll(in)
+	require.NoError(t, in.Close())
+	require.NoError(t, err)
+	assert.Equal(t, "one", string(got))
+	o, err = past.NewObject(ctx, "b.txt")
+	require.NoError(t, err)
+	_, err = o.Open(ctx)
+	assert.ErrorIs(t, err, errNoContent)
+	_, err = past.NewObject(ctx, "c.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+
+	assert.ErrorIs(t, past.Mkdir(ctx, "new"), fs.ErrorPermissionDenied)
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "a.parquet", "small")
+	putTestFile(t, f, "dir/b.parquet", "much larger")
+	putTestFile(t, f, "dir/sub/c.parquet", "also larger")
+	putTestFile(t, f, "dir/c_parquet", "also larger")
+	putTestFile(t, f, "dir/d.csv", "much larger")
+	_, err := f.setStatus(ctx, []string{"dir/b.parquet"}, statusProcessed)
+	require.NoError(t, err)
+
+	search := func(arg []string, opt map[string]string) []string {
+		out, err := f.Command(ctx, "search", arg, opt)
+		require.NoError(t, err)
+		paths := []string{}
+		for _, match := range out.(*searchResult).Matches {
+			paths = append(paths, match.Path)
+		}
+		return paths
+	}
+	assert.Equal(t, []string{"a.parquet", "dir/b.parquet", "dir/sub/c.parquet"}, search(nil, map[string]string{"glob": "*.parquet"}))
+	assert.Equal(t, []string{"dir/b.parquet", "dir/sub/c.parquet"}, search(nil, map[string]string{"glob": "**/*.parquet"}))
+	assert.Equal(t, []string{"dir/sub/c.parquet"}, search(nil, map[string]string{"glob": "**/*.parquet", "unprocessed": "true"}))
+	assert.Equal(t, []string{"dir/b.parquet", "dir/sub/c.parquet"}, search(nil, map[string]string{"glob": "*.parquet", "min-size": "6B"}))
+	assert.Equal(t, []string{"a.parquet"}, search(nil, map[string]string{"max-size": "5B"}))
+	assert.Equal(t, []string{"dir/c_parquet", "dir/d.csv", "dir/sub/c.parquet"}, search([]string{"dir"}, map[string]string{"status": statusPending}))
+
+	out, err := f.Command(ctx, "search", nil, map[string]string{"limit": "2"})
+	require.NoError(t, err)
+	assert.Len(t, out.(*searchResult).Matches, 2)
+	assert.True(t, out.(*searchResult).More)
+
+	_, err = f.Command(ctx, "search", nil, map[string]string{"status": "bogus"})
+	assert.Error(t, err)
+}
+
+func TestViews(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "dir/file.txt", "contents")
+	putTestFile(t, f, "gone.txt", "gone")
+	o, err := f.NewObject(ctx, "gone.txt")
+	require.NoError(t, err)
+	require.NoError(t, o.Remove(ctx))
+
+	var version int
+	require.NoError(t, f.db.QueryRowContext(ctx, `SELECT contract_version FROM v_info`).Scan(&version))
+	assert.Equal(t, viewsVersion, version)
+
+	var path, dir, modTime, md5, status string
+	var size int64
+	require.NoError(t, f.db.QueryRowContext(ctx, `SELECT path, dir, size, mod_time, md5, status FROM v_files`).Scan(&path, &dir, &size, &modTime, &md5, &status))
+	assert.Equal(t, "dir/file.txt", path)
+	assert.Equal(t, "dir", dir)
+	assert.Equal(t, int64(8), size)
+	assert.Equal(t, "2024-01-02T03:04:05Z", modTime)
+	assert.Equal(t, "98bf7d8c15784f0a3d63204441e1e2aa", md5)
+	assert.Equal(t, statusPending, status)
+
+	var events int
+	require.NoError(t, f.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM v_changes WHERE path = 'gone.txt'`).Scan(&events))
+	assert.Equal(t, 2, events)
+
+	out, err := f.Command(ctx, "views", nil, nil)
+	require.NoError(t, err)
+	res := out.(*viewsResult)
+	assert.Equal(t, []string{"path", "dir"}, res.Views["v_dirs"])
+	assert.Contains(t, res.Views["v_files"], "md5")
+}
+
+func TestManifest(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "photos/old.jpg", "old")
+	_, err := f.Command(ctx, "bookmark", []string{"photos"}, nil)
+	require.NoError(t, err)
+	putTestFile(t, f, "photos/new.jpg", "new")
+	putTestFile(t, f, "docs/new.txt", "new")
+
+	paths := func(arg []string, opt map[string]string) []string {
+		out, err := f.Command(ctx, "manifest", arg, opt)
+		require.NoError(t, err)
+		paths := []string{}
+		for _, e := range out.([]searchEntry) {
+			paths = append(paths, e.Path)
+		}
+		return paths
+	}
+	assert.Equal(t, []string{"docs/new.txt", "photos/new.jpg", "photos/old.jpg"}, paths(nil, nil))
+	assert.Equal(t, []string{"photos/new.jpg"}, paths([]string{"photos"}, map[string]string{"bookmark": "photos"}))
+	assert.Equal(t, []string{"docs/new.txt", "photos/new.jpg"}, paths(nil, map[string]string{"bookmark": "photos"}))
+	assert.Equal(t, []string{"docs/new.txt", "photos/new.jpg", "photos/old.jpg"}, paths(nil, map[string]string{"since": "1h"}))
+
+	out, err := f.Command(ctx, "manifest", []string{"docs"}, map[string]string{"format": "csv"})
+	require.NoError(t, err)
+	assert.Equal(t, "path,size,md5,status,mod_time,ingest_time\ndocs/new.txt,3,22af645d1859cb5ca6da0c484f1f37ea,pending,2024-01-02T03:04:05Z,", strings.SplitAfter(out.(string), ",pending,2024-01-02T03:04:05Z,")[0])
+
+	_, err = f.Command(ctx, "manifest", nil, map[string]string{"format": "xml"})
+	assert.Error(t, err)
+}
+
+func TestPriority(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"priority_rules": "*.urgent:10,*.log:-1"})
+	putTestFile(t, f, "a.txt", "a")
+	putTestFile(t, f, "b.log", "b")
+	putTestFile(t, f, "c.urgent", "c")
+	putTestFile(t, f, "d.txt", "d")
+
+	pending := func() []string {
+		out, err := f.Command(ctx, "pending", nil, nil)
+		require.NoError(t, err)
+		paths := []string{}
+		for _, e := range out.([]statusEntry) {
+			paths = append(paths, e.Path)
+		}
+		return paths
+	}
+	assert.Equal(t, []string{"c.urgent", "a.txt", "d.txt", "b.log"}, pending())
+
+	out, err := f.Command(ctx, "set-priority", []string{"d.txt"}, map[string]string{"priority": "20"})
+	require.NoError(t, err)
+	assert.Equal(t, 20, out.([]statusEntry)[0].Priority)
+	assert.Equal(t, []string{"d.txt", "c.urgent", "a.txt", "b.log"}, pending())
+
+	// No rule matches so ingesting again keeps the priority set
+	putTestFile(t, f, "d.txt", "changed")
+	assert.Equal(t, []string{"d.txt", "c.urgent", "a.txt", "b.log"}, pending())
+
+	_, err = f.Command(ctx, "set-priority", []string{"missing"}, map[string]string{"priority": "1"})
+	assert.Error(t, err)
+	_, err = parsePriorityRules(fs.CommaSepList{"*.txt"})
+	assert.Error(t, err)
+}
+
+func TestOverlay(t *testing.T) {
+	ctx := context.Background()
+	origin := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(origin, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(origin, "dir", "file"), []byte("from origin"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(origin, "deleted"), []byte("deleted"), 0644))
+
+	f := newTestFs(t, configmap.Simple{"origin_remote": origin, "overlay": "true"})
+	del := putTestFile(t, f, "deleted", "deleted")
+	require.NoError(t, del.Remove(ctx))
+
+	// Recorded on first access, fetched on first open
+	assert.Empty(t, listNames(t, f, ""))
+	o, err := f.NewObject(ctx, "dir/file")
+	require.NoError(t, err)
+	assert.True(t, o.(*Object).evicted)
+	assert.Equal(t, []string{"dir/file"}, listNames(t, f, "dir"))
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "from origin", string(data))
+	o, err = f.NewObject(ctx, "dir/file")
+	require.NoError(t, err)
+	assert.False(t, o.(*Object).evicted)
+	assert.Equal(t, "54bf6ca33385e2978147150650e39465", o.(*Object).hash)
+
+	_, err = f.NewObject(ctx, "deleted")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = f.NewObject(ctx, "missing")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+}
+
+func TestPlaceholderTaken(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"deleted_retention": "24h"})
+	o := putTestFile(t, f, "file", "file")
+	putTestFile(t, f, "file"+placeholderSuffix, "not a placeholder")
+	require.NoError(t, o.Remove(ctx))
+	data, err := os.ReadFile(filepath.Join(f.opt.RootDirectory, "file"+placeholderSuffix))
+	require.NoError(t, err)
+	assert.Equal(t, "not a placeholder", string(data))
+
+	// Purging the deletion leaves the live file alone
+	_, err = f.db.Exec(`UPDATE files SET deleted_at = ? WHERE remote = 'file'`, formatDBTime(time.Now().Add(-48*time.Hour)))
+	require.NoError(t, err)
+	require.NoError(t, f.purgeDeleted(ctx))
+	_, err = f.NewObject(ctx, "file")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "file"+placeholderSuffix))
+	assert.Equal(t, []string{"file" + placeholderSuffix}, listNames(t, f, ""))
+}
+
+func TestReadRange(t *testing.T) {
+	ctx := context.Background()
+	contents := "0123456789abcdef"
+	for _, config := range []configmap.Simple{{}, {"compress": "zstd"}, {"evict_after_read": "true"}} {
+		f := newTestFs(t, config)
+		o := putTestFile(t, f, "file.txt", contents)
+		for _, test := range []struct {
+			option fs.OpenOption
+			want   string
+		}{
+			{&fs.SeekOption{Offset: 10}, "abcdef"},
+			{&fs.RangeOption{Start: 4, End: 7}, "4567"},
+			{&fs.RangeOption{Start: -1, End: 3}, "def"},
+			{&fs.SeekOption{Offset: 20}, ""},
+		} {
+			in, err := o.Open(ctx, test.option)
+			require.NoError(t, err)
+			data, err := io.ReadAll(in)
+			require.NoError(t, err)
+			require.NoError(t, in.Close())
+			assert.Equal(t, test.want, string(data), "%v with %v", test.option, config)
+		}
+	}
+
+	// Evicted content which can't be fetched fails with a clear error
+	f := newTestFs(t, configmap.Simple{})
+	o := putTestFile(t, f, "file.txt", contents)
+	_, err := o.(*Object).evict(ctx)
+	require.NoError(t, err)
+	o, err = f.NewObject(ctx, "file.txt")
+	require.NoError(t, err)
+	_, err = o.Open(ctx, &fs.SeekOption{Offset: 10})
+	assert.ErrorIs(t, err, errNoContent)
+	assert.ErrorContains(t, err, "no origin_remote")
+}
+
+func TestEvictedRead(t *testing.T) {
+	ctx := context.Background()
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	_, err = NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", configmap.Simple{"root_directory": t.TempDir(), "evicted_read": "404"}))
+	assert.ErrorContains(t, err, "invalid evicted_read")
+
+	f := newTestFs(t, configmap.Simple{"evicted_read": evictedReadNotFound})
+	putTestFile(t, f, "dir/kept.txt", "kept")
+	o := putTestFile(t, f, "dir/evicted.txt", "evicted")
+	_, err = o.(*Object).evict(ctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"dir/kept.txt"}, listNames(t, f, "dir"))
+	_, err = f.NewObject(ctx, "dir/evicted.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = f.NewObject(ctx, "dir/kept.txt")
+	assert.NoError(t, err)
+
+	// Putting the content back shows it again
+	putTestFile(t, f, "dir/evicted.txt", "evicted")
+	assert.ElementsMatch(t, []string{"dir/evicted.txt", "dir/kept.txt"}, listNames(t, f, "dir"))
+}
+
+func TestDirCacheFlush(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	require.NotNil(t, f.Features().DirCacheFlush)
+	putTestFile(t, f, "file.txt", "contents")
+	_, err := f.NewObject(ctx, "file.txt")
+	require.NoError(t, err)
+
+	// Changed by another program, the cached entry is stale until flushed
+	_, err = f.db.Exec(`UPDATE files SET size = 3 WHERE remote = 'file.txt'`)
+	require.NoError(t, err)
+	o, err := f.NewObject(ctx, "file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), o.Size())
+	f.Features().DirCacheFlush()
+	o, err = f.NewObject(ctx, "file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), o.Size())
+}
+
+func TestChangeNotify(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	putTestFile(t, f, "before.txt", "before")
+	_, err := f.NewObject(ctx, "before.txt")
+	require.NoError(t, err)
+
+	// Another process sharing the catalog
+	other := newTestFs(t, configmap.Simple{"root_directory": f.opt.RootDirectory})
+
+	var mu sync.Mutex
+	got := map[string]fs.EntryType{}
+	pollInterval := make(chan time.Duration)
+	f.ChangeNotify(ctx, func(remote string, entryType fs.EntryType) {
+		mu.Lock()
+		defer mu.Unlock()
+		got[remote] = entryType
+	}, pollInterval)
+	defer close(pollInterval)
+	pollInterval <- 10 * time.Millisecond
+
+	require.NoError(t, other.Mkdir(ctx, "dir"))
+	putTestFile(t, other, "dir/file.txt", "file")
+	o, err := other.NewObject(ctx, "before.txt")
+	require.NoError(t, err)
+	require.NoError(t, o.Remove(ctx))
+
+	want := map[string]fs.EntryType{"dir": fs.EntryDirectory, "dir/file.txt": fs.EntryObject, "before.txt": fs.EntryObject}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return assert.ObjectsAreEqual(want, got)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The stale cached entry was dropped
+	_, err = f.NewObject(ctx, "before.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+}
+
+func TestDirSetModTime(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	modTime := time.Date(2020, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	putTestFile(t, f, "dir/sub/file.txt", "file")
+	require.NoError(t, f.DirSetModTime(ctx, "dir/sub", modTime))
+	assert.ErrorIs(t, f.DirSetModTime(ctx, "missing", modTime), fs.ErrorDirNotFound)
+	assert.NoError(t, f.DirSetModTime(ctx, "", modTime))
+
+	// Writing into the directory leaves its time alone
+	putTestFile(t, f, "dir/sub/other.txt", "other")
+	entries, err := f.List(ctx, "dir")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.True(t, modTime.Equal(entries[0].ModTime(ctx)), entries[0].ModTime(ctx))
+}
+
+func TestDirTombstones(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"deleted_retention": "24h"})
+	require.NoError(t, f.Mkdir(ctx, "empty"))
+	require.NoError(t, f.Mkdir(ctx, "gone"))
+	require.NoError(t, f.Rmdir(ctx, "gone"))
+	assert.Equal(t, []string{"empty"}, listNames(t, f, ""))
+	_, err := f.List(ctx, "gone")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+
+	var deleted []string
+	rows, err := f.db.Query(`SELECT path FROM v_deleted_dirs`)
+	require.NoError(t, err)
+	for rows.Next() {
+		var p string
+		require.NoError(t, rows.Scan(&p))
+		deleted = append(deleted, p)
+	}
+	require.NoError(t, rows.Close())
+	assert.Equal(t, []string{"gone"}, deleted)
+
+	// Made again, or in place of a deleted file
+	require.NoError(t, f.Mkdir(ctx, "gone"))
+	o := putTestFile(t, f, "was-file", "file")
+	require.NoError(t, o.Remove(ctx))
+	require.NoError(t, f.Mkdir(ctx, "was-file"))
+	assert.ElementsMatch(t, []string{"empty", "gone", "was-file"}, listNames(t, f, ""))
+
+	// Forgotten after the deleted_retention
+	require.NoError(t, f.Rmdir(ctx, "gone"))
+	_, err = f.db.Exec(`UPDATE files SET deleted_at = ? WHERE remote = 'gone'`, formatDBTime(time.Now().Add(-48*time.Hour)))
+	require.NoError(t, err)
+	require.NoError(t, f.purgeDeleted(ctx))
+	var count int
+	require.NoError(t, f.db.QueryRow(`SELECT COUNT(*) FROM files WHERE remote = 'gone'`).Scan(&count))
+	assert.Equal(t, 0, count)
+}
+
+func TestPutNotVisibleUntilCommitted(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	pr, pw := io.Pipe()
+	src := object.NewStaticObjectInfo("file.txt", time.Now(), 10, true, nil, nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.Put(ctx, pr, src)
+		done <- err
+	}()
+	_, err := pw.Write([]byte("half-"))
+	require.NoError(t, err)
+
+	// Half written it can't be seen by any reader of the catalog
+	_, err = f.NewObject(ctx, "file.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	assert.Empty(t, listNames(t, f, ""))
+	var count int
+	require.NoError(t, f.db.QueryRow(`SELECT COUNT(*) FROM v_files`).Scan(&count))
+	assert.Equal(t, 0, count)
+
+	_, err = pw.Write([]byte("done!"))
+	require.NoError(t, err)
+	require.NoError(t, pw.Close())
+	require.NoError(t, <-done)
+	o, err := f.NewObject(ctx, "file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), o.Size())
+}
+
+func TestDeletionMode(t *testing.T) {
+	ctx := context.Background()
+	for mode, want := range map[string][]string{
+		deletionHidden:      nil,
+		deletionPlaceholder: {"gone.txt" + placeholderSuffix},
+		deletionZeroByte:    {"gone.txt"},
+	} {
+		f := newTestFs(t, configmap.Simple{"deletion_mode": mode, "deleted_retention": "24h"})
+		o := putTestFile(t, f, "gone.txt", "gone")
+		require.NoError(t, o.Remove(ctx))
+		var got []string
+		for _, name := range []string{"gone.txt", "gone.txt" + placeholderSuffix} {
+			info, err := os.Stat(filepath.Join(f.opt.RootDirectory, name))
+			if err == nil {
+				assert.Equal(t, int64(0), info.Size(), mode)
+				got = append(got, name)
+			}
+		}
+		assert.Equal(t, want, got, mode)
+		_, err := f.NewObject(ctx, "gone.txt")
+		assert.ErrorIs(t, err, fs.ErrorObjectNotFound, mode)
+
+		// Left alone by the garbage collector, removed with the deletion
+		res, err := f.gc(ctx, false, 0)
+		require.NoError(t, err)
+		assert.Empty(t, res.Orphans, mode)
+		_, err = f.db.Exec(`UPDATE files SET deleted_at = ? WHERE remote = 'gone.txt'`, formatDBTime(time.Now().Add(-48*time.Hour)))
+		require.NoError(t, err)
+		require.NoError(t, f.purgeDeleted(ctx))
+		assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "gone.txt"), mode)
+		assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "gone.txt"+placeholderSuffix), mode)
+	}
+
+	// Put back over the empty file
+	f := newTestFs(t, configmap.Simple{"deletion_mode": deletionZeroByte})
+	o := putTestFile(t, f, "back.txt", "first")
+	require.NoError(t, o.Remove(ctx))
+	putTestFile(t, f, "back.txt", "again")
+	data, err := os.ReadFile(filepath.Join(f.opt.RootDirectory, "back.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "again", string(data))
+
+	f = newTestFs(t, configmap.Simple{"delete_placeholders": "false"})
+	assert.Equal(t, deletionHidden, f.opt.DeletionMode)
+}
+
+func TestMaintenanceScheduler(t *testing.T) {
+	root := t.TempDir()
+	old := filepath.Join(root, "old-orphan")
+	recent := filepath.Join(root, "recent-orphan")
+	for _, p := range []string{old, recent} {
+		require.NoError(t, os.WriteFile(p, []byte("orphan"), 0644))
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(old, past, past))
+
+	f := newTestFs(t, configmap.Simple{
+		"root_directory":      root,
+		"gc_interval":         "1h",
+		"checkpoint_interval": "1h",
+	})
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(old)
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.FileExists(t, recent)
+
+	assert.Equal(t, time.Minute, f.maintenanceInterval(time.Minute))
+	assert.Equal(t, time.Hour, f.maintenanceInterval(24*time.Hour*365))
+	f = newTestFs(t, configmap.Simple{"maintenance_interval": "5m"})
+	assert.Equal(t, 5*time.Minute, f.maintenanceInterval(24*time.Hour))
+}
+
+func TestStartupCheck(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	f := newTestFs(t, configmap.Simple{"root_directory": root})
+	putTestFile(t, f, "dir/kept.txt", "kept")
+	putTestFile(t, f, "dir/lost.txt", "lost")
+	o := putTestFile(t, f, "gone.txt", "gone")
+	require.NoError(t, o.Remove(ctx))
+	require.NoError(t, os.Remove(filepath.Join(root, "dir", "lost.txt")))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "stray.txt"), []byte("stray"), 0644))
+
+	res, err := f.checkContent(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.rows)
+	assert.Equal(t, 1, res.files)
+	assert.Equal(t, []string{"dir/lost.txt"}, res.missing)
+	assert.Empty(t, res.orphans)
+
+	res, err = f.checkContent(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dir/lost.txt"}, res.missing)
+	assert.Equal(t, []string{"stray.txt"}, res.orphans)
+
+	// Files in directories named like the backend's own are checked
+	// like any other
+	for _, name := range legacyDirs {
+		putTestFile(t, f, name+"/user.txt", "user")
+	}
+	res, err = f.checkContent(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, 2+len(legacyDirs), res.rows)
+	assert.Equal(t, 1+len(legacyDirs), res.files)
+	assert.Equal(t, []string{"dir/lost.txt"}, res.missing)
+	assert.Equal(t, []string{"stray.txt"}, res.orphans)
+
+	for _, check := range []string{startupCheckQuick, startupCheckFull} {
+		newTestFs(t, configmap.Simple{"root_directory": root, "startup_check": check})
+	}
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	_, err = NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", configmap.Simple{"root_directory": t.TempDir(), "startup_check": "sometimes"}))
+	assert.ErrorContains(t, err, "invalid startup_check")
+}
+
+func TestDBRecover(t *testing.T) {
+	ctx := context.Background()
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	open := func(root string, config configmap.Simple) (*Fs, error) {
+		m := configmap.Simple{"root_directory": root, "db_check": dbCheckQuick}
+		for k, v := range config {
+			m[k] = v
+		}
+		f, err := NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", m))
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() {
+			require.NoError(t, f.(*Fs).Shutdown(ctx))
+		})
+		return f.(*Fs), nil
+	}
+	// corrupted makes a catalog with two files, snapshotted after the
+	// first, then wrecks it
+	corrupted := func() string {
+		root := t.TempDir()
+		f := newTestFs(t, configmap.Simple{"root_directory": root})
+		putTestFile(t, f, "dir/first.txt", "first")
+		_, err := f.snapshot(ctx, "")
+		require.NoError(t, err)
+		putTestFile(t, f, "second.txt", "second")
+		require.NoError(t, f.checkpoint(ctx))
+		require.NoError(t, os.WriteFile(f.dbFile, bytes.Repeat([]byte("garbage!"), 1024), 0644))
+		for _, suffix := range []string{"-wal", "-shm"} {
+			_ = os.Remove(f.dbFile + suffix)
+		}
+		return root
+	}
+
+	root := corrupted()
+	_, err = open(root, nil)
+	assert.ErrorIs(t, err, errCatalogCorrupt)
+	assert.ErrorContains(t, err, "restore-db")
+
+	f, err := open(root, configmap.Simple{"db_recover": dbRecoverSnapshot})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"dir"}, listNames(t, f, ""))
+	aside, err := filepath.Glob(filepath.Join(root, dbName+"-corrupt-*"))
+	require.NoError(t, err)
+	assert.Len(t, aside, 1)
+
+	root = corrupted()
+	f, err = open(root, configmap.Simple{"db_recover": dbRecoverScan})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"dir", "second.txt"}, listNames(t, f, ""))
+	o, err := f.NewObject(ctx, "dir/first.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), o.Size())
+	assert.Equal(t, statusPending, o.(*Object).status)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "first", string(data))
+
+	root = corrupted()
+	_, err = open(root, configmap.Simple{"db_recover": dbRecoverScan, "compress": "zstd"})
+	assert.ErrorContains(t, err, "can only be rebuilt")
+}
+
+func TestAutoVacuum(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	f := newTestFs(t, configmap.Simple{"root_directory": root})
+	for i := 0; i < 200; i++ {
+		putTestFile(t, f, "dir/file"+strconv.Itoa(i), strings.Repeat("x", i))
+	}
+
+	// An existing catalog is converted
+	f = newTestFs(t, configmap.Simple{"root_directory": root, "auto_vacuum": "true", "deleted_retention": "24h", "analyze_interval": "1h"})
+	var mode int
+	require.NoError(t, f.db.QueryRow(`PRAGMA auto_vacuum`).Scan(&mode))
+	assert.Equal(t, autoVacuumIncremental, mode)
+
+	for i := 0; i < 200; i++ {
+		o, err := f.NewObject(ctx, "dir/file"+strconv.Itoa(i))
+		require.NoError(t, err)
+		require.NoError(t, o.Remove(ctx))
+	}
+	_, err := f.db.Exec(`UPDATE files SET deleted_at = ?`, formatDBTime(time.Now().Add(-48*time.Hour)))
+	require.NoError(t, err)
+	require.NoError(t, f.purgeDeleted(ctx))
+	var free int
+	require.NoError(t, f.db.QueryRow(`PRAGMA freelist_count`).Scan(&free))
+	assert.Equal(t, 0, free)
+
+	assert.Eventually(t, func() bool {
+		var n int
+		err := f.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'sqlite_stat1'`).Scan(&n)
+		return err == nil && n == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDBPragmas(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"db_pragmas": "cache_size=-1234, temp_store=memory"})
+	putTestFile(t, f, "file.txt", "pragmas")
+
+	// Every connection in the pools has them
+	conns := make([]*sql.Conn, 3)
+	for i := range conns {
+		db := f.rdb
+		if i == 0 {
+			db = f.db
+		}
+		conn, err := db.Conn(ctx)
+		require.NoError(t, err)
+		conns[i] = conn
+		var cacheSize, tempStore int
+		require.NoError(t, conn.QueryRowContext(ctx, `PRAGMA cache_size`).Scan(&cacheSize))
+		require.NoError(t, conn.QueryRowContext(ctx, `PRAGMA temp_store`).Scan(&tempStore))
+		assert.Equal(t, -1234, cacheSize)
+		assert.Equal(t, 2, tempStore)
+	}
+	for _, conn := range conns {
+		require.NoError(t, conn.Close())
+	}
+
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	for _, pragmas := range []string{"cache_size", "cache_size=1; DROP TABLE files", "bad name=1"} {
+		_, err = NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", configmap.Simple{"root_directory": t.TempDir(), "db_pragmas": pragmas}))
+		assert.ErrorContains(t, err, "invalid db_pragmas", pragmas)
+	}
+}
+
+func TestReadsDuringWrite(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "dir/file.txt", "read me")
+
+	// Hold a write transaction open
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- f.inTx(ctx, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `UPDATE files SET status = ? WHERE remote = 'dir/file.txt'`, statusClaimed)
+			close(started)
+			<-release
+			return err
+		})
+	}()
+	<-started
+
+	// Readers see the catalog as it was before it
+	assert.Equal(t, []string{"dir/file.txt"}, listNames(t, f, "dir"))
+	f.DirCacheFlush()
+	o, err := f.NewObject(ctx, "dir/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, statusPending, o.(*Object).status)
+
+	close(release)
+	require.NoError(t, <-done)
+	f.DirCacheFlush()
+	o, err = f.NewObject(ctx, "dir/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, statusClaimed, o.(*Object).status)
+}
+
+func TestObjectCacheEpoch(t *testing.T) {
+	c := newObjectCache(10, func(remote string) string { return remote })
+
+	// A read which started before a removal isn't cached
+	epoch := c.epoch()
+	c.remove("a")
+	c.put(&Object{remote: "a", size: 1}, epoch)
+	c.putMissing("b", epoch)
+	_, ok := c.get("a")
+	assert.False(t, ok)
+	_, ok = c.get("b")
+	assert.False(t, ok)
+
+	epoch = c.epoch()
+	c.put(&Object{remote: "a", size: 2}, epoch)
+	o, ok := c.get("a")
+	require.True(t, ok)
+	assert.Equal(t, int64(2), o.size)
+
+	epoch = c.epoch()
+	c.clear()
+	c.putMissing("b", epoch)
+	_, ok = c.get("b")
+	assert.False(t, ok)
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	putTestFile(t, f, "dir/a.txt", "a")
+	putTestFile(t, f, "dir/sub/b.txt", "b")
+	putTestFile(t, f, "other/c.txt", "c")
+
+	require.NoError(t, f.Purge(ctx, "dir"))
+	assert.Equal(t, []string{"other"}, listNames(t, f, ""))
+	_, err := f.NewObject(ctx, "dir/sub/b.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	assert.NoDirExists(t, filepath.Join(f.opt.RootDirectory, "dir"))
+	var tombstoned int
+	require.NoError(t, f.db.QueryRow(`SELECT COUNT(*) FROM files WHERE deleted = 1`).Scan(&tombstoned))
+	assert.Equal(t, 4, tombstoned)
+
+	assert.ErrorIs(t, f.Purge(ctx, "dir"), fs.ErrorDirNotFound)
+}
+
+func TestRemoveQueued(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	var objects []fs.Object
+	for i := 0; i < 50; i++ {
+		objects = append(objects, putTestFile(t, f, "many/"+strconv.Itoa(i)+".txt", "x"))
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(objects))
+	for i, o := range objects {
+		wg.Add(1)
+		go func(i int, o fs.Object) {
+			defer wg.Done()
+			errs[i] = o.Remove(ctx)
+		}(i, o)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Empty(t, listNames(t, f, "many"))
+	var journalled int
+	require.NoError(t, f.db.QueryRow(`SELECT COUNT(*) FROM journal WHERE event = ?`, eventDelete).Scan(&journalled))
+	assert.Equal(t, len(objects), journalled)
+}
+
+func TestDu(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"deleted_retention": "24h"})
+	putTestFile(t, f, "top/a.txt", "aaa")
+	putTestFile(t, f, "top/sub/b.txt", "bb")
+	gone := putTestFile(t, f, "top/sub/gone.txt", "gone")
+	putTestFile(t, f, "top/sub/evicted.txt", "evicted")
+	require.NoError(t, gone.Remove(ctx))
+	_, err := f.evictFiles(ctx, []string{"top/sub/evicted.txt"})
+	require.NoError(t, err)
+	require.NoError(t, f.Mkdir(ctx, "top/empty"))
+
+	out, err := f.Command(ctx, "du", []string{"top"}, nil)
+	require.NoError(t, err)
+	entries := out.([]*duEntry)
+	require.Len(t, entries, 3)
+	assert.Equal(t, duEntry{Path: "top", Cached: duCount{2, 5}, Evicted: duCount{1, 7}, Deleted: duCount{1, 4}}, *entries[0])
+	assert.Equal(t, duEntry{Path: "top/empty"}, *entries[1])
+	assert.Equal(t, duEntry{Path: "top/sub", Cached: duCount{1, 2}, Evicted: duCount{1, 7}, Deleted: duCount{1, 4}}, *entries[2])
+
+	out, err = f.Command(ctx, "du", nil, map[string]string{"format": "ncdu"})
+	require.NoError(t, err)
+	var dump []interface{}
+	require.NoError(t, json.Unmarshal([]byte(out.(string)), &dump))
+	require.Len(t, dump, 4)
+	top := dump[3].([]interface{})[1].([]interface{})
+	assert.Equal(t, "top", top[0].(map[string]interface{})["name"])
+	assert.Equal(t, "a.txt", top[1].(map[string]interface{})["name"])
+	sub := top[3].([]interface{})
+	evicted := sub[2].(map[string]interface{})
+	assert.Equal(t, "evicted.txt", evicted["name"])
+	assert.Equal(t, float64(7), evicted["asize"])
+	assert.Equal(t, float64(0), evicted["dsize"])
+
+	_, err = f.Command(ctx, "du", []string{"missing"}, nil)
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+}
+
+func TestAsyncDelete(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	leftover := filepath.Join(root, deletingDir, "leftover")
+	require.NoError(t, os.MkdirAll(filepath.Dir(leftover), 0755))
+	require.NoError(t, os.WriteFile(leftover, []byte("left by a crash"), 0644))
+
+	f := newTestFs(t, configmap.Simple{"root_directory": root, "async_delete": "true"})
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(leftover)
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Moved aside straight away so the name can be used again
+	o := putTestFile(t, f, "big.bin", "content")
+	require.NoError(t, o.Remove(ctx))
+	assert.NoFileExists(t, filepath.Join(root, "big.bin"))
+	putTestFile(t, f, "big.bin", "again")
+
+	require.NoError(t, f.Shutdown(ctx))
+	entries, err := os.ReadDir(filepath.Join(root, deletingDir))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	data, err := os.ReadFile(filepath.Join(root, "big.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "again", string(data))
+
+	// Files stored at remote paths like the deleting directory survive
+	root = t.TempDir()
+	f = newTestFs(t, configmap.Simple{"root_directory": root, "async_delete": "true"})
+	putTestFile(t, f, "deleting/c.txt", "user data")
+	o = putTestFile(t, f, "other.txt", "other")
+	require.NoError(t, o.Remove(ctx))
+	require.NoError(t, f.Shutdown(ctx))
+	data, err = os.ReadFile(filepath.Join(root, "deleting", "c.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "user data", string(data))
+	_, err = f.Put(ctx, strings.NewReader("x"), object.NewStaticObjectInfo(internalDir+"/x", time.Now(), 1, true, nil, nil))
+	assert.ErrorIs(t, err, errReserved)
+
+	// The deleting directory of older versions is moved and emptied
+	root = t.TempDir()
+	legacy := filepath.Join(root, "deleting", "leftover")
+	require.NoError(t, os.MkdirAll(filepath.Dir(legacy), 0755))
+	require.NoError(t, os.WriteFile(legacy, []byte("left by an old version"), 0644))
+	f = newTestFs(t, configmap.Simple{"root_directory": root, "async_delete": "true"})
+	require.NoError(t, f.Shutdown(ctx))
+	assert.NoDirExists(t, filepath.Join(root, "deleting"))
+}
+
+func TestSourceRemote(t *testing.T) {
+	ctx := context.Background()
+	srcDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "from.txt"), []byte("source"), 0644))
+	srcFs, err := fs.NewFs(ctx, srcDir)
+	require.NoError(t, err)
+	src, err := srcFs.NewObject(ctx, "from.txt")
+	require.NoError(t, err)
+
+	f := newTestFs(t, configmap.Simple{})
+	in, err := src.Open(ctx)
+	require.NoError(t, err)
+	o, err := f.Put(ctx, in, src)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	putTestFile(t, f, "unknown.txt", "no source")
+
+	metadata, err := o.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "local", metadata["source-remote"])
+	assert.Equal(t, path.Join(srcFs.Root(), "from.txt"), metadata["source-path"])
+
+	out, err := f.Command(ctx, "search", nil, map[string]string{"source": "local:"})
+	require.NoError(t, err)
+	matches := out.(*searchResult).Matches
+	require.Len(t, matches, 1)
+	assert.Equal(t, "from.txt", matches[0].Path)
+	assert.Equal(t, "local", matches[0].Source)
+}
+
+func TestNamespace(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	a := newTestFs(t, configmap.Simple{"root_directory": root, "namespace": "alpha"})
+	b := newTestFs(t, configmap.Simple{"root_directory": root, "namespace": "beta"})
+	assert.Empty(t, listNames(t, b, ""))
+	putTestFile(t, a, "dir/file.txt", "alpha")
+	putTestFile(t, b, "dir/file.txt", "beta")
+	assert.Equal(t, "", a.Root())
+
+	for name, f := range map[string]*Fs{"alpha": a, "beta": b} {
+		assert.Equal(t, []string{"dir"}, listNames(t, f, ""), name)
+		o, err := f.NewObject(ctx, "dir/file.txt")
+		require.NoError(t, err, name)
+		assert.Equal(t, int64(len(name)), o.Size(), name)
+
+		out, err := f.Command(ctx, "status", []string{"dir/file.txt"}, nil)
+		require.NoError(t, err, name)
+		assert.Equal(t, name+"/dir/file.txt", out.([]statusEntry)[0].Path, name)
+		out, err = f.Command(ctx, "search", nil, nil)
+		require.NoError(t, err, name)
+		require.Len(t, out.(*searchResult).Matches, 1, name)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "beta", "dir", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "beta", string(data))
+
+	// Without a namespace they are all seen
+	admin := newTestFs(t, configmap.Simple{"root_directory": root})
+	assert.Equal(t, []string{"alpha", "beta"}, listNames(t, admin, ""))
+
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	for _, ns := range []string{"a/b", "..", trashDir, snapshotDir} {
+		_, err = NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", configmap.Simple{"root_directory": t.TempDir(), "namespace": ns}))
+		assert.Error(t, err, ns)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+	put := func(f *Fs, remote, contents string, modTime time.Time) {
+		src := object.NewStaticObjectInfo(remote, modTime, int64(len(contents)), true, nil, nil)
+		_, err := f.Put(ctx, bytes.NewBufferString(contents), src)
+		require.NoError(t, err)
+	}
+	old, recent := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	other := newTestFs(t, configmap.Simple{})
+	put(other, "only/there.txt", "there", old)
+	put(other, "newer.txt", "newer there", recent)
+	put(other, "older.txt", "older there", old)
+	_, err := other.Command(ctx, "mark-processed", []string{"only/there.txt"}, nil)
+	require.NoError(t, err)
+	otherDB := filepath.Join(other.opt.RootDirectory, dbName)
+
+	f := newTestFs(t, configmap.Simple{})
+	put(f, "newer.txt", "newer here", old)
+	put(f, "older.txt", "older here", recent)
+
+	_, err = f.Command(ctx, "merge", []string{otherDB}, map[string]string{"conflict": "error"})
+	assert.ErrorContains(t, err, "2 files are in both catalogs")
+	_, err = f.NewObject(ctx, "only/there.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+
+	out, err := f.Command(ctx, "merge", []string{otherDB, other.opt.RootDirectory}, nil)
+	require.NoError(t, err)
+	res := out.(*mergeResult)
+	assert.Equal(t, 2, res.Merged)
+	assert.Equal(t, 1, res.Kept)
+	assert.Equal(t, []string{"newer.txt", "older.txt"}, res.Conflicts)
+	for remote, want := range map[string]string{"only/there.txt": "there", "newer.txt": "newer there", "older.txt": "older here"} {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err, remote)
+		in, err := o.Open(ctx)
+		require.NoError(t, err, remote)
+		got, err := io.ReadAll(in)
+		require.NoError(t, err, remote)
+		require.NoError(t, in.Close())
+		assert.Equal(t, want, string(got), remote)
+	}
+	o, err := f.NewObject(ctx, "only/there.txt")
+	require.NoError(t, err)
+	assert.Equal(t, statusProcessed, o.(*Object).status)
+
+	// Without the content the files are merged evicted
+	g := newTestFs(t, configmap.Simple{})
+	out, err = g.Command(ctx, "merge", []string{otherDB}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, out.(*mergeResult).Evicted)
+	o, err = g.NewObject(ctx, "newer.txt")
+	require.NoError(t, err)
+	assert.True(t, o.(*Object).evicted)
+	assert.Equal(t, int64(len("newer there")), o.Size())
+}
+
+func TestIngestFilters(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"ingest_include": "*.jpg,*.txt", "ingest_exclude": "**/.thumbnails/**"})
+	putTestFile(t, f, "photo.jpg", "photo")
+	o := putTestFile(t, f, "scratch.tmp", "temp")
+	assert.Equal(t, "scratch.tmp", o.Remote())
+	assert.Equal(t, int64(4), o.Size())
+	putTestFile(t, f, "album/.thumbnails/photo.jpg", "thumb")
+
+	assert.Equal(t, []string{"photo.jpg"}, listNames(t, f, ""))
+	_, err := f.NewObject(ctx, "scratch.tmp")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "scratch.tmp"))
+	assert.NoDirExists(t, filepath.Join(f.opt.RootDirectory, "album"))
+
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	_, err = NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", configmap.Simple{"root_directory": t.TempDir(), "ingest_exclude": "[a"}))
+	assert.ErrorContains(t, err, "invalid ingest_exclude pattern")
+}
+
+func TestIngestAge(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"ingest_min_age": "1h", "ingest_max_age": "30d"})
+	for remote, age := range map[string]time.Duration{
+		"new.txt":    time.Minute,
+		"recent.txt": 2 * time.Hour,
+		"old.txt":    60 * 24 * time.Hour,
+	} {
+		src := object.NewStaticObjectInfo(remote, time.Now().Add(-age), 4, true, nil, nil)
+		_, err := f.Put(ctx, bytes.NewBufferString("data"), src)
+		require.NoError(t, err, remote)
+	}
+	assert.Equal(t, []string{"recent.txt"}, listNames(t, f, ""))
+}
+
+func TestDuplicateWindow(t *testing.T) {
+	ctx := context.Background()
+	srcDir := t.TempDir()
+	srcPath := filepath.Join(srcDir, "report.csv")
+	require.NoError(t, os.WriteFile(srcPath, []byte("same every run"), 0644))
+	srcFs, err := fs.NewFs(ctx, srcDir)
+	require.NoError(t, err)
+	upload := func(f *Fs, modTime time.Time) fs.Object {
+		require.NoError(t, os.Chtimes(srcPath, modTime, modTime))
+		src, err := srcFs.NewObject(ctx, "report.csv")
+		require.NoError(t, err)
+		in, err := src.Open(ctx)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, in.Close())
+		}()
+		o, err := f.Put(ctx, in, src)
+		require.NoError(t, err)
+		return o
+	}
+	first := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	second := first.Add(time.Hour)
+
+	f := newTestFs(t, configmap.Simple{"duplicate_window": "24h"})
+	upload(f, first)
+	_, err = f.db.Exec(`UPDATE files SET ingested_at = ?`, formatDBTime(time.Now().Add(-time.Hour)))
+	require.NoError(t, err)
+	f.objects.clear()
+	o := upload(f, second).(*Object)
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), o.ingestedAt, time.Minute)
+	assert.True(t, second.Equal(o.ModTime(ctx)))
+	f.objects.clear()
+	found, err := f.NewObject(ctx, "report.csv")
+	require.NoError(t, err)
+	assert.True(t, second.Equal(found.ModTime(ctx)))
+
+	// Ingested again without the window
+	g := newTestFs(t, configmap.Simple{})
+	upload(g, first)
+	_, err = g.db.Exec(`UPDATE files SET ingested_at = ?`, formatDBTime(time.Now().Add(-time.Hour)))
+	require.NoError(t, err)
+	g.objects.clear()
+	o = upload(g, second).(*Object)
+	assert.WithinDuration(t, time.Now(), o.ingestedAt, time.Minute)
+}
+
+func TestQuarantineCorrupt(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"quarantine_corrupt": "true"})
+	putTestFile(t, f, "good", "good content")
+	putTestFile(t, f, "bad", "bad content")
+	require.NoError(t, os.WriteFile(filepath.Join(f.opt.RootDirectory, "bad"), []byte("bad CONTENT"), 0644))
+
+	res, err := f.scrub(ctx, "", time.Now(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bad"}, res.Corrupt)
+
+	// The content is moved aside and the file hidden
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "bad"))
+	data, err := os.ReadFile(filepath.Join(f.opt.RootDirectory, quarantineDir, "bad"))
+	require.NoError(t, err)
+	assert.Equal(t, "bad CONTENT", string(data))
+	assert.Equal(t, []string{"good"}, listNames(t, f, ""))
+	_, err = f.NewObject(ctx, "bad")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+	var corrupt, evicted bool
+	require.NoError(t, f.db.QueryRow(`SELECT corrupt, evicted FROM files WHERE remote = 'bad'`).Scan(&corrupt, &evicted))
+	assert.True(t, corrupt)
+	assert.True(t, evicted)
+
+	// Uploading the same file again replaces it
+	putTestFile(t, f, "bad", "bad content")
+	o, err := f.NewObject(ctx, "bad")
+	require.NoError(t, err)
+	assert.False(t, o.(*Object).corrupt)
+	assert.ElementsMatch(t, []string{"bad", "good"}, listNames(t, f, ""))
+}
+
+func TestRepair(t *testing.T) {
+	ctx := context.Background()
+	origin := t.TempDir()
+	for _, name := range []string{"bad", "gone", "good"} {
+		require.NoError(t, os.WriteFile(filepath.Join(origin, name), []byte(name+" content"), 0644))
+	}
+	f := newTestFs(t, configmap.Simple{"origin_remote": origin, "quarantine_corrupt": "true"})
+	for _, name := range []string{"bad", "gone", "good"} {
+		putTestFile(t, f, name, name+" content")
+	}
+	putTestFile(t, f, "changed", "changed content")
+	require.NoError(t, os.WriteFile(filepath.Join(f.opt.RootDirectory, "bad"), []byte("bad CONTENT"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(f.opt.RootDirectory, "changed"), []byte("CHANGED content"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(origin, "changed"), []byte("CHANGED content"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(f.opt.RootDirectory, "gone")))
+	_, err := f.scrub(ctx, "", time.Now(), 0)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"gone", "good"}, listNames(t, f, ""))
+
+	res, err := f.repair(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, 4, res.Checked)
+	assert.Equal(t, []string{"bad", "gone"}, res.Repaired)
+	require.Len(t, res.Failed, 1)
+	assert.Equal(t, "changed", res.Failed[0].Path)
+
+	assert.ElementsMatch(t, []string{"bad", "gone", "good"}, listNames(t, f, ""))
+	for _, name := range []string{"bad", "gone"} {
+		data, err := os.ReadFile(filepath.Join(f.opt.RootDirectory, name))
+		require.NoError(t, err)
+		assert.Equal(t, name+" content", string(data))
+	}
+	var corrupt bool
+	require.NoError(t, f.db.QueryRow(`SELECT corrupt FROM files WHERE remote = 'changed'`).Scan(&corrupt))
+	assert.True(t, corrupt)
+
+	// Nothing left to do
+	res, err = f.repair(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, res.Repaired)
+}
+
+func TestSkippedChecks(t *testing.T) {
+	ctx := accounting.WithStatsGroup(context.Background(), "virtualfs-skipped")
+	f := newTestFs(t, configmap.Simple{"ingest_compare": "size"})
+	put := func(contents string) {
+		src := object.NewStaticObjectInfo("file.txt", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), int64(len(contents)), true, nil, nil)
+		_, err := f.Put(ctx, bytes.NewBufferString(contents), src)
+		require.NoError(t, err)
+	}
+	stats := accounting.Stats(ctx)
+	put("one")
+	assert.Equal(t, int64(0), stats.GetChecks())
+	put("one")
+	put("one")
+	assert.Equal(t, int64(2), stats.GetChecks())
+	put("three")
+	assert.Equal(t, int64(2), stats.GetChecks())
+}
+
+func TestRcEvents(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	cache.Put("rcevents:", f)
+	t.Cleanup(cache.Clear)
+	events := func(in rc.Params) *eventsResult {
+		t.Helper()
+		in["fs"] = "rcevents:"
+		out, err := rc.Calls.Get("virtualfs/events").Fn(ctx, in)
+		require.NoError(t, err)
+		var res eventsResult
+		require.NoError(t, rc.Reshape(&res, out))
+		return &res
+	}
+	start := f.events.last()
+
+	o := putTestFile(t, f, "dir/one", "1")
+	_, err := f.setStatus(ctx, []string{"dir/one"}, statusProcessed)
+	require.NoError(t, err)
+	_, err = o.(*Object).evict(ctx)
+	require.NoError(t, err)
+	require.NoError(t, o.Remove(ctx))
+
+	res := events(rc.Params{"since": start})
+	assert.False(t, res.Lost)
+	var got []string
+	for _, e := range res.Events {
+		got = append(got, e.Event+" "+e.Path)
+	}
+	assert.Equal(t, []string{"ingest dir/one", "processed dir/one", "evict dir/one", "delete dir/one"}, got)
+	assert.Equal(t, start+4, res.Last)
+
+	res = events(rc.Params{"since": start, "limit": 1})
+	require.Len(t, res.Events, 1)
+	assert.Equal(t, start+1, res.Last)
+
+	// Nothing new so it times out
+	res = events(rc.Params{"timeout": "10ms"})
+	assert.Empty(t, res.Events)
+	assert.Equal(t, start+4, res.Last)
+
+	// A waiting call returns as soon as something happens
+	done := make(chan *eventsResult)
+	go func() {
+		done <- f.events.wait(ctx, start+4, defaultEventsLimit, time.Minute)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	putTestFile(t, f, "two", "22")
+	res = <-done
+	require.Len(t, res.Events, 1)
+	assert.Equal(t, "two", res.Events[0].Path)
+
+	// From before a restart
+	res = events(rc.Params{"since": start + 1000})
+	assert.True(t, res.Lost)
+}
+
+func TestWaitForChange(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	putTestFile(t, f, "incoming/old.csv", "old")
+
+	// Only changes from now on, matching the directory and glob, count
+	type result struct {
+		out interface{}
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		out, err := f.Command(ctx, "wait-for-change", []string{"incoming"}, map[string]string{"include": "*.csv", "poll": "10ms"})
+		done <- result{out, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	putTestFile(t, f, "other/new.csv", "other")
+	putTestFile(t, f, "incoming/new.txt", "txt")
+	putTestFile(t, f, "incoming/new.csv", "csv")
+	r := <-done
+	require.NoError(t, r.err)
+	res := r.out.(*changesResult)
+	require.Len(t, res.Changes, 1)
+	assert.Equal(t, "incoming/new.csv", res.Changes[0].Path)
+
+	// Carrying on from last waits for the next
+	_, err := f.Command(ctx, "wait-for-change", nil, map[string]string{"since": strconv.FormatInt(res.Last, 10), "timeout": "50ms", "poll": "10ms"})
+	assert.Equal(t, errWaitTimeout, err)
+
+	// Changes since an earlier point are returned straight away
+	out, err := f.Command(ctx, "wait-for-change", []string{"incoming"}, map[string]string{"since": "0"})
+	require.NoError(t, err)
+	assert.Len(t, out.(*changesResult).Changes, 3)
+
+	_, err = f.Command(ctx, "wait-for-change", nil, map[string]string{"poll": "0s"})
+	assert.ErrorContains(t, err, "invalid poll")
+}
+
+func TestClaimLease(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	putTestFile(t, f, "incoming/a", "a")
+	putTestFile(t, f, "incoming/b", "b")
+	putTestFile(t, f, "other/c", "c")
+	claim := func(worker string, opts map[string]string, paths ...string) ([]statusEntry, error) {
+		opt := map[string]string{"worker": worker}
+		for k, v := range opts {
+			opt[k] = v
+		}
+		out, err := f.Command(ctx, "claim", paths, opt)
+		if err != nil {
+			return nil, err
+		}
+		return out.([]statusEntry), nil
+	}
+
+	// Workers pulling from the same directory get different files
+	one, err := claim("one", map[string]string{"dir": "incoming"})
+	require.NoError(t, err)
+	require.Len(t, one, 1)
+	assert.Equal(t, "incoming/a", one[0].Path)
+	assert.Equal(t, "one", one[0].Worker)
+	two, err := claim("two", map[string]string{"dir": "incoming", "count": "5"})
+	require.NoError(t, err)
+	require.Len(t, two, 1)
+	assert.Equal(t, "incoming/b", two[0].Path)
+	none, err := claim("three", map[string]string{"dir": "incoming"})
+	require.NoError(t, err)
+	assert.Empty(t, none)
+
+	// A file held by another worker can't be claimed or released
+	_, err = claim("two", nil, "incoming/a")
+	assert.ErrorContains(t, err, "already claimed by one")
+	_, err = f.Command(ctx, "release", []string{"incoming/a"}, map[string]string{"worker": "two"})
+	assert.ErrorContains(t, err, "not claimed by two")
+
+	// But can be once the lease has run out
+	_, err = claim("one", map[string]string{"lease": "1h"}, "incoming/a")
+	require.NoError(t, err)
+	_, err = f.db.Exec(`UPDATE files SET claim_expires = ? WHERE remote = 'incoming/a'`, formatDBTime(time.Now().Add(-time.Minute)))
+	require.NoError(t, err)
+	_, err = claim("two", nil, "incoming/a")
+	require.NoError(t, err)
+
+	// Releasing puts the file back for anyone to claim
+	_, err = f.Command(ctx, "release", []string{"incoming/a"}, map[string]string{"worker": "two"})
+	require.NoError(t, err)
+	o, err := f.NewObject(ctx, "incoming/a")
+	require.NoError(t, err)
+	assert.Equal(t, statusPending, o.(*Object).status)
+	three, err := claim("three", map[string]string{"dir": "incoming"})
+	require.NoError(t, err)
+	require.Len(t, three, 1)
+	assert.Equal(t, "incoming/a", three[0].Path)
+
+	// Finishing the file clears the claim
+	_, err = f.setStatus(ctx, []string{"incoming/a"}, statusProcessed)
+	require.NoError(t, err)
+	var worker sql.NullString
+	require.NoError(t, f.db.QueryRow(`SELECT claim_worker FROM files WHERE remote = 'incoming/a'`).Scan(&worker))
+	assert.False(t, worker.Valid)
+
+	_, err = claim("", nil)
+	assert.ErrorContains(t, err, "need a worker")
+}
+
+func TestNext(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	putTestFile(t, f, "queue/old", "old")
+	putTestFile(t, f, "queue/urgent", "urgent")
+	putTestFile(t, f, "elsewhere", "elsewhere")
+	_, err := f.db.Exec(`UPDATE files SET ingested_at = ? WHERE remote = 'queue/old'`, formatDBTime(time.Now().Add(-time.Hour)))
+	require.NoError(t, err)
+	_, err = f.db.Exec(`UPDATE files SET priority = 5 WHERE remote = 'queue/urgent'`)
+	require.NoError(t, err)
+	f.objects.clear()
+
+	var got []string
+	for {
+		out, err := f.Command(ctx, "next", []string{"queue"}, nil)
+		if err == errNothingWaiting {
+			break
+		}
+		require.NoError(t, err)
+		e := out.(*nextEntry)
+		assert.Equal(t, statusClaimed, e.Status)
+		data, err := os.ReadFile(e.Local)
+		require.NoError(t, err)
+		assert.Equal(t, path.Base(e.Path), string(data))
+		got = append(got, e.Path)
+	}
+	assert.Equal(t, []string{"queue/urgent", "queue/old"}, got)
+
+	out, err := f.Command(ctx, "next", nil, map[string]string{"worker": "w1"})
+	require.NoError(t, err)
+	e := out.(*nextEntry)
+	assert.Equal(t, "elsewhere", e.Path)
+	assert.Equal(t, "w1", e.Worker)
+	assert.NotEmpty(t, e.LeaseExpiry)
+}
+
+func TestAnnotate(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	putTestFile(t, f, "doc.pdf", "pdf")
+
+	out, err := f.Command(ctx, "annotate", []string{"doc.pdf", `{ "pages": 12, "ocr": "done" }`}, nil)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"pages":12,"ocr":"done"}`, string(out.(*annotationEntry).Annotation))
+
+	o, err := f.NewObject(ctx, "doc.pdf")
+	require.NoError(t, err)
+	metadata, err := o.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, `{"pages":12,"ocr":"done"}`, metadata["annotation"])
+
+	found, err := f.Command(ctx, "search", nil, nil)
+	require.NoError(t, err)
+	res := found.(*searchResult)
+	require.Len(t, res.Matches, 1)
+	entry, err := json.Marshal(res.Matches[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(entry), `"annotation":{"pages":12,"ocr":"done"}`)
+
+	var viewed string
+	require.NoError(t, f.db.QueryRow(`SELECT annotation FROM v_files WHERE path = 'doc.pdf'`).Scan(&viewed))
+	assert.Equal(t, `{"pages":12,"ocr":"done"}`, viewed)
+
+	// Kept across ingests and removed with null
+	putTestFile(t, f, "doc.pdf", "new pdf")
+	o, err = f.NewObject(ctx, "doc.pdf")
+	require.NoError(t, err)
+	assert.Equal(t, `{"pages":12,"ocr":"done"}`, o.(*Object).annotation)
+	_, err = f.Command(ctx, "annotate", []string{"doc.pdf", "null"}, nil)
+	require.NoError(t, err)
+	o, err = f.NewObject(ctx, "doc.pdf")
+	require.NoError(t, err)
+	assert.Equal(t, "", o.(*Object).annotation)
+
+	_, err = f.Command(ctx, "annotate", []string{"doc.pdf", "{not json"}, nil)
+	assert.ErrorContains(t, err, "isn't valid JSON")
+	_, err = f.Command(ctx, "annotate", []string{"missing", "{}"}, nil)
+	assert.ErrorContains(t, err, "file not found")
+}
+
+func TestTags(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{})
+	putTestFile(t, f, "a/one.pdf", "one")
+	putTestFile(t, f, "b/two.pdf", "two")
+	putTestFile(t, f, "b/three.pdf", "three")
+
+	out, err := f.Command(ctx, "tag", []string{"a/one.pdf", "invoices", "customer-42"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"customer-42", "invoices"}, out.(*tagEntry).Tags)
+	_, err = f.Command(ctx, "tag", []string{"b/two.pdf", "invoices"}, nil)
+	require.NoError(t, err)
+	_, err = f.Command(ctx, "tag", []string{"b/three.pdf", "invoices"}, nil)
+	require.NoError(t, err)
+	out, err = f.Command(ctx, "untag", []string{"b/three.pdf", "invoices", "never-added"}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, out.(*tagEntry).Tags)
+
+	found, err := f.Command(ctx, "search", nil, map[string]string{"tag": "invoices"})
+	require.NoError(t, err)
+	var paths []string
+	for _, m := range found.(*searchResult).Matches {
+		paths = append(paths, m.Path)
+	}
+	assert.Equal(t, []string{"a/one.pdf", "b/two.pdf"}, paths)
+	assert.Equal(t, []string{"customer-42", "invoices"}, found.(*searchResult).Matches[0].Tags)
+
+	o, err := f.NewObject(ctx, "a/one.pdf")
+	require.NoError(t, err)
+	metadata, err := o.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "customer-42,invoices", metadata["tags"])
+
+	// Driving eviction by tag
+	out, err = f.Command(ctx, "evict", nil, map[string]string{"tag": "invoices"})
+	require.NoError(t, err)
+	assert.Len(t, out.([]evictEntry), 2)
+	o, err = f.NewObject(ctx, "b/three.pdf")
+	require.NoError(t, err)
+	assert.False(t, o.(*Object).evicted)
+
+	_, err = f.Command(ctx, "tag", []string{"a/one.pdf", "a,b"}, nil)
+	assert.ErrorContains(t, err, "invalid tag")
+	_, err = f.Command(ctx, "tag", []string{"missing", "x"}, nil)
+	assert.ErrorContains(t, err, "file not found")
+}
+
+func TestVirtualViews(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"virtual_views": "true"})
+	putTestFile(t, f, "a/one.txt", "one")
+	putTestFile(t, f, "a/b/two.txt", "two")
+	putTestFile(t, f, "three.txt", "three")
+	_, err := f.Command(ctx, "mark-processed", []string{"a/b/two.txt", "three.txt"}, nil)
+	require.NoError(t, err)
+	_, err = f.Command(ctx, "tag", []string{"a/one.txt", "invoices"}, nil)
+	require.NoError(t, err)
+
+	remotes := func(dir string) []string {
+		entries, err := f.List(ctx, dir)
+		require.NoError(t, err)
+		var remotes []string
+		for _, entry := range entries {
+			remotes = append(remotes, entry.Remote())
+		}
+		return remotes
+	}
+	assert.ElementsMatch(t, []string{".by-state", ".by-tag", "a", "three.txt"}, remotes(""))
+	assert.Equal(t, []string{".by-state/claimed", ".by-state/failed", ".by-state/pending", ".by-state/processed"}, remotes(byStateDir))
+	assert.ElementsMatch(t, []string{".by-state/processed/three.txt", ".by-state/processed/a"}, remotes(".by-state/processed"))
+	assert.Equal(t, []string{".by-state/processed/a/b/two.txt"}, remotes(".by-state/processed/a/b"))
+	assert.Equal(t, []string{".by-state/pending/a"}, remotes(".by-state/pending"))
+	assert.Empty(t, remotes(".by-state/failed"))
+	assert.Equal(t, []string{".by-tag/invoices"}, remotes(byTagDir))
+	assert.Equal(t, []string{".by-tag/invoices/a"}, remotes(".by-tag/invoices"))
+	for _, dir := range []string{".by-state/unknown", ".by-tag/missing", ".by-state/pending/a/b"} {
+		_, err = f.List(ctx, dir)
+		assert.ErrorIs(t, err, fs.ErrorDirNotFound, dir)
+	}
+
+	o, err := f.NewObject(ctx, ".by-tag/invoices/a/one.txt")
+	require.NoError(t, err)
+	assert.Equal(t, ".by-tag/invoices/a/one.txt", o.Remote())
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "one", string(data))
+	assert.ErrorIs(t, o.Remove(ctx), errInView)
+	assert.ErrorIs(t, o.SetModTime(ctx, time.Now()), errInView)
+	_, err = f.NewObject(ctx, ".by-state/pending/three.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = f.Put(ctx, strings.NewReader("x"), object.NewStaticObjectInfo(".by-state/pending/new.txt", time.Now(), 1, true, nil, nil))
+	assert.ErrorIs(t, err, errInView)
+
+	_, err = f.Command(ctx, "tag", []string{"a/one.txt", "a/b"}, nil)
+	assert.ErrorContains(t, err, "invalid tag")
+}
+
+func TestCacheMaxSize(t *testing.T) {
+	ctx := context.Background()
+	origin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(origin, "big"), []byte("a huge archive"), 0644))
+
+	f := newTestFs(t, configmap.Simple{"cache_max_size": "10B", "origin_remote": origin})
+	putTestFile(t, f, "small", "cached")
+	putTestFile(t, f, "big", "a huge archive")
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "small"))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "big"))
+
+	o, err := f.NewObject(ctx, "big")
+	require.NoError(t, err)
+	assert.True(t, o.(*Object).evicted)
+	sum, err := o.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	assert.NotEmpty(t, sum)
+
+	// Streamed from the origin without being cached
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "a huge archive", string(data))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "big"))
+	o, err = f.NewObject(ctx, "big")
+	require.NoError(t, err)
+	assert.True(t, o.(*Object).evicted)
+}
+
+func TestCacheHeadBytes(t *testing.T) {
+	ctx := context.Background()
+	origin := t.TempDir()
+	const contents = "HEADER,then a long body"
+	require.NoError(t, os.WriteFile(filepath.Join(origin, "big.csv"), []byte(contents), 0644))
+
+	f := newTestFs(t, configmap.Simple{"cache_head_bytes": "6B", "origin_remote": origin})
+	putTestFile(t, f, "small", "tiny")
+	putTestFile(t, f, "big.csv", contents)
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "small"))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "big.csv"))
+
+	o, err := f.NewObject(ctx, "big.csv")
+	require.NoError(t, err)
+	assert.True(t, o.(*Object).evicted)
+	assert.Equal(t, int64(6), o.(*Object).headSize)
+	sum, err := o.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	sums, err := hash.StreamTypes(strings.NewReader(contents), hash.NewHashSet(hash.MD5))
+	require.NoError(t, err)
+	assert.Equal(t, sums[hash.MD5], sum, "hashed from the whole file")
+
+	read := func(options ...fs.OpenOption) string {
+		in, err := o.Open(ctx, options...)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return string(data)
+	}
+
+	// Reads of the head come from the catalog
+	assert.Equal(t, "HEADER", read(&fs.RangeOption{Start: 0, End: 5}))
+	assert.Equal(t, "ADE", read(&fs.RangeOption{Start: 2, End: 4}))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "big.csv"))
+
+	// Anything more fetches the whole file
+	assert.Equal(t, contents, read())
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "big.csv"))
+	o, err = f.NewObject(ctx, "big.csv")
+	require.NoError(t, err)
+	assert.False(t, o.(*Object).evicted)
+	assert.Zero(t, o.(*Object).headSize)
+
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	_, err = NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", configmap.Simple{"root_directory": t.TempDir(), "cache_head_bytes": "2M"}))
+	assert.ErrorContains(t, err, "cache_head_bytes")
+}
+
+func TestChunkSize(t *testing.T) {
+	for _, compress := range []string{"none", "zstd"} {
+		t.Run(compress, func(t *testing.T) {
+			ctx := context.Background()
+			f := newTestFs(t, configmap.Simple{"chunk_size": "4B", "compress": compress})
+			blobs := func() int {
+				var n int
+				require.NoError(t, f.db.QueryRow(`SELECT COUNT(*) FROM blobs`).Scan(&n))
+				return n
+			}
+			o := putTestFile(t, f, "big", "aaaabbbbaaaacc")
+			putTestFile(t, f, "small", "tiny")
+			assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "big"))
+			assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "small"))
+			assert.Equal(t, 3, blobs(), "the repeated chunk is stored once")
+
+			out, err := f.Command(ctx, "chunks", []string{"big"}, nil)
+			require.NoError(t, err)
+			chunks := out.([]chunkEntry)
+			require.Len(t, chunks, 4)
+			assert.Equal(t, chunkEntry{Offset: 12, Size: 2, MD5: "e0323a9039add2978bf5b49550572c7c"}, chunks[3])
+			assert.Equal(t, chunks[0].MD5, chunks[2].MD5)
+
+			read := func(o fs.Object, options ...fs.OpenOption) string {
+				in, err := o.Open(ctx, options...)
+				require.NoError(t, err)
+				data, err := io.ReadAll(in)
+				require.NoError(t, err)
+				require.NoError(t, in.Close())
+				return string(data)
+			}
+			assert.Equal(t, "aaaabbbbaaaacc", read(o))
+			assert.Equal(t, "bbbaa", read(o, &fs.RangeOption{Start: 5, End: 9}))
+			assert.Equal(t, "acc", read(o, &fs.RangeOption{Start: 11, End: -1}))
+			assert.Equal(t, "bbaaaacc", read(o, &fs.SeekOption{Offset: 6}))
+
+			// A new version shares the chunks it has in common
+			o = putTestFile(t, f, "big", "aaaabbbbdd")
+			assert.Equal(t, 3, blobs(), "cc is dropped, dd added")
+			assert.Equal(t, "aaaabbbbdd", read(o))
+			res, err := f.Command(ctx, "scrub", nil, nil)
+			require.NoError(t, err)
+			assert.Empty(t, res.(*scrubResult).Corrupt)
+			assert.Empty(t, res.(*scrubResult).Missing)
+
+			o2 := putTestFile(t, f, "copy", "aaaazz")
+			require.NoError(t, o.Remove(ctx))
+			assert.Equal(t, 2, blobs(), "aaaa is still used by copy")
+			assert.Equal(t, "aaaazz", read(o2))
+			_, err = o2.(*Object).evict(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 0, blobs())
+			entries, err := os.ReadDir(filepath.Join(f.opt.RootDirectory, blobDir))
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
+}
+
+func TestResumePartial(t *testing.T) {
+	ctx := context.Background()
+	data := strings.Repeat("0123456789", 1000)
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	errInterrupted := errors.New("interrupted")
+	interrupted := func() io.Reader {
+		return io.MultiReader(strings.NewReader(data[:4000]), iotest.ErrReader(errInterrupted))
+	}
+	kept := func(t *testing.T, f *Fs) int64 {
+		var written int64
+		err := f.db.QueryRow(`SELECT written FROM partials WHERE remote = 'file.bin'`).Scan(&written)
+		if err == sql.ErrNoRows {
+			return 0
+		}
+		require.NoError(t, err)
+		return written
+	}
+	check := func(t *testing.T, f *Fs, want string) {
+		obj, err := f.NewObject(ctx, "file.bin")
+		require.NoError(t, err)
+		in, err := obj.Open(ctx)
+		require.NoError(t, err)
+		got, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		assert.Equal(t, want, string(got))
+		sums, err := hash.StreamTypes(strings.NewReader(want), hash.NewHashSet(hash.MD5))
+		require.NoError(t, err)
+		sum, err := obj.Hash(ctx, hash.MD5)
+		require.NoError(t, err)
+		assert.Equal(t, sums[hash.MD5], sum)
+		assert.Equal(t, int64(0), kept(t, f))
+		entries, err := os.ReadDir(f.opt.RootDirectory)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			assert.False(t, strings.HasPrefix(entry.Name(), incomingPrefix), entry.Name())
+		}
+	}
+
+	t.Run("Reopen", func(t *testing.T) {
+		f := newTestFs(t, configmap.Simple{"resume_partial": "1h"})
+		src := object.NewMemoryObject("file.bin", modTime, []byte(data))
+		_, err := f.Put(ctx, interrupted(), src)
+		require.ErrorIs(t, err, errInterrupted)
+		assert.Equal(t, int64(4000), kept(t, f))
+
+		// Reading in at all would fail, so the rest must come from src
+		_, err = f.Put(ctx, iotest.ErrReader(errInterrupted), src)
+		require.NoError(t, err)
+		check(t, f, data)
+	})
+
+	t.Run("Reread", func(t *testing.T) {
+		f := newTestFs(t, configmap.Simple{"resume_partial": "1h"})
+		src := object.NewStaticObjectInfo("file.bin", modTime, int64(len(data)), true, nil, nil)
+		_, err := f.Put(ctx, interrupted(), src)
+		require.ErrorIs(t, err, errInterrupted)
+		assert.Equal(t, int64(4000), kept(t, f))
+
+		// Only the start which matches is kept
+		changed := data[:2000] + strings.Repeat("x", len(data)-2000)
+		_, err = f.Put(ctx, strings.NewReader(changed), src)
+		require.NoError(t, err)
+		check(t, f, changed)
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		f := newTestFs(t, configmap.Simple{"resume_partial": "1h"})
+		src := object.NewStaticObjectInfo("file.bin", modTime, int64(len(data)), true, nil, nil)
+		_, err := f.Put(ctx, interrupted(), src)
+		require.ErrorIs(t, err, errInterrupted)
+
+		// A different modification time starts again
+		other := object.NewStaticObjectInfo("file.bin", modTime.Add(time.Second), int64(len(data)), true, nil, nil)
+		_, err = f.Put(ctx, strings.NewReader(data), other)
+		require.NoError(t, err)
+		check(t, f, data)
+	})
+
+	t.Run("Off", func(t *testing.T) {
+		f := newTestFs(t, nil)
+		src := object.NewMemoryObject("file.bin", modTime, []byte(data))
+		_, err := f.Put(ctx, interrupted(), src)
+		require.ErrorIs(t, err, errInterrupted)
+		assert.Equal(t, int64(0), kept(t, f))
+	})
+}
+
+func TestMultiStream(t *testing.T) {
+	data := strings.Repeat("0123456789", 1000) + "end"
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, compress := range []string{compressNone, compressZstd} {
+		t.Run(compress, func(t *testing.T) {
+			ctx, ci := fs.AddConfig(context.Background())
+			ci.MultiThreadStreams = 4
+			ci.MultiThreadSet = true
+			ci.MultiThreadCutoff = 1
+			ci.MultiThreadChunkSize = 1000
+			f := newTestFs(t, configmap.Simple{"compress": compress})
+			srcFs, err := fs.NewFs(ctx, ":memory:"+t.Name())
+			require.NoError(t, err)
+			src, err := srcFs.Put(ctx, strings.NewReader(data), object.NewStaticObjectInfo("file.bin", modTime, int64(len(data)), true, nil, nil))
+			require.NoError(t, err)
+
+			dst, err := operations.Copy(ctx, f, nil, "dir/file.bin", src)
+			require.NoError(t, err)
+			assert.Equal(t, "dir/file.bin", dst.Remote())
+			assert.Equal(t, int64(len(data)), dst.Size())
+			assert.True(t, modTime.Equal(dst.ModTime(ctx)))
+			in, err := dst.Open(ctx)
+			require.NoError(t, err)
+			got, err := io.ReadAll(in)
+			require.NoError(t, err)
+			require.NoError(t, in.Close())
+			assert.Equal(t, data, string(got))
+			sums, err := hash.StreamTypes(strings.NewReader(data), hash.NewHashSet(hash.MD5))
+			require.NoError(t, err)
+			sum, err := dst.Hash(ctx, hash.MD5)
+			require.NoError(t, err)
+			assert.Equal(t, sums[hash.MD5], sum)
+
+			// Copying it again finds it is there already
+			_, err = operations.Copy(ctx, f, dst, "dir/file.bin", src)
+			require.NoError(t, err)
+			entries, err := os.ReadDir(filepath.Join(f.opt.RootDirectory, "dir"))
+			require.NoError(t, err)
+			for _, entry := range entries {
+				assert.False(t, strings.HasPrefix(entry.Name(), incomingPrefix), entry.Name())
+			}
+		})
+	}
+}
+
+func TestWarm(t *testing.T) {
+	ctx := context.Background()
+	origin := t.TempDir()
+	files := map[string]string{
+		"dir/a.csv":  "aaa",
+		"dir/b.txt":  "bbb",
+		"other/c":    "ccc",
+		"dir/broken": "right",
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(origin, "dir"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(origin, "other"), 0755))
+	f := newTestFs(t, configmap.Simple{"origin_remote": origin})
+	for remote, contents := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(origin, remote), []byte(contents), 0644))
+		o := putTestFile(t, f, remote, contents)
+		_, err := o.(*Object).evict(ctx)
+		require.NoError(t, err)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(origin, "dir", "broken"), []byte("wrong"), 0644))
+	evicted := func(remote string) bool {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		return o.(*Object).evicted
+	}
+
+	out, err := f.Command(ctx, "warm", []string{"dir"}, map[string]string{"glob": "*.csv"})
+	require.NoError(t, err)
+	res := out.(*warmResult)
+	assert.Equal(t, 1, res.Fetched)
+	assert.Equal(t, int64(3), res.Bytes)
+	assert.Empty(t, res.Failed)
+	assert.False(t, evicted("dir/a.csv"))
+	assert.True(t, evicted("dir/b.txt"))
+
+	out, err = f.Command(ctx, "warm", []string{"dir"}, map[string]string{"concurrency": "2"})
+	require.NoError(t, err)
+	res = out.(*warmResult)
+	assert.Equal(t, 1, res.Fetched)
+	assert.Contains(t, res.Failed["dir/broken"], "doesn't match")
+	assert.False(t, evicted("dir/b.txt"))
+	assert.True(t, evicted("dir/broken"))
+	assert.True(t, evicted("other/c"))
+
+	_, err = f.Command(ctx, "warm", nil, map[string]string{"concurrency": "0"})
+	assert.ErrorContains(t, err, "invalid concurrency")
+
+	g := newTestFs(t, nil)
+	_, err = g.Command(ctx, "warm", nil, nil)
+	assert.ErrorContains(t, err, "origin_remote")
+}
+
+func TestAccessTracking(t *testing.T) {
+	ctx := context.Background()
+	read := func(t *testing.T, f *Fs, remote string, times int) {
+		for i := 0; i < times; i++ {
+			o, err := f.NewObject(ctx, remote)
+			require.NoError(t, err)
+			in, err := o.Open(ctx)
+			require.NoError(t, err)
+			_, err = io.ReadAll(in)
+			require.NoError(t, err)
+			require.NoError(t, in.Close())
+		}
+	}
+	evicted := func(t *testing.T, f *Fs) (remotes []string) {
+		remotes, err := f.queryRemotes(ctx, `SELECT remote FROM files WHERE evicted = 1 ORDER BY remote`)
+		require.NoError(t, err)
+		return remotes
+	}
+
+	for _, policy := range []string{evictionLRU, evictionLFU} {
+		t.Run(policy, func(t *testing.T) {
+			f := newTestFs(t, configmap.Simple{"eviction_policy": policy})
+			for _, remote := range []string{"often", "once", "never"} {
+				putTestFile(t, f, remote, "0123456789")
+			}
+			read(t, f, "often", 3)
+			read(t, f, "once", 1)
+			// Opened often but not lately
+			_, err := f.db.Exec(`UPDATE files SET last_access = ? WHERE remote = 'often'`, formatDBTime(time.Now().Add(-2*time.Hour)))
+			require.NoError(t, err)
+
+			o, err := f.NewObject(ctx, "often")
+			require.NoError(t, err)
+			meta, err := o.(*Object).Metadata(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, "3", meta["access-count"])
+			assert.NotEmpty(t, meta["last-access"])
+
+			_, err = f.evictLeastUsed(ctx, "", "", 1)
+			require.NoError(t, err)
+			if policy == evictionLRU {
+				assert.Equal(t, []string{"often"}, evicted(t, f))
+			} else {
+				assert.Equal(t, []string{"never"}, evicted(t, f))
+				_, err = f.evictLeastUsed(ctx, "", "", 1)
+				require.NoError(t, err)
+				assert.Equal(t, []string{"never", "once"}, evicted(t, f))
+			}
+		})
+	}
+
+	t.Run("Search", func(t *testing.T) {
+		f := newTestFs(t, nil)
+		for _, remote := range []string{"often", "once", "never"} {
+			putTestFile(t, f, remote, "0123456789")
+		}
+		read(t, f, "often", 2)
+		read(t, f, "once", 1)
+		_, err := f.db.Exec(`UPDATE files SET last_access = ? WHERE remote = 'never'`, formatDBTime(time.Now().Add(-2*time.Hour)))
+		require.NoError(t, err)
+		for opt, want := range map[string][]string{
+			"min-accesses=2": {"often"},
+			"max-accesses=0": {"never"},
+			"min-accesses=1": {"often", "once"},
+			"idle=1h":        {"never"},
+		} {
+			name, value, _ := strings.Cut(opt, "=")
+			out, err := f.Command(ctx, "search", nil, map[string]string{name: value})
+			require.NoError(t, err)
+			var got []string
+			for _, m := range out.(*searchResult).Matches {
+				got = append(got, m.Path)
+			}
+			assert.Equal(t, want, got, opt)
+		}
+		out, err := f.Command(ctx, "search", nil, map[string]string{"glob": "often"})
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), out.(*searchResult).Matches[0].Accesses)
+		_, err = f.Command(ctx, "search", nil, map[string]string{"idle": "soon"})
+		assert.ErrorContains(t, err, "invalid idle")
+	})
+
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	_, err = NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", configmap.Simple{"root_directory": t.TempDir(), "eviction_policy": "random"}))
+	assert.ErrorContains(t, err, "invalid eviction_policy")
+}
+
+func TestListChangedSince(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "top.txt", "top")
+	putTestFile(t, f, "a/old.txt", "old")
+	putTestFile(t, f, "a/b/deep.txt", "deep")
+	_, err := f.bookmark(ctx, []string{"a"})
+	require.NoError(t, err)
+	var seq int64
+	require.NoError(t, f.db.QueryRow(`SELECT MAX(seq) FROM journal`).Scan(&seq))
+	putTestFile(t, f, "a/new.txt", "new")
+	putTestFile(t, f, "a/old.txt", "old again")
+
+	for since, want := range map[string][]string{
+		"bookmark":                 {"a/b", "a/new.txt", "a/old.txt"},
+		strconv.FormatInt(seq, 10): {"a/b", "a/new.txt", "a/old.txt"},
+		"2000-01-01":               {"a/b", "a/b/deep.txt", "a/new.txt", "a/old.txt"},
+		"2100-01-01":               {"a/b"},
+	} {
+		f.changedSince, err = parseChangedSince(since)
+		require.NoError(t, err)
+		got := append(listNames(t, f, "a"), listNames(t, f, "a/b")...)
+		assert.ElementsMatch(t, want, got, since)
+	}
+
+	// Without a bookmark the top level is listed in full
+	f.changedSince, err = parseChangedSince("bookmark")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "top.txt"}, listNames(t, f, ""))
+	assert.Equal(t, []string{}, listNames(t, f, "a/b"))
+
+	_, err = parseChangedSince("yesterday-ish")
+	assert.ErrorContains(t, err, "invalid list_changed_since")
+}
+
+func TestDelta(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"delta": "true"})
+	putTestFile(t, f, "dir/one.txt", "one")
+	putTestFile(t, f, "dir/two.txt", "two")
+	putTestFile(t, f, "dir/claimed.txt", "claimed")
+	_, err := f.setStatus(ctx, []string{"dir/claimed.txt"}, statusClaimed)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"dir/one.txt", "dir/two.txt"}, listNames(t, f, "dir"))
+
+	read := func(remote string, options ...fs.OpenOption) {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		in, err := o.Open(ctx, options...)
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+	}
+
+	// Only reads of the whole file mark it processed
+	read("dir/one.txt", &fs.RangeOption{Start: 0, End: 0})
+	read("dir/two.txt")
+	assert.Equal(t, []string{"dir/one.txt"}, listNames(t, f, "dir"))
+	o, err := f.NewObject(ctx, "dir/two.txt")
+	require.NoError(t, err)
+	assert.Equal(t, statusProcessed, o.(*Object).status)
+
+	// Changing a file puts it back in the feed
+	putTestFile(t, f, "dir/two.txt", "two again")
+	assert.ElementsMatch(t, []string{"dir/one.txt", "dir/two.txt"}, listNames(t, f, "dir"))
+
+	// A file ingested again while it is read stays pending
+	o, err = f.NewObject(ctx, "dir/one.txt")
+	require.NoError(t, err)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	putTestFile(t, f, "dir/one.txt", "one again")
+	_, err = io.Copy(io.Discard, in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	o, err = f.NewObject(ctx, "dir/one.txt")
+	require.NoError(t, err)
+	assert.Equal(t, statusPending, o.(*Object).status)
+
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	_, err = NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", configmap.Simple{"root_directory": t.TempDir(), "delta": "true", "read_only": "true"}))
+	assert.ErrorContains(t, err, "delta can't be used with read_only")
+}
+
+func TestHardDelete(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"hard_delete": "true", "show_trash": "true"})
+	o := putTestFile(t, f, "dir/file.txt", "hello")
+	putTestFile(t, f, "dir/sub/other.txt", "other")
+	_, err := f.tagFiles(ctx, "dir/file.txt", []string{"keep"}, false)
+	require.NoError(t, err)
+
+	require.NoError(t, o.Remove(ctx))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "dir", "file.txt"))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "dir", "file.txt"+placeholderSuffix))
+	for _, table := range []string{"files", "tags"} {
+		var n int
+		require.NoError(t, f.db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE remote = 'dir/file.txt'`).Scan(&n))
+		assert.Equal(t, 0, n, table)
+	}
+	_, err = f.NewObject(ctx, "dir/file.txt")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+	assert.Equal(t, []string{"dir"}, listNames(t, f, ""))
+
+	// The deletion is still journalled
+	var event string
+	require.NoError(t, f.db.QueryRow(`SELECT event FROM journal WHERE remote = 'dir/file.txt' ORDER BY seq DESC LIMIT 1`).Scan(&event))
+	assert.Equal(t, eventDelete, event)
+
+	require.NoError(t, f.Purge(ctx, "dir"))
+	var n int
+	require.NoError(t, f.db.QueryRow(`SELECT COUNT(*) FROM files`).Scan(&n))
+	assert.Equal(t, 0, n)
+	putTestFile(t, f, "dir/file.txt", "back again")
+	assert.Equal(t, []string{"dir/file.txt"}, listNames(t, f, "dir"))
+}
+
+func TestRetentionPeriod(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"retention_period": "1h"})
+	o := putTestFile(t, f, "dir/new.txt", "new")
+	putTestFile(t, f, "dir/old.txt", "old")
+	_, err := f.db.Exec(`UPDATE files SET ingested_at = ? WHERE remote = 'dir/old.txt'`, formatDBTime(time.Now().Add(-2*time.Hour)))
+	require.NoError(t, err)
+	f.objects.remove("dir/old.txt")
+
+	err = o.Remove(ctx)
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+	assert.False(t, fserrors.IsRetryError(err))
+	src := object.NewStaticObjectInfo("dir/new.txt", time.Now(), 7, true, nil, nil)
+	assert.ErrorIs(t, o.Update(ctx, bytes.NewBufferString("changed"), src), fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, o.SetModTime(ctx, time.Now()), fs.ErrorPermissionDenied)
+	_, err = f.Put(ctx, bytes.NewBufferString("changed"), src)
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, f.Purge(ctx, "dir"), fs.ErrorPermissionDenied)
+	assert.ElementsMatch(t, []string{"dir/new.txt", "dir/old.txt"}, listNames(t, f, "dir"))
+
+	// Once the period is up the file can change, which is journalled,
+	// and go
+	old, err := f.NewObject(ctx, "dir/old.txt")
+	require.NoError(t, err)
+	modTime := time.Unix(1e9, 0)
+	require.NoError(t, old.SetModTime(ctx, modTime))
+	var event string
+	require.NoError(t, f.db.QueryRow(`SELECT event FROM journal WHERE remote = 'dir/old.txt' ORDER BY seq DESC LIMIT 1`).Scan(&event))
+	assert.Equal(t, eventUpdate, event)
+	old, err = f.NewObject(ctx, "dir/old.txt")
+	require.NoError(t, err)
+	assert.True(t, modTime.Equal(old.ModTime(ctx)))
+	require.NoError(t, old.Remove(ctx))
+	assert.Equal(t, []string{"dir/new.txt"}, listNames(t, f, "dir"))
+}
+
+func TestLegalHold(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"content_ttl": "1h", "audit_log": "true"})
+	putTestFile(t, f, "case/a.txt", "a")
+	putTestFile(t, f, "case/sub/b.txt", "b")
+	putTestFile(t, f, "other.txt", "other")
+
+	out, err := f.Command(ctx, "hold", []string{"case"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []holdEntry{{Path: "case/a.txt", Held: true}, {Path: "case/sub/b.txt", Held: true}}, out)
+	_, err = f.Command(ctx, "hold", []string{"missing"}, nil)
+	assert.ErrorContains(t, err, "file not found")
+
+	o, err := f.NewObject(ctx, "case/a.txt")
+	require.NoError(t, err)
+	metadata, err := o.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "true", metadata["legal-hold"])
+	assert.ErrorIs(t, o.Remove(ctx), fs.ErrorPermissionDenied)
+	src := object.NewStaticObjectInfo("case/a.txt", time.Now(), 7, true, nil, nil)
+	assert.ErrorIs(t, o.Update(ctx, bytes.NewBufferString("changed"), src), fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, o.SetModTime(ctx, time.Now()), fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, f.Purge(ctx, "case"), fs.ErrorPermissionDenied)
+	_, err = f.Command(ctx, "evict", []string{"case/a.txt"}, nil)
+	assert.ErrorContains(t, err, "under legal hold")
+
+	// Policies pass held files by
+	_, err = f.db.Exec(`UPDATE files SET last_access = ?`, formatDBTime(time.Now().Add(-2*time.Hour)))
+	require.NoError(t, err)
+	require.NoError(t, f.evictExpired(ctx))
+	for remote, evicted := range map[string]bool{"case/a.txt": false, "case/sub/b.txt": false, "other.txt": true} {
+		o, err := f.findObject(ctx, remote)
+		require.NoError(t, err)
+		assert.Equal(t, evicted, o.(*Object).evicted, remote)
+	}
+	_, err = (&Object{fs: f, remote: "case/a.txt"}).evict(ctx)
+	assert.ErrorIs(t, err, errHeld)
+
+	out, err = f.Command(ctx, "unhold", []string{"case/a.txt"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []holdEntry{{Path: "case/a.txt", Held: false}}, out)
+	o, err = f.NewObject(ctx, "case/a.txt")
+	require.NoError(t, err)
+	require.NoError(t, o.Remove(ctx))
+	var n int
+	require.NoError(t, f.db.QueryRow(`SELECT COUNT(*) FROM audit WHERE op = ?`, auditHold).Scan(&n))
+	assert.Equal(t, 3, n)
+}
+
+func TestErase(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"audit_log": "true", "keep_versions": "1", "resume_partial": "1h"})
+	putTestFile(t, f, "jane/cv.txt", "old cv")
+	putTestFile(t, f, "jane/cv.txt", "new cv")
+	putTestFile(t, f, "jane/photo.jpg", "photo")
+	putTestFile(t, f, "keep/jane.txt", "jane")
+	putTestFile(t, f, "keep/other.txt", "other")
+	_, err := f.tagFiles(ctx, "jane/cv.txt", []string{"hr"}, false)
+	require.NoError(t, err)
+	o, err := f.NewObject(ctx, "jane/photo.jpg")
+	require.NoError(t, err)
+	require.NoError(t, o.Remove(ctx))
+
+	_, err = f.Command(ctx, "hold", []string{"keep/jane.txt"}, nil)
+	require.NoError(t, err)
+	_, err = f.Command(ctx, "erase", []string{"jane", "**/jane.txt"}, nil)
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+	_, err = f.Command(ctx, "unhold", []string{"keep/jane.txt"}, nil)
+	require.NoError(t, err)
+	_, err = f.Command(ctx, "erase", []string{"/"}, nil)
+	assert.ErrorContains(t, err, "can't erase everything")
+
+	out, err := f.Command(ctx, "erase", []string{"jane", "**/jane.txt"}, map[string]string{"overwrite": "true", "reference": "ticket-1"})
+	require.NoError(t, err)
+	receipt := out.(*erasureReceipt)
+	assert.Equal(t, "ticket-1", receipt.Reference)
+	assert.Equal(t, 4, receipt.Files)
+	assert.Equal(t, int64(len("new cv")+len("jane")), receipt.Bytes)
+	assert.True(t, receipt.Overwritten)
+	sum := sha256.Sum256([]byte("jane\njane/cv.txt\njane/photo.jpg\nkeep/jane.txt\n"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), receipt.Digest)
+
+	for _, table := range append([]string{"files", "versions"}, erasedTables...) {
+		var n int
+		require.NoError(t, f.db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE remote LIKE 'jane%' OR remote = 'keep/jane.txt'`).Scan(&n))
+		assert.Equal(t, 0, n, table)
+	}
+	assert.NoDirExists(t, filepath.Join(f.opt.RootDirectory, "jane"))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "keep", "jane.txt"))
+	assert.Equal(t, []string{"keep/other.txt"}, listNames(t, f, "keep"))
+	var reference string
+	require.NoError(t, f.db.QueryRow(`SELECT reference FROM erasures WHERE id = ?`, receipt.ID).Scan(&reference))
+	assert.Equal(t, "ticket-1", reference)
+}
+
+func TestManifestParquet(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "a.txt", "a")
+	putTestFile(t, f, "b/c.txt", "c")
+	_, err := f.Command(ctx, "tag", []string{"a.txt", "red", "blue"}, nil)
+	require.NoError(t, err)
+
+	_, err = f.Command(ctx, "manifest", nil, map[string]string{"format": "parquet"})
+	assert.Error(t, err)
+
+	output := filepath.Join(t.TempDir(), "out", "catalog.parquet")
+	out, err := f.Command(ctx, "manifest", nil, map[string]string{"format": "parquet", "output": output})
+	require.NoError(t, err)
+	assert.Equal(t, output, out)
+
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Greater(t, len(data), 12)
+	assert.Equal(t, parquetMagic, string(data[:4]))
+	assert.Equal(t, parquetMagic, string(data[len(data)-4:]))
+	footerSize := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	require.Less(t, footerSize, len(data)-12)
+	footer := string(data[len(data)-8-footerSize : len(data)-8])
+	for _, column := range []string{"path", "size", "mtime", "hash", "status", "tags", "source"} {
+		assert.Contains(t, footer, column)
+	}
+	// The path column is first, with its values after a page header
+	assert.Contains(t, string(data), "\x05\x00\x00\x00a.txt\x07\x00\x00\x00b/c.txt")
+	assert.Contains(t, string(data), "\x08\x00\x00\x00blue,red")
+}
+
+func TestVerifyAgainst(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "same.txt", "same")
+	putTestFile(t, f, "dir/edited.txt", "old")
+	putTestFile(t, f, "dir/touched.txt", "touched")
+	putTestFile(t, f, "gone.txt", "gone")
+
+	origin := t.TempDir()
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	write := func(remote, contents string, modTime time.Time) {
+		p := filepath.Join(origin, filepath.FromSlash(remote))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(contents), 0644))
+		require.NoError(t, os.Chtimes(p, modTime, modTime))
+	}
+	write("same.txt", "same", modTime)
+	write("dir/edited.txt", "new", modTime)
+	write("dir/touched.txt", "touched", modTime.Add(time.Hour))
+	write("dir/added.txt", "added", modTime)
+
+	out, err := f.Command(ctx, "verify-against", []string{origin}, nil)
+	require.NoError(t, err)
+	res := out.(*driftResult)
+	assert.Equal(t, 5, res.Checked)
+	require.Len(t, res.Changed, 2)
+	assert.Equal(t, "dir/edited.txt", res.Changed[0].Path)
+	assert.Equal(t, []string{"md5"}, res.Changed[0].Differs)
+	assert.Equal(t, "dir/touched.txt", res.Changed[1].Path)
+	assert.Equal(t, []string{"modtime"}, res.Changed[1].Differs)
+	assert.Equal(t, []string{"gone.txt"}, res.MissingUpstream)
+	assert.Equal(t, []string{"dir/added.txt"}, res.MissingFromCatalog)
+
+	out, err = f.Command(ctx, "verify-against", []string{origin, "dir"}, nil)
+	require.NoError(t, err)
+	res = out.(*driftResult)
+	assert.Equal(t, 3, res.Checked)
+	assert.Empty(t, res.MissingUpstream)
+
+	_, err = f.Command(ctx, "verify-against", nil, nil)
+	assert.Error(t, err)
+}
+
+func TestListJSONMetadata(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"show_trash": "true"})
+	putTestFile(t, f, "done.txt", "done")
+	putTestFile(t, f, "todo.txt", "todo")
+	_, err := f.Command(ctx, "mark-processed", []string{"done.txt"}, nil)
+	require.NoError(t, err)
+	o := putTestFile(t, f, "gone.txt", "gone")
+	require.NoError(t, o.Remove(ctx))
+
+	metadata := map[string]fs.Metadata{}
+	err = operations.ListJSON(ctx, f, "", &operations.ListJSONOpt{Recurse: true, Metadata: true, FilesOnly: true}, func(item *operations.ListJSONItem) error {
+		metadata[item.Path] = item.Metadata
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, metadata, 3)
+	assert.Equal(t, "true", metadata["done.txt"]["processed"])
+	assert.Equal(t, "false", metadata["todo.txt"]["processed"])
+	assert.Equal(t, "false", metadata["todo.txt"]["deleted"])
+	assert.Equal(t, "true", metadata[path.Join(trashDir, "gone.txt")]["deleted"])
+	for _, key := range []string{"status", "evicted", "ingest-time", "access-count"} {
+		assert.Contains(t, metadata["todo.txt"], key)
+	}
+}
+
+func TestRootDirectoryExpansion(t *testing.T) {
+	ctx := context.Background()
+	oldConfigPath := config.GetConfigPath()
+	oldCacheDir := config.GetCacheDir()
+	t.Cleanup(func() {
+		require.NoError(t, config.SetConfigPath(oldConfigPath))
+		require.NoError(t, config.SetCacheDir(oldCacheDir))
+	})
+	configDir := t.TempDir()
+	require.NoError(t, config.SetConfigPath(filepath.Join(configDir, "rclone.conf")))
+	t.Setenv("VIRTUALFS_TEST_DIR", configDir)
+
+	assert.Equal(t, filepath.Join(configDir, "data"), expandPath("data"))
+	assert.Equal(t, filepath.Join(configDir, "data"), expandPath("${VIRTUALFS_TEST_DIR}/data"))
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(home, "data"), expandPath("~/data"))
+	assert.Equal(t, "", expandPath(""))
+
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	f, err := NewFs(ctx, "test", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "test", configmap.Simple{"root_directory": "data", "db_path": "$VIRTUALFS_TEST_DIR/db/catalog.db"}))
+	require.NoError(t, err)
+	require.NoError(t, f.(*Fs).Shutdown(ctx))
+	assert.DirExists(t, filepath.Join(configDir, "data"))
+	assert.FileExists(t, filepath.Join(configDir, "db", "catalog.db"))
+
+	// Without a root_directory everything goes in the cache directory
+	cacheDir := t.TempDir()
+	require.NoError(t, config.SetCacheDir(cacheDir))
+	f, err = NewFs(ctx, ":virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, ":virtualfs", configmap.Simple{}))
+	require.NoError(t, err)
+	require.NoError(t, f.(*Fs).Shutdown(ctx))
+	assert.FileExists(t, filepath.Join(cacheDir, defaultRootDir, "virtualfs", dbName))
+}
+
+func TestHealth(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	f := newTestFs(t, configmap.Simple{"root_directory": root})
+	putTestFile(t, f, "file.txt", "content")
+	oldFreeSpace := freeSpace
+	t.Cleanup(func() { freeSpace = oldFreeSpace })
+	freeSpace = func(string) (int64, error) { return 1 << 20, nil }
+
+	out, err := f.Command(ctx, "health", nil, nil)
+	require.NoError(t, err)
+	res := out.(*healthResult)
+	assert.True(t, res.Healthy)
+	var names []string
+	for _, c := range res.Checks {
+		assert.True(t, c.OK, c.Name)
+		names = append(names, c.Name)
+	}
+	assert.Equal(t, []string{healthDatabase, healthWritable, healthRoot, healthFree, healthWAL}, names)
+	entries, err := os.ReadDir(filepath.Join(root, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, entries, "probe removed")
+
+	out, err = f.Command(ctx, "health", nil, map[string]string{"min-free": "2M", "max-wal": "1"})
+	require.NoError(t, err)
+	res = out.(*healthResult)
+	assert.False(t, res.Healthy)
+	for _, c := range res.Checks {
+		assert.Equal(t, c.Name != healthFree && c.Name != healthWAL, c.OK, c.Name)
+	}
+
+	_, err = f.Command(ctx, "health", nil, map[string]string{"min-free": "lots"})
+	assert.Error(t, err)
+
+	cache.Put("healthtest:", f)
+	t.Cleanup(cache.Clear)
+	rcOut, err := rc.Calls.Get("virtualfs/health").Fn(ctx, rc.Params{"fs": "healthtest:", "min-free": "1K"})
+	require.NoError(t, err)
+	assert.Equal(t, true, rcOut["healthy"])
+}
+
+func TestLockedTimeout(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	f := newTestFs(t, configmap.Simple{"root_directory": root, "busy_timeout": "10ms", "locked_timeout": "300ms"})
+	putTestFile(t, f, "before", "data")
+
+	db, err := sql.Open("sqlite3", filepath.Join(root, dbName))
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	conn, err := db.Conn(ctx)
+	require.NoError(t, err)
+	_, err = conn.ExecContext(ctx, `BEGIN IMMEDIATE`)
+	require.NoError(t, err)
+
+	start := time.Now()
+	src := object.NewStaticObjectInfo("locked", time.Now(), 4, true, nil, nil)
+	_, err = f.Put(ctx, strings.NewReader("data"), src)
+	assert.ErrorContains(t, err, "locked by another process for longer than locked_timeout")
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+
+	_, err = conn.ExecContext(ctx, `COMMIT`)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	putTestFile(t, f, "after", "data")
+
+	regInfo, err := fs.Find("virtualfs")
+	require.NoError(t, err)
+	_, err = NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", configmap.Simple{"root_directory": t.TempDir(), "locked_timeout": "-1s"}))
+	assert.ErrorContains(t, err, "invalid locked_timeout")
+}
+
+func TestIngestJournal(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	f := newTestFs(t, configmap.Simple{"root_directory": root, "ingest_journal": "true"})
+	putTestFile(t, f, "dir/live.txt", "live")
+	count := func() (n int) {
+		require.NoError(t, f.db.QueryRow(`SELECT COUNT(*) FROM ingests`).Scan(&n))
+		return n
+	}
+	assert.Equal(t, 0, count(), "entry removed once recorded")
+
+	// What a crash part way through three uploads and a fourth still
+	// under way leaves behind
+	old := formatDBTime(time.Now().Add(-2 * recoverMinAge))
+	tmp := filepath.Join(root, incomingPrefix+"123")
+	require.NoError(t, os.WriteFile(tmp, []byte("half"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "fresh.txt"), []byte("fresh"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "dir", "live.txt"), []byte("replaced"), 0644))
+	recent := filepath.Join(root, incomingPrefix+"456")
+	require.NoError(t, os.WriteFile(recent, []byte("still writing"), 0644))
+	for _, e := range []struct {
+		remote, tmp string
+		key         interface{}
+		started     string
+	}{
+		{"new.txt", tmp, nil, old},
+		{"fresh.txt", filepath.Join(root, incomingPrefix+"gone"), f.contentKey("fresh.txt", ""), old},
+		{"dir/live.txt", filepath.Join(root, "dir", incomingPrefix+"gone"), f.contentKey("dir/live.txt", ""), old},
+		{"busy.txt", recent, nil, formatDBTime(time.Now())},
+	} {
+		_, err := f.db.Exec(`INSERT INTO ingests (remote, tmp, key, started_at) VALUES (?, ?, ?, ?)`, e.remote, e.tmp, e.key, e.started)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, f.recoverCrash(ctx))
+	assert.Equal(t, 1, count(), "only the upload under way is left")
+	assert.NoFileExists(t, tmp)
+	assert.NoFileExists(t, filepath.Join(root, "fresh.txt"))
+	assert.FileExists(t, recent)
+	var corrupt bool
+	require.NoError(t, f.db.QueryRow(`SELECT corrupt FROM files WHERE remote = ?`, "dir/live.txt").Scan(&corrupt))
+	assert.True(t, corrupt)
+}
+
+// onRead calls fn before the first read made of it
+type onRead struct {
+	io.Reader
+	fn func()
+}
+
+func (r *onRead) Read(p []byte) (int, error) {
+	if r.fn != nil {
+		r.fn()
+		r.fn = nil
+	}
+	return r.Reader.Read(p)
+}
+
+func TestStagingDir(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	root := f.opt.RootDirectory
+	staging := filepath.Join(root, stagingDir)
+	putTestFile(t, f, "dir/old.txt", "old")
+
+	var staged, outside []string
+	in := &onRead{Reader: strings.NewReader("being written"), fn: func() {
+		entries, err := os.ReadDir(staging)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			staged = append(staged, entry.Name())
+		}
+		require.NoError(t, filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+			if p == staging {
+				return filepath.SkipDir
+			}
+			if strings.HasPrefix(d.Name(), incomingPrefix) {
+				outside = append(outside, p)
+			}
+			return err
+		}))
+	}}
+	src := object.NewStaticObjectInfo("dir/new.txt", time.Now(), 13, true, nil, nil)
+	_, err := f.Put(ctx, in, src)
+	require.NoError(t, err)
+	require.Len(t, staged, 1)
+	assert.True(t, strings.HasPrefix(staged[0], incomingPrefix), staged[0])
+	assert.Empty(t, outside)
+	got, err := os.ReadFile(filepath.Join(root, "dir", "new.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "being written", string(got))
+	entries, err := os.ReadDir(staging)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Left over by a crash
+	old := time.Now().Add(-2 * recoverMinAge)
+	tmp := filepath.Join(staging, incomingPrefix+"123")
+	require.NoError(t, os.WriteFile(tmp, []byte("half written"), 0644))
+	require.NoError(t, os.Chtimes(tmp, old, old))
+	recent := filepath.Join(staging, incomingPrefix+"456")
+	require.NoError(t, os.WriteFile(recent, []byte("still writing"), 0644))
+	require.NoError(t, f.recoverCrash(ctx))
+	assert.NoFileExists(t, tmp)
+	assert.FileExists(t, recent)
+	assert.ElementsMatch(t, []string{"dir/new.txt", "dir/old.txt"}, listNames(t, f, "dir"))
+}
+
+func TestBench(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "dir/a.txt", "a")
+	putTestFile(t, f, "dir/b.txt", "b")
+
+	out, err := f.Command(ctx, "bench", []string{"dir"}, map[string]string{"files": "50", "size": "1M"})
+	require.NoError(t, err)
+	res := out.(*benchResult)
+	assert.Contains(t, res.Driver, "sqlite3 ")
+	assert.Equal(t, "wal", res.Pragmas["journal_mode"])
+	assert.Equal(t, 50, res.Catalog.Files)
+	assert.Greater(t, res.Catalog.InsertsPerSecond, 0.0)
+	assert.Greater(t, res.Catalog.LookupsPerSecond, 0.0)
+	assert.NoDirExists(t, filepath.Dir(res.Catalog.Path))
+	assert.Equal(t, benchList{Dir: "dir", Entries: 2, LatencyMs: res.List.LatencyMs}, res.List)
+	require.Len(t, res.Writes, 1)
+	assert.Equal(t, int64(1<<20), res.Writes[0].Bytes)
+	assert.Greater(t, res.Writes[0].BytesPerSecond, 0.0)
+	entries, err := os.ReadDir(res.Writes[0].Path)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Nothing was added to the real catalog
+	var n int
+	require.NoError(t, f.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM files WHERE is_dir = 0`).Scan(&n))
+	assert.Equal(t, 2, n)
+
+	_, err = f.Command(ctx, "bench", nil, map[string]string{"files": "0"})
+	assert.Error(t, err)
+}
+
+func TestModifyWindow(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"ingest_compare": "size+modtime", "modify_window": "2s"})
+	assert.Equal(t, 2*time.Second, f.Precision())
+	putTestFile(t, f, "file", "aaaa")
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Within the window the file hasn't changed so it isn't read
+	src := object.NewStaticObjectInfo("file", mtime.Add(-1500*time.Millisecond), 4, true, nil, nil)
+	_, err := f.Put(ctx, iotest.ErrReader(errors.New("source read")), src)
+	require.NoError(t, err)
+
+	src = object.NewStaticObjectInfo("file", mtime.Add(3*time.Second), 4, true, nil, nil)
+	o, err := f.Put(ctx, bytes.NewBufferString("bbbb"), src)
+	require.NoError(t, err)
+	assert.Equal(t, mtime.Add(3*time.Second), o.ModTime(ctx))
+
+	exact := newTestFs(t, nil)
+	assert.Equal(t, time.Nanosecond, exact.Precision())
+
+	regInfo, _ := fs.Find("virtualfs")
+	_, err = NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", configmap.Simple{
+		"root_directory": t.TempDir(),
+		"modify_window":  "-1s",
+	}))
+	assert.ErrorContains(t, err, "invalid modify_window")
+}
+
+func TestContentRootLongPaths(t *testing.T) {
+	assert.True(t, filepath.IsAbs(contentRoot("relative")))
+	if runtime.GOOS == "windows" {
+		assert.Equal(t, `\\?\C:\virtualfs`, contentRoot(`C:\virtualfs`))
+	}
+
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	deep := strings.Repeat("directory-name/", 20) + "file.txt"
+	require.Greater(t, len(filepath.Join(f.opt.RootDirectory, deep)), 260)
+	putTestFile(t, f, deep, "deep")
+	o, err := f.NewObject(ctx, deep)
+	require.NoError(t, err)
+	rc, err := o.Open(ctx)
+	require.NoError(t, err)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, rc.Close())
+	require.NoError(t, err)
+	assert.Equal(t, "deep", string(got))
+}
+
+func TestIDLayout(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"content_layout": "id"})
+	long := "dir/" + strings.Repeat("n", 300) + ".txt"
+	o := putTestFile(t, f, long, "by id")
+	p := o.(*Object).contentPath
+	assert.Regexp(t, `^ids/[0-9a-f]{2}/[0-9a-f]{2}/[0-9a-f]{32}$`, p)
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, filepath.FromSlash(p)))
+	assert.NoDirExists(t, filepath.Join(f.opt.RootDirectory, "dir"))
+
+	// Each upload gets content of its own, the old one being removed
+	o = putTestFile(t, f, long, "new content")
+	assert.NotEqual(t, p, o.(*Object).contentPath)
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, filepath.FromSlash(p)))
+	p = o.(*Object).contentPath
+
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "new content", string(data))
+
+	res, err := f.gc(ctx, false, 0)
+	require.NoError(t, err)
+	assert.Empty(t, res.Orphans)
+
+	require.NoError(t, o.Remove(ctx))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, filepath.FromSlash(p)))
+}
+
+func TestFileTTL(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"content_ttl": "1h"})
+	for _, name := range []string{"reference/a", "reference/b", "scratch", "plain"} {
+		putTestFile(t, f, name, name)
+	}
+
+	out, err := f.Command(ctx, "set-ttl", []string{"reference"}, map[string]string{"ttl": "off"})
+	require.NoError(t, err)
+	assert.Equal(t, []ttlEntry{{Path: "reference/a", TTL: "off"}, {Path: "reference/b", TTL: "off"}}, out)
+	_, err = f.Command(ctx, "set-ttl", []string{"scratch"}, map[string]string{"ttl": "10m"})
+	require.NoError(t, err)
+	_, err = f.Command(ctx, "set-ttl", []string{"plain"}, map[string]string{"ttl": "forever"})
+	assert.ErrorContains(t, err, "invalid TTL")
+
+	// Uploading again keeps the TTL
+	putTestFile(t, f, "reference/a", "new")
+	o, err := f.NewObject(ctx, "reference/a")
+	require.NoError(t, err)
+	meta, err := o.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "off", meta[ttlMetadataKey])
+
+	_, err = f.db.Exec(`UPDATE files SET last_access = ?`, formatDBTime(time.Now().Add(-30*time.Minute)))
+	require.NoError(t, err)
+	require.NoError(t, f.evictExpired(ctx))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "scratch"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "plain"))
+
+	_, err = f.db.Exec(`UPDATE files SET last_access = ?`, formatDBTime(time.Now().Add(-2*time.Hour)))
+	require.NoError(t, err)
+	require.NoError(t, f.evictExpired(ctx))
+	assert.NoFileExists(t, filepath.Join(f.opt.RootDirectory, "plain"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "reference", "a"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "reference", "b"))
+
+	// Set through the metadata
+	metaCtx, ci := fs.AddConfig(ctx)
+	ci.Metadata = true
+	src := object.NewStaticObjectInfo("pinned", time.Now(), 3, true, nil, nil)
+	o, err = f.Put(metaCtx, bytes.NewBufferString("pin"), src, fs.MetadataOption(fs.Metadata{ttlMetadataKey: "off"}))
+	require.NoError(t, err)
+	meta, err = o.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "off", meta[ttlMetadataKey])
+	require.NoError(t, o.(*Object).SetMetadata(ctx, fs.Metadata{ttlMetadataKey: "default"}))
+	o, err = f.NewObject(ctx, "pinned")
+	require.NoError(t, err)
+	meta, err = o.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.NotContains(t, meta, ttlMetadataKey)
+	require.NoError(t, o.(*Object).SetMetadata(ctx, fs.Metadata{ttlMetadataKey: "1d"}))
+	o, err = f.NewObject(ctx, "pinned")
+	require.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, o.(*Object).ttl)
+}
+
+func TestMaintenanceSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		require.NoError(t, err)
+		return tm
+	}
+	sched, err := parseSchedule("* 2-5 * * *")
+	require.NoError(t, err)
+	assert.True(t, sched.matches(at("2024-01-02 02:00")))
+	assert.True(t, sched.matches(at("2024-01-02 05:59")))
+	assert.False(t, sched.matches(at("2024-01-02 06:00")))
+	assert.Equal(t, at("2024-01-03 02:00"), sched.next(at("2024-01-02 09:30")))
+	assert.Equal(t, at("2024-01-02 03:10"), sched.next(at("2024-01-02 03:10")))
+	assert.Equal(t, at("2024-01-02 06:00"), sched.end(at("2024-01-02 03:10")))
+
+	// Steps, lists and Sunday as 7
+	sched, err = parseSchedule("*/15 22 * * 6,7")
+	require.NoError(t, err)
+	assert.Equal(t, at("2024-01-06 22:00"), sched.next(at("2024-01-02 09:30"))) // a Saturday
+	assert.Equal(t, at("2024-01-06 22:15"), sched.next(at("2024-01-06 22:01")))
+	assert.Equal(t, at("2024-01-07 22:00"), sched.next(at("2024-01-06 23:00")))
+
+	// Day of month or week, if both are given
+	sched, err = parseSchedule("0 0 1 * 1")
+	require.NoError(t, err)
+	assert.Equal(t, at("2024-02-01 00:00"), sched.next(at("2024-01-29 00:01"))) // after a Monday
+	assert.Equal(t, at("2024-01-08 00:00"), sched.next(at("2024-01-02 00:00")))
+
+	sched, err = parseSchedule("* * * * *")
+	require.NoError(t, err)
+	assert.True(t, sched.end(time.Now()).IsZero())
+
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *", "x * * * *", "0 0 31 2 *"} {
+		_, err = parseSchedule(bad)
+		assert.Error(t, err, bad)
+	}
+
+	regInfo, _ := fs.Find("virtualfs")
+	_, err = NewFs(context.Background(), "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", configmap.Simple{
+		"root_directory":       t.TempDir(),
+		"maintenance_schedule": "* 25 * * *",
+	}))
+	assert.ErrorContains(t, err, "maintenance_schedule")
+
+	// Tasks only run in the schedule
+	run := func(hour int) bool {
+		f := newTestFs(t, nil)
+		f.schedule = &cronSchedule{minute: 1<<60 - 1, hour: 1 << uint(hour), month: 1<<13 - 2, anyDom: true, anyDow: true}
+		ran := make(chan struct{}, 1)
+		f.startMaintenance("test", time.Hour, func(ctx context.Context) error {
+			ran <- struct{}{}
+			return nil
+		})
+		select {
+		case <-ran:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+	now := time.Now()
+	if now.Add(time.Second).Hour() == now.Hour() {
+		assert.True(t, run(now.Hour()))
+	}
+	assert.False(t, run((now.Hour()+12)%24))
+}
+
+func TestConfigWizard(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+	m := configmap.Simple{"root_directory": file}
+	// answer gives result to state, following the states which don't
+	// ask anything, and returns the next question or error
+	answer := func(state, result string) *fs.ConfigOut {
+		for {
+			out, err := Config(ctx, "test", m, fs.ConfigIn{State: state, Result: result})
+			require.NoError(t, err)
+			if out == nil || out.State == "" || out.Option != nil || out.Error != "" {
+				return out
+			}
+			state, result = out.State, out.Result
+		}
+	}
+	out := answer("", "")
+	assert.Equal(t, "config_guided", out.Option.Name)
+
+	// A root directory which can't be used is asked for again
+	out = answer(out.State, "true")
+	assert.Contains(t, out.Error, "not a directory")
+	out = answer(out.State, "")
+	assert.Equal(t, "root_directory", out.Option.Name)
+	dir := t.TempDir()
+	out = answer(out.State, dir)
+	assert.Equal(t, "db_path", out.Option.Name)
+	assert.Equal(t, dir, m["root_directory"])
+
+	// So is a catalog path which is a directory
+	out = answer(out.State, dir)
+	assert.Contains(t, out.Error, "is a directory")
+	out = answer(out.State, "")
+	assert.Equal(t, "db_path", out.Option.Name)
+	out = answer(out.State, "")
+	assert.Equal(t, "config_eviction", out.Option.Name)
+	assert.Equal(t, configEvictKeep, out.Option.Default)
+	_, set := m["db_path"]
+	assert.False(t, set)
+
+	out = answer(out.State, configEvictTTL)
+	assert.Equal(t, "content_ttl", out.Option.Name)
+	out = answer(out.State, "forever")
+	assert.Contains(t, out.Error, "Invalid content_ttl")
+	out = answer(out.State, "")
+	assert.Equal(t, "config_eviction", out.Option.Name)
+	out = answer(out.State, configEvictTTL)
+	out = answer(out.State, "7d")
+	assert.Equal(t, "7d", m["content_ttl"])
+	assert.Equal(t, "deletion_mode", out.Option.Name)
+	out = answer(out.State, "shred")
+	assert.Contains(t, out.Error, "Invalid deletion_mode")
+	out = answer(out.State, "")
+	out = answer(out.State, deletionHidden)
+	assert.Equal(t, "", out.State)
+	assert.Equal(t, deletionHidden, m["deletion_mode"])
+
+	// Editing again starts from the current choices
+	out = answer("evict", "")
+	assert.Equal(t, configEvictTTL, out.Option.Default)
+	out = answer(out.State, configEvictTTL)
+	assert.Equal(t, fs.Duration(7*24*time.Hour), out.Option.Default)
+
+	// Remotes which can't be parsed are asked for again
+	m["origin_remote"] = "nosuchremote:bucket"
+	out = answer("remotes", "")
+	assert.Contains(t, out.Error, "origin_remote")
+	out = answer(out.State, "")
+	assert.Equal(t, "origin_remote", out.Option.Name)
+
+	// Declining the guided config asks nothing more
+	assert.Nil(t, answer("guided", "false"))
+}
+
+func TestNewFsValidation(t *testing.T) {
+	regInfo, _ := fs.Find("virtualfs")
+	newFs := func(config configmap.Simple) error {
+		_, err := NewFs(context.Background(), "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", config))
+		return err
+	}
+	assert.ErrorContains(t, newFs(configmap.Simple{"root_directory": string(filepath.Separator)}), "top of a filesystem")
+	if home, err := os.UserHomeDir(); err == nil {
+		assert.ErrorContains(t, newFs(configmap.Simple{"root_directory": home}), "home directory")
+	}
+	if runtime.GOOS != "windows" {
+		assert.ErrorContains(t, newFs(configmap.Simple{"root_directory": "/etc"}), "system directory")
+	}
+
+	err := newFs(configmap.Simple{"root_directory": t.TempDir(), "store_content": "false", "scrub_interval": "1d"})
+	assert.ErrorContains(t, err, "scrub_interval can't be used with store_content false")
+	err = newFs(configmap.Simple{"root_directory": t.TempDir(), "store_content": "false", "compress": compressZstd})
+	assert.ErrorContains(t, err, "compress can't be used")
+
+	if runtime.GOOS != "windows" && os.Geteuid() != 0 {
+		dir := t.TempDir()
+		require.NoError(t, os.Chmod(dir, 0555))
+		defer func() {
+			_ = os.Chmod(dir, 0755)
+		}()
+		assert.ErrorContains(t, newFs(configmap.Simple{"root_directory": dir}), "isn't writable")
+	}
+
+	assert.NoError(t, checkRootDirectory(t.TempDir()))
+}
+
+func TestOriginHashes(t *testing.T) {
+	ctx := context.Background()
+	origin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(origin, "file"), []byte("hello"), 0644))
+
+	f := newTestFs(t, configmap.Simple{"origin_remote": origin, "hash_types": "origin"})
+	assert.True(t, f.Hashes().Contains(hash.MD5))
+	assert.True(t, f.Hashes().Contains(hash.SHA256))
+	_, err := parseHashTypes(fs.CommaSepList{hashOrigin}, nil)
+	assert.ErrorContains(t, err, "needs origin_remote")
+
+	// Hashes missing for content not held are read from the origin
+	f = newTestFs(t, configmap.Simple{"origin_remote": origin, "hash_types": "md5,sha1"})
+	o := putTestFile(t, f, "file", "hello")
+	_, err = o.(*Object).evict(ctx)
+	require.NoError(t, err)
+	_, err = f.db.Exec(`DELETE FROM hashes WHERE type = 'sha1'`)
+	require.NoError(t, err)
+	o, err = f.NewObject(ctx, "file")
+	require.NoError(t, err)
+	sum, err := o.Hash(ctx, hash.SHA1)
+	require.NoError(t, err)
+	assert.Equal(t, "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", sum)
+	stored, err := f.lookupHash(ctx, "file", hash.SHA1)
+	require.NoError(t, err)
+	assert.Equal(t, sum, stored)
+}
+
+func TestConflictPolicy(t *testing.T) {
+	ctx := context.Background()
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)
+	content := func(f *Fs, remote string) string {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return string(data)
+	}
+	// race puts "mine" at "dir/file.txt" with modification time
+	// modTime, with another upload of "theirs" committed while it is
+	// being read
+	race := func(policy string, modTime time.Time) (*Fs, fs.Object, error) {
+		f := newTestFs(t, configmap.Simple{"conflict_policy": policy})
+		in := &onRead{Reader: bytes.NewBufferString("mine"), fn: func() {
+			putTestFile(t, f, "dir/file.txt", "theirs")
+		}}
+		o, err := f.Put(ctx, in, object.NewStaticObjectInfo("dir/file.txt", modTime, 4, true, nil, nil))
+		return f, o, err
+	}
+
+	f, _, err := race(conflictOverwrite, older)
+	require.NoError(t, err)
+	assert.Equal(t, "mine", content(f, "dir/file.txt"))
+
+	f, _, err = race(conflictError, newer)
+	assert.ErrorIs(t, err, errWriteConflict)
+	assert.True(t, fserrors.IsNoRetryError(err))
+	assert.Equal(t, "theirs", content(f, "dir/file.txt"))
+	entries, err := os.ReadDir(filepath.Join(f.opt.RootDirectory, stagingDir))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	f, o, err := race(conflictNewestWins, older)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("theirs")), o.Size())
+	assert.Equal(t, "theirs", content(f, "dir/file.txt"))
+	f, _, err = race(conflictNewestWins, newer)
+	require.NoError(t, err)
+	assert.Equal(t, "mine", content(f, "dir/file.txt"))
+
+	f, o, err = race(conflictKeepBoth, newer)
+	require.NoError(t, err)
+	assert.Equal(t, "dir/file-conflict-1.txt", o.Remote())
+	assert.Equal(t, "theirs", content(f, "dir/file.txt"))
+	assert.Equal(t, "mine", content(f, "dir/file-conflict-1.txt"))
+	assert.FileExists(t, filepath.Join(f.opt.RootDirectory, "dir", "file-conflict-1.txt"))
+
+	// Uploads one after the other don't conflict
+	f = newTestFs(t, configmap.Simple{"conflict_policy": conflictError})
+	putTestFile(t, f, "file", "one")
+	putTestFile(t, f, "file", "two")
+	assert.Equal(t, "two", content(f, "file"))
+}
+
+func TestSyncMarkers(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "batches/1/a", "a")
+	putTestFile(t, f, "batches/2/b", "b")
+
+	out, err := f.Command(ctx, "mark-synced", []string{"batches/1"}, nil)
+	require.NoError(t, err)
+	markers := out.([]syncMarker)
+	require.Len(t, markers, 1)
+	assert.Equal(t, "batches/1", markers[0].Path)
+	assert.True(t, markers[0].Complete)
+
+	_, err = f.Command(ctx, "mark-synced", []string{"batches/2"}, map[string]string{"at": "1h"})
+	require.NoError(t, err)
+	_, err = f.Command(ctx, "mark-synced", []string{"batches/missing"}, nil)
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+
+	// batches/2 was written to after its sync finished
+	out, err = f.Command(ctx, "sync-status", []string{"batches"}, nil)
+	require.NoError(t, err)
+	markers = out.([]syncMarker)
+	require.Len(t, markers, 2)
+	assert.True(t, markers[0].Complete)
+	assert.False(t, markers[1].Complete)
+	assert.NotEmpty(t, markers[1].ChangedAt)
+
+	// So is batches/1 once a file in it is removed
+	o, err := f.NewObject(ctx, "batches/1/a")
+	require.NoError(t, err)
+	_, err = f.db.Exec(`UPDATE files SET synced_at = ? WHERE remote = 'batches/1'`, formatDBTime(time.Now().Add(-time.Hour)))
+	require.NoError(t, err)
+	require.NoError(t, o.Remove(ctx))
+	markers, err = f.syncStatus(ctx, "batches/1", false)
+	require.NoError(t, err)
+	require.Len(t, markers, 1)
+	assert.False(t, markers[0].Complete)
+
+	_, err = f.Command(ctx, "mark-synced", []string{"batches/1", "batches/2"}, map[string]string{"clear": ""})
+	require.NoError(t, err)
+	markers, err = f.syncStatus(ctx, "", true)
+	require.NoError(t, err)
+	assert.Empty(t, markers)
+
+	// A file ingested straight after the mark counts, as does one
+	// removed with hard_delete
+	for _, config := range []configmap.Simple{{}, {"hard_delete": "true"}} {
+		f := newTestFs(t, config)
+		putTestFile(t, f, "b/early.txt", "early")
+		_, err := f.Command(ctx, "mark-synced", []string{"b"}, nil)
+		require.NoError(t, err)
+		if config["hard_delete"] != "" {
+			o, err := f.NewObject(ctx, "b/early.txt")
+			require.NoError(t, err)
+			require.NoError(t, o.Remove(ctx))
+		} else {
+			putTestFile(t, f, "b/late.txt", "late")
+		}
+		markers, err := f.syncStatus(ctx, "b", false)
+		require.NoError(t, err)
+		require.Len(t, markers, 1)
+		assert.False(t, markers[0].Complete, config)
+	}
+}
+
+func TestPruneEmptyDirs(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, nil)
+	putTestFile(t, f, "keep/file", "live")
+	o := putTestFile(t, f, "trash/deep/file", "gone")
+	require.NoError(t, o.Remove(ctx))
+	require.NoError(t, f.Mkdir(ctx, "empty/a/b"))
+	require.NoError(t, f.Mkdir(ctx, "junk"))
+	require.NoError(t, os.WriteFile(filepath.Join(f.opt.RootDirectory, "junk", "other"), nil, 0644))
+
+	// Nothing is removed with --dry-run
+	dryCtx, ci := fs.AddConfig(ctx)
+	ci.DryRun = true
+	pruned, err := f.pruneEmptyDirs(dryCtx, "", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"empty/a/b", "empty/a", "empty", "junk"}, pruned)
+	assert.DirExists(t, filepath.Join(f.opt.RootDirectory, "empty", "a", "b"))
+
+	// Directories of deleted files can be kept
+	out, err := f.Command(ctx, "prune-empty-dirs", nil, map[string]string{"keep-tombstones": ""})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"empty/a/b", "empty/a", "empty"}, out)
+	assert.NoDirExists(t, filepath.Join(f.opt.RootDirectory, "empty"))
+	assert.DirExists(t, filepath.Join(f.opt.RootDirectory, "junk"))
+	assert.DirExists(t, filepath.Join(f.opt.RootDirectory, "trash", "deep"))
+
+	out, err = f.Command(ctx, "prune-empty-dirs", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"trash/deep", "trash"}, out)
+	assert.NoDirExists(t, filepath.Join(f.opt.RootDirectory, "trash"))
+	assert.ElementsMatch(t, []string{"junk", "keep"}, listNames(t, f, ""))
+	var dirs int
+	require.NoError(t, f.db.QueryRow(`SELECT COUNT(*) FROM files WHERE is_dir = 1`).Scan(&dirs))
+	assert.Equal(t, 2, dirs)
+}
+
+func TestContentRouting(t *testing.T) {
+	ctx := context.Background()
+	readAll := func(o fs.Object) (string, error) {
+		in, err := o.Open(ctx)
+		if err != nil {
+			return "", err
+		}
+		data, err := io.ReadAll(in)
+		require.NoError(t, in.Close())
+		return string(data), err
+	}
+	root, nvme, bulk := t.TempDir(), t.TempDir(), t.TempDir()
+	f := newTestFs(t, configmap.Simple{
+		"root_directory":  root,
+		"content_routing": "*.mp4:" + bulk + ",*.json:" + nvme,
+		"tier_max_size":   bulk + ":10B",
+	})
+
+	for _, remote := range []string{"videos/a.mp4", "meta/b.json", "notes/c.txt"} {
+		putTestFile(t, f, remote, "12345678")
+	}
+	assert.FileExists(t, filepath.Join(bulk, "videos", "a.mp4"))
+	assert.FileExists(t, filepath.Join(nvme, "meta", "b.json"))
+	assert.FileExists(t, filepath.Join(root, "notes", "c.txt"))
+	assert.NoFileExists(t, filepath.Join(root, "videos", "a.mp4"))
+
+	o, err := f.NewObject(ctx, "videos/a.mp4")
+	require.NoError(t, err)
+	assert.Equal(t, firstTierDisk, o.(*Object).disk)
+	data, err := readAll(o)
+	require.NoError(t, err)
+	assert.Equal(t, "12345678", data)
+
+	// Going over tier_max_size evicts from that tier only
+	putTestFile(t, f, "videos/d.mp4", "12345678")
+	o, err = f.NewObject(ctx, "videos/a.mp4")
+	require.NoError(t, err)
+	assert.True(t, o.(*Object).evicted)
+	assert.NoFileExists(t, filepath.Join(bulk, "videos", "a.mp4"))
+	assert.FileExists(t, filepath.Join(bulk, "videos", "d.mp4"))
+	assert.FileExists(t, filepath.Join(nvme, "meta", "b.json"))
+
+	tiers, err := f.listTiers(ctx)
+	require.NoError(t, err)
+	require.Len(t, tiers, 3)
+	assert.Equal(t, []string{"*.mp4"}, tiers[1].Patterns)
+	assert.Equal(t, int64(1), tiers[1].Files)
+	assert.Equal(t, int64(10), tiers[1].MaxSize)
+
+	// Content stays readable from tiers no longer routed to
+	f = newTestFs(t, configmap.Simple{"root_directory": root})
+	o, err = f.NewObject(ctx, "meta/b.json")
+	require.NoError(t, err)
+	data, err = readAll(o)
+	require.NoError(t, err)
+	assert.Equal(t, "12345678", data)
+
+	// and the tiers keep their numbers when the rules change
+	f = newTestFs(t, configmap.Simple{"root_directory": root, "content_routing": "*.json:" + nvme})
+	assert.Equal(t, firstTierDisk+1, f.routes[0].disk)
+
+	// A tier over a lowered tier_max_size is brought under it on open
+	f = newTestFs(t, configmap.Simple{"root_directory": root, "content_routing": "*.json:" + nvme, "tier_max_size": nvme + ":4B"})
+	o, err = f.NewObject(ctx, "meta/b.json")
+	require.NoError(t, err)
+	assert.True(t, o.(*Object).evicted)
+	assert.NoFileExists(t, filepath.Join(nvme, "meta", "b.json"))
+
+	regInfo, _ := fs.Find("virtualfs")
+	for _, config := range []configmap.Simple{
+		{"content_routing": "*.mp4"},
+		{"content_routing": "*.mp4:" + bulk, "tier_max_size": nvme + ":1G"},
+		{"content_routing": "*.mp4:" + bulk, "content_layout": "cas"},
+	} {
+		config["root_directory"] = t.TempDir()
+		_, err := NewFs(ctx, "virtualfs", "", fs.ConfigMap(regInfo.Prefix, regInfo.Options, "", config))
+		assert.Error(t, err, config)
+	}
+}
+
+func TestInlineContent(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	f := newTestFs(t, configmap.Simple{"root_directory": root, "inline_max_size": "1K"})
+	readObject := func(f *Fs, remote string) string {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return string(data)
+	}
+	inline := func() (n int) {
+		require.NoError(t, f.db.QueryRow(`SELECT COUNT(*) FROM inline_content`).Scan(&n))
+		return n
+	}
+	big := strings.Repeat("x", 2048)
+
+	putTestFile(t, f, "tiny/a.txt", "small")
+	putTestFile(t, f, "tiny/b.txt", big)
+	assert.NoFileExists(t, filepath.Join(root, "tiny", "a.txt"))
+	assert.FileExists(t, filepath.Join(root, "tiny", "b.txt"))
+	assert.Equal(t, 1, inline())
+	assert.Equal(t, "small", readObject(f, "tiny/a.txt"))
+	assert.Equal(t, big, readObject(f, "tiny/b.txt"))
+
+	// Content moves in and out of the catalog as its size changes
+	putTestFile(t, f, "tiny/a.txt", big)
+	putTestFile(t, f, "tiny/b.txt", "small again")
+	assert.FileExists(t, filepath.Join(root, "tiny", "a.txt"))
+	assert.NoFileExists(t, filepath.Join(root, "tiny", "b.txt"))
+	assert.Equal(t, 1, inline())
+	assert.Equal(t, "small again", readObject(f, "tiny/b.txt"))
+
+	// gc leaves content the catalog refers to and removes the rest
+	_, err := f.db.Exec(`INSERT INTO inline_content (key, data, mod_time) VALUES ('orphan', x'00', '2000-01-01T00:00:00Z')`)
+	require.NoError(t, err)
+	res, err := f.gc(ctx, false, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"orphan"}, res.Orphans)
+	assert.Equal(t, 1, inline())
+
+	// Content stays readable once inline_max_size is turned off
+	f = newTestFs(t, configmap.Simple{"root_directory": root})
+	assert.Equal(t, "small again", readObject(f, "tiny/b.txt"))
+	o, err := f.NewObject(ctx, "tiny/b.txt")
+	require.NoError(t, err)
+	require.NoError(t, o.Remove(ctx))
+	assert.Equal(t, 0, inline())
+	assert.FileExists(t, filepath.Join(root, "tiny", "b.txt"+placeholderSuffix))
+}
+
+func TestServeS3Metadata(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFs(t, configmap.Simple{"evicted_read": "error"})
+
+	// The content type the source gave is kept with --metadata
+	mctx, ci := fs.AddConfig(ctx)
+	ci.Metadata = true
+	modTime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	src := object.NewStaticObjectInfo("bucket/image.bin", modTime, 4, true, nil, nil).WithMetadata(fs.Metadata{"content-type": "image/png"})
+	o, err := f.Put(mctx, strings.NewReader("data"), src)
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", fs.MimeType(ctx, o))
+	o = putTestFile(t, f, "bucket/notes.txt", "hello")
+	assert.Equal(t, "text/plain; charset=utf-8", fs.MimeType(ctx, o))
+
+	// Evicted files are listed with what the catalog knows, without
+	// fetching them
+	o, err = f.NewObject(ctx, "bucket/image.bin")
+	require.NoError(t, err)
+	_, err = o.(*Object).evict(ctx)
+	require.NoError(t, err)
+	entries, err := f.List(ctx, "bucket")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	o, err = f.NewObject(ctx, "bucket/image.bin")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), o.Size())
+	assert.True(t, modTime.Equal(o.ModTime(ctx)))
+	md5, err := o.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	assert.Equal(t, "8d777f385d3dfec8815d20f7496026dc", md5)
+	_, err = o.Open(ctx)
+	assert.ErrorIs(t, err, errNoContent)
+}
+
+func TestRewrite(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	f := newTestFs(t, configmap.Simple{"root_directory": root})
+	readObject := func(remote string) string {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		defer func() { _ = in.Close() }()
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		return string(data)
+	}
+	putTestFile(t, f, "old-prefix/a.txt", "aaa")
+	putTestFile(t, f, "old-prefix/sub/b.txt", "bb")
+	putTestFile(t, f, "other/old-prefix/c.txt", "c")
+	_, err := f.Command(ctx, "tag", []string{"old-prefix/a.txt", "invoices"}, nil)
+	require.NoError(t, err)
+	res, err := f.changes(ctx, "0", 100)
+	require.NoError(t, err)
+	since := strconv.FormatInt(res.Last, 10)
+
+	// Nothing changes with --dry-run
+	dctx, ci := fs.AddConfig(ctx)
+	ci.DryRun = true
+	opt := map[string]string{"match": "^old-prefix/", "replace": "new-prefix/"}
+	out, err := f.Command(dctx, "rewrite", nil, opt)
+	require.NoError(t, err)
+	assert.Equal(t, []rewriteEntry{
+		{From: "old-prefix/a.txt", To: "new-prefix/a.txt"},
+		{From: "old-prefix/sub", To: "new-prefix/sub"},
+		{From: "old-prefix/sub/b.txt", To: "new-prefix/sub/b.txt"},
+	}, out)
+	assert.FileExists(t, filepath.Join(root, "old-prefix", "a.txt"))
+
+	_, err = f.Command(ctx, "rewrite", nil, opt)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"new-prefix", "old-prefix", "other"}, listNames(t, f, ""))
+	assert.Equal(t, []string{"new-prefix/a.txt", "new-prefix/sub"}, listNames(t, f, "new-prefix"))
+	assert.Equal(t, "aaa", readObject("new-prefix/a.txt"))
+	assert.Equal(t, "bb", readObject("new-prefix/sub/b.txt"))
+	assert.Equal(t, "c", readObject("other/old-prefix/c.txt"))
+	assert.FileExists(t, filepath.Join(root, "new-prefix", "sub", "b.txt"))
+	assert.NoDirExists(t, filepath.Join(root, "old-prefix", "sub"))
+	_, err = f.NewObject(ctx, "old-prefix/a.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+
+	// The tags go with the file and the journal has the rename
+	var tags int
+	require.NoError(t, f.db.QueryRow(`SELECT COUNT(*) FROM tags WHERE remote = 'new-prefix/a.txt'`).Scan(&tags))
+	assert.Equal(t, 1, tags)
+	res, err = f.changes(ctx, since, 100)
+	require.NoError(t, err)
+	var events []string
+	for _, change := range res.Changes {
+		events = append(events, change.Event+" "+change.Path)
+	}
+	assert.Equal(t, []string{
+		"delete old-prefix/a.txt", "rename new-prefix/a.txt",
+		"delete old-prefix/sub/b.txt", "rename new-prefix/sub/b.txt",
+	}, events)
+
+	// Clashes and bad paths rename nothing
+	_, err = f.Command(ctx, "rewrite", nil, map[string]string{"match": "^other/old-prefix/c", "replace": "new-prefix/a"})
+	assert.ErrorContains(t, err, "already in the catalog")
+	_, err = f.Command(ctx, "rewrite", nil, map[string]string{"match": "^new-prefix/.*$", "replace": "same"})
+	assert.ErrorContains(t, err, "can't rewrite both")
+	_, err = f.Command(ctx, "rewrite", nil, map[string]string{"match": "^new-prefix", "replace": "../up"})
+	assert.ErrorContains(t, err, "isn't clean")
+	assert.Equal(t, "aaa", readObject("new-prefix/a.txt"))
+	assert.Equal(t, "c", readObject("other/old-prefix/c.txt"))
+	_, err = f.Command(ctx, "rewrite", nil, map[string]string{"match": "("})
+	assert.ErrorContains(t, err, "invalid match")
+	_, err = f.Command(ctx, "rewrite", nil, map[string]string{"match": "^new-prefix(/sub)?$", "replace": "x"})
+	assert.ErrorContains(t, err, "as its directory is rewritten")
+
+	// Renaming a directory takes everything in it along
+	out, err = f.Command(ctx, "rewrite", nil, map[string]string{"match": "^new-prefix$", "replace": "moved"})
+	require.NoError(t, err)
+	assert.Equal(t, []rewriteEntry{
+		{From: "new-prefix", To: "moved"},
+		{From: "new-prefix/a.txt", To: "moved/a.txt"},
+		{From: "new-prefix/sub", To: "moved/sub"},
+		{From: "new-prefix/sub/b.txt", To: "moved/sub/b.txt"},
+	}, out)
+	assert.ElementsMatch(t, []string{"moved", "old-prefix", "other"}, listNames(t, f, ""))
+	assert.Equal(t, []string{"moved/sub/b.txt"}, listNames(t, f, "moved/sub"))
+	assert.Equal(t, "bb", readObject("moved/sub/b.txt"))
+	assert.FileExists(t, filepath.Join(root, "moved", "sub", "b.txt"))
+	assert.NoDirExists(t, filepath.Join(root, "new-prefix"))
+}
@@ -0,0 +1,29 @@
+// Test VirtualFS filesystem interface
+package virtualfs_test
+
+import (
+	"testing"
+
+	"github.com/rclone/rclone/backend/virtualfs"
+	"github.com/rclone/rclone/fstest"
+	"github.com/rclone/rclone/fstest/fstests"
+)
+
+// TestIntegration runs integration tests against the remote
+func TestIntegration(t *testing.T) {
+	if *fstest.RemoteName != "" {
+		t.Skip("Skipping as -remote set")
+	}
+	name := "TestVirtualFS"
+	fstests.Run(t, &fstests.Opt{
+		RemoteName: name + ":",
+		ExtraConfig: []fstests.ExtraConfigItem{
+			{Name: name, Key: "type", Value: "virtualfs"},
+			{Name: name, Key: "root_directory", Value: t.TempDir()},
+			// Files are put again with the same size and modification time
+			{Name: name, Key: "ingest_compare", Value: "size+modtime+hash"},
+		},
+		NilObject:   (*virtualfs.Object)(nil),
+		QuickTestOK: true,
+	})
+}
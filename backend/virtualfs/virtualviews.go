@@ -0,0 +1,109 @@
+package virtualfs
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// The synthetic directories listing slices of the catalog
+const (
+	byStateDir = ".by-state" // files by processing status
+	byTagDir   = ".by-tag"   // files by tag
+)
+
+// errInView is returned when trying to change a file in a virtual view
+var errInView = errors.New("files in a virtual view can't be changed")
+
+// showViews returns true if the virtual views are shown, which they
+// are only at the top of the catalog
+func (f *Fs) showViews() bool {
+	return f.opt.VirtualViews && f.root == ""
+}
+
+// viewPath splits remote, if it is in one of the virtual views, into
+// the view, the status or tag it selects, "" for the view itself, and
+// the catalog path below that
+func (f *Fs) viewPath(remote string) (top, key, rest string, ok bool) {
+	if !f.showViews() {
+		return "", "", "", false
+	}
+	top, below, _ := strings.Cut(remote, "/")
+	if top != byStateDir && top != byTagDir {
+		return "", "", "", false
+	}
+	key, rest, _ = strings.Cut(below, "/")
+	return top, key, rest, true
+}
+
+// viewKeys returns the directories of the view top: every status, or
+// the tags of the live files
+func (f *Fs) viewKeys(ctx context.Context, top string) ([]string, error) {
+	if top == byStateDir {
+		keys := make([]string, 0, len(statusFrom))
+		for status := range statusFrom {
+			keys = append(keys, status)
+		}
+		sort.Strings(keys)
+		return keys, nil
+	}
+	return f.queryRemotes(ctx, `SELECT DISTINCT tag FROM tags WHERE remote IN (SELECT remote FROM files WHERE deleted = 0) ORDER BY tag`)
+}
+
+// viewCondition returns the SQL condition selecting the live files in
+// the view top of key
+func viewCondition(top, key string) (string, []interface{}) {
+	if top == byStateDir {
+		return `deleted = 0 AND is_dir = 0 AND status = ?`, []interface{}{key}
+	}
+	return `deleted = 0 AND is_dir = 0 AND remote IN (SELECT remote FROM tags WHERE tag = ?)`, []interface{}{key}
+}
+
+// listView lists dir of the slice of the catalog in the view top
+// selected by key, or the slices themselves if key is ""
+func (f *Fs) listView(ctx context.Context, top, key, dir string) (entries fs.DirEntries, err error) {
+	if key == "" {
+		keys, err := f.viewKeys(ctx, top)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			entries = append(entries, fs.NewDir(path.Join(top, k), time.Time{}))
+		}
+		return entries, nil
+	}
+	if top == byStateDir && statusFrom[key] == nil {
+		return nil, fs.ErrorDirNotFound
+	}
+	cond, args := viewCondition(top, key)
+	entries, err = f.listSelected(ctx, path.Join(top, key), dir, cond, args...)
+	if err == nil && top == byTagDir && len(entries) == 0 {
+		// A tag only exists while a file has it
+		return nil, fs.ErrorDirNotFound
+	}
+	return entries, err
+}
+
+// newViewObject finds the file at the catalog path remote in the
+// slice of the view top selected by key
+func (f *Fs) newViewObject(ctx context.Context, top, key, remote string) (fs.Object, error) {
+	if key == "" || remote == "" {
+		return nil, fs.ErrorObjectNotFound
+	}
+	cond, args := viewCondition(top, key)
+	objects, err := f.queryObjects(ctx, `SELECT `+objectColumns+` FROM files WHERE remote = ? AND `+cond, append([]interface{}{remote}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 || f.hideEvicted(objects[0]) || f.hideCorrupt(objects[0]) {
+		return nil, fs.ErrorObjectNotFound
+	}
+	o := objects[0]
+	o.view = path.Join(top, key)
+	return o, nil
+}
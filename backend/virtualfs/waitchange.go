@@ -0,0 +1,120 @@
+package virtualfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// defaultWaitPoll is how often wait-for-change looks at the journal if
+// not told otherwise
+const defaultWaitPoll = time.Second
+
+// errWaitTimeout is returned by wait-for-change when nothing changes in
+// time
+var errWaitTimeout = errors.New("timed out waiting for a change")
+
+// waitQuery selects the changes wait-for-change waits for
+type waitQuery struct {
+	since   int64            // changes after this journal sequence number
+	dir     string           // changes at or below this directory, if set
+	include []*regexp.Regexp // changes to paths matching one of these, if set
+	poll    time.Duration    // how often to look
+	timeout time.Duration    // how long to wait, forever if 0
+}
+
+// waitForChange blocks until files matching q are created or updated,
+// by this or any other process sharing the catalog, returning those
+// changes. Last in the result is where to carry on waiting from.
+func (f *Fs) waitForChange(ctx context.Context, q waitQuery) (*changesResult, error) {
+	if q.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.timeout)
+		defer cancel()
+	}
+	ticker := time.NewTicker(q.poll)
+	defer ticker.Stop()
+	since := q.since
+	for {
+		res, err := f.changes(ctx, strconv.FormatInt(since, 10), defaultChangesLimit)
+		if err != nil && ctx.Err() == nil {
+			return nil, err
+		}
+		if err == nil {
+			since = res.Last
+			found := res.Changes[:0]
+			for _, change := range res.Changes {
+				if q.matches(change) {
+					found = append(found, change)
+				}
+			}
+			if len(found) > 0 {
+				return &changesResult{Changes: found, Last: res.Last, More: res.More}, nil
+			}
+			if res.More {
+				continue
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if q.timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, errWaitTimeout
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// matches returns true if change is one wait-for-change is waiting for
+func (q *waitQuery) matches(change changeEntry) bool {
+	if change.Event != eventCreate && change.Event != eventUpdate && change.Event != eventRename {
+		return false
+	}
+	if q.dir != "" && change.Path != q.dir && !strings.HasPrefix(change.Path, q.dir+"/") {
+		return false
+	}
+	return len(q.include) == 0 || matchAny(q.include, change.Path)
+}
+
+// parseWaitQuery reads the options of the wait-for-change command
+func (f *Fs) parseWaitQuery(ctx context.Context, arg []string, opt map[string]string) (q waitQuery, err error) {
+	q.poll = defaultWaitPoll
+	if len(arg) > 1 {
+		return q, errors.New("wait-for-change takes at most one directory argument")
+	}
+	if len(arg) == 1 {
+		q.dir = strings.Trim(arg[0], "/")
+	}
+	if v, ok := opt["include"]; ok {
+		q.include, err = parseGlobs("include", fs.CommaSepList(strings.Split(v, ",")))
+		if err != nil {
+			return q, err
+		}
+	}
+	for name, d := range map[string]*time.Duration{"poll": &q.poll, "timeout": &q.timeout} {
+		if v, ok := opt[name]; ok {
+			var value fs.Duration
+			if err = value.Set(v); err != nil || value < 0 || (name == "poll" && value == 0) {
+				return q, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*d = time.Duration(value)
+		}
+	}
+	if v, ok := opt["since"]; ok {
+		q.since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("invalid since %q: need a sequence number", v)
+		}
+		return q, nil
+	}
+	// Only changes from now on
+	err = f.rdb.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM journal`).Scan(&q.since)
+	return q, err
+}
@@ -0,0 +1,115 @@
+package virtualfs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultWarmConcurrency is how many files the warm command fetches at
+// once if not told otherwise
+const defaultWarmConcurrency = 4
+
+// warmProgressInterval is how often the warm command logs how far it
+// has got
+const warmProgressInterval = 10 * time.Second
+
+// warmResult is returned by the warm command
+type warmResult struct {
+	Fetched int               `json:"fetched"` // files whose content was fetched
+	Bytes   int64             `json:"bytes"`   // the size of those files
+	Skipped int               `json:"skipped"` // files over cache_max_size, which are never kept
+	Failed  map[string]string `json:"failed"`  // the error for each file which couldn't be fetched
+}
+
+// warm fetches the content of the evicted files matching q from the
+// origin_remote, concurrency at a time, so reading them later doesn't
+// wait for it
+func (f *Fs) warm(ctx context.Context, q searchQuery, concurrency int) (*warmResult, error) {
+	if err := f.checkWritable(); err != nil {
+		return nil, err
+	}
+	if f.opt.OriginRemote == "" {
+		return nil, errors.New("warm needs an origin_remote to fetch content from")
+	}
+	if !f.opt.StoreContent {
+		return nil, errors.New("can't warm with store_content off as content isn't kept")
+	}
+	q.evicted = true
+	objects, _, err := f.searchObjects(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, o := range objects {
+		total += o.size
+	}
+	fs.Infof(nil, "VirtualFS: Warming %d evicted files of %v", len(objects), fs.SizeSuffix(total))
+
+	res := &warmResult{Failed: map[string]string{}}
+	var mu sync.Mutex
+	done, lastLog := 0, time.Now()
+	g := errgroup.Group{}
+	g.SetLimit(max(concurrency, 1))
+	for _, o := range objects {
+		if ctx.Err() != nil {
+			break
+		}
+		o := o
+		g.Go(func() error {
+			fetched, err := f.warmObject(ctx, o)
+			mu.Lock()
+			defer mu.Unlock()
+			done++
+			switch {
+			case err != nil:
+				fs.Errorf(nil, "VirtualFS: Failed to warm %s: %v", o.remote, err)
+				res.Failed[o.remote] = err.Error()
+			case fetched:
+				res.Fetched++
+				res.Bytes += o.size
+			default:
+				res.Skipped++
+			}
+			if time.Since(lastLog) >= warmProgressInterval {
+				fs.Infof(nil, "VirtualFS: Warmed %d of %d files, %v of %v", done, len(objects), fs.SizeSuffix(res.Bytes), fs.SizeSuffix(total))
+				lastLog = time.Now()
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fs.Infof(nil, "VirtualFS: Warmed %d files, %v, skipped %d and failed on %d", res.Fetched, fs.SizeSuffix(res.Bytes), res.Skipped, len(res.Failed))
+	return res, nil
+}
+
+// warmObject fetches the content of o from the origin_remote, returning
+// false if it is too big to keep
+func (f *Fs) warmObject(ctx context.Context, o *Object) (fetched bool, err error) {
+	if f.uncached(o.size) {
+		fs.Debugf(nil, "VirtualFS: Not warming %s as it is over cache_max_size", o.remote)
+		return false, nil
+	}
+	tr := accounting.Stats(ctx).NewTransferRemoteSize(o.remote, o.size, nil, f)
+	defer func() {
+		tr.Done(ctx, err)
+	}()
+	_, err = o.fetchFromOrigin(ctx, tr)
+	if errors.Is(err, errContentChanged) {
+		// Replaced while being fetched, so what is there now is new
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	f.logOp(nil, "VirtualFS: Warmed %s", o.remote)
+	return true, nil
+}
@@ -0,0 +1,99 @@
+package virtualfs
+
+import (
+	"strings"
+
+	"github.com/rclone/rclone/lib/encoder"
+)
+
+// windowsQuote is put in front of store names which Windows reserves
+// for devices. It is the quote character the encoder uses.
+const windowsQuote = "‛"
+
+// windowsDevices are the names Windows reserves, with or without an
+// extension
+var windowsDevices = map[string]struct{}{}
+
+func init() {
+	for _, name := range []string{"CON", "PRN", "AUX", "NUL"} {
+		windowsDevices[name] = struct{}{}
+	}
+	for _, prefix := range []string{"COM", "LPT"} {
+		for i := '1'; i <= '9'; i++ {
+			windowsDevices[prefix+string(i)] = struct{}{}
+		}
+	}
+}
+
+// isWindowsDevice returns true if name, ignoring any windowsQuote in
+// front of it, is reserved by Windows
+func isWindowsDevice(name string) bool {
+	for strings.HasPrefix(name, windowsQuote) {
+		name = name[len(windowsQuote):]
+	}
+	base, _, _ := strings.Cut(name, ".")
+	_, ok := windowsDevices[strings.ToUpper(strings.TrimRight(base, " "))]
+	return ok
+}
+
+// escapeWindowsName quotes name if Windows reserves it. Names which
+// would unquote to a reserved name are quoted again so every name
+// round trips.
+func escapeWindowsName(name string) string {
+	if isWindowsDevice(name) {
+		return windowsQuote + name
+	}
+	return name
+}
+
+// unescapeWindowsName reverses escapeWindowsName
+func unescapeWindowsName(name string) string {
+	if strings.HasPrefix(name, windowsQuote) && isWindowsDevice(name) {
+		return name[len(windowsQuote):]
+	}
+	return name
+}
+
+// storeEncoder returns the encoder for names in the store, adding the
+// encodings of the trailing characters Windows strips if windows_names
+// is set
+func storeEncoder(opt *Options) encoder.MultiEncoder {
+	if opt.WindowsNames {
+		return opt.Enc | encoder.EncodeRightPeriod | encoder.EncodeRightSpace
+	}
+	return opt.Enc
+}
+
+// storePath returns the path in the store of the file or directory
+// remote when it is stored under its own name
+func (f *Fs) storePath(remote string) string {
+	return f.shortenPath(f.encodePath(remote))
+}
+
+// encodePath encodes remote for the store without shortening any
+// overlong names
+func (f *Fs) encodePath(remote string) string {
+	p := f.enc.FromStandardPath(remote)
+	if !f.opt.WindowsNames {
+		return p
+	}
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = escapeWindowsName(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// storeRemote reverses encodePath, returning the remote stored at the
+// path p in the store. Names stood in for by shortenPath can't be
+// reversed, so content with those always has its path in the catalog.
+func (f *Fs) storeRemote(p string) string {
+	if f.opt.WindowsNames {
+		parts := strings.Split(p, "/")
+		for i, part := range parts {
+			parts[i] = unescapeWindowsName(part)
+		}
+		p = strings.Join(parts, "/")
+	}
+	return f.enc.ToStandardPath(p)
+}
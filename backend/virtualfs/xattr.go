@@ -0,0 +1,28 @@
+//go:build !openbsd && !plan9
+
+package virtualfs
+
+import (
+	"fmt"
+
+	"github.com/pkg/xattr"
+	"github.com/rclone/rclone/fs"
+)
+
+// xattrPrefix is the namespace xattrs are set in, as the local backend
+// reads them from
+const xattrPrefix = "user."
+
+// setXattrs sets the xattrs in metadata on the file at p
+func setXattrs(p string, metadata fs.Metadata) error {
+	if !xattr.XATTR_SUPPORTED {
+		return nil
+	}
+	for k, v := range metadata {
+		err := xattr.Set(p, xattrPrefix+k, []byte(v))
+		if err != nil {
+			return fmt.Errorf("failed to set xattr key %q: %w", k, err)
+		}
+	}
+	return nil
+}
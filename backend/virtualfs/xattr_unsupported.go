@@ -0,0 +1,12 @@
+// The pkg/xattr module doesn't compile for openbsd or plan9
+
+//go:build openbsd || plan9
+
+package virtualfs
+
+import "github.com/rclone/rclone/fs"
+
+// setXattrs sets the xattrs in metadata on the file at p
+func setXattrs(p string, metadata fs.Metadata) error {
+	return nil
+}
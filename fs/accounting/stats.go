@@ -136,9 +136,33 @@ func (s *StatsInfo) RemoteStats() (out rc.Params, err error) {
 		out["lastError"] = s.lastError.Error()
 	}
 
+	statsExtrasMu.Lock()
+	for key, fn := range statsExtras {
+		if v := fn(); v != nil {
+			out[key] = v
+		}
+	}
+	statsExtrasMu.Unlock()
+
 	return out, nil
 }
 
+var (
+	statsExtrasMu sync.Mutex
+	statsExtras   = map[string]func() interface{}{}
+)
+
+// AddStatsExtra adds what fn returns to the stats returned by
+// RemoteStats under key, calling it each time they are read. Nothing
+// is added if fn returns nil.
+//
+// This is for backends to report their own counters in core/stats.
+func AddStatsExtra(key string, fn func() interface{}) {
+	statsExtrasMu.Lock()
+	defer statsExtrasMu.Unlock()
+	statsExtras[key] = fn
+}
+
 // _speed returns the average speed of the transfer in bytes/second
 //
 // Call with lock held
@@ -121,6 +121,7 @@ Returns the following values:
 }
 ` + "```" + `
 Values for "transferring", "checking" and "lastError" are only assigned if data is available.
+Backends may add values of their own, such as "virtualfs", once they have been used.
 The value for "eta" is null if an eta cannot be determined.
 `,
 	})